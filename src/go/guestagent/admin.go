@@ -0,0 +1,32 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/admin"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+)
+
+// adminSubsystem serves the admin API of the state on -adminSocket.
+func adminSubsystem(state admin.State) subsystem {
+	return subsystem{name: "admin", flags: []string{"adminSocket"}, run: func(ctx context.Context) error {
+		// The path is checked by checkAddrFlags, and by checkReloadedFlags.
+		socketPath, _ := config.SocketPath(*adminSocket)
+
+		// The server ends its streams once it shuts down, it is created again with every restart.
+		return admin.NewServer(state).ListenAndServe(ctx, socketPath)
+	}}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/admin"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/conflict"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/exitcode"
+)
+
+// detectConflicts detects the other agents and legacy port forwarding
+// processes, which the PID file does not keep from running, and refuses to
+// start with -onConflict=refuse, or warns about each of them otherwise. It
+// returns the processes for the status, and the marker that this agent
+// holds until it stops, which is nil when another process holds it.
+func detectConflicts() ([]conflict.Process, io.Closer, error) {
+	if !slices.Contains(conflict.Actions, *onConflict) {
+		return nil, nil, fmt.Errorf("%w: invalid -onConflict %q, valid options are %s",
+			exitcode.ErrConfig, *onConflict, strings.Join(conflict.Actions, ", "))
+	}
+
+	// Another agent usually serves the default socket, whether this one serves one or not.
+	adminSocketPath := admin.DefaultSocket
+	if *adminSocket != "" {
+		adminSocketPath, _ = config.SocketPath(*adminSocket)
+	}
+
+	names := conflict.DefaultNames
+	if executable, err := os.Executable(); err == nil && !slices.Contains(names, filepath.Base(executable)) {
+		names = append(slices.Clone(names), filepath.Base(executable))
+	}
+
+	processes := conflict.Detector{
+		Marker:      conflict.DefaultMarker,
+		AdminSocket: adminSocketPath,
+		ProcDir:     conflict.DefaultProcDir,
+		Names:       names,
+	}.Detect()
+
+	if len(processes) != 0 && *onConflict == conflict.ActionRefuse {
+		return nil, nil, fmt.Errorf("%w: %s", conflict.ErrConflict, processes[0])
+	}
+
+	for _, process := range processes {
+		log.Warnf("%v, the port mappings may be registered twice and the listeners fought over: %s",
+			conflict.ErrConflict, process)
+	}
+
+	marker, err := conflict.Mark(conflict.DefaultMarker)
+	if errors.Is(err, conflict.ErrConflict) {
+		return processes, nil, nil
+	}
+
+	if err != nil {
+		log.Debugf("not holding the marker of the agent: %v", err)
+
+		return processes, nil, nil
+	}
+
+	return processes, marker, nil
+}
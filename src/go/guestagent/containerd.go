@@ -0,0 +1,56 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/containerd"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/engine"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// containerdSubsystem monitors the events of containerd at -containerdSock,
+// and reports the ports of its containers to the coordinator.
+func containerdSubsystem(coordinator *tracker.Coordinator) subsystem {
+	// The waiter is kept across the restarts, so that it only gives up once.
+	waiter := engine.NewWaiter(containerdSocketFile, socketInterval, socketRetryTimeout)
+
+	return subsystem{name: "containerd", flags: []string{"containerdSock"}, run: func(ctx context.Context) error {
+		eventMonitor, err := containerd.NewEventMonitor(*containerdSock, coordinator, *enablePrivilegedService)
+		if err != nil {
+			return fmt.Errorf("error initializing containerd event monitor: %w", err)
+		}
+		if *dryRun {
+			eventMonitor.EnableDryRun()
+		}
+		if err := waiter.Wait(ctx, eventMonitor.IsServing); err != nil {
+			eventMonitor.Close()
+
+			return err
+		}
+		eventMonitor.MonitorPorts(ctx)
+
+		// At shutdown, the port mappings are withdrawn once all the sources stopped.
+		if ctx.Err() == nil {
+			if err := eventMonitor.Flush(ctx); err != nil {
+				log.Error(err)
+			}
+		}
+
+		return eventMonitor.Close()
+	}}
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/diagnostics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// diagnosticsState returns the state that the diagnostics and the summaries
+// are collected from, with the effective configuration of config.
+func diagnosticsState(
+	f *forwarding,
+	obs *observers,
+	subsystems *supervisor.Supervisor,
+	config func() map[string]string,
+	logger *logging.Logger,
+) diagnostics.State {
+	state := diagnostics.State{
+		Config:       config,
+		Subsystems:   subsystems.Status,
+		Ports:        f.portTracker.List,
+		Listeners:    f.listenerTracker.Listeners,
+		Forwarder:    f.metricsForwarder.Metrics,
+		RecentErrors: logger.RecentErrors,
+		ErrorCount:   logger.ErrorCount,
+		Latencies: func() []tracker.Latency {
+			return obs.latencies.Worst(worstLatencies)
+		},
+		Changes:         f.portChanges.Counts,
+		ListenerOrigins: f.listenerTracker.ListenerOrigins,
+		Compatibility:   f.compatibility,
+	}
+	if f.network != nil && f.network.profile != "" {
+		state.ForwardingProfile = func() string {
+			return f.network.profile
+		}
+	}
+
+	return state
+}
@@ -0,0 +1,71 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/docker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/engine"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/loopback"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/recording"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// dockerSubsystem monitors the events of the docker engine, and reports the
+// ports of its containers to the tracker; the containers of the labeled
+// networks are relayed at the addresses of relayAddrs, unless it is nil.
+func dockerSubsystem(portTracker tracker.Tracker, relayAddrs func() []netip.Addr, recorder *recording.Recorder) subsystem {
+	// The waiter is kept across the restarts, so that it only gives up once.
+	waiter := engine.NewWaiter(dockerSocketFile, socketInterval, *dockerWaitTimeout)
+
+	return subsystem{name: "docker", flags: []string{"dockerKubernetesContainers"}, run: func(ctx context.Context) error {
+		eventMonitor, err := docker.NewEventMonitor(portTracker)
+		if err != nil {
+			return fmt.Errorf("error initializing docker event monitor: %w", err)
+		}
+		if *dryRun {
+			eventMonitor.EnableDryRun()
+		}
+		if *dockerKubernetesContainers {
+			eventMonitor.ForwardKubernetesContainers()
+		}
+		// The containers of the labeled networks are relayed at the addresses
+		// that the host reaches the VM at, which the API forwarder has none of.
+		if relayAddrs != nil {
+			eventMonitor.ForwardLabeledNetworks(func(ctx context.Context, target netip.AddrPort) (io.Closer, error) {
+				return loopback.Relay(ctx, relayAddrs(), target)
+			})
+		}
+		eventMonitor.SetRecorder(recorder)
+		if err := waiter.Wait(ctx, eventMonitor.Info); err != nil {
+			tracker.InitialPassDone(ctx, err)
+
+			return err
+		}
+		eventMonitor.MonitorPorts(ctx)
+
+		// At shutdown, the port mappings are withdrawn once all the sources stopped.
+		if ctx.Err() == nil {
+			eventMonitor.Flush(ctx)
+		} else {
+			eventMonitor.Close()
+		}
+
+		return nil
+	}}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/docker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/iptables"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/kube"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// driftSources returns the enabled subsystems that the drift checker lists,
+// like onceSources; the port mappings and the listeners that the filter
+// leaves out are not missing. The Kubernetes services are listeners in the
+// listener only mode, and port mappings otherwise.
+func driftSources(
+	portTracker tracker.Tracker,
+	filterTracker *tracker.FilterTracker,
+	listenerTracker *tracker.ListenerTracker,
+) []tracker.DriftSource {
+	var sources []tracker.DriftSource
+
+	if *enableIptables {
+		source := tracker.ListenerDriftSource(portTracker, listenerTracker, tracker.SourceIptables, tracker.OriginRule,
+			func(ctx context.Context) (map[string]nat.PortMap, error) {
+				return iptables.ListPorts(ctx, scanNamespace(), forwardedChains())
+			})
+		source.Requested = filterTracker.RequestedListener
+		sources = append(sources, source)
+	}
+
+	if *enableDocker {
+		source := tracker.EntryDriftSource(portTracker, tracker.SourceDocker,
+			func(ctx context.Context) (map[string]nat.PortMap, error) {
+				return docker.ListRunning(ctx, *dockerKubernetesContainers)
+			}, docker.ContainerID)
+		source.Requested = filterTracker.Requested
+		sources = append(sources, source)
+	}
+
+	if *enableKubernetes {
+		// -k8sServiceListenerAddr is checked by checkAddrFlags.
+		ip := net.ParseIP(*k8sServiceListenerAddr)
+
+		if listenerOnlyMode() {
+			source := tracker.ListenerDriftSource(portTracker, listenerTracker, tracker.SourceKubernetes, tracker.OriginService,
+				func(ctx context.Context) (map[string]nat.PortMap, error) {
+					return kube.ListServices(ctx, *configPath, ip)
+				})
+			source.Requested = filterTracker.RequestedListener
+			sources = append(sources, source)
+		} else {
+			source := tracker.EntryDriftSource(portTracker, tracker.SourceKubernetes,
+				func(ctx context.Context) (map[string]nat.PortMap, error) {
+					return kube.ListServiceUIDs(ctx, *configPath, ip)
+				}, nil)
+			source.Requested = filterTracker.Requested
+			sources = append(sources, source)
+		}
+	}
+
+	return sources
+}
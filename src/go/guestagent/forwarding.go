@@ -0,0 +1,620 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/exitcode"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/platform"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/resume"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/wsl"
+)
+
+// forwarding is the forwarder of the port mappings to the host, and the
+// trackers in front of it, see newForwarding.
+type forwarding struct {
+	// selection is the forwarder and how it was selected, see selectForwarder.
+	selection        forwarder.Selection
+	metricsForwarder *forwarder.MetricsForwarder
+	// portTracker is the tracker that the sources report the port mappings to.
+	portTracker     tracker.Tracker
+	coordinator     *tracker.Coordinator
+	metricsTracker  *tracker.MetricsTracker
+	filterTracker   *tracker.FilterTracker
+	listenerTracker *tracker.ListenerTracker
+	// portChanges counts the changes in the trackers that decide their outcomes.
+	portChanges *tracker.ChangeCounter
+	// lastContact returns when the forwarder last reached its peer, for the readiness;
+	// it is nil for the forwarders that do not keep track of it.
+	lastContact func() time.Time
+	// network is the network that the port mappings are reached at, for the
+	// startup summary; it is nil for the forwarders that do not send it.
+	network *networkSummary
+	// reservedPorts reports the host ports that are reserved on the host,
+	// it is nil for the forwarders whose peer does not report them.
+	reservedPorts reservedPortsForwarder
+	// compatibility returns how the agent works with the peer, for the status
+	// and the diagnostics; it is nil for the forwarders that do not negotiate.
+	compatibility func() *forwarder.Compatibility
+	// relayAddrs returns the addresses that the host reaches the VM at, which
+	// -forwardLoopback relays the ports at; it is nil for the API forwarder.
+	relayAddrs func() []netip.Addr
+	// startupHolder holds the port mappings of the startup batch, see
+	// tracker.StartupBatch; it is nil for the API forwarder.
+	startupHolder tracker.Holder
+	// breaker stops sending to the peer while it is unreachable, for the
+	// readiness and the status; it is nil for the API forwarder.
+	breaker *forwarder.BreakerForwarder
+}
+
+// newForwarding creates the forwarder that -forwarder selects and the
+// trackers in front of it, the ones of the peer forwarders start the
+// periodic tasks that keep the peer up to date.
+func newForwarding(
+	ctx context.Context,
+	periodic *loops,
+	currentPlatform string,
+	natSubnets []netip.Prefix,
+	logger *logging.Logger,
+	hostLogs *logging.Shipper,
+) (*forwarding, error) {
+	f := &forwarding{selection: selectForwarder(ctx)}
+	forwarderKind := f.selection.Kind
+
+	// The addresses are checked before anything is started, rather than when they are first used.
+	if err := checkAddrFlags(forwarderKind); err != nil {
+		return nil, err
+	}
+
+	// The API forwarder does not tell the addresses that the host reaches the VM at.
+	if *forwardLoopback && forwarderKind == forwarder.KindAPI {
+		return nil, fmt.Errorf("%w: -forwardLoopback is not supported with -forwarder=%s", exitcode.ErrConfig, forwarderKind)
+	}
+
+	forwarderOptions.VTunnel.Capabilities = agentCapabilities()
+
+	var err error
+
+	f.metricsForwarder, err = forwarder.NewFromConfig(forwarderKind, *vtunnelAddr, forwarderOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the port mappings forwarder: %w", err)
+	}
+
+	// The host-switch serves the same API as the port forwarding API of the gateway.
+	if hostSwitch, ok := f.metricsForwarder.Unwrap().(*forwarder.HostSwitchForwarder); ok {
+		hostSwitch.SetTimeout(*apiTimeout)
+	}
+
+	// The changes are counted by the trackers that decide their outcomes.
+	f.portChanges = tracker.NewChangeCounter()
+
+	switch forwarderKind {
+	case forwarder.KindAPI:
+		err = f.setupAPI(ctx)
+	default:
+		hostForwarder, ok := f.metricsForwarder.Unwrap().(peerForwarder)
+		if !ok {
+			return nil, fmt.Errorf("%w: the %s forwarder does not send the port mappings to a peer", exitcode.ErrConfig, forwarderKind)
+		}
+
+		err = f.setupPeer(ctx, hostForwarder, periodic, currentPlatform, natSubnets, logger, hostLogs)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if *dryRun {
+		f.listenerTracker.EnableDryRun()
+	}
+
+	// The forwarder keeps reaching the host from the network namespace of the agent.
+	if namespace := scanNamespace(); namespace != nil {
+		if err := namespace.Check(); err != nil {
+			log.Warnf("the network namespace of -netns does not exist yet, the iptables scanning waits for it: %v", err)
+		}
+
+		f.listenerTracker.SetNamespace(namespace)
+	}
+
+	if f.filterTracker, err = wrapTracker(f.portTracker); err != nil {
+		return nil, err
+	}
+
+	f.filterTracker.SetChangeCounter(f.portChanges)
+
+	if f.reservedPorts != nil {
+		skipReservedPorts(ctx, f.reservedPorts, f.filterTracker)
+	}
+
+	f.metricsTracker = tracker.NewMetricsTracker(f.filterTracker)
+	f.coordinator = tracker.NewCoordinator(f.metricsTracker)
+	f.portTracker = f.coordinator
+
+	return f, nil
+}
+
+// setupAPI creates the tracker of the API forwarder, which also sends the
+// port of the Kubernetes API to wsl-proxy.
+func (f *forwarding) setupAPI(ctx context.Context) error {
+	apiTracker := tracker.NewAPITracker(f.metricsForwarder, *apiBaseURL, *adminInstall)
+	apiTracker.SetTimeout(*apiTimeout)
+	apiTracker.SetChangeCounter(f.portChanges)
+	f.portTracker = apiTracker
+	f.listenerTracker = apiTracker.ListenerTracker
+
+	// Manually register the port for K8s API, we would
+	// only want to send this manual port mapping if both
+	// of the following conditions are met:
+	// 1) if kubernetes is enabled
+	// 2) when wsl-proxy for wsl-integration is enabled
+	if !*enableKubernetes {
+		return nil
+	}
+
+	port, err := nat.NewPort("tcp", *k8sAPIPort)
+	if err != nil {
+		return fmt.Errorf("%w: failed to parse port for k8s API: %w", exitcode.ErrConfig, err)
+	}
+	k8sAPIPorts := nat.PortMap{
+		port: []nat.PortBinding{
+			{
+				HostIP:   "127.0.0.1",
+				HostPort: *k8sAPIPort,
+			},
+		},
+	}
+	k8sAPIPortMapping := types.PortMapping{
+		Remove:    false,
+		Ports:     k8sAPIPorts,
+		Protocols: types.PortProtocols(k8sAPIPorts),
+	}
+	if err := f.metricsForwarder.Send(ctx, k8sAPIPortMapping); err != nil {
+		return fmt.Errorf("%w: failed to send a static portMapping event to wsl-proxy: %w", exitcode.ErrUnreachable, err)
+	}
+	log.Debugf("successfully forwarded k8s API port [%s] to wsl-proxy", *k8sAPIPort)
+
+	return nil
+}
+
+// waitForPeer pings the peer until it is reached, for up to timeout, see -peerTimeout.
+func waitForPeer(ctx context.Context, pinger pingForwarder, timeout time.Duration) error {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for {
+		err := pinger.Ping(waitCtx)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-waitCtx.Done():
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			return fmt.Errorf("%w: the peer of the forwarder was not reached within %s: %w", exitcode.ErrUnreachable, timeout, err)
+		case <-time.After(peerRetryInterval):
+		}
+	}
+}
+
+// setupPeer creates the tracker of the peer forwarder, with the addresses that
+// the host reaches the VM at, and starts the periodic tasks that keep them and
+// the port mappings of the peer up to date.
+func (f *forwarding) setupPeer(
+	ctx context.Context,
+	hostForwarder peerForwarder,
+	periodic *loops,
+	currentPlatform string,
+	natSubnets []netip.Prefix,
+	logger *logging.Logger,
+	hostLogs *logging.Shipper,
+) error {
+	selector := interfaceSelector(interfaceNames(*netInterface))
+
+	interfaces, err := netif.Find(ctx, selector, *interfaceTimeout, interfaceRetryInterval)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("the network interface did not come up with an address within %s, "+
+			"-interface selects it when it is not the one with the default route: %w", *interfaceTimeout, err)
+	} else if err != nil {
+		return fmt.Errorf("failure getting the addresses of the network interface: %w", err)
+	}
+
+	if pinger, ok := hostForwarder.(pingForwarder); ok && *peerTimeout > 0 {
+		if err := waitForPeer(ctx, pinger, *peerTimeout); err != nil {
+			return err
+		}
+	}
+
+	connectAddrs := classifyConnectAddrs(interfaces, natSubnets)
+	breaker := forwarder.NewBreakerForwarder(f.metricsForwarder, breakerOptions)
+	vtunnelTracker := tracker.NewVTunnelTracker(breaker, connectAddrs)
+	vtunnelTracker.SetLANPolicy(tracker.LANPolicy(*lanPorts))
+	f.network = &networkSummary{
+		interfaces: interfaces,
+		lanOnly:    types.LANOnly(connectAddrs),
+		families:   types.ConnectFamilies(connectAddrs),
+	}
+	if types.IPv6Only(connectAddrs) {
+		log.Infof("the VM only has IPv6 connectivity, the listeners on 0.0.0.0 are opened on [::] " +
+			"and the host is asked to forward all the ports to the IPv6 addresses")
+	}
+	if f.network.lanOnly {
+		log.Infof("the VM is only reached at addresses on the LAN, e.g. with the bridged networking of WSL, "+
+			"the port mappings are handled with -lanPorts=%s", *lanPorts)
+	}
+	// Only WSL has the mirrored networking.
+	if !*forwardMirrored && currentPlatform != platform.Lima {
+		f.network.mirrored, f.network.mirroredReason = detectMirrored(ctx, vtunnelTracker)
+	}
+	// The host already reaches the loopback of the VM with the mirrored networking.
+	if *forwardingProfile != "" || (currentPlatform == platform.WSL && !f.network.mirrored) {
+		f.network.profile, f.network.profileReason = selectProfile(ctx, vtunnelTracker)
+	}
+	hostForwarder.SetPeerRestartHandler(vtunnelTracker.PeerRestarted)
+	breaker.SetRecoveryHandler(vtunnelTracker.PeerRecovered)
+	if pinger, ok := hostForwarder.(pingForwarder); ok {
+		breaker.SetProbe(pinger.Ping)
+	}
+	if batcher, ok := hostForwarder.(batchForwarder); ok {
+		vtunnelTracker.SetPeerBatches(batcher.Batches)
+	}
+	f.reservedPorts, _ = hostForwarder.(reservedPortsForwarder)
+	if checker, ok := hostForwarder.(compatibilityForwarder); ok {
+		f.compatibility = checker.Compatibility
+	}
+	vtunnelTracker.SetChangeCounter(f.portChanges)
+	if *batchWindow > 0 {
+		vtunnelTracker.EnableBatching(*batchWindow)
+		vtunnelTracker.EnableCoalescing(*coalesceWindow)
+	}
+	if *sendRate > 0 {
+		vtunnelTracker.EnableRateLimit(*sendRate, *sendBurst)
+	}
+	if *retryBackoff > 0 {
+		vtunnelTracker.EnableRetry(*retryBackoff, maxRetryBackoff)
+	}
+	f.portTracker = vtunnelTracker
+	f.listenerTracker = vtunnelTracker.ListenerTracker
+	f.relayAddrs = func() []netip.Addr { return connectIPs(vtunnelTracker.ConnectAddrs()) }
+	f.startupHolder = vtunnelTracker
+	f.breaker = breaker
+
+	if pinger, ok := hostForwarder.(heartbeatForwarder); ok {
+		periodic.start("heartbeat", func(ctx context.Context) {
+			if *heartbeatInterval > 0 {
+				pinger.PingPeriodically(ctx, *heartbeatInterval)
+			}
+		}, "heartbeatInterval")
+
+		f.lastContact = pinger.LastContact
+	}
+
+	// The peers that do not accept the logs fail every batch, the logs stay local.
+	if logs, ok := hostForwarder.(logsForwarder); ok && hostLogs != nil {
+		logger.SetHook(hostLogs.Hook)
+
+		periodic.start("log shipping", func(ctx context.Context) {
+			if *hostLogInterval > 0 {
+				hostLogs.Run(ctx, *hostLogInterval, logs.SendLogs)
+			}
+		}, "hostLogInterval")
+	}
+
+	// The peer is probed while the circuit is open, rather than only by the sends.
+	go breaker.Run(ctx)
+
+	periodic.start("resync", func(ctx context.Context) {
+		if *resyncInterval > 0 {
+			vtunnelTracker.ResyncPeriodically(ctx, *resyncInterval)
+		}
+	}, "resyncInterval")
+
+	// The interfaces are selected again, e.g. the one with the default route after a VPN connected.
+	lookupConnectAddrs := func() ([]types.ConnectAddrs, error) {
+		interfaces, err := selector.Refresh()
+		if err != nil {
+			return nil, err
+		}
+
+		return classifyConnectAddrs(interfaces, natSubnets), nil
+	}
+
+	periodic.start("address watch", func(ctx context.Context) {
+		if *addrWatchInterval <= 0 {
+			return
+		}
+
+		changes := netif.SubscribeAddressChanges(ctx, *addrWatchInterval)
+		vtunnelTracker.WatchConnectAddrs(ctx, changes, lookupConnectAddrs)
+
+		// The subscription is done once its channel is closed, e.g. before the task is restarted.
+		for range changes {
+		}
+	}, "addrWatchInterval")
+
+	periodic.start("resume detection", func(ctx context.Context) {
+		if *resumeCheckInterval > 0 {
+			detector := resume.NewDetector(func() uint64 { return f.metricsForwarder.Metrics().FailureCount() })
+			detector.Watch(ctx, *resumeCheckInterval, func(ctx context.Context, reason string) {
+				_ = resume.Recover(ctx, reason, resumeSteps(vtunnelTracker, hostForwarder, lookupConnectAddrs, periodic)...)
+			})
+		}
+	}, "resumeCheckInterval")
+
+	return nil
+}
+
+// peerForwarder is implemented by the forwarders that
+// send the port mappings to a peer process on the host.
+type peerForwarder interface {
+	forwarder.Forwarder
+	SetPeerRestartHandler(onRestart func())
+}
+
+// batchForwarder is implemented by the peer forwarders
+// whose peer may apply a batch of port mappings at once.
+type batchForwarder interface {
+	Batches() bool
+}
+
+// reservedPortsForwarder is implemented by the peer forwarders
+// whose peer reports the host ports that are reserved on the host.
+type reservedPortsForwarder interface {
+	ReservedPorts() []types.ReservedPorts
+	SetReservedPortsHandler(onReserved func())
+}
+
+// compatibilityForwarder is implemented by the peer forwarders that check
+// the protocol versions of their peer when they negotiate the protocol.
+type compatibilityForwarder interface {
+	Compatibility() *forwarder.Compatibility
+}
+
+// skipReservedPorts makes the filter tracker skip the host ports that the peer
+// reports to be reserved, whenever they change until the context is cancelled.
+// They are applied in the background, since the peer reports them while a port
+// mapping is being sent, possibly by the filter tracker itself.
+func skipReservedPorts(ctx context.Context, reservedPorts reservedPortsForwarder, filterTracker *tracker.FilterTracker) {
+	changes := make(chan struct{}, 1)
+
+	reservedPorts.SetReservedPortsHandler(func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-changes:
+				if err := filterTracker.SetReserved(reservedPorts.ReservedPorts()); err != nil {
+					log.Errorf("failed to apply the reserved host ports: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// heartbeatForwarder is implemented by the peer forwarders that send heartbeats
+// to the peer, the gRPC forwarder relies on the gRPC health checking instead.
+type heartbeatForwarder interface {
+	PingPeriodically(ctx context.Context, interval time.Duration)
+	LastContact() time.Time
+}
+
+// pingForwarder is implemented by the peer forwarders that
+// can check that their peer is reachable without sending to it.
+type pingForwarder interface {
+	Ping(ctx context.Context) error
+}
+
+// reconnectForwarder is implemented by the peer forwarders
+// that can start over with their peers, see forwarder.VTunnelForwarder.Reconnect.
+type reconnectForwarder interface {
+	Reconnect()
+}
+
+// resumeSteps returns the steps that repair the forwards after the host
+// resumed from sleep, see resume.Recover: the addresses of the VM are looked
+// up again, the forwarder starts over with its peer, all the port mappings
+// are sent again, with the new addresses if they changed, and the tickers
+// of the periodic tasks are restarted.
+func resumeSteps(
+	vtunnelTracker *tracker.VTunnelTracker,
+	hostForwarder peerForwarder,
+	lookup func() ([]types.ConnectAddrs, error),
+	periodic *loops,
+) []resume.Step {
+	var connectAddrs []types.ConnectAddrs
+
+	return []resume.Step{
+		{Name: "look up the addresses of the network interfaces", Run: func(context.Context) error {
+			var err error
+			connectAddrs, err = lookup()
+
+			return err
+		}},
+		{Name: "reconnect the forwarder", Run: func(context.Context) error {
+			if reconnector, ok := hostForwarder.(reconnectForwarder); ok {
+				reconnector.Reconnect()
+			}
+
+			return nil
+		}},
+		{Name: "resync the port mappings", Run: func(ctx context.Context) error {
+			// SetConnectAddrs sends the snapshot when the addresses changed.
+			if connectAddrs != nil && !slices.Equal(connectAddrs, vtunnelTracker.ConnectAddrs()) {
+				return vtunnelTracker.SetConnectAddrs(ctx, connectAddrs)
+			}
+
+			return vtunnelTracker.Resync(ctx, true)
+		}},
+		{Name: "restart the periodic tasks", Run: func(context.Context) error {
+			periodic.rearm("heartbeat", "resync", "address watch")
+
+			return nil
+		}},
+	}
+}
+
+// logsForwarder is implemented by the peer forwarders that can send
+// the logs of the agent to the peer, see forwarder.ErrLogsNotSupported.
+type logsForwarder interface {
+	SendLogs(ctx context.Context, batch types.LogBatch) error
+}
+
+// wrapTracker wraps the tracker with the trackers of -portRemap, -maxPorts,
+// -allowPorts and -blockPorts, which also warns of -wellKnownPorts; the filter
+// is always in place so that it can be changed by a reload.
+func wrapTracker(portTracker tracker.Tracker) (*tracker.FilterTracker, error) {
+	if *portRemap != "" {
+		remapTable, err := tracker.ParseRemapTable(*portRemap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse -portRemap: %w", err)
+		}
+
+		portTracker = tracker.NewRemapTracker(portTracker, remapTable)
+	}
+
+	if *maxPorts > 0 {
+		portTracker = tracker.NewBudgetTracker(portTracker, *maxPorts)
+	}
+
+	portFilter, err := tracker.ParsePortFilter(*allowPorts, *blockPorts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse -allowPorts and -blockPorts: %w", err)
+	}
+
+	wellKnown, err := tracker.ParseWellKnownPorts(*wellKnownPorts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse -wellKnownPorts: %w", err)
+	}
+
+	filterTracker := tracker.NewFilterTracker(portTracker, portFilter)
+	filterTracker.SetWellKnown(wellKnown)
+
+	return filterTracker, nil
+}
+
+// detectMirrored switches the tracker to only reporting the port mappings
+// when WSL runs the VM with the mirrored networking, since forwarding them
+// would conflict with the ports that WSL mirrors to the host.
+// It returns whether it is mirrored, and how it was detected.
+func detectMirrored(ctx context.Context, vtunnelTracker *tracker.VTunnelTracker) (bool, string) {
+	mirrored, reason, err := wsl.NewDetector().Mirrored(ctx)
+
+	switch {
+	case err != nil:
+		log.Warnf("failed to detect the mirrored networking of WSL, forwarding the ports: %v", err)
+
+		return false, "detection failed"
+	case mirrored:
+		log.Infof("detected the mirrored networking of WSL, %s: the port mappings are only reported to the host, "+
+			"-forwardMirrored forwards them anyway", reason)
+		vtunnelTracker.EnableMirrored()
+	default:
+		log.Debugf("the networking of WSL is not mirrored, %s", reason)
+	}
+
+	return mirrored, reason
+}
+
+// selectProfile applies -forwardingProfile, or the forwarding profile that
+// matches the localhostForwarding of WSL, to the tracker and returns it along
+// with how it was selected.
+func selectProfile(ctx context.Context, vtunnelTracker *tracker.VTunnelTracker) (string, string) {
+	profile, reason := *forwardingProfile, "set by -forwardingProfile"
+	if profile == "" {
+		var err error
+
+		profile, reason, err = wsl.NewDetector().LocalhostForwarding(ctx, relayProbeTimeout)
+		if err != nil {
+			log.Warnf("failed to detect the localhostForwarding of WSL, forwarding all the ports: %v", err)
+
+			profile, reason = wsl.ProfileDirect, "detection failed"
+		}
+	}
+
+	log.Infof("using the %s forwarding profile, %s", profile, reason)
+
+	switch {
+	case profile == wsl.ProfileRelay:
+		vtunnelTracker.EnableLoopbackRelay()
+	case listenerOnlyMode():
+		log.Warnf("the listeners of -iptables only reach the host through the localhostForwarding of WSL, "+
+			"which the %s forwarding profile does not rely on", profile)
+	}
+
+	return profile, reason
+}
+
+// classifyConnectAddrs returns the connect addresses of the interfaces, with
+// their scope when the NAT subnets of WSL are given, see wsl.Classify.
+func classifyConnectAddrs(interfaces []netif.Interface, natSubnets []netip.Prefix) []types.ConnectAddrs {
+	connectAddrs := netif.ConnectAddrs(interfaces)
+	if natSubnets == nil {
+		return connectAddrs
+	}
+
+	return wsl.Classify(connectAddrs, natSubnets)
+}
+
+// connectIPs returns the addresses of the connect addresses, with the zone of
+// the link-local ones; the ones that do not parse are skipped.
+func connectIPs(connectAddrs []types.ConnectAddrs) []netip.Addr {
+	addrs := make([]netip.Addr, 0, len(connectAddrs))
+	for _, connectAddr := range connectAddrs {
+		addr, err := netip.ParseAddr(connectAddr.IP)
+		if err != nil {
+			continue
+		}
+
+		addrs = append(addrs, addr.WithZone(connectAddr.Zone))
+	}
+
+	return addrs
+}
+
+// interfaceSelector returns the selector of the network interfaces of the
+// names, which falls back to the known interfaces of the platform when none
+// of the interfaces has a default route, e.g. on Lima; the interfaces of
+// -excludeInterfaces are left out of both, unless -includeInterfaces keeps them.
+func interfaceSelector(names []string) *netif.Selector {
+	selector := netif.NewSelector(netif.Netlink(), names, platform.Interfaces(*platformName))
+	selector.SetFilter(netif.Filter{
+		Include: interfaceNames(*includeInterfaces),
+		Exclude: interfaceNames(*excludeInterfaces),
+	})
+
+	return selector
+}
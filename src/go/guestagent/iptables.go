@@ -0,0 +1,37 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/iptables"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// iptablesSubsystem scans the DNAT rules of iptables, and reports their
+// ports to the tracker; the scans are stretched while the system is idle,
+// unless the nudger is nil.
+func iptablesSubsystem(portTracker tracker.Tracker, nudger *tracker.Nudger) subsystem {
+	return subsystem{name: "iptables", flags: []string{"iptablesChains"}, run: func(ctx context.Context) error {
+		poller := iptables.NewPoller(iptablesUpdateInterval, *iptablesMaxInterval, nudger.Nudges())
+		err := iptables.ForwardPorts(ctx, portTracker, poller, scanNamespace(), forwardedChains())
+		if err != nil {
+			return fmt.Errorf("error mapping ports: %w", err)
+		}
+
+		return nil
+	}}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/kube"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/recording"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// kubernetesSubsystem watches the services of the cluster of -kubeconfig,
+// and reports their ports to the tracker.
+func kubernetesSubsystem(portTracker tracker.Tracker, recorder *recording.Recorder) subsystem {
+	flags := []string{"kubeconfig", "k8sServiceListenerAddr", "k8sWorkers"}
+
+	return subsystem{name: "kubernetes", flags: flags, run: func(ctx context.Context) error {
+		// -k8sServiceListenerAddr is checked by checkAddrFlags, and by checkReloadedFlags.
+		k8sServiceListenerIP := net.ParseIP(*k8sServiceListenerAddr)
+
+		// Watch for kube
+		err := kube.WatchForServices(ctx,
+			*configPath,
+			k8sServiceListenerIP,
+			listenerOnlyMode(),
+			portTracker,
+			recorder,
+			*k8sWorkers)
+		if err != nil {
+			return fmt.Errorf("error watching services: %w", err)
+		}
+
+		return nil
+	}}
+}
@@ -0,0 +1,42 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/loopback"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// loopbackSubsystem relays the ports that only listen on the loopback
+// interface at the addresses of relayAddrs, the ones that the filter allows.
+func loopbackSubsystem(portTracker tracker.Tracker, relayAddrs func() []netip.Addr, allows func(hostPort string) bool) subsystem {
+	relayer := loopback.NewRelayer(netif.DefaultProcNet, relayAddrs, allows)
+	if *dryRun {
+		relayer.EnableDryRun()
+	}
+
+	return subsystem{name: "loopback", run: func(ctx context.Context) error {
+		err := relayer.ForwardPorts(ctx, portTracker, iptablesUpdateInterval)
+		if err != nil {
+			return fmt.Errorf("error relaying the loopback ports: %w", err)
+		}
+
+		return nil
+	}}
+}
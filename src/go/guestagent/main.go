@@ -23,27 +23,57 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/Masterminds/log-go"
-	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/admin"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/capabilities"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/conflict"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/containerd"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/diagnostics"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/docker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/exitcode"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/history"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/iptables"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/kube"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/loopback"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netns"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/pidfile"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/platform"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/readiness"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/recording"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/startup"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
-	"golang.org/x/sync/errgroup"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/waitfor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/wsl"
 )
 
 //nolint:gochecknoglobals
 var (
-	debug            = flag.Bool("debug", false, "display debug output")
+	configFile = flag.String(config.FlagName, "",
+		"path to a YAML file that sets the flags that are not given on the command line, its keys are the flag names")
+	printConfig = flag.String("printConfig", "",
+		"print the effective configuration in the given format, yaml or json, with where each value comes from, and exit")
+	showVersion      = flag.Bool("version", false, "print the version of the agent and exit")
+	debug            = flag.Bool("debug", false, "display debug output, an alias of -logLevel=debug")
 	configPath       = flag.String("kubeconfig", "/etc/rancher/k3s/k3s.yaml", "path to kubeconfig")
 	enableIptables   = flag.Bool("iptables", true, "enable iptables scanning")
 	enableKubernetes = flag.Bool("kubernetes", false, "enable Kubernetes service forwarding")
@@ -52,13 +82,210 @@ var (
 	containerdSock   = flag.String("containerdSock",
 		containerdSocketFile,
 		"file path for Containerd socket address")
-	vtunnelAddr             = flag.String("vtunnelAddr", vtunnelPeerAddr, "peer address for Vtunnel in IP:PORT format")
+	iptablesChains = flag.String("iptablesChains", strings.Join(iptables.DefaultChains, ","),
+		"comma separated chains of the nat table whose DNAT rules -iptables forwards the ports of; the names may end "+
+			"with * like the ones of -excludeInterfaces, the chains of ufw and firewalld are only forwarded when named "+
+			"explicitly, e.g. ufw-*")
+	dockerWaitTimeout = flag.Duration("dockerWaitTimeout", socketRetryTimeout,
+		"how long to wait for the Docker API to be served before the docker subsystem is only retried slowly, "+
+			"0 waits for as long as it takes")
+	dockerKubernetesContainers = flag.Bool("dockerKubernetesContainers", false,
+		"forward the port mappings of the containers that Kubernetes runs on Docker, e.g. with cri-dockerd, from the Docker "+
+			"events too; they are left to -kubernetes otherwise, which forwards their services")
+	vtunnelAddr = flag.String("vtunnelAddr", vtunnelPeerAddr,
+		"peer address for Vtunnel in HOST:PORT or unix:///path/to/socket format, or a comma-separated list of "+
+			"them that is failed over in order; a host name is resolved again whenever it can not be connected to")
 	enablePrivilegedService = flag.Bool("privilegedService", false, "enable Privileged Service mode")
 	k8sServiceListenerAddr  = flag.String("k8sServiceListenerAddr", net.IPv4zero.String(),
-		"address to bind Kubernetes services to on the host, valid options are 0.0.0.0 or 127.0.0.1")
+		"address to bind Kubernetes services to on the host, valid options are 0.0.0.0 or 127.0.0.1, "+
+			"or :: and ::1 when the VM only has IPv6 connectivity")
+	k8sWorkers = flag.Int("k8sWorkers", kube.DefaultWorkers,
+		"maximum number of the events of the Kubernetes services that are handled at once, the events of a service "+
+			"are handled in order; the others wait in a queue")
 	adminInstall = flag.Bool("adminInstall", false, "indicates if Rancher Desktop is installed as admin or not")
 	k8sAPIPort   = flag.String("k8sAPIPort", "6443",
 		"K8sAPI port number to forward to rancher-desktop wsl-proxy as a static portMapping event")
+	resyncInterval = flag.Duration("resyncInterval", defaultResyncInterval,
+		"interval for sending a full port mappings snapshot to the privileged service, 0 disables it")
+	batchWindow = flag.Duration("batchWindow", defaultBatchWindow,
+		"amount of time to accumulate port mapping changes for before sending them as a batch, 0 disables it")
+	startupBatchTimeout = flag.Duration("startupBatchTimeout", defaultStartupBatchTimeout,
+		"maximum amount of time that the port mappings that -docker, -kubernetes and -iptables find at startup are held for, "+
+			"so that they are sent as a single batch once the initial pass of each of them ended; 0 disables it")
+	iptablesMaxInterval = flag.Duration("iptablesMaxInterval", defaultIptablesMaxInterval,
+		"maximum interval that the iptables scans are stretched to while the ports do not change, from one scan every 3s; "+
+			"the events of -docker, -containerd and -kubernetes bring them back to every 3s, 0 disables stretching them")
+	coalesceWindow = flag.Duration("coalesceWindow", 0,
+		"maximum amount of time that a batch is postponed for while the port mapping changes of all the sources keep arriving, "+
+			"each of them postponing it by -batchWindow, so that a burst is sent as a single batch; the removals are still sent "+
+			"after -batchWindow; requires -batchWindow, 0 disables it")
+	sendRate = flag.Float64("sendRate", 0,
+		"maximum number of port mapping batches to send to the privileged service per second, the changes beyond it "+
+			"are merged into the next batch; requires -batchWindow, 0 disables it")
+	sendBurst = flag.Int("sendBurst", defaultSendBurst,
+		"maximum number of port mapping batches to send in a burst when -sendRate is set")
+	addrWatchInterval = flag.Duration("addrWatchInterval", defaultAddrWatchInterval,
+		"interval for checking the addresses of the network interfaces for changes when the netlink notifications "+
+			"are not available, 0 disables watching them")
+	resumeCheckInterval = flag.Duration("resumeCheckInterval", defaultResumeInterval,
+		"interval for checking whether the host resumed from sleep, from a jump of the clocks or a burst of failed sends, "+
+			"after which the forwards are repaired; used with -forwarder=vtunnel, vsock, hvsock or hostswitch, 0 disables it")
+	netInterface = flag.String("interface", "",
+		"comma separated network interfaces whose addresses the port mappings are reached at from the host, e.g. eth0; "+
+			"empty picks the first one that is not a loopback one and has a default route, or on Lima, the first of the known "+
+			"interfaces of its VMs that is up")
+	excludeInterfaces = flag.String("excludeInterfaces", strings.Join(netif.DefaultExclude, ","),
+		"comma separated network interfaces of the VPNs and the overlay networks that -interface does not pick when it is "+
+			"empty, e.g. tailscale0; the names may end with * to match the ones that start with them")
+	includeInterfaces = flag.String("includeInterfaces", "",
+		"comma separated network interfaces that -excludeInterfaces does not leave out, e.g. wg0; "+
+			"the names may end with * like the ones of -excludeInterfaces")
+	interfaceTimeout = flag.Duration("interfaceTimeout", defaultInterfaceTimeout,
+		"amount of time to wait at startup for the network interface to come up with an address")
+	once = flag.Bool("once", false,
+		"list the port mappings of the enabled subsystems once, print them as JSON and exit; "+
+			"they are also sent to the host as a snapshot when -forwarder is set")
+	selftestMode = flag.Bool("selftest", false,
+		"check the steps of the port forwarding of the enabled subsystems one after the other, print a report with the "+
+			"hints to fix the failures and exit, with a failure if any of them failed")
+	dryRun = flag.Bool("dryRun", false,
+		"log the port mappings, the listeners and the iptables rules that the agent would apply, without applying them")
+	recordEvents = flag.String("recordEvents", "",
+		"path to the file that the docker and Kubernetes events are appended to as JSON lines, without what the port mappings "+
+			"do not depend on, e.g. the environment of the containers; it is disabled when empty")
+	replayEvents = flag.String("replayEvents", "",
+		"replay a file of -recordEvents through the handlers of the events with the noop forwarder, print the port mappings "+
+			"that are tracked afterwards as JSON and exit")
+	replaySpeed = flag.Float64("replaySpeed", defaultReplaySpeed,
+		"how many times faster than they were recorded the events of -replayEvents are replayed, 0 replays them without waiting")
+	watchPorts = flag.Bool("watchPorts", false,
+		"print the port mappings of the agent that serves -adminSocket, and then their changes as they happen, until "+
+			"interrupted; the changes are polled from GET /ports when the agent does not stream them")
+	watchJSON = flag.Bool("watchJSON", false,
+		"print the changes of -watchPorts as JSON lines, like the records of GET /events, rather than as a table")
+	forwardMirrored = flag.Bool("forwardMirrored", false,
+		"forward the ports to the host even when WSL runs the VM with the mirrored networking, which already "+
+			"makes them reachable from the host; they are only reported to the host otherwise")
+	natSubnets = flag.String("natSubnets", wsl.DefaultNATSubnets,
+		"comma separated subnets of the NAT network of WSL, the addresses of the interface outside of them are "+
+			"on the LAN, e.g. with the bridged networking; the custom NatNetwork of WSL must be listed, empty leaves "+
+			"the addresses unclassified")
+	lanPorts = flag.String("lanPorts", string(tracker.LANForward),
+		"what to do with the port mappings when the VM is only reached at addresses on the LAN, see -natSubnets: "+
+			"forward them, report them to the host without forwarding them, or skip them")
+	netNamespace = flag.String("netns", "",
+		"named network namespace, in "+netns.DefaultDir+" unless it is a path, that the iptables rules are scanned "+
+			"and the listeners are opened within, e.g. for the namespaced networking; the scans are paused while it does "+
+			"not exist, and the port mappings are still sent from the network namespace of the agent")
+	forwardingProfile = flag.String("forwardingProfile", "",
+		"how the ports bound to the loopback of the VM reach the host on WSL: relay leaves them to the localhostForwarding "+
+			"of WSL, direct forwards them like the other ports; it is detected with a probe port when empty")
+	forwardLoopback = flag.Bool("forwardLoopback", false,
+		"relay the TCP ports that the VM only listens on at its loopback from the addresses that the host reaches it at, "+
+			"and forward them to the loopback of the host; it is disabled by default since it exposes the services "+
+			"that only expected local clients")
+	apiBaseURL = flag.String("apiBaseURL", tracker.GatewayBaseURL,
+		"base URL of the host's port forwarding API, used when -privilegedService is disabled")
+	apiTimeout = flag.Duration("apiTimeout", tracker.DefaultAPITimeout,
+		"timeout for a single request to the host's port forwarding API, and to the host-switch API with -forwarder=hostswitch")
+	retryBackoff = flag.Duration("retryBackoff", defaultRetryBackoff,
+		"longest initial delay for retrying the port mappings that failed to be sent to the privileged service, 0 disables it")
+	portRemap = flag.String("portRemap", "",
+		"comma separated host port remap rules, either offset ranges (80-99:+8000) or exact ports (5432:15432)")
+	allowPorts = flag.String("allowPorts", "",
+		"comma separated host ports and port ranges that may be forwarded (80,443,8000-8999), the others are not; "+
+			"empty allows all of them")
+	blockPorts = flag.String("blockPorts", "",
+		"comma separated host ports and port ranges that are never forwarded (22,53), regardless of their source and "+
+			"of -allowPorts; no listener is opened on them either")
+	wellKnownPorts = flag.String("wellKnownPorts", "",
+		"comma separated host ports and port ranges that a service of the host usually holds, each with its service "+
+			"(445=SMB,137-139/udp=NetBIOS); they are forwarded with a warning that they likely conflict, and the platform "+
+			"sets the ones of its host")
+	maxPorts = flag.Int("maxPorts", 0,
+		"maximum number of port bindings to track, the port mappings beyond it are rejected, 0 disables it")
+	portTTL = flag.Duration("portTTL", 0,
+		"remove the refreshed port mappings that are not refreshed again within this duration, 0 disables it")
+	driftInterval = flag.Duration("driftInterval", tracker.DefaultDriftInterval,
+		"interval for comparing the port mappings of the sources with the tracked ones, and repairing them, 0 disables it")
+	summaryInterval = flag.Duration("summaryInterval", diagnostics.DefaultSummaryInterval,
+		"interval for logging a summary of the tracked ports, the listeners, the forwarder, the subsystems "+
+			"and the errors since the last summary, 0 disables it")
+	forwarderType = flag.String("forwarder", forwarder.KindAuto,
+		"forwarder for the port mappings, one of auto, vtunnel, vsock, hvsock, grpc, api, hostswitch, noop or record; vtunnel "+
+			"and grpc connect to -vtunnelAddr, hostswitch exposes them with the API at -hostSwitchURL, noop only logs the port "+
+			"mappings and record appends them to -recordFile; auto selects the first one that answers of hvsock and vtunnel "+
+			"on WSL with -privilegedService, and of vsock and hostswitch on Lima, or else vtunnel when -privilegedService "+
+			"is enabled and api otherwise")
+	forwarderProbeTimeout = flag.Duration("forwarderProbeTimeout", forwarder.DefaultProbeTimeout,
+		"maximum amount of time for the peer of each forwarder that -forwarder=auto probes to answer")
+	logFormat = flag.String("logFormat", string(logging.FormatText),
+		"format of the logs, either text or json for one JSON object per line")
+	logLevel = flag.String("logLevel", "info",
+		"minimum level of the logs, one of error, warn, info, debug or trace")
+	logRepeatInterval = flag.Duration("logRepeatInterval", logging.DefaultRepeatInterval,
+		"interval that the errors which repeat, e.g. while a peer is down, are logged at along with how many times "+
+			"they repeated; 0 logs all of them")
+	logLevelOverride = flag.String("logLevelOverride", "",
+		"comma separated levels of the subsystems that override -logLevel, e.g. kube=trace,docker=info; the subsystems are "+
+			"kube, docker, containerd, iptables, tracker and forwarder")
+	logFile = flag.String("logFile", "",
+		"path to the file that the logs are written to, it is reopened on SIGHUP; they are written to stderr when empty")
+	logMaxSize = flag.Int("logMaxSize", defaultLogMaxSize,
+		"maximum size of -logFile in megabytes before it is rotated, 0 disables the rotation")
+	logMaxFiles = flag.Int("logMaxFiles", defaultLogMaxFiles,
+		"number of rotated log files to keep besides -logFile")
+	hostLogLevel = flag.String("hostLogLevel", "",
+		"minimum level of the logs that are also sent to the host, e.g. warn, for its troubleshooting view; they are only "+
+			"sent with -forwarder=vtunnel, vsock or hvsock to a peer that accepts them, and it is disabled when empty")
+	hostLogInterval = flag.Duration("hostLogInterval", logging.DefaultShipInterval,
+		"interval for sending the logs of -hostLogLevel to the host, at most "+strconv.Itoa(logging.MaxShippedRecords)+
+			" lines each time; the others are only counted")
+	auditLog = flag.String("auditLog", "",
+		"path to the file that a JSON line is appended to for every port binding that is forwarded or withdrawn, "+
+			"and for whether it was sent to the host; it is rotated like -logFile, and disabled when empty")
+	auditSync = flag.Bool("auditSync", false,
+		"commit every line of -auditLog to the disk before the next one, at the cost of the performance")
+	eventHistorySize = flag.Int("eventHistorySize", history.DefaultSize,
+		"number of the recent changes of the port mappings and failures of the subsystems that GET /events "+
+			"of -adminSocket returns, the oldest ones are evicted; 0 disables it")
+	adminSocket = flag.String("adminSocket", "",
+		"path to the unix socket that the admin API is served on, e.g. "+admin.DefaultSocket+
+			", with or without the unix:// scheme; it is disabled when empty")
+	metricsAddr = flag.String("metricsAddr", "",
+		"address that the Prometheus metrics are served on at /metrics, e.g. 127.0.0.1:9311; they are disabled when empty")
+	pprofAddr = flag.String("pprofAddr", "",
+		"loopback address that net/http/pprof is served on at /debug/pprof/, e.g. 127.0.0.1:6060; it is disabled when empty, "+
+			"and shares the server of -metricsAddr when it is the same address")
+	diagnosticsDir = flag.String("diagnosticsDir", "",
+		"directory that the diagnostics are written to on SIGUSR1, e.g. the configuration, the port mappings and the goroutines, "+
+			"which is "+diagnostics.DefaultDir+" when it is empty, and the report of the shutdown when the agent exits, "+
+			"which is only logged when it is empty")
+	pidFile = flag.String("pidFile", "",
+		"path to the PID file, which keeps another instance of the agent from starting while this one runs; "+
+			"it is disabled when empty")
+	onConflict = flag.String("onConflict", conflict.ActionWarn,
+		"what to do when another agent, e.g. an older one or one with another -pidFile, or a legacy port forwarding process "+
+			"is running: warn names each of them and starts, refuse does not start")
+	readyFile = flag.String("readyFile", "",
+		"path to the file that is written once the agent is ready, i.e. its subsystems are running and the forwarder reached "+
+			"its peer, and removed when it no longer is; it is disabled when empty, systemd is notified regardless")
+	readyGrace = flag.Duration("readyGrace", defaultReadyGrace,
+		"how long the forwarder may not reach its peer for before the agent is no longer ready, "+
+			"it should be longer than -heartbeatInterval")
+	platformName = flag.String("platform", "",
+		"platform that the agent runs on, one of wsl, lima or generic, whose defaults apply to the flags that are not set, "+
+			"e.g. -forwarder=api on lima; it is detected when empty")
+	peerTimeout = flag.Duration("peerTimeout", 0,
+		"amount of time to wait at startup for the peer of -forwarder=vtunnel, vsock or hvsock to be reached, the agent "+
+			"exits when it is not; 0 starts the agent without it, the port mappings are sent once it is reached")
+	heartbeatInterval = flag.Duration("heartbeatInterval", defaultHeartbeatInterval,
+		"interval for checking that the Vtunnel peer is reachable, the port mappings are resent "+
+			"once it is reachable again; used with -forwarder=vtunnel, vsock or hvsock, 0 disables it")
+	// forwarderOptions are set by the flags that the forwarders define, e.g. -vtunnelRetryTimeout.
+	forwarderOptions forwarder.Options
+	// breakerOptions are set by the -breaker flags, for the peer forwarders.
+	breakerOptions forwarder.BreakerOptions
 )
 
 // Flags can only be enabled in the following combination:
@@ -78,231 +305,860 @@ var (
 // versions of k8s are used that do not support the service watcher API.
 
 const (
-	wslInfName             = "eth0"
-	iptablesUpdateInterval = 3 * time.Second
-	socketInterval         = 5 * time.Second
-	socketRetryTimeout     = 2 * time.Minute
-	dockerSocketFile       = "/var/run/docker.sock"
-	containerdSocketFile   = "/run/k3s/containerd/containerd.sock"
-	vtunnelPeerAddr        = "127.0.0.1:3040"
+	defaultInterfaceTimeout = 2 * time.Minute
+	interfaceRetryInterval  = time.Second
+	peerRetryInterval       = time.Second
+	iptablesUpdateInterval  = 3 * time.Second
+	socketInterval          = 5 * time.Second
+	socketRetryTimeout      = 2 * time.Minute
+	dockerSocketFile        = "/var/run/docker.sock"
+	containerdSocketFile    = "/run/k3s/containerd/containerd.sock"
+	vtunnelPeerAddr         = "127.0.0.1:3040"
+	defaultResyncInterval   = 30 * time.Second
+	defaultBatchWindow      = 100 * time.Millisecond
+	defaultSendBurst        = 10
+	// defaultStartupBatchTimeout is longer than the initial passes of the sources on a loaded machine.
+	defaultStartupBatchTimeout = 5 * time.Second
+	defaultAddrWatchInterval   = 5 * time.Second
+	defaultIptablesMaxInterval = 30 * time.Second
+	// defaultResumeInterval is short next to resume.DefaultClockJump, so that only sleeping makes the checks late.
+	defaultResumeInterval = 5 * time.Second
+	defaultRetryBackoff   = time.Second
+	maxRetryBackoff       = time.Minute
+	// shutdownTimeout bounds the shutdown, which is shared between its
+	// phases, see supervisor.Shutdown, and the report.
+	shutdownTimeout          = 10 * time.Second
+	sourcesStopTimeout       = 2 * time.Second
+	withdrawTimeout          = 4 * time.Second
+	listenersCloseTimeout    = time.Second
+	forwarderCloseTimeout    = time.Second
+	surfacesStopTimeout      = time.Second
+	shutdownReportTimeout    = time.Second
+	tracingShutdownTimeout   = 2 * time.Second
+	subsystemMinBackoff      = time.Second
+	subsystemMaxBackoff      = time.Minute
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultReadyGrace        = time.Minute
+	readinessInterval        = time.Second
+	onceTimeout              = 30 * time.Second
+	selftestTimeout          = 10 * time.Second
+	defaultReplaySpeed       = 10
+	defaultLogMaxSize        = 10
+	defaultLogMaxFiles       = 3
+	worstLatencies           = 10
+	relayProbeTimeout        = 3 * time.Second
+	megabyte                 = 1 << 20
+)
+
+// errSignal and errSubsystemsStopped are the causes of the shutdown, see shutdown.Report.
+var (
+	errSignal            = errors.New("received a signal")
+	errSubsystemsStopped = errors.New("all the sources stopped")
 )
 
 func main() {
-	// Setup logging with debug and trace levels
-	logger := log.NewStandard()
+	os.Exit(run())
+}
+
+// run runs the agent until it is signalled to stop, or until one of its
+// subsystems fails, and returns the exit code.
+func run() int {
+	// The configuration is logged about in the text format, until the format is configured.
+	logger := logging.New(os.Stderr, logging.FormatText)
 
+	forwarderOptions.RegisterFlags(flag.CommandLine)
+	breakerOptions.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
-	if *debug {
-		logger.Level = log.DebugLevel
+	log.Current = logger
+
+	// The values of the command line are kept for the reloads, see reloader.
+	commandLine := config.CommandLine(flag.CommandLine)
+
+	// The origins of the values are logged in the startup summary.
+	origins := config.Origins{}
+	origins.Record(flag.CommandLine, config.OriginCommandLine)
+
+	// The flags are set from the command line, the environment, the configuration file
+	// and their defaults, in that order of precedence.
+	if err := config.LoadEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		return fail(err)
 	}
 
+	origins.Record(flag.CommandLine, config.OriginEnv)
+
+	if *configFile != "" {
+		if err := config.Load(flag.CommandLine, *configFile); err != nil {
+			return fail(err)
+		}
+
+		origins.Record(flag.CommandLine, config.OriginConfig)
+	}
+
+	if *showVersion {
+		fmt.Println(version.Get())
+
+		return 0
+	}
+
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		return fail(fmt.Errorf("failed to parse -logFormat: %w", err))
+	}
+
+	var (
+		logOutput io.Writer = os.Stderr
+		// logRotatingFile is reopened on SIGHUP, see reloader.
+		logRotatingFile *logging.RotatingFile
+	)
+
+	if *logFile != "" {
+		logRotatingFile, err = logging.OpenFile(*logFile, int64(*logMaxSize)*megabyte, *logMaxFiles, os.Stderr)
+		if err != nil {
+			return fail(err)
+		}
+
+		defer logRotatingFile.Close()
+
+		logOutput = logRotatingFile
+	}
+
+	logger = logging.New(logOutput, format)
 	log.Current = logger
 
-	log.Infof("Starting Rancher Desktop Agent in [AdminInstall=%t] mode", *adminInstall)
+	// The packages of the subsystems log with the named loggers, whose levels can be overridden.
+	kube.SetLogger(logger.Named("kube"))
+	docker.SetLogger(logger.Named("docker"))
+	containerd.SetLogger(logger.Named("containerd"))
+	iptables.SetLogger(logger.Named("iptables"))
+	tracker.SetLogger(logger.Named("tracker"))
+	forwarder.SetLogger(logger.Named("forwarder"))
+	tracing.SetLogger(logger.Named("tracing"))
+	loopback.SetLogger(logger.Named("loopback"))
+	waitfor.SetLogger(logger.Named("waitfor"))
 
-	if os.Geteuid() != 0 {
-		log.Fatal("agent must run as root")
+	if err := applyLogLevels(logger, *debug, *logLevel, *logLevelOverride); err != nil {
+		return fail(err)
 	}
 
-	groupCtx, cancel := context.WithCancel(context.Background())
-	group, ctx := errgroup.WithContext(groupCtx)
+	// The changes are traced if the endpoint of an OTLP collector is set; the
+	// spans that are left are exported once everything else stopped.
+	tracer, err := tracing.FromEnv(os.LookupEnv, version.Get().Version)
+	if err != nil {
+		logger.Warnf("tracing is disabled: %v", err)
+	} else if tracer != nil {
+		tracing.SetTracer(tracer)
+
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+			defer cancel()
+
+			if err := tracer.Shutdown(ctx); err != nil {
+				logger.Warnf("failed to export the spans: %v", err)
+			}
+		}()
+	}
+
+	logging.SetRepeatInterval(*logRepeatInterval)
+
+	// The logs are shipped to the host once the forwarder is created.
+	var hostLogs *logging.Shipper
+
+	if *hostLogLevel != "" {
+		level, err := logging.ParseLevel(*hostLogLevel)
+		if err != nil {
+			return fail(fmt.Errorf("failed to parse -hostLogLevel: %w", err))
+		}
+
+		hostLogs = logging.NewShipper(level)
+	}
+
+	log.Infof("Starting Rancher Desktop Agent [%s] in [AdminInstall=%t] mode", version.Get(), *adminInstall)
+
+	currentPlatform, err := applyPlatformDefaults(origins)
+	if err != nil {
+		return fail(err)
+	}
+
+	// Printing the configuration starts nothing.
+	if *printConfig != "" {
+		return runPrintConfig(os.Stdout, origins)
+	}
+
+	// A single scan neither daemonizes nor takes the PID file, it can run alongside the agent.
+	if *once {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer stop()
+
+		return runOnce(ctx, os.Stdout)
+	}
+
+	// The self-test does not take the PID file either.
+	if *selftestMode {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer stop()
+
+		return runSelftest(ctx, os.Stdout)
+	}
+
+	// Neither does the replay, which does not reach the host.
+	if *replayEvents != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer stop()
+
+		return runReplay(ctx, os.Stdout)
+	}
+
+	// Nor does watching the changes of another agent.
+	if *watchPorts {
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+		defer stop()
+
+		return runWatch(ctx, os.Stdout)
+	}
+
+	if err := capabilities.Check(capabilities.Effective, requiredCapabilities()); err != nil {
+		return fail(fmt.Errorf("%w: refusing to start: %w", exitcode.ErrPrivilege, err))
+	}
+
+	if *pidFile != "" {
+		pid, err := pidfile.Acquire(*pidFile)
+		if errors.Is(err, os.ErrPermission) {
+			return fail(fmt.Errorf("%w: refusing to start: %w", exitcode.ErrPrivilege, err))
+		} else if err != nil {
+			return fail(fmt.Errorf("refusing to start: %w", err))
+		}
+
+		// The PID file is removed on every exit but the forced ones, it is taken over otherwise.
+		defer func() {
+			if err := pid.Release(); err != nil {
+				log.Errorf("failed to remove the PID file: %v", err)
+			}
+		}()
+	}
+
+	conflicts, marker, err := detectConflicts()
+	if err != nil {
+		return fail(fmt.Errorf("refusing to start: %w", err))
+	}
+
+	if marker != nil {
+		defer marker.Close()
+	}
 
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGTERM)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
 
+	// The shutdown is timed from the cancellation, whatever its cause.
+	shutdownStarted := make(chan time.Time, 1)
+	context.AfterFunc(ctx, func() { shutdownStarted <- time.Now() })
+
+	sigCh := make(chan os.Signal, 2)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+
+	// The configuration is reloaded on SIGHUP once the agent started, see reloader;
+	// the ones that are received in the meantime must not terminate it.
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	// The diagnostics are written on SIGUSR1, see diagnostics.Dumper.
+	usr1Ch := make(chan os.Signal, 1)
+	signal.Notify(usr1Ch, syscall.SIGUSR1)
+
+	// The first signal shuts the agent down, the second one makes it
+	// exit right away, without withdrawing the port mappings.
 	go func() {
 		s := <-sigCh
-		log.Debugf("received [%s] signal", s)
-		cancel()
+		log.Infof("received [%s] signal, shutting down", s)
+		cancel(fmt.Errorf("%w: %s", errSignal, s))
+
+		s = <-sigCh
+		log.Warnf("received [%s] signal again, exiting without waiting for the shutdown", s)
+		os.Exit(exitcode.Forced)
 	}()
 
 	if !*enableContainerd &&
 		!*enableDocker &&
 		!*enableIptables {
-		log.Fatal("requires either -docker, -containerd or -iptables enabled.")
+		return fail(fmt.Errorf("%w: requires either -docker, -containerd or -iptables enabled", exitcode.ErrConfig))
 	}
 
 	if *enableContainerd &&
 		*enableDocker &&
 		*enableIptables {
-		log.Fatal("requires either -docker, -containerd or -iptables, not all.")
+		return fail(fmt.Errorf("%w: requires either -docker, -containerd or -iptables, not all", exitcode.ErrConfig))
 	}
 
-	var portTracker tracker.Tracker
+	if *coalesceWindow > 0 && *batchWindow <= 0 {
+		return fail(fmt.Errorf("%w: -coalesceWindow requires a positive -batchWindow", exitcode.ErrConfig))
+	}
 
-	if *enablePrivilegedService {
-		if *vtunnelAddr == "" {
-			log.Fatal("-vtunnelAddr must be provided when -privilegedService is enabled.")
-		}
+	if *sendRate > 0 && (*batchWindow <= 0 || *sendBurst <= 0) {
+		return fail(fmt.Errorf("%w: -sendRate requires a positive -batchWindow and -sendBurst", exitcode.ErrConfig))
+	}
+
+	if *k8sWorkers <= 0 {
+		return fail(fmt.Errorf("%w: -k8sWorkers must be positive", exitcode.ErrConfig))
+	}
+
+	if !slices.Contains(tracker.LANPolicies, tracker.LANPolicy(*lanPorts)) {
+		return fail(fmt.Errorf("%w: invalid -lanPorts %q, valid options are forward, report and skip", exitcode.ErrConfig, *lanPorts))
+	}
 
-		wslAddr, err := getWSLAddr(wslInfName)
+	// Only WSL has the NAT network, the addresses are not classified elsewhere.
+	var wslNATSubnets []netip.Prefix
+	if currentPlatform == platform.WSL {
+		wslNATSubnets, err = wsl.ParseNATSubnets(*natSubnets)
 		if err != nil {
-			log.Fatalf("failure getting WSL IP addresses: %v", err)
+			return fail(fmt.Errorf("%w: invalid -natSubnets: %w", exitcode.ErrConfig, err))
 		}
+	}
 
-		forwarder := forwarder.NewVTunnelForwarder(*vtunnelAddr)
-		portTracker = tracker.NewVTunnelTracker(forwarder, wslAddr)
-	} else {
-		forwarder := forwarder.NewWSLProxyForwarder("/run/wsl-proxy.sock")
-		portTracker = tracker.NewAPITracker(forwarder, tracker.GatewayBaseURL, *adminInstall)
-		// Manually register the port for K8s API, we would
-		// only want to send this manual port mapping if both
-		// of the following conditions are met:
-		// 1) if kubernetes is enabled
-		// 2) when wsl-proxy for wsl-integration is enabled
-		if *enableKubernetes {
-			port, err := nat.NewPort("tcp", *k8sAPIPort)
-			if err != nil {
-				log.Fatalf("failed to parse port for k8s API: %v", err)
-			}
-			k8sAPIPortMapping := types.PortMapping{
-				Remove: false,
-				Ports: nat.PortMap{
-					port: []nat.PortBinding{
-						{
-							HostIP:   "127.0.0.1",
-							HostPort: *k8sAPIPort,
-						},
-					},
-				},
-			}
-			if err := forwarder.Send(k8sAPIPortMapping); err != nil {
-				log.Fatalf("failed to send a static portMapping event to wsl-proxy: %v", err)
-			}
-			log.Debugf("successfully forwarded k8s API port [%s] to wsl-proxy", *k8sAPIPort)
+	if *forwardingProfile != "" && !slices.Contains(wsl.Profiles, *forwardingProfile) {
+		return fail(fmt.Errorf("%w: invalid -forwardingProfile %q, valid options are %s",
+			exitcode.ErrConfig, *forwardingProfile, strings.Join(wsl.Profiles, ", ")))
+	}
+
+	// The periodic tasks are restarted when their intervals are reloaded.
+	periodic := newLoops(ctx)
+
+	fwd, err := newForwarding(ctx, periodic, currentPlatform, wslNATSubnets, logger, hostLogs)
+	if err != nil {
+		return fail(err)
+	}
+
+	defer logForwarderMetrics(fwd.metricsForwarder)
+
+	portTracker := fwd.portTracker
+
+	// The observers record the changes until the port mappings are withdrawn at shutdown.
+	obs, err := startObservers(portTracker)
+	if err != nil {
+		return fail(err)
+	}
+
+	defer obs.close()
+
+	periodic.start("garbage collection", func(ctx context.Context) {
+		if *portTTL > 0 {
+			tracker.CollectGarbagePeriodically(ctx, portTracker, *portTTL)
+		}
+	}, "portTTL")
+
+	// The drift checker is replaced when -driftInterval is reloaded, its
+	// metrics are the ones of the current one.
+	var driftChecker atomic.Pointer[tracker.DriftChecker]
+
+	periodic.start("drift check", func(ctx context.Context) {
+		if *driftInterval > 0 {
+			checker := tracker.NewDriftChecker(*driftInterval, driftSources(portTracker, fwd.filterTracker, fwd.listenerTracker)...)
+			driftChecker.Store(checker)
+			checker.Run(ctx)
+		}
+		// The sources are listed with the flags that their subsystems are restarted with.
+	}, "driftInterval", "dockerKubernetesContainers", "kubeconfig", "k8sServiceListenerAddr", "iptablesChains")
+
+	startupSummary(origins, fwd.selection, fwd.network).Log(log.Current)
+
+	// The events that the subsystems receive are recorded for -replayEvents.
+	var recorder *recording.Recorder
+
+	if *recordEvents != "" {
+		recordFile, err := os.OpenFile(*recordEvents, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+		if err != nil {
+			return fail(fmt.Errorf("failed to open -recordEvents: %w", err))
 		}
+
+		defer recordFile.Close()
+
+		recorder = recording.NewRecorder(recordFile)
 	}
 
+	// The subsystems are restarted when they fail, without stopping the others.
+	subsystems := supervisor.New(subsystemMinBackoff, subsystemMaxBackoff,
+		supervisor.WithFailureHook(func(name string, state supervisor.State, err error) {
+			obs.events.AddSubsystemFailure(name, string(state), err)
+		}))
+
+	// The sources are restarted when the flags that they read are reloaded, see reloader.
+	supervised := newSupervised(subsystems)
+
+	// The initial passes of the sources run concurrently, and their port
+	// mappings reach the host in a single batch.
+	startupBatch := newStartupBatch(fwd.startupHolder)
+
+	// The events of the engines and of the services nudge the iptables
+	// scans, which are stretched while the system is idle.
+	nudger := newNudger()
+	eventsCtx := tracker.ContextWithNudger(ctx, nudger)
+
 	if *enableContainerd {
-		group.Go(func() error {
-			eventMonitor, err := containerd.NewEventMonitor(*containerdSock, portTracker, *enablePrivilegedService)
-			if err != nil {
-				return fmt.Errorf("error initializing containerd event monitor: %w", err)
-			}
-			if err := tryConnectAPI(ctx, containerdSocketFile, eventMonitor.IsServing); err != nil {
-				return err
-			}
-			eventMonitor.MonitorPorts(ctx)
+		supervised.start(eventsCtx, containerdSubsystem(fwd.coordinator))
+	}
+
+	if *enableDocker {
+		supervised.start(startupContext(eventsCtx, startupBatch, tracker.SourceDocker),
+			dockerSubsystem(portTracker, fwd.relayAddrs, recorder))
+	}
+
+	if *enableKubernetes {
+		supervised.start(startupContext(eventsCtx, startupBatch, tracker.SourceKubernetes),
+			kubernetesSubsystem(portTracker, recorder))
+	}
+
+	if *enableIptables {
+		supervised.start(startupContext(ctx, startupBatch, tracker.SourceIptables), iptablesSubsystem(portTracker, nudger))
+	}
+
+	if *forwardLoopback {
+		supervised.start(ctx, loopbackSubsystem(portTracker, fwd.relayAddrs, fwd.filterTracker.Allows))
+	}
+
+	var endpoints httpEndpoints
+
+	if *metricsAddr != "" {
+		registerMetrics(&endpoints, fwd, obs, subsystems, &driftChecker)
+	}
+
+	if *pprofAddr != "" {
+		endpoints.handle(*pprofAddr, "pprof", registerPprof)
+	}
+
+	// The port mappings that the record forwarder kept are served for the tests to check them.
+	if recordingForwarder, ok := fwd.metricsForwarder.Unwrap().(*forwarder.RecordingForwarder); ok && forwarderOptions.Record.Addr != "" {
+		endpoints.handle(forwarderOptions.Record.Addr, "record", recordingForwarder.RegisterHandlers)
+	}
+
+	// The HTTP endpoints and the admin API outlive the other subsystems, so
+	// that the shutdown can still be followed on them, see stopAgent.
+	surfacesCtx := context.WithoutCancel(ctx)
+	surfaces := endpoints.serve(surfacesCtx, subsystems)
+
+	reloader := &reloader{
+		commandLine:   commandLine,
+		logger:        logger,
+		logFile:       logRotatingFile,
+		auditFile:     obs.auditFile,
+		filterTracker: fwd.filterTracker,
+		loops:         periodic,
+		subsystems:    supervised,
+	}
+	go reloader.reloadOnSIGHUP(ctx, hupCh)
 
-			return eventMonitor.Close()
+	state := diagnosticsState(fwd, obs, subsystems, reloader.config, logger)
+	dumper := diagnostics.NewDumper(*diagnosticsDir, state)
+	go dumper.DumpOnSignal(ctx, usr1Ch)
+
+	summarizer := diagnostics.NewSummarizer(state, time.Now)
+	periodic.start("summary", func(ctx context.Context) {
+		if *summaryInterval > 0 {
+			summarizer.LogPeriodically(ctx, *summaryInterval)
+		}
+	}, "summaryInterval")
+
+	var circuit func() forwarder.BreakerStatus
+	if fwd.breaker != nil {
+		circuit = fwd.breaker.Status
+	}
+
+	if *adminSocket != "" {
+		adminAPI := adminSubsystem(admin.State{
+			Tracker:       portTracker,
+			AllowsPort:    fwd.filterTracker.Allows,
+			Listeners:     fwd.listenerTracker.Listeners,
+			Subsystems:    subsystems.Status,
+			Config:        reloader.config,
+			Logger:        logger,
+			History:       obs.events,
+			Compatibility: fwd.compatibility,
+			Forwarder:     fwd.selection,
+			Circuit:       circuit,
+			Conflicts:     conflicts,
 		})
+		supervised.start(surfacesCtx, adminAPI)
+
+		surfaces = append(surfaces, adminAPI.name)
 	}
 
-	if *enableDocker {
-		group.Go(func() error {
-			eventMonitor, err := docker.NewEventMonitor(portTracker)
-			if err != nil {
-				return fmt.Errorf("error initializing docker event monitor: %w", err)
+	// The agent is ready once its subsystems are running and the forwarder reached its peer.
+	reporter := readiness.NewReporter(*readyFile, os.LookupEnv)
+	if reporter.Enabled() {
+		periodic.start("readiness", func(ctx context.Context) {
+			checks := []readiness.Check{subsystems.Healthy}
+			// The last contact is only kept up to date by the heartbeats.
+			if fwd.lastContact != nil && *heartbeatInterval > 0 {
+				checks = append(checks, readiness.PeerCheck(fwd.lastContact, *readyGrace))
 			}
-			if err := tryConnectAPI(ctx, dockerSocketFile, eventMonitor.Info); err != nil {
-				return err
+			// The agent is degraded while the forwarder does not send to its peer.
+			if fwd.breaker != nil {
+				checks = append(checks, readiness.Degraded(fwd.breaker.Err))
 			}
-			eventMonitor.MonitorPorts(ctx)
-			eventMonitor.Flush()
 
-			return nil
-		})
+			reporter.Watch(ctx, readinessInterval, readiness.All(checks...))
+		}, "heartbeatInterval", "readyGrace")
 	}
 
-	if *enableKubernetes {
-		group.Go(func() error {
-			k8sServiceListenerIP := net.ParseIP(*k8sServiceListenerAddr)
+	// The sources are the subsystems that change the port mappings, there is
+	// nothing left to forward once they all stopped on their own.
+	sources := sourceSubsystems(subsystems.Status(), surfaces)
 
-			if k8sServiceListenerIP == nil || !(k8sServiceListenerIP.Equal(net.IPv4zero) ||
-				k8sServiceListenerIP.Equal(net.IPv4(127, 0, 0, 1))) {
-				log.Fatalf("empty or none valid input for Kubernetes service listener IP address %s. "+
-					"Valid options are 0.0.0.0 and 127.0.0.1.", *k8sServiceListenerAddr)
-			}
+	go func() {
+		_ = subsystems.Wait(sources...)
+		cancel(errSubsystemsStopped)
+	}()
 
-			// listenerOnlyMode represents when iptables is enabled and privileged services
-			// and admin install are disabled; this typically indicates a non-admin installation
-			// of the legacy network, requiring listeners only. In listenerOnlyMode, we create
-			// TCP listeners on 127.0.0.1 to enable automatic port forwarding mechanisms,
-			// particularly in WSLv2 environments.
-			listenerOnlyMode := *enableIptables && !*enablePrivilegedService && !*adminInstall
-			// Watch for kube
-			err := kube.WatchForServices(ctx,
-				*configPath,
-				k8sServiceListenerIP,
-				listenerOnlyMode,
-				portTracker)
-			if err != nil {
-				return fmt.Errorf("error watching services: %w", err)
-			}
+	<-ctx.Done()
 
-			return nil
-		})
+	reporter.Stop()
+	log.Info("Rancher Desktop Agent Shutting Down")
+
+	exitCode := stopAgent(ctx, <-shutdownStarted, fwd, subsystems, periodic, sources, surfaces)
+	obs.stop()
+
+	return exitCode
+}
+
+// fail logs the error that the agent stops with, and returns its exit code,
+// see exitcode.Of; run returns it rather than exiting, so that the deferred
+// cleanup runs, e.g. the PID file is removed.
+func fail(err error) int {
+	log.Error(err)
+
+	return exitcode.Of(err)
+}
+
+// applyLogLevels sets the level of the logger from -logLevel, or to debug
+// with -debug unless it is more verbose, and the levels of the named loggers
+// from -logLevelOverride; it sets none of them if one is invalid.
+func applyLogLevels(logger *logging.Logger, debug bool, levelName, overridesSpec string) error {
+	level, err := logging.ParseLevel(levelName)
+	if err != nil {
+		return fmt.Errorf("failed to parse -logLevel: %w", err)
+	}
+
+	if debug {
+		level = min(level, log.DebugLevel)
+	}
+
+	overrides, err := logging.ParseOverrides(overridesSpec)
+	if err != nil {
+		return fmt.Errorf("failed to parse -logLevelOverride: %w", err)
+	}
+
+	if err := logger.SetLevels(level, overrides); err != nil {
+		return fmt.Errorf("failed to apply -logLevelOverride: %w", err)
+	}
+
+	return nil
+}
+
+// newStartupBatch returns the startup batch of the enabled sources, which
+// holds the port mappings of the holder, or nil if there is no holder or
+// -startupBatchTimeout disables it.
+func newStartupBatch(holder tracker.Holder) *tracker.StartupBatch {
+	if holder == nil || *startupBatchTimeout <= 0 {
+		return nil
+	}
+
+	var sources []string
+
+	if *enableDocker {
+		sources = append(sources, tracker.SourceDocker)
+	}
+
+	if *enableKubernetes {
+		sources = append(sources, tracker.SourceKubernetes)
 	}
 
 	if *enableIptables {
-		group.Go(func() error {
-			err := iptables.ForwardPorts(ctx, portTracker, iptablesUpdateInterval)
-			if err != nil {
-				return fmt.Errorf("error mapping ports: %w", err)
-			}
+		sources = append(sources, tracker.SourceIptables)
+	}
 
-			return nil
-		})
+	if len(sources) == 0 {
+		return nil
 	}
 
-	if err := group.Wait(); err != nil {
-		log.Fatal(err)
+	return tracker.NewStartupBatch(holder, *startupBatchTimeout, sources...)
+}
+
+// newNudger returns the nudger of the iptables scans, or nil if they are not
+// enabled or -iptablesMaxInterval does not stretch them.
+func newNudger() *tracker.Nudger {
+	if !*enableIptables || *iptablesMaxInterval <= iptablesUpdateInterval {
+		return nil
 	}
 
-	log.Info("Rancher Desktop Agent Shutting Down")
+	return tracker.NewNudger()
 }
 
-func tryConnectAPI(ctx context.Context, socketFile string, verify func(context.Context) error) error {
-	socketRetry := time.NewTicker(socketInterval)
-	defer socketRetry.Stop()
-	// it can potentially take a few minutes to start RD
-	ctxTimeout, cancel := context.WithTimeout(ctx, socketRetryTimeout)
-	defer cancel()
-
-	for {
-		select {
-		case <-ctxTimeout.Done():
-			return fmt.Errorf("tryConnectAPI failed: %w", ctxTimeout.Err())
-		case <-socketRetry.C:
-			log.Debugf("checking if container engine API is running at %s", socketFile)
-
-			if _, err := os.Stat(socketFile); errors.Is(err, os.ErrNotExist) {
-				continue
-			}
+// startupContext returns the context of the subsystem of the source, which
+// reports the end of its initial pass to the startup batch, unless it is nil.
+func startupContext(ctx context.Context, batch *tracker.StartupBatch, source string) context.Context {
+	if batch == nil {
+		return ctx
+	}
+
+	return tracker.ContextWithStartupBatch(ctx, batch, source)
+}
+
+// requiredCapabilities returns the capabilities of the enabled subsystems,
+// root has all of them.
+func requiredCapabilities() []capabilities.Requirement {
+	return capabilities.Required(capabilities.Subsystems{
+		Iptables:   *enableIptables,
+		Docker:     *enableDocker,
+		Containerd: *enableContainerd,
+		Kubernetes: *enableKubernetes,
+		Netns:      *netNamespace != "",
+	})
+}
+
+// scanNamespace returns the network namespace of -netns that the scans run
+// within, it is nil for the one of the agent.
+func scanNamespace() *netns.Namespace {
+	if *netNamespace == "" {
+		return nil
+	}
+
+	return netns.New(*netNamespace)
+}
 
-			if err := verify(ctx); err != nil {
-				log.Errorf("container engine is not ready yet: %v", err)
+// forwardedChains returns the chains of -iptablesChains whose DNAT rules are forwarded.
+func forwardedChains() iptables.Chains {
+	return iptables.Chains{Include: interfaceNames(*iptablesChains)}
+}
+
+// agentCapabilities returns the capabilities that the agent reports to the
+// host from the flags it runs with, besides the ones that it is built with.
+func agentCapabilities() []string {
+	var agentCapabilities []string
+
+	for _, option := range []struct {
+		enabled    bool
+		capability string
+	}{
+		{*enableDocker, types.CapabilityDocker},
+		{*enableContainerd, types.CapabilityContainerd},
+		{*enableKubernetes, types.CapabilityKubernetes},
+		{*enableIptables, types.CapabilityIptables},
+		{!*forwardMirrored, types.CapabilityMirrored},
+	} {
+		if option.enabled {
+			agentCapabilities = append(agentCapabilities, option.capability)
+		}
+	}
+
+	return agentCapabilities
+}
+
+// selectForwarder returns the forwarder that is selected by the -forwarder
+// flag. With -forwarder=auto, it is the first of the forwarders of the
+// platform whose peer answers, see platform.Forwarders, or else the default
+// one for the -privilegedService mode; on WSL, only the Privileged Service
+// is probed for. -dryRun overrides all of them with the no-op forwarder
+// that only logs the port mappings.
+func selectForwarder(ctx context.Context) forwarder.Selection {
+	if *dryRun {
+		log.Infof("dry run, the port mappings are only logged instead of being sent to the host")
+
+		return forwarder.Selection{Kind: forwarder.KindNoop}
+	}
+
+	if *forwarderType != forwarder.KindAuto {
+		return forwarder.Selection{Kind: *forwarderType}
+	}
 
-				continue
+	var selection forwarder.Selection
+
+	kinds := platform.Forwarders(*platformName)
+	if *platformName == platform.WSL && !*enablePrivilegedService {
+		kinds = nil
+	}
+
+	if len(kinds) != 0 {
+		selection.Kind, selection.Probes = forwarder.Probe(ctx, kinds, *vtunnelAddr, forwarderOptions, *forwarderProbeTimeout)
+		if selection.Detected() {
+			log.Infof("selected the %s forwarder, its peer answered first of %v", selection.Kind, kinds)
+
+			return selection
+		}
+	}
+
+	selection.Kind = forwarder.KindAPI
+	if *enablePrivilegedService {
+		selection.Kind = forwarder.KindVTunnel
+	}
+
+	if len(kinds) != 0 {
+		log.Warnf("none of the peers of the forwarders %v answered, falling back to the %s forwarder: %s",
+			kinds, selection.Kind, formatProbes(selection.Probes))
+	}
+
+	return selection
+}
+
+// checkAddrFlags checks the flags that are addresses, e.g. -vtunnelAddr when
+// the forwarder sends the port mappings to it, and -metricsAddr; the errors
+// name the flag, and the format that it expects.
+func checkAddrFlags(forwarderKind string) error {
+	switch forwarderKind {
+	case forwarder.KindVTunnel, forwarder.KindHvsock, forwarder.KindGRPC:
+		if *vtunnelAddr == "" {
+			return fmt.Errorf("%w: -vtunnelAddr is required by the %s forwarder, it must be the peer address "+
+				"in the HOST:PORT or unix:///path/to/socket format, e.g. %s", exitcode.ErrConfig, forwarderKind, vtunnelPeerAddr)
+		}
+
+		// The gRPC forwarder also supports the other schemes of gRPC.
+		if forwarderKind == forwarder.KindGRPC {
+			break
+		}
+
+		for _, peerAddr := range strings.Split(*vtunnelAddr, ",") {
+			if _, _, err := forwarder.ParsePeerAddr(peerAddr); err != nil {
+				return fmt.Errorf("invalid -vtunnelAddr, it must be in the HOST:PORT or unix:///path/to/socket format: %w", err)
 			}
+		}
+	}
+
+	if *metricsAddr != "" {
+		if err := config.CheckListenAddr(*metricsAddr); err != nil {
+			return fmt.Errorf("invalid -metricsAddr: %w", err)
+		}
+	}
+
+	if *pprofAddr != "" {
+		if err := config.CheckListenAddr(*pprofAddr); err != nil {
+			return fmt.Errorf("invalid -pprofAddr: %w", err)
+		}
+
+		if err := checkLoopback(*pprofAddr); err != nil {
+			return fmt.Errorf("%w: -pprofAddr must only bind the loopback interface: %w", exitcode.ErrConfig, err)
+		}
+	}
+
+	if addr := forwarderOptions.Record.Addr; addr != "" && forwarderKind == forwarder.KindRecord {
+		if err := config.CheckListenAddr(addr); err != nil {
+			return fmt.Errorf("invalid -recordAddr: %w", err)
+		}
+
+		if err := checkLoopback(addr); err != nil {
+			return fmt.Errorf("%w: -recordAddr must only bind the loopback interface: %w", exitcode.ErrConfig, err)
+		}
+	}
 
-			return nil
+	if *adminSocket != "" {
+		if _, err := config.SocketPath(*adminSocket); err != nil {
+			return fmt.Errorf("invalid -adminSocket: %w", err)
 		}
 	}
+
+	if *enableKubernetes {
+		if err := checkK8sServiceListenerAddr(*k8sServiceListenerAddr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkK8sServiceListenerAddr checks the address of -k8sServiceListenerAddr.
+func checkK8sServiceListenerAddr(addr string) error {
+	ip := net.ParseIP(addr)
+	if ip == nil || !(ip.IsUnspecified() || ip.Equal(net.IPv4(127, 0, 0, 1)) || ip.Equal(net.IPv6loopback)) {
+		return fmt.Errorf("%w: invalid -k8sServiceListenerAddr %q, valid options are 0.0.0.0, 127.0.0.1, :: and ::1",
+			exitcode.ErrConfig, addr)
+	}
+
+	return nil
 }
 
-// Gets the wsl interface address by doing a lookup by name
-// for wsl we do a lookup for 'eth0'.
-func getWSLAddr(infName string) ([]types.ConnectAddrs, error) {
-	inf, err := net.InterfaceByName(infName)
+// applyPlatformDefaults sets the defaults of the platform, either -platform or the
+// detected one, to the flags that were not set, and records where they come from;
+// it returns the platform.
+func applyPlatformDefaults(origins config.Origins) (string, error) {
+	name, reason, err := platform.NewDetector().Resolve(*platformName)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("invalid -platform: %w", err)
 	}
 
-	addrs, err := inf.Addrs()
+	defaults := platform.Defaults(name)
+	if *platformName == "" {
+		// The detected platform is the default of -platform, so that the reloads keep it.
+		defaults["platform"] = name
+	}
+
+	replaced, err := config.SetDefaults(flag.CommandLine, defaults)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	connectAddrs := make([]types.ConnectAddrs, 0)
+	for _, flagName := range replaced {
+		origins[flagName] = config.OriginPlatform
+	}
 
-	for _, addr := range addrs {
-		connectAddrs = append(connectAddrs, types.ConnectAddrs{
-			Network: addr.Network(),
-			Addr:    addr.String(),
-		})
+	if reason != "" {
+		origins["platform"] = config.Origin(startup.OriginDetected)
+	}
+
+	switch flagNames := flagList(slices.DeleteFunc(replaced, func(flagName string) bool { return flagName == "platform" })); {
+	case reason != "":
+		log.Infof("detected the %s platform, %s; it sets %v, -platform overrides it", name, reason, flagNames)
+	default:
+		log.Infof("running on the %s platform, it sets %v", name, flagNames)
+	}
+
+	return name, nil
+}
+
+// flagList returns the flags with their values, e.g. [-forwarder=api].
+func flagList(flagNames []string) []string {
+	flags := make([]string, 0, len(flagNames))
+	for _, flagName := range flagNames {
+		flags = append(flags, "-"+flagName+"="+flag.Lookup(flagName).Value.String())
+	}
+
+	return flags
+}
+
+// listenerOnlyMode represents when iptables is enabled and privileged services
+// and admin install are disabled; this typically indicates a non-admin installation
+// of the legacy network, requiring listeners only. In listenerOnlyMode, we create
+// TCP listeners on 127.0.0.1 to enable automatic port forwarding mechanisms,
+// particularly in WSLv2 environments.
+func listenerOnlyMode() bool {
+	return *enableIptables && !*enablePrivilegedService && !*adminInstall
+}
+
+// queuedEvents returns the number of the tracker's change events that are
+// waiting in the subscriptions; the subscriptions that are nil are not used.
+func queuedEvents(subscriptions ...*tracker.Subscription) int {
+	var queued int
+	for _, subscription := range subscriptions {
+		if subscription != nil {
+			queued += subscription.Queued()
+		}
+	}
+
+	return queued
+}
+
+// logForwarderMetrics logs how the sends to the host went, for triaging
+// the port mappings that did not make it.
+func logForwarderMetrics(metricsForwarder *forwarder.MetricsForwarder) {
+	snapshot := metricsForwarder.Metrics()
+	log.Infof("forwarder sent %d port mappings in %s, failures: %v, retries: %d, reconnects: %d, latencies: %v",
+		snapshot.Sends, snapshot.LatencySum, snapshot.Failures, snapshot.Retries, snapshot.Reconnects, snapshot.LatencyCounts)
+}
+
+// interfaceNames returns the names of a comma separated flag, e.g. -interface or -iptablesChains.
+func interfaceNames(spec string) []string {
+	var names []string
+
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
 	}
 
-	return connectAddrs, nil
+	return names
 }
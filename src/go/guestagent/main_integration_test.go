@@ -0,0 +1,1540 @@
+//go:build integration
+
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	namespacesapi "github.com/containerd/containerd/api/services/namespaces/v1"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/admin"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/audit"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/diagnostics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/exitcode"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/history"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/scan"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/shutdown"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/startup"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// agentChildEnv is set in the environment of the test binary
+// that TestShutdownIntegration starts to run the agent.
+const agentChildEnv = "RD_GUESTAGENT_TEST_CHILD"
+
+// TestAgentChild runs the agent in the child process of TestShutdownIntegration,
+// which configures it with the environment variables.
+func TestAgentChild(_ *testing.T) {
+	if os.Getenv(agentChildEnv) == "" {
+		return
+	}
+
+	os.Args = os.Args[:1]
+	os.Exit(run())
+}
+
+// fakeKubernetesAPI serves a single NodePort service, the watches never see any change.
+func fakeKubernetesAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.URL.Path != "/api/v1/services" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		if r.URL.Query().Get("watch") == "true" {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+
+			return
+		}
+
+		_, _ = fmt.Fprint(w, `{
+			"kind": "ServiceList",
+			"apiVersion": "v1",
+			"metadata": {"resourceVersion": "1"},
+			"items": [{
+				"metadata": {"name": "nginx", "namespace": "default", "uid": "nginx-uid", "resourceVersion": "1"},
+				"spec": {"type": "NodePort", "ports": [{"protocol": "TCP", "port": 80, "nodePort": 30080}]}
+			}]
+		}`)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// writeKubeconfig writes a kubeconfig for the server and returns its path.
+func writeKubeconfig(t *testing.T, server string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "kubeconfig.yaml")
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: fake
+  cluster:
+    server: %s
+contexts:
+- name: fake
+  context:
+    cluster: fake
+    user: fake
+users:
+- name: fake
+current-context: fake
+`, server)
+	require.NoError(t, os.WriteFile(path, []byte(kubeconfig), 0o600))
+
+	return path
+}
+
+// readRecord returns the port mappings that the record forwarder appended to the file.
+func readRecord(t *testing.T, path string) []types.PortMapping {
+	t.Helper()
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	require.NoError(t, err)
+	defer file.Close()
+
+	var portMappings []types.PortMapping
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var portMapping types.PortMapping
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &portMapping))
+		portMappings = append(portMappings, portMapping)
+	}
+
+	require.NoError(t, scanner.Err())
+
+	return portMappings
+}
+
+// startAgent starts the agent with a fake Kubernetes API server, and waits for
+// the port mapping of its service to be sent; it returns the agent's process,
+// the file that the port mappings are recorded to, and the agent's log, which
+// may only be read once the agent exited.
+func startAgent(t *testing.T, env ...string) (*exec.Cmd, string, *bytes.Buffer) {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("the agent must run as root")
+	}
+
+	if _, err := netif.Select(netif.System(netif.DefaultProcNet), nil); err != nil {
+		t.Skipf("the agent requires a network interface: %v", err)
+	}
+
+	server := fakeKubernetesAPI(t)
+	recordFile := filepath.Join(t.TempDir(), "record.jsonl")
+
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(),
+		agentChildEnv+"=1",
+		// iptables is not found, so that it reports no ports.
+		"PATH="+t.TempDir(),
+		config.EnvName("kubernetes")+"=true",
+		config.EnvName("kubeconfig")+"="+writeKubeconfig(t, server.URL),
+		config.EnvName("privilegedService")+"=true",
+		config.EnvName("forwarder")+"=record",
+		config.EnvName("recordFile")+"="+recordFile,
+		config.EnvName("heartbeatInterval")+"=0",
+		config.EnvName("resyncInterval")+"=0",
+		config.EnvName("addrWatchInterval")+"=0",
+		config.EnvName("pidFile")+"="+filepath.Join(t.TempDir(), "guestagent.pid"),
+		config.EnvName("diagnosticsDir")+"="+t.TempDir(),
+	)
+	cmd.Env = append(cmd.Env, env...)
+
+	var output bytes.Buffer
+
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = io.MultiWriter(os.Stderr, &output)
+	require.NoError(t, cmd.Start())
+
+	t.Cleanup(func() {
+		if cmd.ProcessState == nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}
+	})
+
+	require.Eventually(t, func() bool {
+		return len(readRecord(t, recordFile)) > 0
+	}, 30*time.Second, 100*time.Millisecond, "the port mapping of the service was not sent")
+
+	return cmd, recordFile, &output
+}
+
+// TestVersionIntegration checks that -version prints the build information and exits.
+func TestVersionIntegration(t *testing.T) {
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(), agentChildEnv+"=1", config.EnvName("version")+"=true")
+
+	output, err := cmd.Output()
+	require.NoError(t, err, "the agent did not exit cleanly")
+	assert.Equal(t, version.Get().String()+"\n", string(output))
+	assert.Contains(t, string(output), "version: "+version.Version)
+	assert.Contains(t, string(output), "go version: "+runtime.Version())
+}
+
+// TestShutdownIntegration checks that the port mapping of the
+// service is withdrawn on SIGTERM, and that it is reported.
+func TestShutdownIntegration(t *testing.T) {
+	diagnosticsDir := t.TempDir()
+	cmd, recordFile, output := startAgent(t, config.EnvName("diagnosticsDir")+"="+diagnosticsDir)
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+
+	// The build information is logged at startup.
+	assert.Contains(t, output.String(), "Starting Rancher Desktop Agent ["+version.Get().String()+"]")
+
+	// The summary of the configuration is logged at startup, with where the values come from.
+	assert.Contains(t, output.String(), "starting with the configuration")
+	assert.Contains(t, output.String(), "[kubernetes=enabled (env)]")
+	assert.Contains(t, output.String(), "[docker=disabled (default)]")
+	assert.Contains(t, output.String(), "[forwarder=record (env)]")
+
+	portMappings := readRecord(t, recordFile)
+	require.GreaterOrEqual(t, len(portMappings), 2)
+
+	added, removed := portMappings[0], portMappings[len(portMappings)-1]
+	assert.False(t, added.Remove)
+	assert.True(t, removed.Remove)
+	assert.Contains(t, added.Ports, nat.Port("30080/TCP"))
+	assert.Contains(t, removed.Ports, nat.Port("30080/TCP"))
+
+	// The withdrawal is reported in the log and in the diagnostics directory.
+	assert.Contains(t, output.String(), "shutdown report")
+
+	data, err := os.ReadFile(filepath.Join(diagnosticsDir, shutdown.FileName))
+	require.NoError(t, err)
+
+	var report shutdown.Report
+	require.NoError(t, json.Unmarshal(data, &report))
+	assert.Equal(t, "received a signal: terminated", report.Cause)
+	require.NotEmpty(t, report.Withdrawn)
+	assert.Equal(t, "30080", report.Withdrawn[0].Port)
+	assert.Empty(t, report.Failed)
+	assert.NotEmpty(t, report.Subsystems)
+
+	// The sources are stopped before the port mappings are withdrawn, and the
+	// surfaces once the listeners and the forwarder were closed.
+	phases := make([]string, 0, len(report.Phases))
+	for _, phase := range report.Phases {
+		phases = append(phases, phase.Name)
+		assert.Empty(t, phase.Error, "the %s phase of the shutdown failed", phase.Name)
+	}
+
+	assert.Equal(t, []string{"sources", "withdraw", "listeners", "forwarder", "surfaces"}, phases)
+	assert.Less(t, report.Duration, 10*time.Second)
+}
+
+// TestReloadIntegration checks that the port mapping of the service is
+// withdrawn on SIGHUP once the configuration no longer allows its port.
+func TestReloadIntegration(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "guestagent.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte("allowPorts: 30000-32767\n"), 0o600))
+
+	cmd, recordFile, _ := startAgent(t, config.EnvName(config.FlagName)+"="+configFile)
+
+	require.NoError(t, os.WriteFile(configFile, []byte("allowPorts: 80,443\n"), 0o600))
+	require.NoError(t, cmd.Process.Signal(syscall.SIGHUP))
+
+	require.Eventually(t, func() bool {
+		portMappings := readRecord(t, recordFile)
+
+		return len(portMappings) == 2 && portMappings[1].Remove
+	}, 10*time.Second, 100*time.Millisecond, "the port mapping of the service was not withdrawn")
+
+	assert.Contains(t, readRecord(t, recordFile)[1].Ports, nat.Port("30080/TCP"))
+
+	// Nothing is left to withdraw on the shutdown.
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+	assert.Len(t, readRecord(t, recordFile), 2)
+}
+
+// serveFakeContainerd serves a gRPC server on a unix domain socket, which the
+// containerd client connects to; it only answers the lookup of the namespace
+// that the client makes when it is created. It returns the path of the
+// socket, and whether the client called it.
+func serveFakeContainerd(t *testing.T) (string, *atomic.Bool) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "containerd.sock")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+
+	var called atomic.Bool
+
+	server := grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		called.Store(true)
+
+		var request namespacesapi.GetNamespaceRequest
+		if err := stream.RecvMsg(&request); err != nil {
+			return err
+		}
+
+		return stream.SendMsg(&namespacesapi.GetNamespaceResponse{Namespace: namespacesapi.Namespace{Name: request.Name}})
+	}))
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(server.Stop)
+
+	return path, &called
+}
+
+// TestReloadRestartIntegration checks that changing -containerdSock on SIGHUP
+// restarts the containerd subsystem, and nothing else.
+func TestReloadRestartIntegration(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "guestagent.yaml")
+	oldSock, _ := serveFakeContainerd(t)
+	newSock, newCalled := serveFakeContainerd(t)
+	require.NoError(t, os.WriteFile(configFile, []byte("containerdSock: "+oldSock+"\n"), 0o600))
+
+	cmd, _, output := startAgent(t,
+		config.EnvName(config.FlagName)+"="+configFile,
+		config.EnvName("containerd")+"=true")
+
+	require.NoError(t, os.WriteFile(configFile, []byte("containerdSock: "+newSock+"\n"), 0o600))
+	require.NoError(t, cmd.Process.Signal(syscall.SIGHUP))
+
+	// The restarted subsystem reaches containerd at the new socket.
+	require.Eventually(t, newCalled.Load, 10*time.Second, 100*time.Millisecond, "the new -containerdSock was not used")
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+	assert.Contains(t, output.String(), "applied: [-containerdSock="+newSock+"], restarted: [containerd]")
+	assert.NotContains(t, output.String(), "only apply once the agent is restarted")
+}
+
+// TestBlockPortsIntegration checks that the port mapping of the service is
+// withdrawn on SIGHUP once the configuration blocks its port, even though it is allowed.
+func TestBlockPortsIntegration(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "guestagent.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte("allowPorts: 30000-32767\n"), 0o600))
+
+	cmd, recordFile, output := startAgent(t, config.EnvName(config.FlagName)+"="+configFile)
+
+	require.NoError(t, os.WriteFile(configFile, []byte("allowPorts: 30000-32767\nblockPorts: 30080\n"), 0o600))
+	require.NoError(t, cmd.Process.Signal(syscall.SIGHUP))
+
+	require.Eventually(t, func() bool {
+		portMappings := readRecord(t, recordFile)
+
+		return len(portMappings) == 2 && portMappings[1].Remove
+	}, 10*time.Second, 100*time.Millisecond, "the port mapping of the service was not withdrawn")
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+	assert.Len(t, readRecord(t, recordFile), 2)
+	assert.Contains(t, output.String(), "applied: [-blockPorts=30080]")
+}
+
+// fakePeer is a vtunnel peer that answers the hellos with the host ports that it reserves.
+type fakePeer struct {
+	mutex      sync.Mutex
+	instanceID string
+	reserved   []types.ReservedPorts
+}
+
+// startFakePeer serves the fake peer on a unix domain socket, and returns its -vtunnelAddr.
+func startFakePeer(t *testing.T) (*fakePeer, string) {
+	t.Helper()
+
+	socket := filepath.Join(t.TempDir(), "peer.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	peer := &fakePeer{instanceID: "first"}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go peer.serve(conn)
+		}
+	}()
+
+	return peer, "unix://" + socket
+}
+
+func (p *fakePeer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	payload, err := forwarder.ReadFrame(conn)
+	if err != nil {
+		return
+	}
+
+	var portMapping types.PortMapping
+	if err := json.Unmarshal(payload, &portMapping); err != nil {
+		return
+	}
+
+	p.mutex.Lock()
+	status := types.PeerStatus{InstanceID: p.instanceID}
+
+	if portMapping.Hello != nil {
+		status.ProtocolVersion = types.ProtocolVersion
+		status.Reserved = p.reserved
+	}
+	p.mutex.Unlock()
+
+	bin, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+
+	_ = forwarder.WriteFrame(conn, bin)
+}
+
+// restart makes the peer answer with a new instance ID, and with the reserved ports from then on.
+func (p *fakePeer) restart(instanceID string, reserved ...types.ReservedPorts) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.instanceID = instanceID
+	p.reserved = reserved
+}
+
+// syncBuffer is a buffer that the test may read while the agent writes its log to it.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.buffer.String()
+}
+
+// TestReservedPortsIntegration checks that the listener of the service is
+// closed once the peer reports its port to be reserved, when it is connected to again.
+func TestReservedPortsIntegration(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the agent must run as root")
+	}
+
+	if _, err := netif.Select(netif.System(netif.DefaultProcNet), nil); err != nil {
+		t.Skipf("the agent requires a network interface: %v", err)
+	}
+
+	peer, peerAddr := startFakePeer(t)
+	server := fakeKubernetesAPI(t)
+
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(),
+		agentChildEnv+"=1",
+		"PATH="+t.TempDir(),
+		config.EnvName("kubernetes")+"=true",
+		config.EnvName("kubeconfig")+"="+writeKubeconfig(t, server.URL),
+		config.EnvName("forwarder")+"=vtunnel",
+		config.EnvName("vtunnelAddr")+"="+peerAddr,
+		config.EnvName("heartbeatInterval")+"=100ms",
+		config.EnvName("resyncInterval")+"=0",
+		config.EnvName("addrWatchInterval")+"=0",
+		config.EnvName("pidFile")+"="+filepath.Join(t.TempDir(), "guestagent.pid"),
+	)
+
+	var output syncBuffer
+
+	cmd.Stderr = io.MultiWriter(os.Stderr, &output)
+	require.NoError(t, cmd.Start())
+
+	t.Cleanup(func() {
+		if cmd.ProcessState == nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}
+	})
+
+	listening := func() bool {
+		conn, err := net.DialTimeout("tcp", "127.0.0.1:30080", time.Second)
+		if err != nil {
+			return false
+		}
+
+		conn.Close()
+
+		return true
+	}
+
+	require.Eventually(t, listening, 30*time.Second, 100*time.Millisecond, "the listener of the service was not opened")
+
+	// The heartbeat finds out that the peer restarted, and the hello gets the reserved ports.
+	peer.restart("second", types.ReservedPorts{First: 30000, Last: 30099, Owner: "svchost.exe (PID 4242)"})
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(output.String(), "not forwarding the host port, it is reserved on the host")
+	}, 10*time.Second, 100*time.Millisecond, "the reserved port of the service was not skipped")
+	assert.False(t, listening(), "the listener of the service was not closed")
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+	assert.Contains(t, output.String(), "vtunnel peer reported 1 reserved host port ranges")
+	assert.Regexp(t, `reserved on the host .*\[owner=svchost.exe \(PID 4242\)\]`, output.String())
+}
+
+// TestDiagnosticsIntegration checks that the diagnostics are written on
+// SIGUSR1, and that the agent keeps running afterwards.
+func TestDiagnosticsIntegration(t *testing.T) {
+	diagnosticsDir := t.TempDir()
+	cmd, _, output := startAgent(t, config.EnvName("diagnosticsDir")+"="+diagnosticsDir)
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGUSR1))
+
+	var paths []string
+
+	require.Eventually(t, func() bool {
+		paths, _ = filepath.Glob(filepath.Join(diagnosticsDir, "*.json"))
+
+		return len(paths) == 1
+	}, 10*time.Second, 100*time.Millisecond, "the diagnostics were not written")
+
+	data, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+
+	var bundle diagnostics.Bundle
+	require.NoError(t, json.Unmarshal(data, &bundle))
+	assert.Equal(t, "true", bundle.Config["kubernetes"])
+	require.Len(t, bundle.Ports, 1)
+	assert.Contains(t, bundle.Ports[0].Ports, nat.Port("30080/TCP"))
+	// The port mapping tells the service that it was added for.
+	assert.Equal(t, &tracker.Origin{Kind: tracker.OriginService, ID: "nginx-uid", Namespace: "default", Name: "nginx"},
+		bundle.Ports[0].Origin)
+	assert.NotEmpty(t, bundle.Subsystems)
+	assert.Contains(t, bundle.Goroutines, "goroutine ")
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+	assert.Contains(t, output.String(), "wrote the diagnostics to "+paths[0])
+}
+
+// TestLogFieldsIntegration checks that the port mapping of the service is
+// logged with the fields that the log lines of all the packages share.
+func TestLogFieldsIntegration(t *testing.T) {
+	cmd, _, output := startAgent(t, config.EnvName("logLevel")+"=debug")
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+
+	assert.Contains(t, output.String(), "create port mapping [port=30080][proto=tcp]\n")
+	assert.Regexp(t, `kubernetes service: port mapping added \[correlationID=\w+\]\[id=nginx-uid\]\[ports=.*\]`+
+		`\[service=default/nginx\]\[source=kubernetes\]\n`, output.String())
+	assert.Regexp(t, `adding the port mapping \[correlationID=\w+\]\[id=nginx-uid\]\[source=kubernetes\]\n`, output.String())
+}
+
+// TestSummaryIntegration checks that the summaries of the forwarding state are logged periodically.
+func TestSummaryIntegration(t *testing.T) {
+	cmd, _, output := startAgent(t, config.EnvName("summaryInterval")+"=100ms")
+
+	// The port mapping of the service was sent, the next summaries have it.
+	time.Sleep(500 * time.Millisecond)
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+	assert.Contains(t, output.String(), "forwarding summary: ports [kubernetes=1/TCP]")
+	assert.Contains(t, output.String(), ", origins [30080/TCP=service:default/nginx], ")
+	assert.Contains(t, output.String(), "forwarder connected, last sent ")
+	assert.Contains(t, output.String(), "kubernetes=running")
+}
+
+// TestAuditLogIntegration checks that the forwarding and the withdrawal
+// of the port mapping of the service are recorded in the audit log.
+func TestAuditLogIntegration(t *testing.T) {
+	auditLog := filepath.Join(t.TempDir(), "audit.jsonl")
+	cmd, _, _ := startAgent(t, config.EnvName("auditLog")+"="+auditLog, config.EnvName("auditSync")+"=true")
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+
+	data, err := os.ReadFile(auditLog)
+	require.NoError(t, err)
+
+	var changes []string
+
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var record audit.Record
+		require.NoError(t, json.Unmarshal([]byte(line), &record), line)
+
+		if record.Port == "30080" {
+			assert.Equal(t, tracker.SourceKubernetes, record.Source)
+			changes = append(changes, record.Action+" "+record.Outcome)
+		}
+	}
+
+	assert.Equal(t, []string{"add tracked", "add sent", "remove tracked", "remove sent"}, changes)
+}
+
+// TestAdminIntegration checks that the admin API serves the port mapping
+// of the service, and that its socket is removed on the shutdown.
+func TestAdminIntegration(t *testing.T) {
+	adminSocket := filepath.Join(t.TempDir(), "admin.sock")
+
+	cmd, _, output := startAgent(t, config.EnvName("adminSocket")+"="+adminSocket)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", adminSocket)
+			},
+		},
+	}
+
+	var entries []tracker.Entry
+
+	require.Eventually(t, func() bool {
+		res, err := client.Get("http://agent/ports")
+		if err != nil {
+			return false
+		}
+		defer res.Body.Close()
+
+		return json.NewDecoder(res.Body).Decode(&entries) == nil
+	}, 10*time.Second, 100*time.Millisecond, "the admin API is not served")
+
+	require.Len(t, entries, 1)
+	assert.Equal(t, tracker.SourceKubernetes, entries[0].Source)
+	assert.Contains(t, entries[0].Ports, nat.Port("30080/TCP"))
+
+	res, err := client.Get("http://agent/config")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	var effective map[string]string
+
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&effective))
+	assert.Equal(t, adminSocket, effective["adminSocket"])
+
+	// The kubernetes subsystem reported the event of the service.
+	res, err = client.Get("http://agent/status")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	var status admin.Status
+
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&status))
+
+	subsystems := make(map[string]supervisor.Status, len(status.Subsystems))
+	for _, subsystem := range status.Subsystems {
+		subsystems[subsystem.Name] = subsystem
+	}
+
+	require.Contains(t, subsystems, "kubernetes")
+	assert.Equal(t, supervisor.StateRunning, subsystems["kubernetes"].State)
+	assert.False(t, subsystems["kubernetes"].LastSuccess.IsZero(), "the kubernetes subsystem reported no success")
+
+	// The history holds the addition of the service's port mapping.
+	res, err = client.Get("http://agent/events?since=1m&limit=10")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	var records []history.Record
+
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&records))
+	require.NotEmpty(t, records)
+	assert.Equal(t, history.KindTracker, records[0].Kind)
+	assert.Equal(t, string(tracker.ActionAdd), records[0].Action)
+	assert.Equal(t, tracker.SourceKubernetes, records[0].Source)
+
+	// The debug logs of the shutdown are written once the level is lowered.
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPut, "http://agent/loglevel",
+		strings.NewReader(`{"level": "debug"}`))
+	require.NoError(t, err)
+
+	res, err = client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+	assert.Contains(t, output.String(), "the admin API changed the log level from info map[] to debug map[]")
+	assert.Contains(t, output.String(), "[DEBUG]")
+
+	_, err = os.Stat(adminSocket)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+// freeAddr returns a loopback address whose port is free.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	return listener.Addr().String()
+}
+
+// TestMetricsIntegration checks that the metrics of the port mapping
+// of the service are served.
+func TestMetricsIntegration(t *testing.T) {
+	metricsAddr := freeAddr(t)
+
+	cmd, _, _ := startAgent(t, config.EnvName("metricsAddr")+"="+metricsAddr)
+
+	var body []byte
+
+	require.Eventually(t, func() bool {
+		res, err := http.Get("http://" + metricsAddr + "/metrics") //nolint:noctx // the test gives up on its own.
+		if err != nil {
+			return false
+		}
+		defer res.Body.Close()
+
+		body, err = io.ReadAll(res.Body)
+
+		// The latency of the port is measured once the host confirmed it.
+		return err == nil && res.StatusCode == http.StatusOK &&
+			strings.Contains(string(body), "\nrd_guestagent_port_latency_seconds_count{source=\"kubernetes\"} 1\n")
+	}, 10*time.Second, 100*time.Millisecond, "the metrics are not served")
+
+	assert.Contains(t, string(body), "\nrd_guestagent_tracked_ports{source=\"kubernetes\"} 1\n")
+	assert.Contains(t, string(body), "\nrd_guestagent_port_adds_total{source=\"kubernetes\"} 1\n")
+	assert.Contains(t, string(body), "\nrd_guestagent_port_changes_total{source=\"kubernetes\",action=\"add\",outcome=\"ok\"} 1\n")
+	assert.Contains(t, string(body), "\nrd_guestagent_forwarder_sends_total ")
+	assert.Contains(t, string(body), "\nrd_guestagent_forward_latency_seconds_count ")
+	assert.Contains(t, string(body), "\nrd_guestagent_subsystem_up{subsystem=\"kubernetes\"} 1\n")
+	assert.Contains(t, string(body), "\nrd_guestagent_kubernetes_watch_reconnects_total 0\n")
+
+	// The profiles are not served unless -pprofAddr is set.
+	res, err := http.Get("http://" + metricsAddr + "/debug/pprof/heap") //nolint:noctx // the test gives up on its own.
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// The core counters are also served with expvar.
+	res, err = http.Get("http://" + metricsAddr + "/debug/vars") //nolint:noctx // the test gives up on its own.
+	require.NoError(t, err)
+
+	var vars map[string]json.RawMessage
+	err = json.NewDecoder(res.Body).Decode(&vars)
+	res.Body.Close()
+	require.NoError(t, err)
+
+	var published map[string]int64
+	require.NoError(t, json.Unmarshal(vars[metrics.VarsName], &published))
+	assert.Equal(t, int64(1), published[metrics.VarTrackedPorts])
+	assert.Positive(t, published[metrics.VarForwarderSends])
+	assert.Contains(t, published, metrics.VarEventQueueDepth)
+	assert.Equal(t, int64(1), published[metrics.VarTrackedEntries])
+	assert.Positive(t, published[metrics.VarGoroutines])
+	assert.Contains(t, published, metrics.VarMapCompactions)
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+}
+
+// TestPprofIntegration checks that the profiles are served on their own
+// address, and alongside the metrics when they are given the same one.
+func TestPprofIntegration(t *testing.T) {
+	pprofAddr, sharedAddr := freeAddr(t), freeAddr(t)
+
+	// getOK returns true once the URL answers.
+	getOK := func(url string) func() bool {
+		return func() bool {
+			res, err := http.Get(url) //nolint:noctx // the test gives up on its own.
+			if err != nil {
+				return false
+			}
+			res.Body.Close()
+
+			return res.StatusCode == http.StatusOK
+		}
+	}
+
+	cmd, _, _ := startAgent(t, config.EnvName("pprofAddr")+"="+pprofAddr)
+
+	require.Eventually(t, getOK("http://"+pprofAddr+"/debug/pprof/heap"), 10*time.Second, 100*time.Millisecond,
+		"the profiles are not served")
+
+	// There is no listener for the metrics, which are not enabled.
+	_, err := net.Dial("tcp", sharedAddr)
+	require.Error(t, err)
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+
+	// The listener is closed with the agent.
+	_, err = net.Dial("tcp", pprofAddr)
+	require.Error(t, err)
+
+	cmd, _, _ = startAgent(t, config.EnvName("metricsAddr")+"="+sharedAddr, config.EnvName("pprofAddr")+"="+sharedAddr)
+
+	require.Eventually(t, getOK("http://"+sharedAddr+"/debug/pprof/heap"), 10*time.Second, 100*time.Millisecond,
+		"the profiles are not served alongside the metrics")
+	assert.True(t, getOK("http://"+sharedAddr+"/metrics")())
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+}
+
+// TestPprofLoopbackIntegration checks that the agent refuses to serve the
+// profiles on the addresses that are reachable from outside of the VM.
+func TestPprofLoopbackIntegration(t *testing.T) {
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(), agentChildEnv+"=1", config.EnvName("pprofAddr")+"=0.0.0.0:6060")
+
+	output, err := cmd.CombinedOutput()
+	assert.Equal(t, exitcode.Config, exitCode(t, err))
+	assert.Contains(t, string(output), "-pprofAddr must only bind the loopback interface")
+}
+
+// TestRecordAddrIntegration checks that the port mappings that the record
+// forwarder sent are served at /sent of -recordAddr, and cleared by DELETE.
+func TestRecordAddrIntegration(t *testing.T) {
+	recordAddr := freeAddr(t)
+
+	cmd, recordFile, _ := startAgent(t, config.EnvName("recordAddr")+"="+recordAddr)
+
+	var sent []types.PortMapping
+
+	require.Eventually(t, func() bool {
+		res, err := http.Get("http://" + recordAddr + "/sent") //nolint:noctx // the test gives up on its own.
+		if err != nil {
+			return false
+		}
+		defer res.Body.Close()
+
+		return res.StatusCode == http.StatusOK && json.NewDecoder(res.Body).Decode(&sent) == nil && len(sent) > 0
+	}, 10*time.Second, 100*time.Millisecond, "the recorded port mappings are not served")
+
+	assert.Contains(t, sent[0].Ports, nat.Port("30080/TCP"))
+	assert.Equal(t, readRecord(t, recordFile)[:len(sent)], sent)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodDelete, "http://"+recordAddr+"/sent", nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	res, err = http.Get("http://" + recordAddr + "/sent") //nolint:noctx // the test gives up on its own.
+	require.NoError(t, err)
+	err = json.NewDecoder(res.Body).Decode(&sent)
+	res.Body.Close()
+	require.NoError(t, err)
+	assert.Empty(t, sent)
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+}
+
+// TestAddrFlagsIntegration checks that the agent refuses to start with the
+// malformed addresses, naming the flag, instead of failing when it uses them.
+func TestAddrFlagsIntegration(t *testing.T) {
+	for _, test := range []struct {
+		env     []string
+		message string
+	}{
+		{
+			env:     []string{config.EnvName("forwarder") + "=vtunnel", config.EnvName("vtunnelAddr") + "="},
+			message: "-vtunnelAddr is required by the vtunnel forwarder",
+		},
+		{
+			env:     []string{config.EnvName("forwarder") + "=vtunnel", config.EnvName("vtunnelAddr") + "=127.0.0.1:70000"},
+			message: "invalid -vtunnelAddr",
+		},
+		{
+			env:     []string{config.EnvName("metricsAddr") + "=http://127.0.0.1:9311"},
+			message: "invalid -metricsAddr",
+		},
+		{
+			env:     []string{config.EnvName("adminSocket") + "=tcp://127.0.0.1:3040"},
+			message: "invalid -adminSocket",
+		},
+		{
+			env: []string{
+				config.EnvName("forwarder") + "=record", config.EnvName("recordFile") + "=" + filepath.Join(t.TempDir(), "record.jsonl"),
+				config.EnvName("recordAddr") + "=0.0.0.0:9312",
+			},
+			message: "-recordAddr must only bind the loopback interface",
+		},
+		{
+			env:     []string{config.EnvName("kubernetes") + "=true", config.EnvName("k8sServiceListenerAddr") + "=192.0.2.1"},
+			message: "invalid -k8sServiceListenerAddr",
+		},
+	} {
+		//nolint:gosec // the test binary runs itself.
+		cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+		cmd.Env = append(os.Environ(), agentChildEnv+"=1", config.EnvName("pidFile")+"="+filepath.Join(t.TempDir(), "guestagent.pid"))
+		cmd.Env = append(cmd.Env, test.env...)
+
+		output, err := cmd.CombinedOutput()
+		assert.Equal(t, exitcode.Config, exitCode(t, err), test.env)
+		assert.Contains(t, string(output), test.message)
+	}
+}
+
+// TestExitCodesIntegration checks that the agent exits with the code of the
+// failure, and still removes its PID file.
+func TestExitCodesIntegration(t *testing.T) {
+	for _, test := range []struct {
+		env  []string
+		code int
+	}{
+		{
+			env:  []string{config.EnvName("sendRate") + "=10", config.EnvName("batchWindow") + "=0"},
+			code: exitcode.Config,
+		},
+		{
+			// The wsl-proxy socket does not exist outside of WSL.
+			env:  []string{config.EnvName("forwarder") + "=api", config.EnvName("kubernetes") + "=true"},
+			code: exitcode.Unreachable,
+		},
+		{
+			env:  []string{config.EnvName("platform") + "=wsl2"},
+			code: exitcode.Config,
+		},
+	} {
+		pidFile := filepath.Join(t.TempDir(), "guestagent.pid")
+
+		//nolint:gosec // the test binary runs itself.
+		cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+		cmd.Env = append(os.Environ(), agentChildEnv+"=1", config.EnvName("pidFile")+"="+pidFile)
+		cmd.Env = append(cmd.Env, test.env...)
+
+		output, err := cmd.CombinedOutput()
+		assert.Equal(t, test.code, exitCode(t, err), string(output))
+		assert.NoFileExists(t, pidFile)
+	}
+}
+
+// TestPeerTimeoutIntegration checks that the agent exits with the code of an
+// unreachable host when the peer of its forwarder is not reached in time.
+func TestPeerTimeoutIntegration(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the agent must run as root")
+	}
+
+	if _, err := netif.Select(netif.System(netif.DefaultProcNet), nil); err != nil {
+		t.Skipf("the agent requires a network interface: %v", err)
+	}
+
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(),
+		agentChildEnv+"=1",
+		config.EnvName("forwarder")+"=vtunnel",
+		// Nothing listens on the address once freeAddr returned.
+		config.EnvName("vtunnelAddr")+"="+freeAddr(t),
+		config.EnvName("peerTimeout")+"=300ms",
+		config.EnvName("pidFile")+"="+filepath.Join(t.TempDir(), "guestagent.pid"),
+	)
+
+	output, err := cmd.CombinedOutput()
+	assert.Equal(t, exitcode.Unreachable, exitCode(t, err), string(output))
+	assert.Contains(t, string(output), "the peer of the forwarder was not reached within 300ms")
+}
+
+// TestPrivilegeIntegration checks that the agent exits with the code of the
+// missing privileges when it runs without the capabilities of its subsystems.
+func TestPrivilegeIntegration(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the agent must be started as root to drop its privileges")
+	}
+
+	// The test binary is copied to a directory that nobody may enter.
+	dir, err := os.MkdirTemp("", "guestagent")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	require.NoError(t, os.Chmod(dir, 0o755))
+
+	binary, err := os.ReadFile(os.Args[0])
+	require.NoError(t, err)
+
+	agent := filepath.Join(dir, "agent.test")
+	require.NoError(t, os.WriteFile(agent, binary, 0o755)) //nolint:gosec // nobody must be able to run the copy.
+
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(agent, "-test.run=^TestAgentChild$")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), agentChildEnv+"=1", config.EnvName("iptables")+"=true")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}}
+
+	output, err := cmd.CombinedOutput()
+	assert.Equal(t, exitcode.Privilege, exitCode(t, err), string(output))
+	assert.Contains(t, string(output), "insufficient privileges: refusing to start: missing capabilities")
+}
+
+// TestPlatformIntegration checks that the defaults of -platform apply to the
+// flags that are not set, and that the flags that are set are kept.
+func TestPlatformIntegration(t *testing.T) {
+	if _, err := net.InterfaceByName("eth0"); err != nil {
+		t.Skipf("the WSL defaults select eth0: %v", err)
+	}
+
+	cmd, _, output := startAgent(t, config.EnvName("platform")+"=wsl")
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+
+	assert.Contains(t, output.String(), "running on the wsl platform, it sets [-interface=eth0 -wellKnownPorts=135=RPC Endpoint Mapper,")
+	assert.Contains(t, output.String(), "[platform=wsl (env)]")
+	assert.Regexp(t, `\[interface=eth0=\S+ \(platform\)\]`, output.String())
+
+	// On Lima, the forwarder is probed for, but it is set here.
+	cmd, _, output = startAgent(t, config.EnvName("platform")+"=lima")
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+
+	assert.Contains(t, output.String(), "running on the lima platform, it sets [-wellKnownPorts=445=SMB File Sharing,")
+	assert.Contains(t, output.String(), "[forwarder=record (env)]")
+}
+
+// TestPrintConfigIntegration checks that -printConfig prints the layered
+// configuration with where each value comes from, without starting anything.
+func TestPrintConfigIntegration(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "guestagent.yaml")
+	require.NoError(t, os.WriteFile(configFile, []byte("batchWindow: 250ms\ndocker: true\n"), 0o600))
+	pidFile := filepath.Join(t.TempDir(), "guestagent.pid")
+
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(),
+		agentChildEnv+"=1",
+		config.EnvName("printConfig")+"=json",
+		config.EnvName(config.FlagName)+"="+configFile,
+		config.EnvName("docker")+"=false",
+		config.EnvName("platform")+"=lima",
+		config.EnvName("vtunnelTLSKey")+"=/etc/rancher-desktop/client.key",
+		config.EnvName("pidFile")+"="+pidFile,
+	)
+
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.NoFileExists(t, pidFile)
+
+	var settings map[string]config.Setting
+	require.NoError(t, json.Unmarshal(output, &settings), string(output))
+	assert.Equal(t, config.Setting{Value: "250ms", Origin: config.OriginConfig}, settings["batchWindow"])
+	// The environment takes precedence over the file.
+	assert.Equal(t, config.Setting{Value: "false", Origin: config.OriginEnv}, settings["docker"])
+	assert.Equal(t, config.Setting{Value: "lima", Origin: config.OriginEnv}, settings["platform"])
+	// None of the forwarders of Lima answer, the agent falls back to the API forwarder.
+	assert.Equal(t, config.Setting{Value: "api", Origin: startup.OriginDetected}, settings["forwarder"])
+	assert.Equal(t, config.Setting{Value: config.Redacted, Origin: config.OriginEnv}, settings["vtunnelTLSKey"])
+	assert.Equal(t, config.Setting{Value: "true", Origin: config.OriginDefault}, settings["iptables"])
+
+	// The network interface is detected for the forwarders that send its addresses.
+	//nolint:gosec // the test binary runs itself.
+	cmd = exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(), agentChildEnv+"=1", config.EnvName("printConfig")+"=yaml", config.EnvName("forwarder")+"=record")
+
+	output, err = cmd.Output()
+	require.NoError(t, err)
+	assert.Contains(t, string(output), "forwarder: record # env\n")
+	assert.Regexp(t, `(?m)^interface: \S+ # auto-detect$`, string(output))
+}
+
+// exitCode returns the exit code of the agent that failed with err.
+func exitCode(t *testing.T, err error) int {
+	t.Helper()
+
+	var exitErr *exec.ExitError
+	require.ErrorAs(t, err, &exitErr)
+
+	return exitErr.ExitCode()
+}
+
+// TestInterfaceTimeoutIntegration checks that the agent gives up on a network
+// interface that never comes up, and suggests selecting it.
+func TestInterfaceTimeoutIntegration(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("the agent must run as root")
+	}
+
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(),
+		agentChildEnv+"=1",
+		config.EnvName("forwarder")+"=record",
+		config.EnvName("recordFile")+"="+filepath.Join(t.TempDir(), "record.jsonl"),
+		config.EnvName("pidFile")+"="+filepath.Join(t.TempDir(), "guestagent.pid"),
+		config.EnvName("interface")+"=rd-missing0",
+		config.EnvName("interfaceTimeout")+"=100ms",
+	)
+
+	output, err := cmd.CombinedOutput()
+	assert.Equal(t, exitcode.Failure, exitCode(t, err))
+	assert.Contains(t, string(output), "the network interface did not come up with an address within 100ms")
+	assert.Contains(t, string(output), "no network interface found named rd-missing0")
+}
+
+// TestOnceIntegration checks that -once prints the port mappings of the enabled
+// subsystems and the failures of the others, and exits without sending a snapshot
+// that would leave out the port mappings of the failed ones.
+func TestOnceIntegration(t *testing.T) {
+	server := fakeKubernetesAPI(t)
+	recordFile := filepath.Join(t.TempDir(), "record.jsonl")
+
+	// iptables fails, so that it can not be listed.
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "iptables"), []byte("#!/bin/sh\nexit 1\n"), 0o700))
+
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(),
+		agentChildEnv+"=1",
+		"PATH="+bin,
+		config.EnvName("once")+"=true",
+		config.EnvName("kubernetes")+"=true",
+		config.EnvName("kubeconfig")+"="+writeKubeconfig(t, server.URL),
+		config.EnvName("forwarder")+"=record",
+		config.EnvName("recordFile")+"="+recordFile,
+	)
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	require.NoError(t, err)
+
+	var result scan.Result
+	require.NoError(t, json.Unmarshal(output, &result))
+	assert.Equal(t, version.Get().Version, result.Version)
+	require.Len(t, result.Sources, 2)
+
+	assert.Equal(t, tracker.SourceIptables, result.Sources[0].Name)
+	assert.NotEmpty(t, result.Sources[0].Error)
+	assert.Empty(t, result.Sources[0].Entries)
+
+	assert.Equal(t, scan.SourceResult{
+		Name: tracker.SourceKubernetes,
+		Entries: []scan.Entry{{
+			ID:    "default/nginx",
+			Ports: nat.PortMap{"30080/TCP": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "30080"}}},
+		}},
+	}, result.Sources[1])
+
+	require.NotNil(t, result.Snapshot)
+	assert.Equal(t, scan.Snapshot{
+		Forwarder: "record",
+		Error:     "the snapshot is not sent since [iptables] could not be listed",
+	}, *result.Snapshot)
+	assert.Empty(t, readRecord(t, recordFile))
+
+	// The snapshot is sent once all the enabled subsystems are listed.
+	if _, err := netif.Select(netif.System(netif.DefaultProcNet), nil); err != nil {
+		t.Skipf("the snapshot requires a network interface: %v", err)
+	}
+
+	env := slices.Concat(cmd.Env, []string{config.EnvName("iptables") + "=false"})
+
+	//nolint:gosec // the test binary runs itself.
+	cmd = exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+
+	output, err = cmd.Output()
+	require.NoError(t, err)
+
+	result = scan.Result{}
+	require.NoError(t, json.Unmarshal(output, &result))
+	assert.Equal(t, &scan.Snapshot{Forwarder: "record"}, result.Snapshot)
+
+	portMappings := readRecord(t, recordFile)
+	require.Len(t, portMappings, 1)
+	assert.True(t, portMappings[0].Replace)
+	assert.Equal(t, result.Sources[0].Entries[0].Ports, portMappings[0].Ports)
+}
+
+// replay replays the events of the recording with -replayEvents, and returns the port mappings that it printed.
+func replay(t *testing.T, recording string) replayResult {
+	t.Helper()
+
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(),
+		agentChildEnv+"=1",
+		config.EnvName("replayEvents")+"="+recording,
+		config.EnvName("replaySpeed")+"=100",
+		// The Kubernetes services are forwarded rather than listened on.
+		config.EnvName("iptables")+"=false",
+		config.EnvName("pidFile")+"="+filepath.Join(t.TempDir(), "guestagent.pid"),
+	)
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	require.NoError(t, err)
+
+	var result replayResult
+	require.NoError(t, json.Unmarshal(output, &result), string(output))
+
+	return result
+}
+
+// TestReplayEventsIntegration checks that the bundled recording is replayed
+// to the port mappings that its events leave, and that the events that the
+// agent records are replayed to the port mappings that it forwarded.
+func TestReplayEventsIntegration(t *testing.T) {
+	result := replay(t, filepath.Join("testdata", "events.jsonl"))
+
+	// web stopped and redis was deleted, the binding of db without a host port is dropped.
+	require.Len(t, result.Entries, 2)
+	assert.Equal(t, "0b6f1c2e-nginx", result.Entries[0].ID)
+	assert.Equal(t, tracker.SourceKubernetes, result.Entries[0].Source)
+	assert.Equal(t, nat.PortMap{"30080/TCP": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "30080"}}}, result.Entries[0].Ports)
+	assert.Equal(t, "db", result.Entries[1].ID)
+	assert.Equal(t, tracker.SourceDocker, result.Entries[1].Source)
+	assert.Equal(t, nat.PortMap{"5432/tcp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "5432"}}}, result.Entries[1].Ports)
+	assert.Empty(t, result.Listeners)
+
+	recording := filepath.Join(t.TempDir(), "events.jsonl")
+
+	cmd, _, _ := startAgent(t, config.EnvName("recordEvents")+"="+recording)
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+
+	result = replay(t, recording)
+	require.Len(t, result.Entries, 1)
+	assert.Equal(t, tracker.SourceKubernetes, result.Entries[0].Source)
+	assert.Equal(t, nat.PortMap{"30080/TCP": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "30080"}}}, result.Entries[0].Ports)
+}
+
+// TestSelftestIntegration checks that -selftest reports the checks of the
+// enabled subsystems, and exits with a failure when one of them fails.
+func TestSelftestIntegration(t *testing.T) {
+	if _, err := netif.Select(netif.System(netif.DefaultProcNet), nil); err != nil {
+		t.Skipf("the self-test requires a network interface: %v", err)
+	}
+
+	server := fakeKubernetesAPI(t)
+	recordFile := filepath.Join(t.TempDir(), "record.jsonl")
+
+	// iptables fails, so that its check fails.
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "iptables"), []byte("#!/bin/sh\nexit 1\n"), 0o700))
+
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(),
+		agentChildEnv+"=1",
+		"PATH="+bin,
+		config.EnvName("selftest")+"=true",
+		config.EnvName("kubernetes")+"=true",
+		config.EnvName("kubeconfig")+"="+writeKubeconfig(t, server.URL),
+		config.EnvName("forwarder")+"=record",
+		config.EnvName("recordFile")+"="+recordFile,
+	)
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	assert.Equal(t, exitcode.Failure, exitCode(t, err))
+
+	assert.Regexp(t, `(?m)^PASS  capabilities$`, string(output))
+	assert.Regexp(t, `(?m)^FAIL  iptables +.+\n +hint: check that the iptables binary is in PATH`, string(output))
+	assert.Regexp(t, `(?m)^SKIP  docker API +disabled with -docker=false$`, string(output))
+	assert.Regexp(t, `(?m)^PASS  kubeconfig +`+regexp.QuoteMeta(server.URL)+`$`, string(output))
+	assert.Regexp(t, `(?m)^PASS  kubernetes API +1 services$`, string(output))
+	assert.Regexp(t, `(?m)^PASS  forwarder +record, forwarded and withdrew the test port 64999/tcp$`, string(output))
+	assert.Contains(t, string(output), "\n1 of the checks failed: iptables\n")
+
+	portMappings := readRecord(t, recordFile)
+	require.Len(t, portMappings, 2)
+	assert.False(t, portMappings[0].Remove)
+	assert.True(t, portMappings[1].Remove)
+	assert.Contains(t, portMappings[0].Ports, nat.Port("64999/tcp"))
+
+	// The self-test passes once the failing subsystem is disabled.
+	env := slices.Concat(cmd.Env, []string{config.EnvName("iptables") + "=false"})
+
+	//nolint:gosec // the test binary runs itself.
+	cmd = exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = env
+	cmd.Stderr = os.Stderr
+
+	output, err = cmd.Output()
+	require.NoError(t, err)
+	assert.Regexp(t, `(?m)^SKIP  iptables +disabled with -iptables=false$`, string(output))
+	assert.Contains(t, string(output), "\nall the checks passed\n")
+}
+
+// TestReadinessIntegration checks that the ready file is written and systemd
+// is notified once the agent is ready, and that both are withdrawn on SIGTERM.
+func TestReadinessIntegration(t *testing.T) {
+	readyFile := filepath.Join(t.TempDir(), "ready")
+	notifySocket := filepath.Join(t.TempDir(), "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: notifySocket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// receive returns the next notification of the agent.
+	receive := func() string {
+		buf := make([]byte, 4096)
+
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)))
+		n, err := conn.Read(buf)
+		require.NoError(t, err, "systemd was not notified")
+
+		return string(buf[:n])
+	}
+
+	cmd, _, _ := startAgent(t, config.EnvName("readyFile")+"="+readyFile, "NOTIFY_SOCKET="+notifySocket)
+
+	// The record forwarder has no peer, the agent is ready once the kubernetes subsystem runs.
+	for message := receive(); message != "READY=1\nSTATUS=ready"; message = receive() {
+		assert.Contains(t, message, "STATUS=not ready")
+	}
+
+	assert.FileExists(t, readyFile)
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	assert.Equal(t, "STOPPING=1\nSTATUS=stopping", receive())
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+	assert.NoFileExists(t, readyFile)
+}
+
+// TestPidFileIntegration checks that a second agent refuses to start while
+// the first one runs, and that the PID file is removed on SIGTERM.
+func TestPidFileIntegration(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "guestagent.pid")
+
+	cmd, _, _ := startAgent(t, config.EnvName("pidFile")+"="+pidFile)
+
+	data, err := os.ReadFile(pidFile)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("%d\n", cmd.Process.Pid), string(data))
+
+	//nolint:gosec // the test binary runs itself.
+	second := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	second.Env = append(os.Environ(), agentChildEnv+"=1", config.EnvName("pidFile")+"="+pidFile)
+
+	output, err := second.CombinedOutput()
+	assert.Equal(t, exitcode.Failure, exitCode(t, err))
+	assert.Contains(t, string(output), fmt.Sprintf("another instance of the agent is running with PID %d", cmd.Process.Pid))
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+	assert.NoFileExists(t, pidFile)
+}
+
+// TestLogFormatIntegration checks that every line is a JSON object with -logFormat=json.
+func TestLogFormatIntegration(t *testing.T) {
+	cmd, _, output := startAgent(t, config.EnvName("logFormat")+"=json")
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+
+	var messages []string
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		var line struct {
+			Time  string `json:"time"`
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+		}
+
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line), scanner.Text())
+		assert.NotEmpty(t, line.Time)
+		assert.NotEmpty(t, line.Level)
+
+		messages = append(messages, line.Msg)
+	}
+
+	assert.Contains(t, messages, "Rancher Desktop Agent Shutting Down")
+}
+
+// TestLogFileIntegration checks that the agent logs to the file,
+// and that it reopens the file that was renamed on SIGHUP.
+func TestLogFileIntegration(t *testing.T) {
+	logFile := filepath.Join(t.TempDir(), "guestagent.log")
+
+	cmd, _, output := startAgent(t, config.EnvName("logFile")+"="+logFile)
+
+	data, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "Starting Rancher Desktop Agent")
+	assert.NotContains(t, output.String(), "Starting Rancher Desktop Agent")
+
+	// An external tool rotates the file.
+	require.NoError(t, os.Rename(logFile, logFile+".old"))
+	require.NoError(t, cmd.Process.Signal(syscall.SIGHUP))
+
+	require.Eventually(t, func() bool {
+		data, err := os.ReadFile(logFile)
+
+		return err == nil && bytes.Contains(data, []byte("reloading the configuration"))
+	}, 10*time.Second, 100*time.Millisecond, "the log file was not reopened")
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+
+	data, err = os.ReadFile(logFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "Rancher Desktop Agent Shutting Down")
+}
+
+// TestLogLevelIntegration checks that the level of a subsystem overrides the one of the agent.
+func TestLogLevelIntegration(t *testing.T) {
+	cmd, _, output := startAgent(t,
+		config.EnvName("logFormat")+"=json",
+		config.EnvName("logLevel")+"=warn",
+		config.EnvName("logLevelOverride")+"=tracker=debug")
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the agent did not shut down cleanly")
+
+	trackerDebug := 0
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		var line struct {
+			Level  string `json:"level"`
+			Logger string `json:"logger"`
+		}
+
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line), scanner.Text())
+
+		switch {
+		case line.Logger == "tracker" && line.Level == "debug":
+			trackerDebug++
+		case line.Logger != "tracker":
+			assert.Contains(t, []string{"warn", "error"}, line.Level, scanner.Text())
+		}
+	}
+
+	assert.Positive(t, trackerDebug, "the tracker did not log at the debug level")
+
+	// The overrides of the unknown subsystems are refused.
+	//nolint:gosec // the test binary runs itself.
+	invalid := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	invalid.Env = append(os.Environ(), agentChildEnv+"=1", config.EnvName("logLevelOverride")+"=kubernetes=trace")
+
+	combined, err := invalid.CombinedOutput()
+	assert.Equal(t, exitcode.Config, exitCode(t, err))
+	assert.Contains(t, string(combined), `unknown logger "kubernetes"`)
+}
+
+// TestWatchPortsIntegration checks that -watchPorts prints the port mappings
+// of the agent that serves the admin API, and exits when it is interrupted.
+func TestWatchPortsIntegration(t *testing.T) {
+	adminSocket := filepath.Join(t.TempDir(), "admin.sock")
+
+	agent, _, _ := startAgent(t, config.EnvName("adminSocket")+"="+adminSocket)
+
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAgentChild$")
+	cmd.Env = append(os.Environ(),
+		agentChildEnv+"=1",
+		config.EnvName("watchPorts")+"=true",
+		config.EnvName("watchJSON")+"=true",
+		config.EnvName("adminSocket")+"="+adminSocket,
+	)
+	cmd.Stderr = os.Stderr
+
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+
+	t.Cleanup(func() {
+		if cmd.ProcessState == nil {
+			_ = cmd.Process.Kill()
+			_ = cmd.Wait()
+		}
+	})
+
+	records := make(chan history.Record)
+
+	go func() {
+		defer close(records)
+
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			var record history.Record
+			if json.Unmarshal(scanner.Bytes(), &record) == nil {
+				records <- record
+			}
+		}
+	}()
+
+	select {
+	case record := <-records:
+		assert.Equal(t, string(tracker.ActionAdd), record.Action)
+		assert.Equal(t, tracker.SourceKubernetes, record.Source)
+		assert.Equal(t, "30080", record.Port)
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "the port mapping of the service was not printed")
+	}
+
+	require.NoError(t, cmd.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, cmd.Wait(), "the watcher did not exit cleanly")
+
+	require.NoError(t, agent.Process.Signal(syscall.SIGTERM))
+	require.NoError(t, agent.Wait(), "the agent did not shut down cleanly")
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/kube"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// registerMetrics registers the Prometheus metrics of the subsystems on
+// -metricsAddr, and their core counters with expvar; the metrics of the
+// drift checker are the ones of the current one.
+func registerMetrics(
+	endpoints *httpEndpoints,
+	f *forwarding,
+	obs *observers,
+	subsystems *supervisor.Supervisor,
+	driftChecker *atomic.Pointer[tracker.DriftChecker],
+) {
+	registry := metrics.NewRegistry()
+	registry.Register(f.metricsForwarder, f.metricsTracker, f.filterTracker, f.listenerTracker, subsystems, obs.latencies,
+		f.portChanges, metrics.CollectorFunc(kube.Collect), metrics.CollectorFunc(func() []metrics.Family {
+			if checker := driftChecker.Load(); checker != nil {
+				return checker.Collect()
+			}
+
+			return nil
+		}))
+	if f.breaker != nil {
+		registry.Register(f.breaker)
+	}
+
+	// The core counters are also published with expvar, which is cheaper to
+	// read than the metrics, e.g. with curl while debugging the agent.
+	metrics.PublishVars(map[string]func() int64{
+		metrics.VarTrackedPorts: func() int64 { return int64(f.metricsTracker.TrackedPorts()) },
+		metrics.VarListeners:    func() int64 { return int64(len(f.listenerTracker.Listeners())) },
+		metrics.VarForwarderSends: func() int64 {
+			return int64(f.metricsForwarder.Metrics().Sends)
+		},
+		metrics.VarForwarderFailures: func() int64 {
+			return int64(f.metricsForwarder.Metrics().FailureCount())
+		},
+		metrics.VarSubsystemRestarts: func() int64 { return int64(subsystems.Restarts()) },
+		metrics.VarEventQueueDepth:   func() int64 { return int64(obs.queued()) },
+		metrics.VarTrackedEntries:    func() int64 { return int64(len(f.metricsTracker.List())) },
+		metrics.VarGoroutines:        func() int64 { return int64(runtime.NumGoroutine()) },
+		metrics.VarMapCompactions:    func() int64 { return int64(tracker.Compactions()) },
+	})
+
+	endpoints.handle(*metricsAddr, "metrics", func(mux *http.ServeMux) {
+		mux.Handle("GET /metrics", registry)
+		mux.Handle("GET /debug/vars", metrics.VarsHandler())
+	})
+}
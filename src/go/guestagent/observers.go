@@ -0,0 +1,116 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/audit"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/history"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// observers follow the changes of the tracker with their outcomes, see
+// startObservers, until the port mappings are withdrawn at shutdown.
+type observers struct {
+	// auditFile is the audit log of -auditLog, if any.
+	auditFile         *logging.RotatingFile
+	auditSubscription *tracker.Subscription
+	auditDone         chan struct{}
+	// events holds the recent changes in memory, for GET /events.
+	events              *history.History
+	historySubscription *tracker.Subscription
+	historyDone         chan struct{}
+	// latencies are the latencies from the events of the ports to their
+	// forwarding, for the metrics and for the summaries.
+	latencies           *tracker.LatencyRecorder
+	latencySubscription *tracker.Subscription
+}
+
+// startObservers subscribes the audit log, the history and the latencies to
+// the changes of the tracker; the audit log is closed by close.
+func startObservers(portTracker tracker.Tracker) (*observers, error) {
+	o := &observers{
+		auditDone:   make(chan struct{}),
+		events:      history.New(*eventHistorySize),
+		historyDone: make(chan struct{}),
+		latencies:   tracker.NewLatencyRecorder(),
+	}
+
+	if *auditLog != "" {
+		auditFile, err := logging.OpenFile(*auditLog, int64(*logMaxSize)*megabyte, *logMaxFiles, os.Stderr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open -auditLog: %w", err)
+		}
+
+		o.auditFile = auditFile
+		o.auditSubscription = portTracker.Subscribe(audit.BufferSize, tracker.WithOutcomes())
+
+		go func() {
+			defer close(o.auditDone)
+			audit.NewLogger(auditFile, *auditSync).Run(o.auditSubscription)
+		}()
+	} else {
+		close(o.auditDone)
+	}
+
+	if *eventHistorySize > 0 {
+		o.historySubscription = portTracker.Subscribe(history.BufferSize, tracker.WithOutcomes())
+
+		go func() {
+			defer close(o.historyDone)
+			o.events.Run(o.historySubscription)
+		}()
+	} else {
+		close(o.historyDone)
+	}
+
+	o.latencySubscription = portTracker.Subscribe(tracker.LatencyBufferSize, tracker.WithOutcomes())
+
+	go o.latencies.Run(o.latencySubscription)
+
+	return o, nil
+}
+
+// queued returns the number of the changes that wait in the subscriptions
+// of the audit log and of the history.
+func (o *observers) queued() int {
+	return queuedEvents(o.auditSubscription, o.historySubscription)
+}
+
+// stop unsubscribes the observers, and waits for the audit log and the
+// history to record the changes that they were given.
+func (o *observers) stop() {
+	if o.auditSubscription != nil {
+		o.auditSubscription.Unsubscribe()
+	}
+
+	if o.historySubscription != nil {
+		o.historySubscription.Unsubscribe()
+	}
+
+	o.latencySubscription.Unsubscribe()
+
+	<-o.auditDone
+	<-o.historyDone
+}
+
+// close closes the audit log, if any.
+func (o *observers) close() {
+	if o.auditFile != nil {
+		_ = o.auditFile.Close()
+	}
+}
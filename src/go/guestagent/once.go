@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/docker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/exitcode"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/iptables"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/kube"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/scan"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+)
+
+// runOnce lists the port mappings of the enabled subsystems once, prints
+// them as JSON to the output and, when -forwarder names a forwarder rather
+// than auto, sends them to the host as a snapshot. The subsystems that can
+// not be listed are reported in the output, the exit code is only a failure
+// when it can not be written.
+func runOnce(ctx context.Context, output io.Writer) int {
+	result := scan.Run(ctx, onceSources(), onceTimeout)
+	result.Version = version.Get().Version
+
+	if *forwarderType != forwarder.KindAuto {
+		result.Snapshot = sendSnapshot(ctx, &result)
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+
+	if err := encoder.Encode(result); err != nil {
+		log.Errorf("failed to write the port mappings: %v", err)
+
+		return exitcode.Failure
+	}
+
+	return 0
+}
+
+// onceSources returns the enabled subsystems that can be listed, the
+// containerd one is not since it only knows the containers from its events.
+func onceSources() []scan.Source {
+	var sources []scan.Source
+
+	if *enableIptables {
+		sources = append(sources, scan.Source{
+			Name: tracker.SourceIptables,
+			List: func(ctx context.Context) (map[string]nat.PortMap, error) {
+				return iptables.ListPorts(ctx, scanNamespace(), forwardedChains())
+			},
+		})
+	}
+
+	if *enableDocker {
+		sources = append(sources, scan.Source{
+			Name: tracker.SourceDocker,
+			List: func(ctx context.Context) (map[string]nat.PortMap, error) {
+				return docker.ListPorts(ctx, *dockerKubernetesContainers)
+			},
+		})
+	}
+
+	if *enableKubernetes {
+		sources = append(sources, scan.Source{
+			Name: tracker.SourceKubernetes,
+			List: func(ctx context.Context) (map[string]nat.PortMap, error) {
+				ip := net.ParseIP(*k8sServiceListenerAddr)
+				if ip == nil {
+					return nil, fmt.Errorf("invalid Kubernetes service listener IP address %q", *k8sServiceListenerAddr)
+				}
+
+				return kube.ListServices(ctx, *configPath, ip)
+			},
+		})
+	}
+
+	return sources
+}
+
+// sendSnapshot sends the port mappings of the result to the host with the forwarder of -forwarder.
+func sendSnapshot(ctx context.Context, result *scan.Result) *scan.Snapshot {
+	kind := selectForwarder(ctx).Kind
+	snapshot := &scan.Snapshot{Forwarder: kind}
+
+	if err := trySendSnapshot(ctx, kind, result); err != nil {
+		log.Errorf("failed to send the port mappings to the host: %v", err)
+		snapshot.Error = err.Error()
+	}
+
+	return snapshot
+}
+
+func trySendSnapshot(ctx context.Context, kind string, result *scan.Result) error {
+	// The host would drop the port mappings of the sources that are missing from the snapshot.
+	if failed := result.Failed(); len(failed) != 0 {
+		return fmt.Errorf("the snapshot is not sent since %v could not be listed", failed)
+	}
+
+	if kind == forwarder.KindAPI {
+		return fmt.Errorf("the %s forwarder can not send a snapshot of the port mappings", kind)
+	}
+
+	hostForwarder, err := forwarder.NewFromConfig(kind, *vtunnelAddr, forwarderOptions)
+	if err != nil {
+		return fmt.Errorf("failed to create the port mappings forwarder: %w", err)
+	}
+
+	if closer, ok := hostForwarder.Unwrap().(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	interfaces, err := interfaceSelector(interfaceNames(*netInterface)).Select()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, onceTimeout)
+	defer cancel()
+
+	return hostForwarder.Send(forwarder.WithForce(ctx), result.PortMapping(netif.ConnectAddrs(interfaces)))
+}
@@ -0,0 +1,69 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// events returns the records of the history, GET /events takes the optional
+// query parameters:
+//
+//	since   the records since the time, either in the RFC 3339 format or as a duration
+//	        before now, e.g. since=10m; all the records that are still held by default
+//	limit   at most the given number of the latest records
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	var (
+		since time.Time
+		limit int
+		err   error
+	)
+
+	if value := r.URL.Query().Get("since"); value != "" {
+		since, err = parseSince(value, time.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+
+			return
+		}
+	}
+
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q, it must be a positive number", value))
+
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, s.state.History.Records(since, limit))
+}
+
+// parseSince parses the since query parameter of GET /events.
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+		return now.Add(-duration), nil
+	}
+
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since %q, it must be a time in the RFC 3339 format or a duration", value)
+	}
+
+	return since, nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/admin"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/history"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerEvents(t *testing.T) {
+	t.Parallel()
+
+	// The records are an hour old but the last two, and the first two are evicted.
+	h := history.New(5)
+	old := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+
+	for i := range 5 {
+		h.Add(history.Record{Timestamp: old.Add(time.Duration(i) * time.Second), Kind: history.KindTracker, ID: fmt.Sprint(i)})
+	}
+
+	h.Add(history.Record{Timestamp: time.Now(), Kind: history.KindTracker, ID: "5"})
+	h.Add(history.Record{Timestamp: time.Now(), Kind: history.KindSubsystem, Subsystem: "kubernetes", Error: "broken"})
+
+	state := testState(t)
+	state.History = h
+	client, _ := serve(t, state)
+
+	ids := func(query string) []string {
+		t.Helper()
+
+		var records []history.Record
+
+		get(t, client, "/events"+query, &records)
+
+		result := make([]string, 0, len(records))
+		for _, record := range records {
+			result = append(result, record.ID+record.Subsystem)
+		}
+
+		return result
+	}
+
+	assert.Equal(t, []string{"2", "3", "4", "5", "kubernetes"}, ids(""))
+	assert.Equal(t, []string{"5", "kubernetes"}, ids("?since=10m"))
+	assert.Equal(t, []string{"4", "5", "kubernetes"}, ids("?since="+old.Add(4*time.Second).Format(time.RFC3339)))
+	assert.Equal(t, []string{"kubernetes"}, ids("?limit=1"))
+	assert.Equal(t, []string{"4", "5", "kubernetes"}, ids("?since="+old.Add(3*time.Second).Format(time.RFC3339)+"&limit=3"))
+
+	for _, query := range []string{"?since=yesterday", "?since=-10m", "?limit=0", "?limit=ten"} {
+		var response admin.Error
+
+		assert.Equal(t, http.StatusBadRequest, do(t, client, http.MethodGet, "/events"+query, nil, &response), query)
+		assert.NotEmpty(t, response.Error, query)
+	}
+}
+
+func TestServerEventsEmpty(t *testing.T) {
+	t.Parallel()
+
+	state := testState(t)
+	state.History = history.New(history.DefaultSize)
+	client, _ := serve(t, state)
+
+	var records []history.Record
+
+	get(t, client, "/events", &records)
+	require.NotNil(t, records)
+	assert.Empty(t, records)
+}
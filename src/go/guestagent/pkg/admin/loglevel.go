@@ -0,0 +1,101 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+)
+
+// LogLevel is the response of GET /loglevel and the body of PUT /loglevel,
+// the levels are the names that -logLevel accepts, e.g.
+//
+//	{"level": "debug", "overrides": {"kube": "trace"}}
+//
+// PUT /loglevel keeps the level when it is empty, and the overrides when they
+// are left out; an empty object clears them.
+type LogLevel struct {
+	Level string `json:"level"`
+	// Overrides are the levels of the subsystems, like -logLevelOverride.
+	Overrides map[string]string `json:"overrides"`
+}
+
+// logLevel returns the current levels of the logger.
+func (s *Server) logLevel() LogLevel {
+	level, overrides := s.state.Logger.Levels()
+
+	logLevel := LogLevel{Level: logging.LevelName(level), Overrides: make(map[string]string, len(overrides))}
+	for name, override := range overrides {
+		logLevel.Overrides[name] = logging.LevelName(override)
+	}
+
+	return logLevel
+}
+
+// setLogLevel sets the levels of the logger, it sets none of them if one is invalid.
+func (s *Server) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var request LogLevel
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+
+		return
+	}
+
+	s.logLevelMutex.Lock()
+	defer s.logLevelMutex.Unlock()
+
+	level, overrides := s.state.Logger.Levels()
+
+	if request.Level != "" {
+		var err error
+		if level, err = logging.ParseLevel(request.Level); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+
+			return
+		}
+	}
+
+	if request.Overrides != nil {
+		overrides = make(map[string]int, len(request.Overrides))
+
+		for name, levelName := range request.Overrides {
+			override, err := logging.ParseLevel(levelName)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("override of %s: %w", name, err))
+
+				return
+			}
+
+			overrides[name] = override
+		}
+	}
+
+	previous := s.logLevel()
+
+	if err := s.state.Logger.SetLevels(level, overrides); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+
+		return
+	}
+
+	current := s.logLevel()
+	// The change is logged at the warn level, so that it is not filtered out by the levels that it sets.
+	log.Warnf("the admin API changed the log level from %s %v to %s %v", previous.Level, previous.Overrides, current.Level, current.Overrides)
+
+	writeJSON(w, http.StatusOK, current)
+}
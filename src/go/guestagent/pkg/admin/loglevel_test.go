@@ -0,0 +1,139 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/admin"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerLogLevel(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatText)
+	kube := logger.Named("kube")
+	logger.Named("docker")
+
+	state := testState(t)
+	state.Logger = logger
+	client, _ := serve(t, state)
+
+	var logLevel admin.LogLevel
+
+	get(t, client, "/loglevel", &logLevel)
+	assert.Equal(t, admin.LogLevel{Level: "info", Overrides: map[string]string{}}, logLevel)
+
+	logger.Debug("debug before")
+
+	assert.Equal(t, http.StatusOK, do(t, client, http.MethodPut, "/loglevel", admin.LogLevel{Level: "debug"}, &logLevel))
+	assert.Equal(t, admin.LogLevel{Level: "debug", Overrides: map[string]string{}}, logLevel)
+
+	logger.Debug("debug after")
+	kube.Trace("kube trace before")
+
+	// The level is kept when only the overrides are set.
+	assert.Equal(t, http.StatusOK, do(t, client, http.MethodPut, "/loglevel", map[string]any{
+		"overrides": map[string]string{"kube": "trace"},
+	}, &logLevel))
+	assert.Equal(t, admin.LogLevel{Level: "debug", Overrides: map[string]string{"kube": "trace"}}, logLevel)
+
+	kube.Trace("kube trace after")
+
+	assert.NotContains(t, output.String(), "debug before")
+	assert.Contains(t, output.String(), "debug after")
+	assert.NotContains(t, output.String(), "kube trace before")
+	assert.Contains(t, output.String(), "kube trace after")
+
+	// Nothing is set when a level is invalid.
+	for _, body := range []any{
+		admin.LogLevel{Level: "verbose"},
+		admin.LogLevel{Level: "error", Overrides: map[string]string{"kube": "verbose"}},
+		admin.LogLevel{Level: "error", Overrides: map[string]string{"unknown": "info"}},
+		"debug",
+	} {
+		var response admin.Error
+
+		assert.Equal(t, http.StatusBadRequest, do(t, client, http.MethodPut, "/loglevel", body, &response))
+		assert.NotEmpty(t, response.Error)
+	}
+
+	get(t, client, "/loglevel", &logLevel)
+	assert.Equal(t, admin.LogLevel{Level: "debug", Overrides: map[string]string{"kube": "trace"}}, logLevel)
+
+	// The overrides are cleared by an empty object.
+	logLevel = admin.LogLevel{}
+	assert.Equal(t, http.StatusOK, do(t, client, http.MethodPut, "/loglevel", map[string]any{
+		"level":     "warn",
+		"overrides": map[string]string{},
+	}, &logLevel))
+	assert.Equal(t, admin.LogLevel{Level: "warn", Overrides: map[string]string{}}, logLevel)
+
+	kube.Info("kube info")
+	assert.NotContains(t, output.String(), "kube info")
+}
+
+// TestServerLogLevelConcurrent changes the levels while the subsystems log, for the race detector.
+func TestServerLogLevelConcurrent(t *testing.T) {
+	t.Parallel()
+
+	logger := logging.New(io.Discard, logging.FormatText)
+	kube := logger.Named("kube")
+
+	state := testState(t)
+	state.Logger = logger
+	client, _ := serve(t, state)
+
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	for range 4 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					logger.Debug("debug")
+					kube.Trace("trace")
+				}
+			}
+		}()
+	}
+
+	for _, level := range []string{"trace", "info", "debug", "error", "info"} {
+		assert.Equal(t, http.StatusOK, do(t, client, http.MethodPut, "/loglevel", admin.LogLevel{
+			Level:     level,
+			Overrides: map[string]string{"kube": level},
+		}, nil))
+	}
+
+	close(done)
+	wg.Wait()
+
+	assert.False(t, kube.Enabled(0))
+}
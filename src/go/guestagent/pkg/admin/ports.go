@@ -0,0 +1,212 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// defaultHostIP is the host address that the manual port forwards bind to by default.
+const defaultHostIP = "127.0.0.1"
+
+// ManualPort is the request body of POST /ports, it forwards the port of a
+// process in the VM that none of the subsystems know about.
+type ManualPort struct {
+	// Protocol is one of tcp, udp or sctp, it defaults to tcp.
+	Protocol string `json:"protocol,omitempty"`
+	// Port is the port in the VM.
+	Port int `json:"port"`
+	// HostIP is the host address that the port is forwarded from, it defaults to 127.0.0.1.
+	HostIP string `json:"hostIP,omitempty"`
+	// HostPort is the host port that the port is forwarded from, it defaults to Port.
+	HostPort int `json:"hostPort,omitempty"`
+}
+
+// Error is the response body of the requests that failed.
+type Error struct {
+	Error string `json:"error"`
+	// Conflicts are the port bindings that the host could not apply,
+	// keyed by the binding in the "hostIP:hostPort/protocol" form.
+	Conflicts map[string]string `json:"conflicts,omitempty"`
+}
+
+// manualID returns the ID of the tracker entry of the manual port forward.
+func manualID(port nat.Port) string {
+	return tracker.SourceManual + "/" + port.Proto() + "/" + port.Port()
+}
+
+// parsePort returns the port in the VM of the protocol and the port number.
+func parsePort(protocol string, port int) (nat.Port, error) {
+	switch protocol {
+	case "tcp", "udp", "sctp":
+	default:
+		return "", fmt.Errorf("invalid protocol %q, valid options are tcp, udp and sctp", protocol)
+	}
+
+	if port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid port %d", port)
+	}
+
+	return nat.NewPort(protocol, strconv.Itoa(port))
+}
+
+// addPort forwards the port of the request with a tracker entry of the
+// manual source. The ports that the allow-list does not allow are rejected,
+// and the host ports that are already forwarded or that the host could not
+// bind are reported as conflicts.
+func (s *Server) addPort(w http.ResponseWriter, r *http.Request) {
+	var request ManualPort
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %w", err))
+
+		return
+	}
+
+	if request.Protocol == "" {
+		request.Protocol = "tcp"
+	}
+
+	if request.HostIP == "" {
+		request.HostIP = defaultHostIP
+	}
+
+	if request.HostPort == 0 {
+		request.HostPort = request.Port
+	}
+
+	port, err := parsePort(request.Protocol, request.Port)
+	if err == nil && (request.HostPort < 1 || request.HostPort > 65535) {
+		err = fmt.Errorf("invalid host port %d", request.HostPort)
+	}
+
+	if err == nil && net.ParseIP(request.HostIP) == nil {
+		err = fmt.Errorf("invalid host IP %q", request.HostIP)
+	}
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+
+		return
+	}
+
+	hostPort := strconv.Itoa(request.HostPort)
+	if s.state.AllowsPort != nil && !s.state.AllowsPort(hostPort) {
+		writeError(w, http.StatusForbidden, fmt.Errorf("host port %s is not allowed to be forwarded", hostPort))
+
+		return
+	}
+
+	s.manualMutex.Lock()
+	defer s.manualMutex.Unlock()
+
+	id := manualID(port)
+	if s.state.Tracker.Get(id) != nil {
+		writeError(w, http.StatusConflict, fmt.Errorf("port %s is already forwarded", port))
+
+		return
+	}
+
+	if entry, ok := s.state.Tracker.GetByPort(hostPort, port.Proto()); ok {
+		writeError(w, http.StatusConflict, fmt.Errorf("host port %s/%s is already forwarded for %s", hostPort, port.Proto(), entry.ID))
+
+		return
+	}
+
+	portMap := nat.PortMap{port: []nat.PortBinding{{HostIP: request.HostIP, HostPort: hostPort}}}
+	// The entry in the response carries the correlation ID, which links it to the logs.
+	correlationID := tracker.NewCorrelationID()
+
+	err = s.state.Tracker.Add(r.Context(), id, portMap,
+		tracker.WithSource(tracker.SourceManual),
+		tracker.WithOrigin(tracker.Origin{Kind: tracker.OriginRequest, Name: r.URL.Path}),
+		tracker.WithCorrelationID(correlationID))
+	if err != nil {
+		statusCode := http.StatusInternalServerError
+		if errors.Is(err, tracker.ErrPortConflict) || errors.Is(err, tracker.ErrRemapCollision) ||
+			errors.Is(err, tracker.ErrPortBudgetExceeded) {
+			statusCode = http.StatusConflict
+		}
+
+		writeError(w, statusCode, fmt.Errorf("failed to forward port %s: %w", port, err))
+
+		return
+	}
+
+	entry, _ := s.state.Tracker.GetByPort(hostPort, port.Proto())
+
+	// The port is not left half forwarded when the host could not bind it.
+	if entry.State == tracker.StateHostConflict {
+		if err := s.state.Tracker.Remove(r.Context(), id, tracker.WithCorrelationID(correlationID)); err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to withdraw port %s: %w", port, err))
+
+			return
+		}
+
+		writeJSON(w, http.StatusConflict, Error{
+			Error:     fmt.Sprintf("the host could not forward port %s", port),
+			Conflicts: entry.HostConflicts,
+		})
+
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, entry)
+}
+
+// removePort withdraws the manual port forward of the port in the VM.
+func (s *Server) removePort(w http.ResponseWriter, r *http.Request) {
+	portNumber, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid port %q", r.PathValue("port")))
+
+		return
+	}
+
+	port, err := parsePort(r.PathValue("proto"), portNumber)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+
+		return
+	}
+
+	s.manualMutex.Lock()
+	defer s.manualMutex.Unlock()
+
+	id := manualID(port)
+	if s.state.Tracker.Get(id) == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("port %s is not forwarded manually", port))
+
+		return
+	}
+
+	if err := s.state.Tracker.Remove(r.Context(), id, tracker.WithCorrelationID(tracker.NewCorrelationID())); err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to withdraw port %s: %w", port, err))
+
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, err error) {
+	writeJSON(w, statusCode, Error{Error: err.Error()})
+}
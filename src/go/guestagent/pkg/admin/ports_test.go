@@ -0,0 +1,198 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/admin"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rejectedHostPort is the host port that the rejectingForwarder fails to bind.
+const rejectedHostPort = "9090"
+
+// rejectingForwarder is a forwarder whose host rejects the rejectedHostPort.
+type rejectingForwarder struct {
+	forwarder.NoopForwarder
+}
+
+func (f *rejectingForwarder) SendWithResults(_ context.Context, portMapping types.PortMapping) ([]forwarder.PortResult, error) {
+	var results []forwarder.PortResult
+
+	for port, bindings := range portMapping.Ports {
+		for _, binding := range bindings {
+			result := forwarder.PortResult{Port: port, Binding: binding}
+			if binding.HostPort == rejectedHostPort && !portMapping.Remove {
+				result.Err = forwarder.ErrPortRejected
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// do sends the request to the admin API and decodes its response, if any.
+func do(t *testing.T, client *http.Client, method, path string, body, response any) int {
+	t.Helper()
+
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+
+	req, err := http.NewRequestWithContext(context.Background(), method, "http://agent"+path, bytes.NewReader(data))
+	require.NoError(t, err)
+
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	if response != nil {
+		require.NoError(t, json.NewDecoder(res.Body).Decode(response))
+	}
+
+	return res.StatusCode
+}
+
+func manualState(t *testing.T) admin.State {
+	t.Helper()
+
+	state := testState(t)
+	state.Tracker = tracker.NewVTunnelTracker(&rejectingForwarder{}, []types.ConnectAddrs{
+		{Network: "tcp", Addr: "192.168.1.2"},
+	})
+	require.NoError(t, state.Tracker.Add(context.Background(), containerID, nat.PortMap{
+		"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+	}, tracker.WithSource(tracker.SourceDocker)))
+
+	state.AllowsPort = func(hostPort string) bool { return hostPort != "22" }
+
+	return state
+}
+
+func TestServerAddPort(t *testing.T) {
+	t.Parallel()
+
+	state := manualState(t)
+	client, _ := serve(t, state)
+
+	var entry tracker.Entry
+
+	statusCode := do(t, client, http.MethodPost, "/ports", admin.ManualPort{Port: 3000}, &entry)
+	require.Equal(t, http.StatusCreated, statusCode)
+	assert.Equal(t, "manual/tcp/3000", entry.ID)
+	assert.Equal(t, tracker.SourceManual, entry.Source)
+	assert.Equal(t, &tracker.Origin{Kind: tracker.OriginRequest, Name: "/ports"}, entry.Origin)
+	assert.Equal(t, nat.PortMap{"3000/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "3000"}}}, entry.Ports)
+
+	var udpEntry tracker.Entry
+
+	statusCode = do(t, client, http.MethodPost, "/ports",
+		admin.ManualPort{Protocol: "udp", Port: 53, HostIP: "0.0.0.0", HostPort: 5353}, &udpEntry)
+	require.Equal(t, http.StatusCreated, statusCode)
+	assert.Equal(t, nat.PortMap{"53/udp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "5353"}}}, udpEntry.Ports)
+
+	// The manual port forwards are listed with the others.
+	var entries []tracker.Entry
+
+	get(t, client, "/ports", &entries)
+	assert.Len(t, entries, 3)
+
+	// Adding the same port again is a conflict.
+	var response admin.Error
+
+	statusCode = do(t, client, http.MethodPost, "/ports", admin.ManualPort{Port: 3000, HostPort: 3001}, &response)
+	assert.Equal(t, http.StatusConflict, statusCode)
+	assert.Contains(t, response.Error, "already forwarded")
+	assert.Len(t, state.Tracker.List(), 3)
+}
+
+func TestServerAddPortRejected(t *testing.T) {
+	t.Parallel()
+
+	state := manualState(t)
+	client, _ := serve(t, state)
+
+	tests := []struct {
+		name       string
+		request    any
+		statusCode int
+		message    string
+	}{
+		{"invalid body", "port 3000", http.StatusBadRequest, "invalid request"},
+		{"invalid protocol", admin.ManualPort{Protocol: "icmp", Port: 3000}, http.StatusBadRequest, "invalid protocol"},
+		{"invalid port", admin.ManualPort{Port: 70000}, http.StatusBadRequest, "invalid port"},
+		{"invalid host IP", admin.ManualPort{Port: 3000, HostIP: "localhost"}, http.StatusBadRequest, "invalid host IP"},
+		{"not allowed", admin.ManualPort{Port: 22}, http.StatusForbidden, "not allowed"},
+		{"host port in use", admin.ManualPort{Port: 3000, HostPort: 8080}, http.StatusConflict, "for " + containerID},
+	}
+
+	for _, tt := range tests {
+		var response admin.Error
+
+		statusCode := do(t, client, http.MethodPost, "/ports", tt.request, &response)
+		assert.Equal(t, tt.statusCode, statusCode, tt.name)
+		assert.Contains(t, response.Error, tt.message, tt.name)
+	}
+
+	assert.Len(t, state.Tracker.List(), 1)
+}
+
+func TestServerAddPortHostConflict(t *testing.T) {
+	t.Parallel()
+
+	state := manualState(t)
+	client, _ := serve(t, state)
+
+	// The host could not bind the port, so it is withdrawn again.
+	var response admin.Error
+
+	statusCode := do(t, client, http.MethodPost, "/ports", admin.ManualPort{Port: 9090}, &response)
+	require.Equal(t, http.StatusConflict, statusCode)
+	assert.Contains(t, response.Error, "the host could not forward port 9090/tcp")
+	assert.Equal(t, map[string]string{"127.0.0.1:9090/tcp": forwarder.ErrPortRejected.Error()}, response.Conflicts)
+	assert.Nil(t, state.Tracker.Get("manual/tcp/9090"))
+}
+
+func TestServerRemovePort(t *testing.T) {
+	t.Parallel()
+
+	state := manualState(t)
+	client, _ := serve(t, state)
+
+	require.Equal(t, http.StatusCreated, do(t, client, http.MethodPost, "/ports", admin.ManualPort{Port: 3000}, nil))
+	require.Equal(t, http.StatusNoContent, do(t, client, http.MethodDelete, "/ports/tcp/3000", nil, nil))
+	assert.Nil(t, state.Tracker.Get("manual/tcp/3000"))
+
+	var response admin.Error
+
+	// The port is no longer forwarded, and only the manual port forwards can be withdrawn.
+	assert.Equal(t, http.StatusNotFound, do(t, client, http.MethodDelete, "/ports/tcp/3000", nil, &response))
+	assert.Contains(t, response.Error, "not forwarded manually")
+	assert.Equal(t, http.StatusNotFound, do(t, client, http.MethodDelete, "/ports/tcp/80", nil, nil))
+	assert.NotNil(t, state.Tracker.Get(containerID))
+
+	assert.Equal(t, http.StatusBadRequest, do(t, client, http.MethodDelete, "/ports/tcp/http", nil, nil))
+	assert.Equal(t, http.StatusBadRequest, do(t, client, http.MethodDelete, "/ports/icmp/3000", nil, nil))
+}
@@ -0,0 +1,243 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package admin serves the state of the agent over HTTP on a unix socket,
+// so that it can be asked what it is forwarding, e.g.
+//
+//	curl --unix-socket /run/rancher-desktop-guestagent.sock http://agent/ports
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/conflict"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/history"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+)
+
+const (
+	// DefaultSocket is the usual path of the admin socket.
+	DefaultSocket = "/run/rancher-desktop-guestagent.sock"
+	// socketMode only lets root use the socket.
+	socketMode        = 0o600
+	readHeaderTimeout = 5 * time.Second
+	shutdownTimeout   = 5 * time.Second
+)
+
+var ErrAdminSocket = errors.New("admin socket")
+
+// State is the state of the agent that the server serves.
+type State struct {
+	// Tracker holds the port mappings that GET /ports returns,
+	// and that POST /ports and DELETE /ports change.
+	Tracker tracker.Tracker
+	// AllowsPort returns true if the host port may be forwarded, see POST /ports;
+	// all the host ports are allowed when it is nil.
+	AllowsPort func(hostPort string) bool
+	// Listeners returns the addresses of the listeners that the agent holds, see GET /listeners.
+	Listeners func() []string
+	// Subsystems returns the status of the subsystems, see GET /status.
+	Subsystems func() []supervisor.Status
+	// Config returns the effective configuration with the secrets redacted, see GET /config.
+	Config func() map[string]string
+	// Logger is the logger whose levels GET /loglevel returns, and PUT /loglevel sets.
+	Logger *logging.Logger
+	// History holds the recent changes and failures that GET /events returns.
+	History *history.History
+	// Compatibility returns how the agent works with the peer of the forwarder,
+	// see GET /status; it is nil for the forwarders that do not negotiate the protocol.
+	Compatibility func() *forwarder.Compatibility
+	// Forwarder is the forwarder that the agent selected, see GET /status.
+	Forwarder forwarder.Selection
+	// Circuit returns the state of the circuit breaker of the forwarder,
+	// see GET /status; it is nil when the forwarder has none.
+	Circuit func() forwarder.BreakerStatus
+	// Conflicts are the other agents and port forwarding processes that
+	// were detected at startup, see GET /status.
+	Conflicts []conflict.Process
+}
+
+// Status is the response of GET /status.
+type Status struct {
+	Version    version.Info        `json:"version"`
+	Subsystems []supervisor.Status `json:"subsystems"`
+	// Compatibility is how the agent works with the peer of the forwarder,
+	// it is not set until the protocol was negotiated.
+	Compatibility *forwarder.Compatibility `json:"compatibility,omitempty"`
+	// Forwarder is the forwarder that the agent selected, along with the
+	// results of the probes of -forwarder=auto.
+	Forwarder *forwarder.Selection `json:"forwarder,omitempty"`
+	// Circuit is the state of the circuit breaker of the forwarder, the agent
+	// is degraded while it is not closed, since the port mappings are not sent.
+	Circuit  *forwarder.BreakerStatus `json:"circuit,omitempty"`
+	Degraded bool                     `json:"degraded,omitempty"`
+	// Conflicts are the other agents and port forwarding processes that
+	// were running when the agent started, see -onConflict.
+	Conflicts []conflict.Process `json:"conflicts,omitempty"`
+}
+
+// Server serves the admin API:
+//
+//	GET /ports                       the entries of the tracker
+//	POST /ports                      forwards a port in the VM, see ManualPort
+//	DELETE /ports/{proto}/{port}     withdraws the port that POST /ports forwarded
+//	GET /listeners                   the addresses of the listeners
+//	GET /status                      the version of the agent, the status of its subsystems, its forwarder, the compatibility of its peer,
+//	                                 the circuit breaker of the forwarder and the conflicting processes
+//	GET /config                      the effective configuration
+//	GET /loglevel                    the log levels, see LogLevel
+//	PUT /loglevel                    sets the log levels right away
+//	GET /events                      the recent changes of the tracker and failures of the subsystems
+//	GET /events/stream               the same records as they happen, as server-sent events
+//
+// The port forwards of POST /ports are kept until they are withdrawn,
+// or until the agent stops.
+type Server struct {
+	state State
+	mux   *http.ServeMux
+	// manualMutex serializes the changes of the manual port forwards.
+	manualMutex sync.Mutex
+	// logLevelMutex serializes the changes of the log levels.
+	logLevelMutex sync.Mutex
+	// streams is cancelled once the server shuts down, to end the streams
+	// of GET /events/stream, which would hold up the shutdown otherwise.
+	streams     context.Context
+	stopStreams context.CancelFunc
+}
+
+// NewServer creates a server for the state of the agent.
+func NewServer(state State) *Server {
+	server := &Server{
+		state: state,
+		mux:   http.NewServeMux(),
+	}
+	server.streams, server.stopStreams = context.WithCancel(context.Background())
+
+	server.mux.HandleFunc("GET /ports", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, server.state.Tracker.List())
+	})
+	server.mux.HandleFunc("POST /ports", server.addPort)
+	server.mux.HandleFunc("DELETE /ports/{proto}/{port}", server.removePort)
+	server.mux.HandleFunc("GET /listeners", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, server.state.Listeners())
+	})
+	server.mux.HandleFunc("GET /status", func(w http.ResponseWriter, _ *http.Request) {
+		status := Status{
+			Version:    version.Get(),
+			Subsystems: server.state.Subsystems(),
+		}
+		if server.state.Compatibility != nil {
+			status.Compatibility = server.state.Compatibility()
+		}
+
+		if server.state.Forwarder.Kind != "" {
+			status.Forwarder = &server.state.Forwarder
+		}
+
+		if server.state.Circuit != nil {
+			circuit := server.state.Circuit()
+			status.Circuit = &circuit
+			status.Degraded = circuit.State != forwarder.BreakerClosed
+		}
+
+		status.Conflicts = server.state.Conflicts
+
+		writeJSON(w, http.StatusOK, status)
+	})
+	server.mux.HandleFunc("GET /config", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, server.state.Config())
+	})
+	server.mux.HandleFunc("GET /loglevel", func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, server.logLevel())
+	})
+	server.mux.HandleFunc("PUT /loglevel", server.setLogLevel)
+	server.mux.HandleFunc("GET /events", server.events)
+	server.mux.HandleFunc("GET /events/stream", server.streamEvents)
+
+	return server
+}
+
+// ListenAndServe serves the admin API on the unix socket at path until the
+// context is cancelled, the socket is removed once the server stopped. The
+// socket that a previous agent left behind is replaced.
+func (s *Server) ListenAndServe(ctx context.Context, path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w %s: %w", ErrAdminSocket, path, err)
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("%w %s: %w", ErrAdminSocket, path, err)
+	}
+
+	if err := os.Chmod(path, socketMode); err != nil {
+		listener.Close()
+
+		return fmt.Errorf("%w %s: %w", ErrAdminSocket, path, err)
+	}
+
+	server := &http.Server{
+		Handler:           s.mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+	}
+	server.RegisterOnShutdown(s.stopStreams)
+
+	shutdown := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(shutdown)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("failed to shut down the admin API: %v", err)
+		}
+	})
+
+	log.Infof("serving the admin API on %s", path)
+
+	err = server.Serve(listener)
+
+	// The requests in flight are answered before the agent goes on with its shutdown.
+	if !stop() {
+		<-shutdown
+	}
+
+	if !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("%w %s: %w", ErrAdminSocket, path, err)
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Errorf("failed to write the admin API response: %v", err)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/admin"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/conflict"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const containerID = "containerID"
+
+// testState returns the state with a port mapping for containerID.
+func testState(t *testing.T) admin.State {
+	t.Helper()
+
+	portTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), []types.ConnectAddrs{
+		{Network: "tcp", Addr: "192.168.1.2"},
+	})
+	require.NoError(t, portTracker.Add(context.Background(), containerID, nat.PortMap{
+		"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+	}, tracker.WithSource(tracker.SourceDocker)))
+
+	return admin.State{
+		Tracker:   portTracker,
+		Listeners: func() []string { return []string{"127.0.0.1:8080"} },
+		Subsystems: func() []supervisor.Status {
+			return []supervisor.Status{{Name: "docker", State: supervisor.StateRunning}}
+		},
+		Config: func() map[string]string { return map[string]string{"debug": "true"} },
+	}
+}
+
+// serve serves the admin API until the test ends, and returns a client for it.
+func serve(t *testing.T, state admin.State) (*http.Client, string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- admin.NewServer(state).ListenAndServe(ctx, path)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		require.NoError(t, <-done)
+	})
+
+	return dialClient(t, path), path
+}
+
+// dialClient returns a client for the admin API on the socket, once it exists.
+func dialClient(t *testing.T, path string) *http.Client {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+
+		return err == nil
+	}, 5*time.Second, time.Millisecond)
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// get decodes the response of the admin API to the GET request.
+func get(t *testing.T, client *http.Client, path string, value any) {
+	t.Helper()
+
+	res, err := client.Get("http://agent" + path)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	require.NoError(t, json.NewDecoder(res.Body).Decode(value))
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	client, path := serve(t, testState(t))
+
+	var entries []tracker.Entry
+
+	get(t, client, "/ports", &entries)
+	require.Len(t, entries, 1)
+	assert.Equal(t, containerID, entries[0].ID)
+	assert.Equal(t, tracker.SourceDocker, entries[0].Source)
+	assert.Equal(t, nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}}}, entries[0].Ports)
+
+	var listeners []string
+
+	get(t, client, "/listeners", &listeners)
+	assert.Equal(t, []string{"127.0.0.1:8080"}, listeners)
+
+	var status admin.Status
+
+	get(t, client, "/status", &status)
+	assert.Equal(t, admin.Status{
+		Version:    version.Get(),
+		Subsystems: []supervisor.Status{{Name: "docker", State: supervisor.StateRunning}},
+	}, status)
+
+	var config map[string]string
+
+	get(t, client, "/config", &config)
+	assert.Equal(t, map[string]string{"debug": "true"}, config)
+
+	// Only root may use the socket.
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeSocket|0o600, info.Mode())
+
+	res, err := client.Post("http://agent/status", "application/json", nil)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func TestServerStatusCompatibility(t *testing.T) {
+	t.Parallel()
+
+	state := testState(t)
+	state.Compatibility = func() *forwarder.Compatibility {
+		return &forwarder.Compatibility{
+			Mode:                   forwarder.CompatibilityUnsupported,
+			ProtocolVersion:        types.ProtocolVersion,
+			PeerMinProtocolVersion: types.ProtocolVersion + 1,
+			PeerProtocolVersion:    types.ProtocolVersion + 1,
+			AgentProtocolVersion:   types.ProtocolVersion,
+			PeerVersion:            "2.0.0",
+			AgentVersion:           version.Version,
+		}
+	}
+
+	client, _ := serve(t, state)
+
+	var status admin.Status
+
+	get(t, client, "/status", &status)
+	assert.Equal(t, state.Compatibility(), status.Compatibility)
+}
+
+func TestServerStatusForwarder(t *testing.T) {
+	t.Parallel()
+
+	state := testState(t)
+	state.Forwarder = forwarder.Selection{
+		Kind: forwarder.KindVTunnel,
+		Probes: []forwarder.ProbeResult{
+			{Kind: forwarder.KindHvsock, Error: "connection refused"},
+			{Kind: forwarder.KindVTunnel},
+		},
+	}
+
+	client, _ := serve(t, state)
+
+	var status admin.Status
+
+	get(t, client, "/status", &status)
+	assert.Equal(t, &state.Forwarder, status.Forwarder)
+}
+
+func TestServerStatusCircuit(t *testing.T) {
+	t.Parallel()
+
+	state := testState(t)
+	circuit := forwarder.BreakerStatus{State: forwarder.BreakerClosed}
+	state.Circuit = func() forwarder.BreakerStatus { return circuit }
+
+	client, _ := serve(t, state)
+
+	var status admin.Status
+
+	get(t, client, "/status", &status)
+	assert.Equal(t, &circuit, status.Circuit)
+	assert.False(t, status.Degraded)
+
+	// The agent is degraded while the circuit is open.
+	circuit = forwarder.BreakerStatus{
+		State:     forwarder.BreakerOpen,
+		Failures:  10,
+		Opens:     1,
+		OpenedAt:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		LastError: "connection refused",
+	}
+
+	status = admin.Status{}
+	get(t, client, "/status", &status)
+	assert.Equal(t, &circuit, status.Circuit)
+	assert.True(t, status.Degraded)
+}
+
+func TestServerStatusConflicts(t *testing.T) {
+	t.Parallel()
+
+	state := testState(t)
+	state.Conflicts = []conflict.Process{
+		{PID: 1234, Name: "rancher-desktop-guestagent", DetectedBy: []string{conflict.ByMarker, conflict.ByName}},
+	}
+
+	client, _ := serve(t, state)
+
+	var status admin.Status
+
+	get(t, client, "/status", &status)
+	assert.Equal(t, state.Conflicts, status.Conflicts)
+}
+
+func TestServerShutdown(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	// The socket that a previous agent left behind is replaced.
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- admin.NewServer(testState(t)).ListenAndServe(ctx, path)
+	}()
+
+	require.Eventually(t, func() bool {
+		info, err := os.Stat(path)
+
+		return err == nil && info.Mode()&os.ModeSocket != 0
+	}, 5*time.Second, time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+
+	// The socket is removed once the server stopped.
+	_, err := os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestServerInvalidSocket(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "missing", "admin.sock")
+
+	err := admin.NewServer(testState(t)).ListenAndServe(context.Background(), path)
+	require.ErrorIs(t, err, admin.ErrAdminSocket)
+	assert.ErrorContains(t, err, path)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/history"
+)
+
+const (
+	// streamKeepalive is the interval of the comments that are sent on the idle
+	// streams of GET /events/stream, so that the clients that left are noticed.
+	streamKeepalive = 15 * time.Second
+	// streamWriteTimeout is how long a client of GET /events/stream may take
+	// to read an event, the stream is closed otherwise.
+	streamWriteTimeout = 10 * time.Second
+)
+
+// streamEvents streams the records of the history as they are added to
+// GET /events/stream with server-sent events: the id of an event is the
+// sequence number of its record, its type is its kind, and its data is the
+// record as JSON. A client that reconnects with the Last-Event-ID header
+// first receives the records that it missed, preceded by a dropped record
+// of the ones that were evicted meanwhile. A client that does not keep up
+// is disconnected rather than lagging behind, it reconnects the same way.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	var after uint64
+
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		var err error
+
+		after, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid Last-Event-ID %q, it must be the id of an event", value))
+
+			return
+		}
+	}
+
+	stream, missed, evicted := s.state.History.Stream(after, history.StreamBufferSize)
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	controller := http.NewResponseController(w)
+
+	// send writes to the stream within the deadline, it returns false once the client is gone.
+	send := func(write func() error) bool {
+		if err := controller.SetWriteDeadline(time.Now().Add(streamWriteTimeout)); err != nil {
+			log.Errorf("failed to set the deadline of the events stream: %v", err)
+
+			return false
+		}
+
+		return write() == nil && controller.Flush() == nil
+	}
+
+	if evicted != 0 {
+		missed = append([]history.Record{{Timestamp: time.Now(), Kind: history.KindDropped, Dropped: evicted}}, missed...)
+	}
+
+	if !send(func() error { return writeEvents(w, missed...) }) {
+		return
+	}
+
+	ticker := time.NewTicker(streamKeepalive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.streams.Done():
+			return
+		case record, ok := <-stream.Records():
+			if !ok {
+				log.Debugf("closing an events stream that fell behind, its client is expected to reconnect")
+
+				return
+			}
+
+			if !send(func() error { return writeEvents(w, record) }) {
+				return
+			}
+		case <-ticker.C:
+			keepalive := func() error {
+				_, err := io.WriteString(w, ": keepalive\n\n")
+
+				return err
+			}
+
+			if !send(keepalive) {
+				return
+			}
+		}
+	}
+}
+
+// writeEvents writes the records as server-sent events, the records that are
+// not in the history, e.g. the dropped records of a stream, have no id.
+func writeEvents(w io.Writer, records ...history.Record) error {
+	for _, record := range records {
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		if record.Seq != 0 {
+			if _, err := fmt.Fprintf(w, "id: %d\n", record.Seq); err != nil {
+				return err
+			}
+		}
+
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", record.Kind, data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
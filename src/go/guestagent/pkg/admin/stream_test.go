@@ -0,0 +1,232 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package admin_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/admin"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/history"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// streamEvent is a server-sent event of GET /events/stream.
+type streamEvent struct {
+	id     string
+	kind   string
+	record history.Record
+}
+
+// openStream connects to GET /events/stream, and returns the events that it
+// receives; the stream is closed once the test ends.
+func openStream(t *testing.T, client *http.Client, lastEventID string) <-chan streamEvent {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://agent/events/stream", nil)
+	require.NoError(t, err)
+
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	t.Cleanup(func() { res.Body.Close() })
+
+	events := make(chan streamEvent, 100)
+
+	go func() {
+		defer close(events)
+
+		var event streamEvent
+
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			name, value, _ := strings.Cut(line, ": ")
+
+			switch name {
+			case "id":
+				event.id = value
+			case "event":
+				event.kind = value
+			case "data":
+				if err := json.Unmarshal([]byte(value), &event.record); err != nil {
+					t.Errorf("invalid event data %q: %v", value, err)
+				}
+			case "":
+				if line == "" {
+					events <- event
+					event = streamEvent{}
+				}
+			}
+		}
+	}()
+
+	return events
+}
+
+// nextEvents returns the next n events of the stream.
+func nextEvents(t *testing.T, events <-chan streamEvent, n int) []streamEvent {
+	t.Helper()
+
+	var received []streamEvent
+
+	for range n {
+		select {
+		case event, ok := <-events:
+			require.True(t, ok, "the stream was closed")
+
+			received = append(received, event)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timed out waiting for the events", "received %v", received)
+		}
+	}
+
+	return received
+}
+
+// changes returns the changes of the records of the events, e.g. "add 8080".
+func changes(events []streamEvent) []string {
+	result := make([]string, 0, len(events))
+	for _, event := range events {
+		result = append(result, event.record.Action+" "+event.record.Port+" "+event.record.Outcome)
+	}
+
+	return result
+}
+
+func TestServerStreamEvents(t *testing.T) {
+	t.Parallel()
+
+	state := testState(t)
+	state.History = history.New(history.DefaultSize)
+
+	subscription := state.Tracker.Subscribe(history.BufferSize, tracker.WithOutcomes())
+	t.Cleanup(subscription.Unsubscribe)
+
+	go state.History.Run(subscription)
+
+	client, _ := serve(t, state)
+	first := openStream(t, client, "")
+	second := openStream(t, client, "")
+
+	portMap := nat.PortMap{"443/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8443"}}}
+	require.NoError(t, state.Tracker.Add(context.Background(), "web", portMap))
+	require.NoError(t, state.Tracker.Remove(context.Background(), "web"))
+
+	// Both clients receive the changes, in order.
+	expected := []string{"add 8443 ", "add 8443 sent", "remove 8443 ", "remove 8443 sent"}
+	events := nextEvents(t, first, len(expected))
+	assert.Equal(t, expected, changes(events))
+	assert.Equal(t, expected, changes(nextEvents(t, second, len(expected))))
+
+	for _, event := range events {
+		assert.Equal(t, history.KindTracker, event.kind)
+		assert.Equal(t, "web", event.record.ID)
+	}
+
+	// A client that reconnects receives the changes that it missed, then the new ones.
+	require.NoError(t, state.Tracker.Add(context.Background(), "db",
+		nat.PortMap{"5432/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "5432"}}}))
+
+	reconnected := openStream(t, client, events[1].id)
+	missed := nextEvents(t, reconnected, 4)
+	assert.Equal(t, []string{"remove 8443 ", "remove 8443 sent", "add 5432 ", "add 5432 sent"}, changes(missed))
+	assert.Equal(t, events[2].id, missed[0].id)
+
+	state.History.AddSubsystemFailure("kubernetes", "backing off", nil)
+
+	live := nextEvents(t, reconnected, 1)
+	assert.Equal(t, history.KindSubsystem, live[0].kind)
+	assert.Equal(t, "kubernetes", live[0].record.Subsystem)
+}
+
+func TestServerStreamEventsEvicted(t *testing.T) {
+	t.Parallel()
+
+	state := testState(t)
+	state.History = history.New(2)
+
+	for range 5 {
+		state.History.Add(history.Record{Timestamp: time.Now(), Kind: history.KindTracker, ID: containerID})
+	}
+
+	client, _ := serve(t, state)
+
+	// The records 4 and 5 are held, the ones after 1 that were evicted are reported as dropped.
+	events := nextEvents(t, openStream(t, client, "1"), 3)
+	assert.Equal(t, history.KindDropped, events[0].kind)
+	assert.Empty(t, events[0].id)
+	assert.Equal(t, uint64(2), events[0].record.Dropped)
+	assert.Equal(t, []string{"4", "5"}, []string{events[1].id, events[2].id})
+
+	var response admin.Error
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://agent/events/stream", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "latest")
+
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+	assert.Contains(t, response.Error, "invalid Last-Event-ID")
+}
+
+func TestServerStreamEventsShutdown(t *testing.T) {
+	t.Parallel()
+
+	state := testState(t)
+	state.History = history.New(history.DefaultSize)
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- admin.NewServer(state).ListenAndServe(ctx, path)
+	}()
+
+	client := dialClient(t, path)
+	events := openStream(t, client, "")
+
+	// The open streams do not hold up the shutdown.
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(2 * time.Second):
+		require.FailNow(t, "the server did not shut down")
+	}
+
+	for range events {
+		assert.Fail(t, "no event was streamed")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit writes an append-only record of the port bindings that the
+// agent forwards and withdraws, and of whether the host was told about them,
+// for the compliance and the bug reports.
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+const (
+	// BufferSize is the number of changes that are held while the log is written,
+	// the changes that do not fit are recorded as dropped rather than blocking the tracker.
+	BufferSize = 1024
+	// ActionDropped is the action of the records of the changes that were lost.
+	ActionDropped = "dropped"
+	// OutcomeTracked is the outcome of the changes of the tracker itself, the
+	// outcome of sending them to the host is recorded by the records that follow.
+	OutcomeTracked = "tracked"
+)
+
+// Record is a line of the audit log.
+type Record struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Action is either tracker.ActionAdd, tracker.ActionRemove or ActionDropped.
+	Action   string            `json:"action"`
+	ID       string            `json:"id,omitempty"`
+	Port     string            `json:"port,omitempty"`
+	Protocol string            `json:"protocol,omitempty"`
+	HostIP   string            `json:"hostIP,omitempty"`
+	Source   string            `json:"source,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Outcome is OutcomeTracked, or the tracker.Outcome of sending the change to the host.
+	Outcome string `json:"outcome,omitempty"`
+	// Error is why the change could not be sent to the host.
+	Error string `json:"error,omitempty"`
+	// Dropped is the number of changes that were lost since the last record.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// Syncer is implemented by the outputs that can commit
+// their writes to stable storage, e.g. logging.RotatingFile.
+type Syncer interface {
+	Sync() error
+}
+
+// Logger writes the records of the changes of a tracker, see Run.
+type Logger struct {
+	output io.Writer
+	// sync commits every record to stable storage, if the output supports it.
+	sync    bool
+	limiter *logging.Limiter
+	dropped uint64
+}
+
+// NewLogger creates a logger that writes the records to the output; with sync,
+// every record is committed to stable storage if the output is a Syncer.
+func NewLogger(output io.Writer, sync bool) *Logger {
+	return &Logger{
+		output:  output,
+		sync:    sync,
+		limiter: logging.NewLimiter(0),
+	}
+}
+
+// Run writes a record for every event of the subscription until it is
+// unsubscribed, it should have tracker.WithOutcomes. The records that fail
+// to be written are only logged, they never block the tracker.
+func (l *Logger) Run(subscription *tracker.Subscription) {
+	for event := range subscription.Events() {
+		l.recordDropped(subscription)
+
+		outcome := OutcomeTracked
+		if event.Outcome != "" {
+			outcome = string(event.Outcome)
+		}
+
+		l.write(Record{
+			Timestamp: event.Timestamp,
+			Action:    string(event.Action),
+			ID:        event.ID,
+			Port:      event.Port,
+			Protocol:  event.Protocol,
+			HostIP:    event.HostIP,
+			Source:    event.Source,
+			Metadata:  event.Metadata,
+			Outcome:   outcome,
+			Error:     event.Error,
+		})
+	}
+
+	l.recordDropped(subscription)
+}
+
+// recordDropped writes a record of the changes that the subscription lost since the last one.
+func (l *Logger) recordDropped(subscription *tracker.Subscription) {
+	dropped := subscription.Dropped()
+	if dropped == l.dropped {
+		return
+	}
+
+	log.Warnf("the audit log lost %d changes, it is not written fast enough", dropped-l.dropped)
+	l.write(Record{Timestamp: time.Now(), Action: ActionDropped, Dropped: dropped - l.dropped})
+	l.dropped = dropped
+}
+
+func (l *Logger) write(record Record) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		l.limiter.Errorf(log.Current, "failed to write the audit log: %v", err)
+
+		return
+	}
+
+	if _, err := l.output.Write(append(line, '\n')); err != nil {
+		l.limiter.Errorf(log.Current, "failed to write the audit log: %v", err)
+
+		return
+	}
+
+	if syncer, ok := l.output.(Syncer); ok && l.sync {
+		if err := syncer.Sync(); err != nil {
+			l.limiter.Errorf(log.Current, "failed to sync the audit log: %v", err)
+
+			return
+		}
+	}
+
+	l.limiter.Reset(log.Current)
+}
@@ -0,0 +1,213 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/audit"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errRefused = errors.New("connection refused")
+
+// testForwarder fails the sends while failing is set.
+type testForwarder struct {
+	mutex   sync.Mutex
+	failing bool
+}
+
+func (f *testForwarder) Send(context.Context, types.PortMapping) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failing {
+		return errRefused
+	}
+
+	return nil
+}
+
+func (f *testForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	for _, portMapping := range portMappings {
+		if err := f.Send(ctx, portMapping); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *testForwarder) setFailing(failing bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failing = failing
+}
+
+func portMap(port string) nat.PortMap {
+	return nat.PortMap{nat.Port(port + "/tcp"): []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: port}}}
+}
+
+// readRecords returns the records of the audit log at path, line by line.
+func readRecords(t *testing.T, path string) []audit.Record {
+	t.Helper()
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+
+	defer file.Close()
+
+	var records []audit.Record
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record audit.Record
+
+		decoder := json.NewDecoder(bytes.NewReader(scanner.Bytes()))
+		decoder.DisallowUnknownFields()
+		require.NoError(t, decoder.Decode(&record), scanner.Text())
+		assert.False(t, record.Timestamp.IsZero(), scanner.Text())
+
+		record.Timestamp = time.Time{}
+		records = append(records, record)
+	}
+
+	require.NoError(t, scanner.Err())
+
+	return records
+}
+
+func TestLoggerRun(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	file, err := logging.OpenFile(path, 0, 0, os.Stderr)
+	require.NoError(t, err)
+
+	forwarder := &testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder, []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}})
+	subscription := vtunnelTracker.Subscribe(audit.BufferSize, tracker.WithOutcomes())
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		audit.NewLogger(file, true).Run(subscription)
+	}()
+
+	metadata := map[string]string{"name": "web"}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "web", portMap("8080"),
+		tracker.WithSource(tracker.SourceDocker), tracker.WithMetadata(metadata)))
+
+	forwarder.setFailing(true)
+	require.ErrorIs(t, vtunnelTracker.Add(context.Background(), "db", portMap("5432"), tracker.WithSource(tracker.SourceDocker)), errRefused)
+	require.ErrorIs(t, vtunnelTracker.Remove(context.Background(), "web"), errRefused)
+
+	forwarder.setFailing(false)
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), "web"))
+
+	subscription.Unsubscribe()
+	<-done
+	require.NoError(t, file.Close())
+
+	web := audit.Record{
+		ID: "web", Port: "8080", Protocol: "tcp", HostIP: "127.0.0.1", Source: tracker.SourceDocker, Metadata: metadata,
+	}
+	with := func(record audit.Record, action tracker.Action, outcome, message string) audit.Record {
+		record.Action, record.Outcome, record.Error = string(action), outcome, message
+
+		return record
+	}
+
+	assert.Equal(t, []audit.Record{
+		with(web, tracker.ActionAdd, audit.OutcomeTracked, ""),
+		with(web, tracker.ActionAdd, string(tracker.OutcomeSent), ""),
+		with(audit.Record{ID: "db", Port: "5432", Protocol: "tcp", HostIP: "127.0.0.1", Source: tracker.SourceDocker},
+			tracker.ActionAdd, string(tracker.OutcomeFailed), errRefused.Error()),
+		with(web, tracker.ActionRemove, string(tracker.OutcomeFailed), errRefused.Error()),
+		with(web, tracker.ActionRemove, audit.OutcomeTracked, ""),
+		with(web, tracker.ActionRemove, string(tracker.OutcomeSent), ""),
+	}, readRecords(t, path))
+}
+
+// blockingWriter blocks the writes until it is released.
+type blockingWriter struct {
+	release chan struct{}
+	mutex   sync.Mutex
+	lines   []string
+}
+
+func (b *blockingWriter) Write(p []byte) (int, error) {
+	<-b.release
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lines = append(b.lines, string(p))
+
+	return len(p), nil
+}
+
+func TestLoggerDoesNotBlock(t *testing.T) {
+	t.Parallel()
+
+	writer := &blockingWriter{release: make(chan struct{})}
+	vtunnelTracker := tracker.NewVTunnelTracker(&testForwarder{}, nil)
+	subscription := vtunnelTracker.Subscribe(1, tracker.WithOutcomes())
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		audit.NewLogger(writer, true).Run(subscription)
+	}()
+
+	// The tracker keeps forwarding while the audit log is stuck.
+	for _, port := range []string{"8080", "8081", "8082"} {
+		require.NoError(t, vtunnelTracker.Add(context.Background(), port, portMap(port)))
+	}
+
+	require.NotZero(t, subscription.Dropped())
+
+	close(writer.release)
+	subscription.Unsubscribe()
+	<-done
+
+	var dropped uint64
+	for _, line := range writer.lines {
+		var record audit.Record
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+
+		if record.Action == audit.ActionDropped {
+			dropped += record.Dropped
+		}
+	}
+
+	assert.Equal(t, subscription.Dropped(), dropped)
+}
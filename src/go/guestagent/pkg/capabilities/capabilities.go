@@ -0,0 +1,195 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package capabilities checks that the agent has the capabilities that its
+// enabled subsystems need, so that it can run without being root, e.g. from
+// a systemd unit that only grants the network capabilities.
+package capabilities
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// StatusPath is the status file of the agent, which has its capabilities.
+const StatusPath = "/proc/self/status"
+
+// Capability is a Linux capability, see capabilities(7).
+type Capability struct {
+	Name string
+	bit  uint
+}
+
+//nolint:gochecknoglobals
+var (
+	NetAdmin       = Capability{Name: "CAP_NET_ADMIN", bit: unix.CAP_NET_ADMIN}
+	NetRaw         = Capability{Name: "CAP_NET_RAW", bit: unix.CAP_NET_RAW}
+	NetBindService = Capability{Name: "CAP_NET_BIND_SERVICE", bit: unix.CAP_NET_BIND_SERVICE}
+	SysAdmin       = Capability{Name: "CAP_SYS_ADMIN", bit: unix.CAP_SYS_ADMIN}
+	SysPtrace      = Capability{Name: "CAP_SYS_PTRACE", bit: unix.CAP_SYS_PTRACE}
+)
+
+var (
+	// ErrMissing is returned by Check when the agent lacks capabilities.
+	ErrMissing = errors.New("missing capabilities")
+	// ErrInvalidStatus is returned by Parse when the status has no effective capabilities.
+	ErrInvalidStatus = errors.New("invalid process status")
+)
+
+// Set is a set of capabilities.
+type Set uint64
+
+// Has returns true if the set has the capability.
+func (s Set) Has(capability Capability) bool {
+	return s&(1<<capability.bit) != 0
+}
+
+// Reader returns the effective capabilities of the agent, see Effective.
+type Reader func() (Set, error)
+
+// Effective returns the effective capabilities of the agent from StatusPath.
+func Effective() (Set, error) {
+	file, err := os.Open(StatusPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return Parse(file)
+}
+
+// Parse returns the effective capabilities of the status of a process, in
+// the format of /proc/<pid>/status.
+func Parse(status io.Reader) (Set, error) {
+	scanner := bufio.NewScanner(status)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "CapEff:")
+		if !ok {
+			continue
+		}
+
+		set, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%w: CapEff: %w", ErrInvalidStatus, err)
+		}
+
+		return Set(set), nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("%w: no CapEff", ErrInvalidStatus)
+}
+
+// Subsystems are the subsystems of the agent that are enabled.
+type Subsystems struct {
+	Iptables   bool
+	Docker     bool
+	Containerd bool
+	Kubernetes bool
+	// Netns is set when the scans run within another network namespace, see -netns.
+	Netns bool
+}
+
+// Requirement is a subsystem and the capabilities that it needs.
+type Requirement struct {
+	Subsystem    string
+	Capabilities []Capability
+}
+
+// Required returns the requirements of the enabled subsystems.
+func Required(subsystems Subsystems) []Requirement {
+	var requirements []Requirement
+
+	// The iptables rules are read with iptables, which opens a raw socket.
+	if subsystems.Iptables {
+		requirements = append(requirements, Requirement{
+			Subsystem:    "iptables scanning",
+			Capabilities: []Capability{NetAdmin, NetRaw},
+		})
+	}
+
+	// The published ports are exposed with iptables rules, and listened to in case they are privileged.
+	if subsystems.Docker {
+		requirements = append(requirements, Requirement{
+			Subsystem:    "Docker event monitoring",
+			Capabilities: []Capability{NetAdmin, NetRaw, NetBindService},
+		})
+	}
+
+	// Besides, the addresses of the containers are read by entering their network namespace.
+	if subsystems.Containerd {
+		requirements = append(requirements, Requirement{
+			Subsystem:    "Containerd event monitoring",
+			Capabilities: []Capability{NetAdmin, NetRaw, NetBindService, SysAdmin, SysPtrace},
+		})
+	}
+
+	if subsystems.Kubernetes {
+		requirements = append(requirements, Requirement{
+			Subsystem:    "Kubernetes service forwarding",
+			Capabilities: []Capability{NetBindService},
+		})
+	}
+
+	// The namespace is entered with setns(2).
+	if subsystems.Netns {
+		requirements = append(requirements, Requirement{
+			Subsystem:    "network namespace scanning",
+			Capabilities: []Capability{SysAdmin},
+		})
+	}
+
+	return requirements
+}
+
+// Check returns ErrMissing, naming the capabilities that every subsystem
+// lacks, unless the effective capabilities that reader returns have all the
+// ones of the requirements; root has all of them.
+func Check(reader Reader, requirements []Requirement) error {
+	set, err := reader()
+	if err != nil {
+		return fmt.Errorf("failed to read the capabilities: %w", err)
+	}
+
+	var missing []string
+
+	for _, requirement := range requirements {
+		var names []string
+
+		for _, capability := range requirement.Capabilities {
+			if !set.Has(capability) {
+				names = append(names, capability.Name)
+			}
+		}
+
+		if len(names) != 0 {
+			missing = append(missing, requirement.Subsystem+" requires "+strings.Join(names, ", "))
+		}
+	}
+
+	if len(missing) != 0 {
+		return fmt.Errorf("%w: %s", ErrMissing, strings.Join(missing, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package capabilities_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/capabilities"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errStatus = errors.New("no status")
+
+const (
+	// root are the effective capabilities of root, as they were captured on a WSL distribution.
+	root = "0000003fffffffff"
+	// network are the effective capabilities of a systemd unit with
+	// CAP_NET_ADMIN, CAP_NET_RAW and CAP_NET_BIND_SERVICE.
+	network = "0000000000003400"
+)
+
+// fakeReader returns the capabilities of a status with the effective ones.
+func fakeReader(t *testing.T, effective string) capabilities.Reader {
+	t.Helper()
+
+	return func() (capabilities.Set, error) {
+		return capabilities.Parse(strings.NewReader(
+			"Name:\trancher-desktop-guestagent\nCapInh:\t0000000000000000\nCapPrm:\t" + effective + "\nCapEff:\t" + effective + "\n",
+		))
+	}
+}
+
+func TestParse(t *testing.T) {
+	t.Parallel()
+
+	set, err := fakeReader(t, network)()
+	require.NoError(t, err)
+	assert.True(t, set.Has(capabilities.NetAdmin))
+	assert.True(t, set.Has(capabilities.NetRaw))
+	assert.True(t, set.Has(capabilities.NetBindService))
+	assert.False(t, set.Has(capabilities.SysAdmin))
+
+	_, err = capabilities.Parse(strings.NewReader("Name:\tagent\n"))
+	require.ErrorIs(t, err, capabilities.ErrInvalidStatus)
+
+	_, err = capabilities.Parse(strings.NewReader("CapEff:\tall\n"))
+	require.ErrorIs(t, err, capabilities.ErrInvalidStatus)
+}
+
+func TestEffective(t *testing.T) {
+	t.Parallel()
+
+	_, err := capabilities.Effective()
+	require.NoError(t, err)
+}
+
+func TestCheck(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		effective  string
+		subsystems capabilities.Subsystems
+		expected   string
+	}{
+		{
+			name:       "root",
+			effective:  root,
+			subsystems: capabilities.Subsystems{Iptables: true, Docker: true, Containerd: true, Kubernetes: true},
+		},
+		{
+			name:       "network capabilities with iptables and kubernetes",
+			effective:  network,
+			subsystems: capabilities.Subsystems{Iptables: true, Kubernetes: true},
+		},
+		{
+			name:       "network capabilities with docker",
+			effective:  network,
+			subsystems: capabilities.Subsystems{Docker: true},
+		},
+		{
+			name:       "network capabilities with containerd",
+			effective:  network,
+			subsystems: capabilities.Subsystems{Containerd: true, Kubernetes: true},
+			expected:   "missing capabilities: Containerd event monitoring requires CAP_SYS_ADMIN, CAP_SYS_PTRACE",
+		},
+		{
+			name:       "network capabilities with iptables in a network namespace",
+			effective:  network,
+			subsystems: capabilities.Subsystems{Iptables: true, Netns: true},
+			expected:   "missing capabilities: network namespace scanning requires CAP_SYS_ADMIN",
+		},
+		{
+			name:       "no capabilities with iptables and kubernetes",
+			effective:  "0000000000000000",
+			subsystems: capabilities.Subsystems{Iptables: true, Kubernetes: true},
+			expected: "missing capabilities: iptables scanning requires CAP_NET_ADMIN, CAP_NET_RAW; " +
+				"Kubernetes service forwarding requires CAP_NET_BIND_SERVICE",
+		},
+		{
+			name:      "no capabilities without subsystems",
+			effective: "0000000000000000",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := capabilities.Check(fakeReader(t, test.effective), capabilities.Required(test.subsystems))
+			if test.expected == "" {
+				require.NoError(t, err)
+
+				return
+			}
+
+			require.ErrorIs(t, err, capabilities.ErrMissing)
+			require.EqualError(t, err, test.expected)
+		})
+	}
+}
+
+func TestCheckReadFailure(t *testing.T) {
+	t.Parallel()
+
+	err := capabilities.Check(func() (capabilities.Set, error) {
+		return 0, errStatus
+	}, nil)
+	require.ErrorIs(t, err, errStatus)
+}
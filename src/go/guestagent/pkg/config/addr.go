@@ -0,0 +1,72 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// UnixScheme is the scheme of the addresses of unix sockets, e.g. unix:///run/guestagent.sock.
+const UnixScheme = "unix://"
+
+// maxSocketPath is the longest path of a unix socket, the size of sun_path without its terminating NUL.
+const maxSocketPath = 107
+
+var ErrInvalidAddr = errors.New("invalid address")
+
+// CheckPort checks that the port is a number between 1 and 65535.
+func CheckPort(port string) error {
+	number, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || number == 0 {
+		return fmt.Errorf("%w: port %q must be a number between 1 and 65535", ErrInvalidAddr, port)
+	}
+
+	return nil
+}
+
+// CheckListenAddr checks that the address is a HOST:PORT address to listen
+// on, e.g. 127.0.0.1:9311; the host is empty for all the interfaces.
+func CheckListenAddr(addr string) error {
+	if scheme, _, ok := strings.Cut(addr, "://"); ok {
+		return fmt.Errorf("%w: %q must be in the HOST:PORT format, without the %s:// scheme", ErrInvalidAddr, addr, scheme)
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%w: %q must be in the HOST:PORT format: %w", ErrInvalidAddr, addr, err)
+	}
+
+	return CheckPort(port)
+}
+
+// SocketPath returns the path of the unix socket at addr, which is either the
+// path itself or the path with the UnixScheme, e.g. unix:///run/guestagent.sock.
+func SocketPath(addr string) (string, error) {
+	path := strings.TrimPrefix(addr, UnixScheme)
+
+	switch {
+	case strings.Contains(path, "://"):
+		return "", fmt.Errorf("%w: %q must be the path of a unix socket, with or without the %s scheme", ErrInvalidAddr, addr, UnixScheme)
+	case path == "":
+		return "", fmt.Errorf("%w: %q has no socket path", ErrInvalidAddr, addr)
+	case len(path) > maxSocketPath:
+		return "", fmt.Errorf("%w: the socket path %q is longer than %d bytes", ErrInvalidAddr, path, maxSocketPath)
+	}
+
+	return path, nil
+}
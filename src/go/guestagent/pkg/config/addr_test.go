@@ -0,0 +1,76 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckListenAddr(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		addr  string
+		valid bool
+	}{
+		{addr: "127.0.0.1:9311", valid: true},
+		{addr: "[::1]:9311", valid: true},
+		{addr: "localhost:6060", valid: true},
+		{addr: ":9311", valid: true},
+		{addr: "127.0.0.1:65535", valid: true},
+		{addr: "127.0.0.1"},
+		{addr: "127.0.0.1:0"},
+		{addr: "127.0.0.1:65536"},
+		{addr: "127.0.0.1:metrics"},
+		{addr: "::1:9311"},
+		{addr: "http://127.0.0.1:9311"},
+		{addr: ""},
+	} {
+		err := config.CheckListenAddr(test.addr)
+		if test.valid {
+			require.NoError(t, err, test.addr)
+		} else {
+			require.ErrorIs(t, err, config.ErrInvalidAddr, test.addr)
+		}
+	}
+}
+
+func TestSocketPath(t *testing.T) {
+	t.Parallel()
+
+	for _, test := range []struct {
+		addr string
+		path string
+	}{
+		{addr: "/run/guestagent.sock", path: "/run/guestagent.sock"},
+		{addr: "unix:///run/guestagent.sock", path: "/run/guestagent.sock"},
+		{addr: "guestagent.sock", path: "guestagent.sock"},
+		{addr: "unix://"},
+		{addr: "tcp://127.0.0.1:3040"},
+		{addr: "/run/" + strings.Repeat("a", 103)},
+	} {
+		path, err := config.SocketPath(test.addr)
+		if test.path != "" {
+			require.NoError(t, err, test.addr)
+			assert.Equal(t, test.path, path)
+		} else {
+			require.ErrorIs(t, err, config.ErrInvalidAddr, test.addr)
+		}
+	}
+}
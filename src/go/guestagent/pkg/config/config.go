@@ -0,0 +1,136 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config sets the flags of the agent that were not given on the
+// command line from a configuration file, so that the agent can be
+// configured without editing the scripts that start it.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Masterminds/log-go"
+	"gopkg.in/yaml.v3"
+)
+
+// FlagName is the name of the flag that Load is usually given the path of.
+const FlagName = "config"
+
+var ErrInvalidConfig = errors.New("invalid configuration file")
+
+// Load sets the flags that were not set on the command line from the YAML
+// file at path, whose keys are the names of the flags, e.g.
+//
+//	debug: true
+//	vtunnelAddr: 127.0.0.1:3040
+//	batchWindow: 250ms
+//
+// The flags that were set take precedence, and the flags that are in neither
+// keep their defaults. The values are parsed like on the command line, the
+// keys that are not the name of a flag are only warned about so that the
+// file can be shared with the agents that have more flags.
+func Load(flags *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+	}
+
+	values, err := parse(data)
+	if err != nil {
+		return fmt.Errorf("%w %s: %w", ErrInvalidConfig, path, err)
+	}
+
+	set := setFlags(flags)
+
+	for _, value := range values {
+		switch {
+		case ignored(flags, value.key, path):
+		case set[value.key]:
+			log.Debugf("the -%s flag overrides the %q key of the configuration file %s", value.key, value.key, path)
+		default:
+			if err := flags.Set(value.key, value.value); err != nil {
+				return fmt.Errorf("%w %s: line %d: key %q: %w", ErrInvalidConfig, path, value.line, value.key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ignored returns true, and warns about it, if the key of the
+// configuration file at path is not the name of a flag that it can set.
+func ignored(flags *flag.FlagSet, key, path string) bool {
+	switch {
+	case key == FlagName:
+		log.Warnf("ignoring the %q key of the configuration file %s", key, path)
+	case flags.Lookup(key) == nil:
+		log.Warnf("ignoring the unknown key %q of the configuration file %s", key, path)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// keyValue is a key of the configuration file, and its value as it would be given on the command line.
+type keyValue struct {
+	key   string
+	value string
+	line  int
+}
+
+// parse returns the keys of the YAML document in the order they are in,
+// an empty document has none.
+func parse(data []byte) ([]keyValue, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	if len(document.Content) == 0 {
+		return nil, nil
+	}
+
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: the configuration must be a mapping of the flag names to their values", root.Line)
+	}
+
+	values := make([]keyValue, 0, len(root.Content)/2)
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		if value.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("line %d: key %q: the value must be a scalar", value.Line, key.Value)
+		}
+
+		values = append(values, keyValue{key: key.Value, value: value.Value, line: value.Line})
+	}
+
+	return values, nil
+}
+
+// setFlags returns the names of the flags that were set.
+func setFlags(flags *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+
+	flags.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	return set
+}
@@ -0,0 +1,161 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testFlags are some of the flags of the agent, with their defaults.
+type testFlags struct {
+	flags       *flag.FlagSet
+	debug       *bool
+	iptables    *bool
+	vtunnelAddr *string
+	batchWindow *time.Duration
+	maxPorts    *int
+}
+
+func newTestFlags(t *testing.T, args ...string) testFlags {
+	t.Helper()
+
+	flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+	testFlags := testFlags{
+		flags:       flags,
+		debug:       flags.Bool("debug", false, ""),
+		iptables:    flags.Bool("iptables", true, ""),
+		vtunnelAddr: flags.String("vtunnelAddr", "127.0.0.1:3040", ""),
+		batchWindow: flags.Duration("batchWindow", 100*time.Millisecond, ""),
+		maxPorts:    flags.Int("maxPorts", 0, ""),
+	}
+	flags.String(config.FlagName, "", "")
+
+	require.NoError(t, flags.Parse(args))
+
+	return testFlags
+}
+
+// writeConfig writes the configuration file and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "guestagent.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	t.Parallel()
+
+	flags := newTestFlags(t)
+	path := writeConfig(t, `
+debug: true
+iptables: false
+vtunnelAddr: 127.0.0.1:3041,unix:///run/relay.sock
+batchWindow: 250ms
+maxPorts: 512
+`)
+
+	require.NoError(t, config.Load(flags.flags, path))
+	assert.True(t, *flags.debug)
+	assert.False(t, *flags.iptables)
+	assert.Equal(t, "127.0.0.1:3041,unix:///run/relay.sock", *flags.vtunnelAddr)
+	assert.Equal(t, 250*time.Millisecond, *flags.batchWindow)
+	assert.Equal(t, 512, *flags.maxPorts)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	t.Parallel()
+
+	// The flags that were set override the file, including to their defaults.
+	flags := newTestFlags(t, "-debug=false", "-batchWindow", "1s")
+	path := writeConfig(t, "debug: true\nbatchWindow: 250ms\nmaxPorts: 512\n")
+
+	require.NoError(t, config.Load(flags.flags, path))
+	assert.False(t, *flags.debug)
+	assert.Equal(t, time.Second, *flags.batchWindow)
+	assert.Equal(t, 512, *flags.maxPorts)
+}
+
+func TestLoadPartial(t *testing.T) {
+	t.Parallel()
+
+	flags := newTestFlags(t)
+	path := writeConfig(t, "# Only forward the containers' ports.\niptables: false\n")
+
+	require.NoError(t, config.Load(flags.flags, path))
+	assert.False(t, *flags.iptables)
+	assert.False(t, *flags.debug)
+	assert.Equal(t, "127.0.0.1:3040", *flags.vtunnelAddr)
+	assert.Equal(t, 100*time.Millisecond, *flags.batchWindow)
+
+	for _, content := range []string{"", "# Nothing is configured.\n"} {
+		require.NoError(t, config.Load(flags.flags, writeConfig(t, content)))
+	}
+}
+
+func TestLoadUnknownKeys(t *testing.T) {
+	t.Parallel()
+
+	flags := newTestFlags(t)
+	path := writeConfig(t, "fromTheFuture: true\nconfig: /etc/other.yaml\nmaxPorts: 8\n")
+
+	require.NoError(t, config.Load(flags.flags, path))
+	assert.Equal(t, 8, *flags.maxPorts)
+	assert.Equal(t, "", flags.flags.Lookup(config.FlagName).Value.String())
+}
+
+func TestLoadInvalid(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		content  string
+		contains string
+	}{
+		{name: "malformed", content: "debug: [true\n", contains: "line"},
+		{name: "not a mapping", content: "- debug\n- iptables\n", contains: "mapping"},
+		{name: "not a scalar", content: "vtunnelAddr:\n  - 127.0.0.1:3040\n", contains: `key "vtunnelAddr"`},
+		{name: "invalid bool", content: "maxPorts: 8\ndebug: yes please\n", contains: `line 2: key "debug"`},
+		{name: "invalid duration", content: "batchWindow: 250\n", contains: `key "batchWindow"`},
+		{name: "invalid int", content: "maxPorts: many\n", contains: `key "maxPorts"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := config.Load(newTestFlags(t).flags, writeConfig(t, test.content))
+			require.ErrorIs(t, err, config.ErrInvalidConfig)
+			assert.ErrorContains(t, err, test.contains)
+		})
+	}
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	t.Parallel()
+
+	err := config.Load(newTestFlags(t).flags, filepath.Join(t.TempDir(), "missing.yaml"))
+	require.ErrorIs(t, err, config.ErrInvalidConfig)
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+)
+
+// OriginPlatform is the origin of the defaults that SetDefaults replaced.
+const OriginPlatform Origin = "platform"
+
+// SetDefaults replaces the defaults of the flags that were not set, e.g. with
+// the ones of the platform that the agent runs on, and returns the names of
+// the flags whose defaults it replaced. It must be called once LoadEnv and
+// Load set the flags, since the values that they set take precedence; the
+// flags that the defaults do not name keep theirs. Reload resolves the flags
+// to the replaced defaults from then on.
+func SetDefaults(flags *flag.FlagSet, defaults map[string]string) ([]string, error) {
+	set := setFlags(flags)
+
+	var replaced []string
+
+	for name, value := range defaults {
+		f := flags.Lookup(name)
+		if f == nil {
+			return nil, fmt.Errorf("%w: no flag is named %q", ErrInvalidConfig, name)
+		}
+
+		if set[name] {
+			continue
+		}
+
+		// The value is set without marking the flag as set, so that it is still a default.
+		if err := f.Value.Set(value); err != nil {
+			return nil, fmt.Errorf("%w: default of -%s: %w", ErrInvalidConfig, name, err)
+		}
+
+		f.DefValue = f.Value.String()
+		replaced = append(replaced, name)
+	}
+
+	sort.Strings(replaced)
+
+	return replaced, nil
+}
@@ -0,0 +1,68 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetDefaults(t *testing.T) {
+	t.Parallel()
+
+	flags := newTestFlags(t, "-maxPorts=64")
+	commandLine := config.CommandLine(flags.flags)
+	env := lookupEnv(map[string]string{"RD_GUESTAGENT_IPTABLES": "true"})
+
+	require.NoError(t, config.LoadEnv(flags.flags, env))
+
+	// The flags that were set keep their values.
+	replaced, err := config.SetDefaults(flags.flags, map[string]string{
+		"maxPorts":    "8",
+		"iptables":    "false",
+		"batchWindow": "0.25s",
+		"vtunnelAddr": "unix:///run/vtunnel.sock",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"batchWindow", "vtunnelAddr"}, replaced)
+	assert.Equal(t, 64, *flags.maxPorts)
+	assert.True(t, *flags.iptables)
+	assert.Equal(t, "250ms", flags.flags.Lookup("batchWindow").Value.String())
+	assert.Equal(t, "unix:///run/vtunnel.sock", *flags.vtunnelAddr)
+
+	// They are still defaults, which the reloads keep.
+	origins := config.Origins{}
+	origins.Record(flags.flags, config.OriginEnv)
+	assert.Equal(t, config.OriginDefault, origins.Of("vtunnelAddr"))
+
+	changed, err := config.Reload(flags.flags, commandLine, "", env)
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+}
+
+func TestSetDefaultsInvalid(t *testing.T) {
+	t.Parallel()
+
+	flags := newTestFlags(t)
+
+	_, err := config.SetDefaults(flags.flags, map[string]string{"unknown": "1"})
+	require.ErrorIs(t, err, config.ErrInvalidConfig)
+
+	_, err = config.SetDefaults(flags.flags, map[string]string{"maxPorts": "many"})
+	require.ErrorIs(t, err, config.ErrInvalidConfig)
+	assert.ErrorContains(t, err, "default of -maxPorts")
+}
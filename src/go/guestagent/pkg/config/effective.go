@@ -0,0 +1,80 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"flag"
+	"net/url"
+	"strings"
+)
+
+// Redacted replaces the values of the secret flags, see Effective.
+const Redacted = "<redacted>"
+
+// secretWords are the words of the flag names whose values are redacted.
+var secretWords = []string{"key", "token", "password", "secret"} //nolint:gochecknoglobals
+
+// Effective returns the current values of all the flags, as they would be
+// given on the command line. The values of the flags that hold secrets, e.g.
+// -vtunnelTLSKey, are replaced with Redacted unless they are empty, and so
+// are the passwords of the URLs, e.g. the one of -apiBaseURL.
+func Effective(flags *flag.FlagSet) map[string]string {
+	values := make(map[string]string)
+
+	flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch {
+		case value != "" && secret(f.Name):
+			value = Redacted
+		case strings.Contains(value, "@"):
+			value = redactURL(value)
+		}
+
+		values[f.Name] = value
+	})
+
+	return values
+}
+
+// redactURL replaces the password of the URL, if it is one that has a password.
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+
+	if _, ok := u.User.Password(); !ok {
+		return value
+	}
+
+	redacted := strings.Replace(value, u.User.String()+"@", u.User.Username()+":"+Redacted+"@", 1)
+	if redacted == value {
+		// The user info is escaped differently than url.Userinfo escapes it.
+		return u.Redacted()
+	}
+
+	return redacted
+}
+
+func secret(flagName string) bool {
+	name := strings.ToLower(flagName)
+
+	for _, word := range secretWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,90 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/Masterminds/log-go"
+)
+
+// EnvPrefix is the prefix of the environment variables that set the flags, see EnvName.
+const EnvPrefix = "RD_GUESTAGENT_"
+
+var ErrInvalidEnv = errors.New("invalid environment variable")
+
+// EnvName returns the name of the environment variable that sets the flag,
+// which is its name in upper snake case after EnvPrefix, e.g.
+// RD_GUESTAGENT_VTUNNEL_ADDR for -vtunnelAddr and RD_GUESTAGENT_K8S_API_PORT
+// for -k8sAPIPort.
+func EnvName(flagName string) string {
+	runes := []rune(flagName)
+
+	var name strings.Builder
+
+	name.WriteString(EnvPrefix)
+
+	for i, r := range runes {
+		// A word starts at an upper case letter that follows a lower case
+		// letter or a digit, or that starts a word after an acronym.
+		if i > 0 && unicode.IsUpper(r) {
+			previous := runes[i-1]
+			afterAcronym := unicode.IsUpper(previous) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+
+			if unicode.IsLower(previous) || unicode.IsDigit(previous) || afterAcronym {
+				name.WriteByte('_')
+			}
+		}
+
+		name.WriteRune(unicode.ToUpper(r))
+	}
+
+	return name.String()
+}
+
+// LoadEnv sets the flags that were not set on the command line from their
+// environment variables, see EnvName, which lookupEnv returns, e.g.
+// os.LookupEnv. The values are parsed like on the command line, and the
+// flags that LoadEnv sets take precedence over the configuration file
+// that Load is called with afterwards.
+func LoadEnv(flags *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	set := setFlags(flags)
+
+	var err error
+
+	flags.VisitAll(func(f *flag.Flag) {
+		name := EnvName(f.Name)
+
+		value, ok := lookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+
+		if set[f.Name] {
+			log.Debugf("the -%s flag overrides the %s environment variable", f.Name, name)
+
+			return
+		}
+
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%w %s: %w", ErrInvalidEnv, name, setErr)
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lookupEnv returns a fake os.LookupEnv of the environment variables.
+func lookupEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+
+		return value, ok
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	t.Parallel()
+
+	for flagName, name := range map[string]string{
+		"debug":                  "RD_GUESTAGENT_DEBUG",
+		"vtunnelAddr":            "RD_GUESTAGENT_VTUNNEL_ADDR",
+		"k8sAPIPort":             "RD_GUESTAGENT_K8S_API_PORT",
+		"k8sServiceListenerAddr": "RD_GUESTAGENT_K8S_SERVICE_LISTENER_ADDR",
+		"apiBaseURL":             "RD_GUESTAGENT_API_BASE_URL",
+		"vtunnelTLSCert":         "RD_GUESTAGENT_VTUNNEL_TLS_CERT",
+		"config":                 "RD_GUESTAGENT_CONFIG",
+	} {
+		assert.Equal(t, name, config.EnvName(flagName), flagName)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	t.Parallel()
+
+	flags := newTestFlags(t)
+	env := lookupEnv(map[string]string{
+		"RD_GUESTAGENT_DEBUG":        "1",
+		"RD_GUESTAGENT_IPTABLES":     "f",
+		"RD_GUESTAGENT_VTUNNEL_ADDR": "unix:///run/relay.sock",
+		"RD_GUESTAGENT_BATCH_WINDOW": "1m30s",
+		"RD_GUESTAGENT_MAX_PORTS":    "0x100",
+		"GUESTAGENT_DEBUG":           "false",
+	})
+
+	require.NoError(t, config.LoadEnv(flags.flags, env))
+	assert.True(t, *flags.debug)
+	assert.False(t, *flags.iptables)
+	assert.Equal(t, "unix:///run/relay.sock", *flags.vtunnelAddr)
+	assert.Equal(t, 90*time.Second, *flags.batchWindow)
+	assert.Equal(t, 256, *flags.maxPorts)
+}
+
+func TestLoadEnvPrecedence(t *testing.T) {
+	t.Parallel()
+
+	// The command line overrides the environment, which overrides the file.
+	flags := newTestFlags(t, "-debug=false")
+	env := lookupEnv(map[string]string{
+		"RD_GUESTAGENT_DEBUG":        "true",
+		"RD_GUESTAGENT_BATCH_WINDOW": "1s",
+	})
+	path := writeConfig(t, "debug: true\nbatchWindow: 250ms\nmaxPorts: 512\n")
+
+	require.NoError(t, config.LoadEnv(flags.flags, env))
+	require.NoError(t, config.Load(flags.flags, path))
+	assert.False(t, *flags.debug)
+	assert.Equal(t, time.Second, *flags.batchWindow)
+	assert.Equal(t, 512, *flags.maxPorts)
+	assert.True(t, *flags.iptables)
+}
+
+func TestLoadEnvConfigFile(t *testing.T) {
+	t.Parallel()
+
+	// The configuration file can be given in the environment as well.
+	flags := newTestFlags(t)
+	path := writeConfig(t, "maxPorts: 512\n")
+
+	require.NoError(t, config.LoadEnv(flags.flags, lookupEnv(map[string]string{"RD_GUESTAGENT_CONFIG": path})))
+
+	configFile := flags.flags.Lookup(config.FlagName).Value.String()
+	require.Equal(t, path, configFile)
+	require.NoError(t, config.Load(flags.flags, configFile))
+	assert.Equal(t, 512, *flags.maxPorts)
+}
+
+func TestLoadEnvInvalid(t *testing.T) {
+	t.Parallel()
+
+	for name, value := range map[string]string{
+		"RD_GUESTAGENT_DEBUG":        "",
+		"RD_GUESTAGENT_IPTABLES":     "yes",
+		"RD_GUESTAGENT_BATCH_WINDOW": "250",
+		"RD_GUESTAGENT_MAX_PORTS":    "many",
+	} {
+		err := config.LoadEnv(newTestFlags(t).flags, lookupEnv(map[string]string{name: value}))
+		require.ErrorIs(t, err, config.ErrInvalidEnv, name)
+		assert.ErrorContains(t, err, name)
+	}
+}
@@ -0,0 +1,48 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "flag"
+
+// Origin is where the value of a flag comes from.
+type Origin string
+
+const (
+	OriginCommandLine Origin = "flag"
+	OriginEnv         Origin = "env"
+	OriginConfig      Origin = "config"
+	OriginDefault     Origin = "default"
+)
+
+// Origins are the origins of the values of the flags, see Record.
+type Origins map[string]Origin
+
+// Record sets the origin of the flags that were set since the last call,
+// e.g. to OriginCommandLine after flag.Parse and to OriginEnv after LoadEnv.
+func (o Origins) Record(flags *flag.FlagSet, origin Origin) {
+	flags.Visit(func(f *flag.Flag) {
+		if _, ok := o[f.Name]; !ok {
+			o[f.Name] = origin
+		}
+	})
+}
+
+// Of returns the origin of the value of the flag, which is OriginDefault if it was not set.
+func (o Origins) Of(name string) Origin {
+	if origin, ok := o[name]; ok {
+		return origin
+	}
+
+	return OriginDefault
+}
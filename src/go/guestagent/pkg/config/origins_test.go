@@ -0,0 +1,44 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrigins(t *testing.T) {
+	t.Parallel()
+
+	flags := newTestFlags(t, "-maxPorts=64")
+	origins := config.Origins{}
+	origins.Record(flags.flags, config.OriginCommandLine)
+
+	// The command line takes precedence over the environment.
+	env := lookupEnv(map[string]string{"RD_GUESTAGENT_DEBUG": "1", "RD_GUESTAGENT_MAX_PORTS": "8"})
+	require.NoError(t, config.LoadEnv(flags.flags, env))
+	origins.Record(flags.flags, config.OriginEnv)
+
+	require.NoError(t, config.Load(flags.flags, writeConfig(t, "batchWindow: 250ms\ndebug: false\n")))
+	origins.Record(flags.flags, config.OriginConfig)
+
+	assert.Equal(t, config.OriginCommandLine, origins.Of("maxPorts"))
+	assert.Equal(t, config.OriginEnv, origins.Of("debug"))
+	assert.Equal(t, config.OriginConfig, origins.Of("batchWindow"))
+	assert.Equal(t, config.OriginDefault, origins.Of("iptables"))
+	assert.Equal(t, config.OriginDefault, origins.Of("unknown"))
+}
@@ -0,0 +1,96 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The formats that Print writes the settings in.
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+var ErrInvalidPrintFormat = errors.New("invalid format")
+
+// Setting is the effective value of a flag, and where it comes from.
+type Setting struct {
+	Value  string `json:"value"`
+	Origin Origin `json:"origin"`
+}
+
+// Settings returns the effective values of all the flags with their origins,
+// the secrets are redacted like Effective does.
+func Settings(flags *flag.FlagSet, origins Origins) map[string]Setting {
+	settings := make(map[string]Setting)
+
+	for name, value := range Effective(flags) {
+		settings[name] = Setting{Value: value, Origin: origins.Of(name)}
+	}
+
+	return settings
+}
+
+// Print writes the settings sorted by name, either in YAML like the
+// configuration file, with the origin of every value as the comment of its
+// line, or in JSON as an object of the names to their Setting.
+func Print(w io.Writer, settings map[string]Setting, format string) error {
+	switch format {
+	case FormatYAML:
+		return printYAML(w, settings)
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+
+		return encoder.Encode(settings)
+	default:
+		return fmt.Errorf("%w %q, valid options are %s and %s", ErrInvalidPrintFormat, format, FormatYAML, FormatJSON)
+	}
+}
+
+func printYAML(w io.Writer, settings map[string]Setting) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	document := &yaml.Node{Kind: yaml.MappingNode}
+
+	for _, name := range names {
+		value := &yaml.Node{Kind: yaml.ScalarNode, Value: settings[name].Value, LineComment: string(settings[name].Origin)}
+		// The empty values are quoted, rather than left out like a null.
+		if value.Value == "" {
+			value.Style = yaml.DoubleQuotedStyle
+		}
+
+		document.Content = append(document.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: name}, value)
+	}
+
+	encoder := yaml.NewEncoder(w)
+	if err := encoder.Encode(document); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
@@ -0,0 +1,100 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// layeredSettings returns the settings of the flags that are set on the
+// command line, in the environment and in the configuration file.
+func layeredSettings(t *testing.T) map[string]config.Setting {
+	t.Helper()
+
+	flags := newTestFlags(t, "-maxPorts=64")
+	flags.flags.String("apiToken", "", "")
+
+	origins := config.Origins{}
+	origins.Record(flags.flags, config.OriginCommandLine)
+
+	env := lookupEnv(map[string]string{"RD_GUESTAGENT_DEBUG": "1", "RD_GUESTAGENT_API_TOKEN": "s3cr3t"})
+	require.NoError(t, config.LoadEnv(flags.flags, env))
+	origins.Record(flags.flags, config.OriginEnv)
+
+	require.NoError(t, config.Load(flags.flags, writeConfig(t, "batchWindow: 250ms\nmaxPorts: 8\n")))
+	origins.Record(flags.flags, config.OriginConfig)
+
+	_, err := config.SetDefaults(flags.flags, map[string]string{"vtunnelAddr": "127.0.0.1:4040"})
+	require.NoError(t, err)
+
+	origins["vtunnelAddr"] = config.OriginPlatform
+
+	return config.Settings(flags.flags, origins)
+}
+
+func TestPrintYAML(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	require.NoError(t, config.Print(&output, layeredSettings(t), config.FormatYAML))
+	assert.Equal(t, `apiToken: <redacted> # env
+batchWindow: 250ms # config
+config: "" # default
+debug: true # env
+iptables: true # default
+maxPorts: 64 # flag
+vtunnelAddr: 127.0.0.1:4040 # platform
+`, output.String())
+
+	// The output can be loaded like a configuration file.
+	flags := newTestFlags(t)
+	require.NoError(t, config.Load(flags.flags, writeConfig(t, output.String())))
+	assert.Equal(t, 64, *flags.maxPorts)
+	assert.Equal(t, "127.0.0.1:4040", *flags.vtunnelAddr)
+}
+
+func TestPrintJSON(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	require.NoError(t, config.Print(&output, layeredSettings(t), config.FormatJSON))
+
+	var settings map[string]config.Setting
+	require.NoError(t, json.Unmarshal(output.Bytes(), &settings))
+	assert.Equal(t, map[string]config.Setting{
+		"apiToken":      {Value: config.Redacted, Origin: config.OriginEnv},
+		"batchWindow":   {Value: "250ms", Origin: config.OriginConfig},
+		config.FlagName: {Value: "", Origin: config.OriginDefault},
+		"debug":         {Value: "true", Origin: config.OriginEnv},
+		"iptables":      {Value: "true", Origin: config.OriginDefault},
+		"maxPorts":      {Value: "64", Origin: config.OriginCommandLine},
+		"vtunnelAddr":   {Value: "127.0.0.1:4040", Origin: config.OriginPlatform},
+	}, settings)
+}
+
+func TestPrintInvalidFormat(t *testing.T) {
+	t.Parallel()
+
+	err := config.Print(&bytes.Buffer{}, nil, "toml")
+	require.ErrorIs(t, err, config.ErrInvalidPrintFormat)
+	assert.ErrorContains(t, err, `"toml", valid options are yaml and json`)
+}
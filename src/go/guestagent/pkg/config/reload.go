@@ -0,0 +1,145 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+)
+
+// CommandLine returns the values of the flags that were set on the command
+// line, it must be called before LoadEnv and Load set the other flags.
+func CommandLine(flags *flag.FlagSet) map[string]string {
+	commandLine := make(map[string]string)
+
+	flags.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = f.Value.String()
+	})
+
+	return commandLine
+}
+
+// Reload resolves the flags again like at startup, from the values of the
+// command line that CommandLine returned, the environment, the configuration
+// file at path if it is not empty, and the defaults. It returns the new values
+// of the flags that changed, without setting them, so that the caller
+// decides which of them can be applied; it fails if any value is invalid.
+func Reload(
+	flags *flag.FlagSet,
+	commandLine map[string]string,
+	path string,
+	lookupEnv func(string) (string, bool),
+) (map[string]string, error) {
+	values := make(map[string]string)
+
+	flags.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.DefValue
+	})
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidConfig, err)
+		}
+
+		keyValues, err := parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w %s: %w", ErrInvalidConfig, path, err)
+		}
+
+		for _, value := range keyValues {
+			if ignored(flags, value.key, path) {
+				continue
+			}
+
+			if err := validate(flags.Lookup(value.key), value.value); err != nil {
+				return nil, fmt.Errorf("%w %s: line %d: key %q: %w", ErrInvalidConfig, path, value.line, value.key, err)
+			}
+
+			values[value.key] = value.value
+		}
+	}
+
+	var err error
+
+	flags.VisitAll(func(f *flag.Flag) {
+		name := EnvName(f.Name)
+
+		value, ok := lookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+
+		if validateErr := validate(f, value); validateErr != nil {
+			err = fmt.Errorf("%w %s: %w", ErrInvalidEnv, name, validateErr)
+
+			return
+		}
+
+		values[f.Name] = value
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for name, value := range commandLine {
+		values[name] = value
+	}
+
+	changed := make(map[string]string)
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if value := normalize(f, values[f.Name]); value != f.Value.String() {
+			changed[f.Name] = value
+		}
+	})
+
+	return changed, nil
+}
+
+// newValue returns a flag value of the same type as the flag's, or nil if it
+// can not be created; the values of the flag package can all be.
+func newValue(f *flag.Flag) flag.Value {
+	valueType := reflect.TypeOf(f.Value)
+	if valueType.Kind() != reflect.Pointer {
+		return nil
+	}
+
+	value, _ := reflect.New(valueType.Elem()).Interface().(flag.Value)
+
+	return value
+}
+
+// validate returns an error if the value can not be set to the flag.
+func validate(f *flag.Flag, value string) error {
+	if newValue := newValue(f); newValue != nil {
+		return newValue.Set(value)
+	}
+
+	return nil
+}
+
+// normalize returns the value as the flag would format it once it is set,
+// so that e.g. "1" and "true" are the same value of a boolean flag.
+func normalize(f *flag.Flag, value string) string {
+	newValue := newValue(f)
+	if newValue == nil || newValue.Set(value) != nil {
+		return value
+	}
+
+	return newValue.String()
+}
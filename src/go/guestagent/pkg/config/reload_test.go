@@ -0,0 +1,68 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+
+	flags := newTestFlags(t, "-maxPorts=64")
+	commandLine := config.CommandLine(flags.flags)
+	env := lookupEnv(map[string]string{"RD_GUESTAGENT_DEBUG": "1"})
+	path := writeConfig(t, "batchWindow: 250ms\niptables: false\n")
+
+	require.NoError(t, config.LoadEnv(flags.flags, env))
+	require.NoError(t, config.Load(flags.flags, path))
+
+	// Nothing changed, the values that are formatted differently are the same.
+	changed, err := config.Reload(flags.flags, commandLine, path, env)
+	require.NoError(t, err)
+	assert.Empty(t, changed)
+
+	// The keys that were removed from the file are back to their defaults,
+	// and the command line and the environment still take precedence.
+	require.NoError(t, os.WriteFile(path, []byte("batchWindow: 0.5s\nmaxPorts: 8\ndebug: false\n"), 0o600))
+
+	changed, err = config.Reload(flags.flags, commandLine, path, env)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"batchWindow": "500ms", "iptables": "true"}, changed)
+
+	// The flags are left to the caller to set.
+	assert.False(t, *flags.iptables)
+}
+
+func TestReloadInvalid(t *testing.T) {
+	t.Parallel()
+
+	flags := newTestFlags(t)
+	path := writeConfig(t, "maxPorts: many\n")
+
+	_, err := config.Reload(flags.flags, nil, path, lookupEnv(nil))
+	require.ErrorIs(t, err, config.ErrInvalidConfig)
+	assert.ErrorContains(t, err, `key "maxPorts"`)
+
+	_, err = config.Reload(flags.flags, nil, "", lookupEnv(map[string]string{"RD_GUESTAGENT_DEBUG": "yes"}))
+	require.ErrorIs(t, err, config.ErrInvalidEnv)
+
+	_, err = config.Reload(flags.flags, nil, path+".missing", lookupEnv(nil))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
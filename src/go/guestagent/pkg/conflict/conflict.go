@@ -0,0 +1,270 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package conflict detects the other agents, and the legacy port forwarding
+// processes, that run along with this one: the PID file only keeps another
+// instance that writes the same file from starting, while an older agent,
+// or one that was started with another -pidFile, would register the port
+// mappings twice and fight over the listeners.
+package conflict
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// DefaultMarker is the abstract unix socket that the agent holds while it
+	// runs, so that the next one detects it whatever its other settings.
+	DefaultMarker = "@rancher-desktop-guestagent"
+	// DefaultProcDir is where the processes are scanned for their names.
+	DefaultProcDir = "/proc"
+	dialTimeout    = time.Second
+)
+
+// The ways that the other processes are detected.
+const (
+	// ByMarker is set when the process holds the marker socket, see Mark.
+	ByMarker = "marker"
+	// ByAdminSocket is set when the process serves the admin socket.
+	ByAdminSocket = "adminSocket"
+	// ByName is set when the name of the executable of the process is one of
+	// the names of the agents or the legacy port forwarding processes.
+	ByName = "name"
+)
+
+// The actions of -onConflict.
+const (
+	// ActionWarn logs a warning that names the other processes, and starts.
+	ActionWarn = "warn"
+	// ActionRefuse refuses to start, see ErrConflict.
+	ActionRefuse = "refuse"
+)
+
+// Actions are the actions of -onConflict.
+var Actions = []string{ActionWarn, ActionRefuse} //nolint:gochecknoglobals
+
+// DefaultNames are the names of the executables of the agents, including
+// the older ones, which held no marker.
+var DefaultNames = []string{"rancher-desktop-guestagent"} //nolint:gochecknoglobals
+
+// ErrConflict is returned when another agent, or a legacy port forwarding
+// process, is running.
+var ErrConflict = errors.New("another agent or port forwarding process is running")
+
+// Process is another process that was detected.
+type Process struct {
+	// PID is the PID of the process, it is 0 when the peer of a socket could not be told.
+	PID int `json:"pid,omitempty"`
+	// Name is the name of the executable of the process.
+	Name string `json:"name,omitempty"`
+	// DetectedBy are the ways that it was detected, e.g. ByMarker.
+	DetectedBy []string `json:"detectedBy"`
+}
+
+func (p Process) String() string {
+	name := "an unknown process"
+	if p.PID != 0 {
+		name = "PID " + strconv.Itoa(p.PID)
+		if p.Name != "" {
+			name += " (" + p.Name + ")"
+		}
+	}
+
+	return name + ", detected by " + strings.Join(p.DetectedBy, ", ")
+}
+
+// Detector detects the other processes, the ones that are not set are not checked.
+type Detector struct {
+	// Marker is the marker socket that the other agents hold, see Mark.
+	Marker string
+	// AdminSocket is the path of the admin socket, which another agent
+	// would serve, and which this one would take over.
+	AdminSocket string
+	// ProcDir is where the processes are scanned for Names.
+	ProcDir string
+	// Names are the names of the executables of the other processes.
+	Names []string
+}
+
+// Detect returns the other processes, by their PID, each once whatever the
+// number of ways that it was detected.
+func (d Detector) Detect() []Process {
+	detected := make(map[int]*Process)
+
+	var unknown []Process
+
+	add := func(pid int, by string) {
+		if pid == 0 {
+			unknown = append(unknown, Process{DetectedBy: []string{by}})
+
+			return
+		}
+
+		process, ok := detected[pid]
+		if !ok {
+			process = &Process{PID: pid, Name: d.name(pid)}
+			detected[pid] = process
+		}
+
+		process.DetectedBy = append(process.DetectedBy, by)
+	}
+
+	for by, path := range map[string]string{ByMarker: d.Marker, ByAdminSocket: d.AdminSocket} {
+		if path == "" {
+			continue
+		}
+
+		if pid, ok := peer(path); ok {
+			add(pid, by)
+		}
+	}
+
+	for _, pid := range d.scan() {
+		add(pid, ByName)
+	}
+
+	processes := make([]Process, 0, len(detected)+len(unknown))
+	for _, process := range detected {
+		sort.Strings(process.DetectedBy)
+		processes = append(processes, *process)
+	}
+
+	sort.Slice(processes, func(i, j int) bool { return processes[i].PID < processes[j].PID })
+
+	return append(processes, unknown...)
+}
+
+// peer returns the PID of the process that listens on the unix socket at
+// path, and false when none does; the PID is 0 when it could not be told.
+func peer(path string) (int, bool) {
+	conn, err := net.DialTimeout("unix", path, dialTimeout)
+	if err != nil {
+		return 0, false
+	}
+	defer conn.Close()
+
+	rawConn, err := conn.(*net.UnixConn).SyscallConn()
+	if err != nil {
+		return 0, true
+	}
+
+	var (
+		cred    *unix.Ucred
+		credErr error
+	)
+
+	err = rawConn.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return 0, true
+	}
+
+	return int(cred.Pid), true
+}
+
+// scan returns the PIDs of the processes but this one whose executable has
+// one of the names.
+func (d Detector) scan() []int {
+	if d.ProcDir == "" || len(d.Names) == 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(d.ProcDir)
+	if err != nil {
+		log.Debugf("failed to scan the processes in %s: %v", d.ProcDir, err)
+
+		return nil
+	}
+
+	var pids []int
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+
+		for _, name := range d.Names {
+			if d.name(pid) == name {
+				pids = append(pids, pid)
+
+				break
+			}
+		}
+	}
+
+	return pids
+}
+
+// name returns the base name of the executable of the process, from the
+// first argument of its command line, which is empty for the kernel threads.
+func (d Detector) name(pid int) string {
+	procDir := d.ProcDir
+	if procDir == "" {
+		procDir = DefaultProcDir
+	}
+
+	cmdline, err := os.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return ""
+	}
+
+	argv0, _, _ := strings.Cut(string(cmdline), "\x00")
+	if argv0 == "" {
+		return ""
+	}
+
+	return filepath.Base(argv0)
+}
+
+// Mark holds the marker socket until it is closed, so that the other agents
+// that start in the meantime detect this one; it fails with ErrConflict when
+// another process holds it already.
+func Mark(marker string) (io.Closer, error) {
+	listener, err := net.Listen("unix", marker)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return nil, fmt.Errorf("%w, it holds the marker %s", ErrConflict, marker)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to hold the marker %s: %w", marker, err)
+	}
+
+	// The connections are only made to tell the PID of this process.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Close()
+		}
+	}()
+
+	return listener, nil
+}
@@ -0,0 +1,211 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package conflict_test
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/conflict"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// markerChildEnv names the marker that TestMarkerChild holds.
+const markerChildEnv = "CONFLICT_TEST_MARKER"
+
+// TestMarkerChild stands for the competing agent when it is run by
+// competingAgent, it holds the marker until its stdin is closed.
+func TestMarkerChild(_ *testing.T) {
+	marker := os.Getenv(markerChildEnv)
+	if marker == "" {
+		return
+	}
+
+	closer, err := conflict.Mark(marker)
+	if err != nil {
+		os.Exit(1)
+	}
+	defer closer.Close()
+
+	os.Stdout.WriteString("marked\n")
+	_, _ = io.Copy(io.Discard, os.Stdin)
+}
+
+// competingAgent starts a process that holds the marker, and returns its PID.
+func competingAgent(t *testing.T, marker string) int {
+	t.Helper()
+
+	//nolint:gosec // the test binary runs itself.
+	cmd := exec.Command(os.Args[0], "-test.run=^TestMarkerChild$")
+	cmd.Env = append(os.Environ(), markerChildEnv+"="+marker)
+
+	stdin, err := cmd.StdinPipe()
+	require.NoError(t, err)
+
+	stdout, err := cmd.StdoutPipe()
+	require.NoError(t, err)
+	require.NoError(t, cmd.Start())
+
+	t.Cleanup(func() {
+		stdin.Close()
+		_ = cmd.Wait()
+	})
+
+	// The marker is held once the child says so.
+	marked := make([]byte, len("marked\n"))
+	_, err = io.ReadFull(stdout, marked)
+	require.NoError(t, err)
+
+	return cmd.Process.Pid
+}
+
+// uniqueMarker returns a marker that the other tests do not hold.
+func uniqueMarker(t *testing.T) string {
+	t.Helper()
+
+	return "@rancher-desktop-guestagent-test-" + strconv.Itoa(os.Getpid()) + "-" + t.Name()
+}
+
+func TestDetectMarker(t *testing.T) {
+	t.Parallel()
+
+	marker := uniqueMarker(t)
+	pid := competingAgent(t, marker)
+
+	processes := conflict.Detector{Marker: marker}.Detect()
+	require.Len(t, processes, 1)
+	assert.Equal(t, pid, processes[0].PID)
+	assert.Equal(t, filepath.Base(os.Args[0]), processes[0].Name)
+	assert.Equal(t, []string{conflict.ByMarker}, processes[0].DetectedBy)
+	assert.Equal(t, "PID "+strconv.Itoa(pid)+" ("+filepath.Base(os.Args[0])+"), detected by marker", processes[0].String())
+
+	// This agent does not hold the marker while the other one does.
+	_, err := conflict.Mark(marker)
+	require.ErrorIs(t, err, conflict.ErrConflict)
+}
+
+func TestDetectNone(t *testing.T) {
+	t.Parallel()
+
+	procDir := t.TempDir()
+	writeProcess(t, procDir, 42, "/usr/sbin/sshd\x00-D\x00")
+
+	processes := conflict.Detector{
+		Marker:      uniqueMarker(t),
+		AdminSocket: filepath.Join(t.TempDir(), "guestagent.sock"),
+		ProcDir:     procDir,
+		Names:       conflict.DefaultNames,
+	}.Detect()
+	assert.Empty(t, processes)
+}
+
+func TestDetectAdminSocket(t *testing.T) {
+	t.Parallel()
+
+	// The other agent serves the admin socket, this process stands for it.
+	path := filepath.Join(t.TempDir(), "guestagent.sock")
+	listener, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	processes := conflict.Detector{AdminSocket: path}.Detect()
+	require.Len(t, processes, 1)
+	assert.Equal(t, os.Getpid(), processes[0].PID)
+	assert.Equal(t, []string{conflict.ByAdminSocket}, processes[0].DetectedBy)
+}
+
+// writeProcess writes the command line of a process to the fake procDir.
+func writeProcess(t *testing.T, procDir string, pid int, cmdline string) {
+	t.Helper()
+
+	dir := filepath.Join(procDir, strconv.Itoa(pid))
+	require.NoError(t, os.Mkdir(dir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "cmdline"), []byte(cmdline), 0o600))
+}
+
+func TestDetectName(t *testing.T) {
+	t.Parallel()
+
+	procDir := t.TempDir()
+	writeProcess(t, procDir, 42, "/usr/sbin/sshd\x00-D\x00")
+	writeProcess(t, procDir, 1234, "/usr/local/bin/rancher-desktop-guestagent\x00-privilegedService\x00")
+	writeProcess(t, procDir, 99, "/opt/legacy/port-forwarder\x00")
+	// The kernel threads have no command line, and this process is skipped.
+	writeProcess(t, procDir, 2, "")
+	writeProcess(t, procDir, os.Getpid(), "/usr/local/bin/rancher-desktop-guestagent\x00")
+
+	processes := conflict.Detector{
+		ProcDir: procDir,
+		Names:   append([]string{"port-forwarder"}, conflict.DefaultNames...),
+	}.Detect()
+	assert.Equal(t, []conflict.Process{
+		{PID: 99, Name: "port-forwarder", DetectedBy: []string{conflict.ByName}},
+		{PID: 1234, Name: "rancher-desktop-guestagent", DetectedBy: []string{conflict.ByName}},
+	}, processes)
+}
+
+func TestDetectMerged(t *testing.T) {
+	t.Parallel()
+
+	marker := uniqueMarker(t)
+	pid := competingAgent(t, marker)
+
+	// The same process is found by its marker and its name.
+	processes := conflict.Detector{
+		Marker:  marker,
+		ProcDir: conflict.DefaultProcDir,
+		Names:   []string{filepath.Base(os.Args[0])},
+	}.Detect()
+
+	var found *conflict.Process
+
+	for i := range processes {
+		if processes[i].PID == pid {
+			found = &processes[i]
+		}
+	}
+
+	require.NotNil(t, found, "the competing agent was not detected")
+	assert.Equal(t, []string{conflict.ByMarker, conflict.ByName}, found.DetectedBy)
+}
+
+func TestMark(t *testing.T) {
+	t.Parallel()
+
+	marker := uniqueMarker(t)
+
+	closer, err := conflict.Mark(marker)
+	require.NoError(t, err)
+
+	processes := conflict.Detector{Marker: marker}.Detect()
+	require.Len(t, processes, 1)
+	assert.Equal(t, os.Getpid(), processes[0].PID)
+
+	// The next agent holds it once this one released it.
+	require.NoError(t, closer.Close())
+	assert.Eventually(t, func() bool {
+		return len(conflict.Detector{Marker: marker}.Detect()) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	closer, err = conflict.Mark(marker)
+	require.NoError(t, err)
+	require.NoError(t, closer.Close())
+}
@@ -29,14 +29,19 @@ import (
 	"github.com/Masterminds/log-go"
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/api/events"
+	containerdEvents "github.com/containerd/containerd/events"
 	containerdNamespace "github.com/containerd/containerd/namespaces"
 	"github.com/docker/go-connections/nat"
 	"github.com/gogo/protobuf/proto"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
 )
 
 const (
 	portsKey       = "nerdctl/ports"
+	nameKey        = "nerdctl/name"
 	maxHashLen     = sha512.Size * 2
 	maxChainLength = 28
 	chainPrefix    = "CNI-"
@@ -51,8 +56,10 @@ var (
 // for container events.
 type EventMonitor struct {
 	containerdClient        *containerd.Client
-	portTracker             tracker.Tracker
+	portTracker             *tracker.Coordinator
 	enablePrivilegedService bool
+	// dryRun logs the iptables rules instead of adding them, see EnableDryRun.
+	dryRun bool
 }
 
 // NewEventMonitor creates and returns a new Event Monitor for
@@ -60,7 +67,7 @@ type EventMonitor struct {
 // Docker engine is up and running.
 func NewEventMonitor(
 	containerdSock string,
-	portTracker tracker.Tracker,
+	portTracker *tracker.Coordinator,
 	enablePrivilegedService bool,
 ) (*EventMonitor, error) {
 	client, err := containerd.New(containerdSock, containerd.WithDefaultNamespace(containerdNamespace.Default))
@@ -75,6 +82,12 @@ func NewEventMonitor(
 	}, nil
 }
 
+// EnableDryRun makes the event monitor log the iptables rules
+// that it would add instead of adding them.
+func (e *EventMonitor) EnableDryRun() {
+	e.dryRun = true
+}
+
 // MonitorPorts subscribes to event API
 // for container Create/Update/Delete events.
 func (e *EventMonitor) MonitorPorts(ctx context.Context) {
@@ -85,111 +98,178 @@ func (e *EventMonitor) MonitorPorts(ctx context.Context) {
 	}
 	msgCh, errCh := e.containerdClient.Subscribe(ctx, subscribeFilters...)
 
+	// Every event that is received is reported, so that the status tells when the last one was.
+	health := supervisor.HealthReporter(ctx)
+
 	for {
 		select {
 		case <-ctx.Done():
-			log.Errorf("context cancellation: %v", ctx.Err())
+			// The monitor is stopped, e.g. at shutdown, which is not an error.
+			logger.Debugf("context cancellation: %v", ctx.Err())
 
 			return
 		case envelope := <-msgCh:
-			log.Debugf("received an event: %+v", envelope.Topic)
+			// The rules of the ports of the container are about to change, see tracker.Nudger.
+			tracker.Nudge(ctx)
+			health.Succeeded()
+			e.handleEnvelope(ctx, health, envelope)
 
-			switch envelope.Topic {
-			case "/tasks/start":
-				startTask := &events.TaskStart{}
-
-				err := proto.Unmarshal(envelope.Event.GetValue(), startTask)
-				if err != nil {
-					log.Errorf("failed to unmarshal container's start task: %v", err)
-				}
-
-				ports, err := e.createPortMapping(ctx, envelope.Namespace, startTask.ContainerID)
-				if err != nil {
-					log.Errorf("failed to create port mapping from container's start task: %v", err)
-				}
+		case err := <-errCh:
+			// The subscription fails once the context is cancelled too.
+			if ctx.Err() != nil {
+				logger.Debugf("receiving container event stopped: %v", err)
+			} else {
+				logger.Errorf("receiving container event failed: %v", err)
+			}
 
-				if len(ports) == 0 {
-					continue
-				}
+			return
+		}
+	}
+}
 
-				err = execIptablesRules(ports, startTask.ContainerID, envelope.Namespace, strconv.Itoa(int(startTask.Pid)))
-				if err != nil {
-					log.Errorf("failed running iptable rules to update DNAT rule in CNI-HOSTPORT-DNAT chain: %v", err)
-				}
+// handleEnvelope changes the port mappings of the container of the event.
+func (e *EventMonitor) handleEnvelope(ctx context.Context, health supervisor.Reporter, envelope *containerdEvents.Envelope) {
+	// The correlation ID links the log lines and the payloads of the
+	// change to the port mapping that the event causes.
+	correlationID := tracker.NewCorrelationID()
+	eventTime := tracker.EventTime(envelope.Timestamp)
+
+	logger.Debugw("received an event", logging.Fields(
+		logging.Source(tracker.SourceContainerd),
+		logging.CorrelationID(correlationID),
+		log.Fields{"topic": envelope.Topic},
+	))
+
+	// The changes of the event are traced as the children of its span.
+	ctx, span := tracing.Start(ctx, "containerd.event",
+		tracing.String(tracing.AttrCorrelationID, correlationID),
+		tracing.String("topic", envelope.Topic))
+	defer span.End()
+
+	switch envelope.Topic {
+	case "/tasks/start":
+		startTask := &events.TaskStart{}
+
+		err := proto.Unmarshal(envelope.Event.GetValue(), startTask)
+		if err != nil {
+			logger.Errorf("failed to unmarshal container's start task: %v", err)
+		}
 
-				err = e.portTracker.Add(startTask.ContainerID, ports)
-				if err != nil {
-					log.Errorf("adding port mapping to tracker failed: %v", err)
+		span.SetAttributes(tracing.String(tracing.AttrID, startTask.ContainerID))
 
-					continue
-				}
-
-				e.updateListener(ctx, ports, e.portTracker.AddListener)
+		ports, origin, err := e.createPortMapping(ctx, envelope.Namespace, startTask.ContainerID)
+		if err != nil {
+			logger.Errorf("failed to create port mapping from container's start task: %v", err)
+		}
 
-			case "/containers/update":
-				cuEvent := &events.ContainerUpdate{}
-				err := proto.Unmarshal(envelope.Event.GetValue(), cuEvent)
-				if err != nil {
-					log.Errorf("failed to unmarshal container update event: %v", err)
-				}
+		if len(ports) == 0 {
+			return
+		}
 
-				ports, err := e.createPortMapping(ctx, envelope.Namespace, cuEvent.ID)
-				if err != nil {
-					log.Errorf("failed to create port mapping from container update event: %v", err)
-				}
+		err = e.execIptablesRules(ctx, ports, startTask.ContainerID, envelope.Namespace, strconv.Itoa(int(startTask.Pid)))
+		if err != nil {
+			logger.Errorf("failed running iptable rules to update DNAT rule in CNI-HOSTPORT-DNAT chain: %v", err)
+		}
 
-				if len(ports) == 0 {
-					continue
-				}
+		// The listeners are opened before the host starts forwarding to them.
+		err = e.portTracker.Publish(tracker.ContextWithOrigin(ctx, origin), startTask.ContainerID, ports, e.listenerAddrs(ports),
+			tracker.WithSource(tracker.SourceContainerd), tracker.WithOrigin(origin), tracker.WithCorrelationID(correlationID),
+			tracker.WithEventTime(eventTime))
+		if err != nil {
+			logger.Errorw("adding port mapping to tracker failed", logging.Fields(
+				logging.Container(startTask.ContainerID),
+				logging.Source(tracker.SourceContainerd),
+				logging.CorrelationID(correlationID),
+				logging.Error(err),
+			))
+			span.RecordError(err)
+			health.Failed(err)
+		}
 
-				existingPortMap := e.portTracker.Get(cuEvent.ID)
-				if existingPortMap != nil {
-					if !reflect.DeepEqual(ports, existingPortMap) {
-						err := e.portTracker.Remove(cuEvent.ID)
-						if err != nil {
-							log.Errorf("failed to remove port mapping from container update event: %v", err)
-						}
+	case "/containers/update":
+		cuEvent := &events.ContainerUpdate{}
+		err := proto.Unmarshal(envelope.Event.GetValue(), cuEvent)
+		if err != nil {
+			logger.Errorf("failed to unmarshal container update event: %v", err)
+		}
 
-						e.updateListener(ctx, ports, e.portTracker.RemoveListener)
-						err = e.portTracker.Add(cuEvent.ID, ports)
-						if err != nil {
-							log.Errorf("failed to add port mapping from container update event: %v", err)
+		span.SetAttributes(tracing.String(tracing.AttrID, cuEvent.ID))
 
-							continue
-						}
+		ports, origin, err := e.createPortMapping(ctx, envelope.Namespace, cuEvent.ID)
+		if err != nil {
+			logger.Errorf("failed to create port mapping from container update event: %v", err)
+		}
 
-						e.updateListener(ctx, ports, e.portTracker.AddListener)
-					}
+		if len(ports) == 0 {
+			return
+		}
 
-					continue
-				}
-				// Not 100% sure if we ever get here...
-				if err = e.portTracker.Add(cuEvent.ID, ports); err != nil {
-					log.Errorf("failed to add port mapping from container update event: %v", err)
+		existingPortMap := e.portTracker.Get(cuEvent.ID)
+		if existingPortMap != nil {
+			if !reflect.DeepEqual(ports, existingPortMap) {
+				err := e.portTracker.Withdraw(ctx, cuEvent.ID, tracker.WithCorrelationID(correlationID))
+				if err != nil {
+					logger.Errorw("failed to remove port mapping from container update event", logging.Fields(
+						logging.Container(cuEvent.ID),
+						logging.Source(tracker.SourceContainerd),
+						logging.CorrelationID(correlationID),
+						logging.Error(err),
+					))
+					health.Failed(err)
 				}
 
-			case "/tasks/exit":
-				exitTask := &events.TaskExit{}
-				err := proto.Unmarshal(envelope.Event.GetValue(), exitTask)
+				err = e.portTracker.Publish(tracker.ContextWithOrigin(ctx, origin), cuEvent.ID, ports, e.listenerAddrs(ports),
+					tracker.WithSource(tracker.SourceContainerd), tracker.WithOrigin(origin), tracker.WithCorrelationID(correlationID),
+					tracker.WithEventTime(eventTime))
 				if err != nil {
-					log.Errorf("failed to unmarshal container's exit task: %v", err)
+					logger.Errorw("failed to add port mapping from container update event", logging.Fields(
+						logging.Container(cuEvent.ID),
+						logging.Source(tracker.SourceContainerd),
+						logging.CorrelationID(correlationID),
+						logging.Error(err),
+					))
+					health.Failed(err)
+
+					return
 				}
+			}
 
-				portMapToDelete := e.portTracker.Get(exitTask.ContainerID)
-				if portMapToDelete != nil {
-					err = e.portTracker.Remove(exitTask.ContainerID)
-					if err != nil {
-						log.Errorf("removing port mapping from tracker failed: %v", err)
-					}
-				}
+			return
+		}
+		// Not 100% sure if we ever get here...
+		err = e.portTracker.Add(ctx, cuEvent.ID, ports,
+			tracker.WithSource(tracker.SourceContainerd), tracker.WithOrigin(origin), tracker.WithCorrelationID(correlationID),
+			tracker.WithEventTime(eventTime))
+		if err != nil {
+			logger.Errorw("failed to add port mapping from container update event", logging.Fields(
+				logging.Container(cuEvent.ID),
+				logging.Source(tracker.SourceContainerd),
+				logging.CorrelationID(correlationID),
+				logging.Error(err),
+			))
+			health.Failed(err)
+		}
 
-				e.updateListener(ctx, portMapToDelete, e.portTracker.RemoveListener)
-			}
+	case "/tasks/exit":
+		exitTask := &events.TaskExit{}
+		err := proto.Unmarshal(envelope.Event.GetValue(), exitTask)
+		if err != nil {
+			logger.Errorf("failed to unmarshal container's exit task: %v", err)
+		}
 
-		case err := <-errCh:
-			log.Errorf("receiving container event failed: %v", err)
+		span.SetAttributes(tracing.String(tracing.AttrID, exitTask.ContainerID))
 
-			return
+		// The listeners are only closed once the host stopped forwarding to them.
+		err = e.portTracker.Withdraw(ctx, exitTask.ContainerID, tracker.WithCorrelationID(correlationID))
+		if err != nil {
+			logger.Errorw("removing port mapping from tracker failed", logging.Fields(
+				logging.Container(exitTask.ContainerID),
+				logging.Source(tracker.SourceContainerd),
+				logging.CorrelationID(correlationID),
+				logging.Error(err),
+			))
+			span.RecordError(err)
+			health.Failed(err)
 		}
 	}
 }
@@ -209,67 +289,80 @@ func (e *EventMonitor) IsServing(ctx context.Context) error {
 	return fmt.Errorf("containerd API is not serving: %w", err)
 }
 
-// Close closes the client connection to the API server.
-func (e *EventMonitor) Close() error {
-	var finalErr error
+// CheckServing checks that the containerd API is served on the socket, for the self-test.
+func CheckServing(ctx context.Context, containerdSock string) error {
+	client, err := containerd.New(containerdSock, containerd.WithDefaultNamespace(containerdNamespace.Default))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if _, err := client.IsServing(ctx); err != nil {
+		return fmt.Errorf("containerd API is not serving: %w", err)
+	}
 
+	return nil
+}
+
+// Close closes the client connection to the API server, the port mappings
+// are left in the port tracker, see Flush.
+func (e *EventMonitor) Close() error {
 	if err := e.containerdClient.Close(); err != nil {
-		finalErr = fmt.Errorf("failed to close containerd client: %w", err)
+		return fmt.Errorf("failed to close containerd client: %w", err)
 	}
 
-	if err := e.portTracker.RemoveAll(); err != nil {
-		finalErr = fmt.Errorf("failed to remove all ports from port tracker: %w", err)
+	return nil
+}
 
-		return finalErr
+// Flush clears all the port mappings out of the port tracker, e.g. before
+// the monitor is restarted; at shutdown, they are withdrawn along with the
+// ones of the other sources instead.
+func (e *EventMonitor) Flush(ctx context.Context) error {
+	if err := e.portTracker.RemoveAll(ctx); err != nil {
+		return fmt.Errorf("failed to remove all ports from port tracker: %w", err)
 	}
 
-	return finalErr
+	return nil
 }
 
-func (e *EventMonitor) updateListener(
-	ctx context.Context,
-	portMappings nat.PortMap,
-	action func(context.Context, net.IP, int) error,
-) {
+// listenerAddrs returns the addresses of the listeners that back the port mappings.
+func (e *EventMonitor) listenerAddrs(portMappings nat.PortMap) []tracker.ListenerAddr {
 	// Only create listeners for the default network when the PrivilegedService is enabled.
 	// Otherwise, creating listeners can conflict with the proxy listeners that are created
 	// by the namespaced network’s port exposing API.
 	if !e.enablePrivilegedService {
-		return
+		return nil
 	}
 
+	var listeners []tracker.ListenerAddr
+
 	for _, portBindings := range portMappings {
 		for _, portBinding := range portBindings {
 			port, err := strconv.Atoi(portBinding.HostPort)
 			if err != nil {
-				log.Errorf("port conversion for [%+v] error: %v", portBinding, err)
+				logger.Errorf("port conversion for [%+v] error: %v", portBinding, err)
 
 				continue
 			}
 
 			// We always need to use INADDR_ANY here since any other addresses used here
 			// can cause a wrong entry in iptables and will not be routable.
-			if err := action(ctx, net.IPv4zero, port); err != nil {
-				log.Errorf("updating listener for IP: [%s] and Port: [%s] failed: %v",
-					net.IPv4zero,
-					portBinding.HostPort,
-					err)
-
-				continue
-			}
+			listeners = append(listeners, tracker.ListenerAddr{IP: net.IPv4zero, Port: port})
 		}
 	}
+
+	return listeners
 }
 
 // execIptablesRules creates an additional DNAT rule to allow service exposure on
 // other network addresses if port binding is bound to 127.0.0.1.
-func execIptablesRules(portMappings nat.PortMap, containerID, namespace, pid string) error {
+func (e *EventMonitor) execIptablesRules(ctx context.Context, portMappings nat.PortMap, containerID, namespace, pid string) error {
 	var errs []error
 
 	for portProto, portBindings := range portMappings {
 		for _, portBinding := range portBindings {
 			if portBinding.HostIP == "127.0.0.1" {
-				err := createLoopbackIPtablesRules(containerID, namespace, pid, portProto.Port(), portBinding.HostPort)
+				err := e.createLoopbackIPtablesRules(ctx, containerID, namespace, pid, portProto.Port(), portBinding.HostPort)
 				if err != nil {
 					errs = append(errs, err)
 				}
@@ -295,15 +388,15 @@ func execIptablesRules(portMappings nat.PortMap, containerID, namespace, pid str
 // DNAT       tcp  --  anywhere             localhost            tcp dpt:9119 to:10.4.0.22:80.
 // We enter the following rule after the existing rule:
 // DNAT       tcp  --  anywhere             anywhere             tcp dpt:9119 to:10.4.0.22:80.
-func createLoopbackIPtablesRules(containerID, namespace, pid, port, destinationPort string) error {
+func (e *EventMonitor) createLoopbackIPtablesRules(ctx context.Context, containerID, namespace, pid, port, destinationPort string) error {
 	// read the container's cni config to extract the network name
-	nsenterNetworkConfCmd := exec.Command("nsenter", "-t", pid, "-n", "cat", "/etc/cni/net.d/nerdctl-bridge.conflist")
+	nsenterNetworkConfCmd := exec.CommandContext(ctx, "nsenter", "-t", pid, "-n", "cat", "/etc/cni/net.d/nerdctl-bridge.conflist")
 	output, err := nsenterNetworkConfCmd.CombinedOutput()
 	if err != nil {
 		return err
 	}
 
-	log.Debugf("read the following network conflist for containerID: %s config: %s", containerID, string(output))
+	logger.Debugf("read the following network conflist for containerID: %s config: %s", containerID, string(output))
 
 	var networkConfig cniNetworkConfig
 	err = json.Unmarshal(output, &networkConfig)
@@ -311,12 +404,12 @@ func createLoopbackIPtablesRules(containerID, namespace, pid, port, destinationP
 		return err
 	}
 
-	eth0IP, err := extractIPAddress(pid)
+	eth0IP, err := extractIPAddress(ctx, pid)
 	if err != nil {
 		return err
 	}
 
-	log.Debugf("found the ip address: %s for containerID: %s", eth0IP, containerID)
+	logger.Debugf("found the ip address: %s for containerID: %s", eth0IP, containerID)
 
 	// create the corresponding chain name, e.g CNI-DN-xxxxxx
 	// (where xxxxxx is a function of the ContainerID and network name)
@@ -325,12 +418,12 @@ func createLoopbackIPtablesRules(containerID, namespace, pid, port, destinationP
 	cID := fmt.Sprintf("%s-%s", namespace, containerID)
 	chainName := mustFormatHashWithPrefix(maxChainLength, chainPrefix+"DN-", networkConfig.Name+cID)
 
-	log.Debugf("determined iptables chain name: %s for containerID: %s", chainName, containerID)
+	logger.Debugf("determined iptables chain name: %s for containerID: %s", chainName, containerID)
 
 	// Instead of updating the existing rule we insert the overriding rule below the previous one
 	// e.g rule can be:
 	// iptables -t nat -A CNI-DN-xxxxxx -p tcp -d 0.0.0.0/0 -j DNAT --dport 9119 --to-destination 10.4.0.10:80
-	iptableCmd := exec.Command("iptables",
+	iptableCmd := exec.CommandContext(ctx, "iptables",
 		"--table", "nat",
 		"--append", chainName,
 		"--protocol", "tcp",
@@ -339,19 +432,46 @@ func createLoopbackIPtablesRules(containerID, namespace, pid, port, destinationP
 		"--dport", destinationPort,
 		"--to-destination", fmt.Sprintf("%s:%s", eth0IP, port))
 
+	if e.dryRun {
+		logger.Infow("dry run, not adding the iptables rule", logging.Fields(
+			logging.Port(destinationPort),
+			logging.Protocol("tcp"),
+			logging.Container(containerID),
+			logging.Source(tracker.SourceContainerd),
+			log.Fields{"rule": iptableCmd.String()},
+		))
+
+		return nil
+	}
+
 	return iptableCmd.Run()
 }
 
-func (e *EventMonitor) createPortMapping(ctx context.Context, namespace, containerID string) (nat.PortMap, error) {
+// createPortMapping returns the port mapping of the container from its
+// labels, and the container as the origin of the port mapping.
+func (e *EventMonitor) createPortMapping(
+	ctx context.Context,
+	namespace string,
+	containerID string,
+) (nat.PortMap, tracker.Origin, error) {
 	container, err := e.containerdClient.ContainerService().Get(
 		containerdNamespace.WithNamespace(ctx, namespace), containerID)
 	if err != nil {
-		return nil, err
+		return nil, tracker.Origin{}, err
+	}
+
+	logger.Debugw("got a container", logging.Fields(logging.Container(container.ID), log.Fields{"namespace": namespace}))
+
+	origin := tracker.Origin{
+		Kind:      tracker.OriginContainer,
+		ID:        container.ID,
+		Namespace: namespace,
+		Name:      container.Labels[nameKey],
 	}
 
-	log.Debugf("got a container [%s] from namespace [%s]", container.ID, namespace)
+	portMap, err := createPortMappingFromString(container.Labels[portsKey])
 
-	return createPortMappingFromString(container.Labels[portsKey])
+	return portMap, origin, err
 }
 
 func createPortMappingFromString(portMapping string) (nat.PortMap, error) {
@@ -388,9 +508,9 @@ func createPortMappingFromString(portMapping string) (nat.PortMap, error) {
 	return portMap, nil
 }
 
-func extractIPAddress(pid string) (string, error) {
+func extractIPAddress(ctx context.Context, pid string) (string, error) {
 	// retrieve the eth0 IP address from the container
-	nsenterInfIPCmd := exec.Command("nsenter", "-t", pid, "-n", "ip", "-o", "-4", "addr", "show", "dev", "eth0")
+	nsenterInfIPCmd := exec.CommandContext(ctx, "nsenter", "-t", pid, "-n", "ip", "-o", "-4", "addr", "show", "dev", "eth0")
 	output, err := nsenterInfIPCmd.CombinedOutput()
 	if err != nil {
 		return "", err
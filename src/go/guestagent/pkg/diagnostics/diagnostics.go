@@ -0,0 +1,251 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package diagnostics writes a point-in-time snapshot of the state of the
+// agent to a file, e.g. on SIGUSR1, to be attached to the bug reports.
+package diagnostics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+)
+
+// DefaultDir is the directory that the bundles are written to when the
+// dumper is given none.
+const DefaultDir = "/var/log"
+
+const (
+	filePrefix = "rancher-desktop-guestagent-diagnostics-"
+	// fileTimeLayout is the timestamp of the bundle in its file name, in UTC.
+	fileTimeLayout = "20060102T150405.000Z"
+	// goroutineDebug writes the stacks of the goroutines like an unrecovered panic does.
+	goroutineDebug = 2
+)
+
+// State returns the parts of the state of the agent that a bundle holds, the
+// ones that are nil are left out. They must only hold their locks briefly,
+// to copy what they return, since the agent keeps running in the meantime.
+type State struct {
+	Config       func() map[string]string
+	Subsystems   func() []supervisor.Status
+	Ports        func() []tracker.Entry
+	Listeners    func() []string
+	Forwarder    func() forwarder.Metrics
+	RecentErrors func() []string
+	ErrorCount   func() uint64
+	// Latencies returns the longest of the recent latencies of the ports,
+	// the longest first, see tracker.LatencyRecorder.Worst.
+	Latencies func() []tracker.Latency
+	// Changes returns the counts of the changes of the port mappings, see tracker.ChangeCounter.
+	Changes func() []tracker.ChangeCount
+	// ListenerOrigins returns the origins of the listeners, keyed by their
+	// address, see tracker.ListenerTracker.ListenerOrigins.
+	ListenerOrigins func() map[string]tracker.Origin
+	// ForwardingProfile returns the forwarding profile of the ports bound to
+	// the loopback of the VM, see wsl.Detector.LocalhostForwarding.
+	ForwardingProfile func() string
+	// Compatibility returns how the agent works with the peer of the
+	// forwarder, see forwarder.VTunnelForwarder.Compatibility.
+	Compatibility func() *forwarder.Compatibility
+}
+
+// Bundle is the snapshot of the state of the agent, which is written as JSON.
+type Bundle struct {
+	Time    time.Time    `json:"time"`
+	Version version.Info `json:"version"`
+	// Config is the effective configuration, see config.Effective.
+	Config     map[string]string   `json:"config,omitempty"`
+	Subsystems []supervisor.Status `json:"subsystems,omitempty"`
+	Ports      []tracker.Entry     `json:"ports,omitempty"`
+	Listeners  []string            `json:"listeners,omitempty"`
+	Forwarder  *forwarder.Metrics  `json:"forwarder,omitempty"`
+	// RecentErrors are the last lines that were logged at the error level.
+	RecentErrors []string `json:"recentErrors,omitempty"`
+	// ErrorCount is the number of lines that were logged at the error level.
+	ErrorCount uint64 `json:"errorCount,omitempty"`
+	// Latencies are the longest of the recent latencies from the events of
+	// the ports to their forwarding by the host.
+	Latencies []tracker.Latency `json:"latencies,omitempty"`
+	// Changes are the counts of the changes of the port mappings by source, action and outcome.
+	Changes []tracker.ChangeCount `json:"changes,omitempty"`
+	// ListenerOrigins are the objects that the listeners were opened for,
+	// like the Origin of the ports; the listeners that are not listed have none.
+	ListenerOrigins map[string]tracker.Origin `json:"listenerOrigins,omitempty"`
+	// ForwardingProfile is the forwarding profile of the ports bound to the
+	// loopback of the VM, e.g. "relay" when WSL relays them.
+	ForwardingProfile string `json:"forwardingProfile,omitempty"`
+	// Compatibility is how the agent works with the peer of the forwarder,
+	// from the protocol versions that it speaks; it is not set until the
+	// protocol was negotiated.
+	Compatibility *forwarder.Compatibility `json:"compatibility,omitempty"`
+	// Goroutines are the stacks of all the goroutines.
+	Goroutines string `json:"goroutines"`
+}
+
+// Dumper writes the bundles to a directory, see Dump.
+type Dumper struct {
+	dir   string
+	state State
+	now   func() time.Time
+}
+
+// NewDumper creates a dumper that writes the bundles of the state to the
+// directory, or to DefaultDir when it is empty.
+func NewDumper(dir string, state State) *Dumper {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Dumper{dir: dir, state: state, now: time.Now}
+}
+
+// Collect returns the bundle of the current state.
+func (d *Dumper) Collect() Bundle {
+	bundle := d.state.collect(d.now().UTC())
+
+	var goroutines bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&goroutines, goroutineDebug); err != nil {
+		fmt.Fprintf(&goroutines, "failed to dump the goroutines: %v", err)
+	}
+
+	bundle.Goroutines = goroutines.String()
+
+	return bundle
+}
+
+// collect returns the bundle of the state at the given time, without the goroutines.
+func (s State) collect(now time.Time) Bundle {
+	bundle := Bundle{Time: now, Version: version.Get()}
+
+	if s.Config != nil {
+		bundle.Config = s.Config()
+	}
+
+	if s.Subsystems != nil {
+		bundle.Subsystems = s.Subsystems()
+	}
+
+	if s.Ports != nil {
+		bundle.Ports = s.Ports()
+	}
+
+	if s.Listeners != nil {
+		bundle.Listeners = s.Listeners()
+	}
+
+	if s.Forwarder != nil {
+		metrics := s.Forwarder()
+		bundle.Forwarder = &metrics
+	}
+
+	if s.RecentErrors != nil {
+		bundle.RecentErrors = s.RecentErrors()
+	}
+
+	if s.ErrorCount != nil {
+		bundle.ErrorCount = s.ErrorCount()
+	}
+
+	if s.Latencies != nil {
+		bundle.Latencies = s.Latencies()
+	}
+
+	if s.Changes != nil {
+		bundle.Changes = s.Changes()
+	}
+
+	if s.ListenerOrigins != nil {
+		bundle.ListenerOrigins = s.ListenerOrigins()
+	}
+
+	if s.ForwardingProfile != nil {
+		bundle.ForwardingProfile = s.ForwardingProfile()
+	}
+
+	if s.Compatibility != nil {
+		bundle.Compatibility = s.Compatibility()
+	}
+
+	return bundle
+}
+
+// Dump writes the bundle of the current state to a file of the directory,
+// named after the time of the bundle, and returns its path. The state is
+// collected before the file is written.
+func (d *Dumper) Dump() (string, error) {
+	bundle := d.Collect()
+
+	data, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the diagnostics: %w", err)
+	}
+
+	if err := os.MkdirAll(d.dir, 0o755); err != nil { //nolint:gosec // the directory is usually /var/log.
+		return "", fmt.Errorf("failed to create the diagnostics directory: %w", err)
+	}
+
+	path := filepath.Join(d.dir, filePrefix+bundle.Time.Format(fileTimeLayout)+".json")
+
+	// The bundle is only renamed to its path once it is complete.
+	file, err := os.CreateTemp(d.dir, filePrefix+"*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create the diagnostics file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to write the diagnostics file %s: %w", path, err)
+	}
+
+	return path, nil
+}
+
+// DumpOnSignal writes a bundle, and logs where it was written, on every
+// signal that it receives until the context is cancelled.
+func (d *Dumper) DumpOnSignal(ctx context.Context, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-signals:
+			path, err := d.Dump()
+			if err != nil {
+				log.Errorf("received [%s] signal, failed to write the diagnostics: %v", s, err)
+
+				continue
+			}
+
+			log.Infof("received [%s] signal, wrote the diagnostics to %s", s, path)
+		}
+	}
+}
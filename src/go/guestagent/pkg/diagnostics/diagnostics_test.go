@@ -0,0 +1,182 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diagnostics_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/diagnostics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func fakeState() diagnostics.State {
+	return diagnostics.State{
+		Config: func() map[string]string {
+			return map[string]string{"docker": "true", "vtunnelAddr": "127.0.0.1:3040"}
+		},
+		Subsystems: func() []supervisor.Status {
+			return []supervisor.Status{
+				{Name: "docker", State: supervisor.StateRunning},
+				{Name: "kubernetes", State: supervisor.StateBackingOff, Restarts: 2, LastError: "connection refused"},
+			}
+		},
+		Ports: func() []tracker.Entry {
+			return []tracker.Entry{{
+				ID:     "web",
+				Source: tracker.SourceDocker,
+				Origin: &tracker.Origin{Kind: tracker.OriginContainer, ID: "web", Name: "web-1"},
+				Ports:  nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}}},
+			}}
+		},
+		Listeners: func() []string {
+			return []string{"127.0.0.1:30080"}
+		},
+		ListenerOrigins: func() map[string]tracker.Origin {
+			return map[string]tracker.Origin{
+				"127.0.0.1:30080": {Kind: tracker.OriginService, ID: "0b5f", Namespace: "default", Name: "web"},
+			}
+		},
+		ForwardingProfile: func() string {
+			return "relay"
+		},
+		Compatibility: func() *forwarder.Compatibility {
+			return &forwarder.Compatibility{Mode: forwarder.CompatibilityLegacy, PeerProtocolVersion: 1, ProtocolVersion: 1}
+		},
+		Forwarder: func() forwarder.Metrics {
+			return forwarder.Metrics{Sends: 3, Failures: map[string]uint64{forwarder.FailureTimeout: 1}}
+		},
+		RecentErrors: func() []string {
+			return []string{"2024/05/14 10:11:12 [ERROR]   connection refused"}
+		},
+		ErrorCount: func() uint64 {
+			return 1
+		},
+	}
+}
+
+// readBundle decodes the bundle of the file, which only has the fields of a bundle.
+func readBundle(t *testing.T, path string) diagnostics.Bundle {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+
+	var bundle diagnostics.Bundle
+	require.NoError(t, decoder.Decode(&bundle))
+
+	return bundle
+}
+
+func TestDump(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "diagnostics")
+	state := fakeState()
+	before := time.Now().UTC()
+
+	path, err := diagnostics.NewDumper(dir, state).Dump()
+	require.NoError(t, err)
+	assert.Equal(t, dir, filepath.Dir(path))
+	assert.Regexp(t, `^rancher-desktop-guestagent-diagnostics-\d{8}T\d{6}\.\d{3}Z\.json$`, filepath.Base(path))
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	bundle := readBundle(t, path)
+	assert.WithinRange(t, bundle.Time, before.Truncate(time.Second), time.Now().UTC())
+	assert.Equal(t, version.Get(), bundle.Version)
+	assert.Equal(t, state.Config(), bundle.Config)
+	assert.Equal(t, state.Subsystems(), bundle.Subsystems)
+	require.Len(t, bundle.Ports, 1)
+	assert.Equal(t, state.Ports()[0].Ports, bundle.Ports[0].Ports)
+	assert.Equal(t, state.Ports()[0].Origin, bundle.Ports[0].Origin)
+	assert.Equal(t, state.Listeners(), bundle.Listeners)
+	assert.Equal(t, state.ListenerOrigins(), bundle.ListenerOrigins)
+	assert.Equal(t, "relay", bundle.ForwardingProfile)
+	assert.Equal(t, state.Compatibility(), bundle.Compatibility)
+	require.NotNil(t, bundle.Forwarder)
+	assert.Equal(t, state.Forwarder(), *bundle.Forwarder)
+	assert.Equal(t, state.RecentErrors(), bundle.RecentErrors)
+	assert.Equal(t, uint64(1), bundle.ErrorCount)
+	assert.Contains(t, bundle.Goroutines, "diagnostics_test.TestDump")
+}
+
+func TestDumpPartialState(t *testing.T) {
+	t.Parallel()
+
+	path, err := diagnostics.NewDumper(t.TempDir(), diagnostics.State{}).Dump()
+	require.NoError(t, err)
+
+	bundle := readBundle(t, path)
+	assert.Nil(t, bundle.Config)
+	assert.Nil(t, bundle.Forwarder)
+	assert.NotEmpty(t, bundle.Goroutines)
+}
+
+func TestDumpInvalidDir(t *testing.T) {
+	t.Parallel()
+
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+
+	_, err := diagnostics.NewDumper(filepath.Join(file, "diagnostics"), fakeState()).Dump()
+	require.ErrorContains(t, err, "failed to create the diagnostics directory")
+}
+
+func TestDumpOnSignal(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	signals := make(chan os.Signal, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		diagnostics.NewDumper(dir, fakeState()).DumpOnSignal(ctx, signals)
+	}()
+
+	signals <- syscall.SIGUSR1
+
+	var paths []string
+
+	require.Eventually(t, func() bool {
+		paths, _ = filepath.Glob(filepath.Join(dir, "*.json"))
+
+		return len(paths) == 1
+	}, 5*time.Second, 10*time.Millisecond, "the diagnostics were not written")
+
+	cancel()
+	<-done
+
+	assert.Equal(t, fakeState().Subsystems(), readBundle(t, paths[0]).Subsystems)
+}
@@ -0,0 +1,273 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diagnostics
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// DefaultSummaryInterval is the interval that the summaries are logged at by default.
+const DefaultSummaryInterval = 5 * time.Minute
+
+// summaryLatencies is the number of the longest latencies that a summary lists.
+const summaryLatencies = 3
+
+// Summarizer logs a compact summary of the state of the agent, so that the
+// steady state can be told apart from the events in the long debug logs. The
+// summaries are made from the same State as the bundles.
+type Summarizer struct {
+	state State
+	now   func() time.Time
+	mutex sync.Mutex
+	// last is the state of the last summary, for the counts since then.
+	last Bundle
+}
+
+// NewSummarizer creates a summarizer of the state, whose first summary
+// counts the errors since now, e.g. time.Now.
+func NewSummarizer(state State, now func() time.Time) *Summarizer {
+	return &Summarizer{state: state, now: now, last: Bundle{Time: now()}}
+}
+
+// Summary returns the summary of the current state, the errors are
+// counted since the previous summary.
+func (s *Summarizer) Summary() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	bundle := s.state.collect(s.now())
+	last := s.last
+	s.last = bundle
+
+	parts := []string{
+		"ports " + summarizePorts(bundle.Ports),
+		fmt.Sprintf("%d listeners", len(bundle.Listeners)),
+	}
+
+	if origins := summarizeOrigins(bundle.Ports, bundle.Listeners, bundle.ListenerOrigins); origins != "" {
+		parts = append(parts, "origins "+origins)
+	}
+
+	if bundle.Forwarder != nil {
+		parts = append(parts, "forwarder "+summarizeForwarder(*bundle.Forwarder, bundle.Time))
+	}
+
+	if len(bundle.Latencies) != 0 {
+		parts = append(parts, "slowest ports "+summarizeLatencies(bundle.Latencies))
+	}
+
+	if changes := summarizeChanges(bundle.Changes, last.Changes); changes != "" {
+		parts = append(parts, "changes "+changes)
+	}
+
+	subsystems := make([]string, 0, len(bundle.Subsystems))
+	for _, status := range bundle.Subsystems {
+		subsystem := status.Name + "=" + string(status.State)
+		if status.Restarts > 0 {
+			subsystem += fmt.Sprintf(" (%d restarts)", status.Restarts)
+		}
+
+		subsystems = append(subsystems, subsystem)
+	}
+
+	parts = append(parts, "subsystems ["+strings.Join(subsystems, " ")+"]")
+
+	errorCounts := fmt.Sprintf("%d errors logged", bundle.ErrorCount-last.ErrorCount)
+	if bundle.Forwarder != nil {
+		errorCounts += fmt.Sprintf(", %d failed sends", failures(bundle.Forwarder)-failures(last.Forwarder))
+	}
+
+	parts = append(parts, fmt.Sprintf("%s in the last %s", errorCounts, bundle.Time.Sub(last.Time).Round(time.Second)))
+
+	return "forwarding summary: " + strings.Join(parts, ", ")
+}
+
+// LogPeriodically logs a summary at every given interval until the context is cancelled.
+func (s *Summarizer) LogPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			log.Info(s.Summary())
+		}
+	}
+}
+
+// summarizePorts returns the number of tracked ports by source and protocol,
+// e.g. [docker=2/tcp,1/udp kubernetes=1/tcp].
+func summarizePorts(entries []tracker.Entry) string {
+	counts := make(map[string]map[string]int)
+
+	for _, entry := range entries {
+		source := entry.Source
+		if source == "" {
+			source = "unknown"
+		}
+
+		if counts[source] == nil {
+			counts[source] = make(map[string]int)
+		}
+
+		for port := range entry.Ports {
+			counts[source][port.Proto()]++
+		}
+	}
+
+	sources := make([]string, 0, len(counts))
+	for source, protocols := range counts {
+		names := make([]string, 0, len(protocols))
+		for protocol := range protocols {
+			names = append(names, protocol)
+		}
+
+		slices.Sort(names)
+
+		formatted := make([]string, 0, len(names))
+		for _, protocol := range names {
+			formatted = append(formatted, fmt.Sprintf("%d/%s", protocols[protocol], protocol))
+		}
+
+		sources = append(sources, source+"="+strings.Join(formatted, ","))
+	}
+
+	slices.Sort(sources)
+
+	return "[" + strings.Join(sources, " ") + "]"
+}
+
+// summarizeOrigins returns the objects that the host ports and the listeners
+// were added for, e.g. [8080/tcp=container:nginx 30080/tcp=service:default/web
+// 0.0.0.0:8081=iptables-rule:CNI-DN-2e2f8], or nothing if there are none. The
+// entries without an origin are named after their source and their ID.
+func summarizeOrigins(entries []tracker.Entry, listeners []string, listenerOrigins map[string]tracker.Origin) string {
+	origins := make(map[string]string)
+
+	for _, entry := range entries {
+		origin := tracker.Origin{Kind: entry.Source, ID: entry.ID}
+		if entry.Origin != nil {
+			origin = *entry.Origin
+		}
+
+		for port, bindings := range entry.Ports {
+			for _, binding := range bindings {
+				origins[binding.HostPort+"/"+port.Proto()] = origin.Kind + ":" + origin.Short()
+			}
+		}
+	}
+
+	for _, listener := range listeners {
+		origins[listener] = "unknown"
+		if origin, ok := listenerOrigins[listener]; ok {
+			origins[listener] = origin.Kind + ":" + origin.Short()
+		}
+	}
+
+	if len(origins) == 0 {
+		return ""
+	}
+
+	formatted := make([]string, 0, len(origins))
+	for key, origin := range origins {
+		formatted = append(formatted, key+"="+origin)
+	}
+
+	slices.Sort(formatted)
+
+	return "[" + strings.Join(formatted, " ") + "]"
+}
+
+// summarizeLatencies returns the longest latencies of the ports, e.g. [80/tcp=1.2s 30080/tcp=350ms].
+func summarizeLatencies(latencies []tracker.Latency) string {
+	if len(latencies) > summaryLatencies {
+		latencies = latencies[:summaryLatencies]
+	}
+
+	formatted := make([]string, 0, len(latencies))
+	for _, latency := range latencies {
+		formatted = append(formatted, latency.Port+"/"+latency.Protocol+"="+latency.Latency.Round(time.Millisecond).String())
+	}
+
+	return "[" + strings.Join(formatted, " ") + "]"
+}
+
+// summarizeChanges returns the changes of the port mappings since the last
+// counts, e.g. [docker/add/ok=4 docker/add/blocked=1], or nothing if there
+// were none.
+func summarizeChanges(counts, last []tracker.ChangeCount) string {
+	lastCounts := make(map[tracker.ChangeCount]uint64, len(last))
+	for _, count := range last {
+		lastCounts[tracker.ChangeCount{Source: count.Source, Action: count.Action, Outcome: count.Outcome}] = count.Count
+	}
+
+	formatted := make([]string, 0, len(counts))
+	for _, count := range counts {
+		key := tracker.ChangeCount{Source: count.Source, Action: count.Action, Outcome: count.Outcome}
+		if delta := count.Count - lastCounts[key]; delta != 0 {
+			formatted = append(formatted, fmt.Sprintf("%s/%s/%s=%d", count.Source, count.Action, count.Outcome, delta))
+		}
+	}
+
+	if len(formatted) == 0 {
+		return ""
+	}
+
+	return "[" + strings.Join(formatted, " ") + "]"
+}
+
+// summarizeForwarder returns whether the forwarder reaches the host, and when it last did.
+func summarizeForwarder(metrics forwarder.Metrics, now time.Time) string {
+	var state string
+
+	switch {
+	case metrics.Sends == 0:
+		state = "idle"
+	case metrics.LastError != "":
+		state = "failing (" + metrics.LastError + ")"
+	default:
+		state = "connected"
+	}
+
+	if metrics.LastSuccess.IsZero() {
+		return state + ", never sent"
+	}
+
+	return state + ", last sent " + now.Sub(metrics.LastSuccess).Round(time.Second).String() + " ago"
+}
+
+// failures returns the number of failed sends of any category.
+func failures(metrics *forwarder.Metrics) uint64 {
+	if metrics == nil {
+		return 0
+	}
+
+	var total uint64
+	for _, count := range metrics.Failures {
+		total += count
+	}
+
+	return total
+}
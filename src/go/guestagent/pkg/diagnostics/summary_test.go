@@ -0,0 +1,182 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package diagnostics_test
+
+import (
+	"maps"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/diagnostics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSummarizer(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2024, 5, 14, 10, 0, 0, 0, time.UTC)
+	metrics := forwarder.Metrics{Failures: map[string]uint64{}}
+	errorCount := uint64(0)
+
+	summarizer := diagnostics.NewSummarizer(diagnostics.State{
+		Subsystems: func() []supervisor.Status {
+			return []supervisor.Status{
+				{Name: "docker", State: supervisor.StateRunning},
+				{Name: "kubernetes", State: supervisor.StateBackingOff, Restarts: 2},
+			}
+		},
+		Ports: func() []tracker.Entry {
+			return []tracker.Entry{
+				{ID: "web", Source: tracker.SourceDocker, Ports: nat.PortMap{"80/tcp": nil, "53/udp": nil, "443/tcp": nil}},
+				{ID: "nodeport", Source: tracker.SourceKubernetes, Ports: nat.PortMap{"30080/tcp": nil}},
+			}
+		},
+		Listeners: func() []string {
+			return []string{"0.0.0.0:30080"}
+		},
+		// The metrics are copied, like MetricsForwarder.Metrics does.
+		Forwarder: func() forwarder.Metrics {
+			snapshot := metrics
+			snapshot.Failures = maps.Clone(metrics.Failures)
+
+			return snapshot
+		},
+		ErrorCount: func() uint64 {
+			return errorCount
+		},
+	}, func() time.Time {
+		return now
+	})
+
+	// Nothing was sent yet.
+	now = now.Add(5 * time.Minute)
+	errorCount = 2
+
+	assert.Equal(t, "forwarding summary: ports [docker=2/tcp,1/udp kubernetes=1/tcp], 1 listeners, origins [0.0.0.0:30080=unknown], "+
+		"forwarder idle, never sent, subsystems [docker=running kubernetes=backing off (2 restarts)], "+
+		"2 errors logged, 0 failed sends in the last 5m0s",
+		summarizer.Summary())
+
+	// The errors are only counted since the last summary.
+	metrics.Sends = 4
+	metrics.Failures[forwarder.FailureTimeout] = 1
+	metrics.LastSuccess = now.Add(4*time.Minute + 30*time.Second)
+	now = now.Add(5 * time.Minute)
+	errorCount = 3
+
+	summary := summarizer.Summary()
+	assert.Contains(t, summary, "forwarder connected, last sent 30s ago")
+	assert.Contains(t, summary, "1 errors logged, 1 failed sends in the last 5m0s")
+
+	metrics.Sends = 6
+	metrics.Failures[forwarder.FailureUnreachable] = 2
+	metrics.LastError = "connection refused"
+	now = now.Add(time.Minute)
+
+	summary = summarizer.Summary()
+	assert.Contains(t, summary, "forwarder failing (connection refused), last sent 1m30s ago")
+	assert.Contains(t, summary, "0 errors logged, 2 failed sends in the last 1m0s")
+	assert.NotContains(t, summary, "slowest ports")
+}
+
+func TestSummarizerOrigins(t *testing.T) {
+	t.Parallel()
+
+	binding := func(port string) []nat.PortBinding {
+		return []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: port}, {HostIP: "::", HostPort: port}}
+	}
+
+	summarizer := diagnostics.NewSummarizer(diagnostics.State{
+		Ports: func() []tracker.Entry {
+			return []tracker.Entry{
+				{
+					ID:     "3f9a1c07ab12cd34",
+					Source: tracker.SourceDocker,
+					Origin: &tracker.Origin{Kind: tracker.OriginContainer, ID: "3f9a1c07ab12cd34", Name: "nginx"},
+					Ports:  nat.PortMap{"80/tcp": binding("8080")},
+				},
+				{
+					ID:     "0b5f",
+					Source: tracker.SourceKubernetes,
+					Origin: &tracker.Origin{Kind: tracker.OriginService, ID: "0b5f", Namespace: "default", Name: "web"},
+					Ports:  nat.PortMap{"80/tcp": binding("30080"), "53/udp": binding("30053")},
+				},
+				// The entries without an origin are named after their source and ID.
+				{ID: "selftest", Source: "selftest", Ports: nat.PortMap{"80/tcp": binding("9999")}},
+			}
+		},
+		Listeners: func() []string {
+			return []string{"0.0.0.0:8081", "127.0.0.1:9000"}
+		},
+		ListenerOrigins: func() map[string]tracker.Origin {
+			return map[string]tracker.Origin{
+				"0.0.0.0:8081": {Kind: tracker.OriginRule, Name: "CNI-DN-2e2f8", Rule: "-A CNI-DN-2e2f8 -p tcp -m tcp --dport 8081 -j DNAT"},
+			}
+		},
+	}, time.Now)
+
+	assert.Contains(t, summarizer.Summary(), ", 2 listeners, origins [0.0.0.0:8081=iptables-rule:CNI-DN-2e2f8 "+
+		"127.0.0.1:9000=unknown 30053/udp=service:default/web 30080/tcp=service:default/web "+
+		"8080/tcp=container:nginx 9999/tcp=selftest:selftest], ")
+
+	// The summaries without any ports or listeners do not list the origins.
+	empty := diagnostics.NewSummarizer(diagnostics.State{}, time.Now)
+	assert.NotContains(t, empty.Summary(), "origins")
+}
+
+func TestSummarizerLatencies(t *testing.T) {
+	t.Parallel()
+
+	summarizer := diagnostics.NewSummarizer(diagnostics.State{
+		Latencies: func() []tracker.Latency {
+			return []tracker.Latency{
+				{Port: "80", Protocol: "tcp", Latency: 1234567 * time.Microsecond},
+				{Port: "30080", Protocol: "tcp", Latency: 350 * time.Millisecond},
+				{Port: "53", Protocol: "udp", Latency: 20 * time.Millisecond},
+				{Port: "443", Protocol: "tcp", Latency: 2 * time.Millisecond},
+			}
+		},
+	}, time.Now)
+
+	// Only the longest latencies are listed.
+	assert.Contains(t, summarizer.Summary(), ", slowest ports [80/tcp=1.235s 30080/tcp=350ms 53/udp=20ms], ")
+}
+
+func TestSummarizerChanges(t *testing.T) {
+	t.Parallel()
+
+	changes := tracker.NewChangeCounter()
+	summarizer := diagnostics.NewSummarizer(diagnostics.State{Changes: changes.Counts}, time.Now)
+
+	// The summaries without any changes do not list them.
+	assert.NotContains(t, summarizer.Summary(), "changes")
+
+	for range 4 {
+		changes.Count(tracker.SourceDocker, tracker.ActionAdd, tracker.ChangeOK)
+	}
+
+	changes.Count(tracker.SourceDocker, tracker.ActionAdd, tracker.ChangeBlocked)
+	changes.Count(tracker.SourceKubernetes, tracker.ActionRemove, tracker.ChangeForwarderError)
+	assert.Contains(t, summarizer.Summary(),
+		", changes [docker/add/blocked=1 docker/add/ok=4 kubernetes/remove/forwarder-error=1], ")
+
+	// Only the changes since the last summary are listed.
+	changes.Count(tracker.SourceDocker, tracker.ActionAdd, tracker.ChangeOK)
+	assert.Contains(t, summarizer.Summary(), ", changes [docker/add/ok=1], ")
+	assert.NotContains(t, summarizer.Summary(), "changes")
+}
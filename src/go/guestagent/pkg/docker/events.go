@@ -16,16 +16,24 @@ package docker
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"os/exec"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Masterminds/log-go"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
 	"github.com/docker/go-connections/nat"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/containerd"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/recording"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
 )
 
@@ -34,6 +42,10 @@ const (
 	stopEvent  = "stop"
 	// die event is a confirmation of kill event.
 	dieEvent = "die"
+	// The labels that the kubelet sets on the containers of the pods when it
+	// runs them on Docker, e.g. with k3s --docker and cri-dockerd.
+	labelPodName      = "io.kubernetes.pod.name"
+	labelPodNamespace = "io.kubernetes.pod.namespace"
 )
 
 // EventMonitor monitors the Docker engine's Event API
@@ -41,6 +53,48 @@ const (
 type EventMonitor struct {
 	dockerClient *client.Client
 	portTracker  tracker.Tracker
+	// dryRun logs the iptables rules instead of adding them, see EnableDryRun.
+	dryRun bool
+	// recorder records the events that are received, see SetRecorder.
+	recorder *recording.Recorder
+	// kubernetesContainers forwards the port mappings of the containers of
+	// the pods too, see ForwardKubernetesContainers.
+	kubernetesContainers bool
+	// podsSeen is set once a container of a pod was seen, which is logged once.
+	podsSeen bool
+	// proxy opens the proxies of the exposed ports of the containers on the
+	// labeled networks, see ForwardLabeledNetworks; forwardedNetworks caches
+	// whether the networks are labeled until they are removed, and
+	// networkProxies holds the proxies.
+	proxy             ProxyFunc
+	forwardedNetworks map[string]bool
+	networkProxies    map[string]*networkProxy
+	// queueSize is the number of the events that are held for the
+	// processor, see SetQueueSize.
+	queueSize int
+}
+
+// Event is what the port mappings depend on of a container event, as it is
+// recorded and replayed, see recording; the rest of the container, e.g. its
+// environment, is left out of the recordings.
+type Event struct {
+	Action      string      `json:"action"`
+	ContainerID string      `json:"containerID"`
+	Ports       nat.PortMap `json:"ports,omitempty"`
+	// IPAddresses are the addresses of the container that the loopback iptables rules lead to.
+	IPAddresses []string `json:"ipAddresses,omitempty"`
+	// Name is the name of the container, without the leading slash.
+	Name string `json:"name,omitempty"`
+	// Pod is the pod of the container as namespace/name when Kubernetes runs
+	// it on Docker, e.g. with cri-dockerd, see podOf.
+	Pod string `json:"pod,omitempty"`
+	// Exposed are the ports that the container exposes, and Networks its
+	// addresses on the networks that forward them, see ForwardLabeledNetworks.
+	Exposed  []nat.Port    `json:"exposed,omitempty"`
+	Networks []NetworkAddr `json:"networks,omitempty"`
+	// eventTime is when the event happened, to measure how long its port
+	// mapping takes to reach the host; it is not recorded, see tracker.WithEventTime.
+	eventTime time.Time
 }
 
 // NewEventMonitor creates and returns a new Event Monitor for
@@ -55,81 +109,325 @@ func NewEventMonitor(portTracker tracker.Tracker) (*EventMonitor, error) {
 	return &EventMonitor{
 		dockerClient: cli,
 		portTracker:  portTracker,
+		queueSize:    DefaultQueueSize,
 	}, nil
 }
 
+// EnableDryRun makes the event monitor log the iptables rules
+// that it would add instead of adding them.
+func (e *EventMonitor) EnableDryRun() {
+	e.dryRun = true
+}
+
+// ForwardKubernetesContainers makes the event monitor forward the port
+// mappings of the containers that Kubernetes runs on Docker, e.g. the ones of
+// the service load balancers of k3s with cri-dockerd; they are skipped
+// otherwise, since the Kubernetes subsystem forwards their services.
+func (e *EventMonitor) ForwardKubernetesContainers() {
+	e.kubernetesContainers = true
+}
+
+// SetRecorder makes the event monitor record the events that it receives,
+// including the running containers that it starts with.
+func (e *EventMonitor) SetRecorder(recorder *recording.Recorder) {
+	e.recorder = recorder
+}
+
+// SetQueueSize sets the number of the events that are held while the
+// previous ones are handled, DefaultQueueSize by default; once it is full,
+// the running containers are scanned instead, see MonitorPorts.
+func (e *EventMonitor) SetQueueSize(size int) {
+	e.queueSize = size
+}
+
 // MonitorPorts scans Docker's event stream API
 // for container start/stop events.
+//
+// The stream is read by a goroutine of its own into a queue, which the
+// containers of the events are inspected and their port mappings changed
+// from, so that the stream is read on while the host is slow to be sent the
+// changes. The events that do not fit in the queue are dropped, and the
+// running containers are scanned for them once it is drained. The events that
+// are still queued once the context is canceled, or the stream failed, are
+// abandoned; MonitorPorts returns once the reader did.
 func (e *EventMonitor) MonitorPorts(ctx context.Context) {
-	msgCh, errCh := e.dockerClient.Events(ctx, types.EventsOptions{
-		Filters: filters.NewArgs(
-			filters.Arg("type", "container"),
-			filters.Arg("event", startEvent),
-			filters.Arg("event", stopEvent),
-			filters.Arg("event", dieEvent)),
-	})
+	msgCh, errCh := e.dockerClient.Events(ctx, containerEvents(e.proxy != nil))
 
-	if err := e.initializeRunningContainers(ctx); err != nil {
-		log.Errorf("failed to initialize existing container port mappings: %v", err)
+	// Every event that is received is reported, so that the status tells when the last one was.
+	health := supervisor.HealthReporter(ctx)
+
+	// The events are read while the running containers are handled too.
+	pipeline := newPipeline(e.queueSize)
+	readerCtx, cancelReader := context.WithCancel(ctx)
+	readerDone := make(chan struct{})
+
+	go func() {
+		defer close(readerDone)
+		pipeline.read(readerCtx, msgCh, errCh)
+	}()
+
+	defer func() {
+		cancelReader()
+		<-readerDone
+	}()
+
+	err := e.initializeRunningContainers(ctx, health)
+	if err != nil {
+		logger.Errorf("failed to initialize existing container port mappings: %v", err)
+		health.Failed(err)
+	} else {
+		health.Succeeded()
 	}
 
-	for {
+	// The running containers are part of the startup batch, see tracker.StartupBatch.
+	tracker.InitialPassDone(ctx, err)
+
+	for ctx.Err() == nil {
 		select {
 		case <-ctx.Done():
-			log.Errorf("context cancellation: %v", ctx.Err())
+		case queued := <-pipeline.queue:
+			e.process(ctx, health, queued)
+		case err := <-pipeline.errs:
+			// The stream fails once the context is cancelled too.
+			if ctx.Err() != nil {
+				break
+			}
+
+			logger.Errorf("receiving container event failed: %v", err)
 
 			return
-		case event := <-msgCh:
-			container, err := e.dockerClient.ContainerInspect(ctx, event.ID)
-			if err != nil {
-				log.Errorf("inspecting container [%v] failed: %v", event.ID, err)
+		}
 
-				continue
-			}
+		if dropped, ok := pipeline.drained(); ok && ctx.Err() == nil {
+			e.reconcile(ctx, health, dropped)
+		}
+	}
 
-			log.Debugf("received an event: {Status: %+v ContainerID: %+v Ports: %+v}",
-				event.Action,
-				event.ID,
-				container.NetworkSettings.NetworkSettingsBase.Ports)
-
-			switch event.Action {
-			case startEvent:
-				if len(container.NetworkSettings.NetworkSettingsBase.Ports) != 0 {
-					validatePortMapping(container.NetworkSettings.NetworkSettingsBase.Ports)
-					err = e.portTracker.Add(container.ID, container.NetworkSettings.NetworkSettingsBase.Ports)
-					if err != nil {
-						log.Errorf("adding port mapping to tracker failed: %v", err)
-					}
-
-					err = createLoopbackIPtablesRules(container.NetworkSettings.DefaultNetworkSettings.IPAddress,
-						container.NetworkSettings.NetworkSettingsBase.Ports)
-					if err != nil {
-						log.Errorf("failed running iptable rules to update DNAT rule in DOCKER chain: %v", err)
-					}
-				}
-			case stopEvent, dieEvent:
-				err := e.portTracker.Remove(container.ID)
-				if err != nil {
-					log.Errorf("remove port mapping from tracker failed: %w", err)
-				}
-			}
-		case err := <-errCh:
-			log.Errorf("receiving container event failed: %v", err)
+	// The monitor is stopped, e.g. at shutdown, which is not an error; the
+	// events that are still queued are abandoned rather than handled.
+	logger.Debugf("context cancellation: %v", ctx.Err())
+}
+
+// process inspects the container of the queued event and handles the event.
+func (e *EventMonitor) process(ctx context.Context, health supervisor.Reporter, queued queuedEvent) {
+	if queued.messageType == events.NetworkEventType && queued.action == destroyEvent {
+		// The IDs of the networks are not reused, so their labels are
+		// not kept for the lifetime of the agent.
+		delete(e.forwardedNetworks, queued.networkID)
+
+		return
+	}
+
+	container, err := e.dockerClient.ContainerInspect(ctx, queued.containerID)
+	if err != nil && queued.messageType == events.NetworkEventType && client.IsErrNotFound(err) {
+		// The container was removed, and its stop closed its proxies.
+		return
+	}
+	if err != nil {
+		logger.Errorw("inspecting the container failed", logging.Fields(
+			logging.Container(queued.containerID),
+			logging.Source(tracker.SourceDocker),
+			logging.Error(err),
+		))
+		health.Failed(err)
+
+		return
+	}
+
+	health.Succeeded()
+
+	e.receive(ctx, health, Event{
+		Action:      queued.action,
+		ContainerID: container.ID,
+		Name:        strings.TrimPrefix(container.Name, "/"),
+		Pod:         podOf(containerLabels(container)),
+		Ports:       container.NetworkSettings.NetworkSettingsBase.Ports,
+		IPAddresses: []string{container.NetworkSettings.DefaultNetworkSettings.IPAddress},
+		Exposed:     e.exposedPorts(containerExposedPorts(container)),
+		Networks:    e.networkAddrs(ctx, container.NetworkSettings.Networks),
+		eventTime:   queued.eventTime,
+	})
+}
+
+// Replay handles a recorded event like the events that are received,
+// see recording.Replay.
+func (e *EventMonitor) Replay(ctx context.Context, recorded json.RawMessage) error {
+	var event Event
+	if err := json.Unmarshal(recorded, &event); err != nil {
+		return fmt.Errorf("failed to decode the event: %w", err)
+	}
+
+	e.handleEvent(ctx, supervisor.HealthReporter(ctx), event)
+
+	return nil
+}
 
+// receive records the event, if the events are recorded, and handles it.
+func (e *EventMonitor) receive(ctx context.Context, health supervisor.Reporter, event Event) {
+	if err := e.recorder.Record(tracker.SourceDocker, event); err != nil {
+		logger.Errorf("recording the event failed: %v", err)
+	}
+
+	e.handleEvent(ctx, health, event)
+}
+
+// handleEvent changes the port mappings of the container of the event,
+// both for the events that are received and for the recorded ones.
+func (e *EventMonitor) handleEvent(ctx context.Context, health supervisor.Reporter, event Event) {
+	// The correlation ID links the log lines and the payloads of the
+	// change to the port mapping that the event causes.
+	correlationID := tracker.NewCorrelationID()
+
+	logger.Debugw("received an event", logging.Fields(
+		logging.Container(event.ContainerID),
+		logging.Source(tracker.SourceDocker),
+		logging.CorrelationID(correlationID),
+		log.Fields{"status": event.Action, "ports": event.Ports},
+	))
+
+	// The changes of the event are traced as the children of its span.
+	ctx, span := tracing.Start(ctx, "docker.event",
+		tracing.String(tracing.AttrID, event.ContainerID),
+		tracing.String(tracing.AttrCorrelationID, correlationID),
+		tracing.String("action", event.Action))
+	defer span.End()
+
+	switch event.Action {
+	case startEvent:
+		if e.skipped(event) {
 			return
 		}
+
+		e.proxyNetworks(ctx, event, correlationID)
+
+		if len(event.Ports) == 0 {
+			return
+		}
+
+		validatePortMapping(event.Ports)
+
+		err := e.portTracker.Add(ctx, event.ContainerID, event.Ports,
+			tracker.WithSource(tracker.SourceDocker),
+			tracker.WithOrigin(tracker.Origin{Kind: tracker.OriginContainer, ID: event.ContainerID, Name: event.Name}),
+			tracker.WithCorrelationID(correlationID),
+			tracker.WithEventTime(event.eventTime))
+		if err != nil {
+			span.RecordError(err)
+			logger.Errorw("adding port mapping to tracker failed", logging.Fields(
+				logging.Container(event.ContainerID),
+				logging.Source(tracker.SourceDocker),
+				logging.CorrelationID(correlationID),
+				logging.Error(err),
+			))
+			health.Failed(err)
+		}
+
+		for _, ipAddress := range event.IPAddresses {
+			if err := e.createLoopbackIPtablesRules(ctx, ipAddress, event.Ports); err != nil {
+				logger.Errorf("failed running iptable rules to update DNAT rule in DOCKER chain: %v", err)
+				health.Failed(err)
+			}
+		}
+	case connectEvent, disconnectEvent:
+		if !e.skipped(event) {
+			e.proxyNetworks(ctx, event, correlationID)
+		}
+	case stopEvent, dieEvent:
+		e.closeNetworkProxy(ctx, event.ContainerID, correlationID)
+
+		err := e.portTracker.Remove(ctx, event.ContainerID, tracker.WithCorrelationID(correlationID))
+		if err != nil {
+			span.RecordError(err)
+			logger.Errorw("remove port mapping from tracker failed", logging.Fields(
+				logging.Container(event.ContainerID),
+				logging.Source(tracker.SourceDocker),
+				logging.CorrelationID(correlationID),
+				logging.Error(err),
+			))
+			health.Failed(err)
+		}
+	}
+}
+
+// skipped returns true if the container of the event is one of a pod that
+// is left to the Kubernetes subsystem, see ForwardKubernetesContainers.
+func (e *EventMonitor) skipped(event Event) bool {
+	if event.Pod == "" {
+		return false
+	}
+
+	if !e.podsSeen {
+		e.podsSeen = true
+
+		if e.kubernetesContainers {
+			logger.Infof("Kubernetes runs its containers on Docker, e.g. with cri-dockerd, their port mappings are " +
+				"forwarded by the Docker subsystem too")
+		} else {
+			logger.Infof("Kubernetes runs its containers on Docker, e.g. with cri-dockerd, their port mappings are " +
+				"left to the Kubernetes subsystem")
+		}
 	}
+
+	if e.kubernetesContainers {
+		return false
+	}
+
+	logger.Debugw("skipping the container of the pod "+event.Pod, logging.Fields(
+		logging.Container(event.ContainerID),
+		logging.Source(tracker.SourceDocker),
+	))
+
+	return true
+}
+
+// podOf returns the pod of the labels of a container as namespace/name, or
+// an empty string for the containers that Kubernetes does not run, including
+// the ones whose labels only look like the ones of the kubelet.
+func podOf(labels map[string]string) string {
+	name, namespace := labels[labelPodName], labels[labelPodNamespace]
+	if name == "" || namespace == "" {
+		return ""
+	}
+
+	return namespace + "/" + name
+}
+
+// containerLabels returns the labels of an inspected container.
+func containerLabels(container types.ContainerJSON) map[string]string {
+	if container.Config == nil {
+		return nil
+	}
+
+	return container.Config.Labels
+}
+
+// containerExposedPorts returns the ports that an inspected container exposes.
+func containerExposedPorts(container types.ContainerJSON) nat.PortSet {
+	if container.Config == nil {
+		return nil
+	}
+
+	return container.Config.ExposedPorts
 }
 
 // Flush clears all the container port mappings
-// out of the port tracker upon shutdown.
-func (e *EventMonitor) Flush() {
-	err := e.portTracker.RemoveAll()
+// out of the port tracker, e.g. before the monitor is restarted.
+func (e *EventMonitor) Flush(ctx context.Context) {
+	e.closeNetworkProxies(ctx)
+
+	err := e.portTracker.RemoveAll(ctx)
 	if err != nil {
-		log.Errorf("Flush received an error to remove all portMappings: %v", err)
+		logger.Errorf("Flush received an error to remove all portMappings: %v", err)
 	}
 }
 
+// Close closes the relays of the containers of the labeled networks, the
+// other port mappings are left in the port tracker, e.g. at shutdown, for
+// them to be withdrawn along with the ones of the other sources.
+func (e *EventMonitor) Close() {
+	e.closeNetworkProxies(context.Background())
+}
+
 // Info returns information about the docker server
 // it is used to verify that docker engine server is up.
 func (e *EventMonitor) Info(ctx context.Context) error {
@@ -138,39 +436,189 @@ func (e *EventMonitor) Info(ctx context.Context) error {
 	return err
 }
 
-func (e *EventMonitor) initializeRunningContainers(ctx context.Context) error {
-	containers, err := e.dockerClient.ContainerList(ctx, types.ContainerListOptions{
-		Filters: filters.NewArgs(filters.Arg("status", "running")),
-	})
+// containerEvents are the events that the port mappings change on, including
+// the ones of the containers that are connected to and disconnected from
+// the networks if networks is set, see ForwardLabeledNetworks; the removed
+// networks are evicted from the cache of their labels.
+func containerEvents(networks bool) types.EventsOptions {
+	args := filters.NewArgs(
+		filters.Arg("type", "container"),
+		filters.Arg("event", startEvent),
+		filters.Arg("event", stopEvent),
+		filters.Arg("event", dieEvent))
+
+	if networks {
+		args.Add("type", "network")
+		args.Add("event", connectEvent)
+		args.Add("event", disconnectEvent)
+		args.Add("event", destroyEvent)
+	}
+
+	return types.EventsOptions{Filters: args}
+}
+
+// Ping checks that the Docker API is reachable, for the self-test.
+func Ping(ctx context.Context) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
 		return err
 	}
+	defer cli.Close()
+
+	_, err = cli.Ping(ctx)
+
+	return err
+}
+
+// CheckEvents checks that the events of the containers can be subscribed to,
+// for the self-test; the subscription is held for wait, since its errors are
+// only reported once it started.
+func CheckEvents(ctx context.Context, wait time.Duration) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	_, errCh := cli.Events(ctx, containerEvents(false))
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("failed to subscribe to the events: %w", err)
+	case <-timer.C:
+		return nil
+	}
+}
+
+// ListPorts returns the port mappings of the running containers, keyed by
+// the container ID, without tracking them; see scan.Lister. The containers of
+// the pods are left out unless kubernetesContainers is set, see
+// EventMonitor.ForwardKubernetesContainers.
+func ListPorts(ctx context.Context, kubernetesContainers bool) (map[string]nat.PortMap, error) {
+	return listPorts(ctx, kubernetesContainers, false)
+}
+
+// ListRunning returns the port mappings of the running containers like
+// ListPorts, along with the containers that have no ports, whose port
+// mappings are nil; see tracker.DriftSource.
+func ListRunning(ctx context.Context, kubernetesContainers bool) (map[string]nat.PortMap, error) {
+	return listPorts(ctx, kubernetesContainers, true)
+}
+
+// ContainerID returns the ID of the container of a port mapping that the
+// monitor tracks, including the ones of its labeled networks.
+func ContainerID(id string) string {
+	return strings.TrimSuffix(id, networkSuffix)
+}
+
+func listPorts(ctx context.Context, kubernetesContainers, withoutPorts bool) (map[string]nat.PortMap, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+
+	containers, err := runningContainers(ctx, cli)
+	if err != nil {
+		return nil, err
+	}
+
+	portMaps := make(map[string]nat.PortMap, len(containers))
 
 	for _, container := range containers {
-		if len(container.Ports) != 0 {
-			portMap, err := createPortMapping(container.Ports)
-			if err != nil {
-				log.Errorf("creating initial port mapping failed: %v", err)
+		if !kubernetesContainers && podOf(container.Labels) != "" {
+			continue
+		}
 
-				continue
+		if len(container.Ports) == 0 {
+			if withoutPorts {
+				portMaps[container.ID] = nil
 			}
 
-			if err := e.portTracker.Add(container.ID, portMap); err != nil {
-				log.Errorf("registering already running containers failed: %v", err)
-			}
+			continue
+		}
 
-			for _, netSettings := range container.NetworkSettings.Networks {
-				err = createLoopbackIPtablesRules(netSettings.IPAddress, portMap)
-				if err != nil {
-					log.Errorf("failed running iptable rules to update DNAT rule in DOCKER chain: %v", err)
-				}
-			}
+		portMap, err := createPortMapping(container.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("creating the port mapping of the container %s failed: %w", container.ID, err)
+		}
+
+		portMaps[container.ID] = portMap
+	}
+
+	return portMaps, nil
+}
+
+func runningContainers(ctx context.Context, cli *client.Client) ([]types.Container, error) {
+	return cli.ContainerList(ctx, types.ContainerListOptions{
+		Filters: filters.NewArgs(filters.Arg("status", "running")),
+	})
+}
+
+// initializeRunningContainers handles the running containers as if they
+// started, so that they are recorded and replayed like the events.
+func (e *EventMonitor) initializeRunningContainers(ctx context.Context, health supervisor.Reporter) error {
+	containers, err := runningContainers(ctx, e.dockerClient)
+	if err != nil {
+		return err
+	}
+
+	for _, container := range containers {
+		// The containers that are left are listed again by the next monitor.
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if event, ok := e.listedEvent(ctx, container); ok {
+			e.receive(ctx, health, event)
 		}
 	}
 
 	return nil
 }
 
+// listedEvent returns the start event of a listed container, unless it has no ports.
+func (e *EventMonitor) listedEvent(ctx context.Context, container types.Container) (Event, bool) {
+	if len(container.Ports) == 0 {
+		return Event{}, false
+	}
+
+	portMap, err := createPortMapping(container.Ports)
+	if err != nil {
+		logger.Errorf("creating initial port mapping failed: %v", err)
+
+		return Event{}, false
+	}
+
+	event := Event{
+		Action:      startEvent,
+		ContainerID: container.ID,
+		Pod:         podOf(container.Labels),
+		Ports:       portMap,
+		Exposed:     e.listedPorts(container.Ports),
+		eventTime:   time.Now(),
+	}
+	if len(container.Names) != 0 {
+		event.Name = strings.TrimPrefix(container.Names[0], "/")
+	}
+
+	if container.NetworkSettings != nil {
+		for _, netSettings := range container.NetworkSettings.Networks {
+			event.IPAddresses = append(event.IPAddresses, netSettings.IPAddress)
+		}
+
+		event.Networks = e.networkAddrs(ctx, container.NetworkSettings.Networks)
+	}
+
+	return event, true
+}
+
 func createPortMapping(ports []types.Port) (nat.PortMap, error) {
 	portMap := make(nat.PortMap)
 
@@ -204,7 +652,10 @@ func createPortMapping(ports []types.Port) (nat.PortMap, error) {
 func validatePortMapping(portMap nat.PortMap) {
 	for k, v := range portMap {
 		if len(v) == 0 {
-			log.Debugf("removing entry: %v from the portmappings: %v", k, portMap)
+			logger.Debugw("removing the port without bindings from the port mapping", logging.Fields(
+				logging.PortProtocol(k),
+				logging.Source(tracker.SourceDocker),
+			))
 			delete(portMap, k)
 		}
 	}
@@ -221,14 +672,14 @@ func validatePortMapping(portMap nat.PortMap) {
 // DNAT       tcp  --  anywhere             localhost            tcp dpt:9119 to:10.4.0.22:80.
 // We enter the following rule after the existing rule:
 // DNAT       tcp  --  anywhere             anywhere             tcp dpt:9119 to:10.4.0.22:80.
-func createLoopbackIPtablesRules(containerIP string, portMappings nat.PortMap) error {
+func (e *EventMonitor) createLoopbackIPtablesRules(ctx context.Context, containerIP string, portMappings nat.PortMap) error {
 	var errs []error
 
 	for portProto, portBindings := range portMappings {
 		for _, portBinding := range portBindings {
 			if portBinding.HostIP == "127.0.0.1" {
 				//nolint:gosec // no security concern with the potentially tainted command arguments
-				iptableCmd := exec.Command("iptables",
+				iptableCmd := exec.CommandContext(ctx, "iptables",
 					"--table", "nat",
 					"--append", "DOCKER",
 					"--protocol", "tcp",
@@ -236,6 +687,17 @@ func createLoopbackIPtablesRules(containerIP string, portMappings nat.PortMap) e
 					"--jump", "DNAT",
 					"--dport", portBinding.HostPort,
 					"--to-destination", fmt.Sprintf("%s:%s", containerIP, portProto.Port()))
+				if e.dryRun {
+					logger.Infow("dry run, not adding the iptables rule", logging.Fields(
+						logging.Port(portBinding.HostPort),
+						logging.Protocol(portProto.Proto()),
+						logging.Source(tracker.SourceDocker),
+						log.Fields{"rule": iptableCmd.String()},
+					))
+
+					continue
+				}
+
 				if err := iptableCmd.Run(); err != nil {
 					errs = append(errs, err)
 				}
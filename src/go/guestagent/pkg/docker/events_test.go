@@ -0,0 +1,577 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/docker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/recording"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	guestagentTypes "github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDockerAPI serves a running container, web, and the events of a
+// second container, db, that starts, and of web that stops, in that order.
+func fakeDockerAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	return fakeAPI(t, []types.Container{runningContainer("web", "172.17.0.2", 80, 8080, nil)},
+		map[string]types.ContainerJSON{
+			"web": containerJSON("web", "172.17.0.2", "80/tcp", "8080"),
+			"db":  containerJSON("db", "172.17.0.3", "5432/tcp", "5432"),
+		},
+		[]events.Message{
+			{Type: events.ContainerEventType, Action: "start", ID: "db", Actor: events.Actor{ID: "db"}},
+			{Type: events.ContainerEventType, Action: "stop", ID: "web", Actor: events.Actor{ID: "web"}},
+		})
+}
+
+// podLabels are the labels that the kubelet sets on the containers of a pod with cri-dockerd.
+func podLabels(namespace, name string) map[string]string {
+	return map[string]string{
+		"io.kubernetes.pod.namespace":    namespace,
+		"io.kubernetes.pod.name":         name,
+		"io.kubernetes.docker.type":      "podsandbox",
+		"io.kubernetes.container.name":   "POD",
+		"io.kubernetes.pod.uid":          "0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0",
+		"annotation.kubernetes.io/notes": "the pause container",
+	}
+}
+
+// fakeCRIDockerdAPI serves the running containers of k3s with cri-dockerd, the
+// service load balancer of traefik and a container of the user, web, and the
+// events of the start of a container of another pod, coredns, and of one of
+// the user, db, whose labels only look like the ones of the kubelet.
+func fakeCRIDockerdAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	coredns := containerJSON("coredns", "10.42.0.5", "53/udp", "53")
+	coredns.Config = &container.Config{Labels: podLabels("kube-system", "coredns-6799fbcd5-xv7lq")}
+	db := containerJSON("db", "172.17.0.3", "5432/tcp", "5432")
+	db.Config = &container.Config{Labels: map[string]string{"io.kubernetes.pod.name": "db"}}
+
+	return fakeAPI(t, []types.Container{
+		runningContainer("svclb", "10.42.0.4", 80, 80, podLabels("kube-system", "svclb-traefik-a1b2c3")),
+		runningContainer("web", "172.17.0.2", 80, 8080, map[string]string{"com.example.app": "web"}),
+	}, map[string]types.ContainerJSON{
+		"coredns": coredns,
+		"db":      db,
+	}, []events.Message{
+		{Type: events.ContainerEventType, Action: "start", ID: "coredns", Actor: events.Actor{ID: "coredns"}},
+		{Type: events.ContainerEventType, Action: "start", ID: "db", Actor: events.Actor{ID: "db"}},
+	})
+}
+
+// fakeAPI serves the running containers, the inspected containers by their
+// ID, and the events in the order of the messages.
+func fakeAPI(
+	t *testing.T,
+	running []types.Container,
+	inspect map[string]types.ContainerJSON,
+	messages []events.Message,
+) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ping", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Api-Version", "1.41")
+	})
+	mux.HandleFunc("GET /{version}/containers/json", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(running)
+	})
+	mux.HandleFunc("GET /{version}/containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(inspect[r.PathValue("id")])
+	})
+	mux.HandleFunc("GET /{version}/events", func(w http.ResponseWriter, r *http.Request) {
+		encoder := json.NewEncoder(w)
+		for _, message := range messages {
+			_ = encoder.Encode(message)
+			w.(http.Flusher).Flush()
+		}
+
+		<-r.Context().Done()
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func runningContainer(id, ip string, port, hostPort uint16, labels map[string]string) types.Container {
+	return types.Container{
+		ID:     id,
+		Names:  []string{"/" + id},
+		Labels: labels,
+		Ports:  []types.Port{{IP: "127.0.0.1", PrivatePort: port, PublicPort: hostPort, Type: "tcp"}},
+		NetworkSettings: &types.SummaryNetworkSettings{
+			Networks: map[string]*network.EndpointSettings{"bridge": {IPAddress: ip}},
+		},
+	}
+}
+
+func containerJSON(id, ip, port, hostPort string) types.ContainerJSON {
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: id, Name: "/" + id},
+		NetworkSettings: &types.NetworkSettings{
+			NetworkSettingsBase: types.NetworkSettingsBase{
+				Ports: nat.PortMap{nat.Port(port): []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: hostPort}}},
+			},
+			DefaultNetworkSettings: types.DefaultNetworkSettings{IPAddress: ip},
+		},
+	}
+}
+
+// TestEventMonitorDryRun checks that a dry run goes through the events
+// without adding any iptables rule, opening any listener or forwarding.
+func TestEventMonitorDryRun(t *testing.T) {
+	server := fakeDockerAPI(t)
+
+	// The iptables that would be run leaves a trace.
+	bin := t.TempDir()
+	trace := filepath.Join(bin, "iptables.trace")
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "iptables"), []byte("#!/bin/sh\necho \"$@\" >> "+trace+"\n"), 0o700))
+
+	t.Setenv("PATH", bin)
+	t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), []guestagentTypes.ConnectAddrs{
+		{Network: "tcp", Addr: "192.168.0.1/24"},
+	})
+	vtunnelTracker.EnableDryRun()
+
+	eventMonitor, err := docker.NewEventMonitor(vtunnelTracker)
+	require.NoError(t, err)
+	eventMonitor.EnableDryRun()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		eventMonitor.MonitorPorts(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		entries := vtunnelTracker.List()
+
+		return len(entries) == 1 && entries[0].ID == "db"
+	}, 5*time.Second, 10*time.Millisecond, "the events were not tracked")
+
+	cancel()
+	<-done
+
+	eventMonitor.Flush(context.Background())
+	assert.Empty(t, vtunnelTracker.List())
+	assert.Empty(t, vtunnelTracker.Listeners())
+	assert.NoFileExists(t, trace, "iptables was run")
+}
+
+// capturingForwarder records the payloads that it is sent.
+type capturingForwarder struct {
+	mutex    sync.Mutex
+	payloads []guestagentTypes.PortMapping
+}
+
+func (c *capturingForwarder) Send(_ context.Context, portMapping guestagentTypes.PortMapping) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.payloads = append(c.payloads, portMapping)
+
+	return nil
+}
+
+func (c *capturingForwarder) RemovePorts(ctx context.Context, portMappings []guestagentTypes.PortMapping) error {
+	for _, portMapping := range portMappings {
+		_ = c.Send(ctx, portMapping)
+	}
+
+	return nil
+}
+
+func (c *capturingForwarder) sent() []guestagentTypes.PortMapping {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]guestagentTypes.PortMapping(nil), c.payloads...)
+}
+
+// syncBuffer is a bytes.Buffer that the loggers can write to while it is read.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.buffer.Write(p)
+}
+
+// lines returns the JSON log lines that were written so far.
+func (s *syncBuffer) lines(t *testing.T) []map[string]any {
+	t.Helper()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var lines []map[string]any
+
+	scanner := bufio.NewScanner(bytes.NewReader(s.buffer.Bytes()))
+	for scanner.Scan() {
+		var line map[string]any
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// TestEventMonitorCorrelationID checks that the correlation ID of a container
+// start is the same in the log of the event, in the log of the tracker and in
+// the payload that is sent to the host. The package loggers are set, so the
+// test does not run in parallel to the others.
+func TestEventMonitorCorrelationID(t *testing.T) {
+	server := fakeDockerAPI(t)
+	t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+
+	output := &syncBuffer{}
+	logger := logging.New(output, logging.FormatJSON)
+	logger.SetLevel(log.DebugLevel)
+
+	docker.SetLogger(logger.Named("docker"))
+	tracker.SetLogger(logger.Named("tracker"))
+	t.Cleanup(func() {
+		docker.SetLogger(log.Current)
+		tracker.SetLogger(log.Current)
+	})
+
+	capturing := &capturingForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(capturing, []guestagentTypes.ConnectAddrs{
+		{Network: "tcp", Addr: "192.168.0.1/24"},
+	})
+
+	eventMonitor, err := docker.NewEventMonitor(vtunnelTracker)
+	require.NoError(t, err)
+	eventMonitor.EnableDryRun()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		eventMonitor.MonitorPorts(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		entries := vtunnelTracker.List()
+
+		return len(entries) == 1 && entries[0].ID == "db"
+	}, 5*time.Second, 10*time.Millisecond, "the events were not tracked")
+
+	cancel()
+	<-done
+
+	var (
+		eventID, trackerID string
+		ruleFields         map[string]any
+	)
+
+	// The lines of both packages have the canonical fields, see logging.Fields.
+	for _, line := range output.lines(t) {
+		switch {
+		case line["logger"] == "docker" && line["msg"] == "received an event" && line["container"] == "db":
+			eventID, _ = line["correlationID"].(string)
+			assert.Equal(t, tracker.SourceDocker, line["source"])
+		case line["logger"] == "tracker" && line["msg"] == "adding the port mapping" && line["id"] == "db":
+			trackerID, _ = line["correlationID"].(string)
+			assert.Equal(t, tracker.SourceDocker, line["source"])
+		case line["logger"] == "docker" && line["msg"] == "dry run, not adding the iptables rule" && line["port"] == 5432.0:
+			ruleFields = line
+		}
+	}
+
+	require.NotNil(t, ruleFields, "the iptables rule of db was not logged")
+	assert.Equal(t, "tcp", ruleFields["proto"])
+	assert.Equal(t, tracker.SourceDocker, ruleFields["source"])
+
+	require.NotEmpty(t, eventID, "the event was not logged with a correlation ID")
+	assert.Equal(t, eventID, trackerID, "the tracker logged another correlation ID")
+
+	var payloadIDs []string
+
+	for _, payload := range capturing.sent() {
+		if metadata, ok := payload.Metadata["5432/tcp"]; ok && !payload.Remove {
+			payloadIDs = append(payloadIDs, metadata[guestagentTypes.MetadataCorrelationID])
+		}
+	}
+
+	assert.Equal(t, []string{eventID}, payloadIDs, "the payload carries another correlation ID")
+	assert.Equal(t, eventID, vtunnelTracker.List()[0].CorrelationID)
+	assert.Equal(t, &tracker.Origin{Kind: tracker.OriginContainer, ID: "db", Name: "db"}, vtunnelTracker.List()[0].Origin)
+}
+
+// TestEventMonitorRecordReplay checks that the events that are recorded,
+// including the running container that the monitor starts with, are
+// replayed to the same port mappings.
+func TestEventMonitorRecordReplay(t *testing.T) {
+	server := fakeDockerAPI(t)
+	t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), nil)
+	vtunnelTracker.EnableDryRun()
+
+	eventMonitor, err := docker.NewEventMonitor(vtunnelTracker)
+	require.NoError(t, err)
+	eventMonitor.EnableDryRun()
+
+	output := &syncBuffer{}
+	eventMonitor.SetRecorder(recording.NewRecorder(output))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		eventMonitor.MonitorPorts(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		entries := vtunnelTracker.List()
+
+		return len(entries) == 1 && entries[0].ID == "db"
+	}, 5*time.Second, 10*time.Millisecond, "the events were not tracked")
+
+	cancel()
+	<-done
+
+	// The running web, and the start of db and the stop of web.
+	assert.Len(t, output.lines(t), 3)
+
+	replayedTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), nil)
+	replayedTracker.EnableDryRun()
+
+	replayer, err := docker.NewEventMonitor(replayedTracker)
+	require.NoError(t, err)
+	replayer.EnableDryRun()
+
+	err = recording.Replay(context.Background(), &output.buffer, 0, map[string]recording.Handler{
+		tracker.SourceDocker: replayer.Replay,
+	})
+	require.NoError(t, err)
+
+	replayed := replayedTracker.List()
+	require.Len(t, replayed, 1)
+	assert.Equal(t, "db", replayed[0].ID)
+	assert.Equal(t, vtunnelTracker.List()[0].Ports, replayed[0].Ports)
+	assert.Equal(t, vtunnelTracker.List()[0].Origin, replayed[0].Origin)
+}
+
+// TestEventMonitorRecordingForwarder checks that the port mappings of the
+// events are read back from the handlers of the record forwarder, as the
+// integration tests of the agent do with -recordAddr.
+func TestEventMonitorRecordingForwarder(t *testing.T) {
+	server := fakeDockerAPI(t)
+	t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+
+	recordingForwarder, err := forwarder.NewRecordingForwarder(filepath.Join(t.TempDir(), "record.jsonl"))
+	require.NoError(t, err)
+	t.Cleanup(func() { recordingForwarder.Close() })
+	recordingForwarder.EnableInspection()
+
+	mux := http.NewServeMux()
+	recordingForwarder.RegisterHandlers(mux)
+	inspection := httptest.NewServer(mux)
+	t.Cleanup(inspection.Close)
+
+	vtunnelTracker := tracker.NewVTunnelTracker(recordingForwarder, []guestagentTypes.ConnectAddrs{
+		{Network: "tcp", Addr: "192.168.0.1/24"},
+	})
+
+	eventMonitor, err := docker.NewEventMonitor(vtunnelTracker)
+	require.NoError(t, err)
+	eventMonitor.EnableDryRun()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		eventMonitor.MonitorPorts(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		entries := vtunnelTracker.List()
+
+		return len(entries) == 1 && entries[0].ID == "db"
+	}, 5*time.Second, 10*time.Millisecond, "the events were not tracked")
+
+	cancel()
+	<-done
+
+	getSent := func() []guestagentTypes.PortMapping {
+		res, err := http.Get(inspection.URL + "/sent") //nolint:noctx // the server is local.
+		require.NoError(t, err)
+		defer res.Body.Close()
+
+		require.Equal(t, http.StatusOK, res.StatusCode)
+
+		var sent []guestagentTypes.PortMapping
+		require.NoError(t, json.NewDecoder(res.Body).Decode(&sent))
+
+		return sent
+	}
+
+	// The running web is added then removed when it stops, and db is added.
+	var added, removed []nat.Port
+
+	for _, portMapping := range getSent() {
+		for port := range portMapping.Ports {
+			if portMapping.Remove {
+				removed = append(removed, port)
+			} else {
+				added = append(added, port)
+			}
+		}
+	}
+
+	assert.ElementsMatch(t, []nat.Port{"80/tcp", "5432/tcp"}, added)
+	assert.Equal(t, []nat.Port{"80/tcp"}, removed)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodDelete, inspection.URL+"/sent", nil)
+	require.NoError(t, err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNoContent, res.StatusCode)
+
+	assert.Empty(t, getSent())
+}
+
+func TestListPorts(t *testing.T) {
+	server := fakeDockerAPI(t)
+	t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+
+	portMaps, err := docker.ListPorts(context.Background(), false)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]nat.PortMap{
+		"web": {"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}}},
+	}, portMaps)
+
+	server.Close()
+
+	_, err = docker.ListPorts(context.Background(), false)
+	require.Error(t, err)
+}
+
+func TestListPortsKubernetesContainers(t *testing.T) {
+	server := fakeCRIDockerdAPI(t)
+	t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+
+	portMaps, err := docker.ListPorts(context.Background(), false)
+	require.NoError(t, err)
+	assert.Len(t, portMaps, 1)
+	assert.Contains(t, portMaps, "web")
+
+	portMaps, err = docker.ListPorts(context.Background(), true)
+	require.NoError(t, err)
+	assert.Len(t, portMaps, 2)
+	assert.Contains(t, portMaps, "svclb")
+}
+
+// TestEventMonitorKubernetesContainers checks that the containers of the
+// pods are left to the Kubernetes subsystem, both the running ones and the
+// ones that start, unless they are forwarded too; the containers of the user
+// are forwarded regardless of their labels.
+func TestEventMonitorKubernetesContainers(t *testing.T) {
+	for name, test := range map[string]struct {
+		forward bool
+		want    []string
+	}{
+		"skipped":   {want: []string{"db", "web"}},
+		"forwarded": {forward: true, want: []string{"coredns", "db", "svclb", "web"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			server := fakeCRIDockerdAPI(t)
+			t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+
+			vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), []guestagentTypes.ConnectAddrs{
+				{Network: "tcp", Addr: "192.168.0.1/24"},
+			})
+			vtunnelTracker.EnableDryRun()
+
+			eventMonitor, err := docker.NewEventMonitor(vtunnelTracker)
+			require.NoError(t, err)
+			eventMonitor.EnableDryRun()
+
+			if test.forward {
+				eventMonitor.ForwardKubernetesContainers()
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				eventMonitor.MonitorPorts(ctx)
+			}()
+
+			tracked := func() []string {
+				var ids []string
+				for _, entry := range vtunnelTracker.List() {
+					ids = append(ids, entry.ID)
+				}
+
+				slices.Sort(ids)
+
+				return ids
+			}
+
+			// db starts after coredns, so coredns was handled once db is tracked.
+			require.Eventually(t, func() bool {
+				return slices.Contains(tracked(), "db")
+			}, 5*time.Second, 10*time.Millisecond, "the events were not tracked")
+
+			cancel()
+			<-done
+
+			assert.Equal(t, test.want, tracked())
+		})
+	}
+}
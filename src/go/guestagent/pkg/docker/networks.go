@@ -0,0 +1,309 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+const (
+	connectEvent    = "connect"
+	disconnectEvent = "disconnect"
+	destroyEvent    = "destroy"
+	// LabelForwardNetwork is the label of the Docker networks whose containers
+	// have their exposed ports forwarded, see ForwardLabeledNetworks.
+	LabelForwardNetwork = "io.rancherdesktop.forward-network"
+	// networkSuffix suffixes the IDs of the port mappings of the proxied
+	// ports, which are tracked apart from the published ports of the container.
+	networkSuffix = "/network"
+)
+
+// ProxyFunc opens the listeners that relay the port of the target in the VM
+// to the target, that is a container at its address on a network; closing
+// them stops the relay, see loopback.Relay.
+type ProxyFunc func(ctx context.Context, target netip.AddrPort) (io.Closer, error)
+
+// NetworkAddr is the address of a container on a network whose label
+// forwards its exposed ports.
+type NetworkAddr struct {
+	Network string `json:"network"`
+	IP      string `json:"ip"`
+}
+
+// networkProxy is the proxied ports of a container, at its address on its
+// first forwarded network.
+type networkProxy struct {
+	target  netip.Addr
+	ports   []nat.Port
+	closers []io.Closer
+}
+
+// ForwardLabeledNetworks makes the event monitor forward the exposed TCP
+// ports of the containers on the Docker networks that are labeled with
+// LabelForwardNetwork=true, including the ones that are not published:
+// the listeners that proxy opens relay them to the address of the container
+// on its first such network, and they are forwarded to the loopback of the
+// host. The proxies follow the containers as they start, stop, and are
+// connected to and disconnected from the networks.
+func (e *EventMonitor) ForwardLabeledNetworks(proxy ProxyFunc) {
+	e.proxy = proxy
+	e.forwardedNetworks = make(map[string]bool)
+	e.networkProxies = make(map[string]*networkProxy)
+}
+
+// forwarded returns true if the label of the network forwards the ports
+// of its containers. The labels of a network can not change, a network
+// that is created again has another ID, so they are only inspected once.
+func (e *EventMonitor) forwarded(ctx context.Context, networkID string) (bool, error) {
+	if forwarded, ok := e.forwardedNetworks[networkID]; ok {
+		return forwarded, nil
+	}
+
+	resource, err := e.dockerClient.NetworkInspect(ctx, networkID, types.NetworkInspectOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	forwarded, _ := strconv.ParseBool(resource.Labels[LabelForwardNetwork])
+	e.forwardedNetworks[networkID] = forwarded
+
+	return forwarded, nil
+}
+
+// networkAddrs returns the addresses of the container on the networks that
+// forward its ports, in the order of the names of the networks; it returns
+// nil unless the labeled networks are forwarded.
+func (e *EventMonitor) networkAddrs(ctx context.Context, networks map[string]*network.EndpointSettings) []NetworkAddr {
+	if e.proxy == nil {
+		return nil
+	}
+
+	var addrs []NetworkAddr
+
+	for name, settings := range networks {
+		if settings == nil || settings.IPAddress == "" {
+			continue
+		}
+
+		forwarded, err := e.forwarded(ctx, settings.NetworkID)
+		if err != nil {
+			logger.Errorf("failed to inspect the network %s: %v", name, err)
+
+			continue
+		}
+
+		if forwarded {
+			addrs = append(addrs, NetworkAddr{Network: name, IP: settings.IPAddress})
+		}
+	}
+
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Network < addrs[j].Network })
+
+	return addrs
+}
+
+// exposedPorts returns the ports that the container exposes, in order; it
+// returns nil unless the labeled networks are forwarded.
+func (e *EventMonitor) exposedPorts(portSet nat.PortSet) []nat.Port {
+	if e.proxy == nil {
+		return nil
+	}
+
+	ports := make([]nat.Port, 0, len(portSet))
+	for port := range portSet {
+		ports = append(ports, port)
+	}
+
+	nat.Sort(ports, func(i, j nat.Port) bool { return i.Int() < j.Int() || (i.Int() == j.Int() && i.Proto() < j.Proto()) })
+
+	return ports
+}
+
+// listedPorts returns the ports that a listed container exposes, whether
+// they are published or not, see exposedPorts.
+func (e *EventMonitor) listedPorts(ports []types.Port) []nat.Port {
+	portSet := make(nat.PortSet, len(ports))
+
+	for _, port := range ports {
+		if exposed, err := nat.NewPort(port.Type, strconv.Itoa(int(port.PrivatePort))); err == nil {
+			portSet[exposed] = struct{}{}
+		}
+	}
+
+	return e.exposedPorts(portSet)
+}
+
+// proxyNetworks proxies the exposed ports of the container of the event at
+// its address on its first forwarded network, and stops proxying the ones
+// of its previous address, e.g. once it restarted with another address or
+// was disconnected from the network.
+func (e *EventMonitor) proxyNetworks(ctx context.Context, event Event, correlationID string) {
+	if e.proxy == nil {
+		return
+	}
+
+	var (
+		target      netip.Addr
+		networkName string
+		ports       []nat.Port
+	)
+
+	for _, addr := range event.Networks {
+		if ip, err := netip.ParseAddr(addr.IP); err == nil {
+			target, networkName = ip, addr.Network
+
+			break
+		}
+	}
+
+	for _, port := range event.Exposed {
+		if port.Proto() != "tcp" {
+			logger.Debugw("not proxying the exposed port of the forwarded network, only TCP is relayed", logging.Fields(
+				logging.Container(event.ContainerID),
+				logging.PortProtocol(port),
+				logging.Source(tracker.SourceDocker),
+			))
+
+			continue
+		}
+
+		ports = append(ports, port)
+	}
+
+	if !target.IsValid() {
+		ports = nil
+	}
+
+	if proxied := e.networkProxies[event.ContainerID]; proxied != nil {
+		if proxied.target == target && slices.Equal(proxied.ports, ports) {
+			return
+		}
+
+		e.closeNetworkProxy(ctx, event.ContainerID, correlationID)
+	}
+
+	if len(ports) == 0 {
+		return
+	}
+
+	proxied := &networkProxy{target: target, ports: ports}
+	portMap := make(nat.PortMap, len(ports))
+
+	for _, port := range ports {
+		addr := netip.AddrPortFrom(target, uint16(port.Int()))
+		fields := logging.Fields(
+			logging.Container(event.ContainerID),
+			logging.Addr(addr.String()),
+			logging.Source(tracker.SourceDocker),
+			logging.CorrelationID(correlationID),
+		)
+
+		if e.dryRun {
+			logger.Infow("dry run, not proxying the exposed port of the forwarded network", fields)
+		} else {
+			closer, err := e.proxy(ctx, addr)
+			if err != nil {
+				logger.Errorw("failed to proxy the exposed port of the forwarded network", logging.Fields(
+					logging.Container(event.ContainerID),
+					logging.Addr(addr.String()),
+					logging.Source(tracker.SourceDocker),
+					logging.Error(err),
+				))
+
+				continue
+			}
+
+			proxied.closers = append(proxied.closers, closer)
+		}
+
+		portMap[port] = []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: port.Port()}}
+	}
+
+	e.networkProxies[event.ContainerID] = proxied
+
+	if len(portMap) == 0 {
+		return
+	}
+
+	err := e.portTracker.Add(ctx, event.ContainerID+networkSuffix, portMap,
+		tracker.WithSource(tracker.SourceDocker),
+		tracker.WithOrigin(tracker.Origin{Kind: tracker.OriginContainer, ID: event.ContainerID, Name: event.Name}),
+		tracker.WithCorrelationID(correlationID),
+		tracker.WithEventTime(event.eventTime))
+	if err != nil {
+		logger.Errorw("adding the proxied ports of the forwarded network to tracker failed", logging.Fields(
+			logging.Container(event.ContainerID),
+			logging.Source(tracker.SourceDocker),
+			logging.CorrelationID(correlationID),
+			logging.Error(err),
+		))
+
+		return
+	}
+
+	logger.Infow("proxying the exposed ports of the container on the forwarded network", logging.Fields(
+		logging.Container(event.ContainerID),
+		logging.Source(tracker.SourceDocker),
+		logging.CorrelationID(correlationID),
+		log.Fields{"network": networkName, "addr": target.String(), "ports": ports},
+	))
+}
+
+// closeNetworkProxy stops proxying the exposed ports of the container, and removes their port mapping.
+func (e *EventMonitor) closeNetworkProxy(ctx context.Context, containerID, correlationID string) {
+	proxied := e.networkProxies[containerID]
+	if proxied == nil {
+		return
+	}
+
+	delete(e.networkProxies, containerID)
+
+	errs := make([]error, 0, len(proxied.closers))
+	for _, closer := range proxied.closers {
+		errs = append(errs, closer.Close())
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		logger.Debugf("failed to close the proxies of the container %s: %v", containerID, err)
+	}
+
+	if err := e.portTracker.Remove(ctx, containerID+networkSuffix, tracker.WithCorrelationID(correlationID)); err != nil {
+		logger.Errorw("removing the proxied ports of the forwarded network from tracker failed", logging.Fields(
+			logging.Container(containerID),
+			logging.Source(tracker.SourceDocker),
+			logging.CorrelationID(correlationID),
+			logging.Error(err),
+		))
+	}
+}
+
+// closeNetworkProxies stops proxying the exposed ports of all the containers.
+func (e *EventMonitor) closeNetworkProxies(ctx context.Context) {
+	for containerID := range e.networkProxies {
+		e.closeNetworkProxy(ctx, containerID, tracker.NewCorrelationID())
+	}
+}
@@ -0,0 +1,306 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/docker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// forwardedNetworks are the inspected networks: frontend is labeled to
+// forward the ports of its containers, backend is not.
+func forwardedNetworks() map[string]types.NetworkResource {
+	return map[string]types.NetworkResource{
+		"frontend-id": {ID: "frontend-id", Name: "frontend", Labels: map[string]string{docker.LabelForwardNetwork: "true"}},
+		"backend-id":  {ID: "backend-id", Name: "backend", Labels: map[string]string{"com.example.tier": "backend"}},
+	}
+}
+
+// exposingContainer is an inspected container that exposes its ports
+// without publishing them, at its addresses on the networks by their names.
+func exposingContainer(id string, addrs map[string]string, ports ...nat.Port) types.ContainerJSON {
+	exposed := make(nat.PortSet, len(ports))
+	for _, port := range ports {
+		exposed[port] = struct{}{}
+	}
+
+	endpoints := make(map[string]*network.EndpointSettings, len(addrs))
+	for name, ip := range addrs {
+		endpoints[name] = &network.EndpointSettings{NetworkID: name + "-id", IPAddress: ip}
+	}
+
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{ID: id, Name: "/" + id},
+		Config:            &container.Config{ExposedPorts: exposed},
+		NetworkSettings:   &types.NetworkSettings{Networks: endpoints},
+	}
+}
+
+// fakeNetworkAPI serves the networks, and the events; each inspection of a
+// container serves the next of its states, and then the last one, so that
+// a container can restart with another address.
+func fakeNetworkAPI(
+	t *testing.T,
+	networks map[string]types.NetworkResource,
+	inspect map[string][]types.ContainerJSON,
+	messages []events.Message,
+) *httptest.Server {
+	t.Helper()
+
+	var mutex sync.Mutex
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ping", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Api-Version", "1.41")
+	})
+	mux.HandleFunc("GET /{version}/containers/json", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode([]types.Container{})
+	})
+	mux.HandleFunc("GET /{version}/containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		states := inspect[r.PathValue("id")]
+		if len(states) == 0 {
+			http.Error(w, `{"message":"no such container"}`, http.StatusNotFound)
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(states[0])
+		if len(states) > 1 {
+			inspect[r.PathValue("id")] = states[1:]
+		}
+	})
+	mux.HandleFunc("GET /{version}/networks/{id}", func(w http.ResponseWriter, r *http.Request) {
+		resource, ok := networks[r.PathValue("id")]
+		if !ok {
+			http.Error(w, `{"message":"no such network"}`, http.StatusNotFound)
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(resource)
+	})
+	mux.HandleFunc("GET /{version}/events", func(w http.ResponseWriter, r *http.Request) {
+		encoder := json.NewEncoder(w)
+		for _, message := range messages {
+			_ = encoder.Encode(message)
+			w.(http.Flusher).Flush()
+		}
+
+		<-r.Context().Done()
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// recordingProxy records the proxies that are opened and closed, in order.
+type recordingProxy struct {
+	mutex   sync.Mutex
+	history []string
+}
+
+func (r *recordingProxy) proxy(_ context.Context, target netip.AddrPort) (io.Closer, error) {
+	r.record("open " + target.String())
+
+	return closerFunc(func() error {
+		r.record("close " + target.String())
+
+		return nil
+	}), nil
+}
+
+func (r *recordingProxy) record(change string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.history = append(r.history, change)
+}
+
+func (r *recordingProxy) changes() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]string(nil), r.history...)
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+func startMessage(id string) events.Message {
+	return events.Message{Type: events.ContainerEventType, Action: "start", ID: id, Actor: events.Actor{ID: id}}
+}
+
+func stopMessage(id string) events.Message {
+	return events.Message{Type: events.ContainerEventType, Action: "stop", ID: id, Actor: events.Actor{ID: id}}
+}
+
+func networkMessage(action string, networkID, containerID string) events.Message {
+	return events.Message{
+		Type:   events.NetworkEventType,
+		Action: action,
+		ID:     networkID,
+		Actor:  events.Actor{ID: networkID, Attributes: map[string]string{"container": containerID}},
+	}
+}
+
+// TestEventMonitorForwardLabeledNetworks checks that the exposed TCP ports
+// of the containers on the labeled network are proxied at their address on
+// it, and follow them as they restart and are disconnected, while the ones
+// of the containers on the unlabeled network are not. DOCKER_HOST is set,
+// so the test does not run in parallel to the others.
+func TestEventMonitorForwardLabeledNetworks(t *testing.T) {
+	frontend := map[string]string{"frontend": "172.18.0.2"}
+	restarted := map[string]string{"frontend": "172.18.0.3"}
+	backend := map[string]string{"backend": "172.19.0.2"}
+
+	tests := map[string]struct {
+		inspect  map[string][]types.ContainerJSON
+		messages []events.Message
+		// history is the proxies that are opened and closed, in order.
+		history []string
+		// tracked are the mappings that are left in the tracker.
+		tracked map[string]nat.PortMap
+	}{
+		"labeled network": {
+			inspect: map[string][]types.ContainerJSON{
+				"web": {exposingContainer("web", frontend, "80/tcp", "53/udp")},
+			},
+			messages: []events.Message{startMessage("web")},
+			history:  []string{"open 172.18.0.2:80"},
+			tracked: map[string]nat.PortMap{
+				"web/network": {"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "80"}}},
+			},
+		},
+		"unlabeled network": {
+			inspect: map[string][]types.ContainerJSON{
+				"db":  {exposingContainer("db", backend, "5432/tcp")},
+				"web": {exposingContainer("web", frontend, "80/tcp")},
+			},
+			messages: []events.Message{startMessage("db"), startMessage("web")},
+			history:  []string{"open 172.18.0.2:80"},
+			tracked: map[string]nat.PortMap{
+				"web/network": {"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "80"}}},
+			},
+		},
+		"restart with another address": {
+			inspect: map[string][]types.ContainerJSON{
+				"web": {
+					exposingContainer("web", frontend, "80/tcp"),
+					exposingContainer("web", nil, "80/tcp"),
+					exposingContainer("web", restarted, "80/tcp"),
+				},
+			},
+			messages: []events.Message{startMessage("web"), stopMessage("web"), startMessage("web")},
+			history:  []string{"open 172.18.0.2:80", "close 172.18.0.2:80", "open 172.18.0.3:80"},
+			tracked: map[string]nat.PortMap{
+				"web/network": {"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "80"}}},
+			},
+		},
+		"connect and disconnect": {
+			inspect: map[string][]types.ContainerJSON{
+				"web": {
+					exposingContainer("web", backend, "80/tcp"),
+					exposingContainer("web", map[string]string{"backend": "172.19.0.2", "frontend": "172.18.0.2"}, "80/tcp"),
+					exposingContainer("web", backend, "80/tcp"),
+				},
+			},
+			messages: []events.Message{
+				startMessage("web"),
+				networkMessage("connect", "frontend-id", "web"),
+				networkMessage("disconnect", "frontend-id", "web"),
+				networkMessage("destroy", "frontend-id", ""),
+			},
+			history: []string{"open 172.18.0.2:80", "close 172.18.0.2:80"},
+		},
+		"stop": {
+			inspect: map[string][]types.ContainerJSON{
+				"web": {exposingContainer("web", frontend, "80/tcp")},
+			},
+			messages: []events.Message{startMessage("web"), stopMessage("web")},
+			history:  []string{"open 172.18.0.2:80", "close 172.18.0.2:80"},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			server := fakeNetworkAPI(t, forwardedNetworks(), tt.inspect, tt.messages)
+			t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+
+			vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), nil)
+			vtunnelTracker.EnableDryRun()
+
+			proxy := &recordingProxy{}
+			eventMonitor, err := docker.NewEventMonitor(vtunnelTracker)
+			require.NoError(t, err)
+			eventMonitor.ForwardLabeledNetworks(proxy.proxy)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+				eventMonitor.MonitorPorts(ctx)
+			}()
+
+			require.Eventually(t, func() bool {
+				return len(proxy.changes()) >= len(tt.history)
+			}, 5*time.Second, 10*time.Millisecond, "the proxies were not changed")
+
+			cancel()
+			<-done
+
+			assert.Equal(t, tt.history, proxy.changes())
+
+			tracked := make(map[string]nat.PortMap)
+			for _, entry := range vtunnelTracker.List() {
+				tracked[entry.ID] = entry.Ports
+			}
+
+			if tt.tracked == nil {
+				assert.Empty(t, tracked)
+			} else {
+				assert.Equal(t, tt.tracked, tracked)
+			}
+
+			eventMonitor.Flush(context.Background())
+			assert.Empty(t, vtunnelTracker.List())
+		})
+	}
+}
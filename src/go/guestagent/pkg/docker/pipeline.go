@@ -0,0 +1,203 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/docker/api/types/events"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// DefaultQueueSize is the number of the events that are held for the
+// processor of MonitorPorts by default, see SetQueueSize.
+const DefaultQueueSize = 1024
+
+// queuedEvent is a message of the event stream as the reader parsed it,
+// before its container is inspected by the processor.
+type queuedEvent struct {
+	messageType events.Type
+	action      string
+	containerID string
+	// networkID is the network of the events of the networks.
+	networkID string
+	// eventTime is taken as the message is read, the time in the queue is
+	// part of the latency; see tracker.WithEventTime.
+	eventTime time.Time
+}
+
+// pipeline is the queue between the reader of the event stream and the
+// processor that inspects the containers and changes their port mappings,
+// so that a slow send to the host does not hold up reading the stream.
+// Once the queue is full, the events are dropped until the processor
+// drained it, and the running containers are scanned again instead.
+type pipeline struct {
+	queue chan queuedEvent
+	// errs holds the error that ended the event stream.
+	errs chan error
+	// overflowed is set from the first event that was dropped until the
+	// processor drained the queue, see drained.
+	overflowed atomic.Bool
+	dropped    atomic.Uint64
+}
+
+func newPipeline(size int) *pipeline {
+	return &pipeline{
+		queue: make(chan queuedEvent, max(size, 1)),
+		errs:  make(chan error, 1),
+	}
+}
+
+// read parses the messages of the event stream into the queue until the
+// context is canceled, or the stream fails, whose error is then sent to errs.
+func (p *pipeline) read(ctx context.Context, msgCh <-chan events.Message, errCh <-chan error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case message := <-msgCh:
+			// The rules of the ports of the container are about to change, see tracker.Nudger.
+			tracker.Nudge(ctx)
+
+			p.push(parseMessage(message))
+		case err := <-errCh:
+			p.errs <- err
+
+			return
+		}
+	}
+}
+
+// push queues the event, or drops it if the queue is full or was full
+// since it was last drained.
+func (p *pipeline) push(event queuedEvent) {
+	if p.overflowed.Load() {
+		p.dropped.Add(1)
+
+		return
+	}
+
+	select {
+	case p.queue <- event:
+	default:
+		p.overflowed.Store(true)
+		p.dropped.Add(1)
+
+		logger.Warnw("the queue of the events is full, the running containers are scanned once it is drained",
+			logging.Fields(logging.Source(tracker.SourceDocker), log.Fields{"queueSize": cap(p.queue)}))
+	}
+}
+
+// drained returns the number of the events that were dropped once the queue
+// was drained after they were. The overflow is reset before the running
+// containers are scanned, so that the events that are dropped are older
+// than the scan.
+func (p *pipeline) drained() (uint64, bool) {
+	if len(p.queue) != 0 || !p.overflowed.Load() {
+		return 0, false
+	}
+
+	p.overflowed.Store(false)
+
+	return p.dropped.Swap(0), true
+}
+
+// parseMessage returns the event of the message for the queue.
+func parseMessage(message events.Message) queuedEvent {
+	event := queuedEvent{
+		messageType: message.Type,
+		action:      string(message.Action),
+		containerID: message.ID,
+		// The event time is taken before the container is inspected, which is part of the latency.
+		eventTime: tracker.EventTime(time.Unix(0, message.TimeNano)),
+	}
+
+	// The events of the networks name their container in the attributes.
+	if message.Type == events.NetworkEventType {
+		event.networkID = message.Actor.ID
+		event.containerID = message.Actor.Attributes["container"]
+	}
+
+	return event
+}
+
+// reconcile scans the containers after events were dropped, see pipeline:
+// the running ones whose port mappings changed are handled as if they
+// started, the others are left as they are so that their iptables rules are
+// not added twice, and the tracked ones that are no longer running as if
+// they stopped.
+func (e *EventMonitor) reconcile(ctx context.Context, health supervisor.Reporter, dropped uint64) {
+	logger.Infow("scanning the running containers for the dropped events", logging.Fields(
+		logging.Source(tracker.SourceDocker),
+		log.Fields{"dropped": dropped},
+	))
+
+	containers, err := runningContainers(ctx, e.dockerClient)
+	if err != nil {
+		logger.Errorw("scanning the running containers failed, the dropped events are lost", logging.Fields(
+			logging.Source(tracker.SourceDocker),
+			logging.Error(err),
+		))
+		health.Failed(err)
+
+		return
+	}
+
+	running := make(map[string]bool, len(containers))
+
+	for _, container := range containers {
+		// The containers that are not scanned yet must not be taken for stopped.
+		if ctx.Err() != nil {
+			return
+		}
+
+		running[container.ID] = true
+
+		if event, ok := e.listedEvent(ctx, container); ok && !reflect.DeepEqual(e.portTracker.Get(container.ID), event.Ports) {
+			e.receive(ctx, health, event)
+		}
+	}
+
+	stopped := make(map[string]bool)
+
+	for _, entry := range e.portTracker.List() {
+		if containerID := ContainerID(entry.ID); entry.Source == tracker.SourceDocker && !running[containerID] {
+			stopped[containerID] = true
+		}
+	}
+
+	for containerID := range e.networkProxies {
+		if !running[containerID] {
+			stopped[containerID] = true
+		}
+	}
+
+	containerIDs := make([]string, 0, len(stopped))
+	for containerID := range stopped {
+		containerIDs = append(containerIDs, containerID)
+	}
+
+	sort.Strings(containerIDs)
+
+	for _, containerID := range containerIDs {
+		e.receive(ctx, health, Event{Action: stopEvent, ContainerID: containerID, eventTime: time.Now()})
+	}
+}
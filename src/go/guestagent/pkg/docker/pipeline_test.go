@@ -0,0 +1,286 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package docker_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/docker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	guestagentTypes "github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const burstSize = 500
+
+// fakeBurstAPI serves a running container, old, and a burst of the events of
+// burstSize containers that start, followed by the stop of old. The
+// containers are listed as running from the second list on, which is the
+// scan that follows the dropped events; the lists are counted.
+func fakeBurstAPI(t *testing.T, lists *atomic.Int32) *httptest.Server {
+	t.Helper()
+
+	inspect := make(map[string]types.ContainerJSON, burstSize)
+	running := make([]types.Container, 0, burstSize)
+	messages := make([]events.Message, 0, burstSize+1)
+
+	for i := range burstSize {
+		id := fmt.Sprintf("c%d", i)
+		hostPort := 10000 + i
+
+		inspect[id] = containerJSON(id, "172.17.0.2", "80/tcp", strconv.Itoa(hostPort))
+		running = append(running, runningContainer(id, "172.17.0.2", 80, uint16(hostPort), nil))
+		messages = append(messages, events.Message{Type: events.ContainerEventType, Action: "start", ID: id, Actor: events.Actor{ID: id}})
+	}
+
+	messages = append(messages, events.Message{Type: events.ContainerEventType, Action: "stop", ID: "old", Actor: events.Actor{ID: "old"}})
+	inspect["old"] = containerJSON("old", "172.17.0.3", "80/tcp", "8080")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ping", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Api-Version", "1.41")
+	})
+	mux.HandleFunc("GET /{version}/containers/json", func(w http.ResponseWriter, _ *http.Request) {
+		if lists.Add(1) == 1 {
+			_ = json.NewEncoder(w).Encode([]types.Container{runningContainer("old", "172.17.0.3", 80, 8080, nil)})
+
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(running)
+	})
+	mux.HandleFunc("GET /{version}/containers/{id}/json", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(inspect[r.PathValue("id")])
+	})
+	mux.HandleFunc("GET /{version}/events", func(w http.ResponseWriter, r *http.Request) {
+		encoder := json.NewEncoder(w)
+		for _, message := range messages {
+			_ = encoder.Encode(message)
+		}
+		w.(http.Flusher).Flush()
+
+		<-r.Context().Done()
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// slowForwarder is a capturingForwarder whose sends take delay, and once the
+// first one was sent, wait for gate to be closed, if it is set.
+type slowForwarder struct {
+	capturingForwarder
+	delay time.Duration
+	gate  chan struct{}
+	sends atomic.Int32
+}
+
+func (s *slowForwarder) Send(ctx context.Context, portMapping guestagentTypes.PortMapping) error {
+	if s.sends.Add(1) > 1 && s.gate != nil {
+		<-s.gate
+	}
+
+	time.Sleep(s.delay)
+
+	return s.capturingForwarder.Send(ctx, portMapping)
+}
+
+func (s *slowForwarder) RemovePorts(ctx context.Context, portMappings []guestagentTypes.PortMapping) error {
+	for _, portMapping := range portMappings {
+		_ = s.Send(ctx, portMapping)
+	}
+
+	return nil
+}
+
+// blockingForwarder blocks the sends until their context is done, it closes
+// sending once the first one started.
+type blockingForwarder struct {
+	sending chan struct{}
+	once    sync.Once
+}
+
+func (b *blockingForwarder) Send(ctx context.Context, _ guestagentTypes.PortMapping) error {
+	b.once.Do(func() { close(b.sending) })
+	<-ctx.Done()
+
+	return ctx.Err()
+}
+
+func (b *blockingForwarder) RemovePorts(ctx context.Context, _ []guestagentTypes.PortMapping) error {
+	return b.Send(ctx, guestagentTypes.PortMapping{})
+}
+
+// trackedBurst returns true once the containers of the burst are tracked, and old is not anymore.
+func trackedBurst(portTracker tracker.Tracker) bool {
+	entries := portTracker.List()
+	if len(entries) != burstSize {
+		return false
+	}
+
+	for _, entry := range entries {
+		if entry.ID == "old" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// TestEventMonitorSlowForwarder checks that the events of a burst are all
+// handled while the host is slow to be sent their port mappings.
+func TestEventMonitorSlowForwarder(t *testing.T) {
+	var lists atomic.Int32
+
+	server := fakeBurstAPI(t, &lists)
+	t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+
+	slow := &slowForwarder{delay: time.Millisecond}
+	vtunnelTracker := tracker.NewVTunnelTracker(slow, []guestagentTypes.ConnectAddrs{
+		{Network: "tcp", Addr: "192.168.0.1/24"},
+	})
+
+	eventMonitor, err := docker.NewEventMonitor(vtunnelTracker)
+	require.NoError(t, err)
+	eventMonitor.EnableDryRun()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		eventMonitor.MonitorPorts(ctx)
+	}()
+
+	require.Eventually(t, func() bool { return trackedBurst(vtunnelTracker) }, 30*time.Second, 10*time.Millisecond,
+		"the events of the burst were not all tracked")
+
+	cancel()
+	<-done
+
+	// The queue held the burst, the containers were not scanned again.
+	assert.Equal(t, int32(1), lists.Load())
+}
+
+// TestEventMonitorCancelled checks that the monitor returns promptly once its
+// context is cancelled while the port mapping of a container is being sent.
+func TestEventMonitorCancelled(t *testing.T) {
+	server := fakeDockerAPI(t)
+	t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+
+	blocking := &blockingForwarder{sending: make(chan struct{})}
+	vtunnelTracker := tracker.NewVTunnelTracker(blocking, []guestagentTypes.ConnectAddrs{
+		{Network: "tcp", Addr: "192.168.0.1/24"},
+	})
+
+	eventMonitor, err := docker.NewEventMonitor(vtunnelTracker)
+	require.NoError(t, err)
+	eventMonitor.EnableDryRun()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		eventMonitor.MonitorPorts(ctx)
+	}()
+
+	<-blocking.sending
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("the monitor did not return once its context was cancelled")
+	}
+}
+
+// TestEventMonitorQueueOverflow checks that the events that are dropped from
+// the full queue are made up for by scanning the running containers once it
+// was drained. The package logger is set, so the test does not run in parallel.
+func TestEventMonitorQueueOverflow(t *testing.T) {
+	var lists atomic.Int32
+
+	server := fakeBurstAPI(t, &lists)
+	t.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+
+	output := &syncBuffer{}
+	logger := logging.New(output, logging.FormatJSON)
+	logger.SetLevel(log.InfoLevel)
+
+	docker.SetLogger(logger.Named("docker"))
+	t.Cleanup(func() {
+		docker.SetLogger(log.Current)
+	})
+
+	// The sends block once old was sent, until the queue overflowed.
+	slow := &slowForwarder{gate: make(chan struct{})}
+	vtunnelTracker := tracker.NewVTunnelTracker(slow, []guestagentTypes.ConnectAddrs{
+		{Network: "tcp", Addr: "192.168.0.1/24"},
+	})
+
+	eventMonitor, err := docker.NewEventMonitor(vtunnelTracker)
+	require.NoError(t, err)
+	eventMonitor.EnableDryRun()
+	eventMonitor.SetQueueSize(10)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		eventMonitor.MonitorPorts(ctx)
+	}()
+
+	logged := func(message string) func() bool {
+		return func() bool {
+			for _, line := range output.lines(t) {
+				if line["msg"] == message {
+					return true
+				}
+			}
+
+			return false
+		}
+	}
+
+	require.Eventually(t, logged("the queue of the events is full, the running containers are scanned once it is drained"),
+		5*time.Second, time.Millisecond)
+	close(slow.gate)
+
+	require.Eventually(t, func() bool { return trackedBurst(vtunnelTracker) }, 30*time.Second, 10*time.Millisecond,
+		"the dropped events were not made up for")
+	assert.Condition(t, logged("scanning the running containers for the dropped events"))
+
+	cancel()
+	<-done
+
+	assert.Equal(t, int32(2), lists.Load())
+}
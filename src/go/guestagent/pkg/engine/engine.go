@@ -0,0 +1,130 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package engine waits for the APIs of the container engines to be served,
+// since they can start long after the agent, e.g. when dockerd is started by hand.
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/waitfor"
+)
+
+// initialInterval is the longest delay after the first check. The delays are
+// random, half of the longest one on average, so that the agents of the VMs
+// that started together do not check in step.
+const initialInterval = 500 * time.Millisecond
+
+// ErrNotReady is returned by Wait when the API was not served within the timeout.
+var ErrNotReady = errors.New("container engine API is not ready")
+
+// Waiter waits for the API of a container engine, see Wait.
+type Waiter struct {
+	socketFile string
+	interval   time.Duration
+	timeout    time.Duration
+	limiter    *logging.Limiter
+	mutex      sync.Mutex
+	gaveUp     bool
+	// now is the clock of the timeout, see SetClock.
+	now func() time.Time
+}
+
+// NewWaiter creates a waiter for the API that is served on the socket file.
+// It is checked at least every interval, and Wait gives up after timeout, unless it
+// is 0 to wait for as long as it takes.
+func NewWaiter(socketFile string, interval, timeout time.Duration) *Waiter {
+	return &Waiter{
+		socketFile: socketFile,
+		interval:   interval,
+		timeout:    timeout,
+		limiter:    logging.NewLimiter(0),
+		now:        time.Now,
+	}
+}
+
+// SetClock replaces the clock that the timeout is measured with, e.g. with
+// a fake one whose jumps are not counted, see resume.Awake.
+func (w *Waiter) SetClock(now func() time.Time) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.now = now
+}
+
+// Wait waits for the API to be ready, which is once verify succeeds, e.g.
+// with the version of the engine. It checks it right away and then with a
+// backoff that grows up to interval, until the timeout, see
+// waitfor.WaitForSocket. Once it gave up, the later calls only check it
+// once, so that the subsystem keeps being retried slowly by the backoff of
+// its supervisor instead of being abandoned, and it stops giving up once the
+// API was ready.
+func (w *Waiter) Wait(ctx context.Context, verify func(ctx context.Context) error) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	probe := func(ctx context.Context) error {
+		if err := verify(ctx); err != nil {
+			w.limiter.Errorf(log.Current, "container engine is not ready yet: %v", err)
+
+			return err
+		}
+
+		return nil
+	}
+
+	if w.gaveUp {
+		_, err := os.Stat(w.socketFile)
+		if err == nil {
+			err = probe(ctx)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%w at %s: %w", ErrNotReady, w.socketFile, err)
+		}
+
+		w.limiter.Reset(log.Current)
+		w.gaveUp = false
+
+		return nil
+	}
+
+	// The timeout is the time that the agent was awake, so that the VM
+	// being paused while the host slept does not make it expire at once.
+	err := waitfor.WaitForSocket(ctx, w.socketFile, probe, waitfor.Options{
+		Name:            "container engine",
+		InitialInterval: initialInterval,
+		MaxInterval:     w.interval,
+		Timeout:         w.timeout,
+		Now:             w.now,
+	})
+	if errors.Is(err, waitfor.ErrTimeout) {
+		w.gaveUp = true
+
+		return fmt.Errorf("%w: %w", ErrNotReady, err)
+	}
+
+	if err == nil {
+		w.limiter.Reset(log.Current)
+	}
+
+	return err
+}
@@ -0,0 +1,154 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package engine_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/engine"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errNotServing = errors.New("not serving")
+
+// fakeAPI is the API of a container engine that is served once ready is set.
+type fakeAPI struct {
+	socketFile string
+	ready      atomic.Bool
+	checks     atomic.Int32
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	t.Helper()
+
+	socketFile := filepath.Join(t.TempDir(), "engine.sock")
+	require.NoError(t, os.WriteFile(socketFile, nil, 0o600))
+
+	return &fakeAPI{socketFile: socketFile}
+}
+
+func (f *fakeAPI) verify(context.Context) error {
+	f.checks.Add(1)
+
+	if !f.ready.Load() {
+		return errNotServing
+	}
+
+	return nil
+}
+
+func TestWaiterImmediate(t *testing.T) {
+	t.Parallel()
+
+	api := newFakeAPI(t)
+	api.ready.Store(true)
+
+	// The API is checked right away, rather than after the first interval.
+	waiter := engine.NewWaiter(api.socketFile, time.Hour, time.Hour)
+
+	require.NoError(t, waiter.Wait(context.Background(), api.verify))
+	assert.Equal(t, int32(1), api.checks.Load())
+}
+
+func TestWaiterDelayed(t *testing.T) {
+	t.Parallel()
+
+	api := newFakeAPI(t)
+	socketFile := filepath.Join(t.TempDir(), "missing.sock")
+	waiter := engine.NewWaiter(socketFile, time.Millisecond, 0)
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		// The socket is created before the API is served.
+		_ = os.Rename(api.socketFile, socketFile)
+		time.Sleep(20 * time.Millisecond)
+		api.ready.Store(true)
+	}()
+
+	// A timeout of 0 waits for as long as it takes.
+	require.NoError(t, waiter.Wait(context.Background(), api.verify))
+	assert.Greater(t, api.checks.Load(), int32(1))
+}
+
+func TestWaiterSlowRetry(t *testing.T) {
+	t.Parallel()
+
+	api := newFakeAPI(t)
+	waiter := engine.NewWaiter(api.socketFile, time.Millisecond, 20*time.Millisecond)
+
+	err := waiter.Wait(context.Background(), api.verify)
+	require.ErrorIs(t, err, engine.ErrNotReady)
+	require.ErrorIs(t, err, errNotServing)
+
+	// Once it gave up, the API is only checked once per call.
+	checks := api.checks.Load()
+
+	require.ErrorIs(t, waiter.Wait(context.Background(), api.verify), engine.ErrNotReady)
+	assert.Equal(t, checks+1, api.checks.Load())
+
+	api.ready.Store(true)
+	require.NoError(t, waiter.Wait(context.Background(), api.verify))
+
+	// It waits for the timeout again once the API was ready.
+	api.ready.Store(false)
+
+	checks = api.checks.Load()
+
+	require.ErrorIs(t, waiter.Wait(context.Background(), api.verify), engine.ErrNotReady)
+	assert.Greater(t, api.checks.Load(), checks+1)
+}
+
+func TestWaiterCancelled(t *testing.T) {
+	t.Parallel()
+
+	api := newFakeAPI(t)
+	waiter := engine.NewWaiter(api.socketFile, time.Millisecond, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := waiter.Wait(ctx, api.verify)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotErrorIs(t, err, engine.ErrNotReady)
+}
+
+func TestWaiterClockJump(t *testing.T) {
+	t.Parallel()
+
+	api := newFakeAPI(t)
+	waiter := engine.NewWaiter(api.socketFile, time.Millisecond, 200*time.Millisecond)
+
+	// The clock jumps 2 hours ahead while it waits, like it does once the VM
+	// was paused while the host slept; only the time that it was awake counts
+	// toward the timeout.
+	var jump atomic.Int64
+
+	waiter.SetClock(func() time.Time { return time.Now().Add(time.Duration(jump.Load())) })
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		jump.Store(int64(2 * time.Hour))
+		time.Sleep(50 * time.Millisecond)
+		api.ready.Store(true)
+	}()
+
+	require.NoError(t, waiter.Wait(context.Background(), api.verify))
+}
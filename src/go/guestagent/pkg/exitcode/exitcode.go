@@ -0,0 +1,107 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package exitcode classifies the errors that the agent exits with, so that
+// the init scripts and the host can tell a misconfiguration from a missing
+// privilege or an unreachable host by the exit code alone.
+package exitcode
+
+import (
+	"errors"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/capabilities"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/platform"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// The exit codes of the agent, besides 0 for a clean shutdown.
+const (
+	// Failure is used for the failures that are not classified.
+	Failure = 1
+	// Config is used when the flags, the environment or the configuration file are invalid.
+	Config = 2
+	// ShutdownTimeout is used when the subsystems did not stop, or the
+	// port mappings were not withdrawn, within the shutdown timeout.
+	ShutdownTimeout = 3
+	// Forced is used when the agent was signalled again during the shutdown.
+	Forced = 4
+	// Privilege is used when the agent lacks the capabilities of its enabled subsystems.
+	Privilege = 5
+	// Unreachable is used when the forwarder could not reach the host at startup.
+	Unreachable = 6
+	// SubsystemFailed is used when a subsystem failed permanently, see supervisor.Permanent.
+	SubsystemFailed = 7
+)
+
+// The classes of the failures that have no sentinel error of their own, the
+// errors are wrapped with them where they originate.
+var (
+	ErrConfig      = errors.New("invalid configuration")
+	ErrPrivilege   = errors.New("insufficient privileges")
+	ErrUnreachable = errors.New("the host is unreachable")
+)
+
+// classes map the errors to their exit code, the first one that matches wins:
+// a subsystem that failed permanently on an invalid configuration is reported
+// as a failed subsystem, since the agent had started.
+var classes = []struct { //nolint:gochecknoglobals
+	errs []error
+	code int
+}{
+	{errs: []error{supervisor.ErrPermanent}, code: SubsystemFailed},
+	{errs: []error{tracker.ErrShutdownTimeout}, code: ShutdownTimeout},
+	{errs: []error{ErrPrivilege, capabilities.ErrMissing}, code: Privilege},
+	{errs: []error{ErrUnreachable}, code: Unreachable},
+	{
+		errs: []error{
+			ErrConfig,
+			config.ErrInvalidConfig,
+			config.ErrInvalidEnv,
+			config.ErrInvalidAddr,
+			config.ErrInvalidPrintFormat,
+			forwarder.ErrUnknownKind,
+			forwarder.ErrInvalidConfig,
+			forwarder.ErrInvalidPeerAddr,
+			logging.ErrInvalidFormat,
+			logging.ErrInvalidLevel,
+			logging.ErrUnknownLogger,
+			platform.ErrUnknownPlatform,
+			tracker.ErrInvalidPortFilter,
+			tracker.ErrInvalidRemapRule,
+			tracker.ErrRemapCollision,
+		},
+		code: Config,
+	},
+}
+
+// Of returns the exit code of the error, 0 for nil and Failure for the
+// errors that are not classified.
+func Of(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	for _, class := range classes {
+		for _, classErr := range class.errs {
+			if errors.Is(err, classErr) {
+				return class.code
+			}
+		}
+	}
+
+	return Failure
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package exitcode_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/capabilities"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/exitcode"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/pidfile"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/platform"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOf(t *testing.T) {
+	t.Parallel()
+
+	missing := capabilities.Check(func() (capabilities.Set, error) { return 0, nil }, capabilities.Required(capabilities.Subsystems{
+		Iptables: true,
+	}))
+
+	_, portFilterErr := tracker.ParsePortFilter("http", "")
+
+	for name, test := range map[string]struct {
+		err  error
+		code int
+	}{
+		"nil":            {err: nil, code: 0},
+		"unclassified":   {err: errors.New("no space left on device"), code: exitcode.Failure},
+		"running":        {err: fmt.Errorf("refusing to start: %w", pidfile.ErrRunning), code: exitcode.Failure},
+		"flags":          {err: fmt.Errorf("%w: -sendRate requires a positive -batchWindow", exitcode.ErrConfig), code: exitcode.Config},
+		"file":           {err: fmt.Errorf("%w: line 1", config.ErrInvalidConfig), code: exitcode.Config},
+		"env":            {err: fmt.Errorf("%w RD_GUESTAGENT_DEBUG", config.ErrInvalidEnv), code: exitcode.Config},
+		"platform":       {err: fmt.Errorf("invalid -platform: %w \"wsl2\"", platform.ErrUnknownPlatform), code: exitcode.Config},
+		"peer":           {err: fmt.Errorf("failed to create the forwarder: %w", forwarder.ErrInvalidPeerAddr), code: exitcode.Config},
+		"port filter":    {err: portFilterErr, code: exitcode.Config},
+		"capabilities":   {err: fmt.Errorf("refusing to start: %w", missing), code: exitcode.Privilege},
+		"unreachable":    {err: fmt.Errorf("%w: connection refused", exitcode.ErrUnreachable), code: exitcode.Unreachable},
+		"shutdown":       {err: fmt.Errorf("removing the ports: %w", tracker.ErrShutdownTimeout), code: exitcode.ShutdownTimeout},
+		"permanent":      {err: supervisor.Permanent(errors.New("broken")), code: exitcode.SubsystemFailed},
+		"permanent file": {err: supervisor.Permanent(config.ErrInvalidConfig), code: exitcode.SubsystemFailed},
+	} {
+		assert.Equal(t, test.code, exitcode.Of(test.err), name)
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// KindAuto selects the first of the forwarders whose peer answers, see Probe.
+const KindAuto = "auto"
+
+// DefaultProbeTimeout bounds each of the probes of Probe.
+const DefaultProbeTimeout = time.Second
+
+var (
+	ErrNoAnswer     = errors.New("the peer did not answer")
+	ErrNotProbeable = errors.New("forwarder can not be probed")
+)
+
+// ProbeResult is the outcome of probing a forwarder, Error is empty when its peer answered.
+type ProbeResult struct {
+	Kind  string `json:"kind"`
+	Error string `json:"error,omitempty"`
+}
+
+// Selection is the forwarder that the agent selected, along with the
+// results of the probes when it was selected with KindAuto.
+type Selection struct {
+	Kind   string        `json:"kind"`
+	Probes []ProbeResult `json:"probes,omitempty"`
+}
+
+// Detected returns true if the forwarder was selected since its peer answered a probe.
+func (s Selection) Detected() bool {
+	return len(s.Probes) != 0 && s.Probes[len(s.Probes)-1].Error == ""
+}
+
+// prober is a forwarder whose peer can be probed, the probe fails if the
+// peer does not answer.
+type prober interface {
+	probe(ctx context.Context) error
+}
+
+// Probe tries the forwarders of the given kinds in order, and returns the
+// first one whose peer answers a handshake within the timeout along with the
+// results of the probes: the vtunnel based ones send a Hello, which the peers
+// that speak the legacy protocol do not answer, and the host-switch one lists
+// the exposed ports. The kind is empty if none of them answered. The probes
+// only connect to the peers, nothing is sent to them that they keep.
+func Probe(ctx context.Context, kinds []string, addr string, options Options, timeout time.Duration) (string, []ProbeResult) {
+	results := make([]ProbeResult, 0, len(kinds))
+
+	for _, kind := range kinds {
+		err := probeKind(ctx, kind, addr, options, timeout)
+		if err == nil {
+			logger.Debugf("the peer of the %s forwarder answered the probe", kind)
+
+			return kind, append(results, ProbeResult{Kind: kind})
+		}
+
+		logger.Debugf("the peer of the %s forwarder did not answer the probe: %v", kind, err)
+
+		results = append(results, ProbeResult{Kind: kind, Error: err.Error()})
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return "", results
+}
+
+func probeKind(ctx context.Context, kind, addr string, options Options, timeout time.Duration) error {
+	if err := checkTLS(kind, options); err != nil {
+		return err
+	}
+
+	forwarder, err := newProber(kind, addr, options)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	return forwarder.probe(ctx)
+}
+
+// newProber creates the forwarder of the kind without logging it, only the
+// part of the hvsock forwarder that dials the Hyper-V socket is probed since
+// its fallback is the vtunnel forwarder.
+func newProber(kind, addr string, options Options) (prober, error) {
+	switch kind {
+	case KindVTunnel:
+		return newVTunnelFromConfig(addr, options)
+	case KindVsock:
+		if err := options.Vsock.validate(); err != nil {
+			return nil, err
+		}
+
+		return newVsockTunnel(uint32(options.Vsock.CID), uint32(options.Vsock.Port)), nil
+	case KindHvsock:
+		port, err := ParseHvsockService(options.Hvsock.Service)
+		if err != nil {
+			return nil, err
+		}
+
+		return newVsockTunnel(unix.VMADDR_CID_HOST, port), nil
+	case KindHostSwitch:
+		if err := options.HostSwitch.validate(); err != nil {
+			return nil, err
+		}
+
+		return NewHostSwitchForwarder(options.HostSwitch.URL), nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrNotProbeable, kind)
+}
+
+// probe negotiates the protocol with the peer, which must answer the Hello.
+func (v *VTunnelForwarder) probe(ctx context.Context) error {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	if _, err := v.negotiate(ctx); err != nil {
+		return err
+	}
+
+	if v.protocolVersion == 0 {
+		return fmt.Errorf("%w: no answer to the Hello from %s", ErrNoAnswer, v.peers[v.active].address)
+	}
+
+	return nil
+}
+
+// probe lists the ports that the host-switch exposes.
+func (h *HostSwitchForwarder) probe(ctx context.Context) error {
+	_, err := h.all(ctx)
+
+	return err
+}
@@ -0,0 +1,164 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// closedAddr returns an address that refuses the connections.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+
+	return addr
+}
+
+func TestProbe(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	legacyPeer := newTestPeer(t, 0)
+	legacyPeer.setLegacy(true, false)
+
+	_, hostSwitch := newTestHostSwitch(t)
+
+	stalled := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(stalled.Close)
+
+	tests := map[string]struct {
+		kinds    []string
+		addr     string
+		options  forwarder.Options
+		expected string
+		// failed are parts of the errors of the probes that failed, in order.
+		failed []string
+	}{
+		"the first one answers": {
+			kinds:    []string{forwarder.KindVTunnel, forwarder.KindHostSwitch},
+			addr:     peer.listener.Addr().String(),
+			options:  forwarder.Options{HostSwitch: forwarder.HostSwitchOptions{URL: hostSwitch.URL}},
+			expected: forwarder.KindVTunnel,
+		},
+		"the peer refuses the connection": {
+			kinds:    []string{forwarder.KindVTunnel, forwarder.KindHostSwitch},
+			addr:     closedAddr(t),
+			options:  forwarder.Options{HostSwitch: forwarder.HostSwitchOptions{URL: hostSwitch.URL}},
+			expected: forwarder.KindHostSwitch,
+			failed:   []string{"connection refused"},
+		},
+		"the peer does not answer the hello": {
+			kinds:    []string{forwarder.KindVTunnel, forwarder.KindHostSwitch},
+			addr:     legacyPeer.listener.Addr().String(),
+			options:  forwarder.Options{HostSwitch: forwarder.HostSwitchOptions{URL: hostSwitch.URL}},
+			expected: forwarder.KindHostSwitch,
+			failed:   []string{"the peer did not answer"},
+		},
+		"the host-switch does not respond in time": {
+			kinds:   []string{forwarder.KindHostSwitch, forwarder.KindVTunnel},
+			addr:    peer.listener.Addr().String(),
+			options: forwarder.Options{HostSwitch: forwarder.HostSwitchOptions{URL: stalled.URL}},
+			// The timeout of the probe of the host-switch does not carry over to the next one.
+			expected: forwarder.KindVTunnel,
+			failed:   []string{"context deadline exceeded"},
+		},
+		"the hvsock forwarder is not reachable": {
+			kinds:    []string{forwarder.KindHvsock, forwarder.KindVTunnel},
+			addr:     peer.listener.Addr().String(),
+			options:  forwarder.Options{Hvsock: forwarder.HvsockOptions{Service: forwarder.HvsockServiceID(3040)}},
+			expected: forwarder.KindVTunnel,
+			failed:   []string{"vsock"},
+		},
+		"the forwarder is not configured": {
+			kinds:    []string{forwarder.KindVsock, forwarder.KindVTunnel},
+			addr:     peer.listener.Addr().String(),
+			expected: forwarder.KindVTunnel,
+			failed:   []string{"the port must be set"},
+		},
+		"the forwarder does not support TLS": {
+			kinds: []string{forwarder.KindHostSwitch},
+			options: forwarder.Options{
+				HostSwitch: forwarder.HostSwitchOptions{URL: hostSwitch.URL},
+				TLS:        forwarder.TLSOptions{Enabled: true},
+			},
+			failed: []string{"TLS is only supported by the vtunnel forwarder"},
+		},
+		"the forwarder can not be probed": {
+			kinds:  []string{forwarder.KindAPI},
+			failed: []string{"forwarder can not be probed"},
+		},
+		"none answers": {
+			kinds:   []string{forwarder.KindVTunnel, forwarder.KindHostSwitch},
+			addr:    closedAddr(t),
+			options: forwarder.Options{HostSwitch: forwarder.HostSwitchOptions{URL: stalled.URL}},
+			failed:  []string{"connection refused", "context deadline exceeded"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			kind, probes := forwarder.Probe(context.Background(), test.kinds, test.addr, test.options, 200*time.Millisecond)
+			assert.Equal(t, test.expected, kind)
+
+			answered := 0
+			if kind != "" {
+				answered = 1
+			}
+
+			require.Len(t, probes, len(test.failed)+answered)
+
+			for i, failure := range test.failed {
+				assert.Equal(t, test.kinds[i], probes[i].Kind)
+				assert.Contains(t, probes[i].Error, failure)
+			}
+
+			if kind != "" {
+				assert.Equal(t, forwarder.ProbeResult{Kind: kind}, probes[len(probes)-1])
+			}
+
+			assert.Equal(t, kind != "", forwarder.Selection{Kind: kind, Probes: probes}.Detected())
+		})
+	}
+}
+
+func TestProbeCancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	kind, probes := forwarder.Probe(ctx, []string{forwarder.KindVTunnel, forwarder.KindHostSwitch}, closedAddr(t),
+		forwarder.Options{HostSwitch: forwarder.HostSwitchOptions{URL: forwarder.DefaultHostSwitchURL}}, time.Second)
+	assert.Empty(t, kind)
+	require.Len(t, probes, 1, "the probes stop once the context is done")
+	assert.Equal(t, forwarder.KindVTunnel, probes[0].Kind)
+}
@@ -0,0 +1,339 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// The states of the circuit of a BreakerForwarder.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+const (
+	defaultBreakerFailures      = 10
+	defaultBreakerProbeInterval = 10 * time.Second
+)
+
+// ErrCircuitOpen is returned by the BreakerForwarder instead of sending while its circuit is open.
+var ErrCircuitOpen = errors.New("the circuit to the peer is open")
+
+// BreakerOptions configure the BreakerForwarder.
+type BreakerOptions struct {
+	// Failures is the number of consecutive failed sends after which the
+	// circuit opens, 0 disables the breaker.
+	Failures int
+	// ProbeInterval is how long the circuit stays open before it is probed.
+	ProbeInterval time.Duration
+}
+
+// RegisterFlags defines the -breaker flags that set the options.
+func (o *BreakerOptions) RegisterFlags(flags *flag.FlagSet) {
+	flags.IntVar(&o.Failures, "breakerFailures", defaultBreakerFailures,
+		"number of consecutive port mappings that the peer could not be reached for, after which they are no longer "+
+			"sent until it is reachable again and the agent is degraded; used with the peer forwarders, 0 disables it")
+	flags.DurationVar(&o.ProbeInterval, "breakerProbeInterval", defaultBreakerProbeInterval,
+		"amount of time between the attempts to reach the peer again after -breakerFailures")
+}
+
+// BreakerStatus is the state of the circuit of a BreakerForwarder.
+type BreakerStatus struct {
+	// State is BreakerClosed, BreakerOpen or BreakerHalfOpen.
+	State string `json:"state"`
+	// Failures is the number of consecutive failed sends.
+	Failures int `json:"failures"`
+	// Opens is the number of times that the circuit opened.
+	Opens uint64 `json:"opens"`
+	// OpenedAt is when the circuit last opened, it is zero while it is closed.
+	OpenedAt time.Time `json:"openedAt"`
+	// LastError is the error of the last failed send while the circuit is not closed.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// BreakerForwarder wraps a Forwarder with a circuit breaker: once the peer
+// could not be reached for a number of consecutive sends, the circuit opens
+// and the sends fail right away with ErrCircuitOpen, rather than each waiting
+// for the peer and retrying. After the probe interval, the next send or the
+// probe of Run is let through, half-open; the circuit closes once it succeeds,
+// and calls the recovery handler, since the changes in between were not sent.
+// The sends that were cancelled, or that the peer rejected, do not count:
+// the peer was not found unreachable.
+type BreakerForwarder struct {
+	Forwarder
+	options BreakerOptions
+	// Now returns the current time, it is time.Now unless a test sets it.
+	Now func() time.Time
+
+	mutex     sync.Mutex
+	status    BreakerStatus
+	lastError error
+	// probing is set while the half-open send is in flight, the other sends are not let through.
+	probing    bool
+	onRecovery func()
+	probe      func(ctx context.Context) error
+}
+
+// NewBreakerForwarder creates a forwarder that stops sending with the
+// given forwarder while its peer is unreachable, see BreakerForwarder.
+func NewBreakerForwarder(forwarder Forwarder, options BreakerOptions) *BreakerForwarder {
+	return &BreakerForwarder{
+		Forwarder: forwarder,
+		options:   options,
+		Now:       time.Now,
+		status:    BreakerStatus{State: BreakerClosed},
+	}
+}
+
+// SetRecoveryHandler sets the function that is called, in the background,
+// when the circuit closes again; e.g. to send all the port mappings again.
+func (b *BreakerForwarder) SetRecoveryHandler(onRecovery func()) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.onRecovery = onRecovery
+}
+
+// SetProbe sets how Run probes the peer while the circuit is open, e.g. with
+// VTunnelForwarder.Ping; without a probe, only the sends probe the peer.
+func (b *BreakerForwarder) SetProbe(probe func(ctx context.Context) error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probe = probe
+}
+
+// Send forwards the port mappings with the wrapped forwarder, unless the circuit is open.
+func (b *BreakerForwarder) Send(ctx context.Context, portMapping types.PortMapping) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := b.Forwarder.Send(ctx, portMapping)
+	b.record(err)
+
+	return err
+}
+
+// SendWithResults forwards the port mappings with the wrapped forwarder, unless
+// the circuit is open; the results are only returned if it implements ResultForwarder.
+func (b *BreakerForwarder) SendWithResults(ctx context.Context, portMapping types.PortMapping) ([]PortResult, error) {
+	resultForwarder, ok := b.Forwarder.(ResultForwarder)
+	if !ok {
+		return nil, b.Send(ctx, portMapping)
+	}
+
+	if err := b.allow(); err != nil {
+		return nil, err
+	}
+
+	results, err := resultForwarder.SendWithResults(ctx, portMapping)
+	b.record(err)
+
+	return results, err
+}
+
+// RemovePorts withdraws the port mappings with the wrapped forwarder, unless the circuit is open.
+func (b *BreakerForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+
+	err := b.Forwarder.RemovePorts(ctx, portMappings)
+	b.record(err)
+
+	return err
+}
+
+// Unwrap returns the wrapped forwarder.
+func (b *BreakerForwarder) Unwrap() Forwarder {
+	return b.Forwarder
+}
+
+// Status returns the state of the circuit.
+func (b *BreakerForwarder) Status() BreakerStatus {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.status
+}
+
+// Err returns why the peer is not sent to while the circuit is not closed, nil otherwise.
+func (b *BreakerForwarder) Err() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.status.State == BreakerClosed {
+		return nil
+	}
+
+	return fmt.Errorf("%w since %s after %d consecutive failures: %w",
+		ErrCircuitOpen, b.status.OpenedAt.Format(time.RFC3339), b.status.Failures, b.lastError)
+}
+
+// Run probes the peer at every probe interval while the circuit is open,
+// until the context is cancelled; it does nothing without a probe, see SetProbe.
+func (b *BreakerForwarder) Run(ctx context.Context) {
+	b.mutex.Lock()
+	probe := b.probe
+	b.mutex.Unlock()
+
+	if probe == nil || b.options.Failures <= 0 || b.options.ProbeInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(b.options.ProbeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.mutex.Lock()
+			probing := b.startProbe()
+			b.mutex.Unlock()
+
+			if probing {
+				b.record(probe(ctx))
+			}
+		}
+	}
+}
+
+// Collect returns the state of the circuit as metrics.
+func (b *BreakerForwarder) Collect() []metrics.Family {
+	status := b.Status()
+
+	var open float64
+	if status.State != BreakerClosed {
+		open = 1
+	}
+
+	return []metrics.Family{
+		{
+			Name:    metrics.Namespace + "forwarder_circuit_open",
+			Help:    "Whether the port mappings are not sent because the peer could not be reached, see -breakerFailures.",
+			Type:    metrics.TypeGauge,
+			Samples: []metrics.Sample{{Value: open}},
+		},
+		{
+			Name:    metrics.Namespace + "forwarder_circuit_opens_total",
+			Help:    "Number of times that the port mappings stopped being sent because the peer could not be reached.",
+			Type:    metrics.TypeCounter,
+			Samples: []metrics.Sample{{Value: float64(status.Opens)}},
+		},
+	}
+}
+
+// allow returns ErrCircuitOpen unless the send may go through: always while the
+// circuit is closed, and as the half-open probe once the probe interval is over.
+func (b *BreakerForwarder) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.options.Failures <= 0 || b.status.State == BreakerClosed || b.startProbe() {
+		return nil
+	}
+
+	return ErrCircuitOpen
+}
+
+// startProbe makes the circuit half-open if it has been open for the probe
+// interval, and returns true if it did; the mutex must be held.
+func (b *BreakerForwarder) startProbe() bool {
+	if b.status.State != BreakerOpen || b.probing || b.Now().Sub(b.status.OpenedAt) < b.options.ProbeInterval {
+		return false
+	}
+
+	b.probing = true
+	b.status.State = BreakerHalfOpen
+	logger.Debugf("probing whether the peer is reachable again")
+
+	return true
+}
+
+// record counts the consecutive failures, it opens the circuit
+// once there are enough and closes it after a successful send.
+func (b *BreakerForwarder) record(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.options.Failures <= 0 {
+		return
+	}
+
+	halfOpen := b.status.State == BreakerHalfOpen
+	b.probing = false
+
+	switch {
+	case err == nil:
+		if b.status.State != BreakerClosed {
+			logger.Infof("the peer is reachable again, after %d consecutive failures", b.status.Failures)
+
+			if b.onRecovery != nil {
+				go b.onRecovery()
+			}
+		}
+
+		b.status = BreakerStatus{State: BreakerClosed, Opens: b.status.Opens}
+		b.lastError = nil
+	case !countsAsFailure(err):
+		// The probe did not tell whether the peer is reachable, it is let through again.
+		if halfOpen {
+			b.status.State = BreakerOpen
+		}
+	default:
+		b.status.Failures++
+		b.lastError = err
+
+		switch {
+		case halfOpen:
+			logger.Debugf("the peer is still unreachable: %v", err)
+			b.status.State, b.status.OpenedAt = BreakerOpen, b.Now()
+			b.status.LastError = err.Error()
+		case b.status.State == BreakerOpen:
+			// A send that was let through before the circuit opened.
+			b.status.LastError = err.Error()
+		case b.status.Failures >= b.options.Failures:
+			logger.Warnf("the peer could not be reached for %d consecutive sends, the port mappings are no "+
+				"longer sent until it is reachable again, probing it every %s: %v",
+				b.status.Failures, b.options.ProbeInterval, err)
+			b.status.State, b.status.OpenedAt = BreakerOpen, b.Now()
+			b.status.LastError = err.Error()
+			b.status.Opens++
+		}
+	}
+}
+
+// countsAsFailure returns true if the failed send tells that the peer is
+// unreachable; it is not when the send was cancelled or rejected by the peer.
+func countsAsFailure(err error) bool {
+	switch failureCategory(err) {
+	case FailureCancelled, FailureRejected:
+		return false
+	default:
+		return true
+	}
+}
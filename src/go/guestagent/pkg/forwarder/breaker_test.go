@@ -0,0 +1,267 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errRefused = fmt.Errorf("dial vtunnel: %w", syscall.ECONNREFUSED)
+
+// scriptedPeer fails the sends with its errors in turn, and succeeds once they
+// run out; while block is set, every send waits for it to be closed first.
+type scriptedPeer struct {
+	mutex sync.Mutex
+	errs  []error
+	sends int
+	block chan struct{}
+}
+
+func (p *scriptedPeer) Send(_ context.Context, _ types.PortMapping) error {
+	p.mutex.Lock()
+	block := p.block
+	p.mutex.Unlock()
+
+	if block != nil {
+		<-block
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.sends++
+	if len(p.errs) == 0 {
+		return nil
+	}
+
+	err := p.errs[0]
+	p.errs = p.errs[1:]
+
+	return err
+}
+
+func (p *scriptedPeer) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	return p.Send(ctx, forwarder.MergeRemovals(portMappings))
+}
+
+func (p *scriptedPeer) script(errs ...error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.errs = append(p.errs, errs...)
+}
+
+func (p *scriptedPeer) sent() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.sends
+}
+
+// fakeClock is advanced by the tests instead of waiting for the probe interval.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+func newTestBreaker(peer *scriptedPeer, options forwarder.BreakerOptions) (*forwarder.BreakerForwarder, *fakeClock, <-chan struct{}) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	recovered := make(chan struct{}, 10)
+
+	breaker := forwarder.NewBreakerForwarder(peer, options)
+	breaker.Now = clock.Now
+	breaker.SetRecoveryHandler(func() { recovered <- struct{}{} })
+
+	return breaker, clock, recovered
+}
+
+func TestBreakerForwarderTransitions(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	peer := &scriptedPeer{}
+	peer.script(errRefused, errRefused, errRefused)
+	breaker, clock, recovered := newTestBreaker(peer, forwarder.BreakerOptions{Failures: 3, ProbeInterval: time.Minute})
+
+	// The circuit stays closed until the failures are consecutive enough.
+	for range 2 {
+		require.ErrorIs(t, breaker.Send(ctx, types.PortMapping{}), syscall.ECONNREFUSED)
+		assert.Equal(t, forwarder.BreakerClosed, breaker.Status().State)
+	}
+
+	require.NoError(t, breaker.Err())
+
+	require.ErrorIs(t, breaker.Send(ctx, types.PortMapping{}), syscall.ECONNREFUSED)
+	status := breaker.Status()
+	assert.Equal(t, forwarder.BreakerOpen, status.State)
+	assert.Equal(t, 3, status.Failures)
+	assert.Equal(t, uint64(1), status.Opens)
+	assert.Equal(t, clock.Now(), status.OpenedAt)
+	assert.Equal(t, errRefused.Error(), status.LastError)
+
+	err := breaker.Err()
+	require.ErrorIs(t, err, forwarder.ErrCircuitOpen)
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+
+	// The sends no longer reach the peer while the circuit is open.
+	require.ErrorIs(t, breaker.Send(ctx, types.PortMapping{}), forwarder.ErrCircuitOpen)
+	require.ErrorIs(t, breaker.RemovePorts(ctx, []types.PortMapping{{Remove: true}}), forwarder.ErrCircuitOpen)
+	assert.Equal(t, 3, peer.sent())
+
+	// The first send after the probe interval is let through, half-open; it
+	// fails, so the circuit opens again for another probe interval.
+	clock.advance(time.Minute)
+	peer.script(errRefused)
+	require.ErrorIs(t, breaker.Send(ctx, types.PortMapping{}), syscall.ECONNREFUSED)
+	assert.Equal(t, 4, peer.sent())
+
+	status = breaker.Status()
+	assert.Equal(t, forwarder.BreakerOpen, status.State)
+	assert.Equal(t, clock.Now(), status.OpenedAt)
+	assert.Equal(t, uint64(1), status.Opens)
+	require.ErrorIs(t, breaker.Send(ctx, types.PortMapping{}), forwarder.ErrCircuitOpen)
+
+	// Only the probe is let through while it is in flight.
+	clock.advance(time.Minute)
+	block := make(chan struct{})
+	peer.mutex.Lock()
+	peer.block = block
+	peer.mutex.Unlock()
+
+	probed := make(chan error)
+	go func() { probed <- breaker.Send(ctx, types.PortMapping{}) }()
+
+	require.Eventually(t, func() bool {
+		return breaker.Status().State == forwarder.BreakerHalfOpen
+	}, 5*time.Second, time.Millisecond)
+	require.ErrorIs(t, breaker.Send(ctx, types.PortMapping{}), forwarder.ErrCircuitOpen)
+	require.ErrorIs(t, breaker.Err(), forwarder.ErrCircuitOpen)
+
+	// The circuit closes once the peer is reached, and the recovery handler is called.
+	close(block)
+	require.NoError(t, <-probed)
+
+	select {
+	case <-recovered:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the recovery handler was not called")
+	}
+
+	assert.Equal(t, forwarder.BreakerStatus{State: forwarder.BreakerClosed, Opens: 1}, breaker.Status())
+	require.NoError(t, breaker.Err())
+	require.NoError(t, breaker.Send(ctx, types.PortMapping{}))
+	assert.Equal(t, 6, peer.sent())
+}
+
+func TestBreakerForwarderConsecutiveFailures(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	peer := &scriptedPeer{}
+	// A success resets the count, the cancelled and rejected sends are not counted.
+	peer.script(errRefused, errRefused, nil, errRefused, context.Canceled,
+		fmt.Errorf("%w: port 80", forwarder.ErrPortRejected), errRefused)
+	breaker, _, recovered := newTestBreaker(peer, forwarder.BreakerOptions{Failures: 3, ProbeInterval: time.Minute})
+
+	for range 7 {
+		_ = breaker.Send(ctx, types.PortMapping{})
+	}
+
+	status := breaker.Status()
+	assert.Equal(t, forwarder.BreakerClosed, status.State)
+	assert.Equal(t, 2, status.Failures)
+	assert.Empty(t, recovered)
+}
+
+func TestBreakerForwarderDisabled(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	peer := &scriptedPeer{}
+	peer.script(errRefused, errRefused, errRefused, errRefused)
+	breaker, _, _ := newTestBreaker(peer, forwarder.BreakerOptions{ProbeInterval: time.Minute})
+
+	for range 4 {
+		require.ErrorIs(t, breaker.Send(ctx, types.PortMapping{}), syscall.ECONNREFUSED)
+	}
+
+	require.NoError(t, breaker.Send(ctx, types.PortMapping{}))
+	assert.Equal(t, forwarder.BreakerClosed, breaker.Status().State)
+	assert.Equal(t, 5, peer.sent())
+}
+
+func TestBreakerForwarderRun(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	peer := &scriptedPeer{}
+	peer.script(errRefused)
+	recovered := make(chan struct{}, 1)
+	breaker := forwarder.NewBreakerForwarder(peer, forwarder.BreakerOptions{Failures: 1, ProbeInterval: 10 * time.Millisecond})
+	breaker.SetRecoveryHandler(func() { recovered <- struct{}{} })
+
+	// The peer is probed without any sends, it is reached on the third probe.
+	var probes sync.WaitGroup
+	probes.Add(3)
+	probeErrs := []error{errRefused, errors.New("connection reset"), nil}
+	breaker.SetProbe(func(context.Context) error {
+		err := probeErrs[0]
+		probeErrs = probeErrs[1:]
+		probes.Done()
+
+		return err
+	})
+
+	require.ErrorIs(t, breaker.Send(ctx, types.PortMapping{}), syscall.ECONNREFUSED)
+	require.Equal(t, forwarder.BreakerOpen, breaker.Status().State)
+
+	go breaker.Run(ctx)
+
+	select {
+	case <-recovered:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the peer was not probed until it was reached")
+	}
+
+	probes.Wait()
+	assert.Equal(t, forwarder.BreakerClosed, breaker.Status().State)
+	assert.Equal(t, 1, peer.sent())
+}
@@ -0,0 +1,202 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sort"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// RemovePorts withdraws all the port mappings in a single message if the
+// peer supports bulk removals, see types.FeatureBulkRemove; the peers that
+// do not, or that have not responded yet, get one removal per port instead.
+func (v *VTunnelForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	if len(portMappings) == 0 {
+		return nil
+	}
+
+	v.sendMutex.Lock()
+	bulk := slices.Contains(v.features, types.FeatureBulkRemove)
+	v.sendMutex.Unlock()
+
+	if !bulk {
+		return RemoveEach(ctx, v, portMappings)
+	}
+
+	return v.Send(ctx, MergeRemovals(portMappings))
+}
+
+// Batches reports whether the peer applies the port mappings of many
+// containers in a single message, see types.FeatureBatch; the peers that
+// have not responded yet do not.
+func (v *VTunnelForwarder) Batches() bool {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	return slices.Contains(v.features, types.FeatureBatch)
+}
+
+// MergeRemovals merges the port mappings into a single removal, the connect
+// addresses and their families are the ones of the first port mapping and the
+// labels are the ones that all the port mappings share.
+func MergeRemovals(portMappings []types.PortMapping) types.PortMapping {
+	merged := types.PortMapping{
+		Remove: true,
+		Ports:  make(nat.PortMap),
+	}
+
+	for i, portMapping := range portMappings {
+		if merged.ConnectAddrs == nil {
+			merged.ConnectAddrs = portMapping.ConnectAddrs
+			merged.Families = portMapping.Families
+		}
+
+		if i == 0 {
+			merged.Labels = maps.Clone(portMapping.Labels)
+		}
+
+		maps.DeleteFunc(merged.Labels, func(key, value string) bool {
+			label, ok := portMapping.Labels[key]
+
+			return !ok || label != value
+		})
+
+		for port, bindings := range portMapping.Ports {
+			merged.Ports[port] = append(merged.Ports[port], bindings...)
+		}
+
+		for metadataKey, metadata := range portMapping.Metadata {
+			if merged.Metadata == nil {
+				merged.Metadata = make(map[string]map[string]string)
+			}
+
+			merged.Metadata[metadataKey] = metadata
+		}
+
+		for port, protocol := range portMapping.Protocols {
+			if merged.Protocols == nil {
+				merged.Protocols = make(map[nat.Port]string)
+			}
+
+			merged.Protocols[port] = protocol
+		}
+
+		for sourceKey, source := range portMapping.Sources {
+			if merged.Sources == nil {
+				merged.Sources = make(map[string]string)
+			}
+
+			merged.Sources[sourceKey] = source
+		}
+
+		for hostBindKey, hostBindAddr := range portMapping.HostBindAddrs {
+			if merged.HostBindAddrs == nil {
+				merged.HostBindAddrs = make(map[string]string)
+			}
+
+			merged.HostBindAddrs[hostBindKey] = hostBindAddr
+		}
+
+		for seqKey, seq := range portMapping.PortSeqs {
+			if merged.PortSeqs == nil {
+				merged.PortSeqs = make(map[string]uint64)
+			}
+
+			merged.PortSeqs[seqKey] = max(merged.PortSeqs[seqKey], seq)
+		}
+	}
+
+	if len(merged.Labels) == 0 {
+		merged.Labels = nil
+	}
+
+	return merged
+}
+
+// RemoveEach sends one removal per port of the port mappings, for the
+// peers that do not support bulk removals. It carries on after a removal
+// fails, and returns all the errors.
+func RemoveEach(ctx context.Context, forwarder Forwarder, portMappings []types.PortMapping) error {
+	var errs []error
+
+	for _, portMapping := range portMappings {
+		ports := make([]nat.Port, 0, len(portMapping.Ports))
+		for port := range portMapping.Ports {
+			ports = append(ports, port)
+		}
+
+		sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+
+		for _, port := range ports {
+			removal := types.PortMapping{
+				Remove:       true,
+				Ports:        nat.PortMap{port: portMapping.Ports[port]},
+				ConnectAddrs: portMapping.ConnectAddrs,
+				Families:     portMapping.Families,
+				Labels:       portMapping.Labels,
+			}
+
+			if protocol, ok := portMapping.Protocols[port]; ok {
+				removal.Protocols = map[nat.Port]string{port: protocol}
+			}
+
+			for _, binding := range portMapping.Ports[port] {
+				metadataKey := binding.HostPort + "/" + port.Proto()
+				if metadata, ok := portMapping.Metadata[metadataKey]; ok {
+					if removal.Metadata == nil {
+						removal.Metadata = make(map[string]map[string]string)
+					}
+
+					removal.Metadata[metadataKey] = metadata
+				}
+
+				if source, ok := portMapping.Sources[metadataKey]; ok {
+					if removal.Sources == nil {
+						removal.Sources = make(map[string]string)
+					}
+
+					removal.Sources[metadataKey] = source
+				}
+
+				if hostBindAddr, ok := portMapping.HostBindAddrs[metadataKey]; ok {
+					if removal.HostBindAddrs == nil {
+						removal.HostBindAddrs = make(map[string]string)
+					}
+
+					removal.HostBindAddrs[metadataKey] = hostBindAddr
+				}
+
+				if seq, ok := portMapping.PortSeqs[metadataKey]; ok {
+					if removal.PortSeqs == nil {
+						removal.PortSeqs = make(map[string]uint64)
+					}
+
+					removal.PortSeqs[metadataKey] = seq
+				}
+			}
+
+			if err := forwarder.Send(ctx, removal); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVTunnelForwarderRemovePortsBulk(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setFeatures(types.FeatureBulkRemove)
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(peer.listener.Addr().String())
+
+	// The features are only known once the peer has responded.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp", "443/tcp")))
+	peer.receive(t)
+
+	err := vtunnelForwarder.RemovePorts(context.Background(), []types.PortMapping{
+		testPortMapping(true, "80/tcp"),
+		testPortMapping(true, "443/tcp"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, testPortMapping(true, "80/tcp", "443/tcp"), peer.receive(t))
+
+	select {
+	case portMapping := <-peer.portMaps:
+		t.Fatalf("unexpected port mapping after the bulk removal: %+v", portMapping)
+	default:
+	}
+}
+
+func TestVTunnelForwarderRemovePortsFallback(t *testing.T) {
+	t.Parallel()
+
+	// The peer does not answer the hello, like the older versions of the privileged service.
+	peer := newTestPeer(t, 0)
+	peer.setLegacy(true, false)
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(peer.listener.Addr().String())
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp", "443/tcp")))
+	peer.receive(t)
+
+	err := vtunnelForwarder.RemovePorts(context.Background(), []types.PortMapping{
+		testPortMapping(true, "80/tcp", "443/tcp"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, testPortMapping(true, "443/tcp"), peer.receive(t))
+	assert.Equal(t, testPortMapping(true, "80/tcp"), peer.receive(t))
+}
+
+func TestVTunnelForwarderRemovePortsFallbackErrors(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setAcknowledge(true, map[string]string{"80": "port is in use"})
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(peer.listener.Addr().String())
+
+	// The removals carry on after one of them fails.
+	err := vtunnelForwarder.RemovePorts(context.Background(), []types.PortMapping{
+		testPortMapping(true, "80/tcp"),
+		testPortMapping(true, "443/tcp"),
+	})
+	require.ErrorIs(t, err, forwarder.ErrPortRejected)
+	assert.Equal(t, testPortMapping(true, "80/tcp"), peer.receive(t))
+	assert.Equal(t, testPortMapping(true, "443/tcp"), peer.receive(t))
+}
+
+func TestMergeRemovals(t *testing.T) {
+	t.Parallel()
+
+	connectAddrs := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	merged := forwarder.MergeRemovals([]types.PortMapping{
+		{
+			Ports:         nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "80"}}},
+			ConnectAddrs:  connectAddrs,
+			Metadata:      map[string]map[string]string{"80/tcp": {"service": "web"}},
+			Sources:       map[string]string{"80/tcp": "kubernetes"},
+			HostBindAddrs: map[string]string{"80/tcp": "127.0.0.1"},
+		},
+		{
+			Ports: nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "80"}}},
+		},
+		{
+			Ports:   nat.PortMap{"443/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "443"}}},
+			Sources: map[string]string{"443/tcp": "docker"},
+		},
+	})
+
+	assert.Equal(t, types.PortMapping{
+		Remove: true,
+		Ports: nat.PortMap{"80/tcp": []nat.PortBinding{
+			{HostIP: "127.0.0.1", HostPort: "80"},
+			{HostIP: "0.0.0.0", HostPort: "80"},
+		}, "443/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "443"}}},
+		ConnectAddrs:  connectAddrs,
+		Metadata:      map[string]map[string]string{"80/tcp": {"service": "web"}},
+		Sources:       map[string]string{"80/tcp": "kubernetes", "443/tcp": "docker"},
+		HostBindAddrs: map[string]string{"80/tcp": "127.0.0.1"},
+	}, merged)
+}
+
+func TestMergeRemovalsLabels(t *testing.T) {
+	t.Parallel()
+
+	labels := map[string]string{types.LabelComposeProject: "demo", types.LabelContainerName: "web"}
+	merged := forwarder.MergeRemovals([]types.PortMapping{
+		{Ports: nat.PortMap{"80/tcp": nil}, Labels: labels},
+		{Ports: nat.PortMap{"443/tcp": nil}, Labels: map[string]string{types.LabelComposeProject: "demo", types.LabelContainerName: "db"}},
+	})
+
+	// Only the labels that describe all the port mappings are kept.
+	assert.Equal(t, map[string]string{types.LabelComposeProject: "demo"}, merged.Labels)
+	assert.Len(t, labels, 2)
+
+	merged = forwarder.MergeRemovals([]types.PortMapping{
+		{Ports: nat.PortMap{"80/tcp": nil}, Labels: labels},
+		{Ports: nat.PortMap{"443/tcp": nil}},
+	})
+	assert.Nil(t, merged.Labels)
+}
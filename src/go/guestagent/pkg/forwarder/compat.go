@@ -0,0 +1,141 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+)
+
+// Compatibility modes of the peer, see Compatibility.
+const (
+	// CompatibilityCompatible is a peer that speaks a version of the protocol that the agent fully supports.
+	CompatibilityCompatible = "compatible"
+	// CompatibilityLegacy is a peer that speaks an older version of the
+	// protocol, which the port mappings are sent in without the newer fields.
+	CompatibilityLegacy = "legacy"
+	// CompatibilityUnsupported is a peer that no longer speaks any version of
+	// the protocol that the agent does; the port mappings are still sent, but
+	// the peer may reject them or misread them.
+	CompatibilityUnsupported = "unsupported"
+)
+
+// protocolRange is a range of the protocol versions that a peer may speak,
+// from first to last, and the mode that the agent works with it in.
+type protocolRange struct {
+	first, last int
+	mode        string
+}
+
+// protocolSupport is the table of the protocol versions of the peers that the
+// agent supports. Version 0 is the peers that do not answer the Hello, and
+// version 1 the ones that predate the schema versions, both of which only get
+// the fields of schema 0; see types.SchemaVersionFor. The peers that are newer
+// than the agent are compatible as long as they still speak its version.
+//
+//nolint:gochecknoglobals // the table is compiled into the agent.
+var protocolSupport = []protocolRange{
+	{first: 0, last: 1, mode: CompatibilityLegacy},
+	{first: 2, last: types.ProtocolVersion, mode: CompatibilityCompatible},
+}
+
+// Compatibility is how the agent works with its peer, from the answer of the
+// peer to the Hello, see protocolSupport.
+type Compatibility struct {
+	// Mode is one of CompatibilityCompatible, CompatibilityLegacy or CompatibilityUnsupported.
+	Mode string `json:"mode"`
+	// ProtocolVersion is the version of the protocol that was negotiated.
+	ProtocolVersion int `json:"protocolVersion"`
+	// PeerMinProtocolVersion and PeerProtocolVersion are the lowest and the
+	// highest versions of the protocol that the peer speaks, and
+	// AgentProtocolVersion is the highest one that the agent speaks.
+	PeerMinProtocolVersion int `json:"peerMinProtocolVersion"`
+	PeerProtocolVersion    int `json:"peerProtocolVersion"`
+	AgentProtocolVersion   int `json:"agentProtocolVersion"`
+	// PeerVersion is the version of the peer, e.g. of Rancher Desktop, when it
+	// tells it, and AgentVersion the one of the agent.
+	PeerVersion  string `json:"peerVersion,omitempty"`
+	AgentVersion string `json:"agentVersion"`
+}
+
+// checkCompatibility returns the compatibility of the peer that answered
+// the Hello with the status, which is nil for the peers that did not.
+func checkCompatibility(status *types.PeerStatus) Compatibility {
+	compatibility := Compatibility{
+		Mode:                 CompatibilityUnsupported,
+		AgentProtocolVersion: types.ProtocolVersion,
+		AgentVersion:         version.Version,
+	}
+
+	if status != nil && status.ProtocolVersion > 0 {
+		compatibility.PeerMinProtocolVersion = status.MinProtocolVersion
+		compatibility.PeerProtocolVersion = status.ProtocolVersion
+		compatibility.PeerVersion = status.ServiceVersion
+	}
+
+	protocolVersion, _ := negotiated(status)
+	compatibility.ProtocolVersion = protocolVersion
+
+	// The peer must still speak the version that was negotiated.
+	if compatibility.PeerMinProtocolVersion > protocolVersion {
+		return compatibility
+	}
+
+	for _, supported := range protocolSupport {
+		if supported.first <= protocolVersion && protocolVersion <= supported.last {
+			compatibility.Mode = supported.mode
+
+			break
+		}
+	}
+
+	return compatibility
+}
+
+// logCompatibility logs how the agent works with the peer at the address,
+// prominently when it is not supported.
+func logCompatibility(compatibility Compatibility, address string) {
+	peerVersion := compatibility.PeerVersion
+	if peerVersion == "" {
+		peerVersion = "unknown"
+	}
+
+	switch compatibility.Mode {
+	case CompatibilityLegacy:
+		logger.Infof("the vtunnel peer %s speaks the legacy protocol version %d, the port mappings are sent "+
+			"without the newer fields; peer version: %s, agent version: %s",
+			address, compatibility.ProtocolVersion, peerVersion, compatibility.AgentVersion)
+	case CompatibilityUnsupported:
+		logger.Warnf("the vtunnel peer %s is not compatible with the agent, the port forwarding may not work: "+
+			"the peer speaks the protocol versions %d to %d, the agent speaks up to %d; peer version: %s, agent version: %s; "+
+			"update Rancher Desktop or the agent so that they match",
+			address, compatibility.PeerMinProtocolVersion, compatibility.PeerProtocolVersion,
+			compatibility.AgentProtocolVersion, peerVersion, compatibility.AgentVersion)
+	}
+}
+
+// Compatibility returns how the agent works with the peer since the protocol
+// was last negotiated, nil until it was.
+func (v *VTunnelForwarder) Compatibility() *Compatibility {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	if v.compatibility == nil {
+		return nil
+	}
+
+	compatibility := *v.compatibility
+
+	return &compatibility
+}
@@ -0,0 +1,106 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVTunnelForwarderCompatibility(t *testing.T) {
+	t.Parallel()
+
+	for name, test := range map[string]struct {
+		legacy             bool
+		minProtocolVersion int
+		protocolVersion    int
+		want               forwarder.Compatibility
+	}{
+		"compatible": {
+			protocolVersion: types.ProtocolVersion,
+			want: forwarder.Compatibility{
+				Mode:                 forwarder.CompatibilityCompatible,
+				ProtocolVersion:      types.ProtocolVersion,
+				PeerProtocolVersion:  types.ProtocolVersion,
+				AgentProtocolVersion: types.ProtocolVersion,
+				PeerVersion:          "1.16.0",
+			},
+		},
+		"newer": {
+			minProtocolVersion: types.ProtocolVersion,
+			protocolVersion:    types.ProtocolVersion + 2,
+			want: forwarder.Compatibility{
+				Mode:                   forwarder.CompatibilityCompatible,
+				ProtocolVersion:        types.ProtocolVersion,
+				PeerMinProtocolVersion: types.ProtocolVersion,
+				PeerProtocolVersion:    types.ProtocolVersion + 2,
+				AgentProtocolVersion:   types.ProtocolVersion,
+				PeerVersion:            "1.16.0",
+			},
+		},
+		"legacy": {
+			protocolVersion: 1,
+			want: forwarder.Compatibility{
+				Mode:                 forwarder.CompatibilityLegacy,
+				ProtocolVersion:      1,
+				PeerProtocolVersion:  1,
+				AgentProtocolVersion: types.ProtocolVersion,
+				PeerVersion:          "1.16.0",
+			},
+		},
+		"no hello": {
+			legacy: true,
+			want: forwarder.Compatibility{
+				Mode:                 forwarder.CompatibilityLegacy,
+				AgentProtocolVersion: types.ProtocolVersion,
+			},
+		},
+		"unsupported": {
+			minProtocolVersion: types.ProtocolVersion + 1,
+			protocolVersion:    types.ProtocolVersion + 3,
+			want: forwarder.Compatibility{
+				Mode:                   forwarder.CompatibilityUnsupported,
+				ProtocolVersion:        types.ProtocolVersion,
+				PeerMinProtocolVersion: types.ProtocolVersion + 1,
+				PeerProtocolVersion:    types.ProtocolVersion + 3,
+				AgentProtocolVersion:   types.ProtocolVersion,
+				PeerVersion:            "1.16.0",
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			peer := newTestPeer(t, 0)
+			peer.setLegacy(test.legacy, false)
+			peer.setProtocol(test.minProtocolVersion, test.protocolVersion, "1.16.0")
+			vtunnelForwarder := newTestForwarder(peer)
+
+			assert.Nil(t, vtunnelForwarder.Compatibility(), "the protocol was not negotiated yet")
+
+			// The port mappings are sent whatever the compatibility of the peer.
+			require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+			peer.receive(t)
+
+			test.want.AgentVersion = version.Version
+			assert.Equal(t, &test.want, vtunnelForwarder.Compatibility())
+		})
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+type forceKey struct{}
+
+// WithForce returns a context that makes the VTunnelForwarder send the port
+// mappings even if they are identical to the last ones that it delivered,
+// e.g. for the resync after the peer restarted.
+func WithForce(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forceKey{}, true)
+}
+
+func forced(ctx context.Context) bool {
+	force, _ := ctx.Value(forceKey{}).(bool)
+
+	return force
+}
+
+// payloadHash returns the hash of the whole port mapping, including its
+// metadata, but without its sequence number.
+func payloadHash(portMapping types.PortMapping) ([]byte, error) {
+	portMapping.Seq = 0
+
+	bin, err := json.Marshal(portMapping)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(bin)
+
+	return hash[:], nil
+}
+
+// duplicate returns true if the port mapping is identical to the last one
+// that was delivered, in which case it does not need to be sent; otherwise the
+// last one is forgotten until the port mapping is delivered. The heartbeats
+// are never duplicates. It must be called with the sendMutex held.
+func (v *VTunnelForwarder) duplicate(ctx context.Context, portMapping types.PortMapping, hash []byte) bool {
+	if portMapping.Ping {
+		return false
+	}
+
+	if !forced(ctx) && bytes.Equal(v.lastHash, hash) {
+		return true
+	}
+
+	v.lastHash = nil
+
+	return false
+}
+
+// remember keeps the hash of the port mapping that was delivered, unless the
+// peer could not apply all of its port bindings; a heartbeat that detected a
+// restart makes the last delivered one be forgotten, since the peer lost it.
+// It must be called with the sendMutex held.
+func (v *VTunnelForwarder) remember(portMapping types.PortMapping, hash []byte, results []PortResult, restarted bool) {
+	switch {
+	case portMapping.Ping:
+		if restarted {
+			v.lastHash = nil
+		}
+	case rejectedError(results) == nil:
+		v.lastHash = hash
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSnapshot(ports ...nat.Port) types.PortMapping {
+	portMapping := testPortMapping(false, ports...)
+	portMapping.Replace = true
+
+	return portMapping
+}
+
+func TestVTunnelForwarderDeduplicate(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	// The same snapshot is only sent once.
+	for range 3 {
+		require.NoError(t, vtunnelForwarder.Send(context.Background(), testSnapshot("80/tcp", "443/tcp")))
+	}
+
+	assert.Equal(t, testSnapshot("80/tcp", "443/tcp"), peer.receive(t))
+	assertNothingReceived(t, peer)
+
+	// The heartbeats do not count as port mappings.
+	require.NoError(t, vtunnelForwarder.Ping(context.Background()))
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testSnapshot("80/tcp", "443/tcp")))
+	assert.True(t, peer.receive(t).Ping)
+	assertNothingReceived(t, peer)
+
+	// Any change is sent.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testSnapshot("80/tcp", "8443/tcp")))
+	assert.Equal(t, testSnapshot("80/tcp", "8443/tcp"), peer.receive(t))
+
+	withMetadata := testSnapshot("80/tcp", "8443/tcp")
+	withMetadata.Metadata = map[string]map[string]string{"80/tcp": {"container": "web"}}
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), withMetadata))
+	assert.Equal(t, withMetadata, peer.receive(t))
+
+	// Unless the context says otherwise, see WithForce.
+	require.NoError(t, vtunnelForwarder.Send(forwarder.WithForce(context.Background()), withMetadata))
+	assert.Equal(t, withMetadata, peer.receive(t))
+	assert.Len(t, peer.receivedSeqs(), 5)
+}
+
+func TestVTunnelForwarderDeduplicateFailed(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setAcknowledge(true, map[string]string{"80": "port is in use"})
+	vtunnelForwarder := newTestForwarder(peer)
+
+	// The port mappings that the peer could not apply are sent again.
+	require.ErrorIs(t, vtunnelForwarder.Send(context.Background(), testSnapshot("80/tcp")), forwarder.ErrPortRejected)
+	peer.receive(t)
+
+	peer.setAcknowledge(true, nil)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testSnapshot("80/tcp")))
+	peer.receive(t)
+
+	// So are the ones that may not have been delivered.
+	peer.setRefuseAll(true)
+	require.Error(t, vtunnelForwarder.Send(context.Background(), testSnapshot("443/tcp")))
+	peer.setRefuseAll(false)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testSnapshot("80/tcp")))
+	assert.Equal(t, testSnapshot("80/tcp"), peer.receive(t))
+}
+
+func TestVTunnelTrackerForcedResync(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelTracker := tracker.NewVTunnelTracker(vtunnelForwarder, nil)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "container", testPortMapping(false, "80/tcp").Ports))
+	peer.receive(t)
+
+	// The forced snapshots are sent even if they did not change.
+	require.NoError(t, vtunnelTracker.Resync(context.Background(), true))
+	assert.True(t, peer.receive(t).Replace)
+	require.NoError(t, vtunnelTracker.Resync(context.Background(), true))
+	assert.True(t, peer.receive(t).Replace)
+}
@@ -0,0 +1,242 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// The kinds of forwarders that NewFromConfig creates.
+const (
+	KindVTunnel    = "vtunnel"
+	KindVsock      = "vsock"
+	KindHvsock     = "hvsock"
+	KindGRPC       = "grpc"
+	KindAPI        = "api"
+	KindHostSwitch = "hostswitch"
+	KindNoop       = "noop"
+	KindRecord     = "record"
+)
+
+// Kinds are all the kinds of forwarders, in the order they are documented in.
+var Kinds = []string{KindVTunnel, KindVsock, KindHvsock, KindGRPC, KindAPI, KindHostSwitch, KindNoop, KindRecord}
+
+var (
+	ErrUnknownKind   = errors.New("unknown forwarder")
+	ErrInvalidConfig = errors.New("invalid forwarder configuration")
+)
+
+// Options configure the forwarders that NewFromConfig creates,
+// the options that do not apply to a kind are ignored.
+type Options struct {
+	VTunnel    VTunnelOptions
+	TLS        TLSOptions
+	Vsock      VsockOptions
+	Hvsock     HvsockOptions
+	Record     RecordOptions
+	HostSwitch HostSwitchOptions
+}
+
+// RegisterFlags defines the flags of all the kinds of forwarders.
+func (o *Options) RegisterFlags(flags *flag.FlagSet) {
+	o.VTunnel.RegisterFlags(flags)
+	o.TLS.RegisterFlags(flags)
+	o.Vsock.RegisterFlags(flags)
+	o.Hvsock.RegisterFlags(flags)
+	o.Record.RegisterFlags(flags)
+	o.HostSwitch.RegisterFlags(flags)
+}
+
+// NewFromConfig creates the forwarder of the given kind, see Kinds. The
+// vtunnel, hvsock and grpc forwarders connect to addr, which is a
+// comma-separated list of peer addresses for the vtunnel based ones.
+// The retries are enabled as configured in the options, and the forwarder
+// is instrumented with a MetricsForwarder; its Unwrap returns the forwarder
+// itself, e.g. to close it or to check for the optional interfaces.
+func NewFromConfig(kind, addr string, options Options) (*MetricsForwarder, error) {
+	if err := checkTLS(kind, options); err != nil {
+		return nil, err
+	}
+
+	var (
+		forwarder Forwarder
+		err       error
+	)
+
+	switch kind {
+	case KindVTunnel:
+		forwarder, err = newVTunnelFromConfig(addr, options)
+	case KindVsock:
+		forwarder, err = newVsockFromConfig(options)
+	case KindHvsock:
+		forwarder, err = newHvsockFromConfig(addr, options)
+	case KindGRPC:
+		forwarder, err = newGRPCFromConfig(addr, options)
+	case KindAPI:
+		forwarder = NewWSLProxyForwarder(WSLProxySocket)
+	case KindHostSwitch:
+		forwarder, err = newHostSwitchFromConfig(options)
+	case KindNoop:
+		logger.Info("dry run, the port mappings are only logged")
+
+		forwarder = NewNoopForwarder()
+	case KindRecord:
+		forwarder, err = newRecordFromConfig(options)
+	default:
+		return nil, fmt.Errorf("%w %q, valid options are %s", ErrUnknownKind, kind, strings.Join(Kinds, ", "))
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s forwarder: %w", ErrInvalidConfig, kind, err)
+	}
+
+	// The queue of the previous agent is delivered before anything else,
+	// failing to load it must not prevent the agent from starting though.
+	if queue, ok := forwarder.(QueuePersister); ok && options.VTunnel.QueueFile != "" && options.VTunnel.QueueSize > 0 {
+		if err := queue.LoadQueue(options.VTunnel.QueueFile, options.VTunnel.QueueMaxAge); err != nil {
+			logger.Errorf("failed to load the undelivered port mappings: %v", err)
+		}
+	}
+
+	return NewMetricsForwarder(forwarder), nil
+}
+
+// checkTLS fails if TLS was asked for and the kind does not support it,
+// the port mappings are never sent in plaintext then.
+func checkTLS(kind string, options Options) error {
+	if options.TLS.Enabled && kind != KindVTunnel {
+		return fmt.Errorf("%w: TLS is only supported by the %s forwarder, not by %q", ErrInvalidConfig, KindVTunnel, kind)
+	}
+
+	return nil
+}
+
+func newVTunnelFromConfig(addr string, options Options) (*VTunnelForwarder, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("%w: a peer address is required", ErrInvalidPeerAddr)
+	}
+
+	peerAddrs := strings.Split(addr, ",")
+	for _, peerAddr := range peerAddrs {
+		if _, _, err := ParsePeerAddr(peerAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	vtunnelForwarder := NewVTunnelForwarder(peerAddrs[0], peerAddrs[1:]...)
+	if options.VTunnel.Failback {
+		vtunnelForwarder.EnableFailback()
+	}
+
+	options.VTunnel.apply(vtunnelForwarder)
+
+	if options.TLS.Enabled {
+		tlsConfig, err := LoadTLSConfig(options.TLS.CertFile, options.TLS.KeyFile, options.TLS.CAFile, options.TLS.ServerName)
+		if err != nil {
+			return nil, err
+		}
+
+		vtunnelForwarder.SetTLSConfig(tlsConfig)
+	}
+
+	return vtunnelForwarder, nil
+}
+
+func newVsockFromConfig(options Options) (*VsockForwarder, error) {
+	if err := options.Vsock.validate(); err != nil {
+		return nil, err
+	}
+
+	logger.Infof("forwarding port mappings over AF_VSOCK to [%d:%d]", options.Vsock.CID, options.Vsock.Port)
+
+	vsockForwarder := NewVsockForwarder(uint32(options.Vsock.CID), uint32(options.Vsock.Port))
+	options.VTunnel.apply(vsockForwarder.VTunnelForwarder)
+
+	return vsockForwarder, nil
+}
+
+func newHvsockFromConfig(addr string, options Options) (*HvsockForwarder, error) {
+	port, err := ParseHvsockService(options.Hvsock.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	fallback, err := newVTunnelFromConfig(addr, options)
+	if err != nil {
+		return nil, fmt.Errorf("fallback: %w", err)
+	}
+
+	logger.Infof("forwarding port mappings over Hyper-V sockets to [%s]", HvsockServiceID(port))
+
+	hvsockForwarder := NewHvsockForwarder(port, fallback)
+	options.VTunnel.apply(hvsockForwarder.VTunnelForwarder)
+
+	return hvsockForwarder, nil
+}
+
+func newGRPCFromConfig(addr string, options Options) (*GRPCForwarder, error) {
+	if addr == "" {
+		return nil, fmt.Errorf("%w: a peer address is required", ErrInvalidPeerAddr)
+	}
+
+	if strings.Contains(addr, ",") {
+		return nil, fmt.Errorf("%w: %q must be a single peer address", ErrInvalidPeerAddr, addr)
+	}
+
+	logger.Infof("forwarding port mappings over gRPC to [%s]", addr)
+
+	grpcForwarder, err := NewGRPCForwarder(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// gRPC retries the connection itself, the calls wait for it up to the timeout.
+	if options.VTunnel.RetryTimeout > 0 {
+		grpcForwarder.SetTimeout(options.VTunnel.RetryTimeout)
+	}
+
+	return grpcForwarder, nil
+}
+
+func newHostSwitchFromConfig(options Options) (*HostSwitchForwarder, error) {
+	if err := options.HostSwitch.validate(); err != nil {
+		return nil, err
+	}
+
+	logger.Infof("exposing the port mappings with the host-switch API at [%s]", options.HostSwitch.URL)
+
+	return NewHostSwitchForwarder(options.HostSwitch.URL), nil
+}
+
+func newRecordFromConfig(options Options) (*RecordingForwarder, error) {
+	if options.Record.File == "" {
+		return nil, ErrNoRecordFile
+	}
+
+	logger.Infof("recording port mappings to [%s]", options.Record.File)
+
+	recordingForwarder, err := NewRecordingForwarder(options.Record.File)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.Record.Addr != "" {
+		recordingForwarder.EnableInspection()
+	}
+
+	return recordingForwarder, nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPeerAddr = "127.0.0.1:3040"
+
+// newFromConfig creates the forwarder and closes it when the test is done.
+func newFromConfig(t *testing.T, kind, addr string, options forwarder.Options) forwarder.Forwarder {
+	t.Helper()
+
+	metricsForwarder, err := forwarder.NewFromConfig(kind, addr, options)
+	require.NoError(t, err)
+
+	if closer, ok := metricsForwarder.Unwrap().(io.Closer); ok {
+		t.Cleanup(func() { closer.Close() })
+	}
+
+	return metricsForwarder.Unwrap()
+}
+
+func TestNewFromConfig(t *testing.T) {
+	t.Parallel()
+
+	var options forwarder.Options
+
+	options.RegisterFlags(flag.NewFlagSet("forwarder", flag.ContinueOnError))
+	options.Record.File = filepath.Join(t.TempDir(), "record.jsonl")
+
+	assert.IsType(t, &forwarder.VTunnelForwarder{}, newFromConfig(t, forwarder.KindVTunnel, testPeerAddr+",unix:///run/relay.sock", options))
+	assert.IsType(t, &forwarder.VsockForwarder{}, newFromConfig(t, forwarder.KindVsock, "", options))
+	assert.IsType(t, &forwarder.HvsockForwarder{}, newFromConfig(t, forwarder.KindHvsock, testPeerAddr, options))
+	assert.IsType(t, &forwarder.GRPCForwarder{}, newFromConfig(t, forwarder.KindGRPC, testPeerAddr, options))
+	assert.IsType(t, &forwarder.WSLProxyForwarder{}, newFromConfig(t, forwarder.KindAPI, "", options))
+	assert.IsType(t, &forwarder.HostSwitchForwarder{}, newFromConfig(t, forwarder.KindHostSwitch, "", options))
+	assert.IsType(t, &forwarder.NoopForwarder{}, newFromConfig(t, forwarder.KindNoop, "", options))
+	assert.IsType(t, &forwarder.RecordingForwarder{}, newFromConfig(t, forwarder.KindRecord, "", options))
+
+	options.TLS.Enabled = true
+	assert.IsType(t, &forwarder.VTunnelForwarder{}, newFromConfig(t, forwarder.KindVTunnel, testPeerAddr, options))
+}
+
+func TestNewFromConfigInvalid(t *testing.T) {
+	t.Parallel()
+
+	valid := forwarder.Options{
+		Vsock:  forwarder.VsockOptions{CID: 2, Port: 3040},
+		Hvsock: forwarder.HvsockOptions{Service: forwarder.HvsockServiceID(3040)},
+		Record: forwarder.RecordOptions{File: filepath.Join(t.TempDir(), "record.jsonl")},
+	}
+
+	type invalidConfig struct {
+		name    string
+		kind    string
+		addr    string
+		options func(options *forwarder.Options)
+		err     error
+	}
+
+	tests := []invalidConfig{
+		{name: "unknown", kind: "carrier-pigeon", err: forwarder.ErrUnknownKind},
+		{name: "vtunnel without address", kind: forwarder.KindVTunnel, err: forwarder.ErrInvalidPeerAddr},
+		{name: "vtunnel without port", kind: forwarder.KindVTunnel, addr: testPeerAddr + ",127.0.0.2", err: forwarder.ErrInvalidPeerAddr},
+		{
+			name: "vtunnel without TLS key",
+			kind: forwarder.KindVTunnel,
+			addr: testPeerAddr,
+			options: func(options *forwarder.Options) {
+				options.TLS = forwarder.TLSOptions{Enabled: true, CertFile: "client.crt"}
+			},
+			err: forwarder.ErrTLSConfig,
+		},
+		{
+			name:    "vsock without port",
+			kind:    forwarder.KindVsock,
+			options: func(options *forwarder.Options) { options.Vsock.Port = 0 },
+			err:     forwarder.ErrInvalidVsockAddr,
+		},
+		{
+			name:    "vsock CID out of range",
+			kind:    forwarder.KindVsock,
+			options: func(options *forwarder.Options) { options.Vsock.CID = math.MaxUint32 + 1 },
+			err:     forwarder.ErrInvalidVsockAddr,
+		},
+		{
+			name:    "hvsock with invalid service",
+			kind:    forwarder.KindHvsock,
+			addr:    testPeerAddr,
+			options: func(options *forwarder.Options) { options.Hvsock.Service = "not-a-service" },
+			err:     forwarder.ErrInvalidHvsockService,
+		},
+		{name: "hvsock without fallback", kind: forwarder.KindHvsock, err: forwarder.ErrInvalidPeerAddr},
+		{name: "grpc without address", kind: forwarder.KindGRPC, err: forwarder.ErrInvalidPeerAddr},
+		{
+			name: "grpc with several addresses",
+			kind: forwarder.KindGRPC,
+			addr: testPeerAddr + ",127.0.0.2:3040",
+			err:  forwarder.ErrInvalidPeerAddr,
+		},
+		{
+			name:    "hostswitch without URL",
+			kind:    forwarder.KindHostSwitch,
+			options: func(options *forwarder.Options) { options.HostSwitch.URL = "" },
+			err:     forwarder.ErrInvalidPeerAddr,
+		},
+		{
+			name:    "hostswitch with a relative URL",
+			kind:    forwarder.KindHostSwitch,
+			options: func(options *forwarder.Options) { options.HostSwitch.URL = "gateway.rancher-desktop.internal:80" },
+			err:     forwarder.ErrInvalidPeerAddr,
+		},
+		{
+			name:    "record without file",
+			kind:    forwarder.KindRecord,
+			options: func(options *forwarder.Options) { options.Record.File = "" },
+			err:     forwarder.ErrNoRecordFile,
+		},
+		{
+			name: "record in a missing directory",
+			kind: forwarder.KindRecord,
+			options: func(options *forwarder.Options) {
+				options.Record.File = filepath.Join(t.TempDir(), "missing", "record.jsonl")
+			},
+			err: forwarder.ErrInvalidConfig,
+		},
+	}
+
+	// TLS is rejected by all the forwarders but the vtunnel one.
+	for _, kind := range forwarder.Kinds[1:] {
+		tests = append(tests, invalidConfig{
+			name:    kind + " with TLS",
+			kind:    kind,
+			addr:    testPeerAddr,
+			options: func(options *forwarder.Options) { options.TLS.Enabled = true },
+			err:     forwarder.ErrInvalidConfig,
+		})
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			options := valid
+			if test.options != nil {
+				test.options(&options)
+			}
+
+			_, err := forwarder.NewFromConfig(test.kind, test.addr, options)
+			require.ErrorIs(t, err, test.err)
+
+			if !errors.Is(test.err, forwarder.ErrUnknownKind) {
+				require.ErrorIs(t, err, forwarder.ErrInvalidConfig)
+			}
+		})
+	}
+}
+
+func TestNewFromConfigRetry(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 3)
+	options := forwarder.Options{
+		VTunnel: forwarder.VTunnelOptions{RetryTimeout: time.Minute},
+	}
+
+	metricsForwarder, err := forwarder.NewFromConfig(forwarder.KindVTunnel, peer.listener.Addr().String(), options)
+	require.NoError(t, err)
+
+	vtunnelForwarder, ok := metricsForwarder.Unwrap().(*forwarder.VTunnelForwarder)
+	require.True(t, ok)
+	vtunnelForwarder.SetDialer(peer.dial)
+
+	// The refused connections are retried, and the send is instrumented.
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, metricsForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, peer.receive(t))
+
+	metrics := metricsForwarder.Metrics()
+	assert.Equal(t, uint64(1), metrics.Sends)
+	assert.Equal(t, uint64(3), metrics.Retries)
+}
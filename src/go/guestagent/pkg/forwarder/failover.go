@@ -0,0 +1,99 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// EnableFailback makes the forwarder return to a more preferred peer as
+// soon as it is reachable again, instead of sticking with the active one.
+// The preferred peers are tried first on every send to find out.
+func (v *VTunnelForwarder) EnableFailback() {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	v.failback = true
+}
+
+// ActivePeer returns the address of the peer that the port mappings are sent to.
+func (v *VTunnelForwarder) ActivePeer() string {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	return v.peers[v.active].address
+}
+
+// dialPeer connects to the active peer, or fails over to the next peer in
+// order that is reachable; with failback, the preferred peers are tried
+// first. It also returns whether the peer changed, which then has none of
+// the port mappings. It must be called with the sendMutex held.
+func (v *VTunnelForwarder) dialPeer(ctx context.Context) (net.Conn, bool, error) {
+	start := v.active
+	if v.failback {
+		start = 0
+	}
+
+	errs := make([]error, 0, len(v.peers))
+
+	for n := range len(v.peers) {
+		i := (start + n) % len(v.peers)
+		peer := &v.peers[i]
+
+		conn, err := v.dialAddr(ctx, peer)
+		if err != nil {
+			// The peers are not failed over when the send timed out.
+			if ctx.Err() != nil {
+				return nil, false, err
+			}
+
+			if !peer.down && len(v.peers) > 1 {
+				logger.Warnf("vtunnel peer %s is not reachable: %v", peer.address, err)
+			}
+
+			peer.down = true
+			errs = append(errs, err)
+
+			continue
+		}
+
+		if peer.down && len(v.peers) > 1 {
+			logger.Infof("vtunnel peer %s is reachable again", peer.address)
+		}
+
+		peer.down = false
+
+		v.tune(conn)
+
+		if i == v.active {
+			return conn, false, nil
+		}
+
+		logger.Infof("vtunnel failing over from peer %s to %s", v.peers[v.active].address, peer.address)
+
+		v.active = i
+		// The instance IDs of different peers are not comparable.
+		v.instanceID = ""
+
+		return conn, true, nil
+	}
+
+	if len(errs) == 1 {
+		return nil, false, errs[0]
+	}
+
+	return nil, false, errors.Join(errs...)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFailoverForwarder creates a forwarder for both peers, in order,
+// the connections go through the dialer of the peer that is dialed.
+func newFailoverForwarder(preferred, fallback *testPeer) *forwarder.VTunnelForwarder {
+	preferredAddr := preferred.listener.Addr().String()
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(preferredAddr, fallback.listener.Addr().String())
+	vtunnelForwarder.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		if address == preferredAddr {
+			return preferred.dial(ctx, network, address)
+		}
+
+		return fallback.dial(ctx, network, address)
+	})
+
+	return vtunnelForwarder
+}
+
+func TestVTunnelForwarderFailover(t *testing.T) {
+	t.Parallel()
+
+	preferred := newTestPeer(t, 0)
+	fallback := newTestPeer(t, 0)
+	vtunnelForwarder := newFailoverForwarder(preferred, fallback)
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	vtunnelTracker := tracker.NewVTunnelTracker(vtunnelForwarder, wslConnectAddr)
+	vtunnelForwarder.SetPeerRestartHandler(vtunnelTracker.PeerRestarted)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_1", testPortMapping(false, "80/tcp").Ports))
+	preferred.receive(t)
+	assert.Equal(t, preferred.listener.Addr().String(), vtunnelForwarder.ActivePeer())
+
+	// The preferred peer dies, the next change fails over to the
+	// fallback peer, which then gets all the port mappings.
+	require.NoError(t, preferred.listener.Close())
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_2", testPortMapping(false, "443/tcp").Ports))
+	assert.Equal(t, testPortMapping(false, "443/tcp").Ports, fallback.receive(t).Ports)
+	assert.Equal(t, fallback.listener.Addr().String(), vtunnelForwarder.ActivePeer())
+
+	snapshot := fallback.receive(t)
+	assert.True(t, snapshot.Replace)
+	assert.Equal(t, testPortMapping(false, "80/tcp", "443/tcp").Ports, snapshot.Ports)
+	assert.Equal(t, wslConnectAddr, snapshot.ConnectAddrs)
+}
+
+func TestVTunnelForwarderFailoverSticky(t *testing.T) {
+	t.Parallel()
+
+	preferred := newTestPeer(t, 0)
+	fallback := newTestPeer(t, 0)
+	vtunnelForwarder := newFailoverForwarder(preferred, fallback)
+
+	preferred.setRefuseAll(true)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	fallback.receive(t)
+
+	// The fallback peer stays active when the preferred one is back.
+	preferred.setRefuseAll(false)
+	dials := preferred.dialCount()
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	fallback.receive(t)
+	assert.Equal(t, dials, preferred.dialCount())
+	assert.Equal(t, fallback.listener.Addr().String(), vtunnelForwarder.ActivePeer())
+}
+
+func TestVTunnelForwarderFailback(t *testing.T) {
+	t.Parallel()
+
+	preferred := newTestPeer(t, 0)
+	fallback := newTestPeer(t, 0)
+	vtunnelForwarder := newFailoverForwarder(preferred, fallback)
+	vtunnelForwarder.EnableFailback()
+
+	restarts := 0
+	vtunnelForwarder.SetPeerRestartHandler(func() {
+		restarts++
+	})
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	preferred.receive(t)
+
+	preferred.setRefuseAll(true)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	fallback.receive(t)
+	assert.Equal(t, 1, restarts)
+
+	// The preferred peer takes over again once it is back.
+	preferred.setRefuseAll(false)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "8080/tcp")))
+	preferred.receive(t)
+	assert.Equal(t, 2, restarts)
+	assert.Equal(t, preferred.listener.Addr().String(), vtunnelForwarder.ActivePeer())
+}
+
+func TestVTunnelForwarderFailoverAllDown(t *testing.T) {
+	t.Parallel()
+
+	preferred := newTestPeer(t, 0)
+	fallback := newTestPeer(t, 0)
+	vtunnelForwarder := newFailoverForwarder(preferred, fallback)
+
+	preferred.setRefuseAll(true)
+	fallback.setRefuseAll(true)
+
+	err := vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+	assert.Equal(t, 1, preferred.dialCount())
+	assert.Equal(t, 1, fallback.dialCount())
+}
@@ -0,0 +1,101 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// FrameVersion is the first byte of every frame, it is never '{'
+	// so that the peers can tell the frames apart from raw JSON.
+	FrameVersion byte = 1
+	// frameHeaderSize is the version byte followed by the
+	// 4-byte big-endian length of the payload.
+	frameHeaderSize = 5
+	// MaxFrameSize is the largest payload that is read from a frame.
+	MaxFrameSize = 1 << 20
+)
+
+var ErrInvalidFrame = errors.New("invalid frame")
+
+// EnableRawJSON makes the forwarder send the port mappings as raw JSON
+// instead of frames, for the peers that predate the framing.
+func (v *VTunnelForwarder) EnableRawJSON() {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	v.rawJSON = true
+}
+
+// WriteFrame writes the payload as a single frame, the version byte
+// and the length of the payload followed by the payload. The peers
+// can not read a payload that is larger than MaxFrameSize.
+func WriteFrame(w io.Writer, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("%w: payload of %d bytes exceeds %d bytes", ErrInvalidFrame, len(payload), MaxFrameSize)
+	}
+
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(payload))
+	frame[0] = FrameVersion
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+
+	return writeFull(w, append(frame, payload...))
+}
+
+// ReadFrame reads a single frame and returns its payload.
+func ReadFrame(r io.Reader) ([]byte, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	if header[0] != FrameVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidFrame, header[0])
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("%w: payload of %d bytes exceeds %d bytes", ErrInvalidFrame, size, MaxFrameSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("%w: truncated payload: %w", ErrInvalidFrame, err)
+	}
+
+	return payload, nil
+}
+
+// writeFull writes all the data, it carries on after the short writes
+// of the writers that do not report them as an error.
+func writeFull(w io.Writer, data []byte) error {
+	for len(data) != 0 {
+		n, err := w.Write(data)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+
+		data = data[n:]
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chunkWriter writes at most size bytes at a time, and reports
+// the short writes without an error, like a slow connection.
+type chunkWriter struct {
+	writer io.Writer
+	size   int
+}
+
+func (c *chunkWriter) Write(data []byte) (int, error) {
+	return c.writer.Write(data[:min(len(data), c.size)])
+}
+
+// stalledWriter never writes anything.
+type stalledWriter struct{}
+
+func (stalledWriter) Write([]byte) (int, error) {
+	return 0, nil
+}
+
+func TestFrameChunkedWrites(t *testing.T) {
+	t.Parallel()
+
+	reader, writer := io.Pipe()
+	payloads := [][]byte{[]byte(`{"remove":false}`), {}, bytes.Repeat([]byte("x"), 4096)}
+
+	go func() {
+		chunked := &chunkWriter{writer: writer, size: 3}
+		for _, payload := range payloads {
+			if err := forwarder.WriteFrame(chunked, payload); err != nil {
+				writer.CloseWithError(err)
+
+				return
+			}
+		}
+
+		writer.Close()
+	}()
+
+	// The frames are read back one by one, even though they were
+	// written in chunks that do not match their boundaries.
+	for _, payload := range payloads {
+		received, err := forwarder.ReadFrame(reader)
+		require.NoError(t, err)
+		assert.Equal(t, payload, received)
+	}
+
+	_, err := forwarder.ReadFrame(reader)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestFrameFormat(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+
+	require.NoError(t, forwarder.WriteFrame(&buf, []byte("{}")))
+	assert.Equal(t, []byte{forwarder.FrameVersion, 0, 0, 0, 2, '{', '}'}, buf.Bytes())
+}
+
+func TestReadFrameInvalid(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string][]byte{
+		"unsupported version": {2, 0, 0, 0, 2, '{', '}'},
+		"too large":           {forwarder.FrameVersion, 0xff, 0xff, 0xff, 0xff},
+		"truncated payload":   {forwarder.FrameVersion, 0, 0, 0, 4, '{', '}'},
+		"raw JSON":            []byte(`{"remove":false}`),
+	}
+
+	for name, frame := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := forwarder.ReadFrame(bytes.NewReader(frame))
+			assert.ErrorIs(t, err, forwarder.ErrInvalidFrame)
+		})
+	}
+}
+
+func TestWriteFrameStalled(t *testing.T) {
+	t.Parallel()
+
+	err := forwarder.WriteFrame(stalledWriter{}, []byte("{}"))
+	assert.ErrorIs(t, err, io.ErrShortWrite)
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	t.Parallel()
+
+	err := forwarder.WriteFrame(io.Discard, make([]byte, forwarder.MaxFrameSize+1))
+	assert.ErrorIs(t, err, forwarder.ErrInvalidFrame)
+}
+
+func TestVTunnelForwarderFramed(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setInstanceID("first")
+	vtunnelForwarder := newTestForwarder(peer)
+
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, peer.receive(t))
+	assert.False(t, peer.receivedRawJSON())
+}
+
+func TestVTunnelForwarderRawJSON(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setAcknowledge(true, map[string]string{"80": "address already in use"})
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableRawJSON()
+
+	// The peer's raw JSON response is read back too.
+	err := vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, forwarder.ErrPortRejected)
+	assert.Equal(t, testPortMapping(false, "80/tcp"), peer.receive(t))
+	assert.True(t, peer.receivedRawJSON())
+}
+
+func TestVTunnelForwarderConcurrentSends(t *testing.T) {
+	t.Parallel()
+
+	const senders = 20
+
+	peer := newTestPeer(t, 0)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	var wg sync.WaitGroup
+
+	for i := range senders {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			assert.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, nat.Port(fmt.Sprintf("%d/tcp", 8000+i)))))
+		}()
+	}
+
+	// Every port mapping arrives intact, in a frame of its own.
+	received := make(nat.PortMap)
+
+	for range senders {
+		for port, bindings := range peer.receive(t).Ports {
+			received[port] = bindings
+		}
+	}
+
+	wg.Wait()
+	assert.Len(t, received, senders)
+}
@@ -0,0 +1,400 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder/portforwardpb"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	// Registers the client side health checking that the service config enables.
+	_ "google.golang.org/grpc/health"
+)
+
+// DefaultGRPCTimeout is the timeout for a single call to the host service,
+// the calls wait for the connection to be ready within it.
+const DefaultGRPCTimeout = 5 * time.Second
+
+// grpcServiceConfig enables the health checking of the host service, so
+// that the connection is only used while the service reports serving.
+const grpcServiceConfig = `{
+	"loadBalancingConfig": [{"round_robin": {}}],
+	"healthCheckConfig": {"serviceName": ""}
+}`
+
+var ErrPortRejected = errors.New("port binding rejected by the host")
+
+// PortResult is the outcome of forwarding a single port binding.
+type PortResult struct {
+	Port    nat.Port
+	Binding nat.PortBinding
+	// Err is nil if the host applied the port binding.
+	Err error
+}
+
+// ResultForwarder is implemented by the forwarders that
+// report the outcome of every port binding they send.
+type ResultForwarder interface {
+	Forwarder
+	SendWithResults(ctx context.Context, portMapping types.PortMapping) ([]PortResult, error)
+}
+
+// GRPCForwarder forwards the PortMappings to the host's PortForward gRPC
+// service. The connection is managed by gRPC, which reconnects with a
+// backoff and checks the health of the service.
+type GRPCForwarder struct {
+	conn    *grpc.ClientConn
+	client  portforwardpb.PortForwardClient
+	timeout time.Duration
+	// syncStream is the SyncState stream that the snapshots are sent on,
+	// it is opened on the first snapshot and again after it fails.
+	syncStream portforwardpb.PortForward_SyncStateClient
+	syncCancel context.CancelFunc
+	syncMutex  sync.Mutex
+	// onRestart is called when the connection is ready again after it was lost.
+	onRestart func()
+	cancel    context.CancelFunc
+	mutex     sync.Mutex
+}
+
+// NewGRPCForwarder creates a forwarder for the service at the given target,
+// the connection is established in the background.
+func NewGRPCForwarder(target string, opts ...grpc.DialOption) (*GRPCForwarder, error) {
+	dialOpts := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff:           backoff.DefaultConfig,
+			MinConnectTimeout: DefaultGRPCTimeout,
+		}),
+		grpc.WithDefaultServiceConfig(grpcServiceConfig),
+	}, opts...)
+
+	conn, err := grpc.Dial(target, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to the port forward service at %s failed: %w", target, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	g := &GRPCForwarder{
+		conn:    conn,
+		client:  portforwardpb.NewPortForwardClient(conn),
+		timeout: DefaultGRPCTimeout,
+		cancel:  cancel,
+	}
+
+	go g.watchState(ctx)
+
+	return g, nil
+}
+
+// SetTimeout sets the timeout for a single call to the host service.
+func (g *GRPCForwarder) SetTimeout(timeout time.Duration) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.timeout = timeout
+}
+
+// SetPeerRestartHandler sets the function that is called when the connection
+// to the service is ready again after it was lost, since the service may
+// have restarted and lost the port mappings.
+func (g *GRPCForwarder) SetPeerRestartHandler(onRestart func()) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.onRestart = onRestart
+}
+
+// Send forwards the port mappings to the host service, it fails with
+// ErrPortRejected if the service rejected any of the port bindings.
+func (g *GRPCForwarder) Send(ctx context.Context, portMapping types.PortMapping) error {
+	results, err := g.SendWithResults(ctx, portMapping)
+	if err != nil {
+		return err
+	}
+
+	return rejectedError(results)
+}
+
+// RemovePorts unexposes all the port mappings in a single call, the
+// host service reports the outcome of every port binding.
+func (g *GRPCForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	return g.Send(ctx, MergeRemovals(portMappings))
+}
+
+// rejectedError returns ErrPortRejected naming the port
+// bindings that the host rejected, if there were any.
+func rejectedError(results []PortResult) error {
+	var rejected []string
+
+	for _, result := range results {
+		if result.Err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s %s:%s: %v",
+				result.Port, result.Binding.HostIP, result.Binding.HostPort, result.Err))
+		}
+	}
+
+	if len(rejected) != 0 {
+		return fmt.Errorf("%w: %s", ErrPortRejected, strings.Join(rejected, ", "))
+	}
+
+	return nil
+}
+
+// SendWithResults forwards the port mappings to the host service and
+// returns the outcome of every port binding. Snapshots are sent on the
+// SyncState stream, the other port mappings are exposed or unexposed.
+func (g *GRPCForwarder) SendWithResults(ctx context.Context, portMapping types.PortMapping) ([]PortResult, error) {
+	mapping := toProtoPortMapping(portMapping)
+
+	if portMapping.Replace {
+		return g.syncState(ctx, mapping)
+	}
+
+	g.mutex.Lock()
+	timeout := g.timeout
+	g.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var (
+		response *portforwardpb.PortResponse
+		err      error
+	)
+
+	if portMapping.Remove {
+		response, err = g.client.UnexposePort(ctx, &portforwardpb.UnexposePortRequest{Mapping: mapping},
+			grpc.WaitForReady(true))
+	} else {
+		response, err = g.client.ExposePort(ctx, &portforwardpb.ExposePortRequest{Mapping: mapping},
+			grpc.WaitForReady(true))
+	}
+
+	if status.Code(err) == codes.DeadlineExceeded {
+		return nil, fmt.Errorf("%w: %w", ErrSendTimeout, err)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return fromProtoResults(response), nil
+}
+
+// Close stops the forwarder and closes the connection to the host service.
+func (g *GRPCForwarder) Close() error {
+	g.cancel()
+
+	g.syncMutex.Lock()
+	g.resetSyncStream()
+	g.syncMutex.Unlock()
+
+	return g.conn.Close()
+}
+
+// syncState sends the snapshot on the SyncState stream and waits for the
+// response, the stream is reopened on the next snapshot if anything fails.
+func (g *GRPCForwarder) syncState(ctx context.Context, mapping *portforwardpb.PortMapping) ([]PortResult, error) {
+	g.syncMutex.Lock()
+	defer g.syncMutex.Unlock()
+
+	g.mutex.Lock()
+	timeout := g.timeout
+	g.mutex.Unlock()
+
+	if g.syncStream == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		stream, err := g.client.SyncState(ctx, grpc.WaitForReady(true))
+		if err != nil {
+			cancel()
+
+			return nil, fmt.Errorf("opening the SyncState stream failed: %w", err)
+		}
+
+		g.syncStream = stream
+		g.syncCancel = cancel
+	}
+
+	type recvResult struct {
+		response *portforwardpb.PortResponse
+		err      error
+	}
+
+	resultCh := make(chan recvResult, 1)
+	stream := g.syncStream
+
+	go func() {
+		if err := stream.Send(&portforwardpb.SyncStateRequest{Mapping: mapping}); err != nil {
+			resultCh <- recvResult{err: err}
+
+			return
+		}
+
+		response, err := stream.Recv()
+		resultCh <- recvResult{response: response, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-resultCh:
+		if result.err != nil {
+			g.resetSyncStream()
+
+			return nil, fmt.Errorf("sending the snapshot on the SyncState stream failed: %w", result.err)
+		}
+
+		return fromProtoResults(result.response), nil
+	case <-timer.C:
+		g.resetSyncStream()
+
+		return nil, fmt.Errorf("%w: the SyncState stream did not respond within %s", ErrSendTimeout, timeout)
+	case <-ctx.Done():
+		g.resetSyncStream()
+
+		return nil, fmt.Errorf("sending the snapshot on the SyncState stream: %w", ctx.Err())
+	}
+}
+
+func (g *GRPCForwarder) resetSyncStream() {
+	if g.syncCancel != nil {
+		g.syncCancel()
+	}
+
+	g.syncStream = nil
+	g.syncCancel = nil
+}
+
+// watchState follows the state of the connection, and calls the restart
+// handler when the connection is ready again after it was lost.
+func (g *GRPCForwarder) watchState(ctx context.Context) {
+	wasReady := false
+	lost := false
+
+	for {
+		state := g.conn.GetState()
+
+		switch {
+		case state == connectivity.Ready && !wasReady:
+			wasReady = true
+
+			if lost {
+				logger.Infof("connection to the port forward service is ready again")
+				g.peerRestarted()
+			}
+		case state != connectivity.Ready && wasReady:
+			logger.Debugf("connection to the port forward service was lost: %s", state)
+
+			wasReady = false
+			lost = true
+		}
+
+		if state == connectivity.Idle {
+			g.conn.Connect()
+		}
+
+		if !g.conn.WaitForStateChange(ctx, state) {
+			return
+		}
+	}
+}
+
+func (g *GRPCForwarder) peerRestarted() {
+	g.mutex.Lock()
+	onRestart := g.onRestart
+	g.mutex.Unlock()
+
+	if onRestart != nil {
+		onRestart()
+	}
+}
+
+func toProtoPortMapping(portMapping types.PortMapping) *portforwardpb.PortMapping {
+	mapping := &portforwardpb.PortMapping{}
+
+	ports := make([]nat.Port, 0, len(portMapping.Ports))
+	for port := range portMapping.Ports {
+		ports = append(ports, port)
+	}
+
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i] < ports[j]
+	})
+
+	for _, port := range ports {
+		protoPort := &portforwardpb.Port{Port: string(port)}
+		for _, binding := range portMapping.Ports[port] {
+			protoPort.Bindings = append(protoPort.Bindings, &portforwardpb.PortBinding{
+				HostIp:   binding.HostIP,
+				HostPort: binding.HostPort,
+			})
+		}
+
+		mapping.Ports = append(mapping.Ports, protoPort)
+	}
+
+	for _, connectAddr := range portMapping.ConnectAddrs {
+		mapping.ConnectAddrs = append(mapping.ConnectAddrs, &portforwardpb.ConnectAddr{
+			Network: connectAddr.Network,
+			Addr:    connectAddr.Addr,
+		})
+	}
+
+	if len(portMapping.Metadata) != 0 {
+		mapping.Metadata = make(map[string]*portforwardpb.Metadata, len(portMapping.Metadata))
+		for key, values := range portMapping.Metadata {
+			mapping.Metadata[key] = &portforwardpb.Metadata{Values: values}
+		}
+	}
+
+	return mapping
+}
+
+func fromProtoResults(response *portforwardpb.PortResponse) []PortResult {
+	results := make([]PortResult, 0, len(response.GetResults()))
+
+	for _, result := range response.GetResults() {
+		portResult := PortResult{
+			Port: nat.Port(result.GetPort()),
+			Binding: nat.PortBinding{
+				HostIP:   result.GetBinding().GetHostIp(),
+				HostPort: result.GetBinding().GetHostPort(),
+			},
+		}
+
+		if result.GetError() != "" {
+			portResult.Err = errors.New(result.GetError())
+		}
+
+		results = append(results, portResult)
+	}
+
+	return results
+}
@@ -0,0 +1,220 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder/portforwardpb"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// reservedPort is rejected by the testPortForwardServer.
+const reservedPort = "9999"
+
+type testPortForwardServer struct {
+	portforwardpb.UnimplementedPortForwardServer
+	exposed   []*portforwardpb.PortMapping
+	unexposed []*portforwardpb.PortMapping
+	snapshots []*portforwardpb.PortMapping
+	streams   int
+	mutex     sync.Mutex
+}
+
+func (s *testPortForwardServer) ExposePort(
+	_ context.Context,
+	req *portforwardpb.ExposePortRequest,
+) (*portforwardpb.PortResponse, error) {
+	if len(req.GetMapping().GetPorts()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no ports to expose")
+	}
+
+	s.mutex.Lock()
+	s.exposed = append(s.exposed, req.GetMapping())
+	s.mutex.Unlock()
+
+	return results(req.GetMapping()), nil
+}
+
+func (s *testPortForwardServer) UnexposePort(
+	_ context.Context,
+	req *portforwardpb.UnexposePortRequest,
+) (*portforwardpb.PortResponse, error) {
+	s.mutex.Lock()
+	s.unexposed = append(s.unexposed, req.GetMapping())
+	s.mutex.Unlock()
+
+	return results(req.GetMapping()), nil
+}
+
+func (s *testPortForwardServer) SyncState(stream portforwardpb.PortForward_SyncStateServer) error {
+	s.mutex.Lock()
+	s.streams++
+	s.mutex.Unlock()
+
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return nil
+		}
+
+		s.mutex.Lock()
+		s.snapshots = append(s.snapshots, req.GetMapping())
+		s.mutex.Unlock()
+
+		if err := stream.Send(results(req.GetMapping())); err != nil {
+			return err
+		}
+	}
+}
+
+// results accepts all the port bindings, except for the reserved port.
+func results(mapping *portforwardpb.PortMapping) *portforwardpb.PortResponse {
+	response := &portforwardpb.PortResponse{}
+
+	for _, port := range mapping.GetPorts() {
+		for _, binding := range port.GetBindings() {
+			result := &portforwardpb.PortResult{Port: port.GetPort(), Binding: binding}
+			if binding.GetHostPort() == reservedPort {
+				result.Error = "port is reserved"
+			}
+
+			response.Results = append(response.Results, result)
+		}
+	}
+
+	return response
+}
+
+func newTestGRPCForwarder(t *testing.T) (*forwarder.GRPCForwarder, *testPortForwardServer) {
+	t.Helper()
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	portForwardServer := &testPortForwardServer{}
+	portforwardpb.RegisterPortForwardServer(server, portForwardServer)
+	grpc_health_v1.RegisterHealthServer(server, health.NewServer())
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	t.Cleanup(server.Stop)
+
+	grpcForwarder, err := forwarder.NewGRPCForwarder("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}))
+	require.NoError(t, err)
+	t.Cleanup(func() { grpcForwarder.Close() })
+
+	return grpcForwarder, portForwardServer
+}
+
+func TestGRPCForwarderExpose(t *testing.T) {
+	t.Parallel()
+
+	grpcForwarder, server := newTestGRPCForwarder(t)
+
+	portMapping := testPortMapping(false, "80/tcp", "443/tcp")
+	portMapping.ConnectAddrs = []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	portMapping.Metadata = map[string]map[string]string{"80/tcp": {"source": "docker"}}
+
+	require.NoError(t, grpcForwarder.Send(context.Background(), portMapping))
+
+	require.Len(t, server.exposed, 1)
+	exposed := server.exposed[0]
+	require.Len(t, exposed.GetPorts(), 2)
+	assert.Equal(t, "443/tcp", exposed.GetPorts()[0].GetPort())
+	assert.Equal(t, "80/tcp", exposed.GetPorts()[1].GetPort())
+	assert.Equal(t, "127.0.0.1", exposed.GetPorts()[1].GetBindings()[0].GetHostIp())
+	assert.Equal(t, "80", exposed.GetPorts()[1].GetBindings()[0].GetHostPort())
+	assert.Equal(t, "192.168.0.1", exposed.GetConnectAddrs()[0].GetAddr())
+	assert.Equal(t, map[string]string{"source": "docker"}, exposed.GetMetadata()["80/tcp"].GetValues())
+	assert.Empty(t, server.unexposed)
+}
+
+func TestGRPCForwarderUnexpose(t *testing.T) {
+	t.Parallel()
+
+	grpcForwarder, server := newTestGRPCForwarder(t)
+
+	results, err := grpcForwarder.SendWithResults(context.Background(), testPortMapping(true, "80/tcp"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []forwarder.PortResult{
+		{
+			Port:    "80/tcp",
+			Binding: nat.PortBinding{HostIP: "127.0.0.1", HostPort: "80"},
+		},
+	}, results)
+	require.Len(t, server.unexposed, 1)
+	assert.Empty(t, server.exposed)
+}
+
+func TestGRPCForwarderErrorResponse(t *testing.T) {
+	t.Parallel()
+
+	grpcForwarder, _ := newTestGRPCForwarder(t)
+
+	portMapping := testPortMapping(false, "80/tcp", nat.Port(reservedPort+"/tcp"))
+
+	results, err := grpcForwarder.SendWithResults(context.Background(), portMapping)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.NoError(t, results[0].Err)
+	assert.EqualError(t, results[1].Err, "port is reserved")
+
+	err = grpcForwarder.Send(context.Background(), portMapping)
+	require.ErrorIs(t, err, forwarder.ErrPortRejected)
+	assert.Contains(t, err.Error(), "9999/tcp 127.0.0.1:9999: port is reserved")
+
+	// The errors for the whole request are reported with their status.
+	err = grpcForwarder.Send(context.Background(), types.PortMapping{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPCForwarderSyncState(t *testing.T) {
+	t.Parallel()
+
+	grpcForwarder, server := newTestGRPCForwarder(t)
+
+	for _, port := range []nat.Port{"80/tcp", "443/tcp"} {
+		portMapping := testPortMapping(false, port)
+		portMapping.Replace = true
+		require.NoError(t, grpcForwarder.Send(context.Background(), portMapping))
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	// Both snapshots are sent on the same stream.
+	assert.Equal(t, 1, server.streams)
+	require.Len(t, server.snapshots, 2)
+	assert.Equal(t, "443/tcp", server.snapshots[1].GetPorts()[0].GetPort())
+	assert.Empty(t, server.exposed)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// Ping sends a heartbeat to the peer, which carries no port mappings. A peer
+// that restarted or that became reachable again is detected like on Send, so
+// the restart handler resends the port mappings without waiting for a change;
+// the queued port mappings are sent first.
+func (v *VTunnelForwarder) Ping(ctx context.Context) error {
+	v.sendMutex.Lock()
+	_, restarted, err := v.deliver(ctx, types.PortMapping{
+		Ping:         true,
+		Ports:        nat.PortMap{},
+		ConnectAddrs: []types.ConnectAddrs{},
+	})
+	v.sendMutex.Unlock()
+
+	if restarted {
+		v.peerRestarted()
+	}
+
+	return err
+}
+
+// LastContact returns when the peer last accepted a payload, either
+// port mappings or a heartbeat; it is zero if that never happened.
+func (v *VTunnelForwarder) LastContact() time.Time {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	return v.lastContact
+}
+
+// ConnectionStats returns the number of retries and reconnects, see ConnectionStats.
+func (v *VTunnelForwarder) ConnectionStats() (retries, reconnects uint64) {
+	return v.retries.Load(), v.reconnects.Load()
+}
+
+// PingPeriodically calls Ping at every given interval
+// until the context is cancelled.
+func (v *VTunnelForwarder) PingPeriodically(ctx context.Context, interval time.Duration) {
+	pingPeriodically(ctx, interval, v.Ping, v.LastContact)
+}
+
+// pingPeriodically calls ping at every given interval until the
+// context is cancelled, and logs when the peer stops or starts answering.
+func pingPeriodically(ctx context.Context, interval time.Duration, ping func(context.Context) error, lastContact func() time.Time) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := ping(ctx)
+
+			switch {
+			case err != nil && !failing:
+				logger.Warnf("vtunnel peer is not answering the heartbeat, last contact at %s: %v",
+					lastContact().Format(time.RFC3339), err)
+
+				failing = true
+			case err != nil:
+				logger.Debugf("vtunnel peer is still not answering the heartbeat: %v", err)
+			case failing:
+				logger.Infof("vtunnel peer is answering the heartbeat again")
+
+				failing = false
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVTunnelForwarderPing(t *testing.T) {
+	t.Parallel()
+
+	// The peer does not respond, like the older versions.
+	peer := newTestPeer(t, 0)
+	vtunnelForwarder := newTestForwarder(peer)
+	assert.Zero(t, vtunnelForwarder.LastContact())
+
+	require.NoError(t, vtunnelForwarder.Ping(context.Background()))
+
+	heartbeat := peer.receive(t)
+	assert.True(t, heartbeat.Ping)
+	assert.False(t, heartbeat.Remove)
+	assert.Empty(t, heartbeat.Ports)
+	assert.WithinDuration(t, time.Now(), vtunnelForwarder.LastContact(), time.Minute)
+
+	peer.setRefuseAll(true)
+	lastContact := vtunnelForwarder.LastContact()
+
+	require.ErrorIs(t, vtunnelForwarder.Ping(context.Background()), syscall.ECONNREFUSED)
+	assert.Equal(t, lastContact, vtunnelForwarder.LastContact())
+}
+
+func TestVTunnelForwarderHeartbeatResync(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setInstanceID("first")
+	vtunnelForwarder := newTestForwarder(peer)
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	vtunnelTracker := tracker.NewVTunnelTracker(vtunnelForwarder, wslConnectAddr)
+	vtunnelForwarder.SetPeerRestartHandler(vtunnelTracker.PeerRestarted)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_1", testPortMapping(false, "80/tcp").Ports))
+	peer.receive(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go vtunnelForwarder.PingPeriodically(ctx, 20*time.Millisecond)
+
+	assert.True(t, peer.receive(t).Ping)
+
+	// The peer stops answering, which is noticed without any port changes.
+	peer.setRefuseAll(true)
+	dials := peer.dialCount()
+	require.Eventually(t, func() bool {
+		return peer.dialCount() >= dials+2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Once it is back, the heartbeat reconnects and the port mappings are resent.
+	peer.setRefuseAll(false)
+
+	for {
+		portMapping := peer.receive(t)
+		if portMapping.Ping {
+			continue
+		}
+
+		assert.True(t, portMapping.Replace)
+		assert.Equal(t, testPortMapping(false, "80/tcp").Ports, portMapping.Ports)
+		assert.Equal(t, wslConnectAddr, portMapping.ConnectAddrs)
+
+		break
+	}
+}
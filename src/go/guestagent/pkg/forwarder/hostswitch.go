@@ -0,0 +1,480 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	gvisorTypes "github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+const (
+	// DefaultHostSwitchURL is the base URL of the control API of the host-switch.
+	DefaultHostSwitchURL = "http://gateway.rancher-desktop.internal:80"
+	// DefaultHostSwitchTimeout is the default timeout for a single request to the host-switch.
+	DefaultHostSwitchTimeout = 5 * time.Second
+	hostSwitchExposeAPI      = "/services/forwarder/expose"
+	hostSwitchUnexposeAPI    = "/services/forwarder/unexpose"
+	hostSwitchAllAPI         = "/services/forwarder/all"
+	// The errors of the host-switch for the ports that are already
+	// exposed, and for the ones that are not exposed.
+	hostSwitchAlreadyExposed = "proxy already running"
+	hostSwitchNotExposed     = "proxy not found"
+	hostSwitchAddrInUse      = "address already in use"
+)
+
+var (
+	ErrHostSwitch = errors.New("error from the host-switch API")
+	// ErrHostSwitchInvalidAddr is the outcome of the port bindings whose
+	// address the host-switch did not accept.
+	ErrHostSwitchInvalidAddr = fmt.Errorf("%w: invalid address", ErrHostSwitch)
+	// ErrHostSwitchUnreachable is returned when the host-switch could not be reached.
+	ErrHostSwitchUnreachable = errors.New("the host-switch could not be reached")
+	// ErrNoIPv4ConnectAddr is the outcome of the port bindings that can not
+	// be exposed, since the host-switch only reaches the IPv4 addresses of the VM.
+	ErrNoIPv4ConnectAddr = errors.New("no IPv4 connect address")
+)
+
+// HostSwitchOptions configure the hostswitch forwarder.
+type HostSwitchOptions struct {
+	// URL is the base URL of the control API of the host-switch.
+	URL string
+}
+
+// RegisterFlags defines the -hostSwitch flags that set the options.
+func (o *HostSwitchOptions) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.URL, "hostSwitchURL", DefaultHostSwitchURL,
+		"base URL of the control API of the host-switch of Rancher Desktop networking, used with -forwarder=hostswitch")
+}
+
+// validate fails if the URL is not an http or https one.
+func (o *HostSwitchOptions) validate() error {
+	baseURL, err := url.Parse(o.URL)
+	if err != nil || (baseURL.Scheme != "http" && baseURL.Scheme != "https") || baseURL.Host == "" {
+		return fmt.Errorf("%w: -hostSwitchURL %q must be an http or https URL, e.g. %s",
+			ErrInvalidPeerAddr, o.URL, DefaultHostSwitchURL)
+	}
+
+	return nil
+}
+
+// HostSwitchForwarder exposes the port mappings on the host with the control
+// API of the host-switch of Rancher Desktop networking, which is based on
+// gvisor-tap-vsock, rather than sending them to a peer over vtunnel. Every
+// port binding is exposed at its host IP and port on the host, and forwarded
+// to the same port at the first IPv4 connect address of the port mapping;
+// the host-switch does not expose the IPv6 port bindings, they are skipped.
+type HostSwitchForwarder struct {
+	baseURL string
+	client  http.Client
+	// exposed are the keys of the port bindings that were exposed, which
+	// the snapshots unexpose once they no longer hold them.
+	exposed map[string]struct{}
+	// unreachable is set when the host-switch could not be reached, the
+	// restart handler is called once it is reached again.
+	unreachable bool
+	onRestart   func()
+	mutex       sync.Mutex
+}
+
+// hostSwitchProxy is a port that the host-switch exposes, see GET /services/forwarder/all.
+type hostSwitchProxy struct {
+	Local    string `json:"local"`
+	Remote   string `json:"remote"`
+	Protocol string `json:"protocol"`
+}
+
+// hostSwitchBinding is a port binding as the host-switch exposes it.
+type hostSwitchBinding struct {
+	port     nat.Port
+	binding  nat.PortBinding
+	local    string
+	protocol gvisorTypes.TransportProtocol
+}
+
+func (b hostSwitchBinding) key() string {
+	return hostSwitchKey(string(b.protocol), b.local)
+}
+
+func hostSwitchKey(protocol, local string) string {
+	return protocol + "/" + local
+}
+
+// NewHostSwitchForwarder creates a forwarder for the host-switch API at the given base URL.
+func NewHostSwitchForwarder(baseURL string) *HostSwitchForwarder {
+	return &HostSwitchForwarder{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  http.Client{Timeout: DefaultHostSwitchTimeout},
+		exposed: make(map[string]struct{}),
+	}
+}
+
+// SetTimeout sets the timeout for a single request to the host-switch.
+func (h *HostSwitchForwarder) SetTimeout(timeout time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.client.Timeout = timeout
+}
+
+// SetPeerRestartHandler sets the function that is called when the
+// host-switch is reached again after it could not be, since it may have
+// restarted and lost the ports that it exposed.
+func (h *HostSwitchForwarder) SetPeerRestartHandler(onRestart func()) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.onRestart = onRestart
+}
+
+// Send exposes or unexposes the port mappings, it fails with ErrPortRejected
+// if the host-switch rejected any of the port bindings.
+func (h *HostSwitchForwarder) Send(ctx context.Context, portMapping types.PortMapping) error {
+	results, err := h.SendWithResults(ctx, portMapping)
+	if err != nil {
+		return err
+	}
+
+	return rejectedError(results)
+}
+
+// RemovePorts unexposes all the port mappings, the host-switch is called
+// for each of their port bindings.
+func (h *HostSwitchForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	return h.Send(ctx, MergeRemovals(portMappings))
+}
+
+// SendWithResults exposes or unexposes the port bindings of the port mapping
+// and returns the outcome of every one of them. A snapshot exposes the port
+// bindings that the host-switch does not expose yet, or to another address,
+// and unexposes the ones that were exposed before but are not held anymore.
+// The ports that are already exposed, or that are not exposed when they are
+// unexposed, are not failures; it fails when the host-switch can not be
+// reached, or responds with an unexpected status.
+func (h *HostSwitchForwarder) SendWithResults(ctx context.Context, portMapping types.PortMapping) ([]PortResult, error) {
+	remote := hostSwitchRemote(portMapping.ConnectAddrs)
+	bindings := hostSwitchBindings(portMapping.Ports)
+
+	if portMapping.Replace {
+		return h.replace(ctx, bindings, remote)
+	}
+
+	results := make([]PortResult, 0, len(bindings))
+
+	for _, binding := range bindings {
+		var rejected, err error
+
+		if portMapping.Remove {
+			rejected, err = h.unexpose(ctx, binding)
+		} else {
+			rejected, err = h.expose(ctx, binding, remote)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, PortResult{Port: binding.port, Binding: binding.binding, Err: rejected})
+	}
+
+	return results, nil
+}
+
+// replace applies the snapshot of the port bindings, see SendWithResults.
+func (h *HostSwitchForwarder) replace(ctx context.Context, bindings []hostSwitchBinding, remote string) ([]PortResult, error) {
+	proxies, err := h.all(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	held := make(map[string]struct{}, len(bindings))
+	for _, binding := range bindings {
+		held[binding.key()] = struct{}{}
+	}
+
+	h.mutex.Lock()
+	stale := make([]string, 0, len(h.exposed))
+
+	for key := range h.exposed {
+		if _, ok := held[key]; !ok {
+			stale = append(stale, key)
+		}
+	}
+	h.mutex.Unlock()
+
+	// The stale port bindings are unexposed first, so that their host ports are released.
+	sort.Strings(stale)
+
+	for _, key := range stale {
+		protocol, local, _ := strings.Cut(key, "/")
+
+		rejected, err := h.unexpose(ctx, hostSwitchBinding{local: local, protocol: gvisorTypes.TransportProtocol(protocol)})
+		if err != nil {
+			return nil, err
+		}
+
+		if rejected != nil {
+			logger.Errorf("failed to unexpose the stale port %s on the host-switch: %v", key, rejected)
+		}
+	}
+
+	results := make([]PortResult, 0, len(bindings))
+
+	for _, binding := range bindings {
+		var rejected error
+
+		switch proxy, ok := proxies[binding.key()]; {
+		case ok && remote != "" && proxy.Remote == net.JoinHostPort(remote, binding.binding.HostPort):
+			h.markExposed(binding.key(), true)
+		case ok:
+			// The port is exposed to another address, e.g. before the address of the VM changed.
+			rejected, err = h.unexpose(ctx, binding)
+			if err == nil && rejected == nil {
+				rejected, err = h.expose(ctx, binding, remote)
+			}
+		default:
+			rejected, err = h.expose(ctx, binding, remote)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, PortResult{Port: binding.port, Binding: binding.binding, Err: rejected})
+	}
+
+	return results, nil
+}
+
+// expose exposes the port binding on the host, it returns the rejection of
+// the host-switch, or the error if it could not be reached.
+func (h *HostSwitchForwarder) expose(ctx context.Context, binding hostSwitchBinding, remote string) (error, error) {
+	if remote == "" {
+		return fmt.Errorf("%w to forward %s to", ErrNoIPv4ConnectAddr, binding.local), nil
+	}
+
+	rejected, err := h.post(ctx, hostSwitchExposeAPI, &gvisorTypes.ExposeRequest{
+		Local:    binding.local,
+		Remote:   net.JoinHostPort(remote, binding.binding.HostPort),
+		Protocol: binding.protocol,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if rejected != nil && strings.Contains(rejected.Error(), hostSwitchAlreadyExposed) {
+		logger.Debugf("the port %s is already exposed on the host-switch", binding.key())
+
+		rejected = nil
+	}
+
+	if rejected == nil {
+		h.markExposed(binding.key(), true)
+	}
+
+	return rejected, nil
+}
+
+// unexpose unexposes the port binding on the host, see expose.
+func (h *HostSwitchForwarder) unexpose(ctx context.Context, binding hostSwitchBinding) (error, error) {
+	rejected, err := h.post(ctx, hostSwitchUnexposeAPI, &gvisorTypes.UnexposeRequest{
+		Local:    binding.local,
+		Protocol: binding.protocol,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if rejected != nil && strings.Contains(rejected.Error(), hostSwitchNotExposed) {
+		logger.Debugf("the port %s is not exposed on the host-switch", binding.key())
+
+		rejected = nil
+	}
+
+	if rejected == nil {
+		h.markExposed(binding.key(), false)
+	}
+
+	return rejected, nil
+}
+
+func (h *HostSwitchForwarder) markExposed(key string, exposed bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if exposed {
+		h.exposed[key] = struct{}{}
+	} else {
+		delete(h.exposed, key)
+	}
+}
+
+// all returns the ports that the host-switch exposes by their key.
+func (h *HostSwitchForwarder) all(ctx context.Context) (map[string]hostSwitchProxy, error) {
+	res, err := h.do(ctx, http.MethodGet, hostSwitchAllAPI, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s responded with %s", ErrHostSwitch, hostSwitchAllAPI, res.Status)
+	}
+
+	var list []hostSwitchProxy
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("%w: decoding the response of %s: %w", ErrHostSwitch, hostSwitchAllAPI, err)
+	}
+
+	proxies := make(map[string]hostSwitchProxy, len(list))
+	for _, proxy := range list {
+		proxies[hostSwitchKey(proxy.Protocol, proxy.Local)] = proxy
+	}
+
+	return proxies, nil
+}
+
+// post sends the request to the API, it returns the rejection of the
+// host-switch, which responds with 400 to the requests that it can not
+// decode, e.g. of an invalid address, and with 500 when it can not expose
+// the port, e.g. when the host port is in use; the other responses fail.
+func (h *HostSwitchForwarder) post(ctx context.Context, api string, body any) (error, error) {
+	bin, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := h.do(ctx, http.MethodPost, api, bin)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	message, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error while reading response body: %w", err)
+	}
+
+	errMsg := strings.TrimSpace(string(message))
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return nil, nil
+	case res.StatusCode == http.StatusBadRequest:
+		return fmt.Errorf("%w: %s", ErrHostSwitchInvalidAddr, errMsg), nil
+	case res.StatusCode == http.StatusInternalServerError && strings.Contains(errMsg, hostSwitchAddrInUse):
+		return fmt.Errorf("%w: %s", ErrPortRejected, errMsg), nil
+	case res.StatusCode == http.StatusInternalServerError:
+		return fmt.Errorf("%w: %s", ErrHostSwitch, errMsg), nil
+	default:
+		return nil, fmt.Errorf("%w: %s responded with %s: %s", ErrHostSwitch, api, res.Status, errMsg)
+	}
+}
+
+// do sends the request to the host-switch, and calls the restart handler
+// when it is reached again after it could not be.
+func (h *HostSwitchForwarder) do(ctx context.Context, method, api string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, h.baseURL+api, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	h.mutex.Lock()
+	client := h.client
+	h.mutex.Unlock()
+
+	res, err := client.Do(req)
+
+	h.mutex.Lock()
+	restarted := err == nil && h.unreachable
+	h.unreachable = err != nil
+	onRestart := h.onRestart
+	h.mutex.Unlock()
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrHostSwitchUnreachable, err)
+	}
+
+	if restarted && onRestart != nil {
+		logger.Infof("the host-switch is reachable again")
+		onRestart()
+	}
+
+	return res, nil
+}
+
+// hostSwitchRemote returns the first IPv4 connect address, which the
+// host-switch forwards the ports to.
+func hostSwitchRemote(connectAddrs []types.ConnectAddrs) string {
+	for _, connectAddr := range connectAddrs {
+		if connectAddr.Family == types.FamilyIPv4 && connectAddr.IP != "" {
+			return connectAddr.IP
+		}
+	}
+
+	return ""
+}
+
+// hostSwitchBindings returns the IPv4 port bindings of the ports, sorted.
+func hostSwitchBindings(portMap nat.PortMap) []hostSwitchBinding {
+	ports := make([]nat.Port, 0, len(portMap))
+	for port := range portMap {
+		ports = append(ports, port)
+	}
+
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i] < ports[j]
+	})
+
+	var bindings []hostSwitchBinding
+
+	for _, port := range ports {
+		for _, binding := range portMap[port] {
+			hostIP := binding.HostIP
+			if hostIP == "" {
+				hostIP = "0.0.0.0"
+			}
+
+			if ip := net.ParseIP(hostIP); ip == nil || ip.To4() == nil {
+				logger.Debugf("skipping the port binding %s %s:%s, the host-switch only exposes IPv4", port, hostIP, binding.HostPort)
+
+				continue
+			}
+
+			bindings = append(bindings, hostSwitchBinding{
+				port:     port,
+				binding:  binding,
+				local:    net.JoinHostPort(hostIP, binding.HostPort),
+				protocol: gvisorTypes.TransportProtocol(port.Proto()),
+			})
+		}
+	}
+
+	return bindings
+}
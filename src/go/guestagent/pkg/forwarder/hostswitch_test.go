@@ -0,0 +1,319 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	gvisorTypes "github.com/containers/gvisor-tap-vsock/pkg/types"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// busyPort is in use on the host of the testHostSwitch.
+const busyPort = "9999"
+
+// testHostSwitch stands in for the forwarder API of the host-switch, it
+// responds like the one of gvisor-tap-vsock.
+type testHostSwitch struct {
+	// proxies are the exposed ports by protocol and local address.
+	proxies map[string]gvisorTypes.ExposeRequest
+	// down aborts the requests, as if the host-switch were not running.
+	down     atomic.Bool
+	requests int
+	mutex    sync.Mutex
+}
+
+func newTestHostSwitch(t *testing.T) (*testHostSwitch, *httptest.Server) {
+	t.Helper()
+
+	hostSwitch := &testHostSwitch{proxies: make(map[string]gvisorTypes.ExposeRequest)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services/forwarder/all", hostSwitch.all)
+	mux.HandleFunc("/services/forwarder/expose", hostSwitch.expose)
+	mux.HandleFunc("/services/forwarder/unexpose", hostSwitch.unexpose)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hostSwitch.down.Load() {
+			panic(http.ErrAbortHandler)
+		}
+
+		hostSwitch.mutex.Lock()
+		hostSwitch.requests++
+		hostSwitch.mutex.Unlock()
+
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return hostSwitch, server
+}
+
+func (h *testHostSwitch) all(w http.ResponseWriter, _ *http.Request) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	proxies := make([]gvisorTypes.ExposeRequest, 0, len(h.proxies))
+	for _, proxy := range h.proxies {
+		proxies = append(proxies, proxy)
+	}
+
+	sort.Slice(proxies, func(i, j int) bool {
+		return proxies[i].Local < proxies[j].Local
+	})
+
+	_ = json.NewEncoder(w).Encode(proxies)
+}
+
+func (h *testHostSwitch) expose(w http.ResponseWriter, r *http.Request) {
+	var req gvisorTypes.ExposeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	if _, _, err := net.SplitHostPort(req.Remote); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, port, _ := net.SplitHostPort(req.Local); port == busyPort {
+		http.Error(w, "listen tcp "+req.Local+": bind: address already in use", http.StatusInternalServerError)
+
+		return
+	}
+
+	if _, ok := h.proxies[string(req.Protocol)+"/"+req.Local]; ok {
+		http.Error(w, "proxy already running", http.StatusInternalServerError)
+
+		return
+	}
+
+	h.proxies[string(req.Protocol)+"/"+req.Local] = req
+}
+
+func (h *testHostSwitch) unexpose(w http.ResponseWriter, r *http.Request) {
+	var req gvisorTypes.UnexposeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.proxies[string(req.Protocol)+"/"+req.Local]; !ok {
+		http.Error(w, "proxy not found", http.StatusInternalServerError)
+
+		return
+	}
+
+	delete(h.proxies, string(req.Protocol)+"/"+req.Local)
+}
+
+// exposed returns the remote addresses of the exposed ports by protocol and local address.
+func (h *testHostSwitch) exposed() map[string]string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	exposed := make(map[string]string, len(h.proxies))
+	for key, proxy := range h.proxies {
+		exposed[key] = proxy.Remote
+	}
+
+	return exposed
+}
+
+// hostSwitchConnectAddrs are the addresses of the VM on the network of the host-switch.
+var hostSwitchConnectAddrs = []types.ConnectAddrs{ //nolint:gochecknoglobals
+	types.NewConnectAddrs(&net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)}, "eth0"),
+	types.NewConnectAddrs(&net.IPNet{IP: net.ParseIP("192.168.127.2").To4(), Mask: net.CIDRMask(24, 32)}, "eth0"),
+}
+
+func TestHostSwitchForwarderSend(t *testing.T) {
+	t.Parallel()
+
+	hostSwitch, server := newTestHostSwitch(t)
+	hostSwitchForwarder := forwarder.NewHostSwitchForwarder(server.URL)
+
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}, {HostIP: "::1", HostPort: "8080"}},
+			"53/udp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "5353"}},
+		},
+		ConnectAddrs: hostSwitchConnectAddrs,
+	}
+
+	// The IPv6 port bindings are not exposed, they are forwarded to the IPv4 address of the VM.
+	results, err := hostSwitchForwarder.SendWithResults(context.Background(), portMapping)
+	require.NoError(t, err)
+	assert.Equal(t, []forwarder.PortResult{
+		{Port: "53/udp", Binding: nat.PortBinding{HostIP: "0.0.0.0", HostPort: "5353"}},
+		{Port: "80/tcp", Binding: nat.PortBinding{HostIP: "127.0.0.1", HostPort: "8080"}},
+	}, results)
+	assert.Equal(t, map[string]string{
+		"tcp/127.0.0.1:8080": "192.168.127.2:8080",
+		"udp/0.0.0.0:5353":   "192.168.127.2:5353",
+	}, hostSwitch.exposed())
+
+	// Exposing the ports again is not a failure.
+	require.NoError(t, hostSwitchForwarder.Send(context.Background(), portMapping))
+
+	portMapping.Remove = true
+	require.NoError(t, hostSwitchForwarder.Send(context.Background(), portMapping))
+	assert.Empty(t, hostSwitch.exposed())
+
+	// Nor is unexposing the ports that are not exposed.
+	require.NoError(t, hostSwitchForwarder.RemovePorts(context.Background(), []types.PortMapping{portMapping}))
+}
+
+func TestHostSwitchForwarderErrorResponse(t *testing.T) {
+	t.Parallel()
+
+	_, server := newTestHostSwitch(t)
+	hostSwitchForwarder := forwarder.NewHostSwitchForwarder(server.URL)
+
+	portMapping := testPortMapping(false, "80/tcp", nat.Port(busyPort+"/tcp"))
+	portMapping.ConnectAddrs = hostSwitchConnectAddrs
+
+	results, err := hostSwitchForwarder.SendWithResults(context.Background(), portMapping)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.NoError(t, results[0].Err)
+	require.ErrorIs(t, results[1].Err, forwarder.ErrPortRejected)
+
+	err = hostSwitchForwarder.Send(context.Background(), portMapping)
+	require.ErrorIs(t, err, forwarder.ErrPortRejected)
+	assert.Contains(t, err.Error(), "9999/tcp 127.0.0.1:9999: port binding rejected by the host: "+
+		"listen tcp 127.0.0.1:9999: bind: address already in use")
+
+	// The ports can not be forwarded without an IPv4 address of the VM.
+	portMapping = testPortMapping(false, "80/tcp")
+	portMapping.ConnectAddrs = hostSwitchConnectAddrs[:1]
+
+	results, err = hostSwitchForwarder.SendWithResults(context.Background(), portMapping)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.ErrorIs(t, results[0].Err, forwarder.ErrNoIPv4ConnectAddr)
+
+	// The host-switch rejects the addresses that it can not parse.
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "address 127.0.0.1:http: invalid port", http.StatusBadRequest)
+	}))
+	t.Cleanup(invalid.Close)
+
+	portMapping.Ports = nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "http"}}}
+	portMapping.ConnectAddrs = hostSwitchConnectAddrs
+
+	results, err = forwarder.NewHostSwitchForwarder(invalid.URL).SendWithResults(context.Background(), portMapping)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.ErrorIs(t, results[0].Err, forwarder.ErrHostSwitchInvalidAddr)
+
+	// The responses that are not the ones of the host-switch fail the request.
+	err = forwarder.NewHostSwitchForwarder(server.URL+"/missing").Send(context.Background(), portMapping)
+	require.ErrorIs(t, err, forwarder.ErrHostSwitch)
+	assert.Contains(t, err.Error(), "404 Not Found")
+}
+
+func TestHostSwitchForwarderSnapshot(t *testing.T) {
+	t.Parallel()
+
+	hostSwitch, server := newTestHostSwitch(t)
+	hostSwitchForwarder := forwarder.NewHostSwitchForwarder(server.URL)
+
+	// The host-switch also exposes the ports of its own configuration, which are left alone.
+	hostSwitch.proxies["tcp/127.0.0.1:2222"] = gvisorTypes.ExposeRequest{Local: "127.0.0.1:2222", Remote: "192.168.127.2:22", Protocol: "tcp"}
+
+	portMapping := testPortMapping(false, "80/tcp", "443/tcp")
+	portMapping.ConnectAddrs = hostSwitchConnectAddrs
+	require.NoError(t, hostSwitchForwarder.Send(context.Background(), portMapping))
+
+	// A port is exposed to the address that the VM had before.
+	hostSwitch.proxies["tcp/127.0.0.1:443"] = gvisorTypes.ExposeRequest{Local: "127.0.0.1:443", Remote: "192.168.127.3:443", Protocol: "tcp"}
+
+	snapshot := testPortMapping(false, "443/tcp", "3000/tcp")
+	snapshot.ConnectAddrs = hostSwitchConnectAddrs
+	snapshot.Replace = true
+
+	results, err := hostSwitchForwarder.SendWithResults(context.Background(), snapshot)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.NoError(t, results[0].Err)
+	require.NoError(t, results[1].Err)
+	assert.Equal(t, map[string]string{
+		"tcp/127.0.0.1:2222": "192.168.127.2:22",
+		"tcp/127.0.0.1:443":  "192.168.127.2:443",
+		"tcp/127.0.0.1:3000": "192.168.127.2:3000",
+	}, hostSwitch.exposed())
+
+	// The snapshot of the same ports only lists them.
+	hostSwitch.mutex.Lock()
+	hostSwitch.requests = 0
+	hostSwitch.mutex.Unlock()
+
+	require.NoError(t, hostSwitchForwarder.Send(context.Background(), snapshot))
+
+	hostSwitch.mutex.Lock()
+	defer hostSwitch.mutex.Unlock()
+	assert.Equal(t, 1, hostSwitch.requests)
+}
+
+func TestHostSwitchForwarderRestart(t *testing.T) {
+	t.Parallel()
+
+	hostSwitch, server := newTestHostSwitch(t)
+	hostSwitchForwarder := forwarder.NewHostSwitchForwarder(server.URL)
+
+	var restarts atomic.Int32
+
+	hostSwitchForwarder.SetPeerRestartHandler(func() { restarts.Add(1) })
+
+	portMapping := testPortMapping(false, "80/tcp")
+	portMapping.ConnectAddrs = hostSwitchConnectAddrs
+	require.NoError(t, hostSwitchForwarder.Send(context.Background(), portMapping))
+
+	hostSwitch.down.Store(true)
+
+	err := hostSwitchForwarder.Send(context.Background(), portMapping)
+	require.ErrorIs(t, err, forwarder.ErrHostSwitchUnreachable)
+	assert.Zero(t, restarts.Load())
+
+	// The host-switch may have lost the ports once it is reached again.
+	hostSwitch.down.Store(false)
+
+	require.NoError(t, hostSwitchForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, int32(1), restarts.Load())
+
+	require.NoError(t, hostSwitchForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, int32(1), restarts.Load())
+}
@@ -0,0 +1,225 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// hvsockServiceSuffix is the part of the Hyper-V socket service IDs that
+// the Linux guests reach over AF_VSOCK, the first part is the vsock port.
+const hvsockServiceSuffix = "-FACB-11E6-BD58-64006A7986D3"
+
+var ErrInvalidHvsockService = errors.New("invalid Hyper-V socket service ID")
+
+// HvsockServiceID returns the Hyper-V socket service ID of the vsock port,
+// which the host registers to accept the connections from the guests.
+func HvsockServiceID(port uint32) string {
+	return fmt.Sprintf("%08X%s", port, hvsockServiceSuffix)
+}
+
+// ParseHvsockService returns the vsock port of the service, which is
+// either a Hyper-V socket service ID, see HvsockServiceID, or the port itself.
+func ParseHvsockService(service string) (uint32, error) {
+	if port, err := strconv.ParseUint(service, 10, 32); err == nil {
+		return uint32(port), nil
+	}
+
+	prefix, suffix, ok := strings.Cut(service, "-")
+	if !ok || len(prefix) != 8 || !strings.EqualFold("-"+suffix, hvsockServiceSuffix) {
+		return 0, fmt.Errorf("%w: %q is neither a port nor in the XXXXXXXX%s format",
+			ErrInvalidHvsockService, service, hvsockServiceSuffix)
+	}
+
+	port, err := strconv.ParseUint(prefix, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q: %w", ErrInvalidHvsockService, service, err)
+	}
+
+	return uint32(port), nil
+}
+
+// HvsockOptions configure the hvsock forwarder,
+// its fallback is configured like the vtunnel forwarder.
+type HvsockOptions struct {
+	// Service is the Hyper-V socket service ID of the host, or its vsock port; see ParseHvsockService.
+	Service string
+}
+
+// RegisterFlags defines the -hvsock flags that set the options.
+func (o *HvsockOptions) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.Service, "hvsockService", HvsockServiceID(defaultVsockPort),
+		"Hyper-V socket service ID on the Windows host to forward the port mappings to, or its vsock port; "+
+			"used with -forwarder=hvsock, which falls back to -vtunnelAddr when AF_VSOCK is not available")
+}
+
+// HvsockForwarder forwards the PortMappings to the Windows host over a
+// Hyper-V socket on WSL2, which the guest dials over AF_VSOCK with the host
+// CID; unlike the vtunnel relay, it does not depend on the eth0 NAT address,
+// so the VPNs and the network switches do not break it. If the kernel does
+// not support AF_VSOCK, the port mappings are sent to the fallback instead.
+type HvsockForwarder struct {
+	*VTunnelForwarder
+	fallback *VTunnelForwarder
+	// unavailable is set once AF_VSOCK was found not to be available,
+	// the port mappings are only sent to the fallback from then on.
+	unavailable atomic.Bool
+}
+
+// NewHvsockForwarder creates a forwarder that connects to the given
+// vsock port of the host, and to fallback if AF_VSOCK is not available.
+func NewHvsockForwarder(port uint32, fallback *VTunnelForwarder) *HvsockForwarder {
+	return &HvsockForwarder{
+		VTunnelForwarder: newVsockTunnel(unix.VMADDR_CID_HOST, port),
+		fallback:         fallback,
+	}
+}
+
+// Send forwards the port mappings to the host, see VTunnelForwarder.Send.
+func (h *HvsockForwarder) Send(ctx context.Context, portMapping types.PortMapping) error {
+	results, err := h.SendWithResults(ctx, portMapping)
+	if err != nil {
+		return err
+	}
+
+	return rejectedError(results)
+}
+
+// SendWithResults forwards the port mappings to the host
+// and returns the outcome of every port binding that it reported.
+func (h *HvsockForwarder) SendWithResults(ctx context.Context, portMapping types.PortMapping) ([]PortResult, error) {
+	if !h.unavailable.Load() {
+		results, err := h.VTunnelForwarder.SendWithResults(ctx, portMapping)
+		if !h.fallBack(err) {
+			return results, err
+		}
+	}
+
+	return h.fallback.SendWithResults(ctx, portMapping)
+}
+
+// RemovePorts withdraws the port mappings from the host, see VTunnelForwarder.RemovePorts.
+func (h *HvsockForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	if !h.unavailable.Load() {
+		err := h.VTunnelForwarder.RemovePorts(ctx, portMappings)
+		if !h.fallBack(err) {
+			return err
+		}
+	}
+
+	return h.fallback.RemovePorts(ctx, portMappings)
+}
+
+// Ping sends a heartbeat to the host, see VTunnelForwarder.Ping.
+func (h *HvsockForwarder) Ping(ctx context.Context) error {
+	if !h.unavailable.Load() {
+		err := h.VTunnelForwarder.Ping(ctx)
+		if !h.fallBack(err) {
+			return err
+		}
+	}
+
+	return h.fallback.Ping(ctx)
+}
+
+// LastContact returns when the host last accepted a payload.
+func (h *HvsockForwarder) LastContact() time.Time {
+	if h.unavailable.Load() {
+		return h.fallback.LastContact()
+	}
+
+	return h.VTunnelForwarder.LastContact()
+}
+
+// ConnectionStats returns the number of retries and reconnects over both of the connections.
+func (h *HvsockForwarder) ConnectionStats() (retries, reconnects uint64) {
+	retries, reconnects = h.VTunnelForwarder.ConnectionStats()
+	fallbackRetries, fallbackReconnects := h.fallback.ConnectionStats()
+
+	return retries + fallbackRetries, reconnects + fallbackReconnects
+}
+
+// PingPeriodically calls Ping at every given interval
+// until the context is cancelled.
+func (h *HvsockForwarder) PingPeriodically(ctx context.Context, interval time.Duration) {
+	pingPeriodically(ctx, interval, h.Ping, h.LastContact)
+}
+
+// SetPeerRestartHandler sets the function that is called when the host
+// is detected to have restarted, over either of the connections.
+func (h *HvsockForwarder) SetPeerRestartHandler(onRestart func()) {
+	h.VTunnelForwarder.SetPeerRestartHandler(onRestart)
+	h.fallback.SetPeerRestartHandler(onRestart)
+}
+
+// SetReservedPortsHandler sets the function that is called when the host
+// ports that the host reports to be reserved change, over either of the connections.
+func (h *HvsockForwarder) SetReservedPortsHandler(onReserved func()) {
+	h.VTunnelForwarder.SetReservedPortsHandler(onReserved)
+	h.fallback.SetReservedPortsHandler(onReserved)
+}
+
+// ReservedPorts returns the host ports that the host reported to be reserved
+// over the connection that is in use, see VTunnelForwarder.ReservedPorts.
+func (h *HvsockForwarder) ReservedPorts() []types.ReservedPorts {
+	if h.unavailable.Load() {
+		return h.fallback.ReservedPorts()
+	}
+
+	return h.VTunnelForwarder.ReservedPorts()
+}
+
+// Compatibility returns how the agent works with the host over the connection
+// that is in use, see VTunnelForwarder.Compatibility.
+func (h *HvsockForwarder) Compatibility() *Compatibility {
+	if h.unavailable.Load() {
+		return h.fallback.Compatibility()
+	}
+
+	return h.VTunnelForwarder.Compatibility()
+}
+
+// AcknowledgedCapabilities returns the capabilities that the host acknowledged over
+// the connection that is in use, see VTunnelForwarder.AcknowledgedCapabilities.
+func (h *HvsockForwarder) AcknowledgedCapabilities() []string {
+	if h.unavailable.Load() {
+		return h.fallback.AcknowledgedCapabilities()
+	}
+
+	return h.VTunnelForwarder.AcknowledgedCapabilities()
+}
+
+// fallBack returns true if the error shows that AF_VSOCK is not available,
+// in which case the fallback is used from then on.
+func (h *HvsockForwarder) fallBack(err error) bool {
+	if !vsockUnavailable(err) {
+		return false
+	}
+
+	if h.unavailable.CompareAndSwap(false, true) {
+		logger.Warnf("AF_VSOCK is not available, falling back to the vtunnel peer at %s: %v", h.fallback.ActivePeer(), err)
+	}
+
+	return true
+}
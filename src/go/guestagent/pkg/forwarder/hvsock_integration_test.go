@@ -0,0 +1,70 @@
+//go:build integration
+
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// TestHvsockForwarderLoopbackIntegration sends a port mapping over a
+// real AF_VSOCK socket, the host CID is replaced by the local one.
+func TestHvsockForwarderLoopbackIntegration(t *testing.T) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Skipf("AF_VSOCK is not supported: %v", err)
+	}
+
+	listener := os.NewFile(uintptr(fd), "vsock-listener")
+	t.Cleanup(func() { listener.Close() })
+
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_LOCAL, Port: unix.VMADDR_PORT_ANY}); err != nil {
+		t.Skipf("AF_VSOCK loopback is not supported: %v", err)
+	}
+
+	require.NoError(t, unix.Listen(fd, 1))
+
+	sa, err := unix.Getsockname(fd)
+	require.NoError(t, err)
+
+	port := sa.(*unix.SockaddrVM).Port
+	portMaps := make(chan types.PortMapping, 1)
+
+	go serveVsockPeer(fd, portMaps)
+
+	fallbackPeer := newTestPeer(t, 0)
+	hvsockForwarder := forwarder.NewHvsockForwarder(port,
+		forwarder.NewVTunnelForwarder(fallbackPeer.listener.Addr().String()))
+	hvsockForwarder.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		assert.Equal(t, fmt.Sprintf("%d:%d", unix.VMADDR_CID_HOST, port), address)
+
+		return forwarder.DialVsock(ctx, network, fmt.Sprintf("%d:%d", unix.VMADDR_CID_LOCAL, port))
+	})
+
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, hvsockForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, <-portMaps)
+	assert.Zero(t, fallbackPeer.dialCount())
+}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHvsockServiceID(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "00000BE0-FACB-11E6-BD58-64006A7986D3", forwarder.HvsockServiceID(3040))
+
+	for service, expected := range map[string]uint32{
+		"3040":                                 3040,
+		"00000BE0-FACB-11E6-BD58-64006A7986D3": 3040,
+		"00000be0-facb-11e6-bd58-64006a7986d3": 3040,
+	} {
+		port, err := forwarder.ParseHvsockService(service)
+		require.NoError(t, err, service)
+		assert.Equal(t, expected, port, service)
+	}
+
+	for _, service := range []string{
+		"",
+		"port",
+		"00000BE0-0000-0000-0000-000000000000",
+		"0BE0-FACB-11E6-BD58-64006A7986D3",
+		"XXXXXXXX-FACB-11E6-BD58-64006A7986D3",
+	} {
+		_, err := forwarder.ParseHvsockService(service)
+		require.ErrorIs(t, err, forwarder.ErrInvalidHvsockService, service)
+	}
+}
+
+func TestHvsockForwarderMockedDialer(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	fallbackPeer := newTestPeer(t, 0)
+	hvsockForwarder := forwarder.NewHvsockForwarder(vsockPort,
+		forwarder.NewVTunnelForwarder(fallbackPeer.listener.Addr().String()))
+	hvsockForwarder.SetDialer(func(_ context.Context, network, address string) (net.Conn, error) {
+		assert.Equal(t, forwarder.VsockNetwork, network)
+		assert.Equal(t, "2:3040", address)
+
+		return net.Dial("tcp", peer.listener.Addr().String())
+	})
+
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, hvsockForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, peer.receive(t))
+	assert.Zero(t, fallbackPeer.dialCount())
+}
+
+func TestHvsockForwarderFallback(t *testing.T) {
+	t.Parallel()
+
+	var dials atomic.Int32
+
+	fallbackPeer := newTestPeer(t, 0)
+	hvsockForwarder := forwarder.NewHvsockForwarder(vsockPort,
+		forwarder.NewVTunnelForwarder(fallbackPeer.listener.Addr().String()))
+	hvsockForwarder.SetDialer(func(_ context.Context, network, _ string) (net.Conn, error) {
+		dials.Add(1)
+
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)}
+	})
+
+	// The port mappings are sent over TCP once AF_VSOCK is found not to be available.
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, hvsockForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, fallbackPeer.receive(t))
+
+	require.NoError(t, hvsockForwarder.RemovePorts(context.Background(), []types.PortMapping{
+		testPortMapping(true, "80/tcp"),
+	}))
+	assert.Equal(t, testPortMapping(true, "80/tcp"), fallbackPeer.receive(t))
+
+	require.NoError(t, hvsockForwarder.Ping(context.Background()))
+	assert.Equal(t, int32(1), dials.Load())
+}
+
+func TestHvsockForwarderNoFallback(t *testing.T) {
+	t.Parallel()
+
+	fallbackPeer := newTestPeer(t, 0)
+	hvsockForwarder := forwarder.NewHvsockForwarder(vsockPort,
+		forwarder.NewVTunnelForwarder(fallbackPeer.listener.Addr().String()))
+	hvsockForwarder.SetDialer(func(_ context.Context, network, _ string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNRESET)}
+	})
+
+	// The host not accepting the connection does not mean that AF_VSOCK is not available.
+	err := hvsockForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	assert.Zero(t, fallbackPeer.dialCount())
+}
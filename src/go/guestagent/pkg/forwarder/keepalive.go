@@ -0,0 +1,165 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	defaultKeepAliveIdle     = 15 * time.Second
+	defaultKeepAliveInterval = 5 * time.Second
+	defaultKeepAliveCount    = 3
+	defaultWriteTimeout      = 2 * time.Second
+)
+
+// ErrPeerUnresponsive is returned when a connection to the peer stopped
+// making progress, e.g. it was left half-open after the network of WSL was
+// reset; the peer is then treated as unreachable, and the port mappings are
+// sent again once it is reached.
+var ErrPeerUnresponsive = errors.New("vtunnel peer is unresponsive")
+
+// KeepAlive configures the TCP keepalive of the connections to the peer:
+// the probes start after Idle without any traffic, they are sent every
+// Interval, and the connection fails after Count of them are not answered.
+// The data that is not acknowledged within the same bound fails the
+// connection as well, see TCP_USER_TIMEOUT. The Interval and the Count that
+// are zero are left to the kernel.
+type KeepAlive struct {
+	Idle     time.Duration
+	Interval time.Duration
+	Count    int
+}
+
+// SetKeepAlive enables the TCP keepalive of every connection to the peer,
+// including the ones after it was reconnected to; it does not apply to the
+// unix domain sockets and to the vsock connections.
+func (v *VTunnelForwarder) SetKeepAlive(keepAlive KeepAlive) {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	v.keepAlive = keepAlive
+}
+
+// SetWriteTimeout bounds every write to the peer, which otherwise blocks for
+// as long as the peer does not read, e.g. for minutes on a half-open
+// connection; it is unbounded when it is zero.
+func (v *VTunnelForwarder) SetWriteTimeout(timeout time.Duration) {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	v.writeTimeout = timeout
+}
+
+// tune applies the keepalive to the TCP connection, the failures are only
+// logged since the connection works without it.
+func (v *VTunnelForwarder) tune(conn net.Conn) {
+	if v.keepAlive.Idle <= 0 {
+		return
+	}
+
+	syscallConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+
+	if _, ok := conn.LocalAddr().(*net.TCPAddr); !ok {
+		return
+	}
+
+	rawConn, err := syscallConn.SyscallConn()
+	if err != nil {
+		logger.Debugf("failed to set the keepalive of the vtunnel connection: %v", err)
+
+		return
+	}
+
+	var setErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		setErr = v.keepAlive.set(int(fd))
+	})
+	if err = errors.Join(err, setErr); err != nil {
+		logger.Debugf("failed to set the keepalive of the vtunnel connection: %v", err)
+	}
+}
+
+// set sets the keepalive options of the socket, the durations are rounded
+// up to the seconds that the kernel counts them in.
+func (k KeepAlive) set(fd int) error {
+	seconds := func(d time.Duration) int {
+		return int(max((d+time.Second-1)/time.Second, 1))
+	}
+
+	userTimeout := k.Idle
+
+	errs := []error{
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_KEEPALIVE, 1),
+		unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE, seconds(k.Idle)),
+	}
+
+	if k.Interval > 0 {
+		errs = append(errs, unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, seconds(k.Interval)))
+	}
+
+	if k.Count > 0 {
+		errs = append(errs, unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, k.Count))
+	}
+
+	if k.Interval > 0 && k.Count > 0 {
+		userTimeout += k.Interval * time.Duration(k.Count)
+		errs = append(errs, unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(userTimeout.Milliseconds())))
+	}
+
+	return errors.Join(errs...)
+}
+
+// setWriteDeadline bounds the next write to the peer, see SetWriteTimeout.
+func (v *VTunnelForwarder) setWriteDeadline(conn net.Conn) {
+	if v.writeTimeout > 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(v.writeTimeout))
+	}
+}
+
+// unresponsive returns true if the error tells that the connection to the
+// peer stopped making progress: a write timed out, or the keepalive probes
+// were not answered.
+func unresponsive(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// writeError reports the failure to write to the peer. A peer that stopped
+// responding, while the context is not done, is unreachable from then on,
+// so that the protocol is negotiated again and the port mappings are sent
+// again once it is reached, like after it restarted.
+func (v *VTunnelForwarder) writeError(ctx context.Context, err error) error {
+	if ctx.Err() != nil || !unresponsive(err) {
+		return sendError(ctx, err)
+	}
+
+	logger.Warnf("vtunnel peer %s stopped responding, reconnecting: %v", v.peers[v.active].address, err)
+
+	v.unreachable = true
+	v.negotiated = false
+
+	return fmt.Errorf("%w: %w", ErrPeerUnresponsive, err)
+}
@@ -0,0 +1,194 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// socketOptions are the keepalive options that a connection was closed with.
+type socketOptions struct {
+	keepAlive, idle, interval, count, userTimeout int
+}
+
+// inspectedConn records the socket options of the connection when it is
+// closed, that is after the forwarder tuned it.
+type inspectedConn struct {
+	*net.TCPConn
+	options chan<- socketOptions
+}
+
+func (c inspectedConn) Close() error {
+	var options socketOptions
+
+	rawConn, err := c.SyscallConn()
+	if err == nil {
+		_ = rawConn.Control(func(fd uintptr) {
+			options.keepAlive, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_KEEPALIVE)
+			options.idle, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+			options.interval, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL)
+			options.count, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPCNT)
+			options.userTimeout, _ = unix.GetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT)
+		})
+	}
+
+	c.options <- options
+
+	return c.TCPConn.Close()
+}
+
+func TestVTunnelForwarderKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	options := make(chan socketOptions, 10)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.SetKeepAlive(forwarder.KeepAlive{Idle: 15 * time.Second, Interval: 5 * time.Second, Count: 3})
+	vtunnelForwarder.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := peer.dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		return inspectedConn{TCPConn: conn.(*net.TCPConn), options: options}, nil
+	})
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+
+	// The reconnections are tuned as well.
+	vtunnelForwarder.Reconnect()
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	peer.receive(t)
+
+	expected := socketOptions{keepAlive: 1, idle: 15, interval: 5, count: 3, userTimeout: 30000}
+
+	// Each send negotiates the protocol over a connection of its own first.
+	for range 4 {
+		select {
+		case actual := <-options:
+			assert.Equal(t, expected, actual)
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timed out waiting for the connection to be closed")
+		}
+	}
+}
+
+// blackholeListener accepts the connections but never reads from them
+// while it is set, like a peer whose end of the connections is gone
+// without the agent being told.
+type blackholeListener struct {
+	net.Listener
+	blackhole atomic.Bool
+	mutex     sync.Mutex
+	parked    []net.Conn
+}
+
+func (l *blackholeListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || !l.blackhole.Load() {
+			return conn, err
+		}
+
+		l.mutex.Lock()
+		l.parked = append(l.parked, conn)
+		l.mutex.Unlock()
+	}
+}
+
+func (l *blackholeListener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, conn := range l.parked {
+		conn.Close()
+	}
+
+	return l.Listener.Close()
+}
+
+// smallBuffer shrinks the socket buffer, so that a write to a peer that
+// does not read blocks as soon as possible.
+func smallBuffer(option int) func(network, address string, rawConn syscall.RawConn) error {
+	return func(_, _ string, rawConn syscall.RawConn) error {
+		var err error
+
+		controlErr := rawConn.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, option, 4096)
+		})
+		if controlErr != nil {
+			return controlErr
+		}
+
+		return err
+	}
+}
+
+func TestVTunnelForwarderUnresponsivePeer(t *testing.T) {
+	t.Parallel()
+
+	listener, err := (&net.ListenConfig{Control: smallBuffer(unix.SO_RCVBUF)}).Listen(context.Background(), "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	blackhole := &blackholeListener{Listener: listener}
+	peer := serveTestPeer(t, blackhole, 0)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.SetWriteTimeout(200 * time.Millisecond)
+	vtunnelForwarder.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+		return (&net.Dialer{Control: smallBuffer(unix.SO_SNDBUF)}).DialContext(ctx, network, address)
+	})
+
+	var restarts atomic.Int32
+	vtunnelForwarder.SetPeerRestartHandler(func() {
+		restarts.Add(1)
+	})
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+	assert.Zero(t, restarts.Load())
+
+	// The payload is much larger than the socket buffers, so that its write blocks.
+	ports := make([]nat.Port, 0, 5000)
+	for port := 1024; port < 6024; port++ {
+		ports = append(ports, nat.Port(fmt.Sprintf("%d/tcp", port)))
+	}
+
+	blackhole.blackhole.Store(true)
+
+	start := time.Now()
+	err = vtunnelForwarder.Send(context.Background(), testPortMapping(false, ports...))
+	require.ErrorIs(t, err, forwarder.ErrPeerUnresponsive)
+	assert.Less(t, time.Since(start), 2*time.Second)
+
+	// The port mappings are sent again once the peer responds.
+	blackhole.blackhole.Store(false)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+	assert.Equal(t, int32(1), restarts.Load())
+}
@@ -0,0 +1,26 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import "github.com/Masterminds/log-go"
+
+// logger logs the forwarders, which log the payloads they send at the trace level; it is the
+// logger of log-go until SetLogger sets another one.
+var logger = log.Current //nolint:gochecknoglobals
+
+// SetLogger sets the logger of the package, usually a named logger so that
+// its level can be set on its own. It must be called before the package logs.
+func SetLogger(l log.Logger) {
+	logger = l
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// ErrLogsNotSupported is returned by SendLogs when the peer
+// did not negotiate types.FeatureLogs, or not yet.
+var ErrLogsNotSupported = errors.New("the vtunnel peer does not accept the logs of the agent")
+
+// SendLogs sends the log lines to the peer, on their own, if it accepts them.
+// The batch is not queued nor resent when it can not be delivered, the lines
+// are in the local logs regardless. Like on Ping, the queued port mappings are
+// sent first, and a peer that restarted is detected.
+func (v *VTunnelForwarder) SendLogs(ctx context.Context, batch types.LogBatch) error {
+	v.sendMutex.Lock()
+
+	if !slices.Contains(v.features, types.FeatureLogs) {
+		v.sendMutex.Unlock()
+
+		return ErrLogsNotSupported
+	}
+
+	_, restarted, err := v.deliver(ctx, types.PortMapping{
+		Ports:        nat.PortMap{},
+		ConnectAddrs: []types.ConnectAddrs{},
+		Logs:         &batch,
+	})
+	v.sendMutex.Unlock()
+
+	if restarted {
+		v.peerRestarted()
+	}
+
+	return err
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVTunnelForwarderSendLogs(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setFeatures(types.FeatureLogs)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	batch := types.LogBatch{
+		Records: []types.LogRecord{{
+			Time:    time.Date(2026, 3, 2, 10, 0, 0, 0, time.UTC),
+			Level:   "warn",
+			Logger:  "kube",
+			Message: "kubernetes: got error, rolling back",
+			Fields:  map[string]string{"error": "connection refused"},
+		}},
+		Dropped: 2,
+	}
+
+	// The logs are not sent before the peer told that it accepts them.
+	require.ErrorIs(t, vtunnelForwarder.SendLogs(context.Background(), batch), forwarder.ErrLogsNotSupported)
+	assert.Zero(t, peer.helloCount())
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+
+	require.NoError(t, vtunnelForwarder.SendLogs(context.Background(), batch))
+
+	received := peer.receive(t)
+	require.NotNil(t, received.Logs)
+	assert.Equal(t, batch, *received.Logs)
+	assert.Empty(t, received.Ports)
+	assert.False(t, received.Remove)
+}
+
+func TestVTunnelForwarderSendLogsNotSupported(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setFeatures(types.FeatureBulkRemove)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+
+	err := vtunnelForwarder.SendLogs(context.Background(), types.LogBatch{Records: []types.LogRecord{{Message: "lost"}}})
+	require.ErrorIs(t, err, forwarder.ErrLogsNotSupported)
+
+	// The next payload that the peer receives is the next port mapping.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	assert.Nil(t, peer.receive(t).Logs)
+}
@@ -0,0 +1,316 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// The categories that the failed sends are counted by.
+const (
+	FailureUnreachable = "unreachable"
+	FailureTimeout     = "timeout"
+	FailureCancelled   = "cancelled"
+	FailureRejected    = "rejected"
+	FailureUnavailable = "unavailable"
+	FailureOther       = "other"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of the send latency
+// histogram, the sends that take longer are counted in a last bucket.
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	30 * time.Second,
+}
+
+// ConnectionStats is implemented by the forwarders that keep track of
+// their connection to the peer.
+type ConnectionStats interface {
+	// ConnectionStats returns the number of retries after the peer refused
+	// a send, and the number of times that the peer was reached again after
+	// it was unreachable or after failing over.
+	ConnectionStats() (retries, reconnects uint64)
+}
+
+// Metrics describe how the sends of a MetricsForwarder went.
+type Metrics struct {
+	// Sends is the number of sends, including the failed ones.
+	Sends uint64 `json:"sends"`
+	// Failures is the number of failed sends by category, e.g. FailureTimeout.
+	Failures map[string]uint64 `json:"failures"`
+	// Retries and Reconnects are reported by the forwarders that implement ConnectionStats.
+	Retries    uint64 `json:"retries"`
+	Reconnects uint64 `json:"reconnects"`
+	// LatencyCounts is the number of sends within each of the LatencyBuckets,
+	// the last count is the number of sends that took longer.
+	LatencyCounts []uint64 `json:"latencyCounts"`
+	// LatencySum is the total duration of the sends.
+	LatencySum time.Duration `json:"latencySum"`
+	// LastSuccess is when a send last succeeded, it is zero if none did.
+	LastSuccess time.Time `json:"lastSuccess"`
+	// LastError is the error of the last send if it failed.
+	LastError string `json:"lastError,omitempty"`
+}
+
+// FailureCount returns the number of failed sends of all the categories.
+func (m Metrics) FailureCount() uint64 {
+	var failures uint64
+	for _, count := range m.Failures {
+		failures += count
+	}
+
+	return failures
+}
+
+// MetricsForwarder wraps any Forwarder to count its sends and failures,
+// and to measure how long every send takes; every send is also traced, as a
+// child of the span of its context, see tracing.Start.
+type MetricsForwarder struct {
+	Forwarder
+	metrics Metrics
+	mutex   sync.Mutex
+}
+
+// NewMetricsForwarder creates a forwarder that instruments the given forwarder.
+func NewMetricsForwarder(forwarder Forwarder) *MetricsForwarder {
+	return &MetricsForwarder{
+		Forwarder: forwarder,
+		metrics: Metrics{
+			Failures:      make(map[string]uint64),
+			LatencyCounts: make([]uint64, len(LatencyBuckets)+1),
+		},
+	}
+}
+
+// Send forwards the port mappings with the wrapped forwarder.
+func (m *MetricsForwarder) Send(ctx context.Context, portMapping types.PortMapping) error {
+	ctx, span := startSend(ctx, portMapping)
+	defer span.End()
+
+	start := time.Now()
+	err := m.Forwarder.Send(ctx, portMapping)
+	m.observe(start, err)
+	span.RecordError(err)
+
+	return err
+}
+
+// SendWithResults forwards the port mappings with the wrapped forwarder, the
+// results are only returned if it implements ResultForwarder.
+func (m *MetricsForwarder) SendWithResults(ctx context.Context, portMapping types.PortMapping) ([]PortResult, error) {
+	resultForwarder, ok := m.Forwarder.(ResultForwarder)
+	if !ok {
+		return nil, m.Send(ctx, portMapping)
+	}
+
+	ctx, span := startSend(ctx, portMapping)
+	defer span.End()
+
+	start := time.Now()
+	results, err := resultForwarder.SendWithResults(ctx, portMapping)
+	m.observe(start, err)
+	span.RecordError(err)
+
+	return results, err
+}
+
+// RemovePorts withdraws the port mappings with the wrapped forwarder,
+// which is counted as a single send.
+func (m *MetricsForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	ctx, span := startSend(ctx, portMappings...)
+	defer span.End()
+
+	start := time.Now()
+	err := m.Forwarder.RemovePorts(ctx, portMappings)
+	m.observe(start, err)
+	span.RecordError(err)
+
+	return err
+}
+
+// startSend starts the span of a send of the port mappings, with the
+// correlation IDs of their changes.
+func startSend(ctx context.Context, portMappings ...types.PortMapping) (context.Context, *tracing.Span) {
+	ctx, span := tracing.Start(ctx, "forwarder.send")
+	if span == nil {
+		return ctx, nil
+	}
+
+	var (
+		correlationIDs []string
+		ports          int
+		remove         bool
+	)
+
+	for _, portMapping := range portMappings {
+		remove = remove || portMapping.Remove
+		for _, bindings := range portMapping.Ports {
+			ports += len(bindings)
+		}
+
+		for _, metadata := range portMapping.Metadata {
+			if id := metadata[types.MetadataCorrelationID]; id != "" && !slices.Contains(correlationIDs, id) {
+				correlationIDs = append(correlationIDs, id)
+			}
+		}
+	}
+
+	slices.Sort(correlationIDs)
+	span.SetAttributes(
+		tracing.String(tracing.AttrCorrelationID, strings.Join(correlationIDs, ",")),
+		tracing.String("remove", strconv.FormatBool(remove)),
+		tracing.String("ports", strconv.Itoa(ports)))
+
+	return ctx, span
+}
+
+// Unwrap returns the instrumented forwarder.
+func (m *MetricsForwarder) Unwrap() Forwarder {
+	return m.Forwarder
+}
+
+// Metrics returns a copy of the metrics.
+func (m *MetricsForwarder) Metrics() Metrics {
+	m.mutex.Lock()
+	metrics := m.metrics
+	metrics.Failures = maps.Clone(m.metrics.Failures)
+	metrics.LatencyCounts = slices.Clone(m.metrics.LatencyCounts)
+	m.mutex.Unlock()
+
+	if stats, ok := m.Forwarder.(ConnectionStats); ok {
+		metrics.Retries, metrics.Reconnects = stats.ConnectionStats()
+	}
+
+	return metrics
+}
+
+// Collect returns the metrics of the sends for the Prometheus endpoint, see metrics.Registry.
+func (m *MetricsForwarder) Collect() []metrics.Family {
+	snapshot := m.Metrics()
+
+	categories := make([]string, 0, len(snapshot.Failures))
+	for category := range snapshot.Failures {
+		categories = append(categories, category)
+	}
+
+	slices.Sort(categories)
+
+	failures := make([]metrics.Sample, 0, len(categories))
+	for _, category := range categories {
+		failures = append(failures, metrics.Sample{
+			Labels: []metrics.Label{{Name: "category", Value: category}},
+			Value:  float64(snapshot.Failures[category]),
+		})
+	}
+
+	upperBounds := make([]float64, 0, len(LatencyBuckets))
+	for _, bucket := range LatencyBuckets {
+		upperBounds = append(upperBounds, bucket.Seconds())
+	}
+
+	return []metrics.Family{
+		{
+			Name:    metrics.Namespace + "forwarder_sends_total",
+			Help:    "Number of port mappings that were sent to the host, including the failed ones.",
+			Type:    metrics.TypeCounter,
+			Samples: []metrics.Sample{{Value: float64(snapshot.Sends)}},
+		},
+		{
+			Name:    metrics.Namespace + "forwarder_failures_total",
+			Help:    "Number of port mappings that could not be sent to the host, by category.",
+			Type:    metrics.TypeCounter,
+			Samples: failures,
+		},
+		{
+			Name:    metrics.Namespace + "forwarder_retries_total",
+			Help:    "Number of sends that were retried after the peer refused them.",
+			Type:    metrics.TypeCounter,
+			Samples: []metrics.Sample{{Value: float64(snapshot.Retries)}},
+		},
+		{
+			Name:    metrics.Namespace + "forwarder_reconnects_total",
+			Help:    "Number of times that the peer was reached again after it was unreachable.",
+			Type:    metrics.TypeCounter,
+			Samples: []metrics.Sample{{Value: float64(snapshot.Reconnects)}},
+		},
+		{
+			Name: metrics.Namespace + "forward_latency_seconds",
+			Help: "Duration of the sends of the port mappings to the host.",
+			Type: metrics.TypeHistogram,
+			Histograms: []metrics.Histogram{{
+				UpperBounds: upperBounds,
+				Counts:      snapshot.LatencyCounts,
+				Sum:         snapshot.LatencySum.Seconds(),
+			}},
+		},
+	}
+}
+
+func (m *MetricsForwarder) observe(start time.Time, err error) {
+	latency := time.Since(start)
+	bucket, _ := slices.BinarySearch(LatencyBuckets, latency)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.metrics.Sends++
+	m.metrics.LatencyCounts[bucket]++
+	m.metrics.LatencySum += latency
+
+	if err != nil {
+		m.metrics.Failures[failureCategory(err)]++
+		m.metrics.LastError = err.Error()
+
+		return
+	}
+
+	m.metrics.LastSuccess = start.Add(latency)
+	m.metrics.LastError = ""
+}
+
+// failureCategory returns the category that the failed send is counted in.
+func failureCategory(err error) string {
+	switch {
+	case errors.Is(err, ErrSendTimeout), errors.Is(err, context.DeadlineExceeded):
+		return FailureTimeout
+	case errors.Is(err, context.Canceled):
+		return FailureCancelled
+	case errors.Is(err, ErrPortRejected):
+		return FailureRejected
+	case vsockUnavailable(err):
+		return FailureUnavailable
+	case retryable(err):
+		return FailureUnreachable
+	default:
+		return FailureOther
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingForwarder fails every send with the next of its errors.
+type failingForwarder struct {
+	errs []error
+}
+
+func (f *failingForwarder) Send(_ context.Context, _ types.PortMapping) error {
+	err := f.errs[0]
+	f.errs = f.errs[1:]
+
+	return err
+}
+
+func (f *failingForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	return f.Send(ctx, forwarder.MergeRemovals(portMappings))
+}
+
+func sum(counts []uint64) uint64 {
+	var total uint64
+	for _, count := range counts {
+		total += count
+	}
+
+	return total
+}
+
+func TestMetricsForwarderSuccess(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	metricsForwarder := forwarder.NewMetricsForwarder(forwarder.NewVTunnelForwarder(peer.listener.Addr().String()))
+
+	require.NoError(t, metricsForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+
+	_, err := metricsForwarder.SendWithResults(context.Background(), testPortMapping(false, "443/tcp"))
+	require.NoError(t, err)
+	peer.receive(t)
+
+	require.NoError(t, metricsForwarder.RemovePorts(context.Background(), []types.PortMapping{
+		testPortMapping(true, "80/tcp"),
+	}))
+	peer.receive(t)
+
+	snapshot := metricsForwarder.Metrics()
+	assert.Equal(t, uint64(3), snapshot.Sends)
+	assert.Empty(t, snapshot.Failures)
+	assert.Len(t, snapshot.LatencyCounts, len(forwarder.LatencyBuckets)+1)
+	assert.Equal(t, uint64(3), sum(snapshot.LatencyCounts))
+	assert.Positive(t, snapshot.LatencySum)
+	assert.False(t, snapshot.LastSuccess.IsZero())
+	assert.Empty(t, snapshot.LastError)
+	assert.Zero(t, snapshot.Retries)
+	assert.Zero(t, snapshot.Reconnects)
+}
+
+func TestMetricsForwarderFailures(t *testing.T) {
+	t.Parallel()
+
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	unavailable := &net.OpError{Op: "dial", Net: forwarder.VsockNetwork, Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)}
+	metricsForwarder := forwarder.NewMetricsForwarder(&failingForwarder{errs: []error{
+		fmt.Errorf("%w: 80/tcp 127.0.0.1:80: port is in use", forwarder.ErrPortRejected),
+		fmt.Errorf("%w after 5s", forwarder.ErrSendTimeout),
+		fmt.Errorf("giving up sending port mapping: %w", context.Canceled),
+		refused,
+		unavailable,
+		errors.New("unexpected error"),
+		nil,
+	}})
+
+	for range 6 {
+		require.Error(t, metricsForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	}
+
+	snapshot := metricsForwarder.Metrics()
+	assert.True(t, snapshot.LastSuccess.IsZero())
+	assert.Equal(t, "unexpected error", snapshot.LastError)
+
+	// The forwarders without results are sent to like with Send.
+	results, err := metricsForwarder.SendWithResults(context.Background(), testPortMapping(false, "80/tcp"))
+	require.NoError(t, err)
+	assert.Nil(t, results)
+
+	snapshot = metricsForwarder.Metrics()
+	assert.Equal(t, uint64(7), snapshot.Sends)
+	assert.Equal(t, map[string]uint64{
+		forwarder.FailureRejected:    1,
+		forwarder.FailureTimeout:     1,
+		forwarder.FailureCancelled:   1,
+		forwarder.FailureUnreachable: 1,
+		forwarder.FailureUnavailable: 1,
+		forwarder.FailureOther:       1,
+	}, snapshot.Failures)
+	assert.Equal(t, uint64(7), sum(snapshot.LatencyCounts))
+	// The last send succeeded.
+	assert.False(t, snapshot.LastSuccess.IsZero())
+	assert.Empty(t, snapshot.LastError)
+}
+
+func TestMetricsForwarderConnectionStats(t *testing.T) {
+	t.Parallel()
+
+	// The peer refuses the first two connections.
+	peer := newTestPeer(t, 2)
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(peer.listener.Addr().String())
+	vtunnelForwarder.EnableRetry(time.Millisecond, time.Minute)
+	vtunnelForwarder.SetDialer(peer.dial)
+	metricsForwarder := forwarder.NewMetricsForwarder(vtunnelForwarder)
+
+	require.NoError(t, metricsForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+
+	snapshot := metricsForwarder.Metrics()
+	assert.Equal(t, uint64(1), snapshot.Sends)
+	assert.Empty(t, snapshot.Failures)
+	assert.Equal(t, uint64(2), snapshot.Retries)
+	assert.Equal(t, uint64(1), snapshot.Reconnects)
+
+	// The copies are not changed by the later sends.
+	require.NoError(t, metricsForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	peer.receive(t)
+	assert.Equal(t, uint64(1), sum(snapshot.LatencyCounts))
+	assert.Equal(t, uint64(2), metricsForwarder.Metrics().Sends)
+}
+
+func TestMetricsForwarderCollect(t *testing.T) {
+	t.Parallel()
+
+	metricsForwarder := forwarder.NewMetricsForwarder(&failingForwarder{errs: []error{
+		fmt.Errorf("%w after 5s", forwarder.ErrSendTimeout),
+		errors.New("unexpected error"),
+		nil,
+	}})
+
+	for range 3 {
+		_ = metricsForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	}
+
+	registry := metrics.NewRegistry()
+	registry.Register(metricsForwarder)
+
+	var output strings.Builder
+
+	require.NoError(t, registry.Write(&output))
+	assert.Contains(t, output.String(), "\nrd_guestagent_forwarder_sends_total 3\n")
+	assert.Contains(t, output.String(), "\nrd_guestagent_forwarder_failures_total{category=\"other\"} 1\n"+
+		"rd_guestagent_forwarder_failures_total{category=\"timeout\"} 1\n")
+	assert.Contains(t, output.String(), "\nrd_guestagent_forwarder_retries_total 0\n")
+	assert.Contains(t, output.String(), "\nrd_guestagent_forward_latency_seconds_bucket{le=\"0.001\"} ")
+	assert.Contains(t, output.String(), "\nrd_guestagent_forward_latency_seconds_bucket{le=\"+Inf\"} 3\n")
+	assert.Contains(t, output.String(), "\nrd_guestagent_forward_latency_seconds_count 3\n")
+}
@@ -0,0 +1,280 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+)
+
+// negotiateTimeout is how long the peer may take to answer the Hello,
+// the peers that do not answer in time speak the legacy protocol.
+const negotiateTimeout = time.Second
+
+// supportedFeatures are the optional parts of the protocol that the agent supports.
+var supportedFeatures = []string{
+	types.FeatureBulkRemove, types.FeatureBatch, types.FeatureReservedPorts, types.FeatureLogs,
+}
+
+// builtinCapabilities are what the agent does regardless of its flags, see types.Hello.Capabilities.
+var builtinCapabilities = []string{
+	types.CapabilityUDP, types.CapabilityMetadata, types.CapabilityLabels, types.CapabilityHostBindAddrs,
+}
+
+// SetCapabilities sets the capabilities that the agent runs with, which are
+// sent in the Hello after the ones that it is built with.
+func (v *VTunnelForwarder) SetCapabilities(capabilities []string) {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	v.capabilities = slices.Clone(capabilities)
+}
+
+// AcknowledgedCapabilities returns the capabilities of the Hello that the
+// peer acknowledged when the protocol was last negotiated; they are nil for
+// the legacy protocol, which must be assumed not to make use of any.
+func (v *VTunnelForwarder) AcknowledgedCapabilities() []string {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	return slices.Clone(v.acknowledged)
+}
+
+// Protocol returns the protocol version and the features that were last
+// negotiated with the peer, the version is 0 for the legacy protocol.
+func (v *VTunnelForwarder) Protocol() (int, []string) {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	return v.protocolVersion, slices.Clone(v.features)
+}
+
+// ReservedPorts returns the host ports that the peer reported to be reserved
+// when it was last connected to, the peers that do not report them have none.
+func (v *VTunnelForwarder) ReservedPorts() []types.ReservedPorts {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	return slices.Clone(v.reserved)
+}
+
+// negotiate sends a Hello to the peer over a connection of its own, the
+// answer sets the protocol version and the features that are used from
+// then on. A peer that does not answer in time, or whose answer can not be
+// decoded, speaks the legacy protocol. It also returns whether the peer was
+// failed over to, and it fails if the peer could not be connected to.
+func (v *VTunnelForwarder) negotiate(ctx context.Context) (bool, error) {
+	conn, failedOver, err := v.dialPeer(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if v.tlsConfig != nil {
+		if conn, err = v.handshake(ctx, conn); err != nil {
+			return failedOver, sendError(ctx, err)
+		}
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	bin, err := json.Marshal(types.PortMapping{
+		Ports:        nat.PortMap{},
+		ConnectAddrs: []types.ConnectAddrs{},
+		Hello: &types.Hello{
+			ProtocolVersion: types.ProtocolVersion,
+			Features:        supportedFeatures,
+			AgentVersion:    version.Version,
+			InstanceID:      v.agentInstance,
+			SchemaVersion:   types.CurrentSchemaVersion,
+			Capabilities:    v.helloCapabilities(),
+		},
+	})
+	if err != nil {
+		return failedOver, err
+	}
+
+	// The Hello is framed unless raw JSON was asked for, the peers that
+	// predate the framing fail to decode it and do not answer.
+	v.setWriteDeadline(conn)
+
+	if v.rawJSON {
+		err = writeFull(conn, append(bin, '\n'))
+	} else {
+		err = WriteFrame(conn, bin)
+	}
+
+	if err != nil {
+		return failedOver, v.writeError(ctx, err)
+	}
+
+	status := readHelloReply(ctx, conn, v.rawJSON)
+
+	protocolVersion, features := negotiated(status)
+	acknowledged := v.acknowledgedBy(status)
+	compatibility := checkCompatibility(status)
+
+	if !v.negotiated || protocolVersion != v.protocolVersion || !slices.Equal(features, v.features) ||
+		!slices.Equal(acknowledged, v.acknowledged) {
+		logger.Infof("negotiated vtunnel protocol version %d with %s, features: %v, acknowledged capabilities: %v",
+			protocolVersion, v.peers[v.active].address, features, acknowledged)
+	}
+
+	// The mode is logged again when it changed, e.g. after the host was upgraded.
+	if v.compatibility == nil || *v.compatibility != compatibility {
+		logCompatibility(compatibility, v.peers[v.active].address)
+	}
+
+	v.negotiated = true
+	v.compatibility = &compatibility
+	v.protocolVersion = protocolVersion
+	v.features = features
+	v.acknowledged = acknowledged
+
+	v.setReserved(status)
+
+	return failedOver, nil
+}
+
+// setReserved records the host ports that the peer reported to be reserved
+// in its answer to the Hello, and calls the handler if they changed.
+func (v *VTunnelForwarder) setReserved(status *types.PeerStatus) {
+	var reserved []types.ReservedPorts
+	if status != nil {
+		reserved = status.Reserved
+	}
+
+	if slices.Equal(reserved, v.reserved) {
+		return
+	}
+
+	logger.Infof("vtunnel peer reported %d reserved host port ranges", len(reserved))
+
+	v.reserved = slices.Clone(reserved)
+
+	if v.onReserved != nil {
+		v.onReserved()
+	}
+}
+
+// negotiated returns the protocol version and the features that
+// both the agent and the peer that answered with the status support.
+func negotiated(status *types.PeerStatus) (int, []string) {
+	if status == nil || status.ProtocolVersion <= 0 {
+		return 0, nil
+	}
+
+	var features []string
+
+	for _, feature := range supportedFeatures {
+		if slices.Contains(status.Features, feature) {
+			features = append(features, feature)
+		}
+	}
+
+	return min(status.ProtocolVersion, types.ProtocolVersion), features
+}
+
+// helloCapabilities returns the capabilities that are sent in the Hello.
+func (v *VTunnelForwarder) helloCapabilities() []string {
+	capabilities := slices.Clone(builtinCapabilities)
+
+	for _, capability := range v.capabilities {
+		if !slices.Contains(capabilities, capability) {
+			capabilities = append(capabilities, capability)
+		}
+	}
+
+	return capabilities
+}
+
+// acknowledgedBy returns the capabilities of the Hello that the peer that
+// answered with the status acknowledged, in the order they were sent.
+func (v *VTunnelForwarder) acknowledgedBy(status *types.PeerStatus) []string {
+	if status == nil || status.ProtocolVersion <= 0 {
+		return nil
+	}
+
+	var acknowledged []string
+
+	for _, capability := range v.helloCapabilities() {
+		if slices.Contains(status.Capabilities, capability) {
+			acknowledged = append(acknowledged, capability)
+		}
+	}
+
+	return acknowledged
+}
+
+// readHelloReply returns the answer of the peer to the Hello, or nil if it
+// did not answer in time or if its answer can not be decoded.
+func readHelloReply(ctx context.Context, conn net.Conn, rawJSON bool) *types.PeerStatus {
+	deadline := time.Now().Add(negotiateTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	if ctx.Err() != nil || conn.SetReadDeadline(deadline) != nil {
+		return nil
+	}
+
+	var (
+		status types.PeerStatus
+		err    error
+	)
+
+	if rawJSON {
+		err = json.NewDecoder(conn).Decode(&status)
+	} else {
+		var payload []byte
+		if payload, err = ReadFrame(conn); err == nil {
+			err = json.Unmarshal(payload, &status)
+		}
+	}
+
+	switch {
+	case err == nil:
+		return &status
+	case errors.Is(err, io.EOF) || errors.Is(err, os.ErrDeadlineExceeded):
+		logger.Debugf("vtunnel peer did not answer the hello, using the legacy protocol")
+	default:
+		logger.Warnf("failed to decode the vtunnel peer's answer to the hello, using the legacy protocol: %v", err)
+	}
+
+	return nil
+}
+
+// newInstanceID returns a random ID for the sequence numbers of a forwarder,
+// see types.Hello.InstanceID.
+func newInstanceID() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
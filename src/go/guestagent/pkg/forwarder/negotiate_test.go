@@ -0,0 +1,327 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVTunnelForwarderNegotiate(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setFeatures(types.FeatureBulkRemove, types.FeatureBatch, "unknownFeature")
+	vtunnelForwarder := newTestForwarder(peer)
+
+	protocolVersion, features := vtunnelForwarder.Protocol()
+	assert.Zero(t, protocolVersion)
+	assert.Empty(t, features)
+	assert.False(t, vtunnelForwarder.Batches())
+
+	// The protocol is negotiated once, before the first port mapping.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	peer.receive(t)
+	assert.Equal(t, 1, peer.helloCount())
+	assert.Equal(t, version.Version, peer.lastAgentVersion())
+	assert.False(t, peer.receivedRawJSON())
+
+	protocolVersion, features = vtunnelForwarder.Protocol()
+	assert.Equal(t, types.ProtocolVersion, protocolVersion)
+	assert.Equal(t, []string{types.FeatureBulkRemove, types.FeatureBatch}, features)
+	assert.True(t, vtunnelForwarder.Batches())
+}
+
+func TestVTunnelForwarderNegotiateLegacy(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setLegacy(true, false)
+	peer.setFeatures(types.FeatureBulkRemove)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	// The legacy peers get the port mappings as raw JSON, without any of the features.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	assert.Equal(t, testPortMapping(false, "80/tcp"), peer.receive(t))
+	assert.True(t, peer.receivedRawJSON())
+	assert.Equal(t, 1, peer.helloCount())
+
+	version, features := vtunnelForwarder.Protocol()
+	assert.Zero(t, version)
+	assert.Empty(t, features)
+}
+
+func TestVTunnelForwarderNegotiateGarbled(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setLegacy(false, true)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	assert.Equal(t, testPortMapping(false, "80/tcp"), peer.receive(t))
+	assert.True(t, peer.receivedRawJSON())
+
+	version, _ := vtunnelForwarder.Protocol()
+	assert.Zero(t, version)
+}
+
+func TestVTunnelForwarderNegotiateAgain(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setInstanceID("first")
+	vtunnelForwarder := newTestForwarder(peer)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+
+	// The peer was downgraded while it restarted.
+	peer.setInstanceID("second")
+	peer.setLegacy(true, false)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	peer.receive(t)
+	assert.False(t, peer.receivedRawJSON())
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "8080/tcp")))
+	peer.receive(t)
+	assert.True(t, peer.receivedRawJSON())
+	assert.Equal(t, 2, peer.helloCount())
+
+	version, _ := vtunnelForwarder.Protocol()
+	assert.Zero(t, version)
+}
+
+func TestVTunnelForwarderNegotiateUnreachable(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+
+	// The protocol is negotiated again once the peer is reachable again.
+	peer.setRefuseAll(true)
+	require.Error(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	peer.setRefuseAll(false)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	peer.receive(t)
+	assert.Equal(t, 2, peer.helloCount())
+}
+
+func TestVTunnelForwarderReservedPorts(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setInstanceID("first")
+	peer.setReserved(types.ReservedPorts{First: 50000, Last: 50059, Owner: "Hyper-V excluded port range"})
+	vtunnelForwarder := newTestForwarder(peer)
+
+	changes := 0
+	vtunnelForwarder.SetReservedPortsHandler(func() { changes++ })
+
+	assert.Empty(t, vtunnelForwarder.ReservedPorts())
+
+	// The reserved ports come with the answer to the hello.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	peer.receive(t)
+	assert.Equal(t, []types.ReservedPorts{{First: 50000, Last: 50059, Owner: "Hyper-V excluded port range"}},
+		vtunnelForwarder.ReservedPorts())
+	assert.Equal(t, 1, changes)
+
+	// They are refreshed once the peer is connected to again.
+	peer.setInstanceID("second")
+	peer.setReserved(types.ReservedPorts{First: 8080, Protocol: "tcp"})
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "8080/tcp")))
+	peer.receive(t)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "8443/tcp")))
+	peer.receive(t)
+	assert.Equal(t, []types.ReservedPorts{{First: 8080, Protocol: "tcp"}}, vtunnelForwarder.ReservedPorts())
+	assert.Equal(t, 2, changes)
+
+	// The peers that do not report them have none.
+	peer.setInstanceID("third")
+	peer.setReserved()
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "9090/tcp")))
+	peer.receive(t)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "9443/tcp")))
+	peer.receive(t)
+	assert.Empty(t, vtunnelForwarder.ReservedPorts())
+	assert.Equal(t, 3, changes)
+}
+
+func TestVTunnelForwarderSchemaVersion(t *testing.T) {
+	t.Parallel()
+
+	portMapping := testPortMapping(false, "80/tcp")
+	portMapping.Protocols = types.PortProtocols(portMapping.Ports)
+	portMapping.Labels = map[string]string{types.LabelContainerName: "web"}
+	portMapping.ConnectAddrs = []types.ConnectAddrs{
+		{Network: "ip+net", Addr: "172.26.118.5/20", Family: types.FamilyIPv4, IP: "172.26.118.5"},
+	}
+
+	// The peers that negotiated the current protocol get the current schema.
+	peer := newTestPeer(t, 0)
+	require.NoError(t, newTestForwarder(peer).Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, peer.receive(t))
+	assert.Equal(t, types.CurrentSchemaVersion, peer.lastSchemaVersion())
+
+	// The legacy peers get the port mappings without the newer fields.
+	legacyPeer := newTestPeer(t, 0)
+	legacyPeer.setLegacy(true, false)
+	require.NoError(t, newTestForwarder(legacyPeer).Send(context.Background(), portMapping))
+	assert.Equal(t, types.Downgrade(portMapping, 0), legacyPeer.receive(t))
+	assert.Zero(t, legacyPeer.lastSchemaVersion())
+	assert.Equal(t, types.FamilyIPv4, portMapping.ConnectAddrs[0].Family)
+}
+
+func TestVTunnelForwarderMirroredLegacy(t *testing.T) {
+	t.Parallel()
+
+	portMapping := testPortMapping(false, "80/tcp")
+	portMapping.Mirrored = true
+
+	// The peers of protocol 1 predate the mirrored flag, they would forward the ports.
+	peer := newTestPeer(t, 0)
+	peer.setProtocol(1, 1, "")
+	vtunnelForwarder := newTestForwarder(peer)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), portMapping))
+	received := peer.receive(t)
+	assert.Empty(t, received.Ports)
+	assert.False(t, received.Mirrored)
+	assert.Len(t, portMapping.Ports, 1, "the port mapping that was sent is left untouched")
+
+	// The removals still withdraw the ports.
+	removal := testPortMapping(true, "80/tcp")
+	removal.Mirrored = true
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), removal))
+	assert.Equal(t, types.Downgrade(removal, 0), peer.receive(t))
+
+	// The peers that understand the mirrored flag get the ports.
+	currentPeer := newTestPeer(t, 0)
+	require.NoError(t, newTestForwarder(currentPeer).Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, currentPeer.receive(t))
+}
+
+func TestVTunnelForwarderReportOnlyLegacy(t *testing.T) {
+	t.Parallel()
+
+	portMapping := testPortMapping(false, "80/tcp")
+	portMapping.ReportOnly = true
+
+	// The peers of protocol 3 predate the report only flag, they would forward the ports.
+	peer := newTestPeer(t, 0)
+	peer.setProtocol(3, 3, "")
+
+	require.NoError(t, newTestForwarder(peer).Send(context.Background(), portMapping))
+	received := peer.receive(t)
+	assert.Empty(t, received.Ports)
+	assert.False(t, received.ReportOnly)
+
+	// The peers of protocol 4 get the ports, flagged as report only.
+	currentPeer := newTestPeer(t, 0)
+	currentPeer.setProtocol(4, 4, "")
+
+	require.NoError(t, newTestForwarder(currentPeer).Send(context.Background(), portMapping))
+	received = currentPeer.receive(t)
+	assert.Equal(t, portMapping.Ports, received.Ports)
+	assert.True(t, received.ReportOnly)
+}
+
+func TestVTunnelForwarderCapabilities(t *testing.T) {
+	t.Parallel()
+
+	builtin := []string{types.CapabilityUDP, types.CapabilityMetadata, types.CapabilityLabels, types.CapabilityHostBindAddrs}
+
+	tests := []struct {
+		name         string
+		capabilities []string
+		expected     []string
+	}{
+		{
+			name:     "builtin only",
+			expected: builtin,
+		},
+		{
+			name:         "docker and iptables",
+			capabilities: []string{types.CapabilityDocker, types.CapabilityIptables, types.CapabilityMirrored},
+			expected:     append(slices.Clone(builtin), types.CapabilityDocker, types.CapabilityIptables, types.CapabilityMirrored),
+		},
+		{
+			name:         "containerd and kubernetes",
+			capabilities: []string{types.CapabilityContainerd, types.CapabilityKubernetes, types.CapabilityUDP},
+			expected:     append(slices.Clone(builtin), types.CapabilityContainerd, types.CapabilityKubernetes),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			peer := newTestPeer(t, 0)
+			peer.setAcknowledged(types.CapabilityUDP, types.CapabilityKubernetes, "unknownCapability")
+			vtunnelForwarder := newTestForwarder(peer)
+			vtunnelForwarder.SetCapabilities(tt.capabilities)
+
+			assert.Nil(t, vtunnelForwarder.AcknowledgedCapabilities())
+
+			require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+			peer.receive(t)
+
+			hello := peer.lastHello()
+			assert.Equal(t, tt.expected, hello.Capabilities)
+			assert.Equal(t, types.CurrentSchemaVersion, hello.SchemaVersion)
+
+			// Only the capabilities that were sent can be acknowledged.
+			acknowledged := []string{types.CapabilityUDP}
+			if slices.Contains(tt.capabilities, types.CapabilityKubernetes) {
+				acknowledged = append(acknowledged, types.CapabilityKubernetes)
+			}
+
+			assert.Equal(t, acknowledged, vtunnelForwarder.AcknowledgedCapabilities())
+		})
+	}
+}
+
+func TestVTunnelForwarderCapabilitiesLegacy(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setLegacy(true, false)
+	peer.setAcknowledged(types.CapabilityUDP)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.SetCapabilities([]string{types.CapabilityDocker})
+
+	// The peers that do not answer the hello acknowledge nothing.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+	assert.Contains(t, peer.lastHello().Capabilities, types.CapabilityDocker)
+	assert.Nil(t, vtunnelForwarder.AcknowledgedCapabilities())
+}
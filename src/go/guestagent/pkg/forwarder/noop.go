@@ -0,0 +1,43 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// NoopForwarder logs the port mappings instead of forwarding them, to see
+// what the agent would forward without any side effects on the host.
+type NoopForwarder struct{}
+
+func NewNoopForwarder() *NoopForwarder {
+	return &NoopForwarder{}
+}
+
+// Send logs the port mappings and always succeeds.
+func (n *NoopForwarder) Send(_ context.Context, portMapping types.PortMapping) error {
+	logger.Infof("dry run, not forwarding the port mapping: %+v", portMapping)
+
+	return nil
+}
+
+// RemovePorts logs the port mappings as a single removal and always succeeds.
+func (n *NoopForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	return n.Send(ctx, MergeRemovals(portMappings))
+}
+
+// SetPeerRestartHandler does nothing, there is no peer that could restart.
+func (n *NoopForwarder) SetPeerRestartHandler(func()) {}
@@ -0,0 +1,153 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// ErrQueueDisabled is returned when the queue is loaded while queuing is disabled, see EnableQueue.
+var ErrQueueDisabled = errors.New("the vtunnel queue is not enabled")
+
+// QueuePersister is implemented by the forwarders whose queue
+// can be saved when the agent exits, see VTunnelForwarder.SaveQueue.
+type QueuePersister interface {
+	SaveQueue(path string) error
+	LoadQueue(path string, maxAge time.Duration) error
+}
+
+// savedBinding is a queued change of a port binding in the queue file.
+type savedBinding struct {
+	Key         string            `json:"key"`
+	QueuedAt    time.Time         `json:"queuedAt"`
+	PortMapping types.PortMapping `json:"portMapping"`
+}
+
+// SaveQueue writes the queued changes of the port bindings to the file, so
+// that the ones that the peer did not get before the agent exits, e.g. the
+// removals of the shutdown, are delivered by the next agent; see LoadQueue.
+// The queued snapshot is not saved, the next agent sends its own. The file
+// is removed if nothing is queued.
+func (v *VTunnelForwarder) SaveQueue(path string) error {
+	v.sendMutex.Lock()
+	saved := make([]savedBinding, 0, len(v.pending))
+
+	for key, pending := range v.pending {
+		saved = append(saved, savedBinding{Key: key, QueuedAt: pending.queuedAt, PortMapping: pending.portMapping})
+	}
+
+	// The changes are saved in the order they were queued in.
+	sort.Slice(saved, func(i, j int) bool {
+		return v.pending[saved[i].Key].seq < v.pending[saved[j].Key].seq
+	})
+	v.sendMutex.Unlock()
+
+	if len(saved) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("removing the queue file: %w", err)
+		}
+
+		return nil
+	}
+
+	bin, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("creating the queue file directory: %w", err)
+	}
+
+	// The file is replaced at once, so that a crash never leaves half of it.
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, bin, 0o600); err != nil {
+		return fmt.Errorf("writing the queue file: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("writing the queue file: %w", err)
+	}
+
+	logger.Infof("saved %d undelivered port bindings to %s", len(saved), path)
+
+	return nil
+}
+
+// LoadQueue queues the changes that a previous agent saved to the file,
+// see SaveQueue, so that they are sent before any other port mappings. The
+// changes that were queued more than maxAge ago are dropped, unless it is
+// zero. The file is removed once it is loaded, and a missing file is not
+// an error.
+func (v *VTunnelForwarder) LoadQueue(path string, maxAge time.Duration) error {
+	bin, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("reading the queue file: %w", err)
+	}
+
+	var saved []savedBinding
+	if err := json.Unmarshal(bin, &saved); err != nil {
+		return fmt.Errorf("decoding the queue file %s: %w", path, err)
+	}
+
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	if v.maxPending == 0 {
+		return ErrQueueDisabled
+	}
+
+	loaded := 0
+
+	for _, binding := range saved {
+		if maxAge > 0 && time.Since(binding.QueuedAt) > maxAge {
+			continue
+		}
+
+		// The changes that were queued since supersede the saved ones.
+		if _, ok := v.pending[binding.Key]; ok {
+			continue
+		}
+
+		v.pendingSeq++
+		v.pending[binding.Key] = pendingBinding{seq: v.pendingSeq, queuedAt: binding.QueuedAt, portMapping: binding.PortMapping}
+		loaded++
+	}
+
+	if len(v.pending) > v.maxPending {
+		logger.Warnf("more than %d port bindings were saved for the vtunnel peer, "+
+			"all the port mappings are sent again once it is reachable", v.maxPending)
+
+		clear(v.pending)
+		v.overflowed = true
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("removing the queue file: %w", err)
+	}
+
+	logger.Infof("loaded %d undelivered port bindings from %s, dropped %d stale ones", loaded, path, len(saved)-loaded)
+
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queueUndelivered queues the port mappings for the unreachable peer, and saves them as the agent exits.
+func queueUndelivered(t *testing.T, peer *testPeer, queueFile string) {
+	t.Helper()
+
+	peer.setRefuseAll(true)
+
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableQueue(10)
+	vtunnelTracker := newQueueTracker(vtunnelForwarder)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_1", testPortMapping(false, "80/tcp").Ports))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_2", testPortMapping(false, "443/tcp").Ports))
+	require.NoError(t, vtunnelTracker.RemoveAll(context.Background()))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_3", testPortMapping(false, "8080/tcp").Ports))
+
+	require.NoError(t, vtunnelForwarder.SaveQueue(queueFile))
+}
+
+func TestVTunnelForwarderQueueFile(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	queueFile := filepath.Join(t.TempDir(), "queue", "vtunnel.json")
+	queueUndelivered(t, peer, queueFile)
+
+	// The next agent delivers the saved changes before its own port mappings.
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableQueue(10)
+	require.NoError(t, vtunnelForwarder.LoadQueue(queueFile, time.Hour))
+	assert.NoFileExists(t, queueFile)
+
+	peer.setRefuseAll(false)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "5432/tcp")))
+
+	assert.Equal(t, fromTracker(testPortMapping(true, "80/tcp", "443/tcp")), peer.receive(t))
+	assert.Equal(t, fromTracker(testPortMapping(false, "8080/tcp")), peer.receive(t))
+	assert.Equal(t, testPortMapping(false, "5432/tcp"), peer.receive(t))
+	assertNothingReceived(t, peer)
+
+	// Nothing is left to save.
+	require.NoError(t, vtunnelForwarder.SaveQueue(queueFile))
+	assert.NoFileExists(t, queueFile)
+}
+
+func TestVTunnelForwarderQueueFileStale(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	queueFile := filepath.Join(t.TempDir(), "vtunnel.json")
+	queueUndelivered(t, peer, queueFile)
+
+	time.Sleep(10 * time.Millisecond)
+
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableQueue(10)
+	require.NoError(t, vtunnelForwarder.LoadQueue(queueFile, time.Millisecond))
+
+	peer.setRefuseAll(false)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "5432/tcp")))
+	assert.Equal(t, testPortMapping(false, "5432/tcp"), peer.receive(t))
+	assertNothingReceived(t, peer)
+}
+
+func TestVTunnelForwarderQueueFileErrors(t *testing.T) {
+	t.Parallel()
+
+	queueFile := filepath.Join(t.TempDir(), "vtunnel.json")
+	vtunnelForwarder := newTestForwarder(newTestPeer(t, 0))
+
+	// A missing file is fine, there was nothing to save.
+	require.NoError(t, vtunnelForwarder.LoadQueue(queueFile, 0))
+
+	require.NoError(t, os.WriteFile(queueFile, []byte("[]"), 0o600))
+	require.ErrorIs(t, vtunnelForwarder.LoadQueue(queueFile, 0), forwarder.ErrQueueDisabled)
+
+	vtunnelForwarder.EnableQueue(10)
+	require.NoError(t, os.WriteFile(queueFile, []byte("not json"), 0o600))
+	require.Error(t, vtunnelForwarder.LoadQueue(queueFile, 0))
+}
+
+func TestNewFromConfigQueueFile(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	queueFile := filepath.Join(t.TempDir(), "vtunnel.json")
+	queueUndelivered(t, peer, queueFile)
+
+	options := forwarder.Options{
+		VTunnel: forwarder.VTunnelOptions{QueueSize: 10, QueueFile: queueFile},
+	}
+
+	_, err := forwarder.NewFromConfig(forwarder.KindVTunnel, peer.listener.Addr().String(), options)
+	require.NoError(t, err)
+	assert.NoFileExists(t, queueFile)
+}
@@ -0,0 +1,341 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"maps"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// pendingBinding is the latest change of a port binding that is queued
+// until the peer is reachable, it holds only that port binding.
+type pendingBinding struct {
+	seq uint64
+	// queuedAt is when the change was queued, see LoadQueue.
+	queuedAt    time.Time
+	portMapping types.PortMapping
+}
+
+// queuedMapping is a payload of queued changes, with the keys of their port bindings.
+type queuedMapping struct {
+	portMapping types.PortMapping
+	keys        []string
+}
+
+// EnableQueue makes Send queue the port mappings that can not be sent since
+// the peer is not reachable, after any retries, instead of failing. The queued
+// changes are sent in order once the peer is reachable, only the latest change
+// of each port binding is kept. If more than maxPending port bindings are
+// queued, the queue is dropped and the peer restart handler is called once
+// the peer is reachable, so that all the port mappings are sent again.
+func (v *VTunnelForwarder) EnableQueue(maxPending int) {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	v.maxPending = maxPending
+	v.pending = make(map[string]pendingBinding)
+}
+
+// enqueue queues the port bindings of the port mapping that were not
+// superseded by a later send, it returns the send error if queuing is disabled.
+func (v *VTunnelForwarder) enqueue(portMapping types.PortMapping, generation uint64, sendErr error) error {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	if v.maxPending == 0 {
+		return sendErr
+	}
+
+	portMapping, ok := v.current(portMapping, generation)
+	if !ok || v.overflowed {
+		return nil
+	}
+
+	if portMapping.Replace {
+		// The snapshot supersedes all the queued changes.
+		clear(v.pending)
+		v.pendingSnapshot = &portMapping
+	} else {
+		for port, bindings := range portMapping.Ports {
+			if bindings == nil {
+				v.queueBinding(string(port), portMapping, port, nil)
+			}
+
+			for _, binding := range bindings {
+				v.queueBinding(bindingKey(port, binding), portMapping, port, []nat.PortBinding{binding})
+			}
+		}
+	}
+
+	if len(v.pending) > v.maxPending {
+		logger.Warnf("more than %d port bindings are queued for the unreachable vtunnel peer, "+
+			"all the port mappings are sent again once it is reachable", v.maxPending)
+
+		clear(v.pending)
+		v.pendingSnapshot = nil
+		v.overflowed = true
+
+		return nil
+	}
+
+	logger.Debugf("vtunnel peer is not reachable, queued the port mapping: %v", sendErr)
+
+	return nil
+}
+
+func (v *VTunnelForwarder) queueBinding(
+	key string,
+	portMapping types.PortMapping,
+	port nat.Port,
+	bindings []nat.PortBinding,
+) {
+	queued := types.PortMapping{
+		Remove:       portMapping.Remove,
+		Ports:        nat.PortMap{port: bindings},
+		ConnectAddrs: portMapping.ConnectAddrs,
+		Families:     portMapping.Families,
+		Labels:       portMapping.Labels,
+	}
+
+	if protocol, ok := portMapping.Protocols[port]; ok {
+		queued.Protocols = map[nat.Port]string{port: protocol}
+	}
+
+	for _, binding := range bindings {
+		metadataKey := binding.HostPort + "/" + port.Proto()
+		if metadata, ok := portMapping.Metadata[metadataKey]; ok {
+			queued.Metadata = map[string]map[string]string{metadataKey: metadata}
+		}
+
+		if source, ok := portMapping.Sources[metadataKey]; ok {
+			queued.Sources = map[string]string{metadataKey: source}
+		}
+
+		if hostBindAddr, ok := portMapping.HostBindAddrs[metadataKey]; ok {
+			queued.HostBindAddrs = map[string]string{metadataKey: hostBindAddr}
+		}
+
+		if seq, ok := portMapping.PortSeqs[metadataKey]; ok {
+			queued.PortSeqs = map[string]uint64{metadataKey: seq}
+		}
+	}
+
+	// A retry that a later change overtook does not replace that change.
+	if pending, ok := v.pending[key]; ok && newerChange(pending.portMapping, queued) {
+		logger.Debugf("dropping the queued change of %s, a later change to it is queued", key)
+
+		return
+	}
+
+	v.pendingSeq++
+	v.pending[key] = pendingBinding{seq: v.pendingSeq, queuedAt: time.Now(), portMapping: queued}
+}
+
+// newerChange returns true if the port mapping holds a later change to one of
+// the host ports of the other one, see types.PortMapping.PortSeqs; the port
+// mappings without sequence numbers are never newer.
+func newerChange(portMapping, other types.PortMapping) bool {
+	for seqKey, seq := range portMapping.PortSeqs {
+		if otherSeq, ok := other.PortSeqs[seqKey]; ok && otherSeq < seq {
+			return true
+		}
+	}
+
+	return false
+}
+
+// unqueue drops the queued changes that the port mapping supersedes, the
+// later changes that are queued are kept.
+func (v *VTunnelForwarder) unqueue(portMapping types.PortMapping) {
+	if v.maxPending == 0 {
+		return
+	}
+
+	if portMapping.Replace {
+		clear(v.pending)
+		v.pendingSnapshot = nil
+		v.overflowed = false
+
+		return
+	}
+
+	for _, key := range bindingKeys(portMapping) {
+		if pending, ok := v.pending[key]; ok && newerChange(pending.portMapping, portMapping) {
+			continue
+		}
+
+		delete(v.pending, key)
+	}
+}
+
+// queued returns the queued changes in order, the consecutive changes
+// that only differ in their port bindings are merged into one payload.
+func (v *VTunnelForwarder) queued() []queuedMapping {
+	var queued []queuedMapping
+
+	if v.pendingSnapshot != nil {
+		queued = append(queued, queuedMapping{portMapping: *v.pendingSnapshot, keys: []string{replaceKey}})
+	}
+
+	keys := make([]string, 0, len(v.pending))
+	for key := range v.pending {
+		keys = append(keys, key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return v.pending[keys[i]].seq < v.pending[keys[j]].seq
+	})
+
+	for _, key := range keys {
+		next := v.pending[key].portMapping
+
+		if n := len(queued); n != 0 && mergeable(queued[n-1].portMapping, next) {
+			last := &queued[n-1]
+			for port, bindings := range next.Ports {
+				last.portMapping.Ports[port] = append(last.portMapping.Ports[port], bindings...)
+			}
+
+			for metadataKey, metadata := range next.Metadata {
+				if last.portMapping.Metadata == nil {
+					last.portMapping.Metadata = make(map[string]map[string]string)
+				}
+
+				last.portMapping.Metadata[metadataKey] = metadata
+			}
+
+			for port, protocol := range next.Protocols {
+				if last.portMapping.Protocols == nil {
+					last.portMapping.Protocols = make(map[nat.Port]string)
+				}
+
+				last.portMapping.Protocols[port] = protocol
+			}
+
+			for sourceKey, source := range next.Sources {
+				if last.portMapping.Sources == nil {
+					last.portMapping.Sources = make(map[string]string)
+				}
+
+				last.portMapping.Sources[sourceKey] = source
+			}
+
+			for hostBindKey, hostBindAddr := range next.HostBindAddrs {
+				if last.portMapping.HostBindAddrs == nil {
+					last.portMapping.HostBindAddrs = make(map[string]string)
+				}
+
+				last.portMapping.HostBindAddrs[hostBindKey] = hostBindAddr
+			}
+
+			for seqKey, seq := range next.PortSeqs {
+				if last.portMapping.PortSeqs == nil {
+					last.portMapping.PortSeqs = make(map[string]uint64)
+				}
+
+				last.portMapping.PortSeqs[seqKey] = seq
+			}
+
+			last.keys = append(last.keys, key)
+
+			continue
+		}
+
+		// The maps are copied, since the merged payloads add to them.
+		ports := make(nat.PortMap, len(next.Ports))
+		for port, bindings := range next.Ports {
+			ports[port] = append([]nat.PortBinding(nil), bindings...)
+		}
+
+		next.Ports = ports
+		next.Metadata = maps.Clone(next.Metadata)
+		next.Protocols = maps.Clone(next.Protocols)
+		next.Sources = maps.Clone(next.Sources)
+		next.HostBindAddrs = maps.Clone(next.HostBindAddrs)
+		next.PortSeqs = maps.Clone(next.PortSeqs)
+		queued = append(queued, queuedMapping{portMapping: next, keys: []string{key}})
+	}
+
+	return queued
+}
+
+func mergeable(portMapping, next types.PortMapping) bool {
+	return !portMapping.Replace &&
+		portMapping.Remove == next.Remove &&
+		reflect.DeepEqual(portMapping.ConnectAddrs, next.ConnectAddrs) &&
+		maps.Equal(portMapping.Labels, next.Labels)
+}
+
+// deliver sends the queued changes in order, and then the port mapping. It
+// returns whether the peer restarted and needs all the port mappings again;
+// a peer that was never reached before only needs the queued changes.
+// It must be called with the sendMutex held.
+func (v *VTunnelForwarder) deliver(ctx context.Context, portMapping types.PortMapping) ([]PortResult, bool, error) {
+	if v.maxPending == 0 {
+		return v.exchange(ctx, portMapping)
+	}
+
+	v.unqueue(portMapping)
+
+	contacted := !v.lastContact.IsZero()
+	restarted, reached := false, false
+
+	for _, queued := range v.queued() {
+		queuedResults, queuedRestarted, err := v.exchange(ctx, queued.portMapping)
+		restarted = restarted || queuedRestarted
+
+		if err != nil {
+			return nil, v.needsResync(contacted, restarted, reached), err
+		}
+
+		// Nobody waits for the queued port mappings anymore.
+		if err := rejectedError(queuedResults); err != nil {
+			logger.Errorf("the vtunnel peer could not apply the queued port mappings: %v", err)
+		}
+
+		reached = true
+
+		if queued.portMapping.Replace {
+			v.pendingSnapshot = nil
+		}
+
+		for _, key := range queued.keys {
+			delete(v.pending, key)
+		}
+	}
+
+	results, sentRestarted, err := v.exchange(ctx, portMapping)
+	restarted = restarted || sentRestarted
+	reached = reached || err == nil
+
+	return results, v.needsResync(contacted, restarted, reached), err
+}
+
+// needsResync returns whether the peer needs all the port mappings again,
+// either since it restarted after it was contacted, or since the queue
+// overflowed while it was not reachable.
+func (v *VTunnelForwarder) needsResync(contacted, restarted, reached bool) bool {
+	if v.overflowed && reached {
+		v.overflowed = false
+
+		return true
+	}
+
+	return restarted && contacted
+}
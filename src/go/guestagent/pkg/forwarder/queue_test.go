@@ -0,0 +1,207 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var queueConnectAddr = []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+
+func newQueueTracker(vtunnelForwarder *forwarder.VTunnelForwarder) *tracker.VTunnelTracker {
+	vtunnelTracker := tracker.NewVTunnelTracker(vtunnelForwarder, queueConnectAddr)
+	vtunnelForwarder.SetPeerRestartHandler(vtunnelTracker.PeerRestarted)
+
+	return vtunnelTracker
+}
+
+// fromTracker adds to the port mapping what the tracker sends along with it.
+func fromTracker(portMapping types.PortMapping) types.PortMapping {
+	portMapping.ConnectAddrs = queueConnectAddr
+	portMapping.Protocols = types.PortProtocols(portMapping.Ports)
+	portMapping.HostBindAddrs = types.PortHostBindAddrs(portMapping.Ports)
+
+	return portMapping
+}
+
+// assertNothingReceived asserts that the peer does not receive anything else,
+// e.g. a snapshot of the port mappings that were already received.
+func assertNothingReceived(t *testing.T, peer *testPeer) {
+	t.Helper()
+
+	select {
+	case portMapping := <-peer.portMaps:
+		assert.Failf(t, "unexpected port mapping", "%+v", portMapping)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestVTunnelForwarderQueue(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setRefuseAll(true)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableQueue(10)
+	vtunnelTracker := newQueueTracker(vtunnelForwarder)
+
+	// The peer is not available yet, as during boot.
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_1", testPortMapping(false, "80/tcp").Ports))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_2", testPortMapping(false, "443/tcp").Ports))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_3", testPortMapping(false, "8080/tcp").Ports))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), "containerID_2"))
+
+	// Only the final state of each port is sent, in order, once the peer is up.
+	peer.setRefuseAll(false)
+	require.NoError(t, vtunnelForwarder.Ping(context.Background()))
+
+	assert.Equal(t, fromTracker(testPortMapping(false, "80/tcp", "8080/tcp")), peer.receive(t))
+	assert.Equal(t, fromTracker(testPortMapping(true, "443/tcp")), peer.receive(t))
+	assert.True(t, peer.receive(t).Ping)
+	assertNothingReceived(t, peer)
+}
+
+func TestVTunnelForwarderQueueBeforeSend(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setRefuseAll(true)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableRetry(time.Millisecond, 20*time.Millisecond)
+	vtunnelForwarder.EnableQueue(10)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+
+	// The queued port mapping is sent before the next one.
+	peer.setRefuseAll(false)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+
+	assert.Equal(t, testPortMapping(false, "80/tcp"), peer.receive(t))
+	assert.Equal(t, testPortMapping(false, "443/tcp"), peer.receive(t))
+	assertNothingReceived(t, peer)
+}
+
+func TestVTunnelForwarderQueueSuperseded(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setRefuseAll(true)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableQueue(10)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+
+	// The removal supersedes the queued add of the same port.
+	peer.setRefuseAll(false)
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(true, "80/tcp")))
+
+	assert.Equal(t, testPortMapping(true, "80/tcp"), peer.receive(t))
+	assertNothingReceived(t, peer)
+}
+
+func TestVTunnelForwarderQueueDelayedRetry(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setRefuseAll(true)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableQueue(10)
+
+	withPortSeqs := func(portMapping types.PortMapping, seq uint64) types.PortMapping {
+		portMapping.PortSeqs = map[string]uint64{"80/tcp": seq}
+
+		return portMapping
+	}
+
+	// The removal of the port is queued before the retry of its earlier
+	// addition, which it supersedes nonetheless.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), withPortSeqs(testPortMapping(true, "80/tcp"), 2)))
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), withPortSeqs(testPortMapping(false, "80/tcp"), 1)))
+
+	peer.setRefuseAll(false)
+	require.NoError(t, vtunnelForwarder.Ping(context.Background()))
+
+	assert.Equal(t, testPortMapping(true, "80/tcp"), peer.receive(t))
+	assert.True(t, peer.receive(t).Ping)
+	assertNothingReceived(t, peer)
+
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+
+	assert.Equal(t, map[string]uint64{"80/tcp": 2}, peer.portSeqs[0])
+}
+
+func TestVTunnelForwarderQueueOverflow(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setRefuseAll(true)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableQueue(1)
+	vtunnelTracker := newQueueTracker(vtunnelForwarder)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_1", testPortMapping(false, "80/tcp").Ports))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_2", testPortMapping(false, "443/tcp").Ports))
+
+	// Nothing was kept, so all the port mappings are sent again.
+	peer.setRefuseAll(false)
+	require.NoError(t, vtunnelForwarder.Ping(context.Background()))
+	assert.True(t, peer.receive(t).Ping)
+
+	snapshot := peer.receive(t)
+	assert.True(t, snapshot.Replace)
+	assert.Equal(t, testPortMapping(false, "80/tcp", "443/tcp").Ports, snapshot.Ports)
+	assertNothingReceived(t, peer)
+}
+
+func TestVTunnelForwarderQueueDisabled(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setRefuseAll(true)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	require.Error(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+}
+
+func TestVTunnelForwarderQueueSources(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setRefuseAll(true)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableQueue(10)
+	vtunnelTracker := newQueueTracker(vtunnelForwarder)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_1", testPortMapping(false, "80/tcp").Ports,
+		tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "serviceUID_1", testPortMapping(false, "443/tcp").Ports,
+		tracker.WithSource(tracker.SourceKubernetes)))
+
+	// The queued changes are merged into one payload, which keeps the source of each port.
+	peer.setRefuseAll(false)
+	require.NoError(t, vtunnelForwarder.Ping(context.Background()))
+
+	portMapping := peer.receive(t)
+	assert.Equal(t, testPortMapping(false, "80/tcp", "443/tcp").Ports, portMapping.Ports)
+	assert.Equal(t, map[string]string{"80/tcp": tracker.SourceDocker, "443/tcp": tracker.SourceKubernetes}, portMapping.Sources)
+}
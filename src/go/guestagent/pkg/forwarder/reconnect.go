@@ -0,0 +1,39 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+// Reconnect makes the forwarder start over with the peers, e.g. after the
+// host resumed from sleep and the connections may be broken in ways that
+// do not show: the protocol is negotiated again, the host names of the
+// peers are resolved again, the peers that were down are tried again, and
+// the next port mappings are sent even if they were already delivered.
+// The instance ID of the peer is kept, so that a restart is still detected.
+func (v *VTunnelForwarder) Reconnect() {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	v.negotiated = false
+	v.lastHash = nil
+
+	for i := range v.peers {
+		v.peers[i].down = false
+		v.peers[i].resolved = nil
+	}
+}
+
+// Reconnect makes both of the connections start over, see VTunnelForwarder.Reconnect.
+func (h *HvsockForwarder) Reconnect() {
+	h.VTunnelForwarder.Reconnect()
+	h.fallback.Reconnect()
+}
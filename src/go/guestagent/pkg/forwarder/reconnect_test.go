@@ -0,0 +1,67 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVTunnelForwarderReconnect(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testSnapshot("80/tcp")))
+	peer.receive(t)
+	assert.Equal(t, 1, peer.helloCount())
+
+	// The protocol is negotiated again, and the snapshot is not skipped.
+	vtunnelForwarder.Reconnect()
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testSnapshot("80/tcp")))
+	assert.Equal(t, testSnapshot("80/tcp"), peer.receive(t))
+	assert.Equal(t, 2, peer.helloCount())
+
+	// Which is only sent once again.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testSnapshot("80/tcp")))
+	assertNothingReceived(t, peer)
+}
+
+func TestVTunnelForwarderReconnectKeepsPeer(t *testing.T) {
+	t.Parallel()
+
+	preferred := newTestPeer(t, 0)
+	fallback := newTestPeer(t, 0)
+	vtunnelForwarder := newFailoverForwarder(preferred, fallback)
+
+	restarts := 0
+	vtunnelForwarder.SetPeerRestartHandler(func() { restarts++ })
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testSnapshot("80/tcp")))
+	preferred.receive(t)
+
+	// Reconnecting is not mistaken for a restart of the peer.
+	vtunnelForwarder.Reconnect()
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testSnapshot("443/tcp")))
+	preferred.receive(t)
+	assert.Equal(t, preferred.listener.Addr().String(), vtunnelForwarder.ActivePeer())
+	assert.Zero(t, restarts)
+	assertNothingReceived(t, fallback)
+}
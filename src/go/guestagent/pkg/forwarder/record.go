@@ -0,0 +1,149 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+var ErrNoRecordFile = errors.New("no file to record the port mappings to")
+
+// RecordOptions configure the record forwarder.
+type RecordOptions struct {
+	// File is the path of the file that the port mappings are appended to.
+	File string
+	// Addr is the loopback address that the recorded port mappings are
+	// served on at /sent, it is disabled when empty.
+	Addr string
+}
+
+// RegisterFlags defines the -record flags that set the options.
+func (o *RecordOptions) RegisterFlags(flags *flag.FlagSet) {
+	flags.StringVar(&o.File, "recordFile", "",
+		"file to append the port mappings to as JSON lines, used with -forwarder=record")
+	flags.StringVar(&o.Addr, "recordAddr", "",
+		"loopback address that the port mappings recorded by -forwarder=record are served on at /sent, "+
+			"e.g. 127.0.0.1:9312, which DELETE clears; it is disabled when empty")
+}
+
+// RecordingForwarder appends the port mappings to a file as JSON lines
+// instead of forwarding them, to debug what the agent would forward.
+// With EnableInspection, they are also kept in memory for the tests
+// to read them from the handlers of RegisterHandlers.
+type RecordingForwarder struct {
+	file    *os.File
+	encoder *json.Encoder
+	mutex   sync.Mutex
+	// sent holds the recorded port mappings, in order, when inspect is set.
+	sent    []types.PortMapping
+	inspect bool
+}
+
+// NewRecordingForwarder creates a forwarder that records to the given file,
+// it is created if it does not exist and appended to otherwise.
+func NewRecordingForwarder(path string) (*RecordingForwarder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening the record file: %w", err)
+	}
+
+	return &RecordingForwarder{
+		file:    file,
+		encoder: json.NewEncoder(file),
+	}, nil
+}
+
+// Send appends the port mappings to the record file.
+func (r *RecordingForwarder) Send(_ context.Context, portMapping types.PortMapping) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.encoder.Encode(portMapping); err != nil {
+		return fmt.Errorf("recording the port mapping: %w", err)
+	}
+
+	if r.inspect {
+		r.sent = append(r.sent, portMapping)
+	}
+
+	return nil
+}
+
+// RemovePorts appends the port mappings to the record file as a single removal.
+func (r *RecordingForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	return r.Send(ctx, MergeRemovals(portMappings))
+}
+
+// EnableInspection keeps the port mappings that are recorded from now on
+// in memory, until ClearSent.
+func (r *RecordingForwarder) EnableInspection() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.inspect = true
+}
+
+// Sent returns the port mappings that were recorded since
+// EnableInspection or the last ClearSent, in order.
+func (r *RecordingForwarder) Sent() []types.PortMapping {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]types.PortMapping{}, r.sent...)
+}
+
+// ClearSent forgets the port mappings that were recorded so far,
+// they are still in the record file.
+func (r *RecordingForwarder) ClearSent() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.sent = nil
+}
+
+// RegisterHandlers registers GET /sent, which returns the port mappings
+// that Sent returns as a JSON array, and DELETE /sent, which clears them.
+func (r *RecordingForwarder) RegisterHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("GET /sent", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(r.Sent()); err != nil {
+			logger.Errorf("failed to write the recorded port mappings: %v", err)
+		}
+	})
+	mux.HandleFunc("DELETE /sent", func(w http.ResponseWriter, _ *http.Request) {
+		r.ClearSent()
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// SetPeerRestartHandler does nothing, there is no peer that could restart.
+func (r *RecordingForwarder) SetPeerRestartHandler(func()) {}
+
+// Close closes the record file.
+func (r *RecordingForwarder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.file.Close()
+}
@@ -0,0 +1,91 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordingForwarder(t *testing.T) {
+	t.Parallel()
+
+	recordFile := filepath.Join(t.TempDir(), "record.jsonl")
+	recordingForwarder, err := forwarder.NewRecordingForwarder(recordFile)
+	require.NoError(t, err)
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	vtunnelTracker := tracker.NewVTunnelTracker(recordingForwarder, wslConnectAddr)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_1", testPortMapping(false, "80/tcp").Ports))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_2", testPortMapping(false, "443/tcp").Ports))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), "containerID_1"))
+	require.NoError(t, vtunnelTracker.RemoveAll(context.Background()))
+	require.NoError(t, recordingForwarder.Close())
+
+	file, err := os.Open(recordFile)
+	require.NoError(t, err)
+	t.Cleanup(func() { file.Close() })
+
+	var (
+		recorded []string
+		lastSeq  uint64
+	)
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var portMapping types.PortMapping
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &portMapping))
+
+		// The sequence numbers of the changes start from the time that
+		// the tracker was created, they only have to increase.
+		for _, seq := range portMapping.PortSeqs {
+			assert.Greater(t, seq, lastSeq)
+			lastSeq = seq
+		}
+
+		portMapping.PortSeqs = nil
+		bin, err := json.Marshal(portMapping)
+		require.NoError(t, err)
+		recorded = append(recorded, string(bin))
+	}
+	require.NoError(t, scanner.Err())
+
+	var expected []string
+	for _, portMapping := range []types.PortMapping{
+		testPortMapping(false, "80/tcp"),
+		testPortMapping(false, "443/tcp"),
+		testPortMapping(true, "80/tcp"),
+		testPortMapping(true, "443/tcp"),
+	} {
+		portMapping.ConnectAddrs = wslConnectAddr
+		portMapping.Protocols = types.PortProtocols(portMapping.Ports)
+		portMapping.HostBindAddrs = types.PortHostBindAddrs(portMapping.Ports)
+		bin, err := json.Marshal(portMapping)
+		require.NoError(t, err)
+		expected = append(expected, string(bin))
+	}
+
+	assert.Equal(t, expected, recorded)
+}
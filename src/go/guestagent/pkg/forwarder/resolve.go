@@ -0,0 +1,101 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// lookupTimeout is how long resolving the host name of a peer may take.
+const lookupTimeout = 5 * time.Second
+
+// LookupFunc returns the addresses of the host, see net.Resolver.LookupHost.
+type LookupFunc func(ctx context.Context, host string) ([]string, error)
+
+// SetResolver replaces the function that is used to resolve the host names of the peers.
+func (v *VTunnelForwarder) SetResolver(lookup LookupFunc) {
+	v.lookup = lookup
+}
+
+// dialAddr connects to the peer. If its address has a host name, it is
+// resolved when it is first dialed and all its addresses are tried in order;
+// the addresses are resolved again whenever none of them can be connected
+// to, since the host may have moved, e.g. after a network switch.
+func (v *VTunnelForwarder) dialAddr(ctx context.Context, peer *peer) (net.Conn, error) {
+	if peer.network != "tcp" {
+		return v.dial(ctx, peer.network, peer.address)
+	}
+
+	host, port, err := net.SplitHostPort(peer.address)
+	if err != nil {
+		return v.dial(ctx, peer.network, peer.address)
+	}
+
+	if _, err := netip.ParseAddr(host); err == nil {
+		return v.dial(ctx, peer.network, peer.address)
+	}
+
+	if len(peer.resolved) != 0 {
+		conn, err := v.dialResolved(ctx, peer, port)
+		if err == nil {
+			return conn, nil
+		}
+
+		logger.Debugf("resolving vtunnel peer %s again after failing to connect to %v: %v", host, peer.resolved, err)
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+
+	addrs, err := v.lookup(lookupCtx, host)
+	if err != nil {
+		peer.resolved = nil
+
+		return nil, fmt.Errorf("failed to resolve vtunnel peer %s: %w", host, err)
+	}
+
+	if !slices.Equal(addrs, peer.resolved) {
+		logger.Debugf("vtunnel peer %s resolved to %v", host, addrs)
+	}
+
+	peer.resolved = addrs
+
+	return v.dialResolved(ctx, peer, port)
+}
+
+// dialResolved connects to the first resolved address of the peer that is reachable.
+func (v *VTunnelForwarder) dialResolved(ctx context.Context, peer *peer, port string) (net.Conn, error) {
+	errs := make([]error, 0, len(peer.resolved))
+
+	for _, addr := range peer.resolved {
+		conn, err := v.dial(ctx, peer.network, net.JoinHostPort(addr, port))
+		if err == nil {
+			return conn, nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 1 {
+		return nil, errs[0]
+	}
+
+	return nil, errors.Join(errs...)
+}
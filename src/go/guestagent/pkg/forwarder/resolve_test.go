@@ -0,0 +1,195 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPeerHost = "host.rancher-desktop.internal"
+
+// testResolver is a fake resolver for testPeerHost, whose answers can change.
+type testResolver struct {
+	addrs   []string
+	lookups int
+	mutex   sync.Mutex
+}
+
+func (r *testResolver) lookup(_ context.Context, host string) ([]string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.lookups++
+
+	if host != testPeerHost || len(r.addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return r.addrs, nil
+}
+
+func (r *testResolver) answer(addrs ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.addrs = addrs
+}
+
+func (r *testResolver) lookupCount() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.lookups
+}
+
+// resolvingDialer connects the given address to the peer,
+// the other resolved addresses refuse the connections.
+type resolvingDialer struct {
+	peer   *testPeer
+	addr   string
+	dialed []string
+	mutex  sync.Mutex
+}
+
+func (d *resolvingDialer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mutex.Lock()
+	d.dialed = append(d.dialed, address)
+	reachable := d.addr
+	d.mutex.Unlock()
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host != reachable {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+
+	return d.peer.dial(ctx, network, d.peer.listener.Addr().String())
+}
+
+func (d *resolvingDialer) moveTo(addr string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.addr = addr
+	d.dialed = nil
+}
+
+func (d *resolvingDialer) dialedAddrs() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.dialed
+}
+
+func newResolvingForwarder(resolver *testResolver, dialer *resolvingDialer) *forwarder.VTunnelForwarder {
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(net.JoinHostPort(testPeerHost, "3040"))
+	vtunnelForwarder.SetResolver(resolver.lookup)
+	vtunnelForwarder.SetDialer(dialer.dial)
+
+	return vtunnelForwarder
+}
+
+func TestVTunnelForwarderResolve(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	resolver := &testResolver{}
+	resolver.answer("192.168.1.10", "fd00::10")
+	dialer := &resolvingDialer{peer: peer, addr: "fd00::10"}
+	vtunnelForwarder := newResolvingForwarder(resolver, dialer)
+
+	// All the resolved addresses are tried in order, for the hello and for the port mapping.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+	assert.Equal(t, []string{"192.168.1.10:3040", "[fd00::10]:3040", "192.168.1.10:3040", "[fd00::10]:3040"},
+		dialer.dialedAddrs())
+
+	// The resolved addresses are kept while they can be connected to.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	peer.receive(t)
+	assert.Equal(t, 1, resolver.lookupCount())
+}
+
+func TestVTunnelForwarderResolveAgain(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	resolver := &testResolver{}
+	resolver.answer("192.168.1.10")
+	dialer := &resolvingDialer{peer: peer, addr: "192.168.1.10"}
+	vtunnelForwarder := newResolvingForwarder(resolver, dialer)
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+
+	// The host moved after a network switch, it is resolved again
+	// once its previous address can not be connected to.
+	resolver.answer("10.0.0.10")
+	dialer.moveTo("10.0.0.10")
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	peer.receive(t)
+	assert.Equal(t, 2, resolver.lookupCount())
+	assert.Equal(t, []string{"192.168.1.10:3040", "10.0.0.10:3040"}, dialer.dialedAddrs())
+}
+
+func TestVTunnelForwarderResolveRetry(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	resolver := &testResolver{}
+	dialer := &resolvingDialer{peer: peer, addr: "192.168.1.10"}
+	vtunnelForwarder := newResolvingForwarder(resolver, dialer)
+
+	var dnsErr *net.DNSError
+
+	err := vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorAs(t, err, &dnsErr)
+	assert.True(t, dnsErr.IsNotFound)
+
+	// A host name that does not resolve yet is retried.
+	vtunnelForwarder.EnableRetry(time.Millisecond, time.Minute)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		resolver.answer("192.168.1.10")
+	}()
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+	assert.Greater(t, resolver.lookupCount(), 2)
+}
+
+func TestVTunnelForwarderIPLiteral(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	resolver := &testResolver{}
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(peer.listener.Addr().String())
+	vtunnelForwarder.SetResolver(resolver.lookup)
+
+	// IP addresses are dialed as they are.
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+	assert.Zero(t, resolver.lookupCount())
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// tlsHandshakeTimeout is how long the TLS handshake with the peer may take.
+const tlsHandshakeTimeout = 10 * time.Second
+
+var (
+	ErrTLSConfig    = errors.New("invalid TLS configuration")
+	ErrTLSHandshake = errors.New("TLS handshake with the vtunnel peer failed")
+)
+
+// TLSOptions configure the TLS connections to the vtunnel peer,
+// which only the vtunnel forwarder supports.
+type TLSOptions struct {
+	Enabled bool
+	// CertFile and KeyFile are the optional client certificate, see LoadTLSConfig.
+	CertFile string
+	KeyFile  string
+	// CAFile holds the CA certificates that the peer is verified against,
+	// the system roots are used when it is empty.
+	CAFile string
+	// ServerName is what the peer's certificate is verified for,
+	// it defaults to the host of the peer address.
+	ServerName string
+}
+
+// RegisterFlags defines the -vtunnelTLS flags that set the options.
+func (o *TLSOptions) RegisterFlags(flags *flag.FlagSet) {
+	flags.BoolVar(&o.Enabled, "vtunnelTLS", false, "connect to the Vtunnel peer over TLS, used with -forwarder=vtunnel")
+	flags.StringVar(&o.CertFile, "vtunnelTLSCert", "",
+		"path to the client certificate that is presented to the Vtunnel peer, used with -vtunnelTLS")
+	flags.StringVar(&o.KeyFile, "vtunnelTLSKey", "",
+		"path to the key of the client certificate, used with -vtunnelTLS")
+	flags.StringVar(&o.CAFile, "vtunnelTLSCA", "",
+		"path to the CA certificates that the Vtunnel peer is verified against, used with -vtunnelTLS; "+
+			"the system roots are used when it is empty")
+	flags.StringVar(&o.ServerName, "vtunnelTLSServerName", "",
+		"name that the Vtunnel peer's certificate is verified for, used with -vtunnelTLS; "+
+			"it defaults to the host of -vtunnelAddr")
+}
+
+// LoadTLSConfig creates the client TLS configuration for the connections to
+// the peer. The peer's certificate is verified against the CA certificates in
+// caFile, or against the system roots when it is empty. The client certificate
+// and key are optional, they are presented to peers that require them.
+func LoadTLSConfig(certFile, keyFile, caFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("%w: the client certificate and key must be provided together", ErrTLSConfig)
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: loading the client certificate: %w", ErrTLSConfig, err)
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading the CA certificates: %w", ErrTLSConfig, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("%w: no CA certificates found in %s", ErrTLSConfig, caFile)
+		}
+	}
+
+	return config, nil
+}
+
+// SetTLSConfig makes the forwarder perform a TLS handshake with the peer
+// before sending the port mappings, nothing is sent if it fails. The server
+// name defaults to the host of a TCP peer address, peers on a unix domain
+// socket must have it set in the configuration.
+func (v *VTunnelForwarder) SetTLSConfig(config *tls.Config) {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	v.tlsConfig = config.Clone()
+}
+
+// handshake secures the connection to the active peer with TLS,
+// it is closed if that fails.
+func (v *VTunnelForwarder) handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+
+	peer := v.peers[v.active]
+
+	config := v.tlsConfig
+	if config.ServerName == "" && peer.network == "tcp" {
+		if host, _, err := net.SplitHostPort(peer.address); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+
+		return nil, fmt.Errorf("%w with %s: %w", ErrTLSHandshake, peer.address, err)
+	}
+
+	return tlsConn, nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues the certificates of the TLS test peers.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue returns a server certificate for 127.0.0.1 that expires at notAfter.
+func (ca *testCA) issue(t *testing.T, notAfter time.Time) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "vtunnel peer"},
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newTLSTestPeer(t *testing.T, cert tls.Certificate) *testPeer {
+	t.Helper()
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	})
+	require.NoError(t, err)
+
+	return serveTestPeer(t, listener, 0)
+}
+
+func writeCAFile(t *testing.T, ca *testCA) string {
+	t.Helper()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+
+	return caFile
+}
+
+func TestVTunnelForwarderTLS(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	peer := newTLSTestPeer(t, ca.issue(t, time.Now().Add(time.Hour)))
+
+	tlsConfig, err := forwarder.LoadTLSConfig("", "", writeCAFile(t, ca), "")
+	require.NoError(t, err)
+
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(peer.listener.Addr().String())
+	vtunnelForwarder.SetTLSConfig(tlsConfig)
+
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, peer.receive(t))
+}
+
+func TestVTunnelForwarderTLSWrongCA(t *testing.T) {
+	t.Parallel()
+
+	peer := newTLSTestPeer(t, newTestCA(t).issue(t, time.Now().Add(time.Hour)))
+
+	tlsConfig, err := forwarder.LoadTLSConfig("", "", writeCAFile(t, newTestCA(t)), "")
+	require.NoError(t, err)
+
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(peer.listener.Addr().String())
+	vtunnelForwarder.SetTLSConfig(tlsConfig)
+	vtunnelForwarder.EnableRetry(time.Millisecond, time.Minute)
+
+	// The handshake failure is not retried, and nothing is sent in plaintext.
+	err = vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, forwarder.ErrTLSHandshake)
+
+	var unknownAuthority x509.UnknownAuthorityError
+	require.ErrorAs(t, err, &unknownAuthority)
+	assert.Empty(t, peer.portMaps)
+}
+
+func TestVTunnelForwarderTLSExpiredCert(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	peer := newTLSTestPeer(t, ca.issue(t, time.Now().Add(-time.Minute)))
+
+	tlsConfig, err := forwarder.LoadTLSConfig("", "", writeCAFile(t, ca), "")
+	require.NoError(t, err)
+
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(peer.listener.Addr().String())
+	vtunnelForwarder.SetTLSConfig(tlsConfig)
+
+	err = vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, forwarder.ErrTLSHandshake)
+
+	var invalidCert x509.CertificateInvalidError
+	require.ErrorAs(t, err, &invalidCert)
+	assert.Equal(t, x509.Expired, invalidCert.Reason)
+	assert.Empty(t, peer.portMaps)
+}
+
+func TestVTunnelForwarderTLSServerName(t *testing.T) {
+	t.Parallel()
+
+	ca := newTestCA(t)
+	peer := newTLSTestPeer(t, ca.issue(t, time.Now().Add(time.Hour)))
+
+	tlsConfig, err := forwarder.LoadTLSConfig("", "", writeCAFile(t, ca), "host.example")
+	require.NoError(t, err)
+
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(peer.listener.Addr().String())
+	vtunnelForwarder.SetTLSConfig(tlsConfig)
+
+	err = vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, forwarder.ErrTLSHandshake)
+
+	var hostnameErr x509.HostnameError
+	require.ErrorAs(t, err, &hostnameErr)
+}
+
+func TestLoadTLSConfigInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := forwarder.LoadTLSConfig("client.pem", "", "", "")
+	require.ErrorIs(t, err, forwarder.ErrTLSConfig)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0o600))
+
+	_, err = forwarder.LoadTLSConfig("", "", caFile, "")
+	require.ErrorIs(t, err, forwarder.ErrTLSConfig)
+}
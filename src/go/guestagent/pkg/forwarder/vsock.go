@@ -0,0 +1,295 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// VsockNetwork is the network name that VsockForwarder dials,
+// the address is in the CID:PORT format.
+const VsockNetwork = "vsock"
+
+// defaultVsockPort is the port on the host that the port mappings are forwarded to.
+const defaultVsockPort = 3040
+
+var ErrInvalidVsockAddr = errors.New("invalid vsock address")
+
+// VsockOptions configure the vsock forwarder.
+type VsockOptions struct {
+	// CID is the context ID of the host, e.g. VMADDR_CID_HOST.
+	CID uint
+	// Port is the vsock port that the host listens on.
+	Port uint
+}
+
+// RegisterFlags defines the -vsock flags that set the options.
+func (o *VsockOptions) RegisterFlags(flags *flag.FlagSet) {
+	flags.UintVar(&o.CID, "vsockCID", unix.VMADDR_CID_HOST,
+		"context ID of the host to forward the port mappings to, used with -forwarder=vsock")
+	flags.UintVar(&o.Port, "vsockPort", defaultVsockPort,
+		"port on the host to forward the port mappings to, used with -forwarder=vsock")
+}
+
+// validate fails if the CID or the port do not fit in an AF_VSOCK address.
+func (o *VsockOptions) validate() error {
+	if o.CID > math.MaxUint32 || o.Port > math.MaxUint32 {
+		return fmt.Errorf("%w: %d:%d is out of range", ErrInvalidVsockAddr, o.CID, o.Port)
+	}
+
+	if o.Port == 0 || o.Port == unix.VMADDR_PORT_ANY {
+		return fmt.Errorf("%w: the port must be set", ErrInvalidVsockAddr)
+	}
+
+	return nil
+}
+
+// VsockForwarder forwards the PortMappings to the host over a virtio-vsock
+// socket, e.g. to the Lima host agent. The connections are managed like
+// the VTunnelForwarder's, including the retries and the restart detection.
+type VsockForwarder struct {
+	*VTunnelForwarder
+	// unavailable makes sure that a missing AF_VSOCK support is only logged once.
+	unavailable sync.Once
+}
+
+// NewVsockForwarder creates a forwarder that connects to the given port of the given CID.
+func NewVsockForwarder(cid, port uint32) *VsockForwarder {
+	return &VsockForwarder{
+		VTunnelForwarder: newVsockTunnel(cid, port),
+	}
+}
+
+// newVsockTunnel creates a VTunnelForwarder that dials the given port of the given CID over AF_VSOCK.
+func newVsockTunnel(cid, port uint32) *VTunnelForwarder {
+	vtunnelForwarder := NewVTunnelForwarder(fmt.Sprintf("%d:%d", cid, port))
+	vtunnelForwarder.peers[0].network = VsockNetwork
+	vtunnelForwarder.SetDialer(DialVsock)
+
+	return vtunnelForwarder
+}
+
+// Send forwards the port mappings to the host. If the kernel does not
+// support AF_VSOCK, nothing is sent and no error is returned.
+func (v *VsockForwarder) Send(ctx context.Context, portMapping types.PortMapping) error {
+	return v.ignoreUnavailable(v.VTunnelForwarder.Send(ctx, portMapping))
+}
+
+// RemovePorts withdraws the port mappings from the host, like Send
+// it does not fail if the kernel does not support AF_VSOCK.
+func (v *VsockForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	return v.ignoreUnavailable(v.VTunnelForwarder.RemovePorts(ctx, portMappings))
+}
+
+// ignoreUnavailable drops the error if AF_VSOCK is not supported, after logging it once.
+func (v *VsockForwarder) ignoreUnavailable(err error) error {
+	if vsockUnavailable(err) {
+		v.unavailable.Do(func() {
+			logger.Warnf("AF_VSOCK is not available, the port mappings are not forwarded: %v", err)
+		})
+
+		return nil
+	}
+
+	return err
+}
+
+// vsockUnavailable returns true if the kernel does not support AF_VSOCK,
+// or if it has no transport that reaches the host.
+func vsockUnavailable(err error) bool {
+	return errors.Is(err, syscall.EAFNOSUPPORT) || errors.Is(err, syscall.ENODEV)
+}
+
+// DialVsock connects to the given CID:PORT address over AF_VSOCK, it gives up
+// once the context is done.
+func DialVsock(ctx context.Context, network, address string) (net.Conn, error) {
+	addr, err := parseVsockAddr(address)
+	if err != nil {
+		return nil, err
+	}
+
+	// A non-blocking descriptor lets the runtime poller handle the deadlines,
+	// and the context while connecting.
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: addr, Err: os.NewSyscallError("socket", err)}
+	}
+
+	file := os.NewFile(uintptr(fd), "vsock:"+address)
+
+	if err := connectVsock(ctx, file, &unix.SockaddrVM{CID: addr.CID, Port: addr.Port}); err != nil {
+		file.Close()
+
+		return nil, &net.OpError{Op: "dial", Net: network, Addr: addr, Err: err}
+	}
+
+	localAddr := &VsockAddr{CID: unix.VMADDR_CID_ANY, Port: unix.VMADDR_PORT_ANY}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			localAddr = &VsockAddr{CID: vm.CID, Port: vm.Port}
+		}
+	}
+
+	return &vsockConn{
+		File:       file,
+		localAddr:  localAddr,
+		remoteAddr: addr,
+	}, nil
+}
+
+// connectVsock connects the non-blocking socket of the file, it waits for the
+// connection to complete with the runtime poller, until the context is done.
+func connectVsock(ctx context.Context, file *os.File, sa *unix.SockaddrVM) error {
+	rawConn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var connectErr error
+	if err := rawConn.Control(func(fd uintptr) { connectErr = unix.Connect(int(fd), sa) }); err != nil {
+		return err
+	}
+
+	switch {
+	case connectErr == nil:
+		return nil
+	case !errors.Is(connectErr, unix.EINPROGRESS):
+		return os.NewSyscallError("connect", connectErr)
+	}
+
+	// The deadline of the context bounds the wait, its cancellation cuts it
+	// short with a deadline in the past.
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = file.SetWriteDeadline(deadline)
+	}
+
+	cancelled := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(cancelled)
+
+		_ = file.SetWriteDeadline(time.Unix(1, 0))
+	})
+
+	// The socket is writable once the connection completed, or failed; the
+	// first call is made before waiting, while it is still in progress.
+	waited := false
+	err = rawConn.Write(func(fd uintptr) bool {
+		if !waited {
+			waited = true
+
+			return false
+		}
+
+		soErr, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			connectErr = os.NewSyscallError("getsockopt", err)
+
+			return true
+		}
+
+		switch errno := syscall.Errno(soErr); {
+		case errno == 0:
+			connectErr = nil
+		case errno == unix.EINPROGRESS || errno == unix.EALREADY || errno == unix.EINTR:
+			return false
+		default:
+			connectErr = os.NewSyscallError("connect", errno)
+		}
+
+		return true
+	})
+
+	if !stop() {
+		<-cancelled
+
+		return ctx.Err()
+	}
+
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		return err
+	}
+
+	if connectErr != nil {
+		return connectErr
+	}
+
+	return file.SetWriteDeadline(time.Time{})
+}
+
+// VsockAddr is the address of an AF_VSOCK socket.
+type VsockAddr struct {
+	CID  uint32
+	Port uint32
+}
+
+func (a *VsockAddr) Network() string {
+	return VsockNetwork
+}
+
+func (a *VsockAddr) String() string {
+	return fmt.Sprintf("%d:%d", a.CID, a.Port)
+}
+
+func parseVsockAddr(address string) (*VsockAddr, error) {
+	cid, port, ok := strings.Cut(address, ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: %q is not in the CID:PORT format", ErrInvalidVsockAddr, address)
+	}
+
+	parsedCID, err := strconv.ParseUint(cid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %w", ErrInvalidVsockAddr, address, err)
+	}
+
+	parsedPort, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q: %w", ErrInvalidVsockAddr, address, err)
+	}
+
+	return &VsockAddr{CID: uint32(parsedCID), Port: uint32(parsedPort)}, nil
+}
+
+// vsockConn adapts a connected AF_VSOCK socket to net.Conn,
+// since net.FileConn does not support the address family.
+type vsockConn struct {
+	*os.File
+	localAddr  *VsockAddr
+	remoteAddr *VsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+const vsockPort = 3040
+
+func TestVsockForwarderMockedDialer(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	vsockForwarder := forwarder.NewVsockForwarder(unix.VMADDR_CID_HOST, vsockPort)
+	vsockForwarder.SetDialer(func(_ context.Context, network, address string) (net.Conn, error) {
+		assert.Equal(t, forwarder.VsockNetwork, network)
+		assert.Equal(t, "2:3040", address)
+
+		return net.Dial("tcp", peer.listener.Addr().String())
+	})
+
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, vsockForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, peer.receive(t))
+}
+
+func TestVsockForwarderUnavailable(t *testing.T) {
+	t.Parallel()
+
+	dials := 0
+	vsockForwarder := forwarder.NewVsockForwarder(unix.VMADDR_CID_HOST, vsockPort)
+	vsockForwarder.SetDialer(func(_ context.Context, network, _ string) (net.Conn, error) {
+		dials++
+
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)}
+	})
+
+	require.NoError(t, vsockForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	require.NoError(t, vsockForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	assert.Equal(t, 2, dials)
+}
+
+func TestDialVsockInvalidAddr(t *testing.T) {
+	t.Parallel()
+
+	_, err := forwarder.DialVsock(context.Background(), forwarder.VsockNetwork, "localhost")
+	require.ErrorIs(t, err, forwarder.ErrInvalidVsockAddr)
+
+	_, err = forwarder.DialVsock(context.Background(), forwarder.VsockNetwork, "2:port")
+	require.ErrorIs(t, err, forwarder.ErrInvalidVsockAddr)
+}
+
+func TestDialVsockCancelled(t *testing.T) {
+	t.Parallel()
+
+	// Nothing listens on the port of the local CID, the connection is only
+	// refused once it times out.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		conn, err := forwarder.DialVsock(ctx, forwarder.VsockNetwork, fmt.Sprintf("%d:%d", unix.VMADDR_CID_LOCAL, vsockPort))
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Skipf("the connection did not hang: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("the dial did not return once its context was cancelled")
+	}
+}
+
+// serveVsockPeer accepts the connections on the AF_VSOCK socket, it answers
+// the hellos and passes on the port mappings.
+func serveVsockPeer(fd int, portMaps chan<- types.PortMapping) {
+	for {
+		connFd, _, err := unix.Accept(fd)
+		if err != nil {
+			return
+		}
+
+		conn := os.NewFile(uintptr(connFd), "vsock-conn")
+
+		portMapping, rawJSON, err := readPortMapping(bufio.NewReader(conn))
+		if err == nil && portMapping.Hello != nil {
+			_ = writeStatus(conn, &types.PeerStatus{ProtocolVersion: types.ProtocolVersion}, rawJSON)
+		} else if err == nil {
+			portMapping.Seq = 0
+			portMapping.SchemaVersion = 0
+			portMaps <- portMapping
+		}
+
+		conn.Close()
+	}
+}
+
+func TestVsockForwarderLoopback(t *testing.T) {
+	t.Parallel()
+
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Skipf("AF_VSOCK is not supported: %v", err)
+	}
+
+	listener := os.NewFile(uintptr(fd), "vsock-listener")
+	t.Cleanup(func() { listener.Close() })
+
+	if err := unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_LOCAL, Port: unix.VMADDR_PORT_ANY}); err != nil {
+		t.Skipf("AF_VSOCK loopback is not supported: %v", err)
+	}
+
+	require.NoError(t, unix.Listen(fd, 1))
+
+	sa, err := unix.Getsockname(fd)
+	require.NoError(t, err)
+
+	portMaps := make(chan types.PortMapping, 1)
+
+	go serveVsockPeer(fd, portMaps)
+
+	vsockForwarder := forwarder.NewVsockForwarder(unix.VMADDR_CID_LOCAL, sa.(*unix.SockaddrVM).Port)
+
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, vsockForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, <-portMaps)
+}
@@ -16,43 +16,833 @@ limitations under the License.
 package forwarder
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/retry"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
 )
 
+const (
+	// replaceKey is the key of the snapshots, which only supersede each other.
+	replaceKey = "replace"
+	// peerResponseTimeout is how long the peer's status is waited for,
+	// older peers close the connection without responding.
+	peerResponseTimeout = time.Second
+)
+
+// unixScheme prefixes the peer addresses that are unix domain sockets.
+const unixScheme = "unix://"
+
+const (
+	// vtunnelRetryBackoff is the longest delay before the first retry of the port mappings that the peer refused,
+	// it is shorter than the tracker's since the refusals typically only happen while the host side is starting.
+	vtunnelRetryBackoff = 200 * time.Millisecond
+	// vtunnelMaxRetryInterval is the longest delay between the retries of a send.
+	vtunnelMaxRetryInterval    = 5 * time.Second
+	defaultVTunnelRetryTimeout = 30 * time.Second
+	defaultVTunnelSendTimeout  = 5 * time.Second
+	defaultVTunnelQueueSize    = 1000
+	defaultVTunnelQueueMaxAge  = 10 * time.Minute
+)
+
+var (
+	ErrPayloadRejected = errors.New("port mapping payload rejected")
+	ErrInvalidPeerAddr = errors.New("invalid peer address")
+	// ErrSendTimeout is returned when the peer did not take the port mapping in
+	// time, e.g. since it accepts the connections but does not read from them.
+	ErrSendTimeout = errors.New("timed out sending the port mapping")
+)
+
 // Forwarder is the interface that wraps the Send method which
 // to forward the port mappings.
 type Forwarder interface {
 	// Send sends the give port mappings to the VTunnel Peer via
-	// a tcp connection.
-	Send(portMapping types.PortMapping) error
+	// a tcp connection, it gives up once the context is done.
+	Send(ctx context.Context, portMapping types.PortMapping) error
+
+	// RemovePorts withdraws all the given port mappings at once, in a
+	// single message unless the peer does not support it; see RemoveEach.
+	RemovePorts(ctx context.Context, portMappings []types.PortMapping) error
 }
 
+// DialFunc connects to the address on the named network, see net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
 // VTunnelForwarder forwards the PortMappings to VTunnel Peer process.
 type VTunnelForwarder struct {
-	peerAddr string
+	// peers are the addresses of the redundant peers in the order of
+	// preference, the port mappings are sent to the active one.
+	peers  []peer
+	active int
+	// failback makes the preferred peers take over again once they are back.
+	failback bool
+	dial     DialFunc
+	lookup   LookupFunc
+	// retryPolicy is how a send that the peer refused is retried, retries
+	// are disabled when its initial delay is zero; a send is given up once
+	// its budget is used up.
+	retryPolicy retry.Policy
+	// timeout bounds every exchange with the peer, it is unbounded when it is zero.
+	timeout time.Duration
+	// generations holds the latest send for each port binding, so that a
+	// queued retry never overrides a later update of the same port.
+	generations map[string]uint64
+	generation  uint64
+	genMutex    sync.Mutex
+	// sendMutex serializes the attempts to send to the peer.
+	sendMutex sync.Mutex
+	// seq is the sequence number of the last payload, see types.PortMapping.Seq;
+	// they start over with every instanceID that is sent in the Hello.
+	seq           uint64
+	agentInstance string
+	// lastHash is the hash of the last port mapping that was delivered, see duplicate.
+	lastHash []byte
+	// instanceID is the last instance ID that the peer responded with.
+	instanceID string
+	// negotiated is set once the protocol was negotiated with the peer, see negotiate.
+	negotiated bool
+	// protocolVersion and features are the ones that were negotiated with the peer.
+	protocolVersion int
+	features        []string
+	// compatibility is how the agent works with the peer, see Compatibility.
+	compatibility *Compatibility
+	// capabilities are sent in the Hello, and acknowledged are the ones
+	// that the peer acknowledged, see SetCapabilities.
+	capabilities []string
+	acknowledged []string
+	// unreachable is set while the peer can not be connected to.
+	unreachable bool
+	// onRestart is called when the peer is detected to have restarted.
+	onRestart func()
+	// reserved are the host ports that the peer last reported to be
+	// reserved, and onReserved is called when they change.
+	reserved   []types.ReservedPorts
+	onReserved func()
+	// lastContact is when the peer last accepted a payload.
+	lastContact time.Time
+	// maxPending is the maximum number of port bindings that are queued
+	// while the peer is not reachable, queuing is disabled when it is zero.
+	maxPending int
+	// pending holds the latest queued change of each port binding.
+	pending    map[string]pendingBinding
+	pendingSeq uint64
+	// pendingSnapshot is the queued snapshot, which precedes the pending changes.
+	pendingSnapshot *types.PortMapping
+	// overflowed is set when the queue had to be dropped.
+	overflowed bool
+	// unacknowledged makes sure that a peer that does not respond is only logged once.
+	unacknowledged sync.Once
+	// withheld makes sure that the ports that are withheld from a legacy peer are only logged once.
+	withheld sync.Once
+	// tlsConfig secures the connections to the peer, they are plaintext if it is nil.
+	tlsConfig *tls.Config
+	// rawJSON makes the payloads be sent without framing, see EnableRawJSON.
+	rawJSON bool
+	// keepAlive and writeTimeout detect the connections that the peer
+	// stopped responding on, see SetKeepAlive and SetWriteTimeout.
+	keepAlive    KeepAlive
+	writeTimeout time.Duration
+	// retries and reconnects are counted for ConnectionStats.
+	retries    atomic.Uint64
+	reconnects atomic.Uint64
+}
+
+// peer is the address of a peer to dial.
+type peer struct {
+	network string
+	address string
+	// down is set while the peer can not be connected to.
+	down bool
+	// resolved holds the addresses that the host name of the peer
+	// last resolved to, it is empty if the address has no host name.
+	resolved []string
 }
 
-func NewVTunnelForwarder(peerAddr string) *VTunnelForwarder {
+// NewVTunnelForwarder creates a forwarder for the peer at the given address,
+// either HOST:PORT or unix:///path/to/socket; see ParsePeerAddr. The fallback
+// addresses are failed over to, in order, when the peer is not reachable.
+func NewVTunnelForwarder(peerAddr string, fallbackAddrs ...string) *VTunnelForwarder {
+	peers := make([]peer, 0, 1+len(fallbackAddrs))
+
+	for _, peerAddr := range append([]string{peerAddr}, fallbackAddrs...) {
+		network, address, err := ParsePeerAddr(peerAddr)
+		if err != nil {
+			// Sending fails with the dial error instead.
+			network, address = "tcp", peerAddr
+		}
+
+		peers = append(peers, peer{network: network, address: address})
+	}
+
 	return &VTunnelForwarder{
-		peerAddr: peerAddr,
+		peers:       peers,
+		dial:        (&net.Dialer{}).DialContext,
+		lookup:      net.DefaultResolver.LookupHost,
+		generations: make(map[string]uint64),
+		// The sequence numbers are not ordered across the instances, so that
+		// they do not depend on the clock, which a resumed VM may step back.
+		agentInstance: newInstanceID(),
+	}
+}
+
+// VTunnelOptions configure the forwarders that exchange the port mappings
+// with a vtunnel peer, that is the vtunnel, vsock and hvsock ones; the zero
+// values disable the features.
+type VTunnelOptions struct {
+	// RetryTimeout is how long the port mappings are retried for when the
+	// peer refuses the connection, see EnableRetry. The gRPC forwarder waits
+	// for the connection that long instead.
+	RetryTimeout time.Duration
+	// SendTimeout is how long a single exchange with the peer may take, see SetTimeout.
+	SendTimeout time.Duration
+	// QueueSize is the number of port bindings that are queued while the peer is not reachable, see EnableQueue.
+	QueueSize int
+	// QueueFile is where the queue is saved when the agent exits and loaded from when it starts, see
+	// SaveQueue; it is not saved when it is empty. The saved changes older than QueueMaxAge are dropped.
+	QueueFile   string
+	QueueMaxAge time.Duration
+	// RawJSON sends the port mappings without framing, see EnableRawJSON.
+	RawJSON bool
+	// Failback returns to the first reachable peer address, see EnableFailback.
+	Failback bool
+	// KeepAlive and WriteTimeout detect the half-open connections to the
+	// peer, see SetKeepAlive and SetWriteTimeout.
+	KeepAlive    KeepAlive
+	WriteTimeout time.Duration
+	// Capabilities are what the agent runs with, see SetCapabilities; they
+	// are not set by a flag, but from the flags of the subsystems.
+	Capabilities []string
+}
+
+// RegisterFlags defines the -vtunnel flags that set the options.
+func (o *VTunnelOptions) RegisterFlags(flags *flag.FlagSet) {
+	flags.DurationVar(&o.RetryTimeout, "vtunnelRetryTimeout", defaultVTunnelRetryTimeout,
+		"maximum amount of time for retrying a port mapping when the Vtunnel peer refuses the connection, 0 disables it")
+	flags.DurationVar(&o.SendTimeout, "vtunnelSendTimeout", defaultVTunnelSendTimeout,
+		"maximum amount of time for sending a single port mapping to the Vtunnel peer and reading its response, "+
+			"the timed out port mappings are retried later by the tracker; used with -forwarder=vtunnel, vsock or hvsock, 0 disables it")
+	flags.IntVar(&o.QueueSize, "vtunnelQueueSize", defaultVTunnelQueueSize,
+		"maximum number of port bindings to queue while the Vtunnel peer is not reachable, all the port mappings "+
+			"are sent again once it is reachable if more changed; used with -forwarder=vtunnel, vsock or hvsock, 0 disables it")
+	flags.StringVar(&o.QueueFile, "vtunnelQueueFile", "",
+		"file to save the port mappings that are queued for the Vtunnel peer to when the agent exits, and to load "+
+			"them from when it starts, so that the removals are not lost; used with -vtunnelQueueSize, empty disables it")
+	flags.DurationVar(&o.QueueMaxAge, "vtunnelQueueMaxAge", defaultVTunnelQueueMaxAge,
+		"maximum age of the port mappings that are loaded from -vtunnelQueueFile, 0 disables it")
+	flags.BoolVar(&o.RawJSON, "vtunnelRawJSON", false,
+		"send the port mappings as raw JSON instead of length-prefixed frames, for Vtunnel peers "+
+			"that predate the framing; used with -forwarder=vtunnel, vsock or hvsock")
+	flags.BoolVar(&o.Failback, "vtunnelFailback", false,
+		"return to the first reachable address of -vtunnelAddr, instead of sticking with the one that was failed over to")
+	flags.DurationVar(&o.KeepAlive.Idle, "vtunnelKeepAliveIdle", defaultKeepAliveIdle,
+		"amount of time without traffic after which the TCP connections to the Vtunnel peer are probed, "+
+			"so that the half-open ones fail; used with -forwarder=vtunnel, 0 disables it")
+	flags.DurationVar(&o.KeepAlive.Interval, "vtunnelKeepAliveInterval", defaultKeepAliveInterval,
+		"amount of time between the keepalive probes of -vtunnelKeepAliveIdle, 0 leaves it to the kernel")
+	flags.IntVar(&o.KeepAlive.Count, "vtunnelKeepAliveCount", defaultKeepAliveCount,
+		"number of unanswered keepalive probes of -vtunnelKeepAliveIdle after which the connection fails, 0 leaves it to the kernel")
+	flags.DurationVar(&o.WriteTimeout, "vtunnelWriteTimeout", defaultWriteTimeout,
+		"maximum amount of time for writing a port mapping to the Vtunnel peer, after which it is considered unresponsive "+
+			"and the port mappings are sent again once it responds; used with -forwarder=vtunnel, vsock or hvsock, 0 disables it")
+}
+
+// apply enables the features that all the vtunnel based forwarders share,
+// the failback only applies to the ones with several peer addresses.
+func (o *VTunnelOptions) apply(vtunnelForwarder *VTunnelForwarder) {
+	if o.RetryTimeout > 0 {
+		vtunnelForwarder.EnableRetry(vtunnelRetryBackoff, o.RetryTimeout)
+	}
+
+	if o.QueueSize > 0 {
+		vtunnelForwarder.EnableQueue(o.QueueSize)
+	}
+
+	if o.SendTimeout > 0 {
+		vtunnelForwarder.SetTimeout(o.SendTimeout)
+	}
+
+	if o.RawJSON {
+		vtunnelForwarder.EnableRawJSON()
+	}
+
+	if o.KeepAlive.Idle > 0 {
+		vtunnelForwarder.SetKeepAlive(o.KeepAlive)
+	}
+
+	if o.WriteTimeout > 0 {
+		vtunnelForwarder.SetWriteTimeout(o.WriteTimeout)
+	}
+
+	if len(o.Capabilities) > 0 {
+		vtunnelForwarder.SetCapabilities(o.Capabilities)
+	}
+}
+
+// ParsePeerAddr returns the network and the address to dial for a peer
+// address, which is either HOST:PORT or unix:///path/to/socket. The host
+// is an IP address, in brackets for IPv6, or a host name that is resolved
+// when the peer is dialed, and the port is between 1 and 65535.
+func ParsePeerAddr(peerAddr string) (string, string, error) {
+	if path, ok := strings.CutPrefix(peerAddr, unixScheme); ok {
+		if !strings.HasPrefix(path, "/") {
+			return "", "", fmt.Errorf("%w: %q must be an absolute socket path", ErrInvalidPeerAddr, peerAddr)
+		}
+
+		return "unix", path, nil
+	}
+
+	if strings.Contains(peerAddr, "://") {
+		return "", "", fmt.Errorf("%w: %q has an unsupported scheme", ErrInvalidPeerAddr, peerAddr)
+	}
+
+	_, port, err := net.SplitHostPort(peerAddr)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %q: %w", ErrInvalidPeerAddr, peerAddr, err)
+	}
+
+	if number, err := strconv.ParseUint(port, 10, 16); err != nil || number == 0 {
+		return "", "", fmt.Errorf("%w: %q: the port must be a number between 1 and 65535", ErrInvalidPeerAddr, peerAddr)
+	}
+
+	return "tcp", peerAddr, nil
+}
+
+// SetDialer replaces the function that is used to connect to the peer.
+func (v *VTunnelForwarder) SetDialer(dial DialFunc) {
+	v.dial = dial
+}
+
+// SetTimeout sets the maximum amount of time for an exchange with the peer,
+// from connecting to it to reading its response. The sends that time out
+// fail with ErrSendTimeout and are not retried, a zero timeout disables it.
+func (v *VTunnelForwarder) SetTimeout(timeout time.Duration) {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	v.timeout = timeout
+}
+
+// SetPeerRestartHandler sets the function that is called when the peer is
+// detected to have restarted, either since it responded with a different
+// instance ID, or since it became reachable again. The peer has lost all the
+// port mappings by then, so the handler should send them again; it is called
+// from Send and must not block on sending.
+func (v *VTunnelForwarder) SetPeerRestartHandler(onRestart func()) {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	v.onRestart = onRestart
+}
+
+// SetReservedPortsHandler sets the function that is called when the host
+// ports that the peer reports to be reserved change, see ReservedPorts. The
+// peer reports them whenever the agent connects to it; the handler is called
+// from Send and must not block on sending.
+func (v *VTunnelForwarder) SetReservedPortsHandler(onReserved func()) {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	v.onReserved = onReserved
+}
+
+// EnableRetry makes Send retry the port mappings when the peer refuses the
+// connection, e.g. while the host side service is still starting; or when
+// the peer's unix domain socket is missing or not accessible yet. The delay
+// between the attempts is random, up to initialBackoff at first and growing
+// exponentially, see retry.Policy, and Send gives up once maxElapsed has passed.
+func (v *VTunnelForwarder) EnableRetry(initialBackoff, maxElapsed time.Duration) {
+	v.retryPolicy = retry.Policy{
+		Initial: initialBackoff,
+		Max:     min(vtunnelMaxRetryInterval, maxElapsed),
+		Budget:  maxElapsed,
+		Source:  v.retryPolicy.Source,
 	}
 }
 
-// Send forwards the port mappings to Vtunnel Peer.
-func (v *VTunnelForwarder) Send(portMapping types.PortMapping) error {
-	conn, err := net.Dial("tcp", v.peerAddr)
+// SetRetrySource sets the source that the delays between the retries are
+// drawn from, e.g. a seeded one for the tests, see retry.NewSource.
+func (v *VTunnelForwarder) SetRetrySource(source rand.Source) {
+	v.retryPolicy.Source = source
+}
+
+// Send forwards the port mappings to Vtunnel Peer. If retries are enabled
+// and the peer refuses the connection, it is attempted again; the port
+// bindings that were sent again by a later call are dropped from the retry.
+// It fails with ErrPortRejected if the peer could not apply any of the port
+// bindings.
+func (v *VTunnelForwarder) Send(ctx context.Context, portMapping types.PortMapping) error {
+	results, err := v.SendWithResults(ctx, portMapping)
 	if err != nil {
 		return err
 	}
+
+	return rejectedError(results)
+}
+
+// SendWithResults forwards the port mappings like Send, and returns the
+// outcome of every port binding that the peer reported. Older peers do not
+// report them, nor do the port mappings that were queued or superseded.
+// The port mappings whose labels are too large are never sent.
+func (v *VTunnelForwarder) SendWithResults(ctx context.Context, portMapping types.PortMapping) ([]PortResult, error) {
+	if err := types.ValidateLabels(portMapping.Labels); err != nil {
+		return nil, err
+	}
+
+	keys := bindingKeys(portMapping)
+	generation := v.supersede(keys)
+	defer v.release(keys, generation)
+
+	backoff := v.retryPolicy.Start()
+
+	// The sequence number is assigned once, on the first attempt, and the
+	// retries keep it.
+	var seq uint64
+
+	for {
+		results, restarted, err := v.attempt(ctx, portMapping, generation, &seq)
+		if restarted {
+			v.peerRestarted()
+		}
+
+		if err == nil || !retryable(err) {
+			return results, err
+		}
+
+		if v.retryPolicy.Initial == 0 {
+			return nil, v.enqueue(portMapping, generation, err)
+		}
+
+		// The delays are random, so that the retries of the
+		// agents that started at the same time spread out.
+		delay, ok := backoff.Next()
+		if !ok {
+			err = fmt.Errorf("giving up sending port mapping after %s: %w", v.retryPolicy.Budget, err)
+
+			return nil, v.enqueue(portMapping, generation, err)
+		}
+
+		logger.Debugf("vtunnel peer is not reachable, retrying in %s: %v", delay, err)
+		v.retries.Add(1)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("giving up sending port mapping: %w", ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryable returns true if the peer is not listening yet, for a unix domain
+// socket that includes the socket file missing or not being accessible yet,
+// and for a host name that does not resolve yet, e.g. while the network is
+// coming up.
+func retryable(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && (dnsErr.IsNotFound || dnsErr.IsTemporary || dnsErr.IsTimeout) {
+		return true
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, syscall.EACCES)
+}
+
+// attempt sends the port bindings of the port mapping that were not
+// superseded by a later send, nothing is sent if they all were. The sequence
+// number of the port mapping is assigned to seq on the first attempt. It also
+// returns whether the peer was detected to have restarted.
+func (v *VTunnelForwarder) attempt(
+	ctx context.Context,
+	portMapping types.PortMapping,
+	generation uint64,
+	seq *uint64,
+) ([]PortResult, bool, error) {
+	v.sendMutex.Lock()
+	defer v.sendMutex.Unlock()
+
+	portMapping, ok := v.current(portMapping, generation)
+	if !ok {
+		logger.Debugf("dropping the retry of a port mapping that was superseded: %+v", portMapping)
+
+		return nil, false, nil
+	}
+
+	if *seq == 0 {
+		*seq = v.nextSeq()
+	}
+
+	portMapping.Seq = *seq
+
+	return v.deliver(ctx, portMapping)
+}
+
+// nextSeq returns the sequence number of the next payload, it must be
+// called with the sendMutex held.
+func (v *VTunnelForwarder) nextSeq() uint64 {
+	v.seq++
+
+	return v.seq
+}
+
+// exchange sends the port mapping to the peer and reads its response, it
+// returns the outcome of the port bindings that the peer reported and whether
+// the peer was detected to have restarted. Nothing is sent if the port mapping
+// is identical to the last one that was delivered, unless the context was
+// created by WithForce. It must be called with the sendMutex held, so that
+// the payloads are sent in the order of their sequence numbers; the payloads
+// that were not assigned one yet, e.g. the heartbeats and the queued changes,
+// get the next one.
+func (v *VTunnelForwarder) exchange(ctx context.Context, portMapping types.PortMapping) ([]PortResult, bool, error) {
+	hash, err := payloadHash(portMapping)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: %w", ErrPayloadRejected, err)
+	}
+
+	if v.duplicate(ctx, portMapping, hash) {
+		logger.Debugf("skipping a port mapping that is identical to the last one that was delivered: %+v", portMapping)
+
+		return nil, false, nil
+	}
+
+	if portMapping.Seq == 0 {
+		portMapping.Seq = v.nextSeq()
+	}
+
+	if v.timeout != 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, v.timeout)
+		defer cancel()
+	}
+
+	// The protocol is negotiated again with every peer that is connected
+	// to, since it may have been upgraded or downgraded in the meantime.
+	negotiatedOver := false
+	if !v.negotiated {
+		if negotiatedOver, err = v.negotiate(ctx); err != nil {
+			return nil, negotiatedOver, v.dialError(ctx, err)
+		}
+	}
+
+	// The fields that the peer does not understand are not sent at all.
+	schemaVersion := types.SchemaVersionFor(v.protocolVersion)
+	payload := types.Downgrade(portMapping, schemaVersion)
+
+	// The peers that can not tell that the ports are only to be reported would
+	// forward them, they are sent none; the removals still withdraw them.
+	if !portMapping.Remove && !types.Reportable(portMapping, schemaVersion) {
+		v.withheld.Do(func() {
+			logger.Warnf("the vtunnel peer speaks the protocol version %d, which can not only report the port mappings, "+
+				"they are tracked without being sent to it", v.protocolVersion)
+		})
+
+		payload = withoutPorts(payload)
+	}
+
+	bin, err := json.Marshal(payload)
+	if err != nil {
+		return nil, negotiatedOver, fmt.Errorf("%w: %w", ErrPayloadRejected, err)
+	}
+
+	logger.Tracef("sending the payload to the vtunnel peer: %s", bin)
+
+	conn, failedOver, err := v.dialPeer(ctx)
+	if err != nil {
+		return nil, negotiatedOver, v.dialError(ctx, err)
+	}
+
+	if failedOver {
+		v.negotiated = false
+	}
+
+	if v.tlsConfig != nil {
+		if conn, err = v.handshake(ctx, conn); err != nil {
+			return nil, negotiatedOver, sendError(ctx, err)
+		}
+	}
 	defer conn.Close()
 
-	err = json.NewEncoder(conn).Encode(portMapping)
+	// The blocked writes and reads are interrupted once the context is done.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	// A peer that comes back after being unreachable may have restarted,
+	// and a peer that was failed over to has none of the port mappings.
+	restarted := v.unreachable || failedOver || negotiatedOver
+	v.unreachable = false
+
+	if restarted {
+		v.reconnects.Add(1)
+	}
+
+	// The legacy peers predate the framing.
+	rawJSON := v.rawJSON || v.protocolVersion == 0
+
+	v.setWriteDeadline(conn)
+
+	if rawJSON {
+		err = writeFull(conn, append(bin, '\n'))
+	} else {
+		err = WriteFrame(conn, bin)
+	}
+
 	if err != nil {
-		return err
+		return nil, restarted, v.writeError(ctx, err)
+	}
+
+	v.lastContact = time.Now()
+
+	status := readStatus(ctx, conn, rawJSON)
+	if status == nil {
+		v.unacknowledged.Do(func() {
+			logger.Infof("vtunnel peer does not acknowledge the port mappings, assuming that they are applied")
+		})
+
+		v.remember(portMapping, hash, nil, restarted)
+
+		return nil, restarted, nil
+	}
+
+	if status.InstanceID != "" {
+		if v.instanceID != "" && v.instanceID != status.InstanceID {
+			logger.Infof("vtunnel peer restarted, instance ID changed from %s to %s", v.instanceID, status.InstanceID)
+
+			restarted = true
+			v.negotiated = false
+		}
+
+		v.instanceID = status.InstanceID
+	}
+
+	results := fromPortStatuses(status.Results)
+	v.remember(portMapping, hash, results, restarted)
+
+	return results, restarted, nil
+}
+
+// withoutPorts returns the port mapping without any of its ports, which
+// withdraws them all when it is a snapshot.
+func withoutPorts(portMapping types.PortMapping) types.PortMapping {
+	portMapping.Ports = nat.PortMap{}
+	portMapping.Metadata = nil
+	portMapping.Protocols = nil
+	portMapping.Sources = nil
+	portMapping.HostBindAddrs = nil
+	portMapping.PortSeqs = nil
+
+	return portMapping
+}
+
+// dialError reports the failure to connect to the peer, which is
+// unreachable from then on unless the context is done.
+func (v *VTunnelForwarder) dialError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return sendError(ctx, err)
+	}
+
+	v.unreachable = true
+	v.negotiated = false
+
+	return err
+}
+
+// sendError reports the failures that are due to the context being done
+// as ErrSendTimeout or as cancelled, distinctly from the connection errors.
+func sendError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrSendTimeout, err)
+	case ctx.Err() != nil:
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+
+	return err
+}
+
+// readStatus returns the status that the peer responded with, in a frame
+// unless rawJSON is set, or nil if it did not respond before the context
+// is done.
+func readStatus(ctx context.Context, conn net.Conn, rawJSON bool) *types.PeerStatus {
+	deadline := time.Now().Add(peerResponseTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	if ctx.Err() != nil || conn.SetReadDeadline(deadline) != nil {
+		return nil
+	}
+
+	var status types.PeerStatus
+
+	if rawJSON {
+		if err := json.NewDecoder(conn).Decode(&status); err != nil {
+			return nil
+		}
+
+		return &status
+	}
+
+	payload, err := ReadFrame(conn)
+	if err != nil {
+		if !errors.Is(err, io.EOF) && !errors.Is(err, os.ErrDeadlineExceeded) {
+			logger.Debugf("failed to read the vtunnel peer status: %v", err)
+		}
+
+		return nil
+	}
+
+	if err := json.Unmarshal(payload, &status); err != nil {
+		logger.Debugf("failed to decode the vtunnel peer status: %v", err)
+
+		return nil
+	}
+
+	return &status
+}
+
+func fromPortStatuses(portStatuses []types.PortStatus) []PortResult {
+	if portStatuses == nil {
+		return nil
+	}
+
+	results := make([]PortResult, 0, len(portStatuses))
+
+	for _, portStatus := range portStatuses {
+		result := PortResult{
+			Port:    portStatus.Port,
+			Binding: nat.PortBinding{HostIP: portStatus.HostIP, HostPort: portStatus.HostPort},
+		}
+
+		if portStatus.Error != "" {
+			result.Err = errors.New(portStatus.Error)
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func (v *VTunnelForwarder) peerRestarted() {
+	v.sendMutex.Lock()
+	onRestart := v.onRestart
+	v.sendMutex.Unlock()
+
+	if onRestart != nil {
+		onRestart()
+	}
+}
+
+// supersede records a new send for the given port bindings.
+func (v *VTunnelForwarder) supersede(keys []string) uint64 {
+	v.genMutex.Lock()
+	defer v.genMutex.Unlock()
+
+	v.generation++
+	for _, key := range keys {
+		v.generations[key] = v.generation
+	}
+
+	return v.generation
+}
+
+// release forgets about the port bindings once the latest send for them is done.
+func (v *VTunnelForwarder) release(keys []string, generation uint64) {
+	v.genMutex.Lock()
+	defer v.genMutex.Unlock()
+
+	for _, key := range keys {
+		if v.generations[key] == generation {
+			delete(v.generations, key)
+		}
+	}
+}
+
+// current returns the port mapping without the port bindings that were
+// superseded by a later send, and false if nothing is left to send.
+// Snapshots are sent whole, since a partial snapshot would drop ports.
+func (v *VTunnelForwarder) current(portMapping types.PortMapping, generation uint64) (types.PortMapping, bool) {
+	v.genMutex.Lock()
+	defer v.genMutex.Unlock()
+
+	if portMapping.Replace {
+		return portMapping, v.generations[replaceKey] == generation
+	}
+
+	ports := make(nat.PortMap, len(portMapping.Ports))
+	superseded := false
+
+	for port, bindings := range portMapping.Ports {
+		if bindings == nil {
+			if v.generations[string(port)] != generation {
+				superseded = true
+
+				continue
+			}
+
+			ports[port] = nil
+
+			continue
+		}
+
+		for _, binding := range bindings {
+			if v.generations[bindingKey(port, binding)] != generation {
+				superseded = true
+
+				continue
+			}
+
+			ports[port] = append(ports[port], binding)
+		}
+	}
+
+	if !superseded {
+		return portMapping, true
+	}
+
+	portMapping.Ports = ports
+
+	return portMapping, len(ports) != 0
+}
+
+func bindingKey(port nat.Port, binding nat.PortBinding) string {
+	return string(port) + "/" + binding.HostIP + "/" + binding.HostPort
+}
+
+func bindingKeys(portMapping types.PortMapping) []string {
+	if portMapping.Replace {
+		return []string{replaceKey}
+	}
+
+	var keys []string
+
+	for port, bindings := range portMapping.Ports {
+		if bindings == nil {
+			keys = append(keys, string(port))
+		}
+
+		for _, binding := range bindings {
+			keys = append(keys, bindingKey(port, binding))
+		}
 	}
 
-	return nil
+	return keys
 }
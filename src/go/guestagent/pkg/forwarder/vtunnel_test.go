@@ -0,0 +1,859 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package forwarder_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPeer is a fake vtunnel peer that refuses the connections until
+// the given number of dials, it responds with its instance ID if set,
+// and with the outcome of every port binding if it acknowledges them.
+// It reads both frames and raw JSON, and responds in the same format.
+type testPeer struct {
+	listener    net.Listener
+	portMaps    chan types.PortMapping
+	refuse      int
+	refuseAll   bool
+	dials       int
+	instanceID  string
+	acknowledge bool
+	// rejected maps the host ports that the peer fails to apply to their error.
+	rejected map[string]string
+	// features are the optional parts of the protocol that the peer advertises.
+	features []string
+	// reserved are the host ports that the peer reports to be reserved.
+	reserved []types.ReservedPorts
+	// acknowledged are the capabilities that the peer acknowledges, whether
+	// or not the agent sent them.
+	acknowledged []string
+	// protocolVersion and minProtocolVersion are the versions that the peer
+	// answers the hellos with, types.ProtocolVersion and none when they are
+	// zero, and serviceVersion is its version.
+	protocolVersion    int
+	minProtocolVersion int
+	serviceVersion     string
+	// legacy makes the peer not answer the hellos, and garbled
+	// makes it answer them with garbage.
+	legacy  bool
+	garbled bool
+	hellos  int
+	// agentVersion is the agent version of the last hello, and
+	// hello is the last hello itself.
+	agentVersion string
+	hello        types.Hello
+	// rawJSON is set if the last port mapping was received as raw JSON.
+	rawJSON bool
+	// seqs are the sequence numbers of the received port mappings, in
+	// order; they are cleared from the port mappings that are received.
+	seqs []uint64
+	// portSeqs are the sequence numbers of the host ports of the received
+	// port mappings, in order; they are cleared like the seqs.
+	portSeqs []map[string]uint64
+	// schemaVersion is the schema version of the last port mapping,
+	// which is cleared from the port mappings like the seqs.
+	schemaVersion int
+	mutex         sync.Mutex
+}
+
+func newTestPeer(t *testing.T, refuse int) *testPeer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	return serveTestPeer(t, listener, refuse)
+}
+
+func serveTestPeer(t *testing.T, listener net.Listener, refuse int) *testPeer {
+	t.Helper()
+
+	t.Cleanup(func() { listener.Close() })
+
+	peer := &testPeer{
+		listener: listener,
+		portMaps: make(chan types.PortMapping, 10),
+		refuse:   refuse,
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			if portMapping, rawJSON, err := readPortMapping(bufio.NewReader(conn)); err == nil && portMapping.Hello != nil {
+				peer.answerHello(conn, portMapping.Hello, rawJSON)
+			} else if err == nil {
+				peer.mutex.Lock()
+				peer.rawJSON = rawJSON
+				peer.seqs = append(peer.seqs, portMapping.Seq)
+				peer.portSeqs = append(peer.portSeqs, portMapping.PortSeqs)
+				peer.schemaVersion = portMapping.SchemaVersion
+				peer.mutex.Unlock()
+
+				status := peer.status(portMapping)
+				portMapping.Seq = 0
+				portMapping.PortSeqs = nil
+				portMapping.SchemaVersion = 0
+				peer.portMaps <- portMapping
+
+				if status != nil {
+					_ = writeStatus(conn, status, rawJSON)
+				}
+			}
+
+			conn.Close()
+		}
+	}()
+
+	return peer
+}
+
+// answerHello answers the hello with the protocol version and
+// the features of the peer, unless it is a legacy peer.
+func (p *testPeer) answerHello(conn net.Conn, hello *types.Hello, rawJSON bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.hellos++
+	p.agentVersion = hello.AgentVersion
+	p.hello = *hello
+
+	switch {
+	case p.garbled:
+		_, _ = conn.Write([]byte{forwarder.FrameVersion, 0, 0, 0, 3, 'n', 'o', 't'})
+	case !p.legacy:
+		protocolVersion := p.protocolVersion
+		if protocolVersion == 0 {
+			protocolVersion = types.ProtocolVersion
+		}
+
+		_ = writeStatus(conn, &types.PeerStatus{
+			InstanceID:         p.instanceID,
+			ProtocolVersion:    protocolVersion,
+			MinProtocolVersion: p.minProtocolVersion,
+			ServiceVersion:     p.serviceVersion,
+			Features:           p.features,
+			Reserved:           p.reserved,
+			Capabilities:       p.acknowledged,
+		}, rawJSON)
+	}
+}
+
+// readPortMapping reads a port mapping, either raw JSON or a frame; it
+// returns whether it was raw JSON.
+func readPortMapping(reader *bufio.Reader) (types.PortMapping, bool, error) {
+	var portMapping types.PortMapping
+
+	first, err := reader.Peek(1)
+	if err != nil {
+		return portMapping, false, err
+	}
+
+	if first[0] == '{' {
+		return portMapping, true, json.NewDecoder(reader).Decode(&portMapping)
+	}
+
+	payload, err := forwarder.ReadFrame(reader)
+	if err != nil {
+		return portMapping, false, err
+	}
+
+	return portMapping, false, json.Unmarshal(payload, &portMapping)
+}
+
+func writeStatus(conn io.Writer, status *types.PeerStatus, rawJSON bool) error {
+	if rawJSON {
+		return json.NewEncoder(conn).Encode(status)
+	}
+
+	payload, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	return forwarder.WriteFrame(conn, payload)
+}
+
+func (p *testPeer) dial(ctx context.Context, network, address string) (net.Conn, error) {
+	p.mutex.Lock()
+	p.dials++
+	refused := p.refuseAll || p.dials <= p.refuse
+	p.mutex.Unlock()
+
+	if refused {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func (p *testPeer) setRefuseAll(refuseAll bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.refuseAll = refuseAll
+}
+
+func (p *testPeer) setInstanceID(instanceID string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.instanceID = instanceID
+}
+
+func (p *testPeer) setFeatures(features ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.features = features
+}
+
+func (p *testPeer) setAcknowledged(capabilities ...string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.acknowledged = capabilities
+}
+
+func (p *testPeer) setProtocol(minProtocolVersion, protocolVersion int, serviceVersion string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.minProtocolVersion, p.protocolVersion, p.serviceVersion = minProtocolVersion, protocolVersion, serviceVersion
+}
+
+func (p *testPeer) setReserved(reserved ...types.ReservedPorts) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.reserved = reserved
+}
+
+func (p *testPeer) setAcknowledge(acknowledge bool, rejected map[string]string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.acknowledge = acknowledge
+	p.rejected = rejected
+}
+
+// status returns the response to the port mapping, or nil if the peer stays silent.
+func (p *testPeer) status(portMapping types.PortMapping) *types.PeerStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.acknowledge {
+		if p.instanceID == "" {
+			return nil
+		}
+
+		return &types.PeerStatus{InstanceID: p.instanceID}
+	}
+
+	status := &types.PeerStatus{InstanceID: p.instanceID, Results: []types.PortStatus{}}
+
+	for port, bindings := range portMapping.Ports {
+		for _, binding := range bindings {
+			status.Results = append(status.Results, types.PortStatus{
+				Port:     port,
+				HostIP:   binding.HostIP,
+				HostPort: binding.HostPort,
+				Error:    p.rejected[binding.HostPort],
+			})
+		}
+	}
+
+	return status
+}
+
+func (p *testPeer) setLegacy(legacy, garbled bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.legacy = legacy
+	p.garbled = garbled
+}
+
+func (p *testPeer) lastSchemaVersion() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.schemaVersion
+}
+
+func (p *testPeer) helloCount() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.hellos
+}
+
+func (p *testPeer) lastAgentVersion() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.agentVersion
+}
+
+func (p *testPeer) lastHello() types.Hello {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.hello
+}
+
+func (p *testPeer) receivedRawJSON() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.rawJSON
+}
+
+func (p *testPeer) receivedSeqs() []uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return append([]uint64(nil), p.seqs...)
+}
+
+func (p *testPeer) dialCount() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.dials
+}
+
+func (p *testPeer) receive(t *testing.T) types.PortMapping {
+	t.Helper()
+
+	select {
+	case portMapping := <-p.portMaps:
+		return portMapping
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for the port mapping")
+	}
+
+	return types.PortMapping{}
+}
+
+func newTestForwarder(peer *testPeer) *forwarder.VTunnelForwarder {
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(peer.listener.Addr().String())
+	vtunnelForwarder.SetDialer(peer.dial)
+
+	return vtunnelForwarder
+}
+
+func testPortMapping(remove bool, ports ...nat.Port) types.PortMapping {
+	portMap := make(nat.PortMap, len(ports))
+	for _, port := range ports {
+		portMap[port] = []nat.PortBinding{
+			{
+				HostIP:   "127.0.0.1",
+				HostPort: port.Port(),
+			},
+		}
+	}
+
+	return types.PortMapping{
+		Remove: remove,
+		Ports:  portMap,
+	}
+}
+
+func TestVTunnelForwarderRetry(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 3)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableRetry(time.Millisecond, time.Minute)
+
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), portMapping))
+
+	// The peer is dialed for the hello once it accepts the connections.
+	assert.Equal(t, portMapping, peer.receive(t))
+	assert.Equal(t, 5, peer.dialCount())
+}
+
+func TestVTunnelForwarderRetryDisabled(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 1)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	err := vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+	assert.Equal(t, 1, peer.dialCount())
+}
+
+func TestVTunnelForwarderRetryMaxElapsed(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setRefuseAll(true)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableRetry(time.Millisecond, 50*time.Millisecond)
+
+	start := time.Now()
+	err := vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Greater(t, peer.dialCount(), 1)
+}
+
+func TestVTunnelForwarderNoRetryOnOtherErrors(t *testing.T) {
+	t.Parallel()
+
+	errDial := errors.New("no route to the peer")
+	dials := 0
+
+	vtunnelForwarder := forwarder.NewVTunnelForwarder("127.0.0.1:0")
+	vtunnelForwarder.SetDialer(func(context.Context, string, string) (net.Conn, error) {
+		dials++
+
+		return nil, errDial
+	})
+	vtunnelForwarder.EnableRetry(time.Millisecond, time.Minute)
+
+	err := vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, errDial)
+	assert.Equal(t, 1, dials)
+}
+
+func TestVTunnelForwarderRetrySuperseded(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setRefuseAll(true)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableRetry(200*time.Millisecond, time.Minute)
+
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp", "443/tcp"))
+	}()
+
+	require.Eventually(t, func() bool {
+		return peer.dialCount() == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// The later removal of port 80 supersedes the queued retry for it.
+	peer.setRefuseAll(false)
+
+	removal := testPortMapping(true, "80/tcp")
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), removal))
+	assert.Equal(t, removal, peer.receive(t))
+
+	require.NoError(t, <-errCh)
+	assert.Equal(t, testPortMapping(false, "443/tcp"), peer.receive(t))
+}
+
+func TestVTunnelForwarderPeerRestart(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setInstanceID("first")
+	vtunnelForwarder := newTestForwarder(peer)
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	vtunnelTracker := tracker.NewVTunnelTracker(vtunnelForwarder, wslConnectAddr)
+	vtunnelForwarder.SetPeerRestartHandler(vtunnelTracker.PeerRestarted)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_1", testPortMapping(false, "80/tcp").Ports))
+	peer.receive(t)
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_2", testPortMapping(false, "443/tcp").Ports))
+	peer.receive(t)
+
+	// The peer restarts, and the restart is detected on the next send.
+	peer.setInstanceID("second")
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "containerID_3", testPortMapping(false, "8080/tcp").Ports))
+	peer.receive(t)
+
+	snapshot := peer.receive(t)
+	assert.True(t, snapshot.Replace)
+	assert.Equal(t, testPortMapping(false, "80/tcp", "443/tcp", "8080/tcp").Ports, snapshot.Ports)
+	assert.Equal(t, wslConnectAddr, snapshot.ConnectAddrs)
+}
+
+func TestVTunnelForwarderPeerReachableAgain(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 1)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	var restarts atomic.Int32
+	vtunnelForwarder.SetPeerRestartHandler(func() {
+		restarts.Add(1)
+	})
+
+	require.ErrorIs(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")), syscall.ECONNREFUSED)
+	assert.Zero(t, restarts.Load())
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+	assert.Equal(t, int32(1), restarts.Load())
+
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, "443/tcp")))
+	peer.receive(t)
+	assert.Equal(t, int32(1), restarts.Load())
+}
+
+func TestParsePeerAddr(t *testing.T) {
+	t.Parallel()
+
+	network, address, err := forwarder.ParsePeerAddr("127.0.0.1:3040")
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "127.0.0.1:3040", address)
+
+	network, address, err = forwarder.ParsePeerAddr("[::1]:3040")
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "[::1]:3040", address)
+
+	network, address, err = forwarder.ParsePeerAddr("host.rancher-desktop.internal:3040")
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", network)
+	assert.Equal(t, "host.rancher-desktop.internal:3040", address)
+
+	network, address, err = forwarder.ParsePeerAddr("unix:///run/relay.sock")
+	require.NoError(t, err)
+	assert.Equal(t, "unix", network)
+	assert.Equal(t, "/run/relay.sock", address)
+
+	for _, peerAddr := range []string{
+		"unix://relay.sock", "http://127.0.0.1:3040", "127.0.0.1", "::1:3040",
+		"127.0.0.1:0", "127.0.0.1:65536", "127.0.0.1:vtunnel",
+	} {
+		_, _, err := forwarder.ParsePeerAddr(peerAddr)
+		require.ErrorIs(t, err, forwarder.ErrInvalidPeerAddr, peerAddr)
+	}
+}
+
+func TestVTunnelForwarderUnixSocket(t *testing.T) {
+	t.Parallel()
+
+	socketPath := filepath.Join(t.TempDir(), "peer.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	peer := serveTestPeer(t, listener, 0)
+	vtunnelForwarder := forwarder.NewVTunnelForwarder("unix://" + socketPath)
+
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, peer.receive(t))
+}
+
+func TestVTunnelForwarderUnixSocketMissing(t *testing.T) {
+	t.Parallel()
+
+	socketPath := filepath.Join(t.TempDir(), "peer.sock")
+	vtunnelForwarder := forwarder.NewVTunnelForwarder("unix://" + socketPath)
+
+	err := vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, syscall.ENOENT)
+
+	// The socket is retried like a refused connection until the relay starts.
+	vtunnelForwarder.EnableRetry(10*time.Millisecond, time.Minute)
+
+	peerCh := make(chan *testPeer, 1)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+
+		listener, err := net.Listen("unix", socketPath)
+		if !assert.NoError(t, err) {
+			close(peerCh)
+
+			return
+		}
+
+		peerCh <- serveTestPeer(t, listener, 0)
+	}()
+
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), portMapping))
+
+	peer := <-peerCh
+	require.NotNil(t, peer)
+	assert.Equal(t, portMapping, peer.receive(t))
+}
+
+func TestVTunnelForwarderUnixSocketPermission(t *testing.T) {
+	t.Parallel()
+
+	if os.Geteuid() == 0 {
+		t.Skip("the socket permissions do not apply to root")
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "peer.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+
+	peer := serveTestPeer(t, listener, 0)
+	require.NoError(t, os.Chmod(socketPath, 0o000))
+
+	vtunnelForwarder := forwarder.NewVTunnelForwarder("unix://" + socketPath)
+	vtunnelForwarder.EnableRetry(10*time.Millisecond, time.Minute)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, os.Chmod(socketPath, 0o600))
+	}()
+
+	portMapping := testPortMapping(false, "80/tcp")
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, peer.receive(t))
+}
+
+func TestVTunnelForwarderAcknowledged(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setAcknowledge(true, nil)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	results, err := vtunnelForwarder.SendWithResults(context.Background(), testPortMapping(false, "80/tcp"))
+	require.NoError(t, err)
+	peer.receive(t)
+
+	require.Len(t, results, 1)
+	assert.Equal(t, nat.Port("80/tcp"), results[0].Port)
+	assert.Equal(t, nat.PortBinding{HostIP: "127.0.0.1", HostPort: "80"}, results[0].Binding)
+	assert.NoError(t, results[0].Err)
+}
+
+func TestVTunnelForwarderLabels(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	portMapping := testPortMapping(false, "80/tcp")
+	portMapping.Labels = map[string]string{types.LabelContainerName: "web"}
+	require.NoError(t, vtunnelForwarder.Send(context.Background(), portMapping))
+	assert.Equal(t, portMapping, peer.receive(t))
+
+	// The labels that are too large are never sent.
+	portMapping.Labels[types.LabelContainerName] = strings.Repeat("w", types.MaxLabelsSize)
+	require.ErrorIs(t, vtunnelForwarder.Send(context.Background(), portMapping), types.ErrLabelsTooLarge)
+	assertNothingReceived(t, peer)
+}
+
+func TestVTunnelForwarderRejected(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	peer.setAcknowledge(true, map[string]string{"443": "address already in use"})
+	vtunnelForwarder := newTestForwarder(peer)
+
+	portMapping := testPortMapping(false, "80/tcp", "443/tcp")
+
+	err := vtunnelForwarder.Send(context.Background(), portMapping)
+	require.ErrorIs(t, err, forwarder.ErrPortRejected)
+	assert.ErrorContains(t, err, "address already in use")
+	peer.receive(t)
+
+	results, err := vtunnelForwarder.SendWithResults(context.Background(), portMapping)
+	require.NoError(t, err)
+	peer.receive(t)
+
+	require.Len(t, results, 2)
+
+	for _, result := range results {
+		if result.Binding.HostPort == "443" {
+			assert.EqualError(t, result.Err, "address already in use")
+		} else {
+			assert.NoError(t, result.Err)
+		}
+	}
+}
+
+func TestVTunnelForwarderUnacknowledged(t *testing.T) {
+	t.Parallel()
+
+	// A peer that does not report the outcome is assumed to apply the port mappings.
+	peer := newTestPeer(t, 0)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	results, err := vtunnelForwarder.SendWithResults(context.Background(), testPortMapping(false, "80/tcp"))
+	require.NoError(t, err)
+	assert.Nil(t, results)
+	peer.receive(t)
+}
+
+// hungDialer connects to a peer that accepts the connections but never reads from them.
+func hungDialer(t *testing.T, dials *atomic.Int32) forwarder.DialFunc {
+	t.Helper()
+
+	return func(context.Context, string, string) (net.Conn, error) {
+		dials.Add(1)
+
+		client, server := net.Pipe()
+		t.Cleanup(func() { server.Close() })
+
+		return client, nil
+	}
+}
+
+func TestVTunnelForwarderSendTimeout(t *testing.T) {
+	t.Parallel()
+
+	var dials atomic.Int32
+
+	vtunnelForwarder := forwarder.NewVTunnelForwarder("127.0.0.1:3040")
+	vtunnelForwarder.SetDialer(hungDialer(t, &dials))
+	vtunnelForwarder.EnableRetry(time.Millisecond, time.Minute)
+	vtunnelForwarder.SetTimeout(100 * time.Millisecond)
+
+	// The timeout is not retried, unlike a refused connection.
+	err := vtunnelForwarder.Send(context.Background(), testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, forwarder.ErrSendTimeout)
+	assert.Equal(t, int32(1), dials.Load())
+}
+
+func TestVTunnelForwarderSendCancelled(t *testing.T) {
+	t.Parallel()
+
+	var dials atomic.Int32
+
+	vtunnelForwarder := forwarder.NewVTunnelForwarder("127.0.0.1:3040")
+	vtunnelForwarder.SetDialer(hungDialer(t, &dials))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	err := vtunnelForwarder.Send(ctx, testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, context.Canceled)
+	assert.NotErrorIs(t, err, forwarder.ErrSendTimeout)
+}
+
+func TestVTunnelForwarderSendDeadline(t *testing.T) {
+	t.Parallel()
+
+	var dials atomic.Int32
+
+	vtunnelForwarder := forwarder.NewVTunnelForwarder("127.0.0.1:3040")
+	vtunnelForwarder.SetDialer(hungDialer(t, &dials))
+
+	// The deadline of the caller applies without a timeout of the forwarder.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	err := vtunnelForwarder.Send(ctx, testPortMapping(false, "80/tcp"))
+	require.ErrorIs(t, err, forwarder.ErrSendTimeout)
+}
+
+func TestVTunnelForwarderSequence(t *testing.T) {
+	t.Parallel()
+
+	const senders = 10
+
+	// Some of the sends are retried while the others go through.
+	peer := newTestPeer(t, 3)
+	vtunnelForwarder := newTestForwarder(peer)
+	vtunnelForwarder.EnableRetry(time.Millisecond, time.Minute)
+
+	var wg sync.WaitGroup
+
+	for i := range senders {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			portMapping := testPortMapping(i%2 == 0, "80/tcp", nat.Port(fmt.Sprintf("%d/tcp", 8000+i)))
+			assert.NoError(t, vtunnelForwarder.Send(context.Background(), portMapping))
+		}()
+	}
+
+	for range senders {
+		peer.receive(t)
+	}
+
+	wg.Wait()
+
+	// Every port mapping gets a single sequence number, which its retries keep.
+	seqs := peer.receivedSeqs()
+	require.Len(t, seqs, senders)
+
+	expected := make([]uint64, 0, senders)
+	for seq := range uint64(senders) {
+		expected = append(expected, seq+1)
+	}
+
+	assert.ElementsMatch(t, expected, seqs)
+}
+
+func TestVTunnelForwarderSequenceOrder(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+	vtunnelForwarder := newTestForwarder(peer)
+
+	for _, port := range []nat.Port{"80/tcp", "443/tcp", "8080/tcp"} {
+		require.NoError(t, vtunnelForwarder.Send(context.Background(), testPortMapping(false, port)))
+		peer.receive(t)
+	}
+
+	// The sequence numbers start from 1, and are in the order of the sends.
+	assert.Equal(t, []uint64{1, 2, 3}, peer.receivedSeqs())
+}
+
+func TestVTunnelForwarderSequenceRestart(t *testing.T) {
+	t.Parallel()
+
+	peer := newTestPeer(t, 0)
+
+	require.NoError(t, newTestForwarder(peer).Send(context.Background(), testPortMapping(false, "80/tcp")))
+	peer.receive(t)
+
+	instanceID := peer.lastHello().InstanceID
+	require.NotEmpty(t, instanceID)
+
+	// A new forwarder, as after the agent restarted, starts over with another
+	// instance ID, rather than relying on the clock that may have stepped back.
+	require.NoError(t, newTestForwarder(peer).Send(context.Background(), testPortMapping(true, "80/tcp")))
+	peer.receive(t)
+
+	assert.NotEqual(t, instanceID, peer.lastHello().InstanceID)
+	assert.Equal(t, []uint64{1, 1}, peer.receivedSeqs())
+}
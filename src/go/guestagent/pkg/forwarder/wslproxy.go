@@ -16,12 +16,16 @@ limitations under the License.
 package forwarder
 
 import (
+	"context"
 	"encoding/json"
 	"net"
 
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
 )
 
+// WSLProxySocket is the unix socket that WSL Proxy listens on.
+const WSLProxySocket = "/run/wsl-proxy.sock"
+
 // WSLProxyForwarder forwards the PortMappings to Rancher Desktop WSLProxy process in
 // the default namespace over the unix socket.
 // For more information on Rancher Desktop WSL Proxy, refer to the source code at:
@@ -37,8 +41,8 @@ func NewWSLProxyForwarder(proxySocket string) *WSLProxyForwarder {
 }
 
 // Send forwards the port mappings to WSL Proxy.
-func (v *WSLProxyForwarder) Send(portMapping types.PortMapping) error {
-	conn, err := net.Dial("unix", v.proxySocket)
+func (v *WSLProxyForwarder) Send(ctx context.Context, portMapping types.PortMapping) error {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "unix", v.proxySocket)
 	if err != nil {
 		return err
 	}
@@ -51,3 +55,8 @@ func (v *WSLProxyForwarder) Send(portMapping types.PortMapping) error {
 
 	return nil
 }
+
+// RemovePorts withdraws the port mappings from WSL Proxy in a single message.
+func (v *WSLProxyForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	return v.Send(ctx, MergeRemovals(portMappings))
+}
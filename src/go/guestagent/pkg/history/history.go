@@ -0,0 +1,201 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package history keeps the recent changes of the tracker and the failures
+// of the subsystems in memory, so that what happened in the last minutes can
+// be asked for after the logs rolled over, see GET /events of the admin API.
+package history
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+const (
+	// DefaultSize is the number of records that are kept unless -eventHistorySize sets another.
+	DefaultSize = 500
+	// BufferSize is the number of changes that are held while they are recorded,
+	// the changes that do not fit are recorded as dropped rather than blocking the tracker.
+	BufferSize = 1024
+)
+
+// The kinds of the records.
+const (
+	// KindTracker is the kind of the records of the changes of the tracker.
+	KindTracker = "tracker"
+	// KindSubsystem is the kind of the records of the subsystems that failed.
+	KindSubsystem = "subsystem"
+	// KindDropped is the kind of the records of the changes that were lost.
+	KindDropped = "dropped"
+)
+
+// Record is an event of the history.
+type Record struct {
+	// Seq is the sequence number of the record, it increases with every
+	// record that is added; see History.Stream.
+	Seq       uint64    `json:"seq"`
+	Timestamp time.Time `json:"timestamp"`
+	// Kind is either KindTracker, KindSubsystem or KindDropped.
+	Kind string `json:"kind"`
+	// Action, ID, Port, Protocol, HostIP, Source, Metadata and
+	// Outcome describe the changes of the tracker, see tracker.Event.
+	Action   string            `json:"action,omitempty"`
+	ID       string            `json:"id,omitempty"`
+	Port     string            `json:"port,omitempty"`
+	Protocol string            `json:"protocol,omitempty"`
+	HostIP   string            `json:"hostIP,omitempty"`
+	Source   string            `json:"source,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Outcome  string            `json:"outcome,omitempty"`
+	// Subsystem and State are the subsystem that failed, and the state that it is in since.
+	Subsystem string `json:"subsystem,omitempty"`
+	State     string `json:"state,omitempty"`
+	// Error is why the change could not be sent to the host, or why the subsystem failed.
+	Error string `json:"error,omitempty"`
+	// Dropped is the number of changes that were lost since the last record.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// History holds the most recent records in a ring buffer of a fixed size,
+// so that the oldest record is evicted by a new one once it is full. It is
+// safe for concurrent use.
+type History struct {
+	mutex   sync.Mutex
+	records []Record
+	// next is the index of records that the next record is stored at.
+	next int
+	// full indicates that every slot of records holds a record.
+	full    bool
+	dropped uint64
+	// seq is the sequence number of the last record.
+	seq uint64
+	// streams receive the records as they are added, see Stream.
+	streams map[*Stream]struct{}
+}
+
+// New creates a history of at most size records, it keeps none if size is not positive.
+func New(size int) *History {
+	return &History{records: make([]Record, max(size, 0)), streams: make(map[*Stream]struct{})}
+}
+
+// Add records the event, evicting the oldest record if the history is full,
+// and delivers it to the streams; its Seq is set.
+func (h *History) Add(record Record) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.seq++
+	record.Seq = h.seq
+
+	for stream := range h.streams {
+		h.deliver(stream, record)
+	}
+
+	if len(h.records) == 0 {
+		return
+	}
+
+	h.records[h.next] = record
+
+	h.next++
+	if h.next == len(h.records) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// Records returns the records since the given time in the order they were
+// added, all of them if since is zero; at most the last limit of them if
+// limit is positive.
+func (h *History) Records(since time.Time, limit int) []Record {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ordered := h.ordered()
+	records := make([]Record, 0, len(ordered))
+
+	for _, record := range ordered {
+		if !record.Timestamp.Before(since) {
+			records = append(records, record)
+		}
+	}
+
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+
+	return records
+}
+
+// ordered returns the records in the order they were added, it must be called with the mutex held.
+func (h *History) ordered() []Record {
+	ordered := h.records[:h.next]
+	if h.full {
+		ordered = append(append([]Record(nil), h.records[h.next:]...), ordered...)
+	}
+
+	return ordered
+}
+
+// AddSubsystemFailure records that the subsystem failed with the error,
+// and the state that it is in since, e.g. backing off.
+func (h *History) AddSubsystemFailure(name, state string, err error) {
+	record := Record{
+		Timestamp: time.Now(),
+		Kind:      KindSubsystem,
+		Subsystem: name,
+		State:     state,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	h.Add(record)
+}
+
+// Run records every event of the subscription until it is unsubscribed,
+// it should have tracker.WithOutcomes.
+func (h *History) Run(subscription *tracker.Subscription) {
+	for event := range subscription.Events() {
+		h.recordDropped(subscription)
+
+		h.Add(Record{
+			Timestamp: event.Timestamp,
+			Kind:      KindTracker,
+			Action:    string(event.Action),
+			ID:        event.ID,
+			Port:      event.Port,
+			Protocol:  event.Protocol,
+			HostIP:    event.HostIP,
+			Source:    event.Source,
+			Metadata:  event.Metadata,
+			Outcome:   string(event.Outcome),
+			Error:     event.Error,
+		})
+	}
+
+	h.recordDropped(subscription)
+}
+
+// recordDropped records the changes that the subscription lost since the last record of them.
+func (h *History) recordDropped(subscription *tracker.Subscription) {
+	dropped := subscription.Dropped()
+	if dropped == h.dropped {
+		return
+	}
+
+	h.Add(Record{Timestamp: time.Now(), Kind: KindDropped, Dropped: dropped - h.dropped})
+	h.dropped = dropped
+}
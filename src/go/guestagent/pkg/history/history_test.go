@@ -0,0 +1,181 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package history_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/history"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ids returns the IDs of the records, in order.
+func ids(records []history.Record) []string {
+	result := make([]string, 0, len(records))
+	for _, record := range records {
+		result = append(result, record.ID)
+	}
+
+	return result
+}
+
+func TestHistoryEvictsTheOldestRecords(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 5, 14, 10, 0, 0, 0, time.UTC)
+	h := history.New(3)
+
+	assert.Empty(t, h.Records(time.Time{}, 0))
+
+	for i := range 5 {
+		h.Add(history.Record{Timestamp: start.Add(time.Duration(i) * time.Minute), Kind: history.KindTracker, ID: fmt.Sprint(i)})
+	}
+
+	assert.Equal(t, []string{"2", "3", "4"}, ids(h.Records(time.Time{}, 0)))
+
+	h.Add(history.Record{Timestamp: start.Add(5 * time.Minute), Kind: history.KindTracker, ID: "5"})
+	assert.Equal(t, []string{"3", "4", "5"}, ids(h.Records(time.Time{}, 0)))
+}
+
+func TestHistoryRecordsFilter(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2024, 5, 14, 10, 0, 0, 0, time.UTC)
+	h := history.New(10)
+
+	for i := range 15 {
+		h.Add(history.Record{Timestamp: start.Add(time.Duration(i) * time.Minute), Kind: history.KindTracker, ID: fmt.Sprint(i)})
+	}
+
+	tests := []struct {
+		name     string
+		since    time.Time
+		limit    int
+		expected []string
+	}{
+		{name: "all", expected: []string{"5", "6", "7", "8", "9", "10", "11", "12", "13", "14"}},
+		{name: "since", since: start.Add(12 * time.Minute), expected: []string{"12", "13", "14"}},
+		{name: "limit", limit: 2, expected: []string{"13", "14"}},
+		{name: "since and limit", since: start.Add(11 * time.Minute), limit: 3, expected: []string{"12", "13", "14"}},
+		{name: "limit above the records", since: start.Add(13 * time.Minute), limit: 5, expected: []string{"13", "14"}},
+		{name: "since the future", since: start.Add(time.Hour), expected: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.expected, ids(h.Records(tt.since, tt.limit)))
+		})
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	t.Parallel()
+
+	h := history.New(0)
+	h.Add(history.Record{Timestamp: time.Now(), ID: "dropped"})
+	h.AddSubsystemFailure("docker", "backing off", errors.New("broken"))
+
+	assert.Empty(t, h.Records(time.Time{}, 0))
+}
+
+func TestHistoryConcurrent(t *testing.T) {
+	t.Parallel()
+
+	h := history.New(50)
+
+	var wg sync.WaitGroup
+
+	for writer := range 4 {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range 100 {
+				h.Add(history.Record{Timestamp: time.Now(), Kind: history.KindTracker, ID: fmt.Sprintf("%d-%d", writer, i)})
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for range 100 {
+				assert.LessOrEqual(t, len(h.Records(time.Time{}, 0)), 50)
+			}
+		}()
+	}
+
+	wg.Wait()
+	assert.Len(t, h.Records(time.Time{}, 0), 50)
+}
+
+func TestHistoryRun(t *testing.T) {
+	t.Parallel()
+
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), []types.ConnectAddrs{
+		{Network: "tcp", Addr: "192.168.0.1"},
+	})
+	subscription := vtunnelTracker.Subscribe(history.BufferSize, tracker.WithOutcomes())
+
+	h := history.New(history.DefaultSize)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		h.Run(subscription)
+	}()
+
+	portMap := nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}}}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "web", portMap, tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), "web"))
+	h.AddSubsystemFailure("kubernetes", "backing off", errors.New("connection refused"))
+
+	require.Eventually(t, func() bool {
+		return len(h.Records(time.Time{}, 0)) == 5
+	}, 5*time.Second, time.Millisecond)
+
+	subscription.Unsubscribe()
+	<-done
+
+	var actions []string
+
+	for _, record := range h.Records(time.Time{}, 0) {
+		switch record.Kind {
+		case history.KindTracker:
+			assert.Equal(t, "web", record.ID)
+			assert.Equal(t, tracker.SourceDocker, record.Source)
+			actions = append(actions, record.Action+" "+record.Outcome)
+		case history.KindSubsystem:
+			assert.Equal(t, "kubernetes", record.Subsystem)
+			assert.Equal(t, "backing off", record.State)
+			assert.Equal(t, "connection refused", record.Error)
+		default:
+			assert.Failf(t, "unexpected record", "%+v", record)
+		}
+	}
+
+	assert.Equal(t, []string{"add ", "add sent", "remove ", "remove sent"}, actions)
+}
@@ -0,0 +1,103 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package history
+
+// StreamBufferSize is the number of records that are held for a stream
+// while they are sent, a stream that does not keep up is closed rather than
+// blocking the history, and therefore the tracker.
+const StreamBufferSize = 256
+
+// Stream delivers the records of a history as they are added, see History.Stream.
+type Stream struct {
+	records chan Record
+	history *History
+	// overflowed indicates that the stream was closed since a record did not fit in its buffer.
+	overflowed bool
+}
+
+// Records returns the channel that the records are delivered on, it is
+// closed once the stream is closed, or once it overflowed.
+func (s *Stream) Records() <-chan Record {
+	return s.records
+}
+
+// Overflowed returns true if the stream was closed since a record did not fit
+// in its buffer, the records that it missed can be asked for with a new
+// stream after the last one that it delivered. It must only be called once
+// Records is closed.
+func (s *Stream) Overflowed() bool {
+	s.history.mutex.Lock()
+	defer s.history.mutex.Unlock()
+
+	return s.overflowed
+}
+
+// Close stops the delivery of the records and closes the records channel.
+// It is safe to call it more than once.
+func (s *Stream) Close() {
+	s.history.mutex.Lock()
+	defer s.history.mutex.Unlock()
+
+	s.history.closeStream(s)
+}
+
+// Stream returns a stream of the records that are added from now on, with at
+// most bufferSize of them held. When after is not zero, it also returns the
+// records that are still held after that sequence number, e.g. the last one
+// that a client received before it reconnected, and the number of them that
+// were evicted meanwhile. A sequence number that is ahead of the history is
+// from an earlier agent, all the records that are held are missed then.
+func (h *History) Stream(after uint64, bufferSize int) (stream *Stream, missed []Record, evicted uint64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	stream = &Stream{records: make(chan Record, bufferSize), history: h}
+	h.streams[stream] = struct{}{}
+
+	if after == 0 || after == h.seq {
+		return stream, nil, 0
+	}
+
+	if after > h.seq {
+		after = 0
+	}
+
+	ordered := h.ordered()
+	for i, record := range ordered {
+		if record.Seq > after {
+			return stream, append([]Record(nil), ordered[i:]...), record.Seq - after - 1
+		}
+	}
+
+	return stream, nil, h.seq - after
+}
+
+// deliver sends the record to the stream, or closes the stream if its buffer
+// is full; it must be called with the mutex held.
+func (h *History) deliver(stream *Stream, record Record) {
+	select {
+	case stream.records <- record:
+	default:
+		stream.overflowed = true
+		h.closeStream(stream)
+	}
+}
+
+// closeStream must be called with the mutex held.
+func (h *History) closeStream(stream *Stream) {
+	if _, ok := h.streams[stream]; ok {
+		delete(h.streams, stream)
+		close(stream.records)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package history_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/history"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// received returns the records that the stream holds, once it is closed.
+func received(stream *history.Stream) []history.Record {
+	stream.Close()
+
+	var records []history.Record
+	for record := range stream.Records() {
+		records = append(records, record)
+	}
+
+	return records
+}
+
+func TestHistoryStream(t *testing.T) {
+	t.Parallel()
+
+	h := history.New(10)
+	h.Add(history.Record{Kind: history.KindTracker, ID: "before"})
+
+	first, missed, evicted := h.Stream(0, 10)
+	assert.Empty(t, missed)
+	assert.Zero(t, evicted)
+
+	second, _, _ := h.Stream(0, 10)
+
+	h.Add(history.Record{Kind: history.KindTracker, ID: "0"})
+	h.Add(history.Record{Kind: history.KindTracker, ID: "1"})
+
+	records := received(first)
+	assert.Equal(t, []string{"0", "1"}, ids(records))
+	assert.Equal(t, []uint64{2, 3}, []uint64{records[0].Seq, records[1].Seq})
+	assert.False(t, first.Overflowed())
+
+	// A closed stream no longer receives the records, the others still do.
+	h.Add(history.Record{Kind: history.KindTracker, ID: "2"})
+	assert.Equal(t, []string{"0", "1", "2"}, ids(received(second)))
+	assert.NotPanics(t, first.Close)
+
+	assert.Equal(t, []uint64{1, 2, 3, 4}, seqs(h.Records(time.Time{}, 0)))
+}
+
+func TestHistoryStreamMissed(t *testing.T) {
+	t.Parallel()
+
+	h := history.New(3)
+
+	for i := range 5 {
+		h.Add(history.Record{Kind: history.KindTracker, ID: fmt.Sprint(i)})
+	}
+
+	// The records 3, 4 and 5 are held.
+	for _, test := range []struct {
+		after   uint64
+		missed  []uint64
+		evicted uint64
+	}{
+		{after: 5},
+		{after: 3, missed: []uint64{4, 5}},
+		{after: 2, missed: []uint64{3, 4, 5}},
+		{after: 1, missed: []uint64{3, 4, 5}, evicted: 1},
+		// The sequence number of an earlier agent.
+		{after: 42, missed: []uint64{3, 4, 5}, evicted: 2},
+	} {
+		stream, missed, evicted := h.Stream(test.after, 1)
+		stream.Close()
+
+		assert.Equal(t, test.missed, seqs(missed), test.after)
+		assert.Equal(t, test.evicted, evicted, test.after)
+	}
+
+	// A history that keeps no records still streams them, they are all missed.
+	disabled := history.New(0)
+	disabled.Add(history.Record{Kind: history.KindTracker})
+	disabled.Add(history.Record{Kind: history.KindTracker})
+
+	stream, missed, evicted := disabled.Stream(1, 1)
+	stream.Close()
+	assert.Empty(t, missed)
+	assert.Equal(t, uint64(1), evicted)
+}
+
+func TestHistoryStreamOverflow(t *testing.T) {
+	t.Parallel()
+
+	h := history.New(10)
+	stream, _, _ := h.Stream(0, 1)
+
+	// The stream that does not keep up is closed rather than blocking the history.
+	for i := range 3 {
+		h.Add(history.Record{Kind: history.KindTracker, ID: fmt.Sprint(i)})
+	}
+
+	var records []history.Record
+	for record := range stream.Records() {
+		records = append(records, record)
+	}
+
+	assert.Equal(t, []string{"0"}, ids(records))
+	require.True(t, stream.Overflowed())
+
+	// The records that it missed are still held.
+	resumed, missed, evicted := h.Stream(records[0].Seq, 1)
+	resumed.Close()
+	assert.Equal(t, []string{"1", "2"}, ids(missed))
+	assert.Zero(t, evicted)
+}
+
+// seqs returns the sequence numbers of the records, in order.
+func seqs(records []history.Record) []uint64 {
+	var result []uint64
+	for _, record := range records {
+		result = append(result, record.Seq)
+	}
+
+	return result
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultIdleScans is the number of the scans in a row that do not change
+// the ports after which the interval between the scans is stretched.
+const DefaultIdleScans = 5
+
+// Poller waits between the scans of the rules. The interval is stretched,
+// twice as long after every scan up to MaxInterval, once IdleScans scans in
+// a row did not change the ports, so that an idle system is not scanned every
+// few seconds for hours; it snaps back to Interval once a scan changes the
+// ports, or once a nudge hints that they are about to change, e.g. for the
+// event of a container that starts.
+type Poller struct {
+	// Interval is the interval between the scans while the ports change,
+	// and MaxInterval the one that it is stretched up to while they do not;
+	// it is not stretched unless MaxInterval is longer than Interval.
+	Interval    time.Duration
+	MaxInterval time.Duration
+	IdleScans   int
+	// Nudges are the nudges of the sources that are told about the changes,
+	// see tracker.Nudger; they are not received when it is nil.
+	Nudges <-chan struct{}
+	// After is the clock of the waits, e.g. time.After.
+	After func(time.Duration) <-chan time.Time
+
+	unchanged int
+	interval  time.Duration
+}
+
+// NewPoller returns the poller with the clock of the system and the default
+// idle scans.
+func NewPoller(interval, maxInterval time.Duration, nudges <-chan struct{}) *Poller {
+	return &Poller{
+		Interval:    interval,
+		MaxInterval: maxInterval,
+		IdleScans:   DefaultIdleScans,
+		Nudges:      nudges,
+		After:       time.After,
+	}
+}
+
+// Wait waits for the next scan, after a scan that changed the ports or not,
+// and returns false if the context was done first.
+func (p *Poller) Wait(ctx context.Context, changed bool) bool {
+	after := p.After(p.next(changed))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-after:
+			return true
+		case <-p.Nudges:
+			// The rules of the change may not be there yet, so the next scan
+			// is still one interval away, rather than at once; the nudges of
+			// the scans that were not stretched do not postpone them.
+			if p.interval <= p.Interval {
+				continue
+			}
+
+			logger.Debugf("the iptables scans are nudged back to every %s from every %s", p.Interval, p.interval)
+
+			p.unchanged = 0
+			p.interval = p.Interval
+			after = p.After(p.Interval)
+		}
+	}
+}
+
+// next returns the interval until the next scan, after a scan that changed
+// the ports or not.
+func (p *Poller) next(changed bool) time.Duration {
+	if changed || p.MaxInterval <= p.Interval {
+		p.unchanged = 0
+		p.interval = p.Interval
+
+		return p.interval
+	}
+
+	p.unchanged++
+
+	switch {
+	case p.unchanged <= p.IdleScans:
+		p.interval = p.Interval
+	case p.unchanged == p.IdleScans+1:
+		logger.Debugf("the iptables scans are stretched up to every %s while the ports do not change", p.MaxInterval)
+
+		p.interval = min(2*p.Interval, p.MaxInterval)
+	default:
+		p.interval = min(2*p.interval, p.MaxInterval)
+	}
+
+	return p.interval
+}
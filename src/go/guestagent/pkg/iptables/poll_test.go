@@ -0,0 +1,182 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/iptables"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	scanInterval    = 3 * time.Second
+	maxScanInterval = 30 * time.Second
+)
+
+// fakeClock is the clock of the waits of a poller, which end once the test
+// elapses them.
+type fakeClock struct {
+	waits chan time.Duration
+	fire  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{waits: make(chan time.Duration, 100), fire: make(chan time.Time)}
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.waits <- d
+
+	return c.fire
+}
+
+// wait returns how long the next wait of the poller is for.
+func (c *fakeClock) wait(t *testing.T) time.Duration {
+	t.Helper()
+
+	select {
+	case d := <-c.waits:
+		return d
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the poller did not wait")
+
+		return 0
+	}
+}
+
+// newFakePoller returns a poller with the fake clock, whose waits follow the
+// scans that changed the ports or not; the result of every wait is sent to
+// the channel that it returns.
+func newFakePoller(ctx context.Context, maxInterval time.Duration, nudges <-chan struct{}, changes []bool) (*fakeClock, <-chan bool) {
+	clock := newFakeClock()
+	poller := iptables.NewPoller(scanInterval, maxInterval, nudges)
+	poller.After = clock.after
+	results := make(chan bool, len(changes))
+
+	go func() {
+		for _, changed := range changes {
+			results <- poller.Wait(ctx, changed)
+		}
+	}()
+
+	return clock, results
+}
+
+func TestPoller(t *testing.T) {
+	t.Parallel()
+
+	const (
+		s3  = scanInterval
+		s30 = maxScanInterval
+	)
+
+	tests := map[string]struct {
+		maxInterval time.Duration
+		changes     []bool
+		waits       []time.Duration
+	}{
+		"stretched while unchanged": {
+			maxInterval: maxScanInterval,
+			changes:     []bool{false, false, false, false, false, false, false, false, false, false},
+			waits:       []time.Duration{s3, s3, s3, s3, s3, 6 * time.Second, 12 * time.Second, 24 * time.Second, s30, s30},
+		},
+		"snaps back once changed": {
+			maxInterval: maxScanInterval,
+			changes:     []bool{false, false, false, false, false, false, false, true, false, false},
+			waits:       []time.Duration{s3, s3, s3, s3, s3, 6 * time.Second, 12 * time.Second, s3, s3, s3},
+		},
+		"changed every scan": {
+			maxInterval: maxScanInterval,
+			changes:     []bool{true, true, true, true, true, true, true},
+			waits:       []time.Duration{s3, s3, s3, s3, s3, s3, s3},
+		},
+		"not stretched past a short max interval": {
+			maxInterval: 5 * time.Second,
+			changes:     []bool{false, false, false, false, false, false, false, false},
+			waits:       []time.Duration{s3, s3, s3, s3, s3, 5 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		"disabled": {
+			changes: []bool{false, false, false, false, false, false, false, false},
+			waits:   []time.Duration{s3, s3, s3, s3, s3, s3, s3, s3},
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			clock, results := newFakePoller(context.Background(), tt.maxInterval, nil, tt.changes)
+
+			waits := make([]time.Duration, 0, len(tt.changes))
+
+			for range tt.changes {
+				waits = append(waits, clock.wait(t))
+				clock.fire <- time.Time{}
+				assert.True(t, <-results)
+			}
+
+			assert.Equal(t, tt.waits, waits)
+		})
+	}
+}
+
+func TestPollerNudge(t *testing.T) {
+	t.Parallel()
+
+	nudges := make(chan struct{})
+	changes := []bool{false, false, false, false, false, false, false, false, false, false}
+	clock, results := newFakePoller(context.Background(), maxScanInterval, nudges, changes)
+
+	// A nudge does not postpone the scans that are not stretched.
+	assert.Equal(t, scanInterval, clock.wait(t))
+	nudges <- struct{}{}
+	clock.fire <- time.Time{}
+	assert.True(t, <-results)
+
+	for i := 1; i < 8; i++ {
+		clock.wait(t)
+		clock.fire <- time.Time{}
+		assert.True(t, <-results)
+	}
+
+	require.Equal(t, maxScanInterval, clock.wait(t))
+
+	// The nudge of an event brings the stretched scans back to the interval
+	// at once, the next one is not stretched again until the ports did not
+	// change for the idle scans.
+	nudges <- struct{}{}
+	assert.Equal(t, scanInterval, clock.wait(t))
+	clock.fire <- time.Time{}
+	assert.True(t, <-results)
+
+	assert.Equal(t, scanInterval, clock.wait(t))
+	clock.fire <- time.Time{}
+	assert.True(t, <-results)
+	assert.Empty(t, clock.waits)
+}
+
+func TestPollerCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	clock, results := newFakePoller(ctx, maxScanInterval, nil, []bool{false})
+
+	assert.Equal(t, scanInterval, clock.wait(t))
+	cancel()
+	assert.False(t, <-results)
+}
@@ -3,28 +3,79 @@ package iptables
 
 import (
 	"context"
+	"errors"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Masterminds/log-go"
+	"github.com/docker/go-connections/nat"
 	"github.com/lima-vm/lima/pkg/guestagent/iptables"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netns"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
 )
 
+// maxRuleLength is the length of the iptables rules that are recorded as the origins of their ports.
+const maxRuleLength = 200
+
 // ForwardPorts forwards ports found in iptables dnat. In some environments,
 // like WSL, ports defined using the CNI portmap plugin happen through iptables.
 // These ports are not sent to places like /proc/net/tcp and are not picked up
 // as part of the normal forwarding system. This function detects those ports
 // and binds them so that they are picked up.
-// The argument is a time, in seconds, to wait between updating.
-func ForwardPorts(ctx context.Context, tracker tracker.Tracker, updateInterval time.Duration) error {
-	var ports []iptables.Entry
+// The poller waits between the scans, see Poller; their failures are retried
+// after its Interval.
+// The rules are scanned within the network namespace, unless it is nil, and
+// the scans are paused while it does not exist; only the DNAT rules of the
+// chains are forwarded.
+func ForwardPorts(
+	ctx context.Context, portTracker tracker.Tracker, poller *Poller, namespace *netns.Namespace, chains Chains,
+) error {
+	var (
+		ports   []iptables.Entry
+		skipped int
+	)
+
+	// The permission errors are retried until they clear, without flooding the logs.
+	limiter := logging.NewLimiter(0)
+
+	// The parser reuses its buffers from one scan to the next.
+	parser := NewParser(chains)
+
+	// Every scan is reported, so that the status tells when the last one succeeded.
+	health := supervisor.HealthReporter(ctx)
 
 	for {
 		// Detect ports for forward
-		newPorts, err := iptables.GetPorts()
+		newPorts, newSkipped, err := getPorts(ctx, namespace, parser)
+
+		// The scan that was cut short at shutdown is neither an error nor complete.
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if errors.Is(err, netns.ErrNotFound) {
+			limiter.Warnf(logger, "the iptables scanning is paused until the network namespace %s exists: %v", namespace, err)
+			health.Failed(err)
+			tracker.InitialPassDone(ctx, err)
+
+			// The listeners of the namespace that is gone are opened again once it is back.
+			removeListeners(ctx, portTracker, ports)
+			ports = nil
+
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(poller.Interval):
+			}
+
+			continue
+		}
+
 		if err != nil {
 			// iptables exiting with an exit status of 4 means there
 			// is a resource problem. For example, something else is
@@ -32,8 +83,29 @@ func ForwardPorts(ctx context.Context, tracker tracker.Tracker, updateInterval t
 			// this loop. You can find the exit code in the iptables
 			// source at https://git.netfilter.org/iptables/tree/include/xtables.h
 			if strings.Contains(err.Error(), "exit status 4") {
-				log.Debug("iptables exited with status 4 (resource error). Retrying...")
-				time.Sleep(updateInterval)
+				logger.Debug("iptables exited with status 4 (resource error). Retrying...")
+				health.Failed(err)
+				tracker.InitialPassDone(ctx, err)
+
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(poller.Interval):
+				}
+
+				continue
+			}
+
+			if errors.Is(err, os.ErrPermission) {
+				limiter.Errorf(logger, "iptables can not be run, retrying: %v", err)
+				health.Failed(err)
+				tracker.InitialPassDone(ctx, err)
+
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(poller.Interval):
+				}
 
 				continue
 			}
@@ -41,39 +113,87 @@ func ForwardPorts(ctx context.Context, tracker tracker.Tracker, updateInterval t
 			return err
 		}
 
-		log.Debugf("found ports %+v", newPorts)
+		limiter.Reset(logger)
+		health.Succeeded()
+
+		logger.Debugf("found ports %+v", newPorts)
+
+		if newSkipped != skipped {
+			logger.Debugf("skipped %d DNAT rules of the chains of the firewall managers", newSkipped)
+			skipped = newSkipped
+		}
+
+		for _, p := range newPorts {
+			logger.Tracef("parsed the iptables rule of %s", entryToString(p))
+		}
 
 		// Diff from existing forwarded ports
 		added, removed := comparePorts(ports, newPorts)
 		ports = newPorts
 
 		// Remove old forwards
-		for _, p := range removed {
-			name := entryToString(p)
-			if err := tracker.RemoveListener(ctx, p.IP, p.Port); err != nil {
-				log.Warnf("failed to close listener %q: %w", name, err)
+		removeListeners(ctx, portTracker, removed)
+
+		// The rules of the new forwards are their origin.
+		var rules []byte
+		if len(added) != 0 {
+			if rules, err = natRules(ctx, namespace); err != nil {
+				logger.Debugf("failed to list the iptables rules of the ports: %v", err)
 			}
 		}
 
 		// Add new forwards
 		for _, p := range added {
-			name := entryToString(p)
-			if err := tracker.AddListener(ctx, p.IP, p.Port); err != nil {
-				log.Errorf("failed to listen %q: %w", name, err)
+			// The listeners are not opened once the agent is shutting down.
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			if err := portTracker.AddListener(contextWithRule(ctx, rules, parser, p), p.IP, p.Port); err != nil {
+				logger.Errorw("failed to listen", logging.Fields(entryFields(p), logging.Error(err)))
 			} else {
-				log.Infof("opened listener for %q", name)
+				logger.Infow("opened listener", entryFields(p))
 			}
 		}
 
-		select {
-		case <-ctx.Done():
+		// The ports of the first scan are part of the startup batch, see tracker.StartupBatch.
+		tracker.InitialPassDone(ctx, nil)
+
+		// Wait for next loop, unless the agent is shutting down
+		if !poller.Wait(ctx, len(added) != 0 || len(removed) != 0) {
 			return nil
-		default: // continue the loop
 		}
+	}
+}
 
-		// Wait for next loop
-		time.Sleep(updateInterval)
+// ListPorts returns the ports that are forwarded with the iptables DNAT rules
+// of the chains of the network namespace, unless it is nil, keyed by their
+// address, without listening on them; see scan.Lister.
+func ListPorts(ctx context.Context, namespace *netns.Namespace, chains Chains) (map[string]nat.PortMap, error) {
+	entries, _, err := getPorts(ctx, namespace, NewParser(chains))
+	if err != nil {
+		return nil, err
 	}
+
+	portMaps := make(map[string]nat.PortMap, len(entries))
+
+	for _, entry := range entries {
+		protocol := "udp"
+		if entry.TCP {
+			protocol = "tcp"
+		}
+
+		port, err := nat.NewPort(protocol, strconv.Itoa(entry.Port))
+		if err != nil {
+			return nil, err
+		}
+
+		portMaps[entryToString(entry)] = nat.PortMap{
+			port: []nat.PortBinding{{HostIP: entry.IP.String(), HostPort: port.Port()}},
+		}
+	}
+
+	return portMaps, nil
 }
 
 // comparePorts compares the old and new ports to find those added or removed.
@@ -111,6 +231,100 @@ func comparePorts(oldPorts, newPorts []iptables.Entry) (added, removed []iptable
 	return
 }
 
+// getPorts returns the ports of the iptables DNAT rules of the network
+// namespace that the parser forwards, whose listening ports are checked within
+// it too, and the number of the rules of the firewall managers that were
+// skipped. The scan gives up once the context is done.
+func getPorts(ctx context.Context, namespace *netns.Namespace, parser *Parser) ([]iptables.Entry, int, error) {
+	var (
+		entries []iptables.Entry
+		skipped int
+	)
+
+	err := namespace.Do(func() error {
+		rules, err := listRules(ctx)
+		if err != nil {
+			return err
+		}
+
+		entries, skipped = parser.Parse(rules)
+		entries = checkPortsOpen(ctx, entries)
+
+		return nil
+	})
+
+	return entries, skipped, err
+}
+
+// removeListeners closes the listeners of the entries.
+func removeListeners(ctx context.Context, tracker tracker.Tracker, entries []iptables.Entry) {
+	for _, p := range entries {
+		if err := tracker.RemoveListener(ctx, p.IP, p.Port); err != nil {
+			logger.Warnw("failed to close listener", logging.Fields(entryFields(p), logging.Error(err)))
+		}
+	}
+}
+
+// natRules returns the rules of the nat table of the network namespace, like
+// getPorts lists them.
+func natRules(ctx context.Context, namespace *netns.Namespace) ([]byte, error) {
+	var rules []byte
+
+	err := namespace.Do(func() error {
+		var err error
+		rules, err = listRules(ctx)
+
+		return err
+	})
+
+	return rules, err
+}
+
+// contextWithRule returns a context with the DNAT rule of the chains of the
+// parser that forwards the port of the entry as its origin, see
+// tracker.ContextWithOrigin; the origin only tells the kind of the rule
+// if it is not found.
+func contextWithRule(ctx context.Context, rules []byte, parser *Parser, entry iptables.Entry) context.Context {
+	origin := tracker.Origin{Kind: tracker.OriginRule}
+
+	for len(rules) != 0 {
+		var rule []byte
+
+		rule, rules = nextLine(rules)
+
+		chain, parsed, ok := parser.parseRule(rule)
+		if !ok || !chain.forwards || parsed.TCP != entry.TCP || parsed.Port != entry.Port || !parsed.IP.Equal(entry.IP) {
+			continue
+		}
+
+		origin.Name = chain.name
+		origin.Rule = string(rule)
+
+		if len(origin.Rule) > maxRuleLength {
+			origin.Rule = origin.Rule[:maxRuleLength] + "..."
+		}
+
+		break
+	}
+
+	return tracker.ContextWithOrigin(ctx, origin)
+}
+
 func entryToString(ip iptables.Entry) string {
 	return net.JoinHostPort(ip.IP.String(), strconv.Itoa(ip.Port))
 }
+
+// entryFields returns the fields of the log lines of the port of the rule.
+func entryFields(entry iptables.Entry) log.Fields {
+	protocol := "udp"
+	if entry.TCP {
+		protocol = "tcp"
+	}
+
+	return logging.Fields(
+		logging.Addr(entryToString(entry)),
+		logging.Port(entry.Port),
+		logging.Protocol(protocol),
+		logging.Source(tracker.SourceIptables),
+	)
+}
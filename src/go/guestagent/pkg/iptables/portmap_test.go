@@ -0,0 +1,88 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/iptables"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netns"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListPortsWithoutNamespace(t *testing.T) {
+	t.Parallel()
+
+	_, err := iptables.ListPorts(context.Background(), netns.New(filepath.Join(t.TempDir(), "rd1")),
+		iptables.Chains{Include: iptables.DefaultChains})
+	require.ErrorIs(t, err, netns.ErrNotFound)
+}
+
+func TestForwardPortsPausedWithoutNamespace(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), nil)
+
+	// The scans are paused until the context is done, rather than failing.
+	namespace := netns.New(filepath.Join(t.TempDir(), "rd1"))
+	poller := iptables.NewPoller(10*time.Millisecond, 0, nil)
+	require.NoError(t, iptables.ForwardPorts(ctx, vtunnelTracker, poller, namespace, iptables.Chains{}))
+	assert.Empty(t, vtunnelTracker.Listeners())
+}
+
+// TestForwardPortsCancelled checks that a scan that is stuck listing the rules
+// returns promptly once the context is cancelled.
+func TestForwardPortsCancelled(t *testing.T) {
+	// The iptables that is run leaves a trace, and hangs.
+	bin := t.TempDir()
+	trace := filepath.Join(bin, "iptables.trace")
+	script := "#!/bin/sh\ntouch " + trace + "\nexec sleep 10\n"
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "iptables"), []byte(script), 0o700))
+
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), nil)
+	poller := iptables.NewPoller(10*time.Millisecond, 0, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- iptables.ForwardPorts(ctx, vtunnelTracker, poller, nil, iptables.Chains{Include: iptables.DefaultChains})
+	}()
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(trace)
+
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "iptables was not run")
+	cancel()
+
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("the scan did not return once its context was cancelled")
+	}
+}
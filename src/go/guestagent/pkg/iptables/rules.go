@@ -0,0 +1,389 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lima-vm/lima/pkg/guestagent/iptables"
+)
+
+// DefaultChains are the patterns of the chains of the DNAT rules that the
+// CNI portmap plugin adds for the ports of the containers.
+var DefaultChains = []string{"CNI-DN-*"} //nolint:gochecknoglobals
+
+// managerChains are the patterns of the chains that the firewall managers,
+// ufw and the zones of firewalld, add in the nat table. Their DNAT rules,
+// e.g. for NetBIOS on 137/udp and 138/udp, do not forward the ports of any
+// workload in the VM.
+//
+//nolint:gochecknoglobals
+var managerChains = []string{
+	"ufw-*", "ufw6-*",
+	"PRE_*", "POST_*", "PREROUTING_*", "POSTROUTING_*", "OUTPUT_*", "FWD_*", "FWDI_*", "FWDO_*",
+}
+
+// Chains selects the chains of the nat table whose DNAT rules forward ports.
+// The patterns are like the ones of netif.Filter, e.g. CNI-DN-* matches the
+// chains that start with CNI-DN-. The chains of the firewall managers are
+// left out, unless a pattern names them explicitly, e.g. ufw-* or
+// PRE_public, rather than * alone.
+type Chains struct {
+	Include []string
+}
+
+// Forwards returns true if the DNAT rules of the chain of the name forward
+// ports.
+func (c Chains) Forwards(chain string) bool {
+	for _, pattern := range c.Include {
+		if matches(chain, pattern) && (!managerChain(chain) || explicit(pattern)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// explicit returns true if the pattern only matches chains of the firewall
+// managers.
+func explicit(pattern string) bool {
+	prefix := strings.TrimSuffix(pattern, "*")
+
+	for _, manager := range managerChains {
+		if strings.HasPrefix(prefix, strings.TrimSuffix(manager, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseRules returns the ports of the DNAT rules of the chains, as
+// iptables -t nat -S or iptables-save lists them, and the number of the
+// ones of the chains of the firewall managers that were skipped; see
+// Parser, which the scans use.
+func ParseRules(rules []string, chains Chains) ([]iptables.Entry, int) {
+	return NewParser(chains).Parse([]byte(strings.Join(rules, "\n")))
+}
+
+// Parser parses the DNAT rules of the chains, like ParseRules, on every scan
+// of the nat table: the rules are parsed in place, and its buffers are reused
+// from one scan to the next, since the scans of the clusters with many
+// services would otherwise be dominated by the copies of their rules. It
+// must not be used concurrently.
+type Parser struct {
+	chains Chains
+	// fields are the fields of the rule that is parsed.
+	fields [][]byte
+	// verdicts caches whether the chains forward their ports, by their name,
+	// until a scan does not see them anymore.
+	verdicts map[string]*verdict
+	// scan is the number of the scan, which the verdicts are last seen at.
+	scan uint64
+	// entries is the number of the ports of the last scan, which the one of
+	// the next scan is sized for.
+	entries int
+}
+
+// verdict is whether the DNAT rules of a chain forward ports, or are the
+// ones of a firewall manager, see Chains.Forwards.
+type verdict struct {
+	name     string
+	forwards bool
+	manager  bool
+	scan     uint64
+}
+
+// NewParser returns a parser of the DNAT rules of the chains.
+func NewParser(chains Chains) *Parser {
+	return &Parser{chains: chains, verdicts: make(map[string]*verdict)}
+}
+
+// Parse returns the ports of the DNAT rules of the chains, of the output of
+// iptables -t nat -S or iptables-save with a rule on each line, and the number
+// of the ones of the chains of the firewall managers that were skipped. The
+// ports are not kept by the parser.
+func (p *Parser) Parse(output []byte) ([]iptables.Entry, int) {
+	p.scan++
+
+	var (
+		entries = make([]iptables.Entry, 0, p.entries)
+		skipped int
+	)
+
+	for len(output) != 0 {
+		var line []byte
+
+		line, output = nextLine(output)
+
+		chain, entry, ok := p.parseRule(line)
+		if !ok {
+			continue
+		}
+
+		if chain.forwards {
+			entries = append(entries, entry)
+		} else if chain.manager {
+			skipped++
+		}
+	}
+
+	// The chains of the containers that are gone are not kept.
+	for name, chain := range p.verdicts {
+		if chain.scan != p.scan {
+			delete(p.verdicts, name)
+		}
+	}
+
+	p.entries = len(entries)
+
+	return entries, skipped
+}
+
+// nextLine returns the first line of the output, and the rest of it.
+func nextLine(output []byte) ([]byte, []byte) {
+	if i := bytes.IndexByte(output, '\n'); i >= 0 {
+		return output[:i], output[i+1:]
+	}
+
+	return output, nil
+}
+
+// verdict returns whether the chain of the name forwards its ports, which is
+// only matched against the patterns once for all the rules of the scans.
+func (p *Parser) verdict(name []byte) *verdict {
+	// The lookup does not copy the name, unlike the insertion.
+	chain, ok := p.verdicts[string(name)]
+	if !ok {
+		chain = &verdict{name: string(name)}
+		chain.forwards = p.chains.Forwards(chain.name)
+		chain.manager = managerChain(chain.name)
+		p.verdicts[chain.name] = chain
+	}
+
+	chain.scan = p.scan
+
+	return chain
+}
+
+// parseRule returns the chain and the port of a DNAT rule like the ones of
+// the CNI portmap plugin, with or without a destination address, e.g.
+//
+//	-A CNI-DN-2e2f8d5b91929ef9fc152 -d 127.0.0.1/32 -p tcp -m tcp --dport 8081 -j DNAT --to-destination 10.4.0.7:80
+//	-A CNI-DN-04579c7bb67f4c3f6cca0 -p tcp -m tcp --dport 8082 -j DNAT --to-destination 10.4.0.10:80
+//
+// The rules without a port, a protocol, or with a destination that is not a
+// single IPv4 address are not forwarded, like lima (github.com/lima-vm/lima),
+// which is licensed under the Apache 2, does. The rules of the chains that
+// neither forward their ports nor are the ones of the firewall managers are
+// not parsed past their chain.
+func (p *Parser) parseRule(rule []byte) (*verdict, iptables.Entry, bool) {
+	p.fields = splitFields(p.fields[:0], rule, 2)
+	if len(p.fields) < 2 || string(p.fields[0]) != "-A" {
+		return nil, iptables.Entry{}, false
+	}
+
+	chain := p.verdict(p.fields[1])
+	if !chain.forwards && !chain.manager {
+		return nil, iptables.Entry{}, false
+	}
+
+	p.fields = splitFields(p.fields[:0], rule, -1)
+
+	fields := p.fields
+	if string(ruleOption(fields, "-j")) != "DNAT" {
+		return nil, iptables.Entry{}, false
+	}
+
+	port, ok := parsePort(ruleOption(fields, "--dport"))
+	if !ok {
+		return nil, iptables.Entry{}, false
+	}
+
+	protocol := string(ruleOption(fields, "-p"))
+	if protocol != "tcp" && protocol != "udp" {
+		return nil, iptables.Entry{}, false
+	}
+
+	// When no IP is present the rule applies to all interfaces.
+	ip := net.IPv4zero
+
+	if destination := ruleOption(fields, "-d"); len(destination) != 0 {
+		addr, ok := bytes.CutSuffix(destination, []byte("/32"))
+		if ip = net.ParseIP(string(addr)).To4(); !ok || ip == nil || negated(fields, "-d") {
+			return nil, iptables.Entry{}, false
+		}
+	}
+
+	return chain, iptables.Entry{TCP: protocol == "tcp", IP: ip, Port: port}, true
+}
+
+// asciiSpace are the white space characters of ASCII, like the ones that
+// strings.Fields separates the fields at.
+var asciiSpace = [utf8.RuneSelf]bool{'\t': true, '\n': true, '\v': true, '\f': true, '\r': true, ' ': true} //nolint:gochecknoglobals
+
+// splitFields appends the first n fields of the rule, or all of them if n is
+// negative, separated by white space like strings.Fields separates them, to
+// the fields, without copying them.
+func splitFields(fields [][]byte, rule []byte, n int) [][]byte {
+	base, start := len(fields), -1
+
+	for i, c := range rule {
+		if c >= utf8.RuneSelf {
+			// The rules are ASCII, but for the comments, which bytes.Fields
+			// splits at the Unicode spaces too.
+			all := bytes.Fields(rule)
+			if n >= 0 && len(all) > n {
+				all = all[:n]
+			}
+
+			return append(fields[:base], all...)
+		}
+
+		switch space := asciiSpace[c]; {
+		case space && start >= 0:
+			if fields = append(fields, rule[start:i]); len(fields)-base == n {
+				return fields
+			}
+
+			start = -1
+		case !space && start < 0:
+			start = i
+		}
+	}
+
+	if start >= 0 {
+		fields = append(fields, rule[start:])
+	}
+
+	return fields
+}
+
+// ruleOption returns the value of the option of the fields of a rule, or nothing if it has none.
+func ruleOption(fields [][]byte, option string) []byte {
+	for i := 0; i < len(fields)-1; i++ {
+		if string(fields[i]) == option {
+			return fields[i+1]
+		}
+	}
+
+	return nil
+}
+
+// parsePort returns the port of the decimal number, like strconv.Atoi
+// parses it, if it is one.
+func parsePort(number []byte) (int, bool) {
+	number = bytes.TrimPrefix(number, []byte("+"))
+	if len(number) == 0 {
+		return 0, false
+	}
+
+	port := 0
+
+	for _, c := range number {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+
+		if port = port*10 + int(c-'0'); port > 65535 {
+			return 0, false
+		}
+	}
+
+	return port, port > 0
+}
+
+// negated returns true if the option of the fields of a rule follows a !.
+func negated(fields [][]byte, option string) bool {
+	for i := 1; i < len(fields); i++ {
+		if string(fields[i]) == option {
+			return string(fields[i-1]) == "!"
+		}
+	}
+
+	return false
+}
+
+// managerChain returns true if the chain of the name is one of the ones of
+// the firewall managers.
+func managerChain(chain string) bool {
+	for _, pattern := range managerChains {
+		if matches(chain, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches returns true if the name matches the pattern, which matches the
+// names that start with it when it ends with *.
+func matches(name, pattern string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+
+	return name == pattern
+}
+
+// listRules returns the output of the rules of the nat table, one for each
+// line, or none if iptables is not installed. The lookup is performed on each
+// run so that iptables may be installed after the agent started; it is
+// killed once the context is done.
+func listRules(ctx context.Context) ([]byte, error) {
+	path, err := exec.LookPath("iptables")
+	if errors.Is(err, exec.ErrNotFound) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return exec.CommandContext(ctx, path, "-t", "nat", "-S").Output()
+}
+
+// checkPortsOpen returns the entries whose TCP ports are listened on, and all
+// of the UDP ones, in place of the entries; the entries that are left once the
+// context is done are dropped. This function is lifted from lima.
+func checkPortsOpen(ctx context.Context, entries []iptables.Entry) []iptables.Entry {
+	open := entries[:0]
+	dialer := net.Dialer{Timeout: time.Second}
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if entry.TCP {
+			conn, err := dialer.DialContext(ctx, "tcp", entryToString(entry))
+			if err != nil {
+				continue
+			}
+
+			conn.Close()
+		}
+
+		open = append(open, entry)
+	}
+
+	return open
+}
@@ -0,0 +1,236 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package iptables_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	limaiptables "github.com/lima-vm/lima/pkg/guestagent/iptables"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/iptables"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRules(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		fixture string
+		chains  []string
+		entries []limaiptables.Entry
+		skipped int
+	}{
+		"ufw": {
+			fixture: "ufw.rules",
+			chains:  iptables.DefaultChains,
+			entries: []limaiptables.Entry{{TCP: true, IP: net.IPv4zero, Port: 8082}},
+			skipped: 3,
+		},
+		"ufw with all the chains": {
+			fixture: "ufw.rules",
+			chains:  []string{"*"},
+			entries: []limaiptables.Entry{{TCP: true, IP: net.IPv4zero, Port: 8082}},
+			skipped: 3,
+		},
+		"ufw included": {
+			fixture: "ufw.rules",
+			chains:  []string{"CNI-DN-*", "ufw-*"},
+			entries: []limaiptables.Entry{
+				{TCP: true, IP: net.IPv4zero, Port: 8082},
+				{IP: net.IPv4zero, Port: 137},
+				{IP: net.IPv4zero, Port: 138},
+				{TCP: true, IP: net.IPv4(172, 24, 0, 5).To4(), Port: 2222},
+			},
+		},
+		"firewalld": {
+			fixture: "firewalld.rules",
+			chains:  iptables.DefaultChains,
+			entries: []limaiptables.Entry{{TCP: true, IP: net.IPv4(127, 0, 0, 1).To4(), Port: 8081}},
+			skipped: 5,
+		},
+		"firewalld with a zone included": {
+			fixture: "firewalld.rules",
+			chains:  []string{"*", "PRE_public_allow"},
+			entries: []limaiptables.Entry{
+				{TCP: true, IP: net.IPv4(127, 0, 0, 1).To4(), Port: 8081},
+				{IP: net.IPv4zero, Port: 137},
+				{IP: net.IPv4zero, Port: 138},
+				{TCP: true, IP: net.IPv4zero, Port: 9090},
+			},
+			skipped: 2,
+		},
+		"kubernetes": {
+			fixture: "kubernetes.rules",
+			chains:  iptables.DefaultChains,
+			entries: kubernetesEntries(),
+		},
+		"kubernetes with all the chains": {
+			fixture: "kubernetes.rules",
+			chains:  []string{"*"},
+			entries: kubernetesEntries(),
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := os.ReadFile(filepath.Join("testdata", tt.fixture))
+			require.NoError(t, err)
+
+			entries, skipped := iptables.ParseRules(strings.Split(string(data), "\n"), iptables.Chains{Include: tt.chains})
+			assert.Equal(t, tt.entries, entries)
+			assert.Equal(t, tt.skipped, skipped)
+		})
+	}
+}
+
+func TestChainsForwards(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		chains   []string
+		chain    string
+		forwards bool
+	}{
+		"portmap":                {chains: iptables.DefaultChains, chain: "CNI-DN-04579c7bb67f4c3f6cca0", forwards: true},
+		"other chain":            {chains: iptables.DefaultChains, chain: "KUBE-SERVICES"},
+		"all the chains":         {chains: []string{"*"}, chain: "KUBE-NODEPORTS", forwards: true},
+		"ufw with all":           {chains: []string{"*"}, chain: "ufw-before-prerouting"},
+		"ufw explicitly":         {chains: []string{"ufw-*"}, chain: "ufw-before-prerouting", forwards: true},
+		"ufw6 by a short prefix": {chains: []string{"u*"}, chain: "ufw6-before-prerouting"},
+		"firewalld zone":         {chains: []string{"PRE_public*"}, chain: "PRE_public_allow", forwards: true},
+		"firewalld other zone":   {chains: []string{"PRE_public*"}, chain: "PRE_internal_allow"},
+		"firewalld forward":      {chains: []string{"*"}, chain: "FWD_public"},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, tt.forwards, iptables.Chains{Include: tt.chains}.Forwards(tt.chain))
+		})
+	}
+}
+
+// kubernetesEntries are the ports of the kubernetes.rules fixture, whose
+// kube-proxy rules forward none: the rules of the ports that are not forwarded
+// have a negated destination, a destination that is not a single address, or
+// a protocol or a port that is not valid.
+func kubernetesEntries() []limaiptables.Entry {
+	return []limaiptables.Entry{
+		{TCP: true, IP: net.IPv4zero, Port: 8443},
+		{IP: net.IPv4zero, Port: 5353},
+		{TCP: true, IP: net.IPv4(192, 168, 5, 15).To4(), Port: 9006},
+		{TCP: true, IP: net.IPv4zero, Port: 8080},
+	}
+}
+
+// serviceHeavyRules are the rules of the nat table of a cluster with the
+// services, like iptables -t nat -S lists them: the kube-proxy rules of each
+// of them, none of which are forwarded, and the portmap rule of every tenth
+// one, with a destination address every other time; 5 rules for each.
+func serviceHeavyRules(services int) []byte {
+	var rules bytes.Buffer
+
+	rules.WriteString("-P PREROUTING ACCEPT\n-N KUBE-SERVICES\n-N CNI-HOSTPORT-DNAT\n")
+
+	for i := 0; i < services; i++ {
+		svc := fmt.Sprintf("KUBE-SVC-%016X", i)
+		sep := fmt.Sprintf("KUBE-SEP-%016X", i)
+		comment := fmt.Sprintf(`-m comment --comment "default/service-%d:http"`, i)
+		clusterIP := fmt.Sprintf("10.43.%d.%d", i/250, i%250+1)
+		podIP := fmt.Sprintf("10.42.%d.%d", i/250, i%250+1)
+
+		fmt.Fprintf(&rules, "-A KUBE-SERVICES -d %s/32 -p tcp %s -m tcp --dport 80 -j %s\n", clusterIP, comment, svc)
+		fmt.Fprintf(&rules, "-A %s %s -m statistic --mode random --probability 0.50000000000 -j %s\n", svc, comment, sep)
+		fmt.Fprintf(&rules, "-A %s -s %s/32 %s -j KUBE-MARK-MASQ\n", sep, podIP, comment)
+		fmt.Fprintf(&rules, "-A %s -p tcp %s -m tcp -j DNAT --to-destination %s:8080\n", sep, comment, podIP)
+
+		switch {
+		case i%20 == 0:
+			fmt.Fprintf(&rules, "-A CNI-DN-%021x -d 127.0.0.1/32 -p tcp -m tcp --dport %d -j DNAT --to-destination %s:80\n",
+				i, 10000+i, podIP)
+		case i%10 == 0:
+			fmt.Fprintf(&rules, "-A CNI-DN-%021x -p udp -m udp --dport %d -j DNAT --to-destination %s:53\n", i, 10000+i, podIP)
+		default:
+			fmt.Fprintf(&rules, "-A KUBE-NODEPORTS -p tcp %s -m tcp --dport %d -j KUBE-EXT-%016X\n", comment, 30000+i%2768, i)
+		}
+	}
+
+	return rules.Bytes()
+}
+
+// TestParserScans checks that a parser that reuses its buffers from one scan
+// to the next parses the rules like a new one, and leaves the ports of the
+// previous scans alone.
+func TestParserScans(t *testing.T) {
+	t.Parallel()
+
+	chains := iptables.Chains{Include: iptables.DefaultChains}
+	parser := iptables.NewParser(chains)
+
+	kubernetes, err := os.ReadFile(filepath.Join("testdata", "kubernetes.rules"))
+	require.NoError(t, err)
+
+	first, skipped := parser.Parse(kubernetes)
+	assert.Equal(t, kubernetesEntries(), first)
+	assert.Zero(t, skipped)
+
+	// The cluster grows, and then shrinks back.
+	services, skipped := parser.Parse(serviceHeavyRules(1000))
+	assert.Zero(t, skipped)
+	assert.Len(t, services, 100)
+
+	for i, entry := range services {
+		assert.Equal(t, 10000+10*i, entry.Port)
+		assert.Equal(t, i%2 == 0, entry.TCP)
+
+		if i%2 == 0 {
+			assert.Equal(t, net.IPv4(127, 0, 0, 1).To4(), entry.IP)
+		} else {
+			assert.Equal(t, net.IPv4zero, entry.IP)
+		}
+	}
+
+	fresh, _ := iptables.NewParser(chains).Parse(serviceHeavyRules(1000))
+	assert.Equal(t, fresh, services)
+
+	last, _ := parser.Parse(kubernetes)
+	assert.Equal(t, kubernetesEntries(), last)
+	assert.Equal(t, kubernetesEntries(), first)
+	assert.Equal(t, fresh, services)
+}
+
+// BenchmarkParserParse scans the rules of a cluster with 1000 services, about
+// 5000 rules, with the same parser, like the scans of ForwardPorts do.
+func BenchmarkParserParse(b *testing.B) {
+	output := serviceHeavyRules(1000)
+	parser := iptables.NewParser(iptables.Chains{Include: iptables.DefaultChains})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if entries, _ := parser.Parse(output); len(entries) != 100 {
+			b.Fatalf("parsed %d ports, instead of 100", len(entries))
+		}
+	}
+}
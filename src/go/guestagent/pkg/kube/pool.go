@@ -0,0 +1,190 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kube
+
+import (
+	"context"
+	"sync"
+)
+
+// DefaultWorkers is the number of the workers that handle the events of the
+// services by default, see NewPool.
+const DefaultWorkers = 4
+
+// Pool runs the work of the services with a bounded number of workers, so
+// that a burst of events, e.g. as a large manifest is applied, does not bind
+// the listeners and change the port mappings of all the services at once.
+// The work of a key, the UID of a service, is run in the order that it was
+// submitted in and never by two workers at once; the keys take turns.
+type Pool struct {
+	mutex   sync.Mutex
+	workers int
+	running int
+	// queues holds the work of the keys that is yet to run; a key is in it
+	// for as long as it is queued in ready or run by a worker.
+	queues map[string][]func()
+	// ready holds the keys whose work can run, in the order that they
+	// are to be run in.
+	ready []string
+	// depth is the number of the pieces of work in queues.
+	depth int
+	// drained is closed once no work is queued or running anymore, see Wait.
+	drained chan struct{}
+	closed  bool
+	panics  chan any
+}
+
+// NewPool returns a pool that runs the work with at most the given number of
+// workers, at least one; they are only started while there is work to run.
+func NewPool(workers int) *Pool {
+	return &Pool{
+		workers: max(workers, 1),
+		queues:  make(map[string][]func()),
+		panics:  make(chan any, 1),
+	}
+}
+
+// Submit queues the work of the key, to run once the previous work of the
+// key ran and a worker is free. It does not block; the work that is
+// submitted once the pool is closed is dropped.
+func (p *Pool) Submit(key string, work func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	if p.drained == nil {
+		p.drained = make(chan struct{})
+	}
+
+	p.depth++
+
+	queue, ok := p.queues[key]
+	p.queues[key] = append(queue, work)
+
+	// The key waits for its worker otherwise.
+	if ok {
+		return
+	}
+
+	p.ready = append(p.ready, key)
+
+	if p.running < p.workers {
+		p.running++
+
+		go p.work()
+	}
+}
+
+// work runs the work of the ready keys, one piece at a time so that the
+// keys with a lot of it do not hold up the others, until none is left.
+func (p *Pool) work() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for len(p.ready) != 0 {
+		key := p.ready[0]
+		p.ready = p.ready[1:]
+
+		work := p.queues[key][0]
+		p.queues[key] = p.queues[key][1:]
+		p.depth--
+
+		p.mutex.Unlock()
+		p.run(work)
+		p.mutex.Lock()
+
+		if len(p.queues[key]) == 0 {
+			delete(p.queues, key)
+		} else {
+			p.ready = append(p.ready, key)
+		}
+	}
+
+	p.running--
+
+	if p.running == 0 && p.drained != nil {
+		close(p.drained)
+		p.drained = nil
+	}
+}
+
+// run runs the work, its panic is recovered for the caller of the pool to
+// raise it again, see Panics, so that the bookkeeping of the pool holds.
+func (p *Pool) run(work func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			select {
+			case p.panics <- r:
+			default:
+			}
+		}
+	}()
+
+	work()
+}
+
+// Panics returns the channel that the first panic of the work that was not
+// received yet is sent to, for the caller of the pool to raise it again,
+// e.g. for the supervisor to recover it.
+func (p *Pool) Panics() <-chan any {
+	return p.panics
+}
+
+// Depth returns the number of the pieces of work that are queued and not
+// running yet; it grows while all the workers are busy.
+func (p *Pool) Depth() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.depth
+}
+
+// Wait waits for the work that was submitted to have run, or for the
+// context to be done, whose error it returns then.
+func (p *Pool) Wait(ctx context.Context) error {
+	p.mutex.Lock()
+	drained := p.drained
+	p.mutex.Unlock()
+
+	if drained == nil {
+		return nil
+	}
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close drops the work that is queued and waits for the running work to
+// return; the work that is submitted afterwards is dropped too.
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	p.closed = true
+
+	for key := range p.queues {
+		p.queues[key] = nil
+	}
+
+	p.ready = nil
+	p.depth = 0
+	p.mutex.Unlock()
+
+	_ = p.Wait(context.Background())
+}
@@ -0,0 +1,168 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kube_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/kube"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolBoundsTheWorkersAndOrdersTheServices(t *testing.T) {
+	t.Parallel()
+
+	const (
+		services = 200
+		events   = 5
+	)
+
+	pool := kube.NewPool(kube.DefaultWorkers)
+	release := make(chan struct{})
+
+	var (
+		running, peak atomic.Int32
+		busy          [services]atomic.Bool
+		handled       [services][]int
+		start, submit sync.WaitGroup
+	)
+
+	start.Add(1)
+
+	// Every service submits its events at once, like a manifest that is applied.
+	for service := range services {
+		submit.Add(1)
+
+		go func() {
+			defer submit.Done()
+
+			start.Wait()
+
+			for event := range events {
+				pool.Submit(fmt.Sprintf("uid-%d", service), func() {
+					current := running.Add(1)
+					defer running.Add(-1)
+
+					for {
+						highest := peak.Load()
+						if current <= highest || peak.CompareAndSwap(highest, current) {
+							break
+						}
+					}
+
+					assert.False(t, busy[service].Swap(true), "the events of service %d are handled at once", service)
+					defer busy[service].Store(false)
+
+					<-release
+
+					handled[service] = append(handled[service], event)
+				})
+			}
+		}()
+	}
+
+	start.Done()
+	submit.Wait()
+
+	// The workers are blocked, the other events wait in the queue.
+	require.Eventually(t, func() bool { return running.Load() == kube.DefaultWorkers }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, services*events-kube.DefaultWorkers, pool.Depth())
+
+	close(release)
+	require.NoError(t, pool.Wait(context.Background()))
+
+	assert.Equal(t, 0, pool.Depth())
+	assert.Equal(t, int32(kube.DefaultWorkers), peak.Load())
+
+	for service := range services {
+		assert.Equal(t, []int{0, 1, 2, 3, 4}, handled[service], "the events of service %d", service)
+	}
+}
+
+func TestPoolPanics(t *testing.T) {
+	t.Parallel()
+
+	pool := kube.NewPool(1)
+	ran := false
+
+	pool.Submit("uid", func() { panic("failed") })
+	pool.Submit("uid", func() { ran = true })
+	require.NoError(t, pool.Wait(context.Background()))
+
+	// The work that follows the panic still runs, the panic is raised by the caller.
+	assert.True(t, ran)
+	assert.Equal(t, "failed", <-pool.Panics())
+}
+
+func TestPoolClose(t *testing.T) {
+	t.Parallel()
+
+	pool := kube.NewPool(1)
+	release := make(chan struct{})
+
+	var handled atomic.Int32
+
+	pool.Submit("first", func() {
+		<-release
+		handled.Add(1)
+	})
+	pool.Submit("first", func() { handled.Add(1) })
+	pool.Submit("second", func() { handled.Add(1) })
+	require.Eventually(t, func() bool { return pool.Depth() == 2 }, 5*time.Second, time.Millisecond)
+
+	closed := make(chan struct{})
+
+	go func() {
+		pool.Close()
+		close(closed)
+	}()
+
+	// The queued work is dropped, the running work is waited for.
+	require.Eventually(t, func() bool { return pool.Depth() == 0 }, 5*time.Second, time.Millisecond)
+	select {
+	case <-closed:
+		t.Fatal("the pool was closed before its running work returned")
+	default:
+	}
+
+	close(release)
+	<-closed
+
+	pool.Submit("second", func() { handled.Add(1) })
+	require.NoError(t, pool.Wait(context.Background()))
+	assert.Equal(t, int32(1), handled.Load())
+}
+
+func TestPoolWaitCancelled(t *testing.T) {
+	t.Parallel()
+
+	pool := kube.NewPool(1)
+	release := make(chan struct{})
+
+	defer close(release)
+
+	pool.Submit("uid", func() { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// The wait gives up on the work that is still running.
+	require.ErrorIs(t, pool.Wait(ctx), context.DeadlineExceeded)
+}
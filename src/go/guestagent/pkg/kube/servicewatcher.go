@@ -32,39 +32,46 @@ import (
 )
 
 // event occurs when a NodePort in a service is added or removed.
+// Its fields are exported for the recordings, which hold
+// neither the specs nor the annotations of the services.
 type event struct {
-	UID         types.UID
-	namespace   string
-	name        string
-	portMapping map[int32]corev1.Protocol
-	deleted     bool
+	UID         types.UID                 `json:"uid"`
+	Namespace   string                    `json:"namespace"`
+	Name        string                    `json:"name"`
+	PortMapping map[int32]corev1.Protocol `json:"portMapping"`
+	Deleted     bool                      `json:"deleted,omitempty"`
+	// received is when the event was received, to measure how long its port
+	// mapping takes to reach the host; it is not recorded, see tracker.WithEventTime.
+	received time.Time
 }
 
 // watchServices monitors for NodePort and LoadBalancer services; after listing all service ports
-// initially, it reports service ports being added or deleted.
-func watchServices(ctx context.Context, client *kubernetes.Clientset) (<-chan event, <-chan error, error) {
+// initially, it reports service ports being added or deleted. The listed channel is closed once
+// the events of the initial list were received.
+func watchServices(ctx context.Context, client *kubernetes.Clientset) (<-chan event, <-chan struct{}, <-chan error, error) {
 	eventCh := make(chan event)
+	listedCh := make(chan struct{})
 	errorCh := make(chan error)
 	informerFactory := informers.NewSharedInformerFactory(client, 1*time.Hour)
 	serviceInformer := informerFactory.Core().V1().Services()
 	sharedInformer := serviceInformer.Informer()
 	_, _ = sharedInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
-			log.Debugf("Service Informer: Add func called with: %+v", obj)
-			handleUpdate(nil, obj, eventCh)
+			logger.Debugf("Service Informer: Add func called with: %+v", obj)
+			handleUpdate(ctx, nil, obj, eventCh)
 		},
 		DeleteFunc: func(obj interface{}) {
-			log.Debugf("Service Informer: Del func called with: %+v", obj)
-			handleUpdate(obj, nil, eventCh)
+			logger.Debugf("Service Informer: Del func called with: %+v", obj)
+			handleUpdate(ctx, obj, nil, eventCh)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
-			log.Debugf("Service Informer: Update func called with old object %+v and new Object: %+v", oldObj, newObj)
-			handleUpdate(oldObj, newObj, eventCh)
+			logger.Debugf("Service Informer: Update func called with old object %+v and new Object: %+v", oldObj, newObj)
+			handleUpdate(ctx, oldObj, newObj, eventCh)
 		},
 	})
 
 	err := sharedInformer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
-		log.Debugw("kubernetes: error watching", log.Fields{
+		logger.Debugw("kubernetes: error watching", log.Fields{
 			"error": err,
 		})
 		switch {
@@ -83,22 +90,25 @@ func watchServices(ctx context.Context, client *kubernetes.Clientset) (<-chan ev
 		case errors.Is(err, unix.ECONNREFUSED):
 			// connection refused; the server is down.
 			// Note that "failed to list" errors need k8s.io/client-go 0.25.0
-			errorCh <- err
+			select {
+			case errorCh <- err:
+			case <-ctx.Done():
+			}
 		default:
 			var statusError *apierrors.StatusError
 			if errors.As(err, &statusError) {
-				log.Debugw("kubernetes: got status error", log.Fields{
+				logger.Debugw("kubernetes: got status error", log.Fields{
 					"status": statusError.Status(),
 					"debug":  fmt.Sprintf(statusError.DebugError()),
 				})
 			}
-			log.Errorw("kubernetes: unexpected error watching", log.Fields{
+			logger.Errorw("kubernetes: unexpected error watching", log.Fields{
 				"error": err,
 			})
 		}
 	})
 	if err != nil {
-		return nil, nil, fmt.Errorf("error watching services: %w", err)
+		return nil, nil, nil, fmt.Errorf("error watching services: %w", err)
 	}
 
 	informerFactory.WaitForCacheSync(ctx.Done())
@@ -106,24 +116,27 @@ func watchServices(ctx context.Context, client *kubernetes.Clientset) (<-chan ev
 
 	services, err := client.CoreV1().Services(corev1.NamespaceAll).List(ctx, v1.ListOptions{})
 	if err != nil {
-		return nil, nil, fmt.Errorf("error listing services: %w", err)
+		return nil, nil, nil, fmt.Errorf("error listing services: %w", err)
 	}
-	log.Debugf("coreV1 services list :%+v", services.Items)
+	logger.Debugf("coreV1 services list :%+v", services.Items)
 
 	// List the initial set of services asynchronously, so that we don't have to
 	// worry about the channel blocking.
 	go func() {
+		defer close(listedCh)
+
 		for _, svc := range services.Items {
-			handleUpdate(nil, svc, eventCh)
+			handleUpdate(ctx, nil, svc, eventCh)
 		}
 	}()
 
-	return eventCh, errorCh, nil
+	return eventCh, listedCh, errorCh, nil
 }
 
 // handleUpdate examines the old and new services, calculating the difference
-// and emitting events to the given channel.
-func handleUpdate(oldObj, newObj interface{}, eventCh chan<- event) {
+// and emitting events to the given channel; the events are dropped once the
+// context is done, as the watch that receives them is stopped.
+func handleUpdate(ctx context.Context, oldObj, newObj interface{}, eventCh chan<- event) {
 	deleted := make(map[int32]corev1.Protocol)
 	added := make(map[int32]corev1.Protocol)
 	oldSvc, _ := oldObj.(*corev1.Service)
@@ -135,16 +148,8 @@ func handleUpdate(oldObj, newObj interface{}, eventCh chan<- event) {
 		namespace = oldSvc.Namespace
 		name = oldSvc.Name
 
-		if oldSvc.Spec.Type == corev1.ServiceTypeNodePort {
-			for _, port := range oldSvc.Spec.Ports {
-				deleted[port.NodePort] = port.Protocol
-			}
-		}
-
-		if oldSvc.Spec.Type == corev1.ServiceTypeLoadBalancer {
-			for _, port := range oldSvc.Spec.Ports {
-				deleted[port.Port] = port.Protocol
-			}
+		for port, protocol := range servicePorts(oldSvc) {
+			deleted[port] = protocol
 		}
 	}
 
@@ -152,41 +157,55 @@ func handleUpdate(oldObj, newObj interface{}, eventCh chan<- event) {
 		namespace = newSvc.Namespace
 		name = newSvc.Name
 
-		if newSvc.Spec.Type == corev1.ServiceTypeNodePort {
-			for _, port := range newSvc.Spec.Ports {
-				delete(deleted, port.NodePort)
-				added[port.NodePort] = port.Protocol
-			}
-		}
-
-		if newSvc.Spec.Type == corev1.ServiceTypeLoadBalancer {
-			for _, port := range newSvc.Spec.Ports {
-				delete(deleted, port.Port)
-				added[port.Port] = port.Protocol
-			}
+		for port, protocol := range servicePorts(newSvc) {
+			delete(deleted, port)
+			added[port] = protocol
 		}
 	}
 
 	if len(deleted) > 0 {
-		sendEvents(deleted, oldSvc, true, eventCh)
+		sendEvents(ctx, deleted, oldSvc, true, eventCh)
 	}
 
 	if len(added) > 0 {
-		sendEvents(added, newSvc, false, eventCh)
+		sendEvents(ctx, added, newSvc, false, eventCh)
 	}
 
-	log.Debugf("kubernetes service update: %s/%s has -%d +%d service port",
+	logger.Debugf("kubernetes service update: %s/%s has -%d +%d service port",
 		namespace, name, len(deleted), len(added))
 }
 
-func sendEvents(mapping map[int32]corev1.Protocol, svc *corev1.Service, deleted bool, eventCh chan<- event) {
-	if svc != nil {
-		eventCh <- event{
-			UID:         svc.UID,
-			namespace:   svc.Namespace,
-			name:        svc.Name,
-			portMapping: mapping,
-			deleted:     deleted,
+// servicePorts returns the ports that the service is exposed on, the node
+// ports of the NodePort services and the ports of the LoadBalancer ones.
+func servicePorts(svc *corev1.Service) map[int32]corev1.Protocol {
+	ports := make(map[int32]corev1.Protocol)
+
+	for _, port := range svc.Spec.Ports {
+		switch svc.Spec.Type {
+		case corev1.ServiceTypeNodePort:
+			ports[port.NodePort] = port.Protocol
+		case corev1.ServiceTypeLoadBalancer:
+			ports[port.Port] = port.Protocol
 		}
 	}
+
+	return ports
+}
+
+func sendEvents(ctx context.Context, mapping map[int32]corev1.Protocol, svc *corev1.Service, deleted bool, eventCh chan<- event) {
+	if svc == nil {
+		return
+	}
+
+	select {
+	case eventCh <- event{
+		UID:         svc.UID,
+		Namespace:   svc.Namespace,
+		Name:        svc.Name,
+		PortMapping: mapping,
+		Deleted:     deleted,
+		received:    time.Now(),
+	}:
+	case <-ctx.Done():
+	}
 }
@@ -28,19 +28,28 @@ package kube
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/Masterminds/log-go"
 	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/recording"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/retry"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
 	"golang.org/x/sys/unix"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	restclient "k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -57,15 +66,53 @@ const (
 	stateWatching
 )
 
+// reconnectPolicy is how the watch of the services is started again once it
+// failed, e.g. while the API server restarts, so that the agents of the VMs
+// whose cluster restarted together do not reconnect in step.
+var reconnectPolicy = retry.Policy{Initial: time.Second, Max: 30 * time.Second} //nolint:gochecknoglobals
+
+// watchReconnects is the number of times that the watch of the services was
+// lost and started over, see Collect.
+var watchReconnects atomic.Uint64 //nolint:gochecknoglobals
+
+// eventPool is the pool of the watch that runs, whose queue depth is collected, see Collect.
+var eventPool atomic.Pointer[Pool] //nolint:gochecknoglobals
+
+// Collect returns the metrics of the watches for the Prometheus endpoint, see metrics.Registry.
+func Collect() []metrics.Family {
+	var depth int
+	if pool := eventPool.Load(); pool != nil {
+		depth = pool.Depth()
+	}
+
+	return []metrics.Family{
+		{
+			Name:    metrics.Namespace + "kubernetes_watch_reconnects_total",
+			Help:    "Number of times that the watch of the Kubernetes services was lost and started over.",
+			Type:    metrics.TypeCounter,
+			Samples: []metrics.Sample{{Value: float64(watchReconnects.Load())}},
+		},
+		{
+			Name:    metrics.Namespace + "kubernetes_event_queue_depth",
+			Help:    "Number of the events of the Kubernetes services that wait for a free worker.",
+			Type:    metrics.TypeGauge,
+			Samples: []metrics.Sample{{Value: float64(depth)}},
+		},
+	}
+}
+
 // WatchForServices watches Kubernetes for NodePort and LoadBalancer services
 // and create listeners on 0.0.0.0 matching them.
 // Any connection errors are ignored and retried.
+// The events are handled by at most the given number of workers, see Pool.
 func WatchForServices(
 	ctx context.Context,
 	configPath string,
 	k8sServiceListenerIP net.IP,
 	enableListeners bool,
 	portTracker tracker.Tracker,
+	recorder *recording.Recorder,
+	workers int,
 ) error {
 	// These variables are shared across the different states
 	var (
@@ -74,30 +121,58 @@ func WatchForServices(
 		config    *restclient.Config
 		clientset *kubernetes.Clientset
 		eventCh   <-chan event
+		listedCh  <-chan struct{}
 		errorCh   <-chan error
 	)
 
+	handler := &serviceHandler{
+		listenerIP:      k8sServiceListenerIP,
+		enableListeners: enableListeners,
+		portTracker:     portTracker,
+	}
+
+	// The events of a service are handled in order, the ones of the other
+	// services meanwhile. The events that are queued as the watch returns are
+	// dropped, since the next watch lists the services again, but the running
+	// ones are waited for, so that they do not race with it.
+	pool := NewPool(workers)
+	eventPool.Store(pool)
+
+	defer pool.Close()
+
 	watchContext, watchCancel := context.WithCancel(ctx)
 
+	// The watch and every event that is received are reported, so that
+	// the status tells when the last one was.
+	health := supervisor.HealthReporter(ctx)
+
 	// Always cancel if we failed; however, we may clobber watchCancel, so we
 	// need a wrapper function to capture the variable reference.
 	defer func() {
 		watchCancel()
 	}()
 
+	// The backoff of the reconnects is reset once the services were listed.
+	reconnect := reconnectPolicy.Start()
+
 	for {
 		switch state {
 		case stateNoConfig:
 			config, err = getClientConfig(configPath)
 			if err != nil {
-				log.Debugw("kubernetes: failed to read kubeconfig", log.Fields{
+				logger.Debugw("kubernetes: failed to read kubeconfig", log.Fields{
 					"config-path": configPath,
 					"error":       err,
 				})
 
 				if errors.Is(err, fs.ErrNotExist) {
+					// The other sources do not wait for the cluster to start.
+					tracker.InitialPassDone(ctx, err)
+
 					// Wait for the file to exist
-					time.Sleep(time.Second)
+					if !sleep(ctx, time.Second) {
+						return ctx.Err()
+					}
 
 					continue
 				}
@@ -105,14 +180,14 @@ func WatchForServices(
 				return err
 			}
 
-			log.Debugf("kubernetes: loaded kubeconfig %s", configPath)
+			logger.Debugf("kubernetes: loaded kubeconfig %s", configPath)
 
 			state = stateDisconnected
 		case stateDisconnected:
 			clientset, err = kubernetes.NewForConfig(config)
 			if err != nil {
 				// There should be no transient errors here
-				log.Errorw("failed to load kubeconfig", log.Fields{
+				logger.Errorw("failed to load kubeconfig", log.Fields{
 					"config-path": configPath,
 					"error":       err,
 				})
@@ -120,7 +195,7 @@ func WatchForServices(
 				return fmt.Errorf("failed to create Kubernetes client: %w", err)
 			}
 
-			eventCh, errorCh, err = watchServices(watchContext, clientset)
+			eventCh, listedCh, errorCh, err = watchServices(watchContext, clientset)
 			if err != nil {
 				switch {
 				default:
@@ -130,112 +205,302 @@ func WatchForServices(
 				case errors.Is(err, unix.ECONNREFUSED):
 				case isAPINotReady(err):
 				}
-				// sleep and continue for all the expected case
-				time.Sleep(time.Second)
+				health.Failed(err)
+				tracker.InitialPassDone(ctx, err)
+				// back off and continue for all the expected case
+				if reconnect.Wait(ctx) != nil {
+					return ctx.Err()
+				}
 
 				continue
 			}
 
-			log.Debugf("watching kubernetes services")
+			logger.Debugf("watching kubernetes services")
+			health.Succeeded()
 
 			state = stateWatching
 		case stateWatching:
 			select {
 			case <-ctx.Done():
-				log.Debugw("kubernetes watcher: context closed", log.Fields{
+				logger.Debugw("kubernetes watcher: context closed", log.Fields{
 					"error": ctx.Err(),
 				})
 
 				return ctx.Err()
+			case <-listedCh:
+				// The events of the initial list were all received, and
+				// are handled once the pool ran them.
+				if err := pool.Wait(ctx); err != nil {
+					return err
+				}
+
+				tracker.InitialPassDone(ctx, nil)
+				reconnect.Reset()
+
+				listedCh = nil
 			case err = <-errorCh:
-				log.Debugw("kubernetes: got error, rolling back", log.Fields{
+				logger.Debugw("kubernetes: got error, rolling back", log.Fields{
 					"error": err,
 				})
 				watchCancel()
+				watchReconnects.Add(1)
+				health.Failed(err)
 
 				state = stateNoConfig
 
-				time.Sleep(time.Second)
+				if reconnect.Wait(ctx) != nil {
+					return ctx.Err()
+				}
 
 				continue
 			case event := <-eventCh:
-				if event.deleted {
-					if enableListeners {
-						for port := range event.portMapping {
-							if err := portTracker.RemoveListener(ctx, k8sServiceListenerIP, int(port)); err != nil {
-								log.Errorw("failed to close listener", log.Fields{
-									"error":     err,
-									"ports":     event.portMapping,
-									"namespace": event.namespace,
-									"name":      event.name,
-								})
-							}
-						}
-
-						log.Debugf("kubernetes service: deleted listener %s/%s:%v",
-							event.namespace, event.name, event.portMapping)
-
-						continue
-					}
+				// The rules of the ports of the service are about to change, see tracker.Nudger.
+				tracker.Nudge(ctx)
+				health.Succeeded()
 
-					if err := portTracker.Remove(string(event.UID)); err != nil {
-						log.Errorw("failed to delete a port from tracker", log.Fields{
-							"error":     err,
-							"UID":       event.UID,
-							"ports":     event.portMapping,
-							"namespace": event.namespace,
-							"name":      event.name,
-						})
-					} else {
-						log.Debugf("kubernetes service: port mapping deleted %s/%s:%v",
-							event.namespace, event.name, event.portMapping)
-					}
-				} else {
-					if enableListeners {
-						for port := range event.portMapping {
-							if err := portTracker.AddListener(ctx, k8sServiceListenerIP, int(port)); err != nil {
-								log.Errorw("failed to create listener", log.Fields{
-									"error":     err,
-									"ports":     event.portMapping,
-									"namespace": event.namespace,
-									"name":      event.name,
-								})
-							}
-						}
-
-						log.Debugf("kubernetes service: started listener %s/%s:%v",
-							event.namespace, event.name, event.portMapping)
-
-						continue
-					}
-					portMapping, err := createPortMapping(event.portMapping, k8sServiceListenerIP)
-					if err != nil {
-						log.Errorw("failed to create port mapping", log.Fields{
-							"error":     err,
-							"ports":     event.portMapping,
-							"namespace": event.namespace,
-							"name":      event.name,
-						})
-
-						continue
-					}
-					if err := portTracker.Add(string(event.UID), portMapping); err != nil {
-						log.Errorw("failed to add port mapping", log.Fields{
-							"error":     err,
-							"ports":     event.portMapping,
-							"namespace": event.namespace,
-							"name":      event.name,
-						})
-					} else {
-						log.Debugf("kubernetes service: port mapping added %s/%s:%v",
-							event.namespace, event.name, event.portMapping)
-					}
+				if err := recorder.Record(tracker.SourceKubernetes, event); err != nil {
+					logger.Errorf("kubernetes: failed to record the event: %v", err)
 				}
+
+				pool.Submit(string(event.UID), func() {
+					handler.handle(ctx, health, event)
+				})
+			case r := <-pool.Panics():
+				// The supervisor recovers it like the panics of the watch.
+				panic(r)
 			}
 		}
 	}
 }
 
+// sleep waits for the duration, it returns false if the context is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// ReplayHandler returns the handler of the recorded events of the services,
+// which handles them like WatchForServices handles the events that it
+// receives; see recording.Replay.
+func ReplayHandler(k8sServiceListenerIP net.IP, enableListeners bool, portTracker tracker.Tracker) recording.Handler {
+	handler := &serviceHandler{
+		listenerIP:      k8sServiceListenerIP,
+		enableListeners: enableListeners,
+		portTracker:     portTracker,
+	}
+
+	return func(ctx context.Context, recorded json.RawMessage) error {
+		var event event
+		if err := json.Unmarshal(recorded, &event); err != nil {
+			return fmt.Errorf("failed to decode the event: %w", err)
+		}
+
+		handler.handle(ctx, supervisor.HealthReporter(ctx), event)
+
+		return nil
+	}
+}
+
+// serviceHandler changes the port mappings of the services, both for
+// the events that are watched and for the recorded ones.
+type serviceHandler struct {
+	listenerIP      net.IP
+	enableListeners bool
+	portTracker     tracker.Tracker
+}
+
+// handle changes the port mappings, or the listeners, of the service of the event.
+func (h *serviceHandler) handle(ctx context.Context, health supervisor.Reporter, event event) {
+	// The correlation ID links the log lines and the payloads of the
+	// change to the port mapping that the event causes.
+	correlationID := tracker.NewCorrelationID()
+
+	// The changes of the event are traced as the children of its span.
+	ctx, span := tracing.Start(ctx, "kubernetes.event",
+		tracing.String(tracing.AttrID, string(event.UID)),
+		tracing.String(tracing.AttrCorrelationID, correlationID),
+		tracing.String("service", event.Namespace+"/"+event.Name),
+		tracing.String("deleted", strconv.FormatBool(event.Deleted)))
+	defer span.End()
+
+	// The service is the origin of its port mapping or of its listeners.
+	origin := tracker.Origin{Kind: tracker.OriginService, ID: string(event.UID), Namespace: event.Namespace, Name: event.Name}
+
+	if event.Deleted {
+		if h.enableListeners {
+			for port, protocol := range event.PortMapping {
+				if err := h.portTracker.RemoveListener(ctx, h.listenerIP, int(port)); err != nil {
+					logger.Errorw("failed to close listener", logging.Fields(
+						logging.Port(int(port)),
+						logging.Protocol(string(protocol)),
+						logging.Service(event.Namespace, event.Name),
+						logging.Source(tracker.SourceKubernetes),
+						logging.Error(err),
+					))
+				}
+			}
+
+			logger.Debugw("kubernetes service: deleted listener", h.fields(event, correlationID))
+
+			return
+		}
+
+		err := h.portTracker.Remove(ctx, string(event.UID), tracker.WithCorrelationID(correlationID))
+		if err != nil {
+			span.RecordError(err)
+			logger.Errorw("failed to delete a port from tracker", logging.Fields(h.fields(event, correlationID), logging.Error(err)))
+			health.Failed(err)
+		} else {
+			logger.Debugw("kubernetes service: port mapping deleted", h.fields(event, correlationID))
+		}
+	} else {
+		if h.enableListeners {
+			for port, protocol := range event.PortMapping {
+				if err := h.portTracker.AddListener(tracker.ContextWithOrigin(ctx, origin), h.listenerIP, int(port)); err != nil {
+					logger.Errorw("failed to create listener", logging.Fields(
+						logging.Port(int(port)),
+						logging.Protocol(string(protocol)),
+						logging.Service(event.Namespace, event.Name),
+						logging.Source(tracker.SourceKubernetes),
+						logging.Error(err),
+					))
+				}
+			}
+
+			logger.Debugw("kubernetes service: started listener", h.fields(event, correlationID))
+
+			return
+		}
+		portMapping, err := createPortMapping(event.PortMapping, h.listenerIP)
+		if err != nil {
+			logger.Errorw("failed to create port mapping", logging.Fields(h.fields(event, correlationID), logging.Error(err)))
+
+			return
+		}
+		err = h.portTracker.Add(ctx, string(event.UID), portMapping,
+			tracker.WithSource(tracker.SourceKubernetes), tracker.WithOrigin(origin), tracker.WithCorrelationID(correlationID),
+			tracker.WithEventTime(event.received))
+		if err != nil {
+			span.RecordError(err)
+			logger.Errorw("failed to add port mapping", logging.Fields(h.fields(event, correlationID), logging.Error(err)))
+			health.Failed(err)
+		} else {
+			logger.Debugw("kubernetes service: port mapping added", h.fields(event, correlationID))
+		}
+	}
+}
+
+// fields returns the fields of the log lines of the event.
+func (h *serviceHandler) fields(event event, correlationID string) log.Fields {
+	return logging.Fields(
+		logging.ID(string(event.UID)),
+		logging.Service(event.Namespace, event.Name),
+		logging.Source(tracker.SourceKubernetes),
+		logging.CorrelationID(correlationID),
+		log.Fields{"ports": event.PortMapping},
+	)
+}
+
+// ListServices returns the port mappings of the NodePort and LoadBalancer
+// services, keyed by the namespace and the name of the service, without
+// tracking them; see scan.Lister.
+func ListServices(ctx context.Context, configPath string, k8sServiceListenerIP net.IP) (map[string]nat.PortMap, error) {
+	return listServices(ctx, configPath, k8sServiceListenerIP, false)
+}
+
+// ListServiceUIDs returns the port mappings of the services like
+// ListServices, keyed by their UID like WatchForServices tracks them,
+// along with the other services, whose port mappings are nil; see
+// tracker.DriftSource.
+func ListServiceUIDs(ctx context.Context, configPath string, k8sServiceListenerIP net.IP) (map[string]nat.PortMap, error) {
+	return listServices(ctx, configPath, k8sServiceListenerIP, true)
+}
+
+func listServices(ctx context.Context, configPath string, k8sServiceListenerIP net.IP, byUID bool) (map[string]nat.PortMap, error) {
+	config, err := getClientConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	services, err := clientset.CoreV1().Services(corev1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing services: %w", err)
+	}
+
+	portMaps := make(map[string]nat.PortMap)
+
+	for i := range services.Items {
+		svc := &services.Items[i]
+
+		key := svc.Namespace + "/" + svc.Name
+		if byUID {
+			key = string(svc.UID)
+		}
+
+		ports := servicePorts(svc)
+		if len(ports) == 0 {
+			if byUID {
+				portMaps[key] = nil
+			}
+
+			continue
+		}
+
+		portMap, err := createPortMapping(ports, k8sServiceListenerIP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the port mapping of the service %s/%s: %w", svc.Namespace, svc.Name, err)
+		}
+
+		portMaps[key] = portMap
+	}
+
+	return portMaps, nil
+}
+
+// CheckConfig checks that the kubeconfig can be loaded, for the self-test;
+// it returns the address of the API server that it points to.
+func CheckConfig(configPath string) (string, error) {
+	config, err := getClientConfig(configPath)
+	if err != nil {
+		return "", err
+	}
+
+	return config.Host, nil
+}
+
+// CheckAPI checks that the services can be listed with the Kubernetes API,
+// for the self-test; it returns how many there are.
+func CheckAPI(ctx context.Context, configPath string) (string, error) {
+	config, err := getClientConfig(configPath)
+	if err != nil {
+		return "", err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return "", fmt.Errorf("failed to create Kubernetes client: %w", err)
+	}
+
+	services, err := clientset.CoreV1().Services(corev1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error listing services: %w", err)
+	}
+
+	return fmt.Sprintf("%d services", len(services.Items)), nil
+}
+
 // getClientConfig returns a rest config.
 func getClientConfig(configPath string) (*restclient.Config, error) {
 	loadingRules := clientcmd.ClientConfigLoadingRules{
@@ -276,7 +541,7 @@ func createPortMapping(ports map[int32]corev1.Protocol, k8sServiceListenerIP net
 	portMap := make(nat.PortMap)
 
 	for port, proto := range ports {
-		log.Debugf("create port mapping for port %d, protocol %s", port, proto)
+		logger.Debugw("create port mapping", logging.Fields(logging.Port(int(port)), logging.Protocol(string(proto))))
 		portMapKey, err := nat.NewPort(string(proto), strconv.Itoa(int(port)))
 		if err != nil {
 			return nil, err
@@ -0,0 +1,169 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package kube_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/kube"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TestWatchForServicesCancelled checks that the watcher returns promptly once
+// its context is cancelled while it waits for the kubeconfig to exist.
+func TestWatchForServicesCancelled(t *testing.T) {
+	t.Parallel()
+
+	portTracker := tracker.NewVTunnelTracker(nil, []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- kube.WatchForServices(ctx, filepath.Join(t.TempDir(), "kubeconfig"), net.IPv4zero, false,
+			portTracker, nil, kube.DefaultWorkers)
+	}()
+
+	// The watcher waits a second between the checks of the kubeconfig.
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("the watcher did not return once its context was cancelled")
+	}
+}
+
+// TestWatchForServicesCancelledWhileHandling checks that the watcher returns
+// promptly once its context is cancelled while the port mapping of a service
+// is being sent.
+func TestWatchForServicesCancelledWhileHandling(t *testing.T) {
+	t.Parallel()
+
+	server := fakeKubernetesAPI(t)
+	config := filepath.Join(t.TempDir(), "kubeconfig")
+	require.NoError(t, os.WriteFile(config, []byte(fmt.Sprintf(kubeconfig, server.URL)), 0o600))
+
+	blocking := &blockingForwarder{sending: make(chan struct{})}
+	portTracker := tracker.NewVTunnelTracker(blocking, []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- kube.WatchForServices(ctx, config, net.IPv4zero, false, portTracker, nil, kube.DefaultWorkers)
+	}()
+
+	select {
+	case <-blocking.sending:
+	case err := <-done:
+		t.Fatalf("the watcher returned before the service was handled: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the port mapping of the service was not sent")
+	}
+
+	cancel()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("the watcher did not return once its context was cancelled")
+	}
+}
+
+const kubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: %s
+contexts:
+- name: test
+  context:
+    cluster: test
+current-context: test
+`
+
+// fakeKubernetesAPI serves a NodePort service, and the watches of the
+// services, which never receive any event.
+func fakeKubernetesAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	services := corev1.ServiceList{
+		TypeMeta: metav1.TypeMeta{Kind: "ServiceList", APIVersion: "v1"},
+		ListMeta: metav1.ListMeta{ResourceVersion: "1"},
+		Items: []corev1.Service{{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web", UID: "web-uid", ResourceVersion: "1"},
+			Spec: corev1.ServiceSpec{
+				Type:  corev1.ServiceTypeNodePort,
+				Ports: []corev1.ServicePort{{Protocol: corev1.ProtocolTCP, Port: 80, NodePort: 30080}},
+			},
+		}},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/services" {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		if r.URL.Query().Get("watch") == "true" {
+			w.Header().Set("Content-Type", "application/json")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(services)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// blockingForwarder blocks the sends until their context is done, it closes
+// sending once the first one started.
+type blockingForwarder struct {
+	sending chan struct{}
+	once    sync.Once
+}
+
+func (b *blockingForwarder) Send(ctx context.Context, _ types.PortMapping) error {
+	b.once.Do(func() { close(b.sending) })
+	<-ctx.Done()
+
+	return ctx.Err()
+}
+
+func (b *blockingForwarder) RemovePorts(ctx context.Context, _ []types.PortMapping) error {
+	return b.Send(ctx, types.PortMapping{})
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/go-connections/nat"
+)
+
+// The names of the fields that the log lines of all the packages share, so that
+// e.g. "port=8080 proto=tcp source=docker" finds the lines of a port whichever
+// package logged them; see the builders, e.g. Port.
+const (
+	FieldID            = "id"
+	FieldPort          = "port"
+	FieldProtocol      = "proto"
+	FieldSource        = "source"
+	FieldContainer     = "container"
+	FieldService       = "service"
+	FieldHostIP        = "hostIP"
+	FieldAddr          = "addr"
+	FieldCorrelationID = "correlationID"
+	FieldError         = "error"
+)
+
+// Fields merges the fields of the builders into the fields of a log line,
+// the later ones take precedence, e.g.
+//
+//	logger.Infow("opened the listener", logging.Fields(logging.Addr(addr), logging.Source(tracker.SourceIptables)))
+func Fields(fields ...log.Fields) log.Fields {
+	merged := make(log.Fields)
+	for _, field := range fields {
+		maps.Copy(merged, field)
+	}
+
+	return merged
+}
+
+// ID is the id field, the key that a port mapping is tracked with,
+// e.g. a container ID or the UID of a Kubernetes service.
+func ID(id string) log.Fields {
+	return log.Fields{FieldID: id}
+}
+
+// Port is the port field, the ports that are numbers are logged as numbers
+// whatever their type, e.g. the host port of a nat.PortBinding.
+func Port(port any) log.Fields {
+	switch port := port.(type) {
+	case string:
+		if number, err := strconv.Atoi(port); err == nil {
+			return log.Fields{FieldPort: number}
+		}
+	case nat.Port:
+		return log.Fields{FieldPort: port.Int()}
+	}
+
+	return log.Fields{FieldPort: port}
+}
+
+// Protocol is the protocol field, in lower case, e.g. tcp for the TCP of Kubernetes.
+func Protocol(protocol string) log.Fields {
+	return log.Fields{FieldProtocol: strings.ToLower(protocol)}
+}
+
+// PortProtocol is the port and the protocol fields of the port, e.g. 80/tcp.
+func PortProtocol(port nat.Port) log.Fields {
+	return Fields(Port(port), Protocol(port.Proto()))
+}
+
+// Source is the source field, the subsystem that the port mapping originates from.
+func Source(source string) log.Fields {
+	return log.Fields{FieldSource: source}
+}
+
+// Container is the container field, the ID of the container.
+func Container(id string) log.Fields {
+	return log.Fields{FieldContainer: id}
+}
+
+// Service is the service field, the namespace and the name of the Kubernetes service.
+func Service(namespace, name string) log.Fields {
+	return log.Fields{FieldService: namespace + "/" + name}
+}
+
+// HostIP is the hostIP field, the address of the host that a port is bound to.
+func HostIP(hostIP string) log.Fields {
+	return log.Fields{FieldHostIP: hostIP}
+}
+
+// Addr is the addr field, the address of a listener, e.g. 127.0.0.1:8080.
+func Addr(addr string) log.Fields {
+	return log.Fields{FieldAddr: addr}
+}
+
+// CorrelationID is the correlationID field, see tracker.NewCorrelationID.
+func CorrelationID(correlationID string) log.Fields {
+	return log.Fields{FieldCorrelationID: correlationID}
+}
+
+// Error is the error field.
+func Error(err error) log.Fields {
+	return log.Fields{FieldError: err}
+}
@@ -0,0 +1,84 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFields(t *testing.T) {
+	t.Parallel()
+
+	err := errors.New("broken")
+
+	assert.Equal(t, log.Fields{
+		"id":            "db",
+		"port":          5432,
+		"proto":         "tcp",
+		"source":        "docker",
+		"container":     "db",
+		"hostIP":        "127.0.0.1",
+		"addr":          "127.0.0.1:5432",
+		"correlationID": "0a1b2c3d",
+		"error":         err,
+	}, logging.Fields(
+		logging.ID("db"),
+		logging.PortProtocol("5432/tcp"),
+		logging.Source("docker"),
+		logging.Container("db"),
+		logging.HostIP("127.0.0.1"),
+		logging.Addr("127.0.0.1:5432"),
+		logging.CorrelationID("0a1b2c3d"),
+		logging.Error(err),
+	))
+
+	// The ports are numbers whatever their type, and the protocols are in lower case.
+	for _, port := range []any{8080, "8080", nat.Port("8080/tcp")} {
+		assert.Equal(t, log.Fields{"port": 8080}, logging.Port(port), port)
+	}
+
+	assert.Equal(t, log.Fields{"port": "http"}, logging.Port("http"))
+	assert.Equal(t, log.Fields{"proto": "tcp"}, logging.Protocol("TCP"))
+	assert.Equal(t, log.Fields{"service": "default/nginx"}, logging.Service("default", "nginx"))
+
+	// The later fields take precedence.
+	assert.Equal(t, log.Fields{"port": 8443}, logging.Fields(logging.Port(8080), logging.Port(8443)))
+}
+
+func TestFieldsOutput(t *testing.T) {
+	t.Parallel()
+
+	var text, jsonOutput bytes.Buffer
+
+	fields := logging.Fields(logging.Port("8080"), logging.Protocol("tcp"), logging.Source("docker"))
+	logging.New(&text, logging.FormatText).Infow("forwarding the port", fields)
+	logging.New(&jsonOutput, logging.FormatJSON).Infow("forwarding the port", fields)
+
+	assert.Contains(t, text.String(), "forwarding the port [port=8080][proto=tcp][source=docker]\n")
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(jsonOutput.Bytes(), &line))
+	assert.InDelta(t, 8080, line["port"], 0)
+	assert.Equal(t, "tcp", line["proto"])
+	assert.Equal(t, "docker", line["source"])
+}
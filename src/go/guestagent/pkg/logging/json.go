@@ -0,0 +1,150 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Masterminds/log-go"
+)
+
+const hex = "0123456789abcdef"
+
+// appendJSON appends the line in the JSON format, with the name of the
+// logger if it is a named one. The fields that are named like the keys
+// of the lines, e.g. msg, are prefixed with "fields.".
+func appendJSON(buf []byte, now time.Time, level int, name, msg string, fields log.Fields) []byte {
+	buf = append(buf, `{"time":"`...)
+	buf = now.AppendFormat(buf, jsonTimeLayout)
+	buf = append(buf, `","level":"`...)
+	buf = append(buf, levels[level].name...)
+
+	if name != "" {
+		buf = append(buf, `","logger":`...)
+		buf = appendString(buf, name)
+		buf = append(buf, `,"msg":`...)
+	} else {
+		buf = append(buf, `","msg":`...)
+	}
+
+	buf = appendString(buf, msg)
+
+	if len(fields) != 0 {
+		for _, key := range sortedKeys(fields) {
+			field := key
+			if field == "time" || field == "level" || field == "logger" || field == "msg" {
+				field = "fields." + field
+			}
+
+			buf = append(buf, ',')
+			buf = appendString(buf, field)
+			buf = append(buf, ':')
+			buf = appendValue(buf, fields[key])
+		}
+	}
+
+	return append(buf, '}', '\n')
+}
+
+// appendValue appends the value of a field, the common types are
+// appended without allocating, the others are marshalled.
+func appendValue(buf []byte, value any) []byte {
+	switch value := value.(type) {
+	case nil:
+		return append(buf, "null"...)
+	case string:
+		return appendString(buf, value)
+	case bool:
+		return strconv.AppendBool(buf, value)
+	case int:
+		return strconv.AppendInt(buf, int64(value), 10)
+	case int32:
+		return strconv.AppendInt(buf, int64(value), 10)
+	case int64:
+		return strconv.AppendInt(buf, value, 10)
+	case uint:
+		return strconv.AppendUint(buf, uint64(value), 10)
+	case uint16:
+		return strconv.AppendUint(buf, uint64(value), 10)
+	case uint32:
+		return strconv.AppendUint(buf, uint64(value), 10)
+	case uint64:
+		return strconv.AppendUint(buf, value, 10)
+	case float64:
+		// JSON has no NaN nor infinities.
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return appendString(buf, strconv.FormatFloat(value, 'g', -1, 64))
+		}
+
+		return strconv.AppendFloat(buf, value, 'g', -1, 64)
+	case time.Duration:
+		return appendString(buf, value.String())
+	case error:
+		return appendString(buf, value.Error())
+	case fmt.Stringer:
+		return appendString(buf, value.String())
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return appendString(buf, fmt.Sprint(value))
+	}
+
+	return append(buf, data...)
+}
+
+// appendString appends the string as a JSON string, the invalid UTF-8 is
+// replaced like encoding/json does.
+func appendString(buf []byte, s string) []byte {
+	buf = append(buf, '"')
+
+	for i := 0; i < len(s); {
+		c := s[i]
+
+		switch {
+		case c >= utf8.RuneSelf:
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				buf = append(buf, `\ufffd`...)
+			} else {
+				buf = append(buf, s[i:i+size]...)
+			}
+
+			i += size
+
+			continue
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c == '\n':
+			buf = append(buf, '\\', 'n')
+		case c == '\r':
+			buf = append(buf, '\\', 'r')
+		case c == '\t':
+			buf = append(buf, '\\', 't')
+		case c < ' ':
+			buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+
+		i++
+	}
+
+	return append(buf, '"')
+}
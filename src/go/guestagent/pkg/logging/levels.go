@@ -0,0 +1,94 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+)
+
+var ErrInvalidLevel = errors.New("invalid log level")
+
+// levelNames are the names that ParseLevel accepts, from the most verbose.
+var levelNames = []string{"trace", "debug", "info", "warn", "error"} //nolint:gochecknoglobals
+
+// ParseLevel parses the name of a level, one of error, warn, info, debug or
+// trace, and returns the level of log-go, e.g. log.DebugLevel.
+func ParseLevel(name string) (int, error) {
+	switch name {
+	case "trace":
+		return log.TraceLevel, nil
+	case "debug":
+		return log.DebugLevel, nil
+	case "info":
+		return log.InfoLevel, nil
+	case "warn":
+		return log.WarnLevel, nil
+	case "error":
+		return log.ErrorLevel, nil
+	default:
+		return 0, fmt.Errorf("%w %q, it must be one of %s", ErrInvalidLevel, name, strings.Join(levelNames, ", "))
+	}
+}
+
+// LevelName returns the name of the level that ParseLevel parses, e.g. "debug"
+// for log.DebugLevel; the levels above log.ErrorLevel are named error.
+func LevelName(level int) string {
+	switch {
+	case level <= log.TraceLevel:
+		return "trace"
+	case level == log.DebugLevel:
+		return "debug"
+	case level == log.InfoLevel:
+		return "info"
+	case level == log.WarnLevel:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// ParseOverrides parses the comma separated levels of the named loggers,
+// e.g. "kube=trace,docker=info", see Logger.SetOverrides; an empty
+// specification overrides none of them.
+func ParseOverrides(spec string) (map[string]int, error) {
+	overrides := make(map[string]int)
+
+	if strings.TrimSpace(spec) == "" {
+		return overrides, nil
+	}
+
+	for _, override := range strings.Split(spec, ",") {
+		name, levelName, ok := strings.Cut(strings.TrimSpace(override), "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%w override %q, it must be name=level", ErrInvalidLevel, override)
+		}
+
+		level, err := ParseLevel(levelName)
+		if err != nil {
+			return nil, fmt.Errorf("override %q: %w", override, err)
+		}
+
+		if _, ok := overrides[name]; ok {
+			return nil, fmt.Errorf("%w override %q, the level of %s is already overridden", ErrInvalidLevel, override, name)
+		}
+
+		overrides[name] = level
+	}
+
+	return overrides, nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging_test
+
+import (
+	"testing"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLevel(t *testing.T) {
+	t.Parallel()
+
+	for name, expected := range map[string]int{
+		"trace": log.TraceLevel,
+		"debug": log.DebugLevel,
+		"info":  log.InfoLevel,
+		"warn":  log.WarnLevel,
+		"error": log.ErrorLevel,
+	} {
+		level, err := logging.ParseLevel(name)
+		require.NoError(t, err, name)
+		assert.Equal(t, expected, level, name)
+		assert.Equal(t, name, logging.LevelName(level))
+	}
+
+	assert.Equal(t, "error", logging.LevelName(log.FatalLevel))
+
+	for _, name := range []string{"", "INFO", "fatal", "verbose"} {
+		_, err := logging.ParseLevel(name)
+		require.ErrorIs(t, err, logging.ErrInvalidLevel, name)
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	t.Parallel()
+
+	overrides, err := logging.ParseOverrides(" kube=trace, docker=info")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"kube": log.TraceLevel, "docker": log.InfoLevel}, overrides)
+
+	overrides, err = logging.ParseOverrides("")
+	require.NoError(t, err)
+	assert.Empty(t, overrides)
+
+	for _, spec := range []string{"kube", "=trace", "kube=loud", "kube=trace,,docker=info", "kube=trace,kube=info"} {
+		_, err := logging.ParseOverrides(spec)
+		require.ErrorIs(t, err, logging.ErrInvalidLevel, spec)
+	}
+}
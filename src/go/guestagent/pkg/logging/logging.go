@@ -0,0 +1,448 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package logging is the logger of the agent. It implements the log.Logger
+// interface of Masterminds/log-go that the packages log with, and writes
+// either the text of log.StdLogger or one JSON object per line, for the host
+// to collect the logs without parsing them.
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+// Format is the format of the logs.
+type Format string
+
+const (
+	// FormatText is the format of log.StdLogger, e.g.
+	//
+	//	2024/05/14 10:11:12 [INFO]    msg [port=8080][proto=tcp]
+	FormatText Format = "text"
+	// FormatJSON is one JSON object per line, e.g.
+	//
+	//	{"time":"2024-05-14T10:11:12.000Z","level":"info","msg":"msg","port":8080,"proto":"tcp"}
+	FormatJSON Format = "json"
+)
+
+// The time layouts of the formats.
+const (
+	textTimeLayout = "2006/01/02 15:04:05"
+	jsonTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+)
+
+var ErrInvalidFormat = errors.New("invalid log format")
+
+// ParseFormat parses the name of a format, either text or json.
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case FormatText, FormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("%w %q, it must be %s or %s", ErrInvalidFormat, name, FormatText, FormatJSON)
+	}
+}
+
+// levels are the names of the levels of log-go, e.g. log.InfoLevel, in the JSON
+// format, and their prefixes in the text format, which align the messages.
+var levels = []struct { //nolint:gochecknoglobals
+	name   string
+	prefix string
+}{
+	log.TraceLevel: {"trace", "[TRACE]   "},
+	log.DebugLevel: {"debug", "[DEBUG]   "},
+	log.InfoLevel:  {"info", "[INFO]    "},
+	log.WarnLevel:  {"warn", "[WARNING] "},
+	log.ErrorLevel: {"error", "[ERROR]   "},
+	log.PanicLevel: {"panic", "[PANIC]   "},
+	log.FatalLevel: {"fatal", "[FATAL]   "},
+}
+
+// Logger writes the logs of the given level and above in its format, it is safe
+// for concurrent use. The messages are formatted like fmt.Sprint and fmt.Sprintf,
+// and the fields of the methods that take them, e.g. Infow, are written sorted
+// by name.
+//
+// The named loggers of the subsystems, see Named, write to the same output;
+// their level is the one of the logger unless it is overridden, see SetOverrides.
+type Logger struct {
+	// name is the name of a named logger, and root the logger that created it.
+	name  string
+	root  *Logger
+	sink  *sink
+	level atomic.Int32
+	// The named loggers and their levels, only the logger that created them holds them.
+	mutex     sync.Mutex
+	rootLevel int
+	named     map[string]*Logger
+	overrides map[string]int
+}
+
+// sink is the output that a logger shares with its named loggers.
+type sink struct {
+	format Format
+	mutex  sync.Mutex
+	output io.Writer
+	// exit is called by the Fatal methods once they logged.
+	exit func(code int)
+	// recentErrors are the last lines of the error level and above, see RecentErrors.
+	recentErrors []string
+	next         int
+	// errors is the number of lines of the error level and above, see ErrorCount.
+	errors uint64
+	// hook is also passed every line that is written, see SetHook.
+	hook func(Record)
+}
+
+// Record is a line that is written, as the hook of SetHook is passed it.
+type Record struct {
+	Time  time.Time
+	Level int
+	// Logger is the name of the named logger that wrote the line, if any.
+	Logger  string
+	Message string
+	Fields  log.Fields
+}
+
+// maxRecentErrors is the number of lines that RecentErrors keeps.
+const maxRecentErrors = 100
+
+// bufferPool holds the buffers that the lines are formatted in, so that
+// logging does not allocate them every time.
+var bufferPool = sync.Pool{ //nolint:gochecknoglobals
+	New: func() any {
+		buf := make([]byte, 0, 256) //nolint:gomnd // most lines are shorter.
+
+		return &buf
+	},
+}
+
+// New creates a logger that writes the logs of log.InfoLevel and above to the
+// output in the given format.
+func New(output io.Writer, format Format) *Logger {
+	l := &Logger{
+		sink:      &sink{format: format, output: output, exit: os.Exit},
+		rootLevel: log.InfoLevel,
+		named:     make(map[string]*Logger),
+	}
+	l.level.Store(log.InfoLevel)
+
+	return l
+}
+
+// SetLevel sets the minimum level of the logs that are written, e.g. log.DebugLevel,
+// for the logger and for its named loggers whose level is not overridden.
+func (l *Logger) SetLevel(level int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.rootLevel = level
+	l.apply()
+}
+
+// Named returns the logger of the named subsystem, e.g. kube, which is created
+// on the first call; its logs have a "logger" field with the name in the JSON format.
+// The named loggers of a named logger are the ones of the logger that created it.
+func (l *Logger) Named(name string) *Logger {
+	if l.root != nil {
+		return l.root.Named(name)
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	named, ok := l.named[name]
+	if !ok {
+		named = &Logger{name: name, root: l, sink: l.sink}
+		l.named[name] = named
+		l.apply()
+	}
+
+	return named
+}
+
+var ErrUnknownLogger = errors.New("unknown logger")
+
+// SetOverrides sets the levels of the named loggers, e.g. {"kube": log.TraceLevel},
+// the others have the level of the logger; it fails without setting any of them
+// if a name is not the one of a named logger.
+func (l *Logger) SetOverrides(overrides map[string]int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for name := range overrides {
+		if _, ok := l.named[name]; !ok {
+			return fmt.Errorf("%w %q, it must be one of %v", ErrUnknownLogger, name, l.names())
+		}
+	}
+
+	l.overrides = overrides
+	l.apply()
+
+	return nil
+}
+
+// SetLevels sets the level of the logger and the overrides of the named loggers
+// at once, like SetLevel and SetOverrides do; it fails without setting any of
+// them if an override is not the one of a named logger.
+func (l *Logger) SetLevels(level int, overrides map[string]int) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for name := range overrides {
+		if _, ok := l.named[name]; !ok {
+			return fmt.Errorf("%w %q, it must be one of %v", ErrUnknownLogger, name, l.names())
+		}
+	}
+
+	l.rootLevel = level
+	l.overrides = overrides
+	l.apply()
+
+	return nil
+}
+
+// Levels returns the level of the logger, and the levels that override it for the named loggers.
+func (l *Logger) Levels() (int, map[string]int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.rootLevel, maps.Clone(l.overrides)
+}
+
+// names returns the names of the named loggers, sorted.
+func (l *Logger) names() []string {
+	names := make([]string, 0, len(l.named))
+	for name := range l.named {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	return names
+}
+
+// apply sets the levels of the logger and of the named loggers.
+func (l *Logger) apply() {
+	l.level.Store(int32(l.rootLevel)) //nolint:gosec // the levels are small.
+
+	for name, named := range l.named {
+		level, ok := l.overrides[name]
+		if !ok {
+			level = l.rootLevel
+		}
+
+		named.level.Store(int32(level)) //nolint:gosec // the levels are small.
+	}
+}
+
+// SetHook sets the function that every line that the logger and its named
+// loggers write is also passed to, e.g. to ship them to the host; nil unsets
+// it. It is called once the line is written, it must neither block nor log,
+// and it must copy the fields that it keeps.
+func (l *Logger) SetHook(hook func(Record)) {
+	l.sink.mutex.Lock()
+	defer l.sink.mutex.Unlock()
+
+	l.sink.hook = hook
+}
+
+// Enabled returns true if the logs of the level are written.
+func (l *Logger) Enabled(level int) bool {
+	return level >= int(l.level.Load())
+}
+
+// write formats the line and writes it to the output, the write error is
+// ignored since there is nowhere to report it.
+func (l *Logger) write(level int, msg string, fields log.Fields) {
+	bufp := bufferPool.Get().(*[]byte)
+	buf := (*bufp)[:0]
+
+	now := time.Now()
+	if l.sink.format == FormatJSON {
+		buf = appendJSON(buf, now, level, l.name, msg, fields)
+	} else {
+		buf = appendText(buf, now, level, msg, fields)
+	}
+
+	l.sink.mutex.Lock()
+	_, _ = l.sink.output.Write(buf)
+
+	if level >= log.ErrorLevel {
+		l.sink.keepError(strings.TrimSuffix(string(buf), "\n"))
+	}
+
+	hook := l.sink.hook
+	l.sink.mutex.Unlock()
+
+	*bufp = buf
+	bufferPool.Put(bufp)
+
+	if hook != nil {
+		hook(Record{Time: now, Level: level, Logger: l.name, Message: msg, Fields: fields})
+	}
+}
+
+// keepError keeps the line, it overwrites the oldest one once maxRecentErrors are kept.
+func (s *sink) keepError(line string) {
+	s.errors++
+
+	if len(s.recentErrors) < maxRecentErrors {
+		s.recentErrors = append(s.recentErrors, line)
+
+		return
+	}
+
+	s.recentErrors[s.next] = line
+	s.next = (s.next + 1) % maxRecentErrors
+}
+
+// ErrorCount returns the number of lines that the logger and its named
+// loggers wrote at the error level and above since it was created.
+func (l *Logger) ErrorCount() uint64 {
+	l.sink.mutex.Lock()
+	defer l.sink.mutex.Unlock()
+
+	return l.sink.errors
+}
+
+// RecentErrors returns the last lines that the logger and its named loggers
+// wrote at the error level and above, the oldest first; for the diagnostics.
+func (l *Logger) RecentErrors() []string {
+	l.sink.mutex.Lock()
+	defer l.sink.mutex.Unlock()
+
+	recentErrors := make([]string, 0, len(l.sink.recentErrors))
+	recentErrors = append(recentErrors, l.sink.recentErrors[l.sink.next:]...)
+
+	return append(recentErrors, l.sink.recentErrors[:l.sink.next]...)
+}
+
+func (l *Logger) print(level int, msg ...any) {
+	if l.Enabled(level) {
+		l.write(level, fmt.Sprint(msg...), nil)
+	}
+}
+
+func (l *Logger) printf(level int, template string, args ...any) {
+	if l.Enabled(level) {
+		l.write(level, fmt.Sprintf(template, args...), nil)
+	}
+}
+
+func (l *Logger) printw(level int, msg string, fields log.Fields) {
+	if l.Enabled(level) {
+		l.write(level, msg, fields)
+	}
+}
+
+// The methods of log.Logger, the ones of the levels that are not enabled do not log.
+
+func (l *Logger) Trace(msg ...any)                     { l.print(log.TraceLevel, msg...) }
+func (l *Logger) Tracef(template string, args ...any)  { l.printf(log.TraceLevel, template, args...) }
+func (l *Logger) Tracew(msg string, fields log.Fields) { l.printw(log.TraceLevel, msg, fields) }
+func (l *Logger) Debug(msg ...any)                     { l.print(log.DebugLevel, msg...) }
+func (l *Logger) Debugf(template string, args ...any)  { l.printf(log.DebugLevel, template, args...) }
+func (l *Logger) Debugw(msg string, fields log.Fields) { l.printw(log.DebugLevel, msg, fields) }
+func (l *Logger) Info(msg ...any)                      { l.print(log.InfoLevel, msg...) }
+func (l *Logger) Infof(template string, args ...any)   { l.printf(log.InfoLevel, template, args...) }
+func (l *Logger) Infow(msg string, fields log.Fields)  { l.printw(log.InfoLevel, msg, fields) }
+func (l *Logger) Warn(msg ...any)                      { l.print(log.WarnLevel, msg...) }
+func (l *Logger) Warnf(template string, args ...any)   { l.printf(log.WarnLevel, template, args...) }
+func (l *Logger) Warnw(msg string, fields log.Fields)  { l.printw(log.WarnLevel, msg, fields) }
+func (l *Logger) Error(msg ...any)                     { l.print(log.ErrorLevel, msg...) }
+func (l *Logger) Errorf(template string, args ...any)  { l.printf(log.ErrorLevel, template, args...) }
+func (l *Logger) Errorw(msg string, fields log.Fields) { l.printw(log.ErrorLevel, msg, fields) }
+
+// Panic logs the message, and panics with it.
+func (l *Logger) Panic(msg ...any) {
+	s := fmt.Sprint(msg...)
+	l.printw(log.PanicLevel, s, nil)
+	panic(s)
+}
+
+// Panicf logs the message, and panics with it.
+func (l *Logger) Panicf(template string, args ...any) {
+	s := fmt.Sprintf(template, args...)
+	l.printw(log.PanicLevel, s, nil)
+	panic(s)
+}
+
+// Panicw logs the message, and panics with it.
+func (l *Logger) Panicw(msg string, fields log.Fields) {
+	l.printw(log.PanicLevel, msg, fields)
+	panic(msg)
+}
+
+// Fatal logs the message, and exits with 1.
+func (l *Logger) Fatal(msg ...any) {
+	l.print(log.FatalLevel, msg...)
+	l.sink.exit(1)
+}
+
+// Fatalf logs the message, and exits with 1.
+func (l *Logger) Fatalf(template string, args ...any) {
+	l.printf(log.FatalLevel, template, args...)
+	l.sink.exit(1)
+}
+
+// Fatalw logs the message, and exits with 1.
+func (l *Logger) Fatalw(msg string, fields log.Fields) {
+	l.printw(log.FatalLevel, msg, fields)
+	l.sink.exit(1)
+}
+
+// sortedKeys returns the names of the fields in order.
+func sortedKeys(fields log.Fields) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	return keys
+}
+
+// appendText appends the line in the text format.
+func appendText(buf []byte, now time.Time, level int, msg string, fields log.Fields) []byte {
+	buf = now.AppendFormat(buf, textTimeLayout)
+	buf = append(buf, ' ')
+	buf = append(buf, levels[level].prefix...)
+	buf = append(buf, msg...)
+
+	if len(fields) != 0 {
+		buf = append(buf, ' ')
+
+		for _, key := range sortedKeys(fields) {
+			buf = fmt.Appendf(buf, "[%s=%v]", key, fields[key])
+		}
+	}
+
+	if len(buf) == 0 || buf[len(buf)-1] != '\n' {
+		buf = append(buf, '\n')
+	}
+
+	return buf
+}
@@ -0,0 +1,313 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// parseLines parses the lines of the JSON format.
+func parseLines(t *testing.T, output string) []map[string]any {
+	t.Helper()
+
+	var lines []map[string]any
+
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		var fields map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &fields), line)
+
+		lines = append(lines, fields)
+	}
+
+	return lines
+}
+
+func TestLoggerJSON(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatJSON)
+
+	logger.Debugf("not logged at the %s level", "info")
+	logger.Infof("forwarding %d ports", 2)
+	logger.Warnw("not forwarding the port", log.Fields{
+		"port":      uint16(8080),
+		"protocol":  "tcp",
+		"source":    "docker",
+		"container": "c\"0\n",
+		"error":     errors.New("not allowed"),
+		"delay":     1500 * time.Millisecond,
+		"ready":     true,
+		"ratio":     0.5,
+		"infinity":  math.Inf(1),
+		"msg":       "shadowed",
+		"addrs":     []string{"127.0.0.1"},
+		"missing":   nil,
+	})
+
+	lines := parseLines(t, output.String())
+	require.Len(t, lines, 2)
+
+	assert.Equal(t, "info", lines[0]["level"])
+	assert.Equal(t, "forwarding 2 ports", lines[0]["msg"])
+
+	timestamp, err := time.Parse(time.RFC3339Nano, lines[0]["time"].(string))
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), timestamp, time.Minute)
+
+	assert.Equal(t, map[string]any{
+		"time":       lines[1]["time"],
+		"level":      "warn",
+		"msg":        "not forwarding the port",
+		"port":       float64(8080),
+		"protocol":   "tcp",
+		"source":     "docker",
+		"container":  "c\"0\n",
+		"error":      "not allowed",
+		"delay":      "1.5s",
+		"ready":      true,
+		"ratio":      0.5,
+		"infinity":   "+Inf",
+		"fields.msg": "shadowed",
+		"addrs":      []any{"127.0.0.1"},
+		"missing":    nil,
+	}, lines[1])
+
+	// The fields are sorted by name.
+	assert.Regexp(t, `"addrs":.*"container":.*"delay":.*"error":.*"fields.msg":.*"port":.*"protocol":.*"source":`, output.String())
+}
+
+func TestLoggerJSONStrings(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatJSON)
+
+	for _, msg := range []string{"tab\tand\\backslash", "control \x01 \x1f", "invalid \xff utf-8", "ünïcödé ✓", "<html> & 'quotes'"} {
+		output.Reset()
+		logger.Info(msg)
+
+		lines := parseLines(t, output.String())
+		require.Len(t, lines, 1)
+		assert.Equal(t, strings.ToValidUTF8(msg, "�"), lines[0]["msg"])
+	}
+}
+
+func TestLoggerText(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatText)
+	logger.SetLevel(log.DebugLevel)
+
+	logger.Trace("not logged at the debug level")
+	logger.Debug("checking ", 2, 3, " ports")
+	logger.Errorf("failed: %v", errors.New("broken"))
+	logger.Infow("forwarding the port", log.Fields{"protocol": "tcp", "port": 8080})
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+
+	// The lines are formatted like the ones of log.StdLogger.
+	prefix := `^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} `
+	assert.Regexp(t, regexp.MustCompile(prefix+`\[DEBUG\]   checking 2 3 ports$`), lines[0])
+	assert.Regexp(t, regexp.MustCompile(prefix+`\[ERROR\]   failed: broken$`), lines[1])
+	assert.Regexp(t, regexp.MustCompile(prefix+`\[INFO\]    forwarding the port \[port=8080\]\[protocol=tcp\]$`), lines[2])
+}
+
+func TestLoggerLevel(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatJSON)
+	assert.True(t, logger.Enabled(log.InfoLevel))
+	assert.False(t, logger.Enabled(log.DebugLevel))
+
+	logger.SetLevel(log.ErrorLevel)
+	logger.Warn("not logged")
+	logger.Error("logged")
+
+	lines := parseLines(t, output.String())
+	require.Len(t, lines, 1)
+	assert.Equal(t, "error", lines[0]["level"])
+
+	logger.SetLevel(log.TraceLevel)
+	assert.True(t, logger.Enabled(log.TraceLevel))
+}
+
+func TestLoggerNamed(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatJSON)
+	kube, docker, tracker := logger.Named("kube"), logger.Named("docker"), logger.Named("tracker")
+	assert.Same(t, kube, logger.Named("kube"))
+	assert.Same(t, docker, kube.Named("docker"))
+
+	logger.SetLevel(log.DebugLevel)
+	require.NoError(t, logger.SetOverrides(map[string]int{"kube": log.TraceLevel, "docker": log.InfoLevel}))
+
+	// logged returns the loggers of the lines that were logged since the last call.
+	logged := func() []string {
+		var names []string
+		for _, line := range parseLines(t, output.String()) {
+			name, _ := line["logger"].(string)
+			names = append(names, name)
+		}
+
+		output.Reset()
+
+		return names
+	}
+
+	for _, l := range []*logging.Logger{logger, kube, docker, tracker} {
+		l.Trace("trace")
+	}
+
+	assert.Equal(t, []string{"kube"}, logged())
+
+	for _, l := range []*logging.Logger{logger, kube, docker, tracker} {
+		l.Debugw("debug", log.Fields{"logger": "shadowed"})
+	}
+
+	assert.Equal(t, []string{"", "kube", "tracker"}, logged())
+
+	// The level of the logger applies to the named loggers that are not overridden.
+	logger.SetLevel(log.WarnLevel)
+
+	for _, l := range []*logging.Logger{logger, kube, docker, tracker} {
+		l.Info("info")
+	}
+
+	assert.Equal(t, []string{"kube", "docker"}, logged())
+
+	// The overrides are replaced, and left as they are when a name is unknown.
+	err := logger.SetOverrides(map[string]int{"tracker": log.InfoLevel, "containerd": log.InfoLevel})
+	require.ErrorIs(t, err, logging.ErrUnknownLogger)
+	assert.ErrorContains(t, err, "[docker kube tracker]")
+	assert.True(t, kube.Enabled(log.TraceLevel))
+
+	require.NoError(t, logger.SetOverrides(map[string]int{"tracker": log.InfoLevel}))
+	assert.False(t, kube.Enabled(log.InfoLevel))
+	assert.True(t, tracker.Enabled(log.InfoLevel))
+
+	// SetLevels sets both at once, or neither.
+	require.ErrorIs(t, logger.SetLevels(log.TraceLevel, map[string]int{"containerd": log.InfoLevel}), logging.ErrUnknownLogger)
+	assert.False(t, logger.Enabled(log.InfoLevel))
+
+	require.NoError(t, logger.SetLevels(log.TraceLevel, map[string]int{"kube": log.ErrorLevel}))
+	assert.True(t, tracker.Enabled(log.TraceLevel))
+	assert.False(t, kube.Enabled(log.WarnLevel))
+
+	level, overrides := logger.Levels()
+	assert.Equal(t, log.TraceLevel, level)
+	assert.Equal(t, map[string]int{"kube": log.ErrorLevel}, overrides)
+}
+
+func TestLoggerPanic(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatJSON)
+
+	assert.PanicsWithValue(t, "broken", func() { logger.Panicw("broken", log.Fields{"port": 80}) })
+
+	lines := parseLines(t, output.String())
+	require.Len(t, lines, 1)
+	assert.Equal(t, "panic", lines[0]["level"])
+	assert.Equal(t, float64(80), lines[0]["port"])
+}
+
+func TestLoggerAllocations(t *testing.T) {
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatJSON)
+
+	fields := log.Fields{"port": 8080, "protocol": "tcp", "source": "kubernetes", "container": "default/nginx"}
+
+	// Only the names of the fields are allocated, to sort them.
+	allocs := testing.AllocsPerRun(100, func() {
+		output.Reset()
+		logger.Infow("forwarding the port", fields)
+	})
+	assert.LessOrEqual(t, allocs, 1.0)
+
+	// Nothing is allocated for the levels that are not enabled.
+	allocs = testing.AllocsPerRun(100, func() {
+		logger.Debugw("forwarding the port", fields)
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestLoggerRecentErrors(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatText)
+	assert.Empty(t, logger.RecentErrors())
+
+	logger.Warn("not kept")
+	logger.Named("docker").Errorf("docker error %d", 0)
+
+	recentErrors := logger.RecentErrors()
+	require.Len(t, recentErrors, 1)
+	assert.Regexp(t, `^\d{4}/\d{2}/\d{2} \d{2}:\d{2}:\d{2} \[ERROR\]   docker error 0$`, recentErrors[0])
+
+	// Only the last ones are kept, the oldest first.
+	for i := 1; i <= 150; i++ {
+		logger.Errorf("error %d", i)
+	}
+
+	recentErrors = logger.RecentErrors()
+	require.Len(t, recentErrors, 100)
+	assert.True(t, strings.HasSuffix(recentErrors[0], "error 51"), recentErrors[0])
+	assert.True(t, strings.HasSuffix(recentErrors[99], "error 150"), recentErrors[99])
+
+	// All of them are counted.
+	assert.Equal(t, uint64(151), logger.ErrorCount())
+}
+
+func TestParseFormat(t *testing.T) {
+	t.Parallel()
+
+	format, err := logging.ParseFormat("json")
+	require.NoError(t, err)
+	assert.Equal(t, logging.FormatJSON, format)
+
+	format, err = logging.ParseFormat("text")
+	require.NoError(t, err)
+	assert.Equal(t, logging.FormatText, format)
+
+	_, err = logging.ParseFormat("xml")
+	require.ErrorIs(t, err, logging.ErrInvalidFormat)
+}
@@ -0,0 +1,138 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+// DefaultRepeatInterval is the default interval of the summaries of the repeated logs, see Limiter.
+const DefaultRepeatInterval = 5 * time.Minute
+
+// repeatInterval is the interval of the limiters that are not given one.
+var repeatInterval atomic.Int64 //nolint:gochecknoglobals
+
+func init() {
+	repeatInterval.Store(int64(DefaultRepeatInterval))
+}
+
+// SetRepeatInterval sets the interval of the limiters that are not given one, see NewLimiter.
+func SetRepeatInterval(interval time.Duration) {
+	repeatInterval.Store(int64(interval))
+}
+
+// Limiter rate limits the logs that repeat, e.g. the errors of a peer that is
+// down. The first log of a template is written, the ones that follow within the
+// interval are only counted; the next one after the interval is written with how
+// many were not, e.g. "... (last message repeated 57 times in 5m0s)", and so on.
+// It is safe for concurrent use.
+type Limiter struct {
+	// interval is 0 for the interval of SetRepeatInterval.
+	interval time.Duration
+	mutex    sync.Mutex
+	repeats  map[string]*repeat
+}
+
+// repeat counts the logs of a template since the last one that was written.
+type repeat struct {
+	level   int
+	since   time.Time
+	skipped int
+}
+
+// NewLimiter creates a limiter with the given interval,
+// or the one of SetRepeatInterval if it is 0.
+func NewLimiter(interval time.Duration) *Limiter {
+	return &Limiter{interval: interval, repeats: make(map[string]*repeat)}
+}
+
+// Errorf logs the error with the logger, unless it repeats, see Limiter.
+func (l *Limiter) Errorf(logger log.Logger, template string, args ...any) {
+	if msg, ok := l.limit(log.ErrorLevel, template, args); ok {
+		logger.Error(msg)
+	}
+}
+
+// Warnf logs the warning with the logger, unless it repeats, see Limiter.
+func (l *Limiter) Warnf(logger log.Logger, template string, args ...any) {
+	if msg, ok := l.limit(log.WarnLevel, template, args); ok {
+		logger.Warn(msg)
+	}
+}
+
+// limit returns the message to write, and false if it is skipped.
+func (l *Limiter) limit(level int, template string, args []any) (string, bool) {
+	interval := l.interval
+	if interval == 0 {
+		interval = time.Duration(repeatInterval.Load())
+	}
+
+	now := time.Now()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	r, ok := l.repeats[template]
+	if !ok {
+		l.repeats[template] = &repeat{level: level, since: now}
+
+		return fmt.Sprintf(template, args...), true
+	}
+
+	elapsed := now.Sub(r.since)
+	if elapsed < interval {
+		r.skipped++
+
+		return "", false
+	}
+
+	msg := fmt.Sprintf(template, args...)
+	if r.skipped != 0 {
+		msg += fmt.Sprintf(" (last message repeated %d times in %s)", r.skipped, elapsed.Round(time.Second))
+	}
+
+	r.since, r.skipped = now, 0
+
+	return msg, true
+}
+
+// Reset forgets the logs once their cause cleared, the next ones are written
+// right away; it logs how many of them were not written since the last one, if any.
+func (l *Limiter) Reset(logger log.Logger) {
+	l.mutex.Lock()
+	repeats := l.repeats
+	l.repeats = make(map[string]*repeat)
+	l.mutex.Unlock()
+
+	now := time.Now()
+
+	for template, r := range repeats {
+		if r.skipped == 0 {
+			continue
+		}
+
+		msg := fmt.Sprintf("the cause of %q cleared, the last message was repeated %d times in %s",
+			template, r.skipped, now.Sub(r.since).Round(time.Second))
+		if r.level == log.ErrorLevel {
+			logger.Error(msg)
+		} else {
+			logger.Warn(msg)
+		}
+	}
+}
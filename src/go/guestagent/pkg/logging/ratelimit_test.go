@@ -0,0 +1,137 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// messages returns the messages of the text lines that were logged since the last call.
+func messages(output *bytes.Buffer) []string {
+	var msgs []string
+
+	for _, line := range strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n") {
+		if _, msg, ok := strings.Cut(line, "] "); ok {
+			msgs = append(msgs, strings.TrimSpace(msg))
+		}
+	}
+
+	output.Reset()
+
+	return msgs
+}
+
+func TestLimiter(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatText)
+	limiter := logging.NewLimiter(100 * time.Millisecond)
+
+	// The first one is logged, the repeated ones are not, even with other arguments.
+	for i := range 5 {
+		limiter.Errorf(logger, "failed to connect to %s: attempt %d", "docker", i)
+	}
+
+	limiter.Warnf(logger, "the peer is down")
+	assert.Equal(t, []string{"failed to connect to docker: attempt 0", "the peer is down"}, messages(&output))
+
+	// The next one after the interval is logged with the number of repeats.
+	time.Sleep(150 * time.Millisecond)
+	limiter.Errorf(logger, "failed to connect to %s: attempt %d", "docker", 5)
+	limiter.Warnf(logger, "the peer is down")
+
+	msgs := messages(&output)
+	require.Len(t, msgs, 2)
+	assert.Regexp(t, `^failed to connect to docker: attempt 5 \(last message repeated 4 times in 0s\)$`, msgs[0])
+	assert.Equal(t, "the peer is down", msgs[1])
+
+	limiter.Errorf(logger, "failed to connect to %s: attempt %d", "docker", 6)
+	limiter.Errorf(logger, "failed to connect to %s: attempt %d", "docker", 7)
+	assert.Empty(t, messages(&output))
+
+	// The summary is logged once the error cleared, and the next one is logged right away.
+	limiter.Reset(logger)
+	assert.Equal(t, []string{`the cause of "failed to connect to %s: attempt %d" cleared, the last message was repeated 2 times in 0s`},
+		messages(&output))
+
+	limiter.Errorf(logger, "failed to connect to %s: attempt %d", "docker", 8)
+	assert.Equal(t, []string{"failed to connect to docker: attempt 8"}, messages(&output))
+}
+
+func TestLimiterConcurrent(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatText)
+	limiter := logging.NewLimiter(time.Hour)
+
+	var wg sync.WaitGroup
+
+	for i := range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			// The limits are kept by template.
+			template := fmt.Sprintf("error of subsystem %d: %%v", i%2)
+			for range 100 {
+				limiter.Errorf(logger, template, "broken")
+			}
+		}()
+	}
+
+	wg.Wait()
+	assert.Len(t, messages(&output), 2)
+
+	limiter.Reset(logger)
+
+	msgs := messages(&output)
+	require.Len(t, msgs, 2)
+
+	for _, msg := range msgs {
+		assert.Contains(t, msg, "the last message was repeated 499 times")
+	}
+}
+
+func TestLimiterDefaultInterval(t *testing.T) {
+	t.Parallel()
+
+	var output bytes.Buffer
+
+	logger := logging.New(&output, logging.FormatText)
+	limiter := logging.NewLimiter(0)
+
+	// The default interval is long enough for the repeats to be skipped.
+	limiter.Errorf(logger, "broken")
+	limiter.Errorf(logger, "broken")
+	assert.Equal(t, []string{"broken"}, messages(&output))
+
+	// Only the templates that were skipped are summarized.
+	limiter.Errorf(logger, "once")
+	limiter.Reset(logger)
+	assert.Equal(t, []string{"once", `the cause of "broken" cleared, the last message was repeated 1 times in 0s`}, messages(&output))
+}
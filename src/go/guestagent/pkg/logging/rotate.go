@@ -0,0 +1,205 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const logFileMode = 0o600
+
+// RotatingFile writes the logs to a file, which is rotated once it would grow
+// beyond its maximum size: the file at path is renamed to path.1, the one at
+// path.1 to path.2, and so on, keeping at most the given number of rotated files.
+//
+// It is safe for concurrent use. Its writes do not fail: when writing to the
+// file fails, the logs are written to the fallback instead, and the file is
+// opened again on the next write.
+type RotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	fallback io.Writer
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	// failing is set once a write failed, so that the failure is only reported once.
+	failing bool
+	closed  bool
+}
+
+// OpenFile opens the log file at path for appending, which is rotated once it
+// would grow beyond maxSize bytes, keeping maxFiles rotated files; it is not
+// rotated when maxSize is 0. The logs are written to the fallback, usually
+// stderr, while the file can not be written.
+func OpenFile(path string, maxSize int64, maxFiles int, fallback io.Writer) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles, fallback: fallback}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, logFileMode)
+	if err != nil {
+		return fmt.Errorf("failed to open the log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+
+		return fmt.Errorf("failed to open the log file: %w", err)
+	}
+
+	r.file, r.size = file, info.Size()
+
+	return nil
+}
+
+// Write writes the line to the file, after rotating it if it would grow beyond
+// its maximum size; the lines are not split across the files.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return r.fallback.Write(p)
+	}
+
+	err := r.write(p)
+	if err == nil {
+		r.failing = false
+
+		return len(p), nil
+	}
+
+	if !r.failing {
+		fmt.Fprintf(r.fallback, "failed to write to the log file, logging here until it works again: %v\n", err)
+		r.failing = true
+	}
+
+	// The file is opened again on the next write.
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+
+	return r.fallback.Write(p)
+}
+
+func (r *RotatingFile) write(p []byte) error {
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+
+	return err
+}
+
+// rotate renames the rotated files, the oldest one is removed once
+// there are maxFiles of them, and opens a new file.
+func (r *RotatingFile) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	r.file = nil
+
+	if err := os.Remove(r.rotated(r.maxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to rotate the log file: %w", err)
+	}
+
+	for i := r.maxFiles - 1; i >= 0; i-- {
+		if err := os.Rename(r.rotated(i), r.rotated(i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate the log file: %w", err)
+		}
+	}
+
+	return r.open()
+}
+
+// rotated returns the path of the nth rotated file, the 0th one is the file itself.
+func (r *RotatingFile) rotated(n int) string {
+	if n == 0 {
+		return r.path
+	}
+
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+// Reopen closes the file and opens the one at its path again, which is
+// created if it does not exist; for the external log rotation tools that
+// rename the file, and then tell the agent to reopen it with SIGHUP.
+func (r *RotatingFile) Reopen() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return os.ErrClosed
+	}
+
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+
+	return r.open()
+}
+
+// Sync commits the lines that were written to the file to stable storage,
+// it does nothing while the file can not be written.
+func (r *RotatingFile) Sync() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	return r.file.Sync()
+}
+
+// Close closes the file, the logs are written to the fallback afterwards.
+func (r *RotatingFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.closed = true
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+
+	return err
+}
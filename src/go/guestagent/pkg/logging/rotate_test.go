@@ -0,0 +1,216 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logFiles returns the log files of the directory, by name.
+func logFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	files := make(map[string]string)
+
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		require.NoError(t, err)
+
+		files[entry.Name()] = string(data)
+	}
+
+	return files
+}
+
+func TestRotatingFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "guestagent.log")
+
+	var fallback bytes.Buffer
+
+	file, err := logging.OpenFile(path, 20, 2, &fallback)
+	require.NoError(t, err)
+
+	// Every file holds two lines of 10 bytes.
+	for i := range 7 {
+		n, err := file.Write([]byte(strings.Repeat(string(rune('a'+i)), 9) + "\n"))
+		require.NoError(t, err)
+		assert.Equal(t, 10, n)
+	}
+
+	require.NoError(t, file.Close())
+
+	// The oldest lines were removed along with the third rotated file.
+	assert.Equal(t, map[string]string{
+		"guestagent.log":   "ggggggggg\n",
+		"guestagent.log.1": "eeeeeeeee\nfffffffff\n",
+		"guestagent.log.2": "ccccccccc\nddddddddd\n",
+	}, logFiles(t, dir))
+	assert.Empty(t, fallback.String())
+
+	// The lines are written to the fallback once the file is closed.
+	_, err = file.Write([]byte("closed\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "closed\n", fallback.String())
+}
+
+func TestRotatingFileAppends(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "guestagent.log")
+	require.NoError(t, os.WriteFile(path, []byte("previous agent\n"), 0o600))
+
+	file, err := logging.OpenFile(path, 20, 1, &bytes.Buffer{})
+	require.NoError(t, err)
+
+	// The size of the existing file counts towards the maximum.
+	_, err = file.Write([]byte("new agent\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	assert.Equal(t, map[string]string{
+		"guestagent.log":   "new agent\n",
+		"guestagent.log.1": "previous agent\n",
+	}, logFiles(t, dir))
+}
+
+func TestRotatingFileUnlimited(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	file, err := logging.OpenFile(filepath.Join(dir, "guestagent.log"), 0, 3, &bytes.Buffer{})
+	require.NoError(t, err)
+
+	for range 100 {
+		_, err := file.Write([]byte("line\n"))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, file.Close())
+	assert.Len(t, logFiles(t, dir), 1)
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "guestagent.log")
+
+	file, err := logging.OpenFile(path, 0, 0, &bytes.Buffer{})
+	require.NoError(t, err)
+
+	_, err = file.Write([]byte("before\n"))
+	require.NoError(t, err)
+
+	// An external tool rotates the file, the writes go to the renamed file until it is reopened.
+	require.NoError(t, os.Rename(path, path+".old"))
+
+	_, err = file.Write([]byte("renamed\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.Reopen())
+
+	_, err = file.Write([]byte("after\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.Sync())
+	require.NoError(t, file.Close())
+	require.NoError(t, file.Sync())
+
+	assert.Equal(t, map[string]string{
+		"guestagent.log":     "after\n",
+		"guestagent.log.old": "before\nrenamed\n",
+	}, logFiles(t, dir))
+	require.ErrorIs(t, file.Reopen(), os.ErrClosed)
+}
+
+func TestRotatingFileWriteFailure(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "logs")
+	require.NoError(t, os.Mkdir(dir, 0o700))
+
+	path := filepath.Join(dir, "guestagent.log")
+
+	var fallback bytes.Buffer
+
+	file, err := logging.OpenFile(path, 10, 1, &fallback)
+	require.NoError(t, err)
+
+	_, err = file.Write([]byte("first\n"))
+	require.NoError(t, err)
+
+	// The directory is gone, the file can not be rotated nor opened again.
+	require.NoError(t, os.RemoveAll(dir))
+
+	for _, line := range []string{"second\n", "third\n"} {
+		n, err := file.Write([]byte(line))
+		require.NoError(t, err)
+		assert.Equal(t, len(line), n)
+	}
+
+	assert.Equal(t, 1, strings.Count(fallback.String(), "failed to write to the log file"))
+	assert.Contains(t, fallback.String(), "second\n")
+	assert.Contains(t, fallback.String(), "third\n")
+
+	// The file is written again once it can be.
+	require.NoError(t, os.Mkdir(dir, 0o700))
+
+	_, err = file.Write([]byte("fourth\n"))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "fourth\n", string(data))
+	assert.NotContains(t, fallback.String(), "fourth")
+}
+
+func TestLoggerRotatingFile(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	file, err := logging.OpenFile(filepath.Join(dir, "guestagent.log"), 1024, 3, &bytes.Buffer{})
+	require.NoError(t, err)
+
+	logger := logging.New(file, logging.FormatJSON)
+	for range 100 {
+		logger.Info(strings.Repeat("x", 100))
+	}
+
+	require.NoError(t, file.Close())
+
+	// The current file and the three rotated ones, whose lines are all complete.
+	files := logFiles(t, dir)
+	assert.Len(t, files, 4)
+
+	for name, data := range files {
+		assert.LessOrEqual(t, len(data), 1024, name)
+		assert.Len(t, parseLines(t, data), strings.Count(data, "\n"), name)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+const (
+	// DefaultShipInterval is the interval that the Shipper sends its batches at.
+	DefaultShipInterval = 5 * time.Second
+	// MaxShippedRecords is the number of lines that a batch holds, the lines
+	// beyond it are only counted until the next batch, so that a burst of
+	// logs does not flood the host.
+	MaxShippedRecords = 100
+)
+
+// Shipper batches the lines of a level and above, for the host; see Hook
+// and Run. Logging never waits for the batches to be sent, the lines that
+// do not fit in a batch are dropped.
+type Shipper struct {
+	level   int
+	mutex   sync.Mutex
+	records []types.LogRecord
+	dropped uint64
+}
+
+// NewShipper creates a shipper of the lines of the level and above, e.g. log.WarnLevel.
+func NewShipper(level int) *Shipper {
+	return &Shipper{level: level}
+}
+
+// Hook adds the line to the next batch, it is the hook of Logger.SetHook.
+func (s *Shipper) Hook(record Record) {
+	if record.Level < s.level {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.records) >= MaxShippedRecords {
+		s.dropped++
+
+		return
+	}
+
+	var fields map[string]string
+	if len(record.Fields) != 0 {
+		fields = make(map[string]string, len(record.Fields))
+		for key, value := range record.Fields {
+			fields[key] = fmt.Sprint(value)
+		}
+	}
+
+	s.records = append(s.records, types.LogRecord{
+		Time:    record.Time,
+		Level:   levels[min(max(record.Level, 0), len(levels)-1)].name,
+		Logger:  record.Logger,
+		Message: record.Message,
+		Fields:  fields,
+	})
+}
+
+// batch returns the lines since the last batch, and forgets them.
+func (s *Shipper) batch() types.LogBatch {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	batch := types.LogBatch{Records: s.records, Dropped: s.dropped}
+	s.records, s.dropped = nil, 0
+
+	return batch
+}
+
+// Run sends a batch of the lines with send at every interval, until the
+// context is cancelled; nothing is sent in the intervals without lines.
+// A batch that can not be sent is dropped without a trace but the local
+// logs, e.g. when the peer does not accept the logs, and each send is
+// given the interval to complete.
+func (s *Shipper) Run(ctx context.Context, interval time.Duration, send func(context.Context, types.LogBatch) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			batch := s.batch()
+			if len(batch.Records) == 0 && batch.Dropped == 0 {
+				continue
+			}
+
+			sendCtx, cancel := context.WithTimeout(ctx, interval)
+			_ = send(sendCtx, batch)
+
+			cancel()
+		}
+	}
+}
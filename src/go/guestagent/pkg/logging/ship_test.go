@@ -0,0 +1,202 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakePeer receives the batches of a shipper, it fails them while failing is set.
+type fakePeer struct {
+	batches chan types.LogBatch
+	failing chan bool
+}
+
+func newFakePeer() *fakePeer {
+	return &fakePeer{batches: make(chan types.LogBatch, 10), failing: make(chan bool, 1)}
+}
+
+var errNotSupported = errors.New("the peer does not accept the logs")
+
+func (p *fakePeer) send(_ context.Context, batch types.LogBatch) error {
+	select {
+	case failing := <-p.failing:
+		if failing {
+			return errNotSupported
+		}
+	default:
+	}
+
+	p.batches <- batch
+
+	return nil
+}
+
+func (p *fakePeer) receive(t *testing.T) types.LogBatch {
+	t.Helper()
+
+	select {
+	case batch := <-p.batches:
+		return batch
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no batch was shipped")
+
+		return types.LogBatch{}
+	}
+}
+
+func TestShipper(t *testing.T) {
+	t.Parallel()
+
+	logger := logging.New(io.Discard, logging.FormatJSON)
+	logger.SetLevel(log.DebugLevel)
+
+	shipper := logging.NewShipper(log.WarnLevel)
+	logger.SetHook(shipper.Hook)
+
+	logger.Infof("not shipped")
+	logger.Named("kube").Warnw("kubernetes: got error, rolling back", log.Fields{"error": errors.New("connection refused")})
+	logger.Errorf("forwarding %d ports failed", 2)
+
+	peer := newFakePeer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go shipper.Run(ctx, 10*time.Millisecond, peer.send)
+
+	batch := peer.receive(t)
+	require.Len(t, batch.Records, 2)
+	assert.Zero(t, batch.Dropped)
+
+	assert.Equal(t, "warn", batch.Records[0].Level)
+	assert.Equal(t, "kube", batch.Records[0].Logger)
+	assert.Equal(t, "kubernetes: got error, rolling back", batch.Records[0].Message)
+	assert.Equal(t, map[string]string{"error": "connection refused"}, batch.Records[0].Fields)
+	assert.WithinDuration(t, time.Now(), batch.Records[0].Time, time.Minute)
+
+	assert.Equal(t, "error", batch.Records[1].Level)
+	assert.Empty(t, batch.Records[1].Logger)
+	assert.Equal(t, "forwarding 2 ports failed", batch.Records[1].Message)
+	assert.Nil(t, batch.Records[1].Fields)
+
+	// A batch that the peer fails is dropped, the next one only has the newer lines.
+	peer.failing <- true
+	logger.Warn("dropped with its batch")
+
+	require.Eventually(t, func() bool {
+		return len(peer.failing) == 0
+	}, 5*time.Second, time.Millisecond)
+
+	logger.Warn("shipped")
+	assert.Equal(t, []string{"shipped"}, shippedMessages(peer.receive(t)))
+}
+
+func TestShipperDropped(t *testing.T) {
+	t.Parallel()
+
+	shipper := logging.NewShipper(log.InfoLevel)
+	for i := range logging.MaxShippedRecords + 50 {
+		shipper.Hook(logging.Record{Level: log.InfoLevel, Message: strconv.Itoa(i)})
+	}
+
+	peer := newFakePeer()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go shipper.Run(ctx, 10*time.Millisecond, peer.send)
+
+	// The oldest lines are shipped, the others are only counted.
+	batch := peer.receive(t)
+	require.Len(t, batch.Records, logging.MaxShippedRecords)
+	assert.Equal(t, "0", batch.Records[0].Message)
+	assert.Equal(t, uint64(50), batch.Dropped)
+
+	// Only the drops are shipped, there is nothing to ship afterwards.
+	shipper.Hook(logging.Record{Level: log.InfoLevel, Message: "next"})
+	assert.Equal(t, []string{"next"}, shippedMessages(peer.receive(t)))
+
+	select {
+	case batch := <-peer.batches:
+		assert.Fail(t, "an empty batch was shipped", "%+v", batch)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// TestShipperBackpressure checks that logging does not wait for the peer.
+func TestShipperBackpressure(t *testing.T) {
+	t.Parallel()
+
+	logger := logging.New(io.Discard, logging.FormatText)
+	shipper := logging.NewShipper(log.InfoLevel)
+	logger.SetHook(shipper.Hook)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The peer hangs, even past the timeout of the send.
+	var once sync.Once
+
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	go shipper.Run(ctx, time.Millisecond, func(context.Context, types.LogBatch) error {
+		once.Do(func() { close(blocked) })
+		<-release
+
+		return nil
+	})
+
+	logger.Info("first")
+	<-blocked
+
+	logged := make(chan struct{})
+
+	go func() {
+		defer close(logged)
+
+		for i := range 10 * logging.MaxShippedRecords {
+			logger.Infof("line %d", i)
+		}
+	}()
+
+	select {
+	case <-logged:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "logging waited for the peer")
+	}
+}
+
+func shippedMessages(batch types.LogBatch) []string {
+	messages := make([]string, 0, len(batch.Records))
+	for _, record := range batch.Records {
+		messages = append(messages, record.Message)
+	}
+
+	return messages
+}
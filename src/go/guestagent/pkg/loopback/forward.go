@@ -0,0 +1,215 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package loopback
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// relayedPort is a port of the loopback and the relays to it.
+type relayedPort struct {
+	target netip.AddrPort
+	addrs  []netip.Addr
+	relays []*relay
+}
+
+// Relayer relays the ports that are only listened on at the loopback of
+// the VM, see ForwardPorts.
+type Relayer struct {
+	procNet string
+	addrs   func() []netip.Addr
+	allows  func(hostPort string) bool
+	dryRun  bool
+	// ports are the relayed ports, and listening the addresses of their relays.
+	ports     map[uint16]*relayedPort
+	listening map[netip.AddrPort]bool
+}
+
+// NewRelayer returns the relayer of the listeners in the procNet directory,
+// see Listeners, whose relays listen on the addresses that addrs returns,
+// e.g. the ones that the host reaches the VM at; the ports that allows
+// returns false for are not relayed, e.g. the ones of -blockPorts.
+func NewRelayer(procNet string, addrs func() []netip.Addr, allows func(hostPort string) bool) *Relayer {
+	return &Relayer{
+		procNet:   procNet,
+		addrs:     addrs,
+		allows:    allows,
+		ports:     make(map[uint16]*relayedPort),
+		listening: make(map[netip.AddrPort]bool),
+	}
+}
+
+// EnableDryRun makes the relayer log the relays instead of opening them,
+// their port mappings are still added to the tracker.
+func (r *Relayer) EnableDryRun() {
+	r.dryRun = true
+}
+
+// ForwardPorts scans the listeners at every interval until the context is
+// cancelled. The ports that are only listened on at the loopback are relayed
+// from the addresses, and added to the tracker as the loopback of the host,
+// with the SourceLoopback source; they are removed once nothing listens on
+// them anymore. The relays are closed once it returns.
+func (r *Relayer) ForwardPorts(ctx context.Context, portTracker tracker.Tracker, interval time.Duration) error {
+	defer r.closeAll()
+
+	// The scans that fail are retried until they succeed, without flooding the logs.
+	limiter := logging.NewLimiter(0)
+
+	health := supervisor.HealthReporter(ctx)
+
+	for {
+		if err := r.scan(ctx, portTracker); err != nil {
+			limiter.Errorf(logger, "failed to scan the listeners of the loopback, retrying: %v", err)
+			health.Failed(err)
+		} else {
+			limiter.Reset(logger)
+			health.Succeeded()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+// scan relays the ports that are only listened on at the loopback, and
+// stops relaying the others.
+func (r *Relayer) scan(ctx context.Context, portTracker tracker.Tracker) error {
+	listeners, err := Listeners(r.procNet)
+	if err != nil {
+		return err
+	}
+
+	addrs := r.addrs()
+	wanted := make(map[uint16]netip.AddrPort)
+
+	// The relays listen on the ports too, but at the other addresses.
+	targets := LoopbackOnly(listeners, func(listener netip.AddrPort) bool { return r.listening[listener] })
+	for _, target := range targets {
+		if r.allows == nil || r.allows(strconv.Itoa(int(target.Port()))) {
+			wanted[target.Port()] = target
+		}
+	}
+
+	// The ports whose listener or addresses changed are relayed again.
+	for port, relayed := range r.ports {
+		if wanted[port] != relayed.target || !slices.Equal(relayed.addrs, addrs) {
+			r.remove(ctx, portTracker, port)
+		}
+	}
+
+	if len(addrs) == 0 {
+		if len(wanted) != 0 {
+			logger.Debugf("not relaying the ports of the loopback, there are no addresses to listen on yet")
+		}
+
+		return nil
+	}
+
+	for _, target := range targets {
+		if _, relayed := r.ports[target.Port()]; !relayed && wanted[target.Port()] == target {
+			r.add(ctx, portTracker, target, addrs)
+		}
+	}
+
+	return nil
+}
+
+// add relays the target from the addresses, and adds its port mapping.
+func (r *Relayer) add(ctx context.Context, portTracker tracker.Tracker, target netip.AddrPort, addrs []netip.Addr) {
+	relayed := &relayedPort{target: target, addrs: addrs}
+	fields := logging.Fields(logging.Addr(target.String()), logging.Port(int(target.Port())))
+
+	for _, addr := range addrs {
+		listenAddr := netip.AddrPortFrom(addr, target.Port())
+
+		if r.dryRun {
+			logger.Infow("dry run, not relaying "+listenAddr.String(), fields)
+
+			continue
+		}
+
+		relay, err := listenRelay(ctx, listenAddr, target)
+		if err != nil {
+			logger.Errorw("failed to relay from "+listenAddr.String(), logging.Fields(logging.Addr(target.String()), logging.Error(err)))
+
+			continue
+		}
+
+		relayed.relays = append(relayed.relays, relay)
+		r.listening[listenAddr] = true
+	}
+
+	r.ports[target.Port()] = relayed
+
+	port, err := nat.NewPort("tcp", strconv.Itoa(int(target.Port())))
+	if err != nil {
+		logger.Errorw("failed to add the relayed port", logging.Fields(logging.Addr(target.String()), logging.Error(err)))
+
+		return
+	}
+
+	portMap := nat.PortMap{port: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: port.Port()}}}
+	origin := tracker.Origin{Kind: tracker.OriginListener, Name: target.String()}
+
+	err = portTracker.Add(ctx, target.String(), portMap, tracker.WithSource(tracker.SourceLoopback), tracker.WithOrigin(origin))
+	if err != nil {
+		logger.Errorw("failed to add the relayed port", logging.Fields(logging.Addr(target.String()), logging.Error(err)))
+	} else {
+		logger.Infow("relaying the port of the loopback", fields)
+	}
+}
+
+// remove closes the relays of the port, and removes its port mapping.
+func (r *Relayer) remove(ctx context.Context, portTracker tracker.Tracker, port uint16) {
+	relayed := r.ports[port]
+	r.closeRelays(relayed)
+	delete(r.ports, port)
+
+	if err := portTracker.Remove(ctx, relayed.target.String()); err != nil {
+		logger.Warnw("failed to remove the relayed port", logging.Fields(logging.Addr(relayed.target.String()), logging.Error(err)))
+	} else {
+		logger.Infow("stopped relaying the port of the loopback", logging.Fields(logging.Addr(relayed.target.String())))
+	}
+}
+
+func (r *Relayer) closeRelays(relayed *relayedPort) {
+	for _, relay := range relayed.relays {
+		delete(r.listening, relay.addr)
+
+		if err := relay.Close(); err != nil {
+			logger.Debugf("failed to close the relay to %s: %v", relayed.target, err)
+		}
+	}
+}
+
+// closeAll closes all the relays, their port mappings are left to the shutdown.
+func (r *Relayer) closeAll() {
+	for port, relayed := range r.ports {
+		r.closeRelays(relayed)
+		delete(r.ports, port)
+	}
+}
@@ -0,0 +1,268 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package loopback_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/loopback"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const scanInterval = 10 * time.Millisecond
+
+// relayAddr stands for the address that the host reaches the VM at.
+var relayAddr = netip.MustParseAddr("127.0.0.2") //nolint:gochecknoglobals
+
+// echoServer listens on the loopback only, and echoes the lines that it reads.
+func echoServer(t *testing.T) netip.AddrPort {
+	t.Helper()
+
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					fmt.Fprintf(conn, "echo %s\n", scanner.Text())
+				}
+			}()
+		}
+	}()
+
+	return netip.MustParseAddrPort(listener.Addr().String())
+}
+
+// procAddr returns the address in the format of /proc/net/tcp.
+func procAddr(addr netip.AddrPort) string {
+	ip := addr.Addr().As4()
+
+	return fmt.Sprintf("%08X:%04X", binary.NativeEndian.Uint32(ip[:]), addr.Port())
+}
+
+// relayedLine sends a line through the relay of the port and returns the answer.
+func relayedLine(t *testing.T, port uint16, line string) (string, error) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", netip.AddrPortFrom(relayAddr, port).String(), time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = fmt.Fprintln(conn, line)
+	require.NoError(t, err)
+
+	answer, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+
+	return answer, nil
+}
+
+func TestRelayerForwardPorts(t *testing.T) {
+	t.Parallel()
+
+	server := echoServer(t)
+	procNet := t.TempDir()
+	writeProcNet(t, procNet, []string{
+		socketLine(0, procAddr(server), "0A"),
+		// The ports that are reachable already are not relayed.
+		socketLine(1, "00000000:0016", "0A"),
+	}, nil)
+
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), nil)
+	relayer := loopback.NewRelayer(procNet, func() []netip.Addr { return []netip.Addr{relayAddr} }, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+
+	go func() { done <- relayer.ForwardPorts(ctx, vtunnelTracker, scanInterval) }()
+
+	// The server is reached at the other address through the relay.
+	require.Eventually(t, func() bool { return len(vtunnelTracker.List()) == 1 }, 5*time.Second, scanInterval)
+
+	answer, err := relayedLine(t, server.Port(), "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "echo hello\n", answer)
+
+	entry := vtunnelTracker.List()[0]
+	assert.Equal(t, server.String(), entry.ID)
+	assert.Equal(t, tracker.SourceLoopback, entry.Source)
+	assert.Equal(t, &tracker.Origin{Kind: tracker.OriginListener, Name: server.String()}, entry.Origin)
+
+	port := fmt.Sprintf("%d/tcp", server.Port())
+	assert.Equal(t, "127.0.0.1", entry.Ports[nat.Port(port)][0].HostIP)
+
+	// The port is no longer relayed once the server stops listening on it.
+	writeProcNet(t, procNet, nil, nil)
+	require.Eventually(t, func() bool { return len(vtunnelTracker.List()) == 0 }, 5*time.Second, scanInterval)
+
+	_, err = relayedLine(t, server.Port(), "hello")
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+
+	cancel()
+	require.NoError(t, <-done)
+}
+
+func TestRelayerBlockedPorts(t *testing.T) {
+	t.Parallel()
+
+	server := echoServer(t)
+	procNet := t.TempDir()
+	writeProcNet(t, procNet, []string{socketLine(0, procAddr(server), "0A")}, nil)
+
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), nil)
+	relayer := loopback.NewRelayer(procNet, func() []netip.Addr { return []netip.Addr{relayAddr} },
+		func(string) bool { return false })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	require.NoError(t, relayer.ForwardPorts(ctx, vtunnelTracker, scanInterval))
+	assert.Empty(t, vtunnelTracker.List())
+
+	_, err := relayedLine(t, server.Port(), "hello")
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
+
+func TestRelayerClosesRelays(t *testing.T) {
+	t.Parallel()
+
+	server := echoServer(t)
+	procNet := t.TempDir()
+	writeProcNet(t, procNet, []string{socketLine(0, procAddr(server), "0A")}, nil)
+
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), nil)
+	relayer := loopback.NewRelayer(procNet, func() []netip.Addr { return []netip.Addr{relayAddr} }, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// The port mappings are left to the shutdown, but not the relays.
+	require.NoError(t, relayer.ForwardPorts(ctx, vtunnelTracker, scanInterval))
+	assert.Len(t, vtunnelTracker.List(), 1)
+
+	_, err := relayedLine(t, server.Port(), "hello")
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
+
+func TestRelay(t *testing.T) {
+	t.Parallel()
+
+	server := echoServer(t)
+	otherAddr := netip.MustParseAddr("127.0.0.3")
+
+	closer, err := loopback.Relay(context.Background(), []netip.Addr{relayAddr, otherAddr}, server)
+	require.NoError(t, err)
+
+	answer, err := relayedLine(t, server.Port(), "hello")
+	require.NoError(t, err)
+	assert.Equal(t, "echo hello\n", answer)
+
+	// Closing it closes the relays at all the addresses.
+	require.NoError(t, closer.Close())
+
+	_, err = relayedLine(t, server.Port(), "hello")
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+
+	// The relays that were opened are closed when one of them fails.
+	taken, err := net.Listen("tcp", netip.AddrPortFrom(otherAddr, server.Port()).String())
+	require.NoError(t, err)
+	t.Cleanup(func() { taken.Close() })
+
+	_, err = loopback.Relay(context.Background(), []netip.Addr{relayAddr, otherAddr}, server)
+	require.ErrorIs(t, err, syscall.EADDRINUSE)
+
+	_, err = relayedLine(t, server.Port(), "hello")
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+}
+
+// TestRelayDeadConnection checks that the relay of a connection whose client
+// is gone does not wait on the target, which is still connected, forever.
+// It is not parallel, since it counts the goroutines.
+func TestRelayDeadConnection(t *testing.T) {
+	// The target holds its connections open, and never answers.
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := make(chan net.Conn, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	target := netip.MustParseAddrPort(listener.Addr().String())
+	otherAddr := netip.MustParseAddr("127.0.0.4")
+
+	closer, err := loopback.Relay(context.Background(), []netip.Addr{otherAddr}, target)
+	require.NoError(t, err)
+	t.Cleanup(func() { closer.Close() })
+
+	conn, err := net.DialTimeout("tcp", netip.AddrPortFrom(otherAddr, target.Port()).String(), time.Second)
+	require.NoError(t, err)
+
+	var targetConn net.Conn
+	select {
+	case targetConn = <-accepted:
+		defer targetConn.Close()
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the relay did not connect to the target")
+	}
+
+	// Both the halves of the relayed connection are running.
+	relaying := runtime.NumGoroutine()
+
+	// The client resets its connection, like a peer that the keepalives found gone.
+	require.NoError(t, conn.(*net.TCPConn).SetLinger(0))
+	require.NoError(t, conn.Close())
+
+	// The target sees the end of the data, and writes nothing back; the relay
+	// stops both the halves rather than waiting on the target to.
+	_, err = io.ReadAll(targetConn)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		// The condition runs in a goroutine of its own.
+		return runtime.NumGoroutine()-1 <= relaying-2
+	}, 5*time.Second, 10*time.Millisecond, "the relay still waits on the target")
+}
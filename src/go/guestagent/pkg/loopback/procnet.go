@@ -0,0 +1,163 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package loopback relays the TCP ports that the workloads of the VM only
+// listen on at its loopback, e.g. the databases that scripts start or the
+// development servers, from the addresses that the host reaches the VM at,
+// so that they are forwarded like the published ports of the containers.
+package loopback
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// stateListen is the state of the listening sockets in /proc/net/tcp, TCP_LISTEN.
+	stateListen = "0A"
+	// The fields of the lines of /proc/net/tcp and /proc/net/tcp6 that are read.
+	socketFields = 4
+	localAddress = 1
+	socketState  = 3
+	// The lengths of the addresses, in bytes.
+	net4Len = 4
+	net6Len = 16
+)
+
+var ErrInvalidSocket = errors.New("invalid socket line")
+
+// Listeners returns the addresses of the TCP sockets that listen, read from
+// the tcp and tcp6 files in the procNet directory, usually netif.DefaultProcNet;
+// a missing file has none, e.g. the one of IPv6 when it is disabled.
+func Listeners(procNet string) ([]netip.AddrPort, error) {
+	var listeners []netip.AddrPort
+
+	for _, name := range []string{"tcp", "tcp6"} {
+		addrs, err := readListeners(filepath.Join(procNet, name))
+		if err != nil {
+			return nil, err
+		}
+
+		listeners = append(listeners, addrs...)
+	}
+
+	return listeners, nil
+}
+
+func readListeners(path string) ([]netip.AddrPort, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var listeners []netip.AddrPort
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// The header, and the sockets that do not listen, are skipped.
+		if len(fields) < socketFields || fields[socketState] != stateListen {
+			continue
+		}
+
+		addr, err := parseSocketAddr(fields[localAddress])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+
+		listeners = append(listeners, addr)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	return listeners, nil
+}
+
+// parseSocketAddr parses an address of /proc/net/tcp, e.g. 0100007F:1F90 for
+// 127.0.0.1:8080, whose address is made of 32 bits words in the host order.
+func parseSocketAddr(field string) (netip.AddrPort, error) {
+	hexAddr, hexPort, ok := strings.Cut(field, ":")
+	if !ok {
+		return netip.AddrPort{}, fmt.Errorf("%w: %q has no port", ErrInvalidSocket, field)
+	}
+
+	raw, err := hex.DecodeString(hexAddr)
+	if err != nil || (len(raw) != net4Len && len(raw) != net6Len) {
+		return netip.AddrPort{}, fmt.Errorf("%w: %q is not an address", ErrInvalidSocket, hexAddr)
+	}
+
+	for i := 0; i < len(raw); i += net4Len {
+		binary.BigEndian.PutUint32(raw[i:], binary.NativeEndian.Uint32(raw[i:]))
+	}
+
+	port, err := strconv.ParseUint(hexPort, 16, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: %q is not a port", ErrInvalidSocket, hexPort)
+	}
+
+	addr, _ := netip.AddrFromSlice(raw)
+
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port)), nil
+}
+
+// LoopbackOnly returns the addresses of the listeners of the ports that are
+// only listened on at the loopback, one per port in the order of the ports,
+// preferring IPv4; the listeners that skip returns true for are left out,
+// e.g. the relays themselves.
+func LoopbackOnly(listeners []netip.AddrPort, skip func(netip.AddrPort) bool) []netip.AddrPort {
+	loopback := make(map[uint16]netip.AddrPort)
+	reachable := make(map[uint16]bool)
+
+	for _, listener := range listeners {
+		if skip != nil && skip(listener) {
+			continue
+		}
+
+		port := listener.Port()
+		if !listener.Addr().IsLoopback() {
+			reachable[port] = true
+
+			continue
+		}
+
+		if current, ok := loopback[port]; !ok || (listener.Addr().Is4() && !current.Addr().Is4()) {
+			loopback[port] = listener
+		}
+	}
+
+	addrs := make([]netip.AddrPort, 0, len(loopback))
+
+	for port, addr := range loopback {
+		if !reachable[port] {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	slices.SortFunc(addrs, func(a, b netip.AddrPort) int { return int(a.Port()) - int(b.Port()) })
+
+	return addrs
+}
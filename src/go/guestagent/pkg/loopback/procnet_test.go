@@ -0,0 +1,136 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package loopback_test
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/loopback"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	tcpHeader = "  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode\n"
+	tcpSocket = "   %d: %s 00000000:0000 %s 00000000:00000000 00:00000000 00000000     0        0 %d 1 0000000000000000 100 0 0 10 0\n"
+)
+
+// writeProcNet writes the tcp and tcp6 files of a fake /proc/net, whose lines are the ones of the sockets.
+func writeProcNet(t *testing.T, dir string, tcp, tcp6 []string) {
+	t.Helper()
+
+	for name, lines := range map[string][]string{"tcp": tcp, "tcp6": tcp6} {
+		content := tcpHeader
+		for _, line := range lines {
+			content += line
+		}
+
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644))
+	}
+}
+
+func socketLine(sl int, addr, state string) string {
+	return fmt.Sprintf(tcpSocket, sl, addr, state, 1000+sl)
+}
+
+func TestListeners(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeProcNet(t, dir, []string{
+		socketLine(0, "0100007F:1538", "0A"),
+		socketLine(1, "00000000:0016", "0A"),
+		// The connections are not listeners.
+		socketLine(2, "0100007F:1538", "01"),
+	}, []string{
+		socketLine(0, "00000000000000000000000001000000:1F90", "0A"),
+		socketLine(1, "0000000000000000FFFF00000100007F:0BB8", "0A"),
+	})
+
+	listeners, err := loopback.Listeners(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:5432"),
+		netip.MustParseAddrPort("0.0.0.0:22"),
+		netip.MustParseAddrPort("[::1]:8080"),
+		// The IPv4-mapped addresses are the IPv4 ones.
+		netip.MustParseAddrPort("127.0.0.1:3000"),
+	}, listeners)
+}
+
+func TestListenersWithoutIPv6(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "tcp"), []byte(tcpHeader+socketLine(0, "0100007F:1538", "0A")), 0o644))
+
+	listeners, err := loopback.Listeners(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("127.0.0.1:5432")}, listeners)
+}
+
+func TestListenersInvalid(t *testing.T) {
+	t.Parallel()
+
+	for name, addr := range map[string]string{
+		"no port":      "0100007F",
+		"short":        "01007F:1538",
+		"not hex":      "0100007G:1538",
+		"invalid port": "0100007F:1538A",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			writeProcNet(t, dir, []string{socketLine(0, addr, "0A")}, nil)
+
+			_, err := loopback.Listeners(dir)
+			require.ErrorIs(t, err, loopback.ErrInvalidSocket)
+		})
+	}
+}
+
+func TestLoopbackOnly(t *testing.T) {
+	t.Parallel()
+
+	listeners := []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.1:5432"),
+		netip.MustParseAddrPort("[::1]:5432"),
+		netip.MustParseAddrPort("[::1]:8080"),
+		netip.MustParseAddrPort("127.0.0.53:53"),
+		// The ports that are listened on at the other addresses too are already reachable.
+		netip.MustParseAddrPort("127.0.0.1:22"),
+		netip.MustParseAddrPort("0.0.0.0:22"),
+		netip.MustParseAddrPort("127.0.0.1:3000"),
+		netip.MustParseAddrPort("172.20.1.2:3000"),
+		// Unless the others are skipped, e.g. the relays.
+		netip.MustParseAddrPort("127.0.0.1:9000"),
+		netip.MustParseAddrPort("172.20.1.2:9000"),
+	}
+
+	skip := func(listener netip.AddrPort) bool {
+		return listener == netip.MustParseAddrPort("172.20.1.2:9000")
+	}
+
+	assert.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("127.0.0.53:53"),
+		netip.MustParseAddrPort("127.0.0.1:5432"),
+		netip.MustParseAddrPort("[::1]:8080"),
+		netip.MustParseAddrPort("127.0.0.1:9000"),
+	}, loopback.LoopbackOnly(listeners, skip))
+}
@@ -0,0 +1,151 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package loopback
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+)
+
+// dialTimeout is how long connecting to the listener of the loopback may take.
+const dialTimeout = 5 * time.Second
+
+// relay accepts the connections at its address and relays them to the
+// listener of the loopback, until it is closed.
+type relay struct {
+	listener net.Listener
+	addr     netip.AddrPort
+	target   netip.AddrPort
+}
+
+// listenRelay opens the relay at the address to the target.
+func listenRelay(ctx context.Context, addr, target netip.AddrPort) (*relay, error) {
+	listener, err := (&net.ListenConfig{}).Listen(ctx, "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+
+	r := &relay{listener: listener, addr: addr, target: target}
+
+	go r.serve()
+
+	return r, nil
+}
+
+func (r *relay) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Errorw("failed to accept a connection to relay",
+					logging.Fields(logging.Error(err), logging.Addr(r.listener.Addr().String())))
+			}
+
+			return
+		}
+
+		go r.pipe(conn)
+	}
+}
+
+// pipe copies the data of the connection to a connection to the target,
+// both ways, until both of them are closed.
+func (r *relay) pipe(conn net.Conn) {
+	defer conn.Close()
+
+	target, err := net.DialTimeout("tcp", r.target.String(), dialTimeout)
+	if err != nil {
+		logger.Debugf("failed to connect to %s to relay a connection from %s: %v", r.target, conn.RemoteAddr(), err)
+
+		return
+	}
+	defer target.Close()
+
+	var copied sync.WaitGroup
+
+	copied.Add(1)
+
+	go func() {
+		defer copied.Done()
+		copyHalf(target, conn)
+	}()
+
+	copyHalf(conn, target)
+	copied.Wait()
+}
+
+// copyHalf copies the data from src to dst, and then closes the writes of dst
+// so that its peer sees the end of the data, like its own peer closed them.
+// Both are closed if the copy fails, e.g. once the keepalives found the peer
+// of src gone, since the other half would otherwise wait on dst forever.
+func copyHalf(dst, src net.Conn) {
+	if _, err := io.Copy(dst, src); err != nil {
+		_ = src.Close()
+		_ = dst.Close()
+
+		return
+	}
+
+	if tcpConn, ok := dst.(*net.TCPConn); ok {
+		_ = tcpConn.CloseWrite()
+	} else {
+		_ = dst.Close()
+	}
+}
+
+// Close stops accepting the connections; the ones that are relayed are
+// left to finish, like the ones of a listener that stopped listening.
+func (r *relay) Close() error {
+	return r.listener.Close()
+}
+
+// relays are the relays of a target from several addresses.
+type relays []*relay
+
+// Relay relays the connections to the port of the target at each of the
+// addresses, e.g. the ones that the host reaches the VM at, to the target,
+// e.g. a container at its bridge address; the relays that were opened are
+// closed if one of them fails. Closing it closes all of them.
+func Relay(ctx context.Context, addrs []netip.Addr, target netip.AddrPort) (io.Closer, error) {
+	opened := make(relays, 0, len(addrs))
+
+	for _, addr := range addrs {
+		relay, err := listenRelay(ctx, netip.AddrPortFrom(addr, target.Port()), target)
+		if err != nil {
+			_ = opened.Close()
+
+			return nil, err
+		}
+
+		opened = append(opened, relay)
+	}
+
+	return opened, nil
+}
+
+func (r relays) Close() error {
+	errs := make([]error, 0, len(r))
+	for _, relay := range r {
+		errs = append(errs, relay.Close())
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// VarsName is the name of the expvar map that holds the core counters and
+// gauges of the agent, see PublishVars.
+const VarsName = "rd_guestagent"
+
+// The names of the counters and gauges of the VarsName map, they are part of
+// the interface of /debug/vars like the names of the metrics, so they are
+// not to be renamed.
+const (
+	// VarTrackedPorts is the number of port bindings that the tracker holds.
+	VarTrackedPorts = "trackedPorts"
+	// VarListeners is the number of listeners that the agent holds.
+	VarListeners = "listeners"
+	// VarForwarderSends is the number of sends to the host, including the failed ones.
+	VarForwarderSends = "forwarderSends"
+	// VarForwarderFailures is the number of sends to the host that failed.
+	VarForwarderFailures = "forwarderFailures"
+	// VarSubsystemRestarts is the number of times that the subsystems were restarted.
+	VarSubsystemRestarts = "subsystemRestarts"
+	// VarEventQueueDepth is the number of the tracker's change events that are
+	// waiting to be handled by their subscribers, e.g. the audit log.
+	VarEventQueueDepth = "eventQueueDepth"
+	// VarTrackedEntries is the number of entries that the tracker holds,
+	// which stays flat for as long as the port mappings do.
+	VarTrackedEntries = "trackedEntries"
+	// VarGoroutines is the number of goroutines of the agent, which stays
+	// flat once it started unless they leak.
+	VarGoroutines = "goroutines"
+	// VarMapCompactions is the number of maps of the trackers that were
+	// recreated after most of their entries were deleted.
+	VarMapCompactions = "mapCompactions"
+)
+
+// PublishVars publishes the values in the VarsName map of expvar. They are
+// read whenever the variables are served, from the same counters that the
+// metrics are collected from, so they cost nothing in between. Publishing
+// them again replaces them.
+func PublishVars(vars map[string]func() int64) {
+	published, ok := expvar.Get(VarsName).(*expvar.Map)
+	if !ok {
+		published = expvar.NewMap(VarsName)
+	}
+
+	for name, value := range vars {
+		published.Set(name, expvar.Func(func() any {
+			return value()
+		}))
+	}
+}
+
+// VarsHandler serves the variables of expvar in JSON, e.g. at /debug/vars;
+// they include the memstats and the cmdline that expvar publishes itself.
+func VarsHandler() http.Handler {
+	return expvar.Handler()
+}
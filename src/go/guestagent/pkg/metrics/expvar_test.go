@@ -0,0 +1,63 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishVars(t *testing.T) {
+	t.Parallel()
+
+	var ports int64
+
+	metrics.PublishVars(map[string]func() int64{
+		metrics.VarTrackedPorts: func() int64 { return ports },
+	})
+
+	read := func() map[string]int64 {
+		recorder := httptest.NewRecorder()
+		metrics.VarsHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/debug/vars", http.NoBody))
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		var vars map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &vars))
+		require.Contains(t, vars, "memstats")
+
+		var published map[string]int64
+		require.NoError(t, json.Unmarshal(vars[metrics.VarsName], &published))
+
+		return published
+	}
+
+	assert.Equal(t, map[string]int64{metrics.VarTrackedPorts: 0}, read())
+
+	// The values are read when the variables are served.
+	ports = 3
+	assert.Equal(t, map[string]int64{metrics.VarTrackedPorts: 3}, read())
+
+	// Publishing them again replaces them, rather than panicking like expvar.Publish.
+	metrics.PublishVars(map[string]func() int64{
+		metrics.VarTrackedPorts:    func() int64 { return 1 },
+		metrics.VarEventQueueDepth: func() int64 { return 2 },
+	})
+	assert.Equal(t, map[string]int64{metrics.VarTrackedPorts: 1, metrics.VarEventQueueDepth: 2}, read())
+}
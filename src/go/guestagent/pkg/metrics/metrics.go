@@ -0,0 +1,211 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics exposes the metrics of the agent in the Prometheus text
+// format. The packages of the agent implement Collector for their metrics,
+// and the agent registers them, so that this package imports none of them.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/log-go"
+)
+
+// Namespace is the prefix of the names of the metrics of the agent.
+const Namespace = "rd_guestagent_"
+
+// contentType is the content type of the Prometheus text format.
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// The escapers of the help texts and of the label values.
+//
+//nolint:gochecknoglobals
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+// Type is the type of a metric family.
+type Type string
+
+const (
+	TypeCounter   Type = "counter"
+	TypeGauge     Type = "gauge"
+	TypeHistogram Type = "histogram"
+)
+
+// Label is a label of a sample.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a value of a counter or a gauge.
+type Sample struct {
+	Labels []Label
+	Value  float64
+}
+
+// Histogram is a value of a histogram.
+type Histogram struct {
+	Labels []Label
+	// UpperBounds are the upper bounds of the buckets, in increasing order.
+	UpperBounds []float64
+	// Counts are the number of observations within each bucket, they are
+	// not cumulative; the last count is of the observations above all the
+	// upper bounds.
+	Counts []uint64
+	Sum    float64
+}
+
+// Family is a metric, with all its values.
+type Family struct {
+	// Name is the name of the metric, it usually starts with the Namespace.
+	Name       string
+	Help       string
+	Type       Type
+	Samples    []Sample
+	Histograms []Histogram
+}
+
+// Collector returns the current values of some metrics.
+type Collector interface {
+	Collect() []Family
+}
+
+// CollectorFunc is a function that implements Collector.
+type CollectorFunc func() []Family
+
+// Collect calls the function.
+func (f CollectorFunc) Collect() []Family {
+	return f()
+}
+
+// Registry holds the collectors of the agent.
+type Registry struct {
+	collectors []Collector
+	mutex      sync.Mutex
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds the collectors to the registry.
+func (r *Registry) Register(collectors ...Collector) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.collectors = append(r.collectors, collectors...)
+}
+
+// Gather returns the metrics of all the collectors, sorted by name.
+func (r *Registry) Gather() []Family {
+	r.mutex.Lock()
+	collectors := r.collectors
+	r.mutex.Unlock()
+
+	var families []Family
+	for _, collector := range collectors {
+		families = append(families, collector.Collect()...)
+	}
+
+	sort.SliceStable(families, func(i, j int) bool {
+		return families[i].Name < families[j].Name
+	})
+
+	return families
+}
+
+// Write writes the metrics of all the collectors in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+
+	for _, family := range r.Gather() {
+		writeFamily(buffered, family)
+	}
+
+	return buffered.Flush()
+}
+
+// ServeHTTP serves the metrics in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+
+	if err := r.Write(w); err != nil {
+		log.Errorf("failed to write the metrics: %v", err)
+	}
+}
+
+func writeFamily(w io.Writer, family Family) {
+	fmt.Fprintf(w, "# HELP %s %s\n", family.Name, helpEscaper.Replace(family.Help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", family.Name, family.Type)
+
+	for _, sample := range family.Samples {
+		fmt.Fprintf(w, "%s%s %s\n", family.Name, formatLabels(sample.Labels), formatValue(sample.Value))
+	}
+
+	for _, histogram := range family.Histograms {
+		var count uint64
+
+		for i, upperBound := range histogram.UpperBounds {
+			count += histogram.Counts[i]
+			labels := slices.Concat(histogram.Labels, []Label{{"le", formatValue(upperBound)}})
+			fmt.Fprintf(w, "%s_bucket%s %d\n", family.Name, formatLabels(labels), count)
+		}
+
+		if len(histogram.Counts) > len(histogram.UpperBounds) {
+			count += histogram.Counts[len(histogram.UpperBounds)]
+		}
+
+		labels := slices.Concat(histogram.Labels, []Label{{"le", "+Inf"}})
+		fmt.Fprintf(w, "%s_bucket%s %d\n", family.Name, formatLabels(labels), count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", family.Name, formatLabels(histogram.Labels), formatValue(histogram.Sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", family.Name, formatLabels(histogram.Labels), count)
+	}
+}
+
+func formatLabels(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		pairs = append(pairs, label.Name+`="`+labelEscaper.Replace(label.Value)+`"`)
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(value, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics_test
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	registry.Register(metrics.CollectorFunc(func() []metrics.Family {
+		return []metrics.Family{
+			{
+				Name: "test_ports",
+				Help: "Ports by source.\nSecond \\ line.",
+				Type: metrics.TypeGauge,
+				Samples: []metrics.Sample{
+					{Labels: []metrics.Label{{Name: "source", Value: `do"ck\er`}}, Value: 2},
+					{Labels: []metrics.Label{{Name: "source", Value: "kubernetes"}}, Value: 0.5},
+				},
+			},
+		}
+	}), metrics.CollectorFunc(func() []metrics.Family {
+		return []metrics.Family{
+			{
+				Name:    "test_adds_total",
+				Help:    "Adds.",
+				Type:    metrics.TypeCounter,
+				Samples: []metrics.Sample{{Value: math.Inf(1)}},
+			},
+			{
+				Name: "test_latency_seconds",
+				Help: "Latency.",
+				Type: metrics.TypeHistogram,
+				Histograms: []metrics.Histogram{{
+					UpperBounds: []float64{0.1, 1},
+					Counts:      []uint64{1, 2, 3},
+					Sum:         7.5,
+				}},
+			},
+		}
+	}))
+
+	var output strings.Builder
+
+	require.NoError(t, registry.Write(&output))
+	assert.Equal(t, `# HELP test_adds_total Adds.
+# TYPE test_adds_total counter
+test_adds_total +Inf
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 3
+test_latency_seconds_bucket{le="+Inf"} 6
+test_latency_seconds_sum 7.5
+test_latency_seconds_count 6
+# HELP test_ports Ports by source.\nSecond \\ line.
+# TYPE test_ports gauge
+test_ports{source="do\"ck\\er"} 2
+test_ports{source="kubernetes"} 0.5
+`, output.String())
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	t.Parallel()
+
+	registry := metrics.NewRegistry()
+	registry.Register(metrics.CollectorFunc(func() []metrics.Family {
+		return []metrics.Family{{Name: "test_up", Help: "Up.", Type: metrics.TypeGauge, Samples: []metrics.Sample{{Value: 1}}}}
+	}))
+
+	recorder := httptest.NewRecorder()
+	registry.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Equal(t, "# HELP test_up Up.\n# TYPE test_up gauge\ntest_up 1\n", recorder.Body.String())
+}
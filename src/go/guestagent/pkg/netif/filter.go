@@ -0,0 +1,56 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netif
+
+import "slices"
+
+// DefaultExclude are the patterns of the interfaces that the VPNs and the
+// overlay networks add when they run in the VM, e.g. Tailscale, WireGuard,
+// ZeroTier and OpenVPN; the host can not reach the port mappings at them.
+var DefaultExclude = []string{"tailscale*", "wg*", "zt*", "tun*"} //nolint:gochecknoglobals
+
+// Filter leaves out the interfaces that match any of the Exclude patterns,
+// unless they match any of the Include ones, when they are picked by their
+// default route or by the fallbacks; the interfaces that are selected by
+// their names are never left out. The patterns are like the fallbacks of
+// NewSelector, e.g. wg* matches wg0.
+type Filter struct {
+	Include []string
+	Exclude []string
+}
+
+// Excluded returns true if the interface of the name is left out.
+func (f Filter) Excluded(name string) bool {
+	match := func(pattern string) bool { return matches(name, pattern) }
+
+	return slices.ContainsFunc(f.Exclude, match) && !slices.ContainsFunc(f.Include, match)
+}
+
+// apply returns the interfaces that are not left out, and the names of the
+// ones that are up and not loopback ones but are left out.
+func (f Filter) apply(interfaces []Interface) ([]Interface, []string) {
+	kept := make([]Interface, 0, len(interfaces))
+
+	var excluded []string
+
+	for _, inf := range interfaces {
+		if !f.Excluded(inf.Name) {
+			kept = append(kept, inf)
+		} else if candidate(inf) {
+			excluded = append(excluded, inf.Name)
+		}
+	}
+
+	return kept, excluded
+}
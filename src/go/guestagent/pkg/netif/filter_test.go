@@ -0,0 +1,137 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netif_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterExcluded(t *testing.T) {
+	t.Parallel()
+
+	filter := netif.Filter{Exclude: netif.DefaultExclude}
+	for _, name := range []string{"tailscale0", "wg0", "wg-office", "zt5u4y6ejv", "tun0"} {
+		assert.True(t, filter.Excluded(name), name)
+	}
+
+	// The NAT interface of WSL and the ones of Lima are kept.
+	for _, name := range []string{"eth0", "rd0", "lima0", "enp0s1", "docker0", "lo"} {
+		assert.False(t, filter.Excluded(name), name)
+	}
+
+	filter.Include = []string{"wg0"}
+	assert.False(t, filter.Excluded("wg0"))
+	assert.True(t, filter.Excluded("wg1"))
+
+	filter.Exclude = append(filter.Exclude, "docker0")
+	assert.True(t, filter.Excluded("docker0"))
+
+	assert.False(t, netif.Filter{}.Excluded("tailscale0"))
+}
+
+func TestSelectorFilter(t *testing.T) {
+	t.Parallel()
+
+	loopback := netif.Interface{Name: "lo", Flags: net.FlagUp | net.FlagLoopback, Addrs: []netif.Addr{mustParseCIDR(t, "127.0.0.1/8")}}
+	up := func(name, cidr string) netif.Interface {
+		return netif.Interface{Name: name, Flags: net.FlagUp, Addrs: []netif.Addr{mustParseCIDR(t, cidr)}}
+	}
+
+	tunnels := []netif.Interface{
+		up("tailscale0", "100.101.102.103/32"), up("wg0", "10.66.0.2/24"), up("zt5u4y6ejv", "10.147.17.5/24"),
+	}
+
+	tests := map[string]struct {
+		platform   string
+		names      []string
+		include    []string
+		interfaces []netif.Interface
+		routes     []string
+		selected   []string
+		err        string
+	}{
+		"without tunnels": {
+			platform:   platform.Generic,
+			interfaces: []netif.Interface{loopback, up("eth0", "172.20.1.2/20")},
+			routes:     []string{"eth0"},
+			selected:   []string{"eth0"},
+		},
+		"exit node": {
+			// The default route of the tunnel does not take over the NAT interface.
+			platform:   platform.Generic,
+			interfaces: append([]netif.Interface{loopback}, append(tunnels, up("eth0", "172.20.1.2/20"))...),
+			routes:     []string{"tailscale0", "wg0", "eth0"},
+			selected:   []string{"eth0"},
+		},
+		"only tunnels have a default route": {
+			platform:   platform.Generic,
+			interfaces: append([]netif.Interface{loopback, up("eth0", "172.20.1.2/20")}, tunnels...),
+			routes:     []string{"wg0"},
+			err:        "no network interface found with a default route, leaving out tailscale0 and wg0 and zt5u4y6ejv",
+		},
+		"lima fallback": {
+			platform:   platform.Lima,
+			interfaces: []netif.Interface{loopback, up("tun0", "10.8.0.2/24"), up("enp0s1", "192.168.64.3/24")},
+			routes:     []string{"tun0"},
+			selected:   []string{"enp0s1"},
+		},
+		"included": {
+			platform:   platform.Generic,
+			include:    []string{"wg*"},
+			interfaces: append([]netif.Interface{loopback}, append(tunnels, up("eth0", "172.20.1.2/20"))...),
+			routes:     []string{"wg0", "eth0"},
+			selected:   []string{"wg0"},
+		},
+		"named": {
+			// The interfaces that are asked for by their names are never left out.
+			platform:   platform.WSL,
+			names:      []string{"eth0", "tailscale0"},
+			interfaces: append([]netif.Interface{loopback, up("eth0", "172.20.1.2/20")}, tunnels...),
+			selected:   []string{"eth0", "tailscale0"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			lister := &fakeLister{interfaces: test.interfaces, routes: test.routes}
+			selector := netif.NewSelector(lister, test.names, platform.Interfaces(test.platform))
+			selector.SetFilter(netif.Filter{Include: test.include, Exclude: netif.DefaultExclude})
+
+			interfaces, err := selector.Select()
+			if test.err != "" {
+				require.ErrorIs(t, err, netif.ErrNoInterface)
+				require.EqualError(t, err, test.err)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			names := make([]string, 0, len(interfaces))
+			for _, inf := range interfaces {
+				names = append(names, inf.Name)
+			}
+
+			assert.Equal(t, test.selected, names)
+		})
+	}
+}
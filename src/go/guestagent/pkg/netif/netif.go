@@ -0,0 +1,357 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package netif finds the network interface of the VM whose addresses the
+// port mappings are reached at from the host, e.g. eth0 on WSL, or lima0 and
+// rd0 on Lima. The interfaces, their addresses and their default routes are
+// read with netlink, which also notifies their changes, see Netlink and
+// SubscribeAddressChanges.
+package netif
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultProcNet is where the routing tables of the system are usually read from.
+const DefaultProcNet = "/proc/net"
+
+const (
+	routeFlagUp     = 0x1
+	routeFlagReject = 0x200
+	// The fields of the lines of /proc/net/route and /proc/net/ipv6_route that are read.
+	ipv4Fields    = 8
+	ipv6Fields    = 10
+	ipv4Mask      = 7
+	ipv6Prefix    = 1
+	ipv6Flags     = 8
+	ipv6Interface = 9
+)
+
+var (
+	// ErrNoInterface is returned by Select when no interface matches.
+	ErrNoInterface = errors.New("no network interface found")
+	// ErrNoAddress is returned by Find when the interfaces have no address yet that the port mappings can use.
+	ErrNoAddress = errors.New("no usable address")
+)
+
+// Interface is a network interface and its addresses.
+type Interface struct {
+	Name  string
+	Flags net.Flags
+	Addrs []Addr
+}
+
+// Addr is an address of a network interface.
+type Addr struct {
+	*net.IPNet
+	// Flags are the IFA_F_* flags of the address, e.g. IFA_F_TEMPORARY.
+	Flags uint32
+}
+
+// Temporary returns true for the temporary addresses of the IPv6 privacy
+// extensions, which are replaced every few hours.
+func (a Addr) Temporary() bool {
+	return a.Flags&unix.IFA_F_TEMPORARY != 0
+}
+
+// ConnectAddrs returns the addresses of the interface for the port mappings,
+// but the link-local and the temporary ones.
+func (i Interface) ConnectAddrs() []types.ConnectAddrs {
+	connectAddrs := make([]types.ConnectAddrs, 0, len(i.Addrs))
+
+	for _, addr := range i.Addrs {
+		if addr.IP.IsLinkLocalUnicast() || addr.Temporary() {
+			continue
+		}
+
+		connectAddrs = append(connectAddrs, types.NewConnectAddrs(addr.IPNet, i.Name))
+	}
+
+	return connectAddrs
+}
+
+// ConnectAddrs returns the addresses of the interfaces for the port mappings, see Interface.ConnectAddrs.
+func ConnectAddrs(interfaces []Interface) []types.ConnectAddrs {
+	var connectAddrs []types.ConnectAddrs
+
+	for _, inf := range interfaces {
+		connectAddrs = append(connectAddrs, inf.ConnectAddrs()...)
+	}
+
+	return connectAddrs
+}
+
+// Lister lists the network interfaces, see System.
+type Lister interface {
+	// Interfaces returns the interfaces in the order of their index.
+	Interfaces() ([]Interface, error)
+	// DefaultRoutes returns the names of the interfaces that a default route goes through.
+	DefaultRoutes() ([]string, error)
+}
+
+// System lists the interfaces of the system with the standard library, which
+// does not tell the flags of their addresses, and reads their default routes
+// from the routing tables in the procNet directory, usually DefaultProcNet;
+// it is the fallback of Netlink.
+func System(procNet string) Lister {
+	return systemLister{procNet: procNet}
+}
+
+type systemLister struct {
+	procNet string
+}
+
+func (s systemLister) Interfaces() ([]Interface, error) {
+	infs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	interfaces := make([]Interface, 0, len(infs))
+
+	for _, inf := range infs {
+		addrs, err := inf.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the addresses of the network interface %s: %w", inf.Name, err)
+		}
+
+		interfaces = append(interfaces, Interface{Name: inf.Name, Flags: inf.Flags, Addrs: stdlibAddrs(addrs)})
+	}
+
+	return interfaces, nil
+}
+
+// stdlibAddrs returns the addresses of the standard library, without their
+// flags; the IPv4 ones are shortened to 4 bytes like the ones of netlink.
+func stdlibAddrs(addrs []net.Addr) []Addr {
+	var converted []Addr
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		if ip := ipNet.IP.To4(); ip != nil && len(ipNet.Mask) == net.IPv4len {
+			ipNet = &net.IPNet{IP: ip, Mask: ipNet.Mask}
+		}
+
+		converted = append(converted, Addr{IPNet: ipNet})
+	}
+
+	return converted
+}
+
+func (s systemLister) DefaultRoutes() ([]string, error) {
+	ipv4, err := readRoutes(filepath.Join(s.procNet, "route"), func(fields []string) (string, bool) {
+		// The header, and the routes that are not the default one, are skipped.
+		if len(fields) < ipv4Fields || fields[1] != "00000000" || fields[ipv4Mask] != "00000000" {
+			return "", false
+		}
+
+		return fields[0], usable(fields[3])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ipv6, err := readRoutes(filepath.Join(s.procNet, "ipv6_route"), func(fields []string) (string, bool) {
+		if len(fields) < ipv6Fields || strings.Trim(fields[0], "0") != "" || fields[ipv6Prefix] != "00" {
+			return "", false
+		}
+
+		return fields[ipv6Interface], usable(fields[ipv6Flags])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(ipv4, ipv6...), nil
+}
+
+// usable returns true if the hexadecimal route flags are of a route that is up and does not reject the packets.
+func usable(flags string) bool {
+	value, err := strconv.ParseUint(flags, 16, 32)
+
+	return err == nil && value&routeFlagUp != 0 && value&routeFlagReject == 0
+}
+
+// readRoutes returns the interfaces of the routes of the file that match, a
+// missing file has none, e.g. the one of IPv6 when it is disabled.
+func readRoutes(path string, match func(fields []string) (string, bool)) ([]string, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var names []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if name, ok := match(strings.Fields(scanner.Text())); ok {
+			names = append(names, name)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	return names, nil
+}
+
+// Select returns the interfaces of the names that exist, in the order of
+// the names, or when there are none, the first interface that is up, is not
+// a loopback one, and has a default route.
+func Select(lister Lister, names []string) ([]Interface, error) {
+	selected, _, err := selectInterfaces(lister, names, nil, Filter{})
+
+	return selected, err
+}
+
+// selectInterfaces selects the interfaces like Select, and when none of them
+// has a default route, the first one that is up and matches the first of the
+// fallbacks that any interface matches; the filter leaves out interfaces of
+// both, whose names are also returned.
+func selectInterfaces(lister Lister, names, fallbacks []string, filter Filter) ([]Interface, []string, error) {
+	interfaces, err := lister.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(names) != 0 {
+		var selected []Interface
+
+		for _, name := range names {
+			for _, inf := range interfaces {
+				if inf.Name == name {
+					selected = append(selected, inf)
+				}
+			}
+		}
+
+		if len(selected) == 0 {
+			return nil, nil, fmt.Errorf("%w named %s", ErrNoInterface, strings.Join(names, " or "))
+		}
+
+		return selected, nil, nil
+	}
+
+	routes, err := lister.DefaultRoutes()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	interfaces, excluded := filter.apply(interfaces)
+
+	for _, inf := range interfaces {
+		if !candidate(inf) {
+			continue
+		}
+
+		for _, route := range routes {
+			if route == inf.Name {
+				return []Interface{inf}, excluded, nil
+			}
+		}
+	}
+
+	var leftOut string
+	if len(excluded) != 0 {
+		leftOut = ", leaving out " + strings.Join(excluded, " and ")
+	}
+
+	if len(fallbacks) == 0 {
+		return nil, excluded, fmt.Errorf("%w with a default route%s", ErrNoInterface, leftOut)
+	}
+
+	// The routes may not be set up yet, or go through another interface, e.g. of a VPN in the VM.
+	for _, fallback := range fallbacks {
+		for _, inf := range interfaces {
+			if candidate(inf) && matches(inf.Name, fallback) {
+				log.Debugf("no network interface has a default route, falling back to %s", inf.Name)
+
+				return []Interface{inf}, excluded, nil
+			}
+		}
+	}
+
+	return nil, excluded, fmt.Errorf("%w with a default route or named %s%s",
+		ErrNoInterface, strings.Join(fallbacks, " or "), leftOut)
+}
+
+// candidate returns true if the interface is up and is not a loopback one.
+func candidate(inf Interface) bool {
+	return inf.Flags&net.FlagUp != 0 && inf.Flags&net.FlagLoopback == 0
+}
+
+// matches returns true if the name is the one of the pattern, or starts
+// with it when it ends with *, e.g. ens* matches ens160.
+func matches(name, pattern string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(name, prefix)
+	}
+
+	return name == pattern
+}
+
+// Find selects the interfaces again with the selector, and waits for them
+// to have an address that the port mappings can use. It tries again every
+// interval until the timeout when there are none yet, e.g. early during the
+// boot while the network is set up.
+func Find(ctx context.Context, selector *Selector, timeout, interval time.Duration) ([]Interface, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		interfaces, err := selector.Refresh()
+		if err == nil && len(ConnectAddrs(interfaces)) == 0 {
+			err = fmt.Errorf("%w on the network interface %s yet", ErrNoAddress, interfaces[0].Name)
+		}
+
+		if err == nil {
+			for _, inf := range interfaces {
+				log.Infof("using the network interface %s with the addresses %v", inf.Name, inf.Addrs)
+			}
+
+			return interfaces, nil
+		}
+
+		log.Debugf("waiting for the network interface, looking again in %s: %v", interval, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w: %w", err, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
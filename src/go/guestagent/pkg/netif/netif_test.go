@@ -0,0 +1,339 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netif_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// fakeLister lists the interfaces once it was called more than delay times,
+// and their addresses once it was called more than addrsDelay times.
+type fakeLister struct {
+	interfaces []netif.Interface
+	routes     []string
+	delay      int32
+	addrsDelay int32
+	calls      atomic.Int32
+}
+
+func (f *fakeLister) Interfaces() ([]netif.Interface, error) {
+	calls := f.calls.Add(1)
+	if calls <= f.delay {
+		return nil, nil
+	}
+
+	if calls <= f.addrsDelay {
+		interfaces := make([]netif.Interface, 0, len(f.interfaces))
+		for _, inf := range f.interfaces {
+			interfaces = append(interfaces, netif.Interface{Name: inf.Name, Flags: inf.Flags})
+		}
+
+		return interfaces, nil
+	}
+
+	return f.interfaces, nil
+}
+
+func (f *fakeLister) DefaultRoutes() ([]string, error) {
+	return f.routes, nil
+}
+
+func mustParseCIDR(t *testing.T, cidr string) netif.Addr {
+	t.Helper()
+
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+
+	ipNet.IP = ip
+
+	return netif.Addr{IPNet: ipNet}
+}
+
+func newFakeLister(t *testing.T) *fakeLister {
+	t.Helper()
+
+	return &fakeLister{
+		interfaces: []netif.Interface{
+			{Name: "lo", Flags: net.FlagUp | net.FlagLoopback, Addrs: []netif.Addr{mustParseCIDR(t, "127.0.0.1/8")}},
+			{Name: "docker0", Flags: net.FlagUp, Addrs: []netif.Addr{mustParseCIDR(t, "172.17.0.1/16")}},
+			{Name: "eth0", Flags: 0, Addrs: []netif.Addr{mustParseCIDR(t, "10.0.0.2/24")}},
+			{Name: "lima0", Flags: net.FlagUp, Addrs: []netif.Addr{
+				mustParseCIDR(t, "192.168.5.15/24"),
+				mustParseCIDR(t, "169.254.10.1/16"),
+				mustParseCIDR(t, "fe80::5055:55ff:fe7e:8b5a/64"),
+				mustParseCIDR(t, "fd00:5::5055:55ff:fe7e:8b5a/64"),
+				{IPNet: mustParseCIDR(t, "fd00:5::1c2d:3e4f:5a6b:7c8d/64").IPNet, Flags: unix.IFA_F_TEMPORARY},
+			}},
+		},
+		// The loopback interface and the interfaces that are down are not picked even with a default route.
+		routes: []string{"lo", "eth0", "lima0"},
+	}
+}
+
+func TestSelect(t *testing.T) {
+	t.Parallel()
+
+	lister := newFakeLister(t)
+
+	interfaces, err := netif.Select(lister, nil)
+	require.NoError(t, err)
+	require.Len(t, interfaces, 1)
+	assert.Equal(t, "lima0", interfaces[0].Name)
+
+	// The link-local and the temporary addresses are not used.
+	assert.Equal(t, []types.ConnectAddrs{
+		types.NewConnectAddrs(mustParseCIDR(t, "192.168.5.15/24").IPNet, "lima0"),
+		types.NewConnectAddrs(mustParseCIDR(t, "fd00:5::5055:55ff:fe7e:8b5a/64").IPNet, "lima0"),
+	}, netif.ConnectAddrs(interfaces))
+
+	// The names that do not exist are skipped, the others are in the order of the names.
+	interfaces, err = netif.Select(lister, []string{"rd0", "lima0", "docker0"})
+	require.NoError(t, err)
+	require.Len(t, interfaces, 2)
+	assert.Equal(t, "lima0", interfaces[0].Name)
+	assert.Equal(t, "docker0", interfaces[1].Name)
+	assert.Len(t, netif.ConnectAddrs(interfaces), 3)
+
+	_, err = netif.Select(lister, []string{"rd0", "wlan0"})
+	require.ErrorIs(t, err, netif.ErrNoInterface)
+	require.EqualError(t, err, "no network interface found named rd0 or wlan0")
+
+	lister.routes = []string{"lo"}
+	_, err = netif.Select(lister, nil)
+	require.EqualError(t, err, "no network interface found with a default route")
+}
+
+func TestFind(t *testing.T) {
+	t.Parallel()
+
+	lister := newFakeLister(t)
+	lister.delay = 3
+
+	interfaces, err := netif.Find(context.Background(), netif.NewSelector(lister, nil, nil), time.Minute, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "lima0", interfaces[0].Name)
+	assert.Equal(t, int32(4), lister.calls.Load())
+}
+
+func TestFindWaitsForAddresses(t *testing.T) {
+	t.Parallel()
+
+	lister := newFakeLister(t)
+	lister.delay = 1
+	lister.addrsDelay = 3
+
+	interfaces, err := netif.Find(context.Background(), netif.NewSelector(lister, []string{"lima0"}, nil), time.Minute, time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "lima0", interfaces[0].Name)
+	assert.NotEmpty(t, netif.ConnectAddrs(interfaces))
+	assert.Equal(t, int32(4), lister.calls.Load())
+
+	// The interfaces that only have link-local addresses are not ready either.
+	lister = newFakeLister(t)
+	lister.interfaces[3].Addrs = lister.interfaces[3].Addrs[1:3]
+
+	_, err = netif.Find(context.Background(), netif.NewSelector(lister, nil, nil), 20*time.Millisecond, time.Millisecond)
+	require.ErrorIs(t, err, netif.ErrNoAddress)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.EqualError(t, err, "no usable address on the network interface lima0 yet: context deadline exceeded")
+}
+
+func TestFindCancelled(t *testing.T) {
+	t.Parallel()
+
+	lister := newFakeLister(t)
+	lister.delay = 1 << 30
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	_, err := netif.Find(ctx, netif.NewSelector(lister, nil, nil), time.Hour, time.Millisecond)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestFindTimeout(t *testing.T) {
+	t.Parallel()
+
+	lister := newFakeLister(t)
+	lister.delay = 1 << 30
+
+	_, err := netif.Find(context.Background(), netif.NewSelector(lister, nil, nil), 20*time.Millisecond, time.Millisecond)
+	require.ErrorIs(t, err, netif.ErrNoInterface)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Greater(t, lister.calls.Load(), int32(1))
+}
+
+func TestSystemDefaultRoutes(t *testing.T) {
+	t.Parallel()
+
+	procNet := t.TempDir()
+
+	// The routing tables as they were captured on a WSL distribution, with an
+	// extra default route that is down, and the one of lo that rejects.
+	require.NoError(t, os.WriteFile(filepath.Join(procNet, "route"), []byte(
+		"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"+
+			"eth0\t00000000\t0170A8C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n"+
+			"eth0\t0070A8C0\t00000000\t0001\t0\t0\t0\t00F0FFFF\t0\t0\t0\n"+
+			"eth1\t00000000\t0100000A\t0002\t0\t0\t0\t00000000\t0\t0\t0\n",
+	), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(procNet, "ipv6_route"), []byte(
+		"fe800000000000000000000000000000 40 00000000000000000000000000000000 00 "+
+			"00000000000000000000000000000000 00000100 00000001 00000000 00000001     eth0\n"+
+			"00000000000000000000000000000000 00 00000000000000000000000000000000 00 "+
+			"fd000000000000000000000000000001 00000400 00000001 00000000 00000003     eth2\n"+
+			"00000000000000000000000000000000 00 00000000000000000000000000000000 00 "+
+			"00000000000000000000000000000000 ffffffff 00000001 00000000 00200200       lo\n",
+	), 0o600))
+
+	routes, err := netif.System(procNet).DefaultRoutes()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eth0", "eth2"}, routes)
+
+	// Without IPv6, there are only the IPv4 routes.
+	require.NoError(t, os.Remove(filepath.Join(procNet, "ipv6_route")))
+
+	routes, err = netif.System(procNet).DefaultRoutes()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"eth0"}, routes)
+}
+
+func TestSystemInterfaces(t *testing.T) {
+	t.Parallel()
+
+	interfaces, err := netif.System(netif.DefaultProcNet).Interfaces()
+	require.NoError(t, err)
+
+	// The addresses are listed with the standard library, the loopback interface is always there.
+	for _, inf := range interfaces {
+		if inf.Flags&net.FlagLoopback != 0 && inf.Flags&net.FlagUp != 0 {
+			require.NotEmpty(t, inf.Addrs, inf.Name)
+			assert.Equal(t, "127.0.0.1/8", inf.Addrs[0].String())
+
+			return
+		}
+	}
+
+	t.Skip("there is no loopback interface that is up")
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan struct{}, 1)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		netif.Watch(ctx, time.Millisecond, changes)
+	}()
+
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the watch did not stop once the context was cancelled")
+	}
+}
+
+func TestSubscribeAddressChanges(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := netif.SubscribeAddressChanges(ctx, time.Millisecond)
+
+	cancel()
+
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			require.Fail(t, "the subscription was not closed once the context was cancelled")
+		}
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	t.Parallel()
+
+	in := make(chan struct{})
+	out := netif.Debounce(in, 50*time.Millisecond)
+
+	// The changes that are received within the window are delivered once.
+	for range 5 {
+		in <- struct{}{}
+	}
+
+	select {
+	case <-out:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the changes were not delivered")
+	}
+
+	select {
+	case <-out:
+		assert.Fail(t, "the changes were delivered more than once")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(in)
+
+	select {
+	case _, ok := <-out:
+		assert.False(t, ok, "no change was pending")
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the output was not closed once the input was")
+	}
+}
+
+func TestDebounceWaitsForTheChangesToSettle(t *testing.T) {
+	t.Parallel()
+
+	in := make(chan struct{})
+	out := netif.Debounce(in, 100*time.Millisecond)
+	start := time.Now()
+
+	// Each change restarts the window.
+	for range 4 {
+		in <- struct{}{}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	select {
+	case <-out:
+		assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the changes were not delivered")
+	}
+
+	close(in)
+}
@@ -0,0 +1,413 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netif
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// notificationsSize is the size of the buffer that the netlink notifications are read into.
+	notificationsSize = 1 << 16
+	// DefaultDebounce is how long SubscribeAddressChanges waits for the
+	// changes to settle, e.g. the addresses and the routes of an interface that
+	// comes up are notified one by one.
+	DefaultDebounce = 250 * time.Millisecond
+)
+
+// Netlink lists the interfaces, their addresses and their default routes
+// with netlink, which tells the flags of the addresses; it falls back to System
+// with DefaultProcNet when netlink is not available.
+func Netlink() Lister {
+	return netlinkLister{fallback: System(DefaultProcNet)}
+}
+
+type netlinkLister struct {
+	fallback Lister
+}
+
+func (n netlinkLister) Interfaces() ([]Interface, error) {
+	infs, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := readAddrs()
+	if err != nil {
+		log.Debugf("failed to list the addresses with netlink, listing them without their flags instead: %v", err)
+
+		return n.fallback.Interfaces()
+	}
+
+	interfaces := make([]Interface, 0, len(infs))
+
+	for _, inf := range infs {
+		interfaces = append(interfaces, Interface{Name: inf.Name, Flags: inf.Flags, Addrs: addrs[inf.Index]})
+	}
+
+	return interfaces, nil
+}
+
+func (n netlinkLister) DefaultRoutes() ([]string, error) {
+	names, err := readDefaultRoutes()
+	if err != nil {
+		log.Debugf("failed to list the routes with netlink, reading them from %s instead: %v", DefaultProcNet, err)
+
+		return n.fallback.DefaultRoutes()
+	}
+
+	return names, nil
+}
+
+// ListAddresses returns the addresses of the interface of the name, see Netlink.
+func ListAddresses(name string) ([]Addr, error) {
+	interfaces, err := Netlink().Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, inf := range interfaces {
+		if inf.Name == name {
+			return inf.Addrs, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrNoInterface, name)
+}
+
+// DefaultRouteInterface returns the name of the first interface that a
+// default route goes through, see Netlink.
+func DefaultRouteInterface() (string, error) {
+	names, err := Netlink().DefaultRoutes()
+	if err != nil {
+		return "", err
+	}
+
+	if len(names) == 0 {
+		return "", fmt.Errorf("%w with a default route", ErrNoInterface)
+	}
+
+	return names[0], nil
+}
+
+// readAddrs returns the addresses of the system by the index of their interface.
+func readAddrs() (map[int][]Addr, error) {
+	rib, err := syscall.NetlinkRIB(unix.RTM_GETADDR, unix.AF_UNSPEC)
+	if err != nil {
+		return nil, os.NewSyscallError("netlinkrib", err)
+	}
+
+	messages, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return nil, os.NewSyscallError("parsenetlinkmessage", err)
+	}
+
+	addrs := make(map[int][]Addr)
+
+	for i := range messages {
+		message := &messages[i]
+		if message.Header.Type != unix.RTM_NEWADDR || len(message.Data) < unix.SizeofIfAddrmsg {
+			continue
+		}
+
+		attributes, err := syscall.ParseNetlinkRouteAttr(message)
+		if err != nil {
+			return nil, os.NewSyscallError("parsenetlinkrouteattr", err)
+		}
+
+		index := int(binary.NativeEndian.Uint32(message.Data[4:8]))
+		if addr, ok := parseAddr(message.Data, attributes); ok {
+			addrs[index] = append(addrs[index], addr)
+		}
+	}
+
+	return addrs, nil
+}
+
+// readDefaultRoutes returns the names of the interfaces that the default
+// routes of the main routing table go through, the IPv4 ones first.
+func readDefaultRoutes() ([]string, error) {
+	var names []string
+
+	for _, family := range []int{unix.AF_INET, unix.AF_INET6} {
+		rib, err := syscall.NetlinkRIB(unix.RTM_GETROUTE, family)
+		if err != nil {
+			return nil, os.NewSyscallError("netlinkrib", err)
+		}
+
+		messages, err := syscall.ParseNetlinkMessage(rib)
+		if err != nil {
+			return nil, os.NewSyscallError("parsenetlinkmessage", err)
+		}
+
+		for i := range messages {
+			message := &messages[i]
+			if message.Header.Type != unix.RTM_NEWROUTE || len(message.Data) < unix.SizeofRtMsg {
+				continue
+			}
+
+			attributes, err := syscall.ParseNetlinkRouteAttr(message)
+			if err != nil {
+				return nil, os.NewSyscallError("parsenetlinkrouteattr", err)
+			}
+
+			for _, index := range defaultRouteInterfaces(message.Data, attributes) {
+				// The interface may have gone since the routes were read.
+				if inf, err := net.InterfaceByIndex(index); err == nil {
+					names = append(names, inf.Name)
+				}
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// defaultRouteInterfaces returns the indexes of the interfaces of an
+// RTM_NEWROUTE message, whose data starts with its rtmsg, if it is a default
+// route of the main table that does not reject the packets.
+func defaultRouteInterfaces(data []byte, attributes []syscall.NetlinkRouteAttr) []int {
+	dstLength, table, routeType := data[1], uint32(data[4]), data[7]
+	if dstLength != 0 || routeType != unix.RTN_UNICAST {
+		return nil
+	}
+
+	var indexes []int
+
+	for _, attribute := range attributes {
+		switch attribute.Attr.Type {
+		case unix.RTA_TABLE:
+			// The table ids above 255 are only in this attribute.
+			if len(attribute.Value) >= 4 {
+				table = binary.NativeEndian.Uint32(attribute.Value)
+			}
+		case unix.RTA_OIF:
+			if len(attribute.Value) >= 4 {
+				indexes = append(indexes, int(binary.NativeEndian.Uint32(attribute.Value)))
+			}
+		case unix.RTA_MULTIPATH:
+			// The next hops of a multipath route are rtnexthop structures, each with its interface.
+			for hops := attribute.Value; len(hops) >= unix.SizeofRtNexthop; {
+				length := int(binary.NativeEndian.Uint16(hops[0:2]))
+				if hops[2]&unix.RTNH_F_DEAD == 0 {
+					indexes = append(indexes, int(binary.NativeEndian.Uint32(hops[4:8])))
+				}
+
+				if length < unix.SizeofRtNexthop || length > len(hops) {
+					break
+				}
+
+				hops = hops[(length+unix.RTA_ALIGNTO-1)&^(unix.RTA_ALIGNTO-1):]
+			}
+		}
+	}
+
+	if table != unix.RT_TABLE_MAIN {
+		return nil
+	}
+
+	return indexes
+}
+
+// parseAddr returns the address of an RTM_NEWADDR message, whose data starts with its ifaddrmsg.
+func parseAddr(data []byte, attributes []syscall.NetlinkRouteAttr) (Addr, bool) {
+	family, prefixLength, flags := data[0], int(data[1]), uint32(data[2])
+
+	var address, local net.IP
+
+	for _, attribute := range attributes {
+		switch attribute.Attr.Type {
+		case unix.IFA_ADDRESS:
+			address = net.IP(attribute.Value)
+		case unix.IFA_LOCAL:
+			local = net.IP(attribute.Value)
+		case unix.IFA_FLAGS:
+			// The flags that do not fit in the ifaddrmsg are only in this attribute.
+			if len(attribute.Value) >= 4 {
+				flags = binary.NativeEndian.Uint32(attribute.Value)
+			}
+		}
+	}
+
+	// IFA_ADDRESS is the address of the peer on the point-to-point IPv4 links, which IFA_LOCAL is the one of.
+	if family == unix.AF_INET && local != nil {
+		address = local
+	}
+
+	bits := net.IPv6len * 8
+	if family == unix.AF_INET {
+		bits = net.IPv4len * 8
+	}
+
+	if address == nil || len(address)*8 != bits {
+		return Addr{}, false
+	}
+
+	return Addr{IPNet: &net.IPNet{IP: address, Mask: net.CIDRMask(prefixLength, bits)}, Flags: flags}, true
+}
+
+// Watch sends to changes, without blocking, whenever the addresses or the
+// routes of the system may have changed, as the netlink notifications tell,
+// or every interval when they can not be subscribed to; it returns once the
+// context is cancelled.
+func Watch(ctx context.Context, interval time.Duration, changes chan<- struct{}) {
+	file, err := subscribe()
+	watch(ctx, file, err, interval, changes)
+}
+
+// SubscribeAddressChanges returns the channel that receives once the
+// addresses or the routes of the system changed, like Watch does, and no
+// other change followed within DefaultDebounce, see Debounce. The netlink
+// socket is opened before it returns, in the network namespace of the calling
+// thread; the channel is closed once the context is cancelled.
+func SubscribeAddressChanges(ctx context.Context, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	file, err := subscribe()
+
+	go func() {
+		defer close(changes)
+		watch(ctx, file, err, interval, changes)
+	}()
+
+	return Debounce(changes, DefaultDebounce)
+}
+
+// Debounce returns the channel that receives, without blocking, once in did
+// and nothing else was received within the window; the changes that are
+// received while it waits restart it. The channel is closed once in is.
+func Debounce(in <-chan struct{}, window time.Duration) <-chan struct{} {
+	out := make(chan struct{}, 1)
+
+	go func() {
+		defer close(out)
+
+		timer := time.NewTimer(window)
+		timer.Stop()
+
+		var settled <-chan time.Time
+
+		for {
+			select {
+			case _, ok := <-in:
+				if !ok {
+					timer.Stop()
+
+					return
+				}
+
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+
+				timer.Reset(window)
+				settled = timer.C
+			case <-settled:
+				settled = nil
+				notify(out)
+			}
+		}
+	}()
+
+	return out
+}
+
+// watch reads the notifications of the file that subscribe returned, or
+// polls when it failed.
+func watch(ctx context.Context, file *os.File, err error, interval time.Duration, changes chan<- struct{}) {
+	if err != nil {
+		log.Warnf("failed to watch the network interfaces, checking them every %s instead: %v", interval, err)
+		poll(ctx, interval, changes)
+
+		return
+	}
+	defer file.Close()
+
+	// Closing the file stops the read of the notifications.
+	stop := context.AfterFunc(ctx, func() { file.Close() })
+	defer stop()
+
+	buffer := make([]byte, notificationsSize)
+
+	for {
+		_, err := file.Read(buffer)
+
+		switch {
+		case ctx.Err() != nil:
+			return
+		case errors.Is(err, unix.ENOBUFS):
+			// Some notifications were dropped, the addresses are read again anyway.
+		case err != nil:
+			log.Errorf("failed to read the network interface notifications, checking them every %s instead: %v", interval, err)
+			poll(ctx, interval, changes)
+
+			return
+		}
+
+		notify(changes)
+	}
+}
+
+// subscribe returns the netlink socket that the notifications of the changes
+// of the addresses and the routes are received from.
+func subscribe() (*os.File, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+
+	groups := uint32(unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR |
+		unix.RTMGRP_IPV4_ROUTE | unix.RTMGRP_IPV6_ROUTE)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		unix.Close(fd)
+
+		return nil, os.NewSyscallError("bind", err)
+	}
+
+	// The socket is non-blocking, so that its reads go through the poller and stop once it is closed.
+	return os.NewFile(uintptr(fd), "netlink"), nil
+}
+
+func poll(ctx context.Context, interval time.Duration, changes chan<- struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notify(changes)
+		}
+	}
+}
+
+func notify(changes chan<- struct{}) {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
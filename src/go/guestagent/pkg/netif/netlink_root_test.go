@@ -0,0 +1,102 @@
+//go:build root
+
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netif_test
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// newNamespace creates a network namespace with unshare, which is mounted at
+// a file of a temporary directory and unmounted once the test is done.
+func newNamespace(t *testing.T) string {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("creating the network namespaces requires root")
+	}
+
+	path := filepath.Join(t.TempDir(), "rd1")
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+	output, err := exec.Command("unshare", "--net="+path, "true").CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	t.Cleanup(func() {
+		assert.NoError(t, unix.Unmount(path, unix.MNT_DETACH))
+	})
+
+	return path
+}
+
+// ip runs the ip command within the network namespace of the file.
+func ip(t *testing.T, path string, args ...string) {
+	t.Helper()
+
+	output, err := exec.Command("nsenter", append([]string{"--net=" + path, "ip"}, args...)...).CombinedOutput()
+	require.NoError(t, err, string(output))
+}
+
+func TestNetlinkNamespace(t *testing.T) {
+	path := newNamespace(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	require.NoError(t, netns.New(path).Do(func() error {
+		changes := netif.SubscribeAddressChanges(ctx, time.Hour)
+
+		// The routes and the address of the interface are notified one by one.
+		ip(t, path, "link", "set", "lo", "up")
+		ip(t, path, "address", "add", "192.0.2.1/24", "dev", "lo")
+		ip(t, path, "route", "add", "default", "dev", "lo")
+
+		select {
+		case <-changes:
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "the changes of the network namespace were not notified")
+		}
+
+		addrs, err := netif.ListAddresses("lo")
+		require.NoError(t, err)
+
+		var listed []string
+		for _, addr := range addrs {
+			listed = append(listed, addr.String())
+		}
+
+		assert.Contains(t, listed, "192.0.2.1/24")
+
+		name, err := netif.DefaultRouteInterface()
+		require.NoError(t, err)
+		assert.Equal(t, "lo", name)
+
+		_, err = netif.ListAddresses("eth0")
+		assert.ErrorIs(t, err, netif.ErrNoInterface)
+
+		return nil
+	}))
+}
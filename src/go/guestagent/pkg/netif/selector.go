@@ -0,0 +1,97 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netif
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/Masterminds/log-go"
+)
+
+// Selector selects the network interfaces like Select, and keeps them until
+// they are selected again, e.g. once Watch tells that the interfaces changed.
+type Selector struct {
+	lister    Lister
+	names     []string
+	fallbacks []string
+	filter    Filter
+
+	mutex    sync.Mutex
+	selected []Interface
+	// excluded are the names of the interfaces that the filter last left out.
+	excluded []string
+}
+
+// NewSelector returns the selector of the interfaces of the names, see
+// Select. When there are no names and no interface has a default route, it
+// falls back to the first interface that matches the fallbacks, in their
+// order, e.g. the known interfaces of the platform, see platform.Interfaces.
+func NewSelector(lister Lister, names, fallbacks []string) *Selector {
+	return &Selector{
+		lister:    lister,
+		names:     names,
+		fallbacks: fallbacks,
+	}
+}
+
+// SetFilter sets the filter of the interfaces that are not selected by
+// their names, see Filter. It must be called before they are selected.
+func (s *Selector) SetFilter(filter Filter) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.filter = filter
+}
+
+// Select returns the interfaces that were last selected, or selects them
+// if none were yet.
+func (s *Selector) Select() ([]Interface, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.selected != nil {
+		return s.selected, nil
+	}
+
+	return s.refresh()
+}
+
+// Refresh selects the interfaces again and keeps them; the ones that were
+// selected before are kept when it fails.
+func (s *Selector) Refresh() ([]Interface, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.refresh()
+}
+
+func (s *Selector) refresh() ([]Interface, error) {
+	selected, excluded, err := selectInterfaces(s.lister, s.names, s.fallbacks, s.filter)
+
+	// The interfaces that are left out are logged when they change.
+	if len(excluded) != 0 && !slices.Equal(excluded, s.excluded) {
+		log.Infof("leaving out the network interfaces of the VPNs and of the overlay networks: %v", excluded)
+	}
+
+	s.excluded = excluded
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.selected = selected
+
+	return selected, nil
+}
@@ -0,0 +1,141 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netif_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectorLayouts(t *testing.T) {
+	t.Parallel()
+
+	loopback := netif.Interface{Name: "lo", Flags: net.FlagUp | net.FlagLoopback, Addrs: []netif.Addr{mustParseCIDR(t, "127.0.0.1/8")}}
+	up := func(name, cidr string) netif.Interface {
+		return netif.Interface{Name: name, Flags: net.FlagUp, Addrs: []netif.Addr{mustParseCIDR(t, cidr)}}
+	}
+
+	tests := map[string]struct {
+		platform   string
+		names      []string
+		interfaces []netif.Interface
+		routes     []string
+		selected   string
+		err        string
+	}{
+		"wsl": {
+			platform:   platform.WSL,
+			names:      []string{"eth0"},
+			interfaces: []netif.Interface{loopback, up("eth0", "172.20.1.2/20")},
+			routes:     []string{"eth0"},
+			selected:   "eth0",
+		},
+		"wsl with a vpn": {
+			// The default route of the VPN does not take over the NAT interface.
+			platform:   platform.WSL,
+			names:      []string{"eth0"},
+			interfaces: []netif.Interface{loopback, up("tun0", "10.8.0.2/24"), up("eth0", "172.20.1.2/20")},
+			routes:     []string{"tun0"},
+			selected:   "eth0",
+		},
+		"lima qemu": {
+			platform:   platform.Lima,
+			interfaces: []netif.Interface{loopback, up("eth0", "192.168.5.15/24"), up("lima0", "192.168.105.2/24")},
+			routes:     []string{"eth0"},
+			selected:   "eth0",
+		},
+		"lima qemu without routes": {
+			platform:   platform.Lima,
+			interfaces: []netif.Interface{loopback, up("eth0", "192.168.5.15/24"), up("rd0", "192.168.205.2/24")},
+			selected:   "rd0",
+		},
+		"lima vz": {
+			platform: platform.Lima,
+			interfaces: []netif.Interface{
+				loopback, up("docker0", "172.17.0.1/16"), up("cni0", "10.42.0.1/24"), up("enp0s1", "192.168.64.3/24"),
+			},
+			selected: "enp0s1",
+		},
+		"lima without known interfaces": {
+			platform:   platform.Lima,
+			interfaces: []netif.Interface{loopback, up("docker0", "172.17.0.1/16"), {Name: "enp0s1"}},
+			err:        "no network interface found with a default route or named rd0 or lima0 or eth0 or enp0s* or ens*",
+		},
+		"generic without routes": {
+			platform:   platform.Generic,
+			interfaces: []netif.Interface{loopback, up("eth0", "10.0.0.2/24")},
+			err:        "no network interface found with a default route",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			lister := &fakeLister{interfaces: test.interfaces, routes: test.routes}
+			selector := netif.NewSelector(lister, test.names, platform.Interfaces(test.platform))
+
+			interfaces, err := selector.Select()
+			if test.err != "" {
+				require.ErrorIs(t, err, netif.ErrNoInterface)
+				require.EqualError(t, err, test.err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			require.Len(t, interfaces, 1)
+			assert.Equal(t, test.selected, interfaces[0].Name)
+		})
+	}
+}
+
+func TestSelectorCache(t *testing.T) {
+	t.Parallel()
+
+	lister := newFakeLister(t)
+	selector := netif.NewSelector(lister, nil, platform.Interfaces(platform.Lima))
+
+	interfaces, err := selector.Select()
+	require.NoError(t, err)
+	assert.Equal(t, "lima0", interfaces[0].Name)
+	assert.Equal(t, int32(1), lister.calls.Load())
+
+	// The interfaces are only listed again once they are refreshed.
+	lister.routes = []string{"docker0"}
+
+	interfaces, err = selector.Select()
+	require.NoError(t, err)
+	assert.Equal(t, "lima0", interfaces[0].Name)
+	assert.Equal(t, int32(1), lister.calls.Load())
+
+	interfaces, err = selector.Refresh()
+	require.NoError(t, err)
+	assert.Equal(t, "docker0", interfaces[0].Name)
+
+	// The interfaces that were selected are kept when none can be selected anymore.
+	lister.interfaces = lister.interfaces[:1]
+
+	_, err = selector.Refresh()
+	require.ErrorIs(t, err, netif.ErrNoInterface)
+
+	interfaces, err = selector.Select()
+	require.NoError(t, err)
+	assert.Equal(t, "docker0", interfaces[0].Name)
+}
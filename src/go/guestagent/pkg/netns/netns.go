@@ -0,0 +1,163 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package netns runs the scans of the agent within a named network namespace,
+// e.g. the one that the namespaced networking of Rancher Desktop runs the
+// workloads in, while the rest of the agent stays in its own; see Namespace.Do.
+package netns
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultDir is where the named network namespaces are, like ip-netns(8) keeps them.
+const DefaultDir = "/var/run/netns"
+
+// threadNamespace is the network namespace of the calling thread.
+const threadNamespace = "/proc/thread-self/ns/net"
+
+// ErrNotFound is returned when the network namespace does not exist, e.g.
+// since it was deleted while the agent runs.
+var ErrNotFound = errors.New("network namespace not found")
+
+// Namespace is a named network namespace, see New.
+type Namespace struct {
+	name string
+	path string
+}
+
+// New returns the network namespace of the name, which is looked up in
+// DefaultDir unless it is an absolute path, e.g. /proc/1234/ns/net. It is
+// only opened when it is entered, so it may not exist yet.
+func New(name string) *Namespace {
+	path := name
+	if !filepath.IsAbs(name) {
+		path = filepath.Join(DefaultDir, name)
+	}
+
+	return &Namespace{name: name, path: path}
+}
+
+// String returns the name of the namespace.
+func (n *Namespace) String() string {
+	return n.name
+}
+
+// Check returns ErrNotFound if the namespace does not exist.
+func (n *Namespace) Check() error {
+	file, err := n.open()
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// Do runs fn within the namespace, on a dedicated OS thread that is locked
+// for it, and returns its error; a nil namespace runs fn as it is. The
+// goroutines that fn starts do not run within the namespace, but the sockets
+// that it opens and the processes that it starts stay in it. The thread goes
+// back to the namespace of the agent afterwards, or is discarded if it can
+// not, so that no other goroutine ever runs in the namespace.
+func (n *Namespace) Do(fn func() error) error {
+	if n == nil {
+		return fn()
+	}
+
+	file, err := n.open()
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	type result struct {
+		err       error
+		recovered any
+	}
+
+	results := make(chan result, 1)
+
+	go func() {
+		// The thread is only unlocked once it is back, the goroutine takes it down otherwise.
+		runtime.LockOSThread()
+
+		origin, err := os.Open(threadNamespace)
+		if err != nil {
+			results <- result{err: fmt.Errorf("failed to open the network namespace of the agent: %w", err)}
+
+			return
+		}
+		defer origin.Close()
+
+		if err := unix.Setns(int(file.Fd()), unix.CLONE_NEWNET); err != nil {
+			results <- result{err: fmt.Errorf("failed to enter the network namespace %s: %w", n.name, err)}
+
+			return
+		}
+
+		// The panics are raised again by the caller, e.g. for the supervisor to recover them.
+		defer func() {
+			if r := recover(); r != nil {
+				results <- result{recovered: r}
+			}
+		}()
+
+		defer func() {
+			if err := unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET); err == nil {
+				runtime.UnlockOSThread()
+			}
+		}()
+
+		results <- result{err: fn()}
+	}()
+
+	outcome := <-results
+	if outcome.recovered != nil {
+		panic(outcome.recovered)
+	}
+
+	return outcome.err
+}
+
+// open opens the namespace, it is only a namespace while the nsfs is mounted
+// at its path, which ip-netns(8) unmounts as it deletes it.
+func (n *Namespace) open() (*os.File, error) {
+	file, err := os.Open(n.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s does not exist", ErrNotFound, n.path)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open the network namespace %s: %w", n.name, err)
+	}
+
+	var stat unix.Statfs_t
+	if err := unix.Fstatfs(int(file.Fd()), &stat); err != nil {
+		file.Close()
+
+		return nil, fmt.Errorf("failed to open the network namespace %s: %w", n.name, err)
+	}
+
+	if stat.Type != unix.NSFS_MAGIC {
+		file.Close()
+
+		return nil, fmt.Errorf("%w: %s is not a mounted namespace", ErrNotFound, n.path)
+	}
+
+	return file, nil
+}
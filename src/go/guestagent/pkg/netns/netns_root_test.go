@@ -0,0 +1,107 @@
+//go:build root
+
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netns_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// newNamespace creates a network namespace with unshare, which is mounted at
+// a file of a temporary directory; it returns the file, see deleteNamespace.
+func newNamespace(t *testing.T) string {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("creating the network namespaces requires root")
+	}
+
+	path := filepath.Join(t.TempDir(), "rd1")
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+	output, err := exec.Command("unshare", "--net="+path, "true").CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	t.Cleanup(func() {
+		deleteNamespace(t, path)
+	})
+
+	return path
+}
+
+// deleteNamespace unmounts the network namespace like ip netns delete does.
+func deleteNamespace(t *testing.T, path string) {
+	t.Helper()
+
+	if err := unix.Unmount(path, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) {
+		t.Errorf("failed to unmount the network namespace %s: %v", path, err)
+	}
+}
+
+// inode returns the inode of the network namespace of the file.
+func inode(t *testing.T, path string) uint64 {
+	t.Helper()
+
+	var stat unix.Stat_t
+	require.NoError(t, unix.Stat(path, &stat))
+
+	return stat.Ino
+}
+
+func TestDoEntersNamespace(t *testing.T) {
+	path := newNamespace(t)
+	namespace := netns.New(path)
+	require.NoError(t, namespace.Check())
+
+	var entered uint64
+	require.NoError(t, namespace.Do(func() error {
+		entered = inode(t, "/proc/thread-self/ns/net")
+
+		return nil
+	}))
+
+	assert.Equal(t, inode(t, path), entered)
+	// The agent itself stays in its network namespace.
+	assert.NotEqual(t, inode(t, path), inode(t, "/proc/self/ns/net"))
+}
+
+func TestDoAfterDeletion(t *testing.T) {
+	path := newNamespace(t)
+	namespace := netns.New(path)
+	require.NoError(t, namespace.Do(func() error { return nil }))
+
+	deleteNamespace(t, path)
+
+	require.ErrorIs(t, namespace.Do(func() error { return nil }), netns.ErrNotFound)
+}
+
+func TestDoPanics(t *testing.T) {
+	namespace := netns.New(newNamespace(t))
+
+	assert.PanicsWithValue(t, "scan failed", func() {
+		_ = namespace.Do(func() error {
+			panic("scan failed")
+		})
+	})
+}
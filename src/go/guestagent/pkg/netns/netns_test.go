@@ -0,0 +1,68 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netns_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "rd1", netns.New("rd1").String())
+	require.ErrorContains(t, netns.New("rd-missing").Check(), filepath.Join(netns.DefaultDir, "rd-missing"))
+	require.ErrorContains(t, netns.New("/proc/0/ns/net").Check(), "/proc/0/ns/net")
+}
+
+func TestCheckNotFound(t *testing.T) {
+	t.Parallel()
+
+	// A file that the namespace is not mounted at, e.g. after ip netns delete failed to remove it.
+	unmounted := filepath.Join(t.TempDir(), "rd1")
+	require.NoError(t, os.WriteFile(unmounted, nil, 0o600))
+
+	for _, path := range []string{filepath.Join(t.TempDir(), "missing"), unmounted} {
+		namespace := netns.New(path)
+		require.ErrorIs(t, namespace.Check(), netns.ErrNotFound)
+
+		called := false
+		err := namespace.Do(func() error {
+			called = true
+
+			return nil
+		})
+		require.ErrorIs(t, err, netns.ErrNotFound)
+		assert.False(t, called)
+	}
+}
+
+func TestDoWithoutNamespace(t *testing.T) {
+	t.Parallel()
+
+	var namespace *netns.Namespace
+
+	called := false
+	require.NoError(t, namespace.Do(func() error {
+		called = true
+
+		return nil
+	}))
+	assert.True(t, called)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package pidfile keeps a single instance of the agent running, two of them
+// would register the port mappings twice and fight over the listeners.
+package pidfile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	fileMode     = 0o644
+	maxPIDLength = 32
+)
+
+// ErrRunning is returned by Acquire when another instance holds the PID file.
+var ErrRunning = errors.New("another instance of the agent is running")
+
+// File is a PID file that is held by this instance, see Acquire.
+type File struct {
+	path string
+	file *os.File
+}
+
+// Acquire writes the PID of this process to the file at path, and holds an
+// exclusive lock on it until Release; it fails with ErrRunning, naming the
+// PID of the other instance, when a live one holds it. The lock of an
+// instance that crashed is released with it, so its stale file is taken over.
+func Acquire(path string) (*File, error) {
+	for {
+		file, err := lock(path)
+		switch {
+		case err != nil:
+			return nil, err
+		case file != nil:
+			return &File{path: path, file: file}, nil
+		}
+	}
+}
+
+// lock locks the PID file and writes the PID of this process to it, it
+// returns nil without an error when the file was removed in the meantime
+// by the instance that held it, which must be tried again.
+func lock(path string) (*os.File, error) {
+	//nolint:gosec // the PID file is readable by the tools that signal the agent.
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, fileMode)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the PID file: %w", err)
+	}
+
+	if err := unix.Flock(int(file.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		pid := readPID(file)
+		file.Close()
+
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w with PID %s, it holds %s", ErrRunning, pid, path)
+		}
+
+		return nil, fmt.Errorf("failed to lock the PID file %s: %w", path, err)
+	}
+
+	if !exists(file, path) {
+		file.Close()
+
+		return nil, nil
+	}
+
+	if pid := readPID(file); pid != "" {
+		log.Warnf("taking over the stale PID file %s of PID %s, which did not stop cleanly", path, pid)
+	}
+
+	if err := write(file, os.Getpid()); err != nil {
+		file.Close()
+
+		return nil, fmt.Errorf("failed to write the PID file %s: %w", path, err)
+	}
+
+	return file, nil
+}
+
+// exists returns true if the open file is still the one at path.
+func exists(file *os.File, path string) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	pathInfo, err := os.Stat(path)
+
+	return err == nil && os.SameFile(info, pathInfo)
+}
+
+// Release removes the PID file and releases its lock.
+func (f *File) Release() error {
+	// The file is removed while it is locked, so that the next
+	// instance does not lock the file that is being removed.
+	err := os.Remove(f.path)
+
+	return errors.Join(err, f.file.Close())
+}
+
+// readPID returns the PID that the file holds, if any.
+func readPID(file *os.File) string {
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, maxPIDLength))
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+func write(file *os.File, pid int) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+
+	_, err := file.WriteAt([]byte(strconv.Itoa(pid)+"\n"), 0)
+	if err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package pidfile_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/pidfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquire(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "guestagent.pid")
+
+	first, err := pidfile.Acquire(path)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid())+"\n", string(data))
+
+	// The second instance refuses to start while the first one holds the file.
+	_, err = pidfile.Acquire(path)
+	require.ErrorIs(t, err, pidfile.ErrRunning)
+	assert.ErrorContains(t, err, "with PID "+strconv.Itoa(os.Getpid())+", it holds "+path)
+
+	require.NoError(t, first.Release())
+	assert.NoFileExists(t, path)
+
+	// It starts once the first one stopped.
+	second, err := pidfile.Acquire(path)
+	require.NoError(t, err)
+	require.NoError(t, second.Release())
+}
+
+func TestAcquireStale(t *testing.T) {
+	t.Parallel()
+
+	// The instance that crashed left its PID file behind, unlocked.
+	path := filepath.Join(t.TempDir(), "guestagent.pid")
+	require.NoError(t, os.WriteFile(path, []byte("123456789\n"), 0o600))
+
+	file, err := pidfile.Acquire(path)
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid())+"\n", string(data))
+
+	require.NoError(t, file.Release())
+	assert.NoFileExists(t, path)
+}
+
+func TestAcquireInvalidPath(t *testing.T) {
+	t.Parallel()
+
+	_, err := pidfile.Acquire(filepath.Join(t.TempDir(), "missing", "guestagent.pid"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	assert.NotErrorIs(t, err, pidfile.ErrRunning)
+}
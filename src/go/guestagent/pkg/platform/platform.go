@@ -0,0 +1,167 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package platform detects the platform that the agent runs on, i.e. WSL or
+// Lima, whose defaults differ from the ones of the agent, see Defaults.
+package platform
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	// WSL is the Windows Subsystem for Linux, the Rancher Desktop VM on Windows.
+	WSL = "wsl"
+	// Lima is the Rancher Desktop VM on macOS and Linux.
+	Lima = "lima"
+	// Generic is any other Linux machine, which keeps the defaults of the agent.
+	Generic = "generic"
+)
+
+var ErrUnknownPlatform = errors.New("unknown platform")
+
+//nolint:gochecknoglobals
+var (
+	// wslInteropFiles register the interop with Windows, the later
+	// versions of WSL register it under the second name.
+	wslInteropFiles = []string{"/proc/sys/fs/binfmt_misc/WSLInterop", "/proc/sys/fs/binfmt_misc/WSLInterop-late"}
+	// defaults are the defaults of the flags that differ on each platform.
+	defaults = map[string]map[string]string{
+		WSL: {
+			// The host reaches the ports at the address of the NAT interface of
+			// WSL, even once a VPN adds a default route of its own.
+			"interface": "eth0",
+			// Windows holds these ports itself, forwarding them rarely works.
+			"wellKnownPorts": "135=RPC Endpoint Mapper,137-139=NetBIOS,445=SMB,3389=Remote Desktop,5357=WSD,5985-5986=WinRM",
+		},
+		Lima: {
+			// The services of macOS that are enabled by default, or often.
+			"wellKnownPorts": "445=SMB File Sharing,5000=AirPlay Receiver,5900=Screen Sharing,7000=AirPlay Receiver",
+		},
+		Generic: {},
+	}
+	// interfaces are the network interfaces that the host may reach the VM
+	// at, which are tried in order when none of them has a default route.
+	interfaces = map[string][]string{
+		// The bridged interface of Rancher Desktop, the shared one of Lima's
+		// vmnet, the user network of QEMU, and the ones of the vz driver,
+		// which are named after their slot.
+		Lima: {"rd0", "lima0", "eth0", "enp0s*", "ens*"},
+	}
+	// forwarders are the forwarders that -forwarder=auto probes for on the
+	// platform, in order. The Privileged Service of WSL listens on the
+	// Hyper-V socket, and on the vtunnel relay for the older ones; the Lima
+	// hosts listen on vsock, or serve the API of their host-switch.
+	forwarders = map[string][]string{
+		WSL:  {"hvsock", "vtunnel"},
+		Lima: {"vsock", "hostswitch"},
+	}
+)
+
+const (
+	osReleaseFile = "/proc/sys/kernel/osrelease"
+	hostnameFile  = "/proc/sys/kernel/hostname"
+	// limaCidataDir is where Lima mounts the cloud-init data of the VM.
+	limaCidataDir = "/mnt/lima-cidata"
+	// limaHostnamePrefix prefixes the host names of the Lima VMs, e.g. lima-rancher-desktop.
+	limaHostnamePrefix = "lima-"
+)
+
+// Detector detects the platform, see Detect.
+type Detector struct {
+	// Stat returns the information of the file, see os.Stat.
+	Stat func(name string) (os.FileInfo, error)
+	// ReadFile returns the content of the file, see os.ReadFile.
+	ReadFile func(name string) ([]byte, error)
+}
+
+// NewDetector returns the detector of the system.
+func NewDetector() *Detector {
+	return &Detector{
+		Stat:     os.Stat,
+		ReadFile: os.ReadFile,
+	}
+}
+
+// Detect returns the platform that the agent runs on, along with how it was
+// detected: WSL registers its interop with Windows and names its kernels
+// after Microsoft, and Lima mounts the cloud-init data of the VM and names
+// the VM after itself. It is Generic when none of them are found.
+func (d *Detector) Detect() (string, string) {
+	for _, name := range wslInteropFiles {
+		if _, err := d.Stat(name); err == nil {
+			return WSL, "found " + name
+		}
+	}
+
+	if release, err := d.ReadFile(osReleaseFile); err == nil {
+		release := strings.TrimSpace(string(release))
+		if strings.Contains(strings.ToLower(release), "microsoft") {
+			return WSL, "the kernel release " + release + " is the one of WSL"
+		}
+	}
+
+	if info, err := d.Stat(limaCidataDir); err == nil && info.IsDir() {
+		return Lima, "found " + limaCidataDir
+	}
+
+	if hostname, err := d.ReadFile(hostnameFile); err == nil {
+		hostname := strings.TrimSpace(string(hostname))
+		if strings.HasPrefix(hostname, limaHostnamePrefix) {
+			return Lima, "the host name " + hostname + " is the one of a Lima VM"
+		}
+	}
+
+	return Generic, "found neither WSL nor Lima"
+}
+
+// Resolve returns the named platform, or the detected one if the name is empty,
+// along with how it was detected; it fails if the platform is not known.
+func (d *Detector) Resolve(name string) (string, string, error) {
+	if name == "" {
+		platform, reason := d.Detect()
+
+		return platform, reason, nil
+	}
+
+	if _, ok := defaults[name]; !ok {
+		return "", "", fmt.Errorf("%w %q, valid options are %s, %s and %s", ErrUnknownPlatform, name, WSL, Lima, Generic)
+	}
+
+	return name, "", nil
+}
+
+// Defaults returns the defaults of the flags on the platform by flag
+// name, the flags that it does not name keep the defaults of the agent.
+func Defaults(platform string) map[string]string {
+	return maps.Clone(defaults[platform])
+}
+
+// Interfaces returns the names of the network interfaces that the host may
+// reach the VM of the platform at, in the order that they are preferred,
+// see netif.NewSelector; a trailing * matches any suffix.
+func Interfaces(platform string) []string {
+	return slices.Clone(interfaces[platform])
+}
+
+// Forwarders returns the kinds of the forwarders that the host of the
+// platform may listen with, in the order that they are probed for; there
+// are none on the Generic platform.
+func Forwarders(platform string) []string {
+	return slices.Clone(forwarders[platform])
+}
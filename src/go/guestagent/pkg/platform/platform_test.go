@@ -0,0 +1,168 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package platform_test
+
+import (
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/platform"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fileInfo is the information of the files of a testDetector.
+type fileInfo struct {
+	name string
+	dir  bool
+}
+
+func (f fileInfo) Name() string       { return f.name }
+func (f fileInfo) Size() int64        { return 0 }
+func (f fileInfo) Mode() fs.FileMode  { return 0 }
+func (f fileInfo) ModTime() time.Time { return time.Time{} }
+func (f fileInfo) IsDir() bool        { return f.dir }
+func (f fileInfo) Sys() any           { return nil }
+
+// testDetector returns a detector of the given files, the directories are the ones with no content.
+func testDetector(files map[string]string) *platform.Detector {
+	return &platform.Detector{
+		Stat: func(name string) (os.FileInfo, error) {
+			content, ok := files[name]
+			if !ok {
+				return nil, os.ErrNotExist
+			}
+
+			return fileInfo{name: name, dir: content == ""}, nil
+		},
+		ReadFile: func(name string) ([]byte, error) {
+			content, ok := files[name]
+			if !ok {
+				return nil, os.ErrNotExist
+			}
+
+			return []byte(content), nil
+		},
+	}
+}
+
+func TestDetect(t *testing.T) {
+	t.Parallel()
+
+	for name, test := range map[string]struct {
+		files    map[string]string
+		platform string
+		reason   string
+	}{
+		"wsl interop": {
+			files:    map[string]string{"/proc/sys/fs/binfmt_misc/WSLInterop": "enabled\n"},
+			platform: platform.WSL,
+			reason:   "found /proc/sys/fs/binfmt_misc/WSLInterop",
+		},
+		"wsl late interop": {
+			files:    map[string]string{"/proc/sys/fs/binfmt_misc/WSLInterop-late": "enabled\n"},
+			platform: platform.WSL,
+			reason:   "found /proc/sys/fs/binfmt_misc/WSLInterop-late",
+		},
+		"wsl kernel": {
+			files:    map[string]string{"/proc/sys/kernel/osrelease": "5.15.153.1-microsoft-standard-WSL2\n"},
+			platform: platform.WSL,
+			reason:   "the kernel release 5.15.153.1-microsoft-standard-WSL2 is the one of WSL",
+		},
+		"lima cidata": {
+			files: map[string]string{
+				"/proc/sys/kernel/osrelease": "6.6.14-0-virt\n",
+				"/mnt/lima-cidata":           "",
+			},
+			platform: platform.Lima,
+			reason:   "found /mnt/lima-cidata",
+		},
+		"lima hostname": {
+			files: map[string]string{
+				"/proc/sys/kernel/osrelease": "6.6.14-0-virt\n",
+				"/proc/sys/kernel/hostname":  "lima-rancher-desktop\n",
+			},
+			platform: platform.Lima,
+			reason:   "the host name lima-rancher-desktop is the one of a Lima VM",
+		},
+		"generic": {
+			files: map[string]string{
+				"/proc/sys/kernel/osrelease": "6.8.0-45-generic\n",
+				"/proc/sys/kernel/hostname":  "builder\n",
+				// A file named after the mount of Lima is not one.
+				"/mnt/lima-cidata": "user-data",
+			},
+			platform: platform.Generic,
+			reason:   "found neither WSL nor Lima",
+		},
+	} {
+		detected, reason := testDetector(test.files).Detect()
+		assert.Equal(t, test.platform, detected, name)
+		assert.Equal(t, test.reason, reason, name)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	t.Parallel()
+
+	detector := testDetector(map[string]string{"/proc/sys/fs/binfmt_misc/WSLInterop": "enabled\n"})
+
+	// The platform that is named overrides the detected one.
+	resolved, reason, err := detector.Resolve(platform.Lima)
+	require.NoError(t, err)
+	assert.Equal(t, platform.Lima, resolved)
+	assert.Empty(t, reason)
+
+	resolved, reason, err = detector.Resolve("")
+	require.NoError(t, err)
+	assert.Equal(t, platform.WSL, resolved)
+	assert.Equal(t, "found /proc/sys/fs/binfmt_misc/WSLInterop", reason)
+
+	_, _, err = detector.Resolve("macos")
+	require.ErrorIs(t, err, platform.ErrUnknownPlatform)
+	assert.ErrorContains(t, err, `"macos", valid options are wsl, lima and generic`)
+}
+
+func TestDefaults(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, "eth0", platform.Defaults(platform.WSL)["interface"])
+	assert.Contains(t, platform.Defaults(platform.WSL)["wellKnownPorts"], "445=SMB")
+	assert.NotContains(t, platform.Defaults(platform.Lima), "forwarder")
+	assert.Contains(t, platform.Defaults(platform.Lima)["wellKnownPorts"], "5000=AirPlay Receiver")
+	assert.Empty(t, platform.Defaults(platform.Generic))
+
+	// The defaults are copies.
+	platform.Defaults(platform.WSL)["interface"] = "eth1"
+	assert.Equal(t, "eth0", platform.Defaults(platform.WSL)["interface"])
+}
+
+func TestInterfaces(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"rd0", "lima0", "eth0", "enp0s*", "ens*"}, platform.Interfaces(platform.Lima))
+	// WSL selects eth0 with the default of -interface instead.
+	assert.Empty(t, platform.Interfaces(platform.WSL))
+	assert.Empty(t, platform.Interfaces(platform.Generic))
+}
+
+func TestForwarders(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, []string{"hvsock", "vtunnel"}, platform.Forwarders(platform.WSL))
+	assert.Equal(t, []string{"vsock", "hostswitch"}, platform.Forwarders(platform.Lima))
+	assert.Empty(t, platform.Forwarders(platform.Generic))
+}
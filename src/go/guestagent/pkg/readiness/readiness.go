@@ -0,0 +1,271 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package readiness tells the init system when the agent is operational,
+// i.e. when it forwards the port mappings, rather than merely started; with
+// a ready file that the provisioning scripts can wait for, and with the
+// systemd notification protocol when the agent runs as a notify service.
+package readiness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+// The environment variables of the systemd notification protocol, see sd_notify(3).
+const (
+	NotifySocketEnv = "NOTIFY_SOCKET"
+	WatchdogUSecEnv = "WATCHDOG_USEC"
+	WatchdogPIDEnv  = "WATCHDOG_PID"
+)
+
+const readyFileMode = 0o644
+
+// Check returns nil when the agent is ready, or why it is not.
+type Check func() error
+
+// ErrDegraded is wrapped by the errors of the checks that leave the agent
+// ready, but degraded; e.g. while the forwarder does not send to its peer.
+var ErrDegraded = errors.New("degraded")
+
+// All returns a check that is only ready when all the given checks are, it
+// returns the error of the first one that is not; the agent is only reported
+// degraded when none of them make it not ready.
+func All(checks ...Check) Check {
+	return func() error {
+		var degraded error
+
+		for _, check := range checks {
+			err := check()
+			switch {
+			case err == nil:
+			case !errors.Is(err, ErrDegraded):
+				return err
+			case degraded == nil:
+				degraded = err
+			}
+		}
+
+		return degraded
+	}
+}
+
+// Degraded returns a check that reports the agent as degraded, rather
+// than not ready, when the given check fails; see ErrDegraded.
+func Degraded(check Check) Check {
+	return func() error {
+		if err := check(); err != nil {
+			return fmt.Errorf("%w: %w", ErrDegraded, err)
+		}
+
+		return nil
+	}
+}
+
+// Reporter reports whether the agent is ready, see Update.
+type Reporter struct {
+	readyFile    string
+	notifySocket string
+	// watchdog is the interval that systemd expects the keep-alive pings at, 0 if it does not.
+	watchdog time.Duration
+	mutex    sync.Mutex
+	ready    bool
+	status   string
+}
+
+// NewReporter creates a reporter that writes the ready file at the given
+// path, unless it is empty, and that notifies systemd when the environment
+// that lookupEnv looks up has a NOTIFY_SOCKET.
+func NewReporter(readyFile string, lookupEnv func(string) (string, bool)) *Reporter {
+	r := &Reporter{readyFile: readyFile}
+
+	r.notifySocket, _ = lookupEnv(NotifySocketEnv)
+
+	// The watchdog is meant for another process when its PID is not ours.
+	if pid, ok := lookupEnv(WatchdogPIDEnv); ok && pid != strconv.Itoa(os.Getpid()) {
+		return r
+	}
+
+	if usec, ok := lookupEnv(WatchdogUSecEnv); ok {
+		n, err := strconv.ParseInt(usec, 10, 64)
+		if err != nil || n <= 0 {
+			log.Warnf("ignoring the invalid %s=%q", WatchdogUSecEnv, usec)
+		} else {
+			r.watchdog = time.Duration(n) * time.Microsecond
+		}
+	}
+
+	return r
+}
+
+// Enabled returns true if the readiness is reported anywhere.
+func (r *Reporter) Enabled() bool {
+	return r.readyFile != "" || r.notifySocket != ""
+}
+
+// Ready returns whether the agent was last reported ready, and its status.
+func (r *Reporter) Ready() (bool, string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.ready, r.status
+}
+
+// Update reports the agent as ready when err is nil, as ready but degraded
+// when err wraps ErrDegraded, and as not ready because of err otherwise. The
+// ready file is written, or removed, and systemd is notified when the
+// readiness or its status changed.
+func (r *Reporter) Update(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	degraded := errors.Is(err, ErrDegraded)
+	ready, status := err == nil || degraded, "ready"
+
+	switch {
+	case degraded:
+		status = err.Error()
+	case err != nil:
+		status = "not ready: " + err.Error()
+	}
+
+	if ready == r.ready && status == r.status {
+		return
+	}
+
+	switch {
+	case degraded:
+		log.Warnf("the agent is %s", status)
+		r.writeReadyFile()
+		r.notify("READY=1\nSTATUS=" + status)
+	case ready:
+		log.Infof("the agent is ready")
+		r.writeReadyFile()
+		r.notify("READY=1\nSTATUS=" + status)
+	default:
+		if r.ready {
+			log.Warnf("the agent is no longer ready: %v", err)
+		} else {
+			log.Debugf("the agent is not ready yet: %v", err)
+		}
+
+		// The ready file of an agent that did not stop cleanly is removed too.
+		r.removeReadyFile()
+		r.notify("STATUS=" + status)
+	}
+
+	r.ready, r.status = ready, status
+}
+
+// Stop reports the agent as stopping, it is no longer ready.
+func (r *Reporter) Stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.removeReadyFile()
+	r.notify("STOPPING=1\nSTATUS=stopping")
+	r.ready, r.status = false, "stopping"
+}
+
+// Watch updates the readiness with the result of the check at every
+// interval until the context is cancelled, see Update. It also sends the
+// keep-alive pings when systemd expects them, at least twice per interval
+// of its watchdog.
+func (r *Reporter) Watch(ctx context.Context, interval time.Duration, check Check) {
+	if r.watchdog > 0 {
+		interval = min(interval, r.watchdog/2) //nolint:gomnd // twice per interval of the watchdog.
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		r.Update(check())
+
+		if r.watchdog > 0 {
+			r.mutex.Lock()
+			r.notify("WATCHDOG=1")
+			r.mutex.Unlock()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			// The subsystems that are stopping do not make the agent not ready.
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+}
+
+func (r *Reporter) writeReadyFile() {
+	if r.readyFile == "" {
+		return
+	}
+
+	data := []byte(strconv.Itoa(os.Getpid()) + "\n")
+	//nolint:gosec // the init system and the provisioning scripts read the ready file.
+	if err := os.WriteFile(r.readyFile, data, readyFileMode); err != nil {
+		log.Errorf("failed to write the ready file: %v", err)
+	}
+}
+
+func (r *Reporter) removeReadyFile() {
+	if r.readyFile == "" {
+		return
+	}
+
+	if err := os.Remove(r.readyFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("failed to remove the ready file: %v", err)
+	}
+}
+
+func (r *Reporter) notify(state string) {
+	if r.notifySocket == "" {
+		return
+	}
+
+	if err := Notify(r.notifySocket, state); err != nil {
+		log.Errorf("failed to notify systemd of %q: %v", state, err)
+	}
+}
+
+// ErrPeerLost is returned by the PeerCheck when the peer was not reached within the grace period.
+var ErrPeerLost = errors.New("the forwarder lost its peer")
+
+// PeerCheck returns a check that is not ready until the forwarder reached its
+// peer, and when it has not reached it within the grace period since; lastContact
+// returns when it last did, or zero if it never did.
+func PeerCheck(lastContact func() time.Time, grace time.Duration) Check {
+	return func() error {
+		last := lastContact()
+
+		switch {
+		case last.IsZero():
+			return errors.New("the forwarder has not reached its peer yet")
+		case time.Since(last) > grace:
+			return fmt.Errorf("%w, last contact at %s", ErrPeerLost, last.Format(time.RFC3339))
+		}
+
+		return nil
+	}
+}
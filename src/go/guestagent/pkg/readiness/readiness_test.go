@@ -0,0 +1,272 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package readiness_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/readiness"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errNotReady = errors.New("the subsystems are starting")
+
+// fakeNotifySocket listens like the notification socket of systemd,
+// it returns its path and the messages that it receives.
+func fakeNotifySocket(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	messages := make(chan string, 100)
+
+	go func() {
+		defer close(messages)
+
+		buf := make([]byte, 4096)
+
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+
+	return path, messages
+}
+
+// receive returns the next message of the fake notification socket.
+func receive(t *testing.T, messages <-chan string) string {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "systemd was not notified")
+
+		return ""
+	}
+}
+
+// lookupEnv looks up the variables in the given environment.
+func lookupEnv(env map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := env[name]
+
+		return value, ok
+	}
+}
+
+func TestReporterUpdate(t *testing.T) {
+	t.Parallel()
+
+	socket, messages := fakeNotifySocket(t)
+	readyFile := filepath.Join(t.TempDir(), "ready")
+	reporter := readiness.NewReporter(readyFile, lookupEnv(map[string]string{readiness.NotifySocketEnv: socket}))
+	require.True(t, reporter.Enabled())
+
+	// The ready file of a previous agent is removed.
+	require.NoError(t, os.WriteFile(readyFile, []byte("1\n"), 0o600))
+
+	reporter.Update(errNotReady)
+	assert.Equal(t, "STATUS=not ready: the subsystems are starting", receive(t, messages))
+	assert.NoFileExists(t, readyFile)
+
+	ready, status := reporter.Ready()
+	assert.False(t, ready)
+	assert.Equal(t, "not ready: the subsystems are starting", status)
+
+	// The ready file is only written once the agent is ready.
+	reporter.Update(nil)
+	assert.Equal(t, "READY=1\nSTATUS=ready", receive(t, messages))
+
+	data, err := os.ReadFile(readyFile)
+	require.NoError(t, err)
+	assert.Equal(t, strconv.Itoa(os.Getpid())+"\n", string(data))
+
+	// The same readiness is not reported again.
+	reporter.Update(nil)
+
+	reporter.Update(readiness.ErrPeerLost)
+	assert.Equal(t, "STATUS=not ready: the forwarder lost its peer", receive(t, messages))
+	assert.NoFileExists(t, readyFile)
+
+	reporter.Update(nil)
+	assert.Equal(t, "READY=1\nSTATUS=ready", receive(t, messages))
+	assert.FileExists(t, readyFile)
+
+	reporter.Stop()
+	assert.Equal(t, "STOPPING=1\nSTATUS=stopping", receive(t, messages))
+	assert.NoFileExists(t, readyFile)
+
+	ready, _ = reporter.Ready()
+	assert.False(t, ready)
+}
+
+func TestReporterDegraded(t *testing.T) {
+	t.Parallel()
+
+	socket, messages := fakeNotifySocket(t)
+	readyFile := filepath.Join(t.TempDir(), "ready")
+	reporter := readiness.NewReporter(readyFile, lookupEnv(map[string]string{readiness.NotifySocketEnv: socket}))
+
+	// The degraded agent is still ready, with the reason in its status.
+	reporter.Update(fmt.Errorf("%w: the peer is unreachable", readiness.ErrDegraded))
+	assert.Equal(t, "READY=1\nSTATUS=degraded: the peer is unreachable", receive(t, messages))
+	assert.FileExists(t, readyFile)
+
+	ready, status := reporter.Ready()
+	assert.True(t, ready)
+	assert.Equal(t, "degraded: the peer is unreachable", status)
+
+	reporter.Update(nil)
+	assert.Equal(t, "READY=1\nSTATUS=ready", receive(t, messages))
+	assert.FileExists(t, readyFile)
+
+	reporter.Update(errNotReady)
+	assert.Equal(t, "STATUS=not ready: the subsystems are starting", receive(t, messages))
+	assert.NoFileExists(t, readyFile)
+}
+
+func TestReporterDisabled(t *testing.T) {
+	t.Parallel()
+
+	reporter := readiness.NewReporter("", lookupEnv(nil))
+	assert.False(t, reporter.Enabled())
+
+	// Nothing is reported, nor does it fail.
+	reporter.Update(nil)
+	reporter.Stop()
+}
+
+func TestReporterWatch(t *testing.T) {
+	t.Parallel()
+
+	socket, messages := fakeNotifySocket(t)
+	readyFile := filepath.Join(t.TempDir(), "ready")
+	reporter := readiness.NewReporter(readyFile, lookupEnv(map[string]string{
+		readiness.NotifySocketEnv: socket,
+		readiness.WatchdogUSecEnv: "20000",
+		readiness.WatchdogPIDEnv:  strconv.Itoa(os.Getpid()),
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	checkCh := make(chan error)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		// The checks are run at least every half interval of the watchdog.
+		reporter.Watch(ctx, time.Hour, func() error { return <-checkCh })
+	}()
+
+	checkCh <- errNotReady
+	assert.Equal(t, "STATUS=not ready: the subsystems are starting", receive(t, messages))
+	assert.Equal(t, "WATCHDOG=1", receive(t, messages))
+	assert.NoFileExists(t, readyFile)
+
+	// The ready file is written as soon as the check passes.
+	checkCh <- nil
+	assert.Equal(t, "READY=1\nSTATUS=ready", receive(t, messages))
+	assert.FileExists(t, readyFile)
+	assert.Equal(t, "WATCHDOG=1", receive(t, messages))
+
+	checkCh <- nil
+	assert.Equal(t, "WATCHDOG=1", receive(t, messages))
+
+	cancel()
+
+	select {
+	case checkCh <- nil:
+	case <-done:
+	}
+	<-done
+}
+
+func TestReporterWatchdogOfAnotherProcess(t *testing.T) {
+	t.Parallel()
+
+	socket, messages := fakeNotifySocket(t)
+	reporter := readiness.NewReporter("", lookupEnv(map[string]string{
+		readiness.NotifySocketEnv: socket,
+		readiness.WatchdogUSecEnv: "20000",
+		readiness.WatchdogPIDEnv:  "1",
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	reporter.Watch(ctx, time.Hour, func() error { return nil })
+	assert.Equal(t, "READY=1\nSTATUS=ready", receive(t, messages))
+
+	select {
+	case message := <-messages:
+		assert.Failf(t, "unexpected notification", "%q", message)
+	default:
+	}
+}
+
+func TestPeerCheck(t *testing.T) {
+	t.Parallel()
+
+	var lastContact time.Time
+
+	check := readiness.PeerCheck(func() time.Time { return lastContact }, time.Minute)
+	require.ErrorContains(t, check(), "has not reached its peer yet")
+
+	lastContact = time.Now().Add(-30 * time.Second)
+	require.NoError(t, check())
+
+	// The peer is lost once the grace period is over.
+	lastContact = time.Now().Add(-2 * time.Minute)
+	require.ErrorIs(t, check(), readiness.ErrPeerLost)
+}
+
+func TestAll(t *testing.T) {
+	t.Parallel()
+
+	ready := func() error { return nil }
+	notReady := func() error { return errNotReady }
+
+	require.NoError(t, readiness.All()())
+	require.NoError(t, readiness.All(ready, ready)())
+	require.ErrorIs(t, readiness.All(ready, notReady, func() error { return readiness.ErrPeerLost })(), errNotReady)
+
+	// The agent is only degraded when it is otherwise ready.
+	degraded := readiness.Degraded(func() error { return readiness.ErrPeerLost })
+	require.ErrorIs(t, readiness.All(ready, degraded)(), readiness.ErrDegraded)
+	require.ErrorIs(t, readiness.All(ready, degraded)(), readiness.ErrPeerLost)
+	require.ErrorIs(t, readiness.All(degraded, notReady)(), errNotReady)
+	require.NotErrorIs(t, readiness.All(degraded, notReady)(), readiness.ErrDegraded)
+	require.NoError(t, readiness.All(readiness.Degraded(ready))())
+}
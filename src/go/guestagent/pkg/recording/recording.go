@@ -0,0 +1,143 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package recording writes the events that the subsystems receive to a file,
+// one JSON line for each, and replays them through the same handlers, so
+// that the port mappings that a user ran into can be reproduced offline.
+package recording
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxLineSize is the size of the longest line that can be replayed.
+const maxLineSize = 1 << 20
+
+// ErrUnknownSource is returned by Replay for a record of a source that it has no handler for.
+var ErrUnknownSource = errors.New("no handler for the source of the record")
+
+// Record is a line of a recording.
+type Record struct {
+	// Time is when the event was received, the replay keeps the time between the events.
+	Time time.Time `json:"time"`
+	// Source is the subsystem that received the event, e.g. tracker.SourceDocker.
+	Source string `json:"source"`
+	// Event is the event as its subsystem records it, only with what the
+	// port mappings depend on; e.g. not the environment of a container.
+	Event json.RawMessage `json:"event"`
+}
+
+// Recorder writes the events to a recording, it is safe for concurrent use.
+// A nil Recorder records nothing, so that the subsystems do not check for it.
+type Recorder struct {
+	output io.Writer
+	mutex  sync.Mutex
+}
+
+// NewRecorder creates a recorder that writes the records to the output.
+func NewRecorder(output io.Writer) *Recorder {
+	return &Recorder{output: output}
+}
+
+// Record writes the event of the source, which is encoded as JSON.
+func (r *Recorder) Record(source string, event any) error {
+	if r == nil {
+		return nil
+	}
+
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode the %s event: %w", source, err)
+	}
+
+	line, err := json.Marshal(Record{Time: time.Now(), Source: source, Event: encoded})
+	if err != nil {
+		return fmt.Errorf("failed to encode the %s event: %w", source, err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, err := r.output.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to record the %s event: %w", source, err)
+	}
+
+	return nil
+}
+
+// Handler handles an event of a recording, as its subsystem handles the events that it receives.
+type Handler func(ctx context.Context, event json.RawMessage) error
+
+// Replay feeds the records of the input to the handlers of their sources, in
+// order. The time between the records is divided by speed, so that a speed of
+// 10 replays them ten times faster than they were received; they are replayed
+// without waiting when it is not positive. It stops at the first error.
+func Replay(ctx context.Context, input io.Reader, speed float64, handlers map[string]Handler) error {
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(nil, maxLineSize)
+
+	var last time.Time
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return fmt.Errorf("failed to decode the record on line %d: %w", line, err)
+		}
+
+		handler, ok := handlers[record.Source]
+		if !ok {
+			return fmt.Errorf("%w: %q on line %d", ErrUnknownSource, record.Source, line)
+		}
+
+		if speed > 0 && !last.IsZero() && record.Time.After(last) {
+			if err := sleep(ctx, time.Duration(float64(record.Time.Sub(last))/speed)); err != nil {
+				return err
+			}
+		}
+
+		last = record.Time
+
+		if err := handler(ctx, record.Event); err != nil {
+			return fmt.Errorf("failed to replay the %s event on line %d: %w", record.Source, line, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read the recording: %w", err)
+	}
+
+	return nil
+}
+
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
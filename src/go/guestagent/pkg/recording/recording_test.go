@@ -0,0 +1,128 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package recording_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/recording"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testEvent struct {
+	ID string `json:"id"`
+}
+
+// collect returns a handler that appends the IDs of the events it handles.
+func collect(ids *[]string) recording.Handler {
+	return func(_ context.Context, recorded json.RawMessage) error {
+		var event testEvent
+		if err := json.Unmarshal(recorded, &event); err != nil {
+			return err
+		}
+
+		*ids = append(*ids, event.ID)
+
+		return nil
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	t.Parallel()
+
+	var buffer bytes.Buffer
+
+	recorder := recording.NewRecorder(&buffer)
+	require.NoError(t, recorder.Record("docker", testEvent{ID: "web"}))
+	require.NoError(t, recorder.Record("kubernetes", testEvent{ID: "nginx"}))
+	require.NoError(t, recorder.Record("docker", testEvent{ID: "db"}))
+
+	var docker, kubernetes []string
+
+	err := recording.Replay(context.Background(), &buffer, 0, map[string]recording.Handler{
+		"docker":     collect(&docker),
+		"kubernetes": collect(&kubernetes),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web", "db"}, docker)
+	assert.Equal(t, []string{"nginx"}, kubernetes)
+}
+
+func TestNilRecorder(t *testing.T) {
+	t.Parallel()
+
+	var recorder *recording.Recorder
+	assert.NoError(t, recorder.Record("docker", testEvent{ID: "web"}))
+}
+
+func TestReplaySpeed(t *testing.T) {
+	t.Parallel()
+
+	// The records are a second apart, which takes 50ms at 20 times the speed.
+	input := `{"time":"2026-03-02T10:00:00Z","source":"docker","event":{"id":"web"}}
+{"time":"2026-03-02T10:00:01Z","source":"docker","event":{"id":"db"}}
+`
+
+	var ids []string
+
+	start := time.Now()
+	err := recording.Replay(context.Background(), strings.NewReader(input), 20, map[string]recording.Handler{
+		"docker": collect(&ids),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"web", "db"}, ids)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Less(t, time.Since(start), time.Second)
+
+	// The replay stops waiting once the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err = recording.Replay(ctx, strings.NewReader(input), 1, map[string]recording.Handler{
+		"docker": collect(&ids),
+	})
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+func TestReplayErrors(t *testing.T) {
+	t.Parallel()
+
+	var ids []string
+
+	handlers := map[string]recording.Handler{"docker": collect(&ids)}
+
+	err := recording.Replay(context.Background(), strings.NewReader(`{"source":"containerd","event":{}}`), 0, handlers)
+	require.ErrorIs(t, err, recording.ErrUnknownSource)
+	assert.ErrorContains(t, err, "line 1")
+
+	err = recording.Replay(context.Background(), strings.NewReader("\n{\n"), 0, handlers)
+	assert.ErrorContains(t, err, "line 2")
+
+	errHandler := errors.New("handler failed")
+	err = recording.Replay(context.Background(), strings.NewReader(`{"source":"docker","event":{}}`), 0,
+		map[string]recording.Handler{
+			"docker": func(context.Context, json.RawMessage) error {
+				return errHandler
+			},
+		})
+	require.ErrorIs(t, err, errHandler)
+	assert.Empty(t, ids)
+}
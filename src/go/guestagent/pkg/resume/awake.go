@@ -0,0 +1,86 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resume
+
+import (
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+// Awake measures how long the agent was awake, from the clock of the timers.
+// The clock of the timers does not stop while the VM is paused on some hosts,
+// after which the timers and the deadlines that were set before expire at
+// once, e.g. the leases of the port mappings or the timeout of a wait. Its
+// steps between two observations that are longer than their interval by
+// ClockJump or more are counted as a single interval: the rest of the step is
+// the time that the agent was suspended.
+type Awake struct {
+	// Now returns the time of the clock of the timers, e.g. time.Now.
+	Now func() time.Time
+	// Interval is the longest time that is expected between two
+	// observations, e.g. the interval of a ticker.
+	Interval  time.Duration
+	ClockJump time.Duration
+
+	started bool
+	last    time.Time
+	elapsed time.Duration
+}
+
+// NewAwake returns the awake time of the clock of the system, which is
+// observed at least every interval, with the default clock jump.
+func NewAwake(interval time.Duration) *Awake {
+	return &Awake{
+		Now:       time.Now,
+		Interval:  interval,
+		ClockJump: DefaultClockJump,
+	}
+}
+
+// Observe observes the clock, and returns whether it jumped since the last
+// observation; the first observation starts the awake time.
+func (a *Awake) Observe() bool {
+	now := a.Now()
+
+	if !a.started {
+		a.started = true
+		a.last = now
+
+		return false
+	}
+
+	step := now.Sub(a.last)
+	a.last = now
+
+	if step >= a.Interval+a.ClockJump {
+		log.Debugf("the clock jumped by %s, counting %s of it as awake", step, a.Interval)
+
+		a.elapsed += a.Interval
+
+		return true
+	}
+
+	a.elapsed += max(step, 0)
+
+	return false
+}
+
+// Elapsed observes the clock, and returns how long the agent was awake
+// since the first observation.
+func (a *Awake) Elapsed() time.Duration {
+	a.Observe()
+
+	return a.elapsed
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resume_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/resume"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAwake(t *testing.T) {
+	t.Parallel()
+
+	tests := map[string]struct {
+		steps   []time.Duration
+		elapsed time.Duration
+		jumps   int
+	}{
+		"steady": {
+			steps:   []time.Duration{interval, interval, interval},
+			elapsed: 3 * interval,
+		},
+		"late observations": {
+			steps:   []time.Duration{interval, 4 * interval, interval},
+			elapsed: 6 * interval,
+		},
+		"paused for 2 hours": {
+			steps:   []time.Duration{interval, 2 * time.Hour, interval},
+			elapsed: 3 * interval,
+			jumps:   1,
+		},
+		"clock set back": {
+			steps:   []time.Duration{interval, -time.Hour, interval},
+			elapsed: 2 * interval,
+		},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+			awake := resume.NewAwake(interval)
+			awake.Now = func() time.Time { return now }
+
+			assert.Zero(t, awake.Elapsed())
+
+			var jumps int
+
+			for _, step := range tt.steps {
+				now = now.Add(step)
+
+				if awake.Observe() {
+					jumps++
+				}
+			}
+
+			assert.Equal(t, tt.elapsed, awake.Elapsed())
+			assert.Equal(t, tt.jumps, jumps)
+		})
+	}
+}
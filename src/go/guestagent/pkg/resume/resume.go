@@ -0,0 +1,198 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package resume detects that the host resumed from sleep, after which the
+// vtunnel peer, the NAT mappings and the addresses of the VM often come back
+// subtly broken, and repairs the forwards that the agent set up.
+package resume
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+const (
+	// DefaultClockJump is how far the clocks must jump between two checks,
+	// beyond the interval between them, for the host to have slept.
+	DefaultClockJump = 30 * time.Second
+	// DefaultFailureBurst is how many sends of the forwarder must fail between
+	// two checks, after DefaultQuiescence without any failure.
+	DefaultFailureBurst = 5
+	DefaultQuiescence   = 5 * time.Minute
+	// DefaultCooldown is the least time between two recoveries, so that the
+	// failures that the recovery itself runs into do not start another one.
+	DefaultCooldown = 2 * time.Minute
+)
+
+// Detector detects that the host resumed from sleep, either from the clocks,
+// or from a burst of failed sends after the forwarder was quiet for a while.
+// It is conservative: a host that merely slowed down does not look resumed.
+type Detector struct {
+	// Wall returns the wall clock time, which the time synchronization of the
+	// VM moves forward once the host resumes, e.g. time.Now().Round(0).
+	Wall func() time.Time
+	// Monotonic returns the time since a fixed point, which does not advance
+	// while the VM is suspended, e.g. time.Since with a start time.
+	Monotonic func() time.Duration
+	// Failures returns the number of failed sends of the forwarder so far,
+	// the failed sends are not checked when it is nil.
+	Failures func() uint64
+	// ClockJump, FailureBurst, Quiescence and Cooldown are the thresholds,
+	// see the defaults; a zero ClockJump or FailureBurst disables its check.
+	ClockJump    time.Duration
+	FailureBurst uint64
+	Quiescence   time.Duration
+	Cooldown     time.Duration
+
+	checked      bool
+	lastWall     time.Time
+	lastTick     time.Duration
+	lastFailures uint64
+	// lastFailing is when the failed sends last increased, or the first check.
+	lastFailing time.Duration
+	recovered   bool
+	lastRecover time.Duration
+}
+
+// NewDetector returns the detector with the clocks of the system and
+// the default thresholds, failures is the same as Detector.Failures.
+func NewDetector(failures func() uint64) *Detector {
+	start := time.Now()
+
+	return &Detector{
+		Wall:         func() time.Time { return time.Now().Round(0) },
+		Monotonic:    func() time.Duration { return time.Since(start) },
+		Failures:     failures,
+		ClockJump:    DefaultClockJump,
+		FailureBurst: DefaultFailureBurst,
+		Quiescence:   DefaultQuiescence,
+		Cooldown:     DefaultCooldown,
+	}
+}
+
+// Check compares the clocks and the failed sends with the last check, which
+// was expected the interval ago, and returns why the host is believed to have
+// resumed since; it returns "" otherwise, and within the cooldown of the last
+// time it did not. The first check only records the state to compare with.
+func (d *Detector) Check(interval time.Duration) string {
+	wall, tick := d.Wall(), d.Monotonic()
+
+	var failures uint64
+	if d.Failures != nil {
+		failures = d.Failures()
+	}
+
+	if !d.checked {
+		d.checked = true
+		d.lastWall, d.lastTick, d.lastFailures, d.lastFailing = wall, tick, failures, tick
+
+		return ""
+	}
+
+	wallElapsed, tickElapsed := wall.Sub(d.lastWall), tick-d.lastTick
+	newFailures := failures - d.lastFailures
+	quiet := tick - d.lastFailing
+
+	d.lastWall, d.lastTick, d.lastFailures = wall, tick, failures
+	if newFailures > 0 {
+		d.lastFailing = tick
+	}
+
+	reason := d.reason(interval, wallElapsed, tickElapsed, newFailures, quiet)
+	if reason == "" || (d.recovered && tick-d.lastRecover < d.Cooldown) {
+		return ""
+	}
+
+	d.recovered, d.lastRecover = true, tick
+
+	return reason
+}
+
+func (d *Detector) reason(interval, wallElapsed, tickElapsed time.Duration, newFailures uint64, quiet time.Duration) string {
+	switch {
+	case d.ClockJump == 0:
+	case wallElapsed-tickElapsed > d.ClockJump:
+		// The monotonic clock stopped while the VM was suspended.
+		return fmt.Sprintf("the wall clock jumped %s ahead of the monotonic clock",
+			(wallElapsed - tickElapsed).Round(time.Second))
+	case tickElapsed-interval > d.ClockJump:
+		// The VM was paused without stopping the monotonic clock.
+		return fmt.Sprintf("the check was due %s ago, but ran %s late",
+			interval, (tickElapsed - interval).Round(time.Second))
+	}
+
+	if d.FailureBurst > 0 && newFailures >= d.FailureBurst && quiet >= d.Quiescence {
+		return fmt.Sprintf("%d sends of the forwarder failed after %s without a failure",
+			newFailures, quiet.Round(time.Second))
+	}
+
+	return ""
+}
+
+// Watch calls Check at every interval until the context is cancelled, and
+// onResume with the reason when the host resumed. The interval starts over
+// once onResume returns, since the ticker may have fired erratically.
+func (d *Detector) Watch(ctx context.Context, interval time.Duration, onResume func(ctx context.Context, reason string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	d.Check(interval)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if reason := d.Check(interval); reason != "" {
+				onResume(ctx, reason)
+				ticker.Reset(interval)
+			}
+		}
+	}
+}
+
+// Step is a step of the recovery, see Recover.
+type Step struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// Recover runs the steps in order after the host resumed, a step that fails
+// is logged and does not keep the next ones from running; the errors of the
+// steps are returned joined. It stops once the context is cancelled.
+func Recover(ctx context.Context, reason string, steps ...Step) error {
+	log.Infof("the host seems to have resumed from sleep, %s: repairing the port forwards", reason)
+
+	var errs []error
+
+	for _, step := range steps {
+		if ctx.Err() != nil {
+			return errors.Join(append(errs, ctx.Err())...)
+		}
+
+		if err := step.Run(ctx); err != nil {
+			log.Warnf("failed to %s after the host resumed: %v", step.Name, err)
+			errs = append(errs, fmt.Errorf("%s: %w", step.Name, err))
+
+			continue
+		}
+
+		log.Debugf("recovery step %q is done", step.Name)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,264 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package resume_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/resume"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const interval = 5 * time.Second
+
+// fakeClock is the injectable clock of the detector, whose monotonic
+// clock stops while the host sleeps.
+type fakeClock struct {
+	wall     time.Time
+	tick     time.Duration
+	failures uint64
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.wall = c.wall.Add(d)
+	c.tick += d
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.wall = c.wall.Add(d)
+}
+
+func newDetector() (*resume.Detector, *fakeClock) {
+	clock := &fakeClock{wall: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)}
+	detector := resume.NewDetector(func() uint64 { return clock.failures })
+	detector.Wall = func() time.Time { return clock.wall }
+	detector.Monotonic = func() time.Duration { return clock.tick }
+
+	return detector, clock
+}
+
+func TestDetectorClockJump(t *testing.T) {
+	t.Parallel()
+
+	detector, clock := newDetector()
+	assert.Empty(t, detector.Check(interval))
+
+	for range 10 {
+		clock.advance(interval)
+		assert.Empty(t, detector.Check(interval))
+	}
+
+	// The wall clock is set forward once the host resumes.
+	clock.sleep(time.Hour)
+	clock.advance(interval)
+	assert.Equal(t, "the wall clock jumped 1h0m0s ahead of the monotonic clock", detector.Check(interval))
+
+	clock.advance(interval)
+	assert.Empty(t, detector.Check(interval))
+}
+
+func TestDetectorLateCheck(t *testing.T) {
+	t.Parallel()
+
+	detector, clock := newDetector()
+	detector.Check(interval)
+
+	// The monotonic clock kept running while the VM was paused.
+	clock.advance(10 * time.Minute)
+	assert.Equal(t, "the check was due 5s ago, but ran 9m55s late", detector.Check(interval))
+}
+
+func TestDetectorSmallDrift(t *testing.T) {
+	t.Parallel()
+
+	detector, clock := newDetector()
+	detector.Check(interval)
+
+	// The time synchronization and a busy host do not look like resuming.
+	clock.sleep(10 * time.Second)
+	clock.advance(interval)
+	assert.Empty(t, detector.Check(interval))
+
+	clock.sleep(-time.Hour)
+	clock.advance(interval)
+	assert.Empty(t, detector.Check(interval))
+
+	clock.advance(interval + 20*time.Second)
+	assert.Empty(t, detector.Check(interval))
+}
+
+func TestDetectorFailureBurst(t *testing.T) {
+	t.Parallel()
+
+	detector, clock := newDetector()
+	detector.Check(interval)
+
+	// The failures right after starting are not after a quiet forwarder.
+	clock.failures = resume.DefaultFailureBurst
+	clock.advance(interval)
+	assert.Empty(t, detector.Check(interval))
+
+	// Neither are the ones that keep on going.
+	for range 10 {
+		clock.failures += resume.DefaultFailureBurst
+		clock.advance(interval)
+		assert.Empty(t, detector.Check(interval))
+	}
+
+	for clock.tick < 20*time.Minute {
+		clock.advance(interval)
+		assert.Empty(t, detector.Check(interval))
+	}
+
+	// A few failures are not a burst.
+	clock.failures += resume.DefaultFailureBurst - 1
+	clock.advance(interval)
+	assert.Empty(t, detector.Check(interval))
+
+	for clock.tick < 30*time.Minute {
+		clock.advance(interval)
+		assert.Empty(t, detector.Check(interval))
+	}
+
+	clock.failures += resume.DefaultFailureBurst
+	clock.advance(interval)
+	assert.Equal(t, "5 sends of the forwarder failed after 10m0s without a failure", detector.Check(interval))
+}
+
+func TestDetectorCooldown(t *testing.T) {
+	t.Parallel()
+
+	detector, clock := newDetector()
+	detector.Check(interval)
+
+	clock.sleep(time.Hour)
+	clock.advance(interval)
+	require.NotEmpty(t, detector.Check(interval))
+
+	// The host that sleeps again right away is only recovered from after the cooldown.
+	clock.sleep(time.Hour)
+	clock.advance(interval)
+	assert.Empty(t, detector.Check(interval))
+
+	clock.advance(resume.DefaultCooldown)
+	clock.sleep(time.Hour)
+	assert.NotEmpty(t, detector.Check(interval))
+}
+
+func TestDetectorDisabled(t *testing.T) {
+	t.Parallel()
+
+	detector, clock := newDetector()
+	detector.ClockJump = 0
+	detector.FailureBurst = 0
+	detector.Check(interval)
+
+	clock.sleep(time.Hour)
+	clock.advance(time.Hour)
+	clock.failures = 100
+	assert.Empty(t, detector.Check(interval))
+}
+
+func TestDetectorWatch(t *testing.T) {
+	t.Parallel()
+
+	detector, clock := newDetector()
+
+	var (
+		calls   = make(chan int, 1)
+		reasons = make(chan string, 1)
+	)
+
+	calls <- 0
+
+	// The clock jumps once the detector checked a few times.
+	detector.Wall = func() time.Time {
+		count := <-calls
+		defer func() { calls <- count + 1 }()
+
+		if count == 3 {
+			clock.sleep(time.Hour)
+		}
+
+		return clock.wall
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go detector.Watch(ctx, time.Millisecond, func(_ context.Context, reason string) {
+		reasons <- reason
+	})
+
+	select {
+	case reason := <-reasons:
+		assert.Contains(t, reason, "the wall clock jumped 1h0m0s")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the detector did not detect the clock jump")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	t.Parallel()
+
+	var ran []string
+
+	step := func(name string, err error) resume.Step {
+		return resume.Step{Name: name, Run: func(context.Context) error {
+			ran = append(ran, name)
+
+			return err
+		}}
+	}
+
+	errReconnect := errors.New("no peer")
+
+	// The steps run in order, even after one of them failed.
+	err := resume.Recover(context.Background(), "the wall clock jumped",
+		step("detect the addresses", nil),
+		step("reconnect the forwarder", errReconnect),
+		step("resync", nil),
+	)
+	require.ErrorIs(t, err, errReconnect)
+	assert.ErrorContains(t, err, "reconnect the forwarder: no peer")
+	assert.Equal(t, []string{"detect the addresses", "reconnect the forwarder", "resync"}, ran)
+}
+
+func TestRecoverCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var ran []string
+
+	err := resume.Recover(ctx, "the wall clock jumped",
+		resume.Step{Name: "detect the addresses", Run: func(context.Context) error {
+			ran = append(ran, "detect the addresses")
+			cancel()
+
+			return nil
+		}},
+		resume.Step{Name: "resync", Run: func(context.Context) error {
+			ran = append(ran, "resync")
+
+			return nil
+		}},
+	)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, []string{"detect the addresses"}, ran)
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package retry schedules the retries of the operations that fail, with an
+// exponential backoff of random delays, so that the subsystems, and the
+// agents, that failed at the same time do not retry in step.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ErrBudgetExhausted is returned by Wait once the retries used up the budget
+// of their policy.
+var ErrBudgetExhausted = errors.New("retry budget exhausted")
+
+// Policy is how an operation is retried.
+type Policy struct {
+	// Initial is the longest delay before the first retry, which doubles
+	// with every retry up to Max; Max is Initial if it is lower.
+	Initial time.Duration
+	Max     time.Duration
+	// Budget is how long the retries may take from the first one, 0 retries
+	// for as long as it takes.
+	Budget time.Duration
+	// Source draws the delays, the global source if nil; a seeded one, see
+	// NewSource, makes the schedule deterministic.
+	Source rand.Source
+}
+
+// Start returns the schedule of the retries of an operation under the policy.
+func (p Policy) Start() *Backoff {
+	p.Max = max(p.Max, p.Initial)
+
+	backoff := &Backoff{policy: p, now: time.Now}
+	if p.Source != nil {
+		backoff.rand = rand.New(p.Source)
+	}
+
+	return backoff
+}
+
+// Backoff is the schedule of the retries of an operation, it is not safe for
+// concurrent use.
+type Backoff struct {
+	policy Policy
+	rand   *rand.Rand
+	now    func() time.Time
+	// started is when the first retry was scheduled, the budget is spent from it.
+	started time.Time
+	// ceiling is the longest delay of the next retry.
+	ceiling time.Duration
+	retries int
+}
+
+// SetClock sets the clock that the budget is measured with, time.Now by default.
+func (b *Backoff) SetClock(now func() time.Time) {
+	b.now = now
+}
+
+// Next returns the delay before the next retry, and false once the budget is
+// used up. The delay is drawn evenly up to a ceiling that doubles with every
+// retry ("full jitter"), and the last one is cut short to end with the budget.
+func (b *Backoff) Next() (time.Duration, bool) {
+	now := b.now()
+	if b.retries == 0 {
+		b.started = now
+		b.ceiling = b.policy.Initial
+	}
+
+	delay := b.draw(b.ceiling)
+
+	if b.policy.Budget > 0 {
+		remaining := b.policy.Budget - now.Sub(b.started)
+		if remaining <= 0 {
+			return 0, false
+		}
+
+		delay = min(delay, remaining)
+	}
+
+	b.retries++
+	b.ceiling = min(2*b.ceiling, b.policy.Max)
+
+	return delay, true
+}
+
+// Wait waits for the delay before the next retry, see Next. It fails with
+// ErrBudgetExhausted once the budget is used up, or with the error of ctx
+// once it is done.
+func (b *Backoff) Wait(ctx context.Context) error {
+	delay, ok := b.Next()
+	if !ok {
+		return ErrBudgetExhausted
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Retries returns how many retries were scheduled since the start, or the
+// last reset.
+func (b *Backoff) Retries() int {
+	return b.retries
+}
+
+// Reset starts the schedule over, along with its budget, e.g. once the
+// operation succeeded.
+func (b *Backoff) Reset() {
+	b.retries = 0
+}
+
+func (b *Backoff) draw(ceiling time.Duration) time.Duration {
+	if ceiling <= 0 {
+		return 0
+	}
+
+	if b.rand == nil {
+		return rand.N(ceiling + 1)
+	}
+
+	return time.Duration(b.rand.Int64N(int64(ceiling) + 1))
+}
+
+// NewSource returns a random source seeded with seed, for the tests that need
+// the delays to be the same every time. It is safe for concurrent use, so the
+// backoffs of several policies may share it.
+func NewSource(seed uint64) rand.Source {
+	return &lockedSource{source: rand.NewPCG(seed, seed)}
+}
+
+type lockedSource struct {
+	source rand.Source
+	mutex  sync.Mutex
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.source.Uint64()
+}
@@ -0,0 +1,118 @@
+//go:build integration
+
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retry_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/retry"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestDesynchronizedRetriesIntegration makes three forwarders, like the
+// ones of three VMs, fail to reach the same peer at the same moment, and
+// checks that their retries spread out rather than hitting it in step.
+func TestDesynchronizedRetriesIntegration(t *testing.T) {
+	// The peer refuses the connections, since nothing listens on its port.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	peerAddr := closed.Addr().String()
+	require.NoError(t, closed.Close())
+
+	const consumers = 3
+
+	var (
+		started = time.Now()
+		dials   [consumers][]time.Duration
+		wg      sync.WaitGroup
+	)
+
+	failed := make(chan struct{})
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}}},
+	}
+
+	for i := range consumers {
+		vtunnelForwarder := forwarder.NewVTunnelForwarder(peerAddr)
+		vtunnelForwarder.EnableRetry(20*time.Millisecond, 800*time.Millisecond)
+		vtunnelForwarder.SetRetrySource(retry.NewSource(uint64(i + 1)))
+		vtunnelForwarder.SetDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dials[i] = append(dials[i], time.Since(started))
+
+			var dialer net.Dialer
+
+			return dialer.DialContext(ctx, network, address)
+		})
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			<-failed
+
+			err := vtunnelForwarder.Send(context.Background(), portMapping)
+			assert.ErrorIs(t, err, syscall.ECONNREFUSED, "consumer %d", i)
+			assert.ErrorContains(t, err, "giving up sending port mapping after", "consumer %d", i)
+		}()
+	}
+
+	// The peer goes away for all of them at once.
+	started = time.Now()
+
+	close(failed)
+	wg.Wait()
+
+	retries := len(dials[0])
+	for i := range consumers {
+		t.Logf("consumer %d dialed at %v", i, dials[i])
+		require.Greater(t, len(dials[i]), 2, "consumer %d did not retry", i)
+		retries = min(retries, len(dials[i]))
+	}
+
+	// The first attempts are made together, the retries drift apart: in
+	// step, the same retries would be made within a few milliseconds.
+	spread := func(attempt int) time.Duration {
+		earliest, latest := dials[0][attempt], dials[0][attempt]
+		for i := 1; i < consumers; i++ {
+			earliest = min(earliest, dials[i][attempt])
+			latest = max(latest, dials[i][attempt])
+		}
+
+		return latest - earliest
+	}
+
+	require.Less(t, spread(0), 100*time.Millisecond, "the first attempts were not made together")
+
+	var total time.Duration
+
+	for attempt := 1; attempt < retries; attempt++ {
+		total += spread(attempt)
+	}
+
+	mean := total / time.Duration(retries-1)
+	assert.Greater(t, mean, 10*time.Millisecond, "the retries are in step, %s apart on average", mean)
+}
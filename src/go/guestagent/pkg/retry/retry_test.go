@@ -0,0 +1,163 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package retry_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// schedule returns the first n delays of the policy.
+func schedule(t *testing.T, policy retry.Policy, n int) []time.Duration {
+	t.Helper()
+
+	backoff := policy.Start()
+	delays := make([]time.Duration, 0, n)
+
+	for range n {
+		delay, ok := backoff.Next()
+		require.True(t, ok)
+
+		delays = append(delays, delay)
+	}
+
+	return delays
+}
+
+func TestBackoffScheduleShape(t *testing.T) {
+	t.Parallel()
+
+	// The ceilings double up to the max: 10ms, 20ms, 40ms, 80ms, 100ms, 100ms.
+	ceilings := []time.Duration{10, 20, 40, 80, 100, 100}
+	for i := range ceilings {
+		ceilings[i] *= time.Millisecond
+	}
+
+	source := retry.NewSource(1)
+	longest := make([]time.Duration, len(ceilings))
+	total := make([]time.Duration, len(ceilings))
+
+	const runs = 1000
+
+	for range runs {
+		policy := retry.Policy{Initial: 10 * time.Millisecond, Max: 100 * time.Millisecond, Source: source}
+
+		for i, delay := range schedule(t, policy, len(ceilings)) {
+			require.GreaterOrEqual(t, delay, time.Duration(0), "delay %d", i)
+			require.LessOrEqual(t, delay, ceilings[i], "delay %d", i)
+
+			longest[i] = max(longest[i], delay)
+			total[i] += delay
+		}
+	}
+
+	// The delays are spread evenly up to their ceiling.
+	for i, ceiling := range ceilings {
+		assert.Greater(t, longest[i], ceiling*9/10, "longest delay %d", i)
+		assert.InDelta(t, float64(ceiling/2), float64(total[i]/runs), float64(ceiling/10), "mean delay %d", i)
+	}
+}
+
+func TestBackoffSeeded(t *testing.T) {
+	t.Parallel()
+
+	policy := func(seed uint64) retry.Policy {
+		return retry.Policy{Initial: time.Second, Max: time.Minute, Source: retry.NewSource(seed)}
+	}
+
+	// The same seed draws the same schedule, another one draws another.
+	assert.Equal(t, schedule(t, policy(1), 10), schedule(t, policy(1), 10))
+	assert.NotEqual(t, schedule(t, policy(1), 10), schedule(t, policy(2), 10))
+}
+
+func TestBackoffBudget(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	backoff := retry.Policy{
+		Initial: 100 * time.Millisecond,
+		Max:     time.Second,
+		Budget:  3 * time.Second,
+		Source:  retry.NewSource(1),
+	}.Start()
+	backoff.SetClock(func() time.Time { return now })
+
+	var elapsed time.Duration
+
+	for {
+		delay, ok := backoff.Next()
+		if !ok {
+			break
+		}
+
+		elapsed += delay
+		now = now.Add(delay)
+
+		require.Less(t, backoff.Retries(), 100, "the budget was not enforced")
+	}
+
+	// The last delay is cut short to end with the budget.
+	assert.Equal(t, 3*time.Second, elapsed)
+	assert.ErrorIs(t, backoff.Wait(context.Background()), retry.ErrBudgetExhausted)
+
+	// A reset starts the schedule and its budget over.
+	backoff.Reset()
+	assert.Zero(t, backoff.Retries())
+
+	delay, ok := backoff.Next()
+	assert.True(t, ok)
+	assert.LessOrEqual(t, delay, 100*time.Millisecond)
+}
+
+func TestBackoffUnlimited(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	backoff := retry.Policy{Initial: time.Minute, Max: time.Hour}.Start()
+	backoff.SetClock(func() time.Time { return now })
+
+	for range 1000 {
+		delay, ok := backoff.Next()
+		require.True(t, ok)
+		require.LessOrEqual(t, delay, time.Hour)
+
+		now = now.Add(delay)
+	}
+}
+
+func TestBackoffWaitCancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	backoff := retry.Policy{Initial: time.Hour}.Start()
+	done := make(chan error)
+
+	go func() {
+		done <- backoff.Wait(ctx)
+	}()
+
+	cancel()
+
+	select {
+	case err := <-done:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Wait did not return once its context was cancelled")
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scan lists the port mappings of the subsystems once, for -once,
+// instead of watching them for changes.
+package scan
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// Lister lists the port mappings of a subsystem, keyed by the ID that
+// the subsystem tracks them with, e.g. the ID of the container.
+type Lister func(ctx context.Context) (map[string]nat.PortMap, error)
+
+// Source is a subsystem that is listed, see Run.
+type Source struct {
+	// Name is the name of the subsystem, e.g. tracker.SourceDocker.
+	Name string
+	List Lister
+}
+
+// Entry is a port mapping of a subsystem.
+type Entry struct {
+	ID    string      `json:"id"`
+	Ports nat.PortMap `json:"ports"`
+}
+
+// SourceResult is the outcome of listing a subsystem.
+type SourceResult struct {
+	Name string `json:"name"`
+	// Entries are the port mappings of the subsystem, sorted by their ID.
+	Entries []Entry `json:"entries"`
+	// Error is why the subsystem could not be listed, if it could not.
+	Error string `json:"error,omitempty"`
+}
+
+// Snapshot is the outcome of sending the port mappings to the host.
+type Snapshot struct {
+	Forwarder string `json:"forwarder"`
+	// Error is why the snapshot could not be sent, if it could not.
+	Error string `json:"error,omitempty"`
+}
+
+// Result is the outcome of a scan, which -once prints as JSON.
+type Result struct {
+	Version string `json:"version"`
+	// Sources are the enabled subsystems, in the order they were listed.
+	Sources []SourceResult `json:"sources"`
+	// Snapshot is only set when the port mappings were sent to the host.
+	Snapshot *Snapshot `json:"snapshot,omitempty"`
+}
+
+// Run lists the sources in order, each of them within the timeout. The
+// sources that fail are reported in the result, along with the others.
+func Run(ctx context.Context, sources []Source, timeout time.Duration) Result {
+	result := Result{Sources: make([]SourceResult, 0, len(sources))}
+
+	for _, source := range sources {
+		result.Sources = append(result.Sources, list(ctx, source, timeout))
+	}
+
+	return result
+}
+
+func list(ctx context.Context, source Source, timeout time.Duration) SourceResult {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	sourceResult := SourceResult{Name: source.Name, Entries: []Entry{}}
+
+	portMaps, err := source.List(ctx)
+	if err != nil {
+		sourceResult.Error = err.Error()
+
+		return sourceResult
+	}
+
+	for id, ports := range portMaps {
+		sourceResult.Entries = append(sourceResult.Entries, Entry{ID: id, Ports: ports})
+	}
+
+	sort.Slice(sourceResult.Entries, func(i, j int) bool {
+		return sourceResult.Entries[i].ID < sourceResult.Entries[j].ID
+	})
+
+	return sourceResult
+}
+
+// Failed returns the names of the sources that could not be listed.
+func (r *Result) Failed() []string {
+	var failed []string
+
+	for _, source := range r.Sources {
+		if source.Error != "" {
+			failed = append(failed, source.Name)
+		}
+	}
+
+	return failed
+}
+
+// PortMapping returns the port mappings of all the sources as an
+// authoritative snapshot, to be sent to the host.
+func (r *Result) PortMapping(connectAddrs []types.ConnectAddrs) types.PortMapping {
+	ports := make(nat.PortMap)
+	sources := make(map[string]string)
+
+	for _, source := range r.Sources {
+		for _, entry := range source.Entries {
+			for port, bindings := range entry.Ports {
+				ports[port] = append(ports[port], bindings...)
+
+				for _, binding := range bindings {
+					sources[binding.HostPort+"/"+port.Proto()] = source.Name
+				}
+			}
+		}
+	}
+
+	if len(sources) == 0 {
+		sources = nil
+	}
+
+	return types.PortMapping{
+		Ports:         ports,
+		ConnectAddrs:  connectAddrs,
+		Families:      types.ConnectFamilies(connectAddrs),
+		Replace:       true,
+		Protocols:     types.PortProtocols(ports),
+		Sources:       sources,
+		HostBindAddrs: types.PortHostBindAddrs(ports),
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scan_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/scan"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+var errNotRunning = errors.New("the engine is not running")
+
+// fakeSources are a source that lists two containers, one that fails
+// and one that never answers.
+func fakeSources() []scan.Source {
+	return []scan.Source{
+		{
+			Name: "docker",
+			List: func(context.Context) (map[string]nat.PortMap, error) {
+				return map[string]nat.PortMap{
+					"web": {"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}}},
+					"db":  {"5432/tcp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "5432"}}},
+				}, nil
+			},
+		},
+		{
+			Name: "iptables",
+			List: func(context.Context) (map[string]nat.PortMap, error) {
+				return nil, errNotRunning
+			},
+		},
+		{
+			Name: "kubernetes",
+			List: func(ctx context.Context) (map[string]nat.PortMap, error) {
+				<-ctx.Done()
+
+				return nil, ctx.Err()
+			},
+		},
+	}
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	result := scan.Run(context.Background(), fakeSources(), 10*time.Millisecond)
+	result.Version = "1.2.3"
+	result.Snapshot = &scan.Snapshot{Forwarder: "vtunnel", Error: "the snapshot is not sent since [iptables] could not be listed"}
+
+	assert.Equal(t, []string{"iptables", "kubernetes"}, result.Failed())
+
+	bin, err := json.Marshal(result)
+	require.NoError(t, err)
+
+	var indented bytes.Buffer
+	require.NoError(t, json.Indent(&indented, bin, "", "  "))
+	indented.WriteByte('\n')
+
+	golden := filepath.Join("testdata", "result.golden.json")
+	if *update {
+		require.NoError(t, os.WriteFile(golden, indented.Bytes(), 0o644))
+	}
+
+	expected, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), indented.String())
+
+	// The output only has the fields of the schema.
+	decoder := json.NewDecoder(bytes.NewReader(expected))
+	decoder.DisallowUnknownFields()
+
+	var decoded scan.Result
+	require.NoError(t, decoder.Decode(&decoded))
+	assert.Equal(t, result, decoded)
+}
+
+func TestRunNoSources(t *testing.T) {
+	t.Parallel()
+
+	result := scan.Run(context.Background(), nil, time.Second)
+
+	bin, err := json.Marshal(result)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"version": "", "sources": []}`, string(bin))
+	assert.Empty(t, result.Failed())
+}
+
+func TestResultPortMapping(t *testing.T) {
+	t.Parallel()
+
+	sources := fakeSources()[:1]
+	sources = append(sources, scan.Source{
+		Name: "kubernetes",
+		List: func(context.Context) (map[string]nat.PortMap, error) {
+			return map[string]nat.PortMap{
+				"default/dns": {"53/udp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "53"}}},
+			}, nil
+		},
+	})
+
+	result := scan.Run(context.Background(), sources, time.Second)
+	connectAddrs := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1/24"}}
+	ports := nat.PortMap{
+		"80/tcp":   []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+		"5432/tcp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "5432"}},
+		"53/udp":   []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "53"}},
+	}
+
+	assert.Equal(t, types.PortMapping{
+		Ports:         ports,
+		ConnectAddrs:  connectAddrs,
+		Replace:       true,
+		Protocols:     types.PortProtocols(ports),
+		Sources:       map[string]string{"8080/tcp": "docker", "5432/tcp": "docker", "53/udp": "kubernetes"},
+		HostBindAddrs: map[string]string{"8080/tcp": "127.0.0.1"},
+	}, result.PortMapping(connectAddrs))
+}
@@ -0,0 +1,157 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package selftest checks the steps of the port forwarding pipeline one
+// after the other, for -selftest, and reports which of them fail and how
+// to fix them.
+package selftest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Status is the outcome of a check.
+type Status string
+
+const (
+	StatusPass Status = "pass"
+	StatusFail Status = "fail"
+	// StatusSkip is the status of the checks of the disabled subsystems,
+	// and of the checks whose requirement did not pass.
+	StatusSkip Status = "skip"
+)
+
+// Check is a step of the pipeline that is checked, see Run.
+type Check struct {
+	Name string
+	// Skip is why the check is skipped, e.g. its subsystem is disabled;
+	// the check is run when it is empty.
+	Skip string
+	// Requires is the name of the check that must pass first, if any,
+	// e.g. the Kubernetes API is not reached without a valid kubeconfig.
+	Requires string
+	// Hint tells how to fix the failures of the check.
+	Hint string
+	// Run checks the step, and returns what it found, e.g. the addresses
+	// of the network interfaces.
+	Run func(ctx context.Context) (string, error)
+}
+
+// Result is the outcome of a check.
+type Result struct {
+	Name   string `json:"name"`
+	Status Status `json:"status"`
+	// Detail is what the check found, or why it was skipped.
+	Detail string `json:"detail,omitempty"`
+	// Error and Hint are why the check failed, and how to fix it.
+	Error string `json:"error,omitempty"`
+	Hint  string `json:"hint,omitempty"`
+}
+
+// Report is the outcome of the checks, in the order they were run.
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// Run runs the checks in order, each of them within the timeout. The checks
+// that fail are reported along with the others, they do not stop the run.
+func Run(ctx context.Context, checks []Check, timeout time.Duration) Report {
+	report := Report{Results: make([]Result, 0, len(checks))}
+	statuses := make(map[string]Status, len(checks))
+
+	for _, check := range checks {
+		var result Result
+
+		switch {
+		case check.Skip != "":
+			result = Result{Name: check.Name, Status: StatusSkip, Detail: check.Skip}
+		case check.Requires != "" && statuses[check.Requires] != StatusPass:
+			result = Result{Name: check.Name, Status: StatusSkip, Detail: fmt.Sprintf("%s did not pass", check.Requires)}
+		default:
+			result = run(ctx, check, timeout)
+		}
+
+		statuses[check.Name] = result.Status
+		report.Results = append(report.Results, result)
+	}
+
+	return report
+}
+
+func run(ctx context.Context, check Check, timeout time.Duration) Result {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	detail, err := check.Run(ctx)
+	if err != nil {
+		return Result{Name: check.Name, Status: StatusFail, Detail: detail, Error: err.Error(), Hint: check.Hint}
+	}
+
+	return Result{Name: check.Name, Status: StatusPass, Detail: detail}
+}
+
+// Failed returns the names of the checks that failed.
+func (r *Report) Failed() []string {
+	var failed []string
+
+	for _, result := range r.Results {
+		if result.Status == StatusFail {
+			failed = append(failed, result.Name)
+		}
+	}
+
+	return failed
+}
+
+// Write writes the report as a table with a line for each check, the
+// hints of the failed checks, and a summary.
+func (r *Report) Write(output io.Writer) error {
+	table := tabwriter.NewWriter(output, 0, 0, 2, ' ', 0) //nolint:gomnd // the padding between the columns.
+
+	for _, result := range r.Results {
+		detail := result.Detail
+		if result.Error != "" {
+			detail = strings.TrimPrefix(detail+": "+result.Error, ": ")
+		}
+
+		line := strings.ToUpper(string(result.Status)) + "\t" + result.Name
+		if detail != "" {
+			line += "\t" + detail
+		}
+
+		fmt.Fprintln(table, line)
+
+		if result.Hint != "" {
+			fmt.Fprintf(table, "\t\thint: %s\n", result.Hint)
+		}
+	}
+
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	var err error
+
+	if failed := r.Failed(); len(failed) != 0 {
+		_, err = fmt.Fprintf(output, "\n%d of the checks failed: %s\n", len(failed), strings.Join(failed, ", "))
+	} else {
+		_, err = fmt.Fprintln(output, "\nall the checks passed")
+	}
+
+	return err
+}
@@ -0,0 +1,135 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package selftest_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/selftest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errRefused = errors.New("connection refused")
+
+// pass and fail are the fake checks.
+func pass(detail string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		return detail, nil
+	}
+}
+
+func fail(detail string) func(context.Context) (string, error) {
+	return func(context.Context) (string, error) {
+		return detail, errRefused
+	}
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	var ran []string
+
+	track := func(name string, run func(context.Context) (string, error)) func(context.Context) (string, error) {
+		return func(ctx context.Context) (string, error) {
+			ran = append(ran, name)
+
+			return run(ctx)
+		}
+	}
+
+	report := selftest.Run(context.Background(), []selftest.Check{
+		{Name: "capabilities", Run: track("capabilities", pass(""))},
+		{Name: "network interface", Run: track("network interface", pass("eth0=172.20.1.2"))},
+		{Name: "iptables", Skip: "disabled with -iptables=false", Run: track("iptables", pass(""))},
+		{Name: "docker API", Hint: "start dockerd", Run: track("docker API", fail("unix:///var/run/docker.sock"))},
+		{Name: "docker events", Requires: "docker API", Run: track("docker events", pass(""))},
+		{Name: "kubeconfig", Run: track("kubeconfig", pass("https://127.0.0.1:6443"))},
+		{Name: "kubernetes API", Requires: "kubeconfig", Run: track("kubernetes API", pass("1 services"))},
+		{Name: "forwarder", Hint: "start the privileged service", Run: track("forwarder", fail(""))},
+	}, time.Second)
+
+	// The skipped checks and the ones whose requirement failed are not run, the failures do not stop the others.
+	assert.Equal(t, []string{"capabilities", "network interface", "docker API", "kubeconfig", "kubernetes API", "forwarder"}, ran)
+	assert.Equal(t, []selftest.Result{
+		{Name: "capabilities", Status: selftest.StatusPass},
+		{Name: "network interface", Status: selftest.StatusPass, Detail: "eth0=172.20.1.2"},
+		{Name: "iptables", Status: selftest.StatusSkip, Detail: "disabled with -iptables=false"},
+		{
+			Name:   "docker API",
+			Status: selftest.StatusFail,
+			Detail: "unix:///var/run/docker.sock",
+			Error:  "connection refused",
+			Hint:   "start dockerd",
+		},
+		{Name: "docker events", Status: selftest.StatusSkip, Detail: "docker API did not pass"},
+		{Name: "kubeconfig", Status: selftest.StatusPass, Detail: "https://127.0.0.1:6443"},
+		{Name: "kubernetes API", Status: selftest.StatusPass, Detail: "1 services"},
+		{Name: "forwarder", Status: selftest.StatusFail, Error: "connection refused", Hint: "start the privileged service"},
+	}, report.Results)
+	assert.Equal(t, []string{"docker API", "forwarder"}, report.Failed())
+
+	var output strings.Builder
+
+	require.NoError(t, report.Write(&output))
+	assert.Equal(t, `PASS  capabilities
+PASS  network interface  eth0=172.20.1.2
+SKIP  iptables           disabled with -iptables=false
+FAIL  docker API         unix:///var/run/docker.sock: connection refused
+                         hint: start dockerd
+SKIP  docker events      docker API did not pass
+PASS  kubeconfig         https://127.0.0.1:6443
+PASS  kubernetes API     1 services
+FAIL  forwarder          connection refused
+                         hint: start the privileged service
+
+2 of the checks failed: docker API, forwarder
+`, output.String())
+}
+
+func TestRunPassed(t *testing.T) {
+	t.Parallel()
+
+	report := selftest.Run(context.Background(), []selftest.Check{
+		{Name: "capabilities", Run: pass("")},
+		{Name: "docker API", Skip: "disabled with -docker=false", Run: fail("")},
+	}, time.Second)
+	assert.Empty(t, report.Failed())
+
+	var output strings.Builder
+
+	require.NoError(t, report.Write(&output))
+	assert.Equal(t, "PASS  capabilities\nSKIP  docker API  disabled with -docker=false\n\nall the checks passed\n", output.String())
+}
+
+func TestRunTimeout(t *testing.T) {
+	t.Parallel()
+
+	report := selftest.Run(context.Background(), []selftest.Check{{
+		Name: "kubernetes API",
+		Run: func(ctx context.Context) (string, error) {
+			<-ctx.Done()
+
+			return "", ctx.Err()
+		},
+	}}, time.Millisecond)
+
+	require.Len(t, report.Results, 1)
+	assert.Equal(t, selftest.StatusFail, report.Results[0].Status)
+	assert.Equal(t, context.DeadlineExceeded.Error(), report.Results[0].Error)
+}
@@ -0,0 +1,339 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package shutdown reports what the agent cleaned up when it exits, and what
+// it could not, so that the last lines of its logs tell how it stopped.
+package shutdown
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+)
+
+// BufferSize is the number of the outcomes of the withdrawals that are held
+// while they are recorded, the ones that do not fit are left out of the report.
+const BufferSize = 1024
+
+// FileName is the name of the file that Write writes the report to, it
+// replaces the report of the previous shutdown.
+const FileName = "rancher-desktop-guestagent-shutdown.json"
+
+// Withdrawal is the outcome of withdrawing a port binding from the host.
+type Withdrawal struct {
+	ID       string `json:"id"`
+	Port     string `json:"port"`
+	Protocol string `json:"protocol"`
+	HostIP   string `json:"hostIP"`
+	Source   string `json:"source,omitempty"`
+	// Error is why the withdrawal failed, it is empty if it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// String returns the port binding of the withdrawal, e.g. "80/tcp on 127.0.0.1 of web".
+func (w Withdrawal) String() string {
+	return fmt.Sprintf("%s/%s on %s of %s", w.Port, w.Protocol, w.HostIP, w.ID)
+}
+
+// Subsystem is how a subsystem stopped.
+type Subsystem struct {
+	Name  string           `json:"name"`
+	State supervisor.State `json:"state"`
+	// Duration is how long the subsystem took to stop from the start of the
+	// shutdown; it is zero if it stopped before, or if it did not stop.
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// Report is what the agent cleaned up when it exited.
+type Report struct {
+	Time    time.Time    `json:"time"`
+	Version version.Info `json:"version"`
+	// Cause is what the shutdown was triggered by, e.g. a signal.
+	Cause string `json:"cause"`
+	// Duration is how long the shutdown took until the report.
+	Duration   time.Duration `json:"duration"`
+	Subsystems []Subsystem   `json:"subsystems,omitempty"`
+	// Phases are the phases of the shutdown, in the order they ran in.
+	Phases []supervisor.PhaseResult `json:"phases,omitempty"`
+	// Withdrawn are the port bindings that were withdrawn from the host,
+	// and Failed are the ones that could not be.
+	Withdrawn []Withdrawal `json:"withdrawn,omitempty"`
+	Failed    []Withdrawal `json:"failed,omitempty"`
+	// Dropped is the number of the outcomes of the withdrawals that are
+	// left out, since they did not fit in BufferSize.
+	Dropped uint64 `json:"dropped,omitempty"`
+	// Error is why the shutdown failed, e.g. withdrawing the port mappings timed out.
+	Error string `json:"error,omitempty"`
+	// ListenersClosed are the addresses of the listeners that were closed,
+	// and ListenersLeft the ones that were still open.
+	ListenersClosed []string `json:"listenersClosed,omitempty"`
+	ListenersLeft   []string `json:"listenersLeft,omitempty"`
+}
+
+// Clean returns whether everything was cleaned up.
+func (r *Report) Clean() bool {
+	return len(r.Failed) == 0 && r.Error == "" && len(r.ListenersLeft) == 0 && r.Dropped == 0
+}
+
+// Fields returns the fields of the report, which count the withdrawals and the
+// closed listeners and list the ones that failed, and the stop of each subsystem.
+func (r *Report) Fields() log.Fields {
+	fields := log.Fields{
+		"cause":           r.Cause,
+		"duration":        r.Duration.Round(time.Millisecond).String(),
+		"withdrawn":       len(r.Withdrawn),
+		"listenersClosed": len(r.ListenersClosed),
+	}
+
+	if len(r.Failed) != 0 {
+		failed := make([]string, 0, len(r.Failed))
+		for _, withdrawal := range r.Failed {
+			failed = append(failed, withdrawal.String()+": "+withdrawal.Error)
+		}
+
+		fields["failed"] = failed
+	}
+
+	if r.Dropped != 0 {
+		fields["dropped"] = r.Dropped
+	}
+
+	if r.Error != "" {
+		fields["error"] = r.Error
+	}
+
+	if len(r.ListenersLeft) != 0 {
+		fields["listenersLeft"] = r.ListenersLeft
+	}
+
+	subsystems := make([]string, 0, len(r.Subsystems))
+
+	for _, subsystem := range r.Subsystems {
+		if subsystem.State == supervisor.StateStopped {
+			subsystems = append(subsystems, subsystem.Name+"="+subsystem.Duration.Round(time.Millisecond).String())
+		} else {
+			subsystems = append(subsystems, subsystem.Name+"="+string(subsystem.State))
+		}
+	}
+
+	if len(subsystems) != 0 {
+		fields["subsystems"] = strings.Join(subsystems, " ")
+	}
+
+	phases := make([]string, 0, len(r.Phases))
+	for _, phase := range r.Phases {
+		phases = append(phases, phase.Name+"="+phase.Duration.Round(time.Millisecond).String())
+	}
+
+	if len(phases) != 0 {
+		fields["phases"] = strings.Join(phases, " ")
+	}
+
+	return fields
+}
+
+// Log logs the report as a single line, at the warning level unless it is clean.
+func (r *Report) Log(logger log.Logger) {
+	if r.Clean() {
+		logger.Infow("shutdown report", r.Fields())
+	} else {
+		logger.Warnw("shutdown report", r.Fields())
+	}
+}
+
+// Write writes the report as JSON to FileName in the directory, which is
+// created if needed, and returns its path; the file is only renamed to its
+// path once it is complete.
+func (r *Report) Write(dir string) (string, error) {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the shutdown report: %w", err)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil { //nolint:gosec // the directory is usually /var/log.
+		return "", fmt.Errorf("failed to create the directory of the shutdown report: %w", err)
+	}
+
+	path := filepath.Join(dir, FileName)
+
+	file, err := os.CreateTemp(dir, FileName+".*.tmp")
+	if err != nil {
+		return "", fmt.Errorf("failed to create the shutdown report: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(append(data, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to write the shutdown report %s: %w", path, err)
+	}
+
+	return path, nil
+}
+
+// Recorder collects the report while the agent shuts down.
+type Recorder struct {
+	mutex   sync.Mutex
+	report  Report
+	started time.Time
+	now     func() time.Time
+	// withdrawals holds the index in the report of the last outcome of each
+	// port binding, since a failed withdrawal may be tried again.
+	withdrawals map[Withdrawal]int
+	outcomes    []Withdrawal
+}
+
+// NewRecorder creates a recorder for the shutdown that started at the
+// given time, triggered by the cause.
+func NewRecorder(cause string, started time.Time, now func() time.Time) *Recorder {
+	return &Recorder{
+		report:      Report{Cause: cause},
+		started:     started,
+		now:         now,
+		withdrawals: make(map[Withdrawal]int),
+	}
+}
+
+// Subsystems records how long the subsystems took to stop, from their status
+// once they were waited for; see supervisor.Status.Stopped.
+func (r *Recorder) Subsystems(statuses []supervisor.Status) {
+	subsystems := make([]Subsystem, 0, len(statuses))
+
+	for _, status := range statuses {
+		subsystem := Subsystem{Name: status.Name, State: status.State}
+		if status.State == supervisor.StateStopped && status.Stopped.After(r.started) {
+			subsystem.Duration = status.Stopped.Sub(r.started)
+		}
+
+		subsystems = append(subsystems, subsystem)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.report.Subsystems = subsystems
+}
+
+// Phases records how the phases of the shutdown went, see supervisor.Shutdown.
+func (r *Recorder) Phases(results []supervisor.PhaseResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.report.Phases = slices.Clone(results)
+}
+
+// Run records the withdrawals from the outcomes of the removals that the
+// subscription delivers, see tracker.WithOutcomes; it returns once the
+// subscription is unsubscribed.
+func (r *Recorder) Run(subscription *tracker.Subscription) {
+	for event := range subscription.Events() {
+		r.Observe(event)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.report.Dropped += subscription.Dropped()
+}
+
+// Observe records the withdrawal of the event, the events that are not the
+// outcome of a removal are ignored.
+func (r *Recorder) Observe(event tracker.Event) {
+	if event.Action != tracker.ActionRemove || event.Outcome == "" {
+		return
+	}
+
+	key := Withdrawal{ID: event.ID, Port: event.Port, Protocol: event.Protocol, HostIP: event.HostIP}
+	withdrawal := key
+	withdrawal.Source = event.Source
+
+	if event.Outcome == tracker.OutcomeFailed {
+		withdrawal.Error = event.Error
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if index, ok := r.withdrawals[key]; ok {
+		r.outcomes[index] = withdrawal
+
+		return
+	}
+
+	r.withdrawals[key] = len(r.outcomes)
+	r.outcomes = append(r.outcomes, withdrawal)
+}
+
+// Listeners records the listeners that were closed, from the addresses of
+// the ones that were open before the port mappings were withdrawn and after.
+func (r *Recorder) Listeners(before, after []string) {
+	var closed []string
+
+	for _, listener := range before {
+		if !slices.Contains(after, listener) {
+			closed = append(closed, listener)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.report.ListenersClosed = closed
+	r.report.ListenersLeft = slices.Clone(after)
+}
+
+// Report returns the report, with the error that the shutdown failed with,
+// if any, see supervisor.Shutdown.
+func (r *Recorder) Report(err error) Report {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+
+	report := r.report
+	report.Time = now.UTC()
+	report.Version = version.Get()
+	report.Duration = now.Sub(r.started)
+	report.Withdrawn, report.Failed = nil, nil
+
+	for _, withdrawal := range r.outcomes {
+		if withdrawal.Error == "" {
+			report.Withdrawn = append(report.Withdrawn, withdrawal)
+		} else {
+			report.Failed = append(report.Failed, withdrawal)
+		}
+	}
+
+	if err != nil {
+		report.Error = err.Error()
+	}
+
+	return report
+}
@@ -0,0 +1,237 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package shutdown_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/shutdown"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errWithdraw = errors.New("host port is busy")
+
+// failingForwarder fails to withdraw the host port, it forwards all the others.
+type failingForwarder struct {
+	hostPort string
+}
+
+func (f failingForwarder) Send(_ context.Context, portMapping types.PortMapping) error {
+	if !portMapping.Remove {
+		return nil
+	}
+
+	for _, bindings := range portMapping.Ports {
+		for _, binding := range bindings {
+			if binding.HostPort == f.hostPort {
+				return errWithdraw
+			}
+		}
+	}
+
+	return nil
+}
+
+func (f failingForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	return forwarder.RemoveEach(ctx, f, portMappings)
+}
+
+// newShutdownCoordinator returns a coordinator that forwards the ports with
+// their listeners, whose withdrawal of the failing host port fails.
+func newShutdownCoordinator(t *testing.T, failing string, ports ...int) (*tracker.Coordinator, *tracker.ListenerTracker) {
+	t.Helper()
+
+	vtunnelTracker := tracker.NewVTunnelTracker(failingForwarder{hostPort: failing},
+		[]types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}})
+	vtunnelTracker.ListenerTracker.EnableDryRun()
+	coordinator := tracker.NewCoordinator(vtunnelTracker)
+
+	for _, port := range ports {
+		portMap := nat.PortMap{
+			nat.Port(fmt.Sprintf("%d/tcp", port)): []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: fmt.Sprint(port)}},
+		}
+		listeners := []tracker.ListenerAddr{{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+
+		require.NoError(t, coordinator.Publish(context.Background(), fmt.Sprintf("container_%d", port), portMap, listeners))
+	}
+
+	return coordinator, vtunnelTracker.ListenerTracker
+}
+
+func TestRecorder(t *testing.T) {
+	t.Parallel()
+
+	started := time.Now()
+	coordinator, listenerTracker := newShutdownCoordinator(t, "443", 80, 443)
+
+	recorder := shutdown.NewRecorder("received a signal: terminated", started, time.Now)
+	recorder.Subsystems([]supervisor.Status{
+		{Name: "docker", State: supervisor.StateStopped, Stopped: started.Add(20 * time.Millisecond)},
+		{Name: "iptables", State: supervisor.StateStopped, Stopped: started.Add(-time.Minute)},
+		{Name: "kubernetes", State: supervisor.StateRunning},
+	})
+
+	subscription := coordinator.Subscribe(shutdown.BufferSize, tracker.WithOutcomes())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		recorder.Run(subscription)
+	}()
+
+	listeners := listenerTracker.Listeners()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	err := coordinator.Shutdown(ctx)
+	require.ErrorIs(t, err, tracker.ErrRemoveAll)
+
+	subscription.Unsubscribe()
+	<-done
+	coordinator.CloseListeners(ctx)
+	recorder.Listeners(listeners, listenerTracker.Listeners())
+	recorder.Phases([]supervisor.PhaseResult{
+		{Name: "sources", Duration: 20 * time.Millisecond},
+		{Name: "withdraw", Duration: time.Millisecond, Error: err.Error()},
+	})
+
+	report := recorder.Report(err)
+	assert.Equal(t, "received a signal: terminated", report.Cause)
+	assert.Positive(t, report.Duration)
+	assert.Equal(t, []shutdown.Withdrawal{
+		{ID: "container_80", Port: "80", Protocol: "tcp", HostIP: "127.0.0.1"},
+	}, report.Withdrawn)
+
+	// The failed withdrawal is tried again, its last outcome is reported once.
+	require.Len(t, report.Failed, 1)
+	assert.Equal(t, "443/tcp on 127.0.0.1 of container_443", report.Failed[0].String())
+	assert.Contains(t, report.Failed[0].Error, errWithdraw.Error())
+	assert.Contains(t, report.Error, errWithdraw.Error())
+
+	// The listeners are closed even if the withdrawal of their port failed.
+	assert.Equal(t, []string{"127.0.0.1:443", "127.0.0.1:80"}, report.ListenersClosed)
+	assert.Empty(t, report.ListenersLeft)
+	assert.Equal(t, []shutdown.Subsystem{
+		{Name: "docker", State: supervisor.StateStopped, Duration: 20 * time.Millisecond},
+		{Name: "iptables", State: supervisor.StateStopped},
+		{Name: "kubernetes", State: supervisor.StateRunning},
+	}, report.Subsystems)
+	assert.Equal(t, "sources", report.Phases[0].Name)
+	assert.Equal(t, "withdraw", report.Phases[1].Name)
+	assert.False(t, report.Clean())
+}
+
+func TestReportLog(t *testing.T) {
+	t.Parallel()
+
+	report := shutdown.Report{
+		Cause:    "received a signal: terminated",
+		Duration: 1234 * time.Microsecond,
+		Subsystems: []shutdown.Subsystem{
+			{Name: "docker", State: supervisor.StateStopped, Duration: 20 * time.Millisecond},
+			{Name: "kubernetes", State: supervisor.StateRunning},
+		},
+		Phases: []supervisor.PhaseResult{
+			{Name: "sources", Duration: 21 * time.Millisecond},
+			{Name: "withdraw", Duration: 3 * time.Millisecond},
+		},
+		Withdrawn: []shutdown.Withdrawal{{ID: "web", Port: "80", Protocol: "tcp", HostIP: "127.0.0.1"}},
+		Failed: []shutdown.Withdrawal{
+			{ID: "db", Port: "5432", Protocol: "tcp", HostIP: "127.0.0.1", Error: "host port is busy"},
+		},
+		ListenersClosed: []string{"127.0.0.1:80"},
+		ListenersLeft:   []string{"127.0.0.1:5432"},
+	}
+
+	var output bytes.Buffer
+
+	report.Log(logging.New(&output, logging.FormatJSON))
+
+	var line map[string]any
+	require.NoError(t, json.Unmarshal(output.Bytes(), &line))
+	delete(line, "time")
+
+	assert.Equal(t, map[string]any{
+		"level":           "warn",
+		"msg":             "shutdown report",
+		"cause":           "received a signal: terminated",
+		"duration":        "1ms",
+		"withdrawn":       float64(1),
+		"failed":          []any{"5432/tcp on 127.0.0.1 of db: host port is busy"},
+		"listenersClosed": float64(1),
+		"listenersLeft":   []any{"127.0.0.1:5432"},
+		"subsystems":      "docker=20ms kubernetes=running",
+		"phases":          "sources=21ms withdraw=3ms",
+	}, line)
+
+	// The clean shutdowns are logged at the info level.
+	output.Reset()
+
+	clean := shutdown.Report{Cause: "all the subsystems stopped", Withdrawn: report.Withdrawn}
+	clean.Log(logging.New(&output, logging.FormatJSON))
+	require.NoError(t, json.Unmarshal(output.Bytes(), &line))
+	assert.Equal(t, "info", line["level"])
+}
+
+func TestReportWrite(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "diagnostics")
+	recorder := shutdown.NewRecorder("all the subsystems stopped", time.Now(), time.Now)
+	recorder.Observe(tracker.Event{
+		Action: tracker.ActionRemove, ID: "web", Port: "80", Protocol: "tcp", HostIP: "127.0.0.1", Outcome: tracker.OutcomeSent,
+	})
+
+	report := recorder.Report(nil)
+	path, err := report.Write(dir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, shutdown.FileName), path)
+
+	// The report of the previous shutdown is replaced.
+	_, err = report.Write(dir)
+	require.NoError(t, err)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var written shutdown.Report
+	require.NoError(t, decoder.Decode(&written))
+	assert.Equal(t, report.Withdrawn, written.Withdrawn)
+	assert.Equal(t, "all the subsystems stopped", written.Cause)
+	assert.True(t, written.Clean())
+}
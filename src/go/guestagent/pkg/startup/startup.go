@@ -0,0 +1,81 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package startup logs the summary of the configuration that the agent
+// starts with, so that the first lines of its logs tell how it runs.
+package startup
+
+import (
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+)
+
+// OriginDetected is the origin of the settings that the agent detected,
+// besides the origins of the flags, e.g. config.OriginEnv.
+const OriginDetected = "auto-detect"
+
+// Setting is a subsystem of the summary, whose value is whether it is
+// enabled, or a parameter, e.g. the path of a socket.
+type Setting struct {
+	Name  string
+	Value string
+	// Origin is where the value comes from, e.g. config.OriginCommandLine or OriginDetected.
+	Origin string
+}
+
+// Summary is the configuration that the agent starts with.
+type Summary struct {
+	Version    version.Info
+	Subsystems []Setting
+	Parameters []Setting
+}
+
+// AddSubsystem adds the subsystem, whether it is enabled and why.
+func (s *Summary) AddSubsystem(name string, enabled bool, origin string) {
+	value := "disabled"
+	if enabled {
+		value = "enabled"
+	}
+
+	s.Subsystems = append(s.Subsystems, Setting{Name: name, Value: value, Origin: origin})
+}
+
+// AddParameter adds the parameter and where its value comes from; the
+// value must already be redacted if it is a secret, see config.Effective.
+func (s *Summary) AddParameter(name, value, origin string) {
+	s.Parameters = append(s.Parameters, Setting{Name: name, Value: value, Origin: origin})
+}
+
+// Fields returns the fields of the summary, which are the subsystems and the
+// parameters by name, e.g. "docker": "enabled (flag)", and the version.
+func (s *Summary) Fields() log.Fields {
+	fields := log.Fields{
+		"version": s.Version.Version,
+		"commit":  s.Version.Commit,
+	}
+
+	for _, setting := range s.Subsystems {
+		fields[setting.Name] = setting.Value + " (" + setting.Origin + ")"
+	}
+
+	for _, setting := range s.Parameters {
+		fields[setting.Name] = setting.Value + " (" + setting.Origin + ")"
+	}
+
+	return fields
+}
+
+// Log logs the summary as a single line at the info level.
+func (s *Summary) Log(logger log.Logger) {
+	logger.Infow("starting with the configuration", s.Fields())
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+// ErrPhaseTimeout marks the errors of the phases of the shutdown that did
+// not return within their timeout, see Shutdown.
+var ErrPhaseTimeout = errors.New("timed out")
+
+// phaseGrace is how long a phase is still waited for once its context is
+// done, for it to return the error that it stopped with.
+const phaseGrace = 20 * time.Millisecond
+
+// Phase is a step of the shutdown of the agent, see Shutdown.
+type Phase struct {
+	Name string
+	// Timeout bounds the phase; it is cut down to what is left of the
+	// deadline of the shutdown.
+	Timeout time.Duration
+	// Stop stops what the phase is for, it is given up on once its context
+	// is done, and should return then.
+	Stop func(ctx context.Context) error
+}
+
+// PhaseResult is how a phase of the shutdown went.
+type PhaseResult struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	// Error is why the phase failed, it is empty if it succeeded.
+	Error string `json:"error,omitempty"`
+}
+
+// Shutdown runs the phases in order, each one once the previous one
+// returned or ran out of its timeout, so that e.g. the port mappings are
+// withdrawn once the sources stopped changing them and before the listeners
+// that back them are closed. It returns by the deadline, give or take a
+// grace period for each phase: the phases that are left once it passed are
+// still run, with a context that is done already, so that they release what
+// they can without waiting. The errors of the phases are joined, the ones
+// that did not return in time are ErrPhaseTimeout errors.
+func Shutdown(deadline time.Time, phases ...Phase) ([]PhaseResult, error) {
+	results := make([]PhaseResult, 0, len(phases))
+
+	var errs []error
+
+	for _, phase := range phases {
+		started := time.Now()
+		err := runPhase(phase, min(phase.Timeout, deadline.Sub(started)))
+
+		result := PhaseResult{Name: phase.Name, Duration: time.Since(started)}
+		if err != nil {
+			result.Error = err.Error()
+			errs = append(errs, fmt.Errorf("%s: %w", phase.Name, err))
+
+			log.Errorf("the %s phase of the shutdown failed after %s: %v", phase.Name, result.Duration, err)
+		} else {
+			log.Debugf("the %s phase of the shutdown took %s", phase.Name, result.Duration)
+		}
+
+		results = append(results, result)
+	}
+
+	return results, errors.Join(errs...)
+}
+
+// runPhase runs the phase for up to the timeout, the phase is left running
+// if it does not return by then.
+func runPhase(phase Phase, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- phase.Stop(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	// The phase that returns as its context is done is not timed out.
+	grace := time.NewTimer(phaseGrace)
+	defer grace.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-grace.C:
+		return fmt.Errorf("%w after %s", ErrPhaseTimeout, max(timeout, 0))
+	}
+}
@@ -0,0 +1,200 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supervisor_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stopRecorder records the steps of a shutdown, in the order they happened.
+type stopRecorder struct {
+	mutex sync.Mutex
+	steps []string
+}
+
+func (r *stopRecorder) record(step string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.steps = append(r.steps, step)
+}
+
+func (r *stopRecorder) recorded() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return append([]string(nil), r.steps...)
+}
+
+// phase returns a phase that records its name.
+func (r *stopRecorder) phase(name string) supervisor.Phase {
+	return supervisor.Phase{Name: name, Timeout: time.Second, Stop: func(context.Context) error {
+		r.record(name)
+
+		return nil
+	}}
+}
+
+func TestShutdownOrder(t *testing.T) {
+	t.Parallel()
+
+	recorder := &stopRecorder{}
+	s := supervisor.New(time.Millisecond, time.Millisecond)
+
+	// The source keeps changing the port mappings until it is stopped, and
+	// the admin API keeps serving until the end.
+	s.Go(context.Background(), "kubernetes", func(ctx context.Context) error {
+		<-ctx.Done()
+		recorder.record("kubernetes stopped")
+
+		return nil
+	})
+	s.Go(context.Background(), "admin", func(ctx context.Context) error {
+		<-ctx.Done()
+		recorder.record("admin stopped")
+
+		return nil
+	})
+
+	withdraw := recorder.phase("withdraw")
+	withdraw.Stop = func(context.Context) error {
+		recorder.record("withdraw with the admin " + string(statusOf(t, s, "admin").State))
+
+		return nil
+	}
+
+	results, err := supervisor.Shutdown(time.Now().Add(5*time.Second),
+		supervisor.Phase{Name: "sources", Timeout: time.Second, Stop: func(ctx context.Context) error {
+			return s.Stop(ctx, "kubernetes")
+		}},
+		withdraw,
+		recorder.phase("listeners"),
+		recorder.phase("forwarder"),
+		supervisor.Phase{Name: "surfaces", Timeout: time.Second, Stop: func(ctx context.Context) error {
+			return s.Stop(ctx, "admin")
+		}},
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"kubernetes stopped",
+		"withdraw with the admin running",
+		"listeners",
+		"forwarder",
+		"admin stopped",
+	}, recorder.recorded())
+
+	names := make([]string, 0, len(results))
+	for _, result := range results {
+		names = append(names, result.Name)
+		assert.Empty(t, result.Error)
+	}
+
+	assert.Equal(t, []string{"sources", "withdraw", "listeners", "forwarder", "surfaces"}, names)
+	require.NoError(t, s.Wait())
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	t.Parallel()
+
+	recorder := &stopRecorder{}
+	release := make(chan struct{})
+
+	defer close(release)
+
+	started := time.Now()
+	deadline := started.Add(200 * time.Millisecond)
+
+	results, err := supervisor.Shutdown(deadline,
+		// The phase that does not return is given up on after its timeout.
+		supervisor.Phase{Name: "stuck", Timeout: 50 * time.Millisecond, Stop: func(context.Context) error {
+			<-release
+
+			return nil
+		}},
+		// The phase that takes longer than the deadline is cut down to it.
+		supervisor.Phase{Name: "slow", Timeout: time.Hour, Stop: func(ctx context.Context) error {
+			<-ctx.Done()
+			recorder.record("slow")
+
+			return ctx.Err()
+		}},
+		// The phases after the deadline still run, with a context that is done.
+		supervisor.Phase{Name: "late", Timeout: time.Second, Stop: func(ctx context.Context) error {
+			recorder.record("late")
+
+			return ctx.Err()
+		}},
+	)
+
+	// Each phase is given a grace period to return once its context is done.
+	assert.Less(t, time.Since(started), deadline.Sub(started)+100*time.Millisecond, "the shutdown ran past its deadline")
+	require.ErrorIs(t, err, supervisor.ErrPhaseTimeout)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, []string{"slow", "late"}, recorder.recorded())
+
+	require.Len(t, results, 3)
+	assert.Contains(t, results[0].Error, supervisor.ErrPhaseTimeout.Error())
+	assert.GreaterOrEqual(t, results[0].Duration, 50*time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded.Error(), results[1].Error)
+	assert.Equal(t, context.DeadlineExceeded.Error(), results[2].Error)
+}
+
+func TestSupervisorStop(t *testing.T) {
+	t.Parallel()
+
+	s := supervisor.New(time.Millisecond, time.Millisecond)
+	release := make(chan struct{})
+
+	s.Go(context.Background(), "docker", func(ctx context.Context) error {
+		<-ctx.Done()
+
+		return ctx.Err()
+	})
+	s.Go(context.Background(), "stuck", func(context.Context) error {
+		<-release
+
+		return nil
+	})
+	s.Go(context.Background(), "admin", func(ctx context.Context) error {
+		<-ctx.Done()
+
+		return nil
+	})
+
+	// Only the named subsystems are stopped.
+	require.NoError(t, s.Stop(context.Background(), "docker"))
+	assert.Equal(t, supervisor.StateStopped, statusOf(t, s, "docker").State)
+	assert.Equal(t, supervisor.StateRunning, statusOf(t, s, "admin").State)
+
+	// The subsystems that do not stop in time are named.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := s.Stop(ctx)
+	require.ErrorIs(t, err, supervisor.ErrStopTimeout)
+	assert.Contains(t, err.Error(), "stuck")
+	assert.NotContains(t, err.Error(), "admin")
+	assert.Equal(t, supervisor.StateStopped, statusOf(t, s, "admin").State)
+
+	close(release)
+	require.NoError(t, s.Wait())
+}
@@ -0,0 +1,609 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package supervisor runs the subsystems of the agent independently of each
+// other, the subsystems that fail are restarted while the others keep running.
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+)
+
+// ErrPermanent marks the errors that restarting the subsystem does not fix,
+// e.g. an invalid configuration, see Permanent.
+var ErrPermanent = errors.New("permanent failure")
+
+// Permanent marks the error as one that restarting the subsystem does not fix.
+func Permanent(err error) error {
+	return fmt.Errorf("%w: %w", ErrPermanent, err)
+}
+
+// ErrPanic marks the errors of the subsystems that panicked.
+var ErrPanic = errors.New("panic")
+
+// ErrStopTimeout is returned by Stop when some of the subsystems did not stop in time.
+var ErrStopTimeout = errors.New("the subsystems did not stop in time")
+
+const (
+	// defaultPanicBudget and defaultPanicWindow are the panic budget of the
+	// subsystems unless it is set with WithPanicBudget.
+	defaultPanicBudget = 5
+	defaultPanicWindow = 10 * time.Minute
+)
+
+// State is the state of a subsystem.
+type State string
+
+const (
+	StateRunning    State = "running"
+	StateBackingOff State = "backing off"
+	// StateFailed is the state of the subsystems that failed permanently.
+	StateFailed State = "failed"
+	// StateStopped is the state of the subsystems that stopped on their own,
+	// or because the supervisor is shutting down.
+	StateStopped State = "stopped"
+)
+
+// Status is the status of a subsystem, for diagnostics.
+type Status struct {
+	Name     string `json:"name"`
+	State    State  `json:"state"`
+	Restarts int    `json:"restarts"`
+	// Panics is the number of times that the subsystem panicked.
+	Panics int `json:"panics"`
+	// LastError is the last error that the subsystem failed with, or that it
+	// reported, if any; LastErrorTime is when it happened.
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime"`
+	// LastSuccess is when the subsystem last reported an operation to succeed,
+	// see Reporter; it is zero if the subsystem reports none.
+	LastSuccess time.Time `json:"lastSuccess"`
+	// Backoff is how long the subsystem waits before it is restarted, and
+	// NextRestart when it is, while it is backing off.
+	Backoff     time.Duration `json:"backoff,omitempty"`
+	NextRestart time.Time     `json:"nextRestart"`
+	// Stopped is when the subsystem stopped, see StateStopped; it is zero
+	// until then.
+	Stopped time.Time `json:"stopped"`
+}
+
+// Reporter records the health of a subsystem in its Status, see HealthReporter.
+type Reporter interface {
+	// Succeeded records that an operation of the subsystem succeeded. The
+	// subsystems call it on their normal cadence, e.g. for every event or
+	// every scan, so that the age of LastSuccess tells one that went stale.
+	Succeeded()
+	// Failed records an error that the subsystem recovers from on its own,
+	// without failing; it is not restarted for it.
+	Failed(err error)
+}
+
+type reporterKey struct{}
+
+// HealthReporter returns the reporter of the subsystem that runs with the
+// context, the reports are discarded if the context is not a subsystem's.
+func HealthReporter(ctx context.Context) Reporter {
+	if reporter, ok := ctx.Value(reporterKey{}).(Reporter); ok {
+		return reporter
+	}
+
+	return discardReporter{}
+}
+
+// unitReporter reports the health of a subsystem to the supervisor.
+type unitReporter struct {
+	supervisor *Supervisor
+	status     *Status
+}
+
+func (u unitReporter) Succeeded() {
+	u.supervisor.mutex.Lock()
+	defer u.supervisor.mutex.Unlock()
+
+	u.status.LastSuccess = time.Now()
+}
+
+func (u unitReporter) Failed(err error) {
+	u.supervisor.mutex.Lock()
+	defer u.supervisor.mutex.Unlock()
+
+	u.status.LastError = err.Error()
+	u.status.LastErrorTime = time.Now()
+}
+
+type discardReporter struct{}
+
+func (discardReporter) Succeeded()   {}
+func (discardReporter) Failed(error) {}
+
+// Supervisor runs the subsystems, see Go.
+type Supervisor struct {
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// panicBudget is the number of panics within panicWindow
+	// after which a subsystem is no longer restarted.
+	panicBudget int
+	panicWindow time.Duration
+	// onFailure is called whenever a subsystem fails, see WithFailureHook.
+	onFailure func(name string, state State, err error)
+	mutex     sync.Mutex
+	units     []*unit
+}
+
+// unit is a subsystem that the supervisor runs.
+type unit struct {
+	status *Status
+	// ctx is the context that the subsystem runs until, see Go.
+	ctx context.Context
+	run func(ctx context.Context) error
+	// cancel stops the subsystem, see Stop, and done is closed once it
+	// stopped; both are replaced when it is restarted, see Restart.
+	cancel context.CancelFunc
+	done   chan struct{}
+	// stopped is set once the subsystem is stopped with Stop.
+	stopped bool
+	// err is the error that the subsystem failed permanently with, if it did.
+	err error
+}
+
+// Option configures a Supervisor, see New.
+type Option func(*Supervisor)
+
+// WithPanicBudget sets the number of panics within the window after which a
+// subsystem fails permanently, instead of 5 panics within 10 minutes.
+func WithPanicBudget(panics int, window time.Duration) Option {
+	return func(s *Supervisor) {
+		s.panicBudget, s.panicWindow = panics, window
+	}
+}
+
+// WithFailureHook calls the hook whenever a subsystem fails, with its name,
+// the state that it is in since, either backing off or failed, and the error.
+// The hook must not block.
+func WithFailureHook(hook func(name string, state State, err error)) Option {
+	return func(s *Supervisor) {
+		s.onFailure = hook
+	}
+}
+
+// New creates a supervisor that waits minBackoff before it restarts a
+// subsystem that failed, doubling it up to maxBackoff when it keeps failing.
+func New(minBackoff, maxBackoff time.Duration, opts ...Option) *Supervisor {
+	s := &Supervisor{
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+		panicBudget: defaultPanicBudget,
+		panicWindow: defaultPanicWindow,
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Go runs the subsystem until the context is cancelled, or until it is
+// stopped with Stop. It is restarted after a backoff whenever it fails or
+// panics, unless its error is Permanent or it ran out of its panic budget;
+// it is not restarted when it returns nil either.
+func (s *Supervisor) Go(ctx context.Context, name string, run func(ctx context.Context) error) {
+	u := &unit{
+		status: &Status{Name: name, State: StateRunning},
+		ctx:    ctx,
+		run:    run,
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.units = append(s.units, u)
+	s.start(u, make(chan struct{}))
+}
+
+// start supervises the unit until its context is cancelled, done is closed
+// once it stopped. It must be called with the mutex held.
+func (s *Supervisor) start(u *unit, done chan struct{}) {
+	ctx, cancel := context.WithCancel(u.ctx)
+	u.cancel, u.done = cancel, done
+
+	go func() {
+		defer close(done)
+		defer cancel()
+
+		s.supervise(ctx, u, u.run)
+	}()
+}
+
+// Restart stops the named subsystems, calls apply once they stopped, e.g. to
+// change the flags that they read when they start, and runs them again with
+// their backoff reset; the ones that failed permanently or returned are run
+// again too, but not the ones that were stopped with Stop or whose context
+// is done. Wait keeps waiting for the subsystems in the meantime.
+// It returns the names of the subsystems that were restarted.
+func (s *Supervisor) Restart(names []string, apply func()) []string {
+	if len(names) == 0 {
+		apply()
+
+		return nil
+	}
+
+	units := s.named(names)
+	stopping := make([]chan struct{}, 0, len(units))
+
+	// The new done channels are in place before the old ones are closed,
+	// so that Wait does not see the subsystems stop.
+	s.mutex.Lock()
+	for _, u := range units {
+		stopping = append(stopping, u.done)
+		u.done = make(chan struct{})
+		u.cancel()
+	}
+	s.mutex.Unlock()
+
+	for _, done := range stopping {
+		<-done
+	}
+
+	apply()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	restarted := make([]string, 0, len(units))
+
+	for _, u := range units {
+		if u.stopped || u.ctx.Err() != nil {
+			close(u.done)
+
+			continue
+		}
+
+		u.err = nil
+		u.status.State = StateRunning
+		u.status.Restarts++
+		u.status.Stopped = time.Time{}
+		s.start(u, u.done)
+
+		restarted = append(restarted, u.status.Name)
+	}
+
+	return restarted
+}
+
+func (s *Supervisor) supervise(ctx context.Context, u *unit, run func(ctx context.Context) error) {
+	status := u.status
+	backoff := s.minBackoff
+
+	// panics are the times of the recent panics, within the panic window.
+	var panics []time.Time
+
+	ctx = context.WithValue(ctx, reporterKey{}, unitReporter{supervisor: s, status: status})
+
+	for {
+		started := time.Now()
+		err := s.run(ctx, status, run)
+
+		if errors.Is(err, ErrPanic) {
+			panics = append(recent(panics, s.panicWindow), time.Now())
+			if len(panics) >= s.panicBudget {
+				err = Permanent(fmt.Errorf("panicked %d times in %s: %w", len(panics), s.panicWindow, err))
+			}
+		}
+
+		switch {
+		case ctx.Err() != nil || err == nil:
+			s.setState(status, StateStopped, nil)
+
+			return
+		case errors.Is(err, ErrPermanent):
+			log.Errorf("subsystem %s failed, it is not restarted: %v", status.Name, err)
+			s.setState(status, StateFailed, err)
+			s.failed(status.Name, StateFailed, err)
+
+			s.mutex.Lock()
+			u.err = fmt.Errorf("%s: %w", status.Name, err)
+			s.mutex.Unlock()
+
+			return
+		}
+
+		// The subsystems that ran for a while before they failed start over.
+		if time.Since(started) > s.maxBackoff {
+			backoff = s.minBackoff
+		}
+
+		log.Errorf("subsystem %s failed, restarting it in %s: %v", status.Name, backoff, err)
+		s.setState(status, StateBackingOff, err)
+
+		s.mutex.Lock()
+		status.Backoff = backoff
+		status.NextRestart = time.Now().Add(backoff)
+		s.mutex.Unlock()
+		s.failed(status.Name, StateBackingOff, err)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			s.setState(status, StateStopped, nil)
+
+			return
+		case <-timer.C:
+		}
+
+		backoff = min(2*backoff, s.maxBackoff)
+
+		s.mutex.Lock()
+		status.State = StateRunning
+		status.Restarts++
+		status.Backoff = 0
+		status.NextRestart = time.Time{}
+		s.mutex.Unlock()
+	}
+}
+
+// run runs the subsystem once, its panics are returned as an ErrPanic
+// error and counted in its status.
+func (s *Supervisor) run(ctx context.Context, status *Status, run func(ctx context.Context) error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("subsystem %s panicked: %v\n%s", status.Name, r, debug.Stack())
+
+			s.mutex.Lock()
+			status.Panics++
+			s.mutex.Unlock()
+
+			err = fmt.Errorf("%w: %v", ErrPanic, r)
+		}
+	}()
+
+	return run(ctx)
+}
+
+// recent returns the times that are within the window from now.
+func recent(times []time.Time, window time.Duration) []time.Time {
+	cutoff := time.Now().Add(-window)
+
+	for len(times) != 0 && times[0].Before(cutoff) {
+		times = times[1:]
+	}
+
+	return times
+}
+
+func (s *Supervisor) setState(status *Status, state State, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status.State = state
+	if state == StateStopped {
+		status.Stopped = time.Now()
+	}
+
+	if state != StateBackingOff {
+		status.Backoff = 0
+		status.NextRestart = time.Time{}
+	}
+
+	if err != nil {
+		status.LastError = err.Error()
+		status.LastErrorTime = time.Now()
+	}
+}
+
+func (s *Supervisor) failed(name string, state State, err error) {
+	if s.onFailure != nil {
+		s.onFailure(name, state, err)
+	}
+}
+
+// Wait waits for the named subsystems to stop, all of them if none is named,
+// it returns the errors of the ones that failed permanently.
+func (s *Supervisor) Wait(names ...string) error {
+	units := s.named(names)
+
+	for _, u := range units {
+		s.wait(context.Background(), u)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	errs := make([]error, 0, len(units))
+	for _, u := range units {
+		errs = append(errs, u.err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Stop cancels the named subsystems, all of them if none is named, and waits
+// for them to stop; it gives up once the context is done, and returns an
+// ErrStopTimeout error that names the ones that are still running then.
+func (s *Supervisor) Stop(ctx context.Context, names ...string) error {
+	units := s.named(names)
+
+	s.mutex.Lock()
+	for _, u := range units {
+		u.stopped = true
+		u.cancel()
+	}
+	s.mutex.Unlock()
+
+	var running []string
+
+	for _, u := range units {
+		if !s.wait(ctx, u) {
+			running = append(running, u.status.Name)
+		}
+	}
+
+	if len(running) != 0 {
+		return fmt.Errorf("%w: %s", ErrStopTimeout, strings.Join(running, ", "))
+	}
+
+	return nil
+}
+
+// wait waits for the unit to stop, and to be run again if it is being
+// restarted, see Restart; it returns false if the context is done first.
+func (s *Supervisor) wait(ctx context.Context, u *unit) bool {
+	for {
+		s.mutex.Lock()
+		done := u.done
+		s.mutex.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			// The ones that already stopped are not reported.
+			select {
+			case <-done:
+			default:
+				return false
+			}
+		}
+
+		s.mutex.Lock()
+		current := done == u.done
+		s.mutex.Unlock()
+
+		if current {
+			return true
+		}
+	}
+}
+
+// named returns the units of the named subsystems, or all of them if none is named.
+func (s *Supervisor) named(names []string) []*unit {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(names) == 0 {
+		return slices.Clone(s.units)
+	}
+
+	units := make([]*unit, 0, len(names))
+	for _, u := range s.units {
+		if slices.Contains(names, u.status.Name) {
+			units = append(units, u)
+		}
+	}
+
+	return units
+}
+
+// Status returns the status of the subsystems, in the order they were started.
+func (s *Supervisor) Status() []Status {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	statuses := make([]Status, 0, len(s.units))
+	for _, u := range s.units {
+		statuses = append(statuses, *u.status)
+	}
+
+	return statuses
+}
+
+// Restarts returns the number of times that the subsystems were restarted.
+func (s *Supervisor) Restarts() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var restarts int
+	for _, u := range s.units {
+		restarts += u.status.Restarts
+	}
+
+	return restarts
+}
+
+// ErrUnhealthy is returned by Healthy when some of the subsystems are not running.
+var ErrUnhealthy = errors.New("subsystems are not running")
+
+// Healthy returns nil when all the subsystems are running, and
+// which of them are not, and why, otherwise.
+func (s *Supervisor) Healthy() error {
+	var unhealthy []string
+
+	for _, status := range s.Status() {
+		switch {
+		case status.State == StateRunning:
+		case status.LastError != "":
+			unhealthy = append(unhealthy, fmt.Sprintf("%s is %s: %s", status.Name, status.State, status.LastError))
+		default:
+			unhealthy = append(unhealthy, fmt.Sprintf("%s is %s", status.Name, status.State))
+		}
+	}
+
+	if len(unhealthy) != 0 {
+		return fmt.Errorf("%w: %s", ErrUnhealthy, strings.Join(unhealthy, ", "))
+	}
+
+	return nil
+}
+
+// Collect returns the metrics of the subsystems for the Prometheus endpoint, see metrics.Registry.
+func (s *Supervisor) Collect() []metrics.Family {
+	statuses := s.Status()
+
+	up := make([]metrics.Sample, 0, len(statuses))
+	restarts := make([]metrics.Sample, 0, len(statuses))
+	panics := make([]metrics.Sample, 0, len(statuses))
+
+	for _, status := range statuses {
+		labels := []metrics.Label{{Name: "subsystem", Value: status.Name}}
+
+		value := 0.0
+		if status.State == StateRunning {
+			value = 1
+		}
+
+		up = append(up, metrics.Sample{Labels: labels, Value: value})
+		restarts = append(restarts, metrics.Sample{Labels: labels, Value: float64(status.Restarts)})
+		panics = append(panics, metrics.Sample{Labels: labels, Value: float64(status.Panics)})
+	}
+
+	return []metrics.Family{
+		{
+			Name:    metrics.Namespace + "subsystem_up",
+			Help:    "Whether the subsystem is running.",
+			Type:    metrics.TypeGauge,
+			Samples: up,
+		},
+		{
+			Name:    metrics.Namespace + "subsystem_restarts_total",
+			Help:    "Number of times that the subsystem was restarted after it failed.",
+			Type:    metrics.TypeCounter,
+			Samples: restarts,
+		},
+		{
+			Name:    metrics.Namespace + "subsystem_panics_total",
+			Help:    "Number of times that the subsystem panicked.",
+			Type:    metrics.TypeCounter,
+			Samples: panics,
+		},
+	}
+}
@@ -0,0 +1,595 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package supervisor_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errBroken = errors.New("broken subsystem")
+
+// statusOf returns the status of the named subsystem.
+func statusOf(t *testing.T, s *supervisor.Supervisor, name string) supervisor.Status {
+	t.Helper()
+
+	for _, status := range s.Status() {
+		if status.Name == name {
+			return status
+		}
+	}
+
+	require.Failf(t, "unknown subsystem", "%s is not supervised", name)
+
+	return supervisor.Status{}
+}
+
+func TestSupervisorRestartsFailingSubsystem(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := supervisor.New(time.Millisecond, 5*time.Millisecond)
+
+	var (
+		failures atomic.Int32
+		starts   atomic.Int32
+		stopped  atomic.Bool
+	)
+
+	s.Go(ctx, "healthy", func(ctx context.Context) error {
+		starts.Add(1)
+		<-ctx.Done()
+		stopped.Store(true)
+
+		return ctx.Err()
+	})
+	s.Go(ctx, "failing", func(context.Context) error {
+		failures.Add(1)
+
+		return errBroken
+	})
+
+	require.Eventually(t, func() bool {
+		return failures.Load() >= 10
+	}, 5*time.Second, time.Millisecond)
+
+	// The healthy subsystem was neither stopped nor restarted by the failures.
+	assert.False(t, stopped.Load())
+	assert.Equal(t, int32(1), starts.Load())
+	assert.Equal(t, supervisor.StateRunning, statusOf(t, s, "healthy").State)
+
+	failing := statusOf(t, s, "failing")
+	assert.Contains(t, []supervisor.State{supervisor.StateRunning, supervisor.StateBackingOff}, failing.State)
+	assert.GreaterOrEqual(t, failing.Restarts, 9)
+	assert.Equal(t, errBroken.Error(), failing.LastError)
+
+	cancel()
+	require.NoError(t, s.Wait())
+	assert.True(t, stopped.Load())
+
+	registry := metrics.NewRegistry()
+	registry.Register(s)
+
+	var output strings.Builder
+
+	require.NoError(t, registry.Write(&output))
+	assert.Contains(t, output.String(), "\nrd_guestagent_subsystem_up{subsystem=\"healthy\"} 0\n")
+	assert.Contains(t, output.String(), "\nrd_guestagent_subsystem_restarts_total{subsystem=\"healthy\"} 0\n")
+	assert.Regexp(t, `\nrd_guestagent_subsystem_restarts_total\{subsystem="failing"\} (9|[1-9][0-9]+)\n`, output.String())
+
+	for _, status := range s.Status() {
+		assert.Equal(t, supervisor.StateStopped, status.State, status.Name)
+	}
+}
+
+func TestSupervisorPermanentFailure(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := supervisor.New(time.Millisecond, time.Millisecond)
+
+	var runs atomic.Int32
+
+	s.Go(ctx, "misconfigured", func(context.Context) error {
+		runs.Add(1)
+
+		return supervisor.Permanent(errBroken)
+	})
+	s.Go(ctx, "healthy", func(ctx context.Context) error {
+		<-ctx.Done()
+
+		return nil
+	})
+
+	require.Eventually(t, func() bool {
+		return statusOf(t, s, "misconfigured").State == supervisor.StateFailed
+	}, 5*time.Second, time.Millisecond)
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), runs.Load())
+	require.EqualError(t, s.Healthy(), "subsystems are not running: misconfigured is failed: "+supervisor.Permanent(errBroken).Error())
+	assert.Equal(t, supervisor.StateRunning, statusOf(t, s, "healthy").State)
+
+	cancel()
+
+	err := s.Wait()
+	require.ErrorIs(t, err, supervisor.ErrPermanent)
+	require.ErrorIs(t, err, errBroken)
+	assert.ErrorContains(t, err, "misconfigured")
+}
+
+func TestSupervisorFailureHook(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		mutex    sync.Mutex
+		failures []string
+	)
+
+	s := supervisor.New(time.Millisecond, time.Millisecond, supervisor.WithFailureHook(
+		func(name string, state supervisor.State, err error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			failures = append(failures, fmt.Sprintf("%s %s: %v", name, state, err))
+		}))
+
+	var runs atomic.Int32
+
+	s.Go(ctx, "flaky", func(context.Context) error {
+		if runs.Add(1) == 1 {
+			return errBroken
+		}
+
+		return supervisor.Permanent(errBroken)
+	})
+
+	require.Eventually(t, func() bool {
+		return statusOf(t, s, "flaky").State == supervisor.StateFailed
+	}, 5*time.Second, time.Millisecond)
+
+	cancel()
+	require.Error(t, s.Wait())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	assert.Equal(t, []string{
+		"flaky backing off: " + errBroken.Error(),
+		"flaky failed: " + supervisor.Permanent(errBroken).Error(),
+	}, failures)
+}
+
+func TestSupervisorHealth(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := supervisor.New(time.Hour, time.Hour)
+
+	var (
+		runs    atomic.Int32
+		fail    = make(chan error)
+		succeed = make(chan struct{})
+		// reported is sent to once the report is recorded.
+		reported = make(chan struct{})
+	)
+
+	before := time.Now()
+
+	s.Go(ctx, "watcher", func(ctx context.Context) error {
+		runs.Add(1)
+
+		health := supervisor.HealthReporter(ctx)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case err := <-fail:
+				health.Failed(err)
+			case <-succeed:
+				health.Succeeded()
+			}
+
+			reported <- struct{}{}
+		}
+	})
+
+	// The errors that the subsystem recovers from do not stop it.
+	fail <- errBroken
+	<-reported
+
+	status := statusOf(t, s, "watcher")
+	assert.Equal(t, supervisor.StateRunning, status.State)
+	assert.Equal(t, errBroken.Error(), status.LastError)
+	assert.False(t, status.LastErrorTime.Before(before))
+	assert.True(t, status.LastSuccess.IsZero())
+
+	succeed <- struct{}{}
+	<-reported
+
+	// The recovery is told by a success after the last error.
+	status = statusOf(t, s, "watcher")
+	assert.False(t, status.LastSuccess.Before(status.LastErrorTime))
+	assert.Equal(t, int32(1), runs.Load())
+
+	var restarted atomic.Bool
+
+	s.Go(ctx, "crashing", func(ctx context.Context) error {
+		if restarted.Swap(true) {
+			supervisor.HealthReporter(ctx).Succeeded()
+			<-ctx.Done()
+
+			return nil
+		}
+
+		return errBroken
+	})
+
+	require.Eventually(t, func() bool {
+		return statusOf(t, s, "crashing").State == supervisor.StateBackingOff
+	}, 5*time.Second, time.Millisecond)
+
+	crashing := statusOf(t, s, "crashing")
+	assert.Equal(t, time.Hour, crashing.Backoff)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), crashing.NextRestart, time.Minute)
+	assert.Equal(t, errBroken.Error(), crashing.LastError)
+	assert.False(t, crashing.LastErrorTime.IsZero())
+	assert.True(t, crashing.LastSuccess.IsZero())
+
+	// Outside of a subsystem, the reports are discarded.
+	supervisor.HealthReporter(context.Background()).Failed(errBroken)
+
+	cancel()
+	require.NoError(t, s.Wait())
+
+	crashing = statusOf(t, s, "crashing")
+	assert.Equal(t, supervisor.StateStopped, crashing.State)
+	assert.Zero(t, crashing.Backoff)
+	assert.True(t, crashing.NextRestart.IsZero())
+}
+
+func TestSupervisorHealthRecovery(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := supervisor.New(time.Millisecond, time.Millisecond)
+
+	var runs atomic.Int32
+
+	s.Go(ctx, "flaky", func(ctx context.Context) error {
+		if runs.Add(1) <= 2 {
+			return errBroken
+		}
+
+		supervisor.HealthReporter(ctx).Succeeded()
+		<-ctx.Done()
+
+		return nil
+	})
+
+	require.Eventually(t, func() bool {
+		return !statusOf(t, s, "flaky").LastSuccess.IsZero()
+	}, 5*time.Second, time.Millisecond)
+
+	status := statusOf(t, s, "flaky")
+	assert.Equal(t, supervisor.StateRunning, status.State)
+	assert.Equal(t, 2, status.Restarts)
+	assert.Zero(t, status.Backoff)
+	assert.True(t, status.NextRestart.IsZero())
+	assert.Equal(t, errBroken.Error(), status.LastError)
+	assert.True(t, status.LastSuccess.After(status.LastErrorTime))
+
+	cancel()
+	require.NoError(t, s.Wait())
+}
+
+func TestSupervisorCompletedSubsystem(t *testing.T) {
+	t.Parallel()
+
+	s := supervisor.New(time.Millisecond, time.Millisecond)
+
+	var runs atomic.Int32
+
+	s.Go(context.Background(), "one-shot", func(context.Context) error {
+		runs.Add(1)
+
+		return nil
+	})
+
+	// Wait returns once all the subsystems stopped, even without a cancellation.
+	require.NoError(t, s.Wait())
+	assert.Equal(t, int32(1), runs.Load())
+
+	status := s.Status()
+	require.Len(t, status, 1)
+	assert.WithinDuration(t, time.Now(), status[0].Stopped, time.Minute)
+
+	status[0].Stopped = time.Time{}
+	assert.Equal(t, []supervisor.Status{{Name: "one-shot", State: supervisor.StateStopped}}, status)
+	require.EqualError(t, s.Healthy(), "subsystems are not running: one-shot is stopped")
+}
+
+func TestSupervisorStopsWhileBackingOff(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := supervisor.New(time.Hour, time.Hour)
+
+	s.Go(ctx, "failing", func(context.Context) error {
+		return errBroken
+	})
+
+	require.Eventually(t, func() bool {
+		return statusOf(t, s, "failing").State == supervisor.StateBackingOff
+	}, 5*time.Second, time.Millisecond)
+
+	err := s.Healthy()
+	require.ErrorIs(t, err, supervisor.ErrUnhealthy)
+	require.EqualError(t, err, "subsystems are not running: failing is backing off: broken subsystem")
+
+	assert.True(t, statusOf(t, s, "failing").Stopped.IsZero())
+
+	cancelled := time.Now()
+
+	cancel()
+	require.NoError(t, s.Wait())
+	assert.Equal(t, supervisor.StateStopped, statusOf(t, s, "failing").State)
+	assert.False(t, statusOf(t, s, "failing").Stopped.Before(cancelled))
+}
+
+func TestSupervisorRecoversFromPanics(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := supervisor.New(time.Millisecond, time.Millisecond, supervisor.WithPanicBudget(100, time.Hour))
+
+	var (
+		runs    atomic.Int32
+		stopped atomic.Bool
+	)
+
+	s.Go(ctx, "panicking", func(ctx context.Context) error {
+		// The subsystem panics on its first runs, and keeps running once it was restarted enough.
+		if runs.Add(1) <= 3 {
+			panic("malformed event")
+		}
+
+		<-ctx.Done()
+
+		return nil
+	})
+	s.Go(ctx, "healthy", func(ctx context.Context) error {
+		<-ctx.Done()
+		stopped.Store(true)
+
+		return nil
+	})
+
+	require.Eventually(t, func() bool {
+		return statusOf(t, s, "panicking").State == supervisor.StateRunning && runs.Load() == 4
+	}, 5*time.Second, time.Millisecond)
+
+	panicking := statusOf(t, s, "panicking")
+	assert.Equal(t, 3, panicking.Restarts)
+	assert.Equal(t, 3, panicking.Panics)
+	assert.Contains(t, panicking.LastError, "panic: malformed event")
+
+	// The panics did not reach the other subsystems.
+	assert.False(t, stopped.Load())
+	assert.Equal(t, supervisor.StateRunning, statusOf(t, s, "healthy").State)
+
+	registry := metrics.NewRegistry()
+	registry.Register(s)
+
+	var output strings.Builder
+
+	require.NoError(t, registry.Write(&output))
+	assert.Contains(t, output.String(), "\nrd_guestagent_subsystem_panics_total{subsystem=\"panicking\"} 3\n")
+	assert.Contains(t, output.String(), "\nrd_guestagent_subsystem_panics_total{subsystem=\"healthy\"} 0\n")
+
+	cancel()
+	require.NoError(t, s.Wait())
+	assert.True(t, stopped.Load())
+}
+
+func TestSupervisorPanicBudget(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := supervisor.New(time.Millisecond, time.Millisecond, supervisor.WithPanicBudget(3, time.Hour))
+
+	var runs atomic.Int32
+
+	s.Go(ctx, "panicking", func(context.Context) error {
+		runs.Add(1)
+		panic("unexpected nil")
+	})
+	s.Go(ctx, "healthy", func(ctx context.Context) error {
+		<-ctx.Done()
+
+		return nil
+	})
+
+	require.Eventually(t, func() bool {
+		return statusOf(t, s, "panicking").State == supervisor.StateFailed
+	}, 5*time.Second, time.Millisecond)
+
+	// The subsystem that keeps panicking is no longer restarted, the others keep running.
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(3), runs.Load())
+	assert.Equal(t, 3, statusOf(t, s, "panicking").Panics)
+	assert.Equal(t, supervisor.StateRunning, statusOf(t, s, "healthy").State)
+
+	cancel()
+
+	err := s.Wait()
+	require.ErrorIs(t, err, supervisor.ErrPermanent)
+	require.ErrorIs(t, err, supervisor.ErrPanic)
+	assert.ErrorContains(t, err, "panicking: permanent failure: panicked 3 times in 1h0m0s: panic: unexpected nil")
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := supervisor.New(time.Millisecond, time.Millisecond)
+
+	var (
+		restartedStarts atomic.Int32
+		restartedUp     atomic.Bool
+		otherStarts     atomic.Int32
+	)
+
+	s.Go(ctx, "restarted", func(ctx context.Context) error {
+		restartedStarts.Add(1)
+		restartedUp.Store(true)
+		defer restartedUp.Store(false)
+
+		<-ctx.Done()
+
+		return nil
+	})
+	s.Go(ctx, "other", func(ctx context.Context) error {
+		otherStarts.Add(1)
+		<-ctx.Done()
+
+		return nil
+	})
+
+	require.Eventually(t, func() bool {
+		return restartedStarts.Load() == 1 && otherStarts.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+
+	waited := make(chan error, 1)
+
+	go func() {
+		waited <- s.Wait("restarted")
+	}()
+
+	// The subsystem is stopped while apply runs.
+	var upWhileApplying bool
+
+	restarted := s.Restart([]string{"restarted"}, func() {
+		upWhileApplying = restartedUp.Load()
+	})
+	assert.Equal(t, []string{"restarted"}, restarted)
+	assert.False(t, upWhileApplying)
+
+	require.Eventually(t, func() bool {
+		return restartedStarts.Load() == 2
+	}, 5*time.Second, time.Millisecond)
+
+	assert.Equal(t, int32(1), otherStarts.Load())
+	assert.Equal(t, supervisor.StateRunning, statusOf(t, s, "restarted").State)
+	assert.Equal(t, 1, statusOf(t, s, "restarted").Restarts)
+	assert.Equal(t, 0, statusOf(t, s, "other").Restarts)
+
+	// Wait does not see the restarted subsystem stop.
+	select {
+	case err := <-waited:
+		require.Failf(t, "the restart was waited for", "Wait returned %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	cancel()
+	require.NoError(t, <-waited)
+	require.NoError(t, s.Wait())
+}
+
+func TestSupervisorRestartFailed(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := supervisor.New(time.Millisecond, time.Millisecond)
+
+	var fixed atomic.Bool
+
+	s.Go(ctx, "misconfigured", func(ctx context.Context) error {
+		if !fixed.Load() {
+			return supervisor.Permanent(errBroken)
+		}
+
+		<-ctx.Done()
+
+		return nil
+	})
+
+	require.Eventually(t, func() bool {
+		return statusOf(t, s, "misconfigured").State == supervisor.StateFailed
+	}, 5*time.Second, time.Millisecond)
+
+	// The subsystem that failed permanently runs again once its configuration is fixed.
+	assert.Equal(t, []string{"misconfigured"}, s.Restart([]string{"misconfigured"}, func() { fixed.Store(true) }))
+	assert.Equal(t, supervisor.StateRunning, statusOf(t, s, "misconfigured").State)
+	require.NoError(t, s.Healthy())
+
+	cancel()
+	require.NoError(t, s.Wait())
+}
+
+func TestSupervisorRestartStopped(t *testing.T) {
+	t.Parallel()
+
+	s := supervisor.New(time.Millisecond, time.Millisecond)
+
+	var runs atomic.Int32
+
+	s.Go(context.Background(), "stopped", func(ctx context.Context) error {
+		runs.Add(1)
+		<-ctx.Done()
+
+		return nil
+	})
+
+	require.NoError(t, s.Stop(context.Background(), "stopped"))
+
+	// The subsystems that were stopped are not run again, apply is still called.
+	applied := false
+	assert.Empty(t, s.Restart([]string{"stopped"}, func() { applied = true }))
+	assert.True(t, applied)
+	assert.Equal(t, int32(1), runs.Load())
+	assert.Equal(t, supervisor.StateStopped, statusOf(t, s, "stopped").State)
+	require.NoError(t, s.Wait())
+}
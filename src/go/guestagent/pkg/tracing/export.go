@@ -0,0 +1,180 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The defaults of the batches of NewBatchExporter, like the batch span
+// processor of OpenTelemetry.
+const (
+	DefaultBatchInterval = 5 * time.Second
+	DefaultBatchSize     = 512
+	DefaultQueueSize     = 2048
+)
+
+// InMemoryExporter keeps the spans in memory, for the tests.
+type InMemoryExporter struct {
+	mutex sync.Mutex
+	spans []SpanData
+}
+
+// NewInMemoryExporter creates an exporter without any spans.
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+// ExportSpans keeps the spans.
+func (e *InMemoryExporter) ExportSpans(_ context.Context, spans []SpanData) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.spans = append(e.spans, spans...)
+
+	return nil
+}
+
+// Shutdown does nothing, the spans are kept.
+func (e *InMemoryExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// Spans returns the spans in the order that they ended.
+func (e *InMemoryExporter) Spans() []SpanData {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return append([]SpanData(nil), e.spans...)
+}
+
+// BatchExporter queues the spans and exports them in batches with another
+// exporter, so that ending a span never waits for the network. The spans
+// that do not fit in the queue are dropped.
+type BatchExporter struct {
+	exporter  Exporter
+	interval  time.Duration
+	batchSize int
+	queue     chan SpanData
+	done      chan struct{}
+	stopped   chan struct{}
+	stop      sync.Once
+	dropped   atomic.Uint64
+}
+
+// NewBatchExporter starts exporting the spans with the exporter, every
+// interval or whenever the batch size is queued, until Shutdown.
+func NewBatchExporter(exporter Exporter, interval time.Duration, batchSize, queueSize int) *BatchExporter {
+	b := &BatchExporter{
+		exporter:  exporter,
+		interval:  interval,
+		batchSize: batchSize,
+		queue:     make(chan SpanData, queueSize),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+
+	go b.run()
+
+	return b
+}
+
+// ExportSpans queues the spans, it never blocks.
+func (b *BatchExporter) ExportSpans(_ context.Context, spans []SpanData) error {
+	for _, span := range spans {
+		// The spans that end after the shutdown are dropped, rather than left in the queue.
+		select {
+		case <-b.done:
+			b.dropped.Add(1)
+
+			continue
+		default:
+		}
+
+		select {
+		case b.queue <- span:
+		default:
+			b.dropped.Add(1)
+		}
+	}
+
+	return nil
+}
+
+// Dropped returns the number of the spans that did not fit in the queue.
+func (b *BatchExporter) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+// Shutdown exports the queued spans and stops the exporter, it gives up
+// once the context is done.
+func (b *BatchExporter) Shutdown(ctx context.Context) error {
+	b.stop.Do(func() { close(b.done) })
+
+	select {
+	case <-b.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return b.exporter.Shutdown(ctx)
+}
+
+// run exports the batches until Shutdown, and then the spans that are left.
+func (b *BatchExporter) run() {
+	defer close(b.stopped)
+
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	batch := make([]SpanData, 0, b.batchSize)
+
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		if err := b.exporter.ExportSpans(context.Background(), batch); err != nil {
+			logger.Warnf("failed to export %d spans: %v", len(batch), err)
+		}
+
+		batch = make([]SpanData, 0, b.batchSize)
+	}
+
+	for {
+		select {
+		case span := <-b.queue:
+			batch = append(batch, span)
+			if len(batch) >= b.batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case <-b.done:
+			for {
+				select {
+				case span := <-b.queue:
+					batch = append(batch, span)
+				default:
+					export()
+
+					return
+				}
+			}
+		}
+	}
+}
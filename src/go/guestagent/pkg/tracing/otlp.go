@@ -0,0 +1,328 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The standard environment variables of the OTLP exporter that the agent
+// reads, see
+// https://opentelemetry.io/docs/specs/otel/protocol/exporter/ and
+// https://opentelemetry.io/docs/specs/otel/configuration/sdk-environment-variables/.
+const (
+	EnvEndpoint       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	EnvTracesEndpoint = "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"
+	EnvHeaders        = "OTEL_EXPORTER_OTLP_HEADERS"
+	EnvTracesHeaders  = "OTEL_EXPORTER_OTLP_TRACES_HEADERS"
+	EnvProtocol       = "OTEL_EXPORTER_OTLP_PROTOCOL"
+	EnvTracesProtocol = "OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"
+	EnvTimeout        = "OTEL_EXPORTER_OTLP_TIMEOUT"
+	EnvTracesTimeout  = "OTEL_EXPORTER_OTLP_TRACES_TIMEOUT"
+	EnvServiceName    = "OTEL_SERVICE_NAME"
+	EnvSDKDisabled    = "OTEL_SDK_DISABLED"
+)
+
+const (
+	// ProtocolJSON is the only protocol of OTLP that the agent exports with,
+	// protobuf over HTTP, which it encodes as JSON.
+	ProtocolJSON = "http/json"
+	// DefaultServiceName is the name of the service of the spans, unless
+	// OTEL_SERVICE_NAME names another one.
+	DefaultServiceName = "rancher-desktop-guestagent"
+	// DefaultTimeout is the time that an export may take, unless
+	// OTEL_EXPORTER_OTLP_TIMEOUT sets another one.
+	DefaultTimeout = 10 * time.Second
+	// tracesPath is the path of the traces, after OTEL_EXPORTER_OTLP_ENDPOINT.
+	tracesPath = "/v1/traces"
+	// scopeName is the name of the instrumentation scope of the spans.
+	scopeName = "github.com/rancher-sandbox/rancher-desktop/src/go/guestagent"
+)
+
+var (
+	// ErrConfig is returned by FromEnv for the environment variables that it can not use.
+	ErrConfig = errors.New("invalid OTLP exporter configuration")
+	// ErrExport is returned for the exports that the collector rejects.
+	ErrExport = errors.New("the OTLP collector rejected the spans")
+)
+
+// OTLPExporter exports the spans to an OTLP collector with HTTP and JSON.
+type OTLPExporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	version     string
+	client      *http.Client
+}
+
+// NewOTLPExporter creates an exporter that posts the spans to the URL of the
+// traces of a collector, e.g. http://localhost:4318/v1/traces.
+func NewOTLPExporter(endpoint string, headers map[string]string, serviceName, version string, timeout time.Duration) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		version:     version,
+		client:      &http.Client{Timeout: timeout},
+	}
+}
+
+// FromEnv returns the tracer of the standard environment variables of the
+// OTLP exporter, which exports in batches; it returns nil if no endpoint is
+// set, or if OTEL_SDK_DISABLED is true.
+func FromEnv(lookupEnv func(string) (string, bool), version string) (*Tracer, error) {
+	getenv := func(names ...string) string {
+		for _, name := range names {
+			if value, ok := lookupEnv(name); ok && value != "" {
+				return value
+			}
+		}
+
+		return ""
+	}
+
+	if disabled, _ := strconv.ParseBool(getenv(EnvSDKDisabled)); disabled {
+		return nil, nil
+	}
+
+	endpoint := getenv(EnvTracesEndpoint)
+	if endpoint == "" {
+		endpoint = getenv(EnvEndpoint)
+		if endpoint == "" {
+			return nil, nil
+		}
+
+		endpoint = strings.TrimSuffix(endpoint, "/") + tracesPath
+	}
+
+	if parsed, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("%w: endpoint %q: %w", ErrConfig, endpoint, err)
+	} else if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("%w: endpoint %q is not an HTTP URL", ErrConfig, endpoint)
+	}
+
+	if protocol := getenv(EnvTracesProtocol, EnvProtocol); protocol != "" && protocol != ProtocolJSON {
+		return nil, fmt.Errorf("%w: protocol %q is not supported, only %s is", ErrConfig, protocol, ProtocolJSON)
+	}
+
+	headers, err := parseHeaders(getenv(EnvTracesHeaders, EnvHeaders))
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := DefaultTimeout
+	if value := getenv(EnvTracesTimeout, EnvTimeout); value != "" {
+		milliseconds, err := strconv.Atoi(value)
+		if err != nil || milliseconds <= 0 {
+			return nil, fmt.Errorf("%w: timeout %q is not a positive number of milliseconds", ErrConfig, value)
+		}
+
+		timeout = time.Duration(milliseconds) * time.Millisecond
+	}
+
+	serviceName := getenv(EnvServiceName)
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+
+	exporter := NewOTLPExporter(endpoint, headers, serviceName, version, timeout)
+
+	return NewTracer(NewBatchExporter(exporter, DefaultBatchInterval, DefaultBatchSize, DefaultQueueSize)), nil
+}
+
+// Endpoint returns the URL that the spans are posted to.
+func (e *OTLPExporter) Endpoint() string {
+	return e.endpoint
+}
+
+// ExportSpans posts the spans to the collector.
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return fmt.Errorf("failed to encode the spans: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create the export request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	for name, value := range e.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to export the spans: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+		return fmt.Errorf("%w: %s: %s", ErrExport, resp.Status, strings.TrimSpace(string(message)))
+	}
+
+	return nil
+}
+
+// Shutdown does nothing, the spans are posted as they are exported.
+func (e *OTLPExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// parseHeaders parses the headers of OTEL_EXPORTER_OTLP_HEADERS, e.g.
+// "api-key=secret,tenant=rd", whose values are URL encoded.
+func parseHeaders(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	headers := make(map[string]string)
+
+	for _, pair := range strings.Split(value, ",") {
+		name, encoded, ok := strings.Cut(pair, "=")
+		name = strings.TrimSpace(name)
+
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%w: header %q is not in the name=value form", ErrConfig, pair)
+		}
+
+		decoded, err := url.QueryUnescape(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("%w: header %q: %w", ErrConfig, name, err)
+		}
+
+		headers[name] = decoded
+	}
+
+	return headers, nil
+}
+
+// The messages of OTLP/JSON, see
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding; the
+// integers of 64 bits are encoded as strings, and the IDs in hex.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+const (
+	// spanKindInternal is SPAN_KIND_INTERNAL, the spans of the agent are all internal.
+	spanKindInternal = 1
+	// statusCodeError is STATUS_CODE_ERROR.
+	statusCodeError = 2
+)
+
+// request returns the request that exports the spans.
+func (e *OTLPExporter) request(spans []SpanData) otlpRequest {
+	converted := make([]otlpSpan, 0, len(spans))
+
+	for i := range spans {
+		span := &spans[i]
+		otlp := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+
+		if span.Parent.IsValid() {
+			otlp.ParentSpanID = span.Parent.String()
+		}
+
+		if span.Error != "" {
+			otlp.Status = &otlpStatus{Code: statusCodeError, Message: span.Error}
+		}
+
+		converted = append(converted, otlp)
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource: otlpResource{Attributes: otlpAttributes([]Attribute{
+					String("service.name", e.serviceName),
+					String("service.version", e.version),
+				})},
+				ScopeSpans: []otlpScopeSpans{
+					{Scope: otlpScope{Name: scopeName, Version: e.version}, Spans: converted},
+				},
+			},
+		},
+	}
+}
+
+// otlpAttributes converts the attributes to OTLP.
+func otlpAttributes(attrs []Attribute) []otlpAttribute {
+	converted := make([]otlpAttribute, 0, len(attrs))
+	for _, attr := range attrs {
+		converted = append(converted, otlpAttribute{Key: attr.Key, Value: otlpValue{StringValue: attr.Value}})
+	}
+
+	return converted
+}
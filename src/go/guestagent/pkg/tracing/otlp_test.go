@@ -0,0 +1,167 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromEnv(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		enabled bool
+		err     error
+	}{
+		{name: "unset"},
+		{name: "endpoint", env: map[string]string{tracing.EnvEndpoint: "http://localhost:4318"}, enabled: true},
+		{name: "traces endpoint", env: map[string]string{tracing.EnvTracesEndpoint: "http://localhost:4318/v1/traces"}, enabled: true},
+		{
+			name: "disabled",
+			env:  map[string]string{tracing.EnvEndpoint: "http://localhost:4318", tracing.EnvSDKDisabled: "true"},
+		},
+		{
+			name:    "JSON",
+			env:     map[string]string{tracing.EnvEndpoint: "http://localhost:4318", tracing.EnvProtocol: tracing.ProtocolJSON},
+			enabled: true,
+		},
+		{
+			name: "gRPC",
+			env:  map[string]string{tracing.EnvEndpoint: "http://localhost:4317", tracing.EnvTracesProtocol: "grpc"},
+			err:  tracing.ErrConfig,
+		},
+		{name: "invalid endpoint", env: map[string]string{tracing.EnvEndpoint: "localhost:4318"}, err: tracing.ErrConfig},
+		{
+			name: "invalid headers",
+			env:  map[string]string{tracing.EnvEndpoint: "http://localhost:4318", tracing.EnvHeaders: "api-key"},
+			err:  tracing.ErrConfig,
+		},
+		{
+			name: "invalid timeout",
+			env:  map[string]string{tracing.EnvEndpoint: "http://localhost:4318", tracing.EnvTimeout: "10s"},
+			err:  tracing.ErrConfig,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			tracer, err := tracing.FromEnv(func(name string) (string, bool) {
+				value, ok := tt.env[name]
+
+				return value, ok
+			}, "1.0.0")
+			require.ErrorIs(t, err, tt.err)
+			assert.Equal(t, tt.enabled, tracer != nil)
+			require.NoError(t, tracer.Shutdown(context.Background()))
+		})
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	t.Parallel()
+
+	requests := make(chan *http.Request, 1)
+	bodies := make(chan map[string]any, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		requests <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	tracer, err := tracing.FromEnv(func(name string) (string, bool) {
+		value, ok := map[string]string{
+			tracing.EnvEndpoint:    server.URL,
+			tracing.EnvHeaders:     "api-key=a%20secret",
+			tracing.EnvServiceName: "guestagent",
+		}[name]
+
+		return value, ok
+	}, "1.0.0")
+	require.NoError(t, err)
+
+	ctx, root := tracer.Start(context.Background(), "docker.event", tracing.String(tracing.AttrCorrelationID, "1234"))
+	_, child := tracing.Start(ctx, "tracker.add")
+	child.RecordError(errors.New("failed"))
+	child.End()
+	root.End()
+
+	// The spans that are left are exported on shutdown.
+	require.NoError(t, tracer.Shutdown(context.Background()))
+
+	var req *http.Request
+	select {
+	case req = <-requests:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the spans were not exported")
+	}
+
+	assert.Equal(t, "/v1/traces", req.URL.Path)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "a secret", req.Header.Get("api-key"))
+
+	body := <-bodies
+	resourceSpans := body["resourceSpans"].([]any)[0].(map[string]any)
+	assert.Contains(t, resourceSpans["resource"].(map[string]any)["attributes"],
+		map[string]any{"key": "service.name", "value": map[string]any{"stringValue": "guestagent"}})
+
+	spans := resourceSpans["scopeSpans"].([]any)[0].(map[string]any)["spans"].([]any)
+	require.Len(t, spans, 2)
+
+	child0, root0 := spans[0].(map[string]any), spans[1].(map[string]any)
+	assert.Equal(t, "tracker.add", child0["name"])
+	assert.Equal(t, root0["spanId"], child0["parentSpanId"])
+	assert.Equal(t, root0["traceId"], child0["traceId"])
+	assert.Len(t, root0["traceId"], 32)
+	assert.NotContains(t, root0, "parentSpanId")
+	assert.Equal(t, map[string]any{"code": float64(2), "message": "failed"}, child0["status"])
+	assert.Contains(t, root0["attributes"],
+		map[string]any{"key": tracing.AttrCorrelationID, "value": map[string]any{"stringValue": "1234"}})
+}
+
+func TestOTLPExporterRejected(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	exporter := tracing.NewOTLPExporter(server.URL+"/v1/traces", nil, tracing.DefaultServiceName, "1.0.0", time.Second)
+
+	err := exporter.ExportSpans(context.Background(), []tracing.SpanData{{Name: "docker.event"}})
+	require.ErrorIs(t, err, tracing.ErrExport)
+	assert.Contains(t, err.Error(), "unauthorized")
+}
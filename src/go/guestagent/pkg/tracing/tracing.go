@@ -0,0 +1,269 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tracing traces the changes to the port mappings through the agent,
+// from the event of a source to the send to the host, for the debugging of
+// their latency and of their failures. The spans are exported with OTLP, see
+// FromEnv; without a tracer, starting a span does nothing and costs next to
+// nothing, so that the agent can trace unconditionally.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The names of the attributes that the spans of the agent share.
+const (
+	AttrCorrelationID = "correlationID"
+	AttrSource        = "source"
+	AttrID            = "id"
+)
+
+// TraceID identifies a trace, the spans of a change to a port mapping.
+type TraceID [16]byte
+
+// String returns the ID in hex, like OTLP/JSON.
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+// SpanID identifies a span of a trace.
+type SpanID [8]byte
+
+// String returns the ID in hex, like OTLP/JSON.
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// IsValid returns true if the ID is set, the parent of a root span is not.
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+// Attribute is a key/value pair that describes a span.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// String returns an attribute with the key and the value.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// SpanData is a span that ended, as it is exported.
+type SpanData struct {
+	TraceID TraceID
+	SpanID  SpanID
+	// Parent is not valid for the root spans.
+	Parent     SpanID
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	// Error is the error that the operation of the span failed with, if any.
+	Error string
+}
+
+// Attribute returns the value of the attribute with the key, if the span has it.
+func (s SpanData) Attribute(key string) (string, bool) {
+	for _, attr := range s.Attributes {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+
+	return "", false
+}
+
+// Exporter exports the spans that ended, see InMemoryExporter and FromEnv.
+type Exporter interface {
+	// ExportSpans exports the spans, it must not block the operation that
+	// ended them for long, see NewBatchExporter.
+	ExportSpans(ctx context.Context, spans []SpanData) error
+	// Shutdown exports the spans that are left and stops the exporter.
+	Shutdown(ctx context.Context) error
+}
+
+// Tracer starts the spans and exports them once they end.
+type Tracer struct {
+	exporter Exporter
+}
+
+// NewTracer creates a tracer that exports its spans with the exporter.
+func NewTracer(exporter Exporter) *Tracer {
+	return &Tracer{exporter: exporter}
+}
+
+// Start starts a span, whose parent is the span of the context if there is
+// one; the returned context carries the new span for its children.
+func (t *Tracer) Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		data: SpanData{
+			SpanID:     newSpanID(),
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: append([]Attribute(nil), attrs...),
+		},
+	}
+
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.data.TraceID = parent.data.TraceID
+		span.data.Parent = parent.data.SpanID
+	} else {
+		span.data.TraceID = newTraceID()
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Shutdown exports the spans that are left, within the context.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+
+	return t.exporter.Shutdown(ctx)
+}
+
+// export exports a span that ended.
+func (t *Tracer) export(data SpanData) {
+	if err := t.exporter.ExportSpans(context.Background(), []SpanData{data}); err != nil {
+		logger.Debugf("failed to export the span %s: %v", data.Name, err)
+	}
+}
+
+// Span is an operation of a trace; a nil span, which Start returns without
+// a tracer, does nothing.
+type Span struct {
+	tracer *Tracer
+	mutex  sync.Mutex
+	data   SpanData
+	ended  bool
+}
+
+// SetAttributes adds the attributes to the span.
+func (s *Span) SetAttributes(attrs ...Attribute) {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data.Attributes = append(s.data.Attributes, attrs...)
+}
+
+// RecordError records that the operation of the span failed with the error, if it is not nil.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.data.Error = err.Error()
+}
+
+// End ends the span and exports it, only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+
+		return
+	}
+
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.mutex.Unlock()
+
+	s.tracer.export(data)
+}
+
+// spanKey is the key of the span of a context.
+type spanKey struct{}
+
+// SpanFromContext returns the span of the context, or nil if it has none.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+
+	return span
+}
+
+// ContextWithSpan returns a context that carries the span, e.g. to trace an
+// operation that outlives the context of its parent.
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	if span == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, spanKey{}, span)
+}
+
+// current is the tracer of Start, see SetTracer.
+var current atomic.Pointer[Tracer] //nolint:gochecknoglobals
+
+// SetTracer sets the tracer that Start starts the root spans with, nil
+// disables the tracing.
+func SetTracer(tracer *Tracer) {
+	current.Store(tracer)
+}
+
+// Enabled returns true if SetTracer set a tracer.
+func Enabled() bool {
+	return current.Load() != nil
+}
+
+// Start starts a span like Tracer.Start: the children of a span are started
+// with the tracer of their parent, and the root spans with the tracer of
+// SetTracer; without one, it returns the context and a nil span.
+func Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, *Span) {
+	if parent := SpanFromContext(ctx); parent != nil {
+		return parent.tracer.Start(ctx, name, attrs...)
+	}
+
+	return current.Load().Start(ctx, name, attrs...)
+}
+
+// newTraceID returns a random trace ID.
+func newTraceID() TraceID {
+	var id TraceID
+	_, _ = rand.Read(id[:])
+
+	return id
+}
+
+// newSpanID returns a random span ID.
+func newSpanID() SpanID {
+	var id SpanID
+	_, _ = rand.Read(id[:])
+
+	return id
+}
@@ -0,0 +1,114 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestStartDisabled does not run in parallel, since testing.AllocsPerRun can not.
+func TestStartDisabled(t *testing.T) {
+	ctx := context.Background()
+
+	spanCtx, span := tracing.Start(ctx, "tracker.add", tracing.String(tracing.AttrID, "abc"))
+	assert.Nil(t, span)
+	assert.Equal(t, ctx, spanCtx)
+
+	// The spans are cheap no-ops without a tracer.
+	err := errors.New("failed")
+	allocs := testing.AllocsPerRun(100, func() {
+		_, span := tracing.Start(ctx, "tracker.add", tracing.String(tracing.AttrID, "abc"))
+		span.SetAttributes(tracing.String("batched", "true"))
+		span.RecordError(err)
+		span.End()
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestTracer(t *testing.T) {
+	t.Parallel()
+
+	exporter := tracing.NewInMemoryExporter()
+	tracer := tracing.NewTracer(exporter)
+
+	ctx, root := tracer.Start(context.Background(), "docker.event", tracing.String(tracing.AttrCorrelationID, "1234"))
+	require.NotNil(t, root)
+	assert.Same(t, root, tracing.SpanFromContext(ctx))
+
+	// The children are started with the tracer of their parent.
+	_, child := tracing.Start(ctx, "tracker.add")
+	child.SetAttributes(tracing.String(tracing.AttrID, "abc"))
+	child.RecordError(errors.New("failed"))
+	child.End()
+	// Only the first end is exported.
+	child.End()
+	root.End()
+
+	spans := exporter.Spans()
+	require.Len(t, spans, 2)
+	assert.Equal(t, "tracker.add", spans[0].Name)
+	assert.Equal(t, "docker.event", spans[1].Name)
+
+	assert.Equal(t, spans[1].TraceID, spans[0].TraceID)
+	assert.Equal(t, spans[1].SpanID, spans[0].Parent)
+	assert.False(t, spans[1].Parent.IsValid())
+	assert.NotEqual(t, spans[1].SpanID, spans[0].SpanID)
+
+	id, ok := spans[0].Attribute(tracing.AttrID)
+	assert.True(t, ok)
+	assert.Equal(t, "abc", id)
+	assert.Equal(t, "failed", spans[0].Error)
+	assert.Empty(t, spans[1].Error)
+	assert.False(t, spans[0].End.Before(spans[0].Start))
+
+	// The root spans of another trace get another trace ID.
+	_, other := tracer.Start(context.Background(), "docker.event")
+	other.End()
+	assert.NotEqual(t, spans[1].TraceID, exporter.Spans()[2].TraceID)
+}
+
+func TestBatchExporter(t *testing.T) {
+	t.Parallel()
+
+	exporter := tracing.NewInMemoryExporter()
+	batchExporter := tracing.NewBatchExporter(exporter, time.Hour, 2, 3)
+	tracer := tracing.NewTracer(batchExporter)
+
+	end := func(name string) {
+		_, span := tracer.Start(context.Background(), name)
+		span.End()
+	}
+
+	// A full batch is exported without waiting for the interval.
+	end("first")
+	end("second")
+	require.Eventually(t, func() bool { return len(exporter.Spans()) == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// The spans that are left are exported on shutdown, the later ones are dropped.
+	end("third")
+	require.NoError(t, tracer.Shutdown(context.Background()))
+	end("fourth")
+
+	spans := exporter.Spans()
+	require.Len(t, spans, 3)
+	assert.Equal(t, "third", spans[2].Name)
+	assert.Equal(t, uint64(1), batchExporter.Dropped())
+}
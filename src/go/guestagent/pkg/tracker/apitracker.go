@@ -23,11 +23,12 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"time"
 
-	"github.com/Masterminds/log-go"
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 	"github.com/docker/go-connections/nat"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
 	guestagentTypes "github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
 )
 
@@ -41,6 +42,14 @@ const (
 	hostSwitchIP = "192.168.127.2"
 	exposeAPI    = "/services/forwarder/expose"
 	unexposeAPI  = "/services/forwarder/unexpose"
+	// DefaultAPITimeout is the default timeout for a single API request.
+	DefaultAPITimeout = 5 * time.Second
+	// apiMaxAttempts is the number of times a request is sent
+	// when the API keeps responding with a server error.
+	apiMaxAttempts = 3
+	// apiRetryDelay is multiplied by the attempt number
+	// to get the delay before the next attempt.
+	apiRetryDelay = 50 * time.Millisecond
 )
 
 var (
@@ -49,6 +58,9 @@ var (
 	ErrUnexposeAPI = fmt.Errorf("error from %s API", unexposeAPI)
 	ErrInvalidIPv4 = errors.New("not an IPv4 address")
 	ErrWSLProxy    = errors.New("error from Rancher Desktop WSL Proxy")
+	// ErrPortConflict is returned when the host rejects a port
+	// because it is already in use by another process.
+	ErrPortConflict = fmt.Errorf("%w: port is already in use on the host", ErrAPI)
 )
 
 // APITracker keeps track of the port mappings and calls the
@@ -70,7 +82,7 @@ func NewAPITracker(forwarder forwarder.Forwarder, baseURL string, isAdmin bool)
 		forwarder:       forwarder,
 		isAdmin:         isAdmin,
 		baseURL:         baseURL,
-		httpClient:      *http.DefaultClient,
+		httpClient:      http.Client{Timeout: DefaultAPITimeout},
 		portStorage:     newPortStorage(),
 		ListenerTracker: NewListenerTracker(),
 	}
@@ -78,7 +90,19 @@ func NewAPITracker(forwarder forwarder.Forwarder, baseURL string, isAdmin bool)
 
 // Add a container ID and port mapping to the tracker and calls the
 // /services/forwarder/expose endpoint to forward the port mappings.
-func (a *APITracker) Add(containerID string, portMap nat.PortMap) error {
+func (a *APITracker) Add(ctx context.Context, containerID string, portMap nat.PortMap, opts ...EntryOption) error {
+	// Re-adding an identical port mapping only refreshes the entry.
+	if a.portStorage.unchanged(newEntry(containerID, portMap, opts...)) {
+		logger.Debugf("port mapping for [%s] is unchanged, skipping the expose API", containerID)
+		a.portStorage.add(containerID, portMap, opts...)
+
+		return nil
+	}
+
+	entry := newEntry(containerID, portMap, opts...)
+	ctx, span := entry.startSpan(ctx, "tracker.add")
+	defer span.End()
+
 	var errs []error
 
 	successfullyForwarded := make(nat.PortMap)
@@ -93,14 +117,26 @@ func (a *APITracker) Add(containerID string, portMap nat.PortMap) error {
 				continue
 			}
 
-			log.Debugf("calling %s API for the following port binding: %+v", exposeAPI, portBinding)
+			logger.Debugf("calling %s API for the following port binding: %+v", exposeAPI, portBinding)
 
 			err = a.expose(
+				ctx,
 				&types.ExposeRequest{
 					Local:  ipPortBuilder(a.determineHostIP(portBinding.HostIP), portBinding.HostPort),
 					Remote: ipPortBuilder(hostSwitchIP, portBinding.HostPort),
 				})
 			if err != nil {
+				if errors.Is(err, ErrPortConflict) {
+					logger.Warnw("host rejected the port binding", logging.Fields(
+						logging.ID(containerID),
+						logging.Source(entry.Source),
+						logging.Port(portBinding.HostPort),
+						logging.Protocol(portProto.Proto()),
+						logging.HostIP(portBinding.HostIP),
+					))
+					a.portStorage.countChange(entry.Source, ActionAdd, ChangeConflict)
+				}
+
 				errs = append(errs, fmt.Errorf("exposing %+v failed: %w", portBinding, err))
 
 				continue
@@ -112,19 +148,28 @@ func (a *APITracker) Add(containerID string, portMap nat.PortMap) error {
 		successfullyForwarded[portProto] = tmpPortBinding
 	}
 
-	a.portStorage.add(containerID, successfullyForwarded)
+	a.portStorage.add(containerID, successfullyForwarded, opts...)
 	portMapping := guestagentTypes.PortMapping{
-		Remove: false,
-		Ports:  successfullyForwarded,
+		Remove:        false,
+		Ports:         successfullyForwarded,
+		Metadata:      mergeEntryMetadata([]Entry{newEntry(containerID, successfullyForwarded, opts...)}),
+		Protocols:     guestagentTypes.PortProtocols(successfullyForwarded),
+		HostBindAddrs: guestagentTypes.PortHostBindAddrs(successfullyForwarded),
 	}
-	log.Debugf("forwarding to wsl-proxy to add port mapping: %+v", portMapping)
+	logger.Debugf("forwarding to wsl-proxy to add port mapping: %+v", portMapping)
+
+	err := a.forwarder.Send(ctx, portMapping)
+	a.portStorage.setSendStatus(containerID, err)
 
-	err := a.forwarder.Send(portMapping)
 	if err != nil {
+		span.RecordError(err)
+
 		return fmt.Errorf("sending port mappings to wsl proxy error: %w", err)
 	}
 
 	if len(errs) != 0 {
+		span.RecordError(errors.Join(errs...))
+
 		return fmt.Errorf("%w: %+v", ErrExposeAPI, errs)
 	}
 
@@ -136,12 +181,36 @@ func (a *APITracker) Get(containerID string) nat.PortMap {
 	return a.portStorage.get(containerID)
 }
 
+// GetByPort looks up the entry that holds the given host port and protocol.
+func (a *APITracker) GetByPort(hostPort, protocol string) (Entry, bool) {
+	return a.portStorage.getByPort(hostPort, protocol)
+}
+
+// Refresh renews the lease of the entry for the given container ID.
+func (a *APITracker) Refresh(containerID string) bool {
+	return a.portStorage.refresh(containerID)
+}
+
+// Subscribe returns a subscription to the tracker's change events.
+func (a *APITracker) Subscribe(bufferSize int, opts ...SubscribeOption) *Subscription {
+	return a.portStorage.subscribe(bufferSize, opts...)
+}
+
+// List returns all the entries that are held by the tracker.
+func (a *APITracker) List() []Entry {
+	return a.portStorage.list()
+}
+
 // Remove a single entry from the port storage and calls the
 // /services/forwarder/unexpose endpoint to remove the forwarded the port mappings.
-func (a *APITracker) Remove(containerID string) error {
+func (a *APITracker) Remove(ctx context.Context, containerID string, opts ...EntryOption) error {
 	portMap := a.portStorage.get(containerID)
 	defer a.portStorage.remove(containerID)
 
+	removal := newEntry(containerID, portMap, opts...)
+	ctx, span := removal.startSpan(ctx, "tracker.remove")
+	defer span.End()
+
 	var errs []error
 
 	for _, portBindings := range portMap {
@@ -152,9 +221,10 @@ func (a *APITracker) Remove(containerID string) error {
 				continue
 			}
 
-			log.Debugf("calling %s API for the following port binding: %+v", unexposeAPI, portBinding)
+			logger.Debugf("calling %s API for the following port binding: %+v", unexposeAPI, portBinding)
 
 			err = a.unexpose(
+				ctx,
 				&types.UnexposeRequest{
 					Local: ipPortBuilder(a.determineHostIP(portBinding.HostIP), portBinding.HostPort),
 				})
@@ -168,16 +238,27 @@ func (a *APITracker) Remove(containerID string) error {
 	}
 
 	portMapping := guestagentTypes.PortMapping{
-		Remove: true,
-		Ports:  portMap,
+		Remove:    true,
+		Ports:     portMap,
+		Metadata:  mergeEntryMetadata([]Entry{removal}),
+		Protocols: guestagentTypes.PortProtocols(portMap),
 	}
-	log.Debugf("forwarding to wsl-proxy to remove port mapping: %+v", portMapping)
-	err := a.forwarder.Send(portMapping)
+	logger.Debugf("forwarding to wsl-proxy to remove port mapping: %+v", portMapping)
+	err := a.forwarder.Send(ctx, portMapping)
+
+	if entry, ok := a.portStorage.getEntry(containerID); ok {
+		a.portStorage.publishOutcomes(ActionRemove, []Entry{entry}, err)
+	}
+
 	if err != nil {
+		span.RecordError(err)
+
 		return fmt.Errorf("sending port mappings to wsl proxy error: %w", err)
 	}
 
 	if len(errs) != 0 {
+		span.RecordError(errors.Join(errs...))
+
 		return fmt.Errorf("%w: %+v", ErrUnexposeAPI, errs)
 	}
 
@@ -186,7 +267,7 @@ func (a *APITracker) Remove(containerID string) error {
 
 // RemoveAll calls the /services/forwarder/unexpose
 // and removes all the port bindings from the tracker.
-func (a *APITracker) RemoveAll() error {
+func (a *APITracker) RemoveAll(ctx context.Context) error {
 	var apiErrs, wslProxyErrs []error
 
 	for _, portMapping := range a.portStorage.getAll() {
@@ -198,9 +279,10 @@ func (a *APITracker) RemoveAll() error {
 					continue
 				}
 
-				log.Debugf("calling %s API for the following port binding: %+v", unexposeAPI, portBinding)
+				logger.Debugf("calling %s API for the following port binding: %+v", unexposeAPI, portBinding)
 
 				err = a.unexpose(
+					ctx,
 					&types.UnexposeRequest{
 						Local: ipPortBuilder(a.determineHostIP(portBinding.HostIP), portBinding.HostPort),
 					})
@@ -214,12 +296,13 @@ func (a *APITracker) RemoveAll() error {
 		}
 
 		portMapping := guestagentTypes.PortMapping{
-			Remove: true,
-			Ports:  portMapping,
+			Remove:    true,
+			Ports:     portMapping,
+			Protocols: guestagentTypes.PortProtocols(portMapping),
 		}
 
-		log.Debugf("forwarding to wsl-proxy to remove port mapping: %+v", portMapping)
-		wslProxyError := a.forwarder.Send(portMapping)
+		logger.Debugf("forwarding to wsl-proxy to remove port mapping: %+v", portMapping)
+		wslProxyError := a.forwarder.Send(ctx, portMapping)
 		if wslProxyError != nil {
 			wslProxyErrs = append(wslProxyErrs,
 				fmt.Errorf("sending port mappings to wsl proxy error: %w", wslProxyError))
@@ -239,52 +322,71 @@ func (a *APITracker) RemoveAll() error {
 	return nil
 }
 
-func (a *APITracker) expose(exposeReq *types.ExposeRequest) error {
-	bin, err := json.Marshal(exposeReq)
-	if err != nil {
-		return err
-	}
+// SetChangeCounter sets the counter of the outcomes of the changes that are
+// sent to the host.
+func (a *APITracker) SetChangeCounter(changes *ChangeCounter) {
+	a.portStorage.setChangeCounter(changes)
+}
 
-	log.Debugf("sending a HTTP POST to %s API with expose request: %v", exposeAPI, exposeReq)
-	req, err := http.NewRequestWithContext(
-		context.Background(),
-		http.MethodPost,
-		a.urlBuilder(exposeAPI),
-		bytes.NewReader(bin))
-	if err != nil {
-		return err
-	}
+// SetTimeout sets the timeout for a single API request,
+// a retried request gets the full timeout for each attempt.
+func (a *APITracker) SetTimeout(timeout time.Duration) {
+	a.httpClient.Timeout = timeout
+}
 
-	res, err := a.httpClient.Do(req)
-	if err != nil {
-		return err
-	}
+func (a *APITracker) expose(ctx context.Context, exposeReq *types.ExposeRequest) error {
+	logger.Debugf("sending a HTTP POST to %s API with expose request: %v", exposeAPI, exposeReq)
 
-	return verifyResponseBody(res)
+	return a.post(ctx, exposeAPI, exposeReq)
 }
 
-func (a *APITracker) unexpose(unexposeReq *types.UnexposeRequest) error {
-	bin, err := json.Marshal(unexposeReq)
-	if err != nil {
-		return err
-	}
+func (a *APITracker) unexpose(ctx context.Context, unexposeReq *types.UnexposeRequest) error {
+	logger.Debugf("sending a HTTP POST to %s API with unexpose request: %v", unexposeAPI, unexposeReq)
 
-	log.Debugf("sending a HTTP POST to %s API with expose request: %v", unexposeAPI, unexposeReq)
-	req, err := http.NewRequestWithContext(
-		context.Background(),
-		http.MethodPost,
-		a.urlBuilder(unexposeAPI),
-		bytes.NewReader(bin))
-	if err != nil {
-		return err
-	}
+	return a.post(ctx, unexposeAPI, unexposeReq)
+}
 
-	res, err := a.httpClient.Do(req)
+// post sends the request body to the given API, the request is retried with
+// a backoff if the API responds with a server error, until the context is done.
+func (a *APITracker) post(ctx context.Context, api string, body any) error {
+	bin, err := json.Marshal(body)
 	if err != nil {
 		return err
 	}
 
-	return verifyResponseBody(res)
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(
+			ctx,
+			http.MethodPost,
+			a.urlBuilder(api),
+			bytes.NewReader(bin))
+		if err != nil {
+			return err
+		}
+
+		res, err := a.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if res.StatusCode < http.StatusInternalServerError || attempt == apiMaxAttempts {
+			return verifyResponseBody(res)
+		}
+
+		_, _ = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+
+		logger.Debugf("%s API responded with %d, retrying (attempt %d/%d)", api, res.StatusCode, attempt, apiMaxAttempts)
+
+		timer := time.NewTimer(time.Duration(attempt) * apiRetryDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return fmt.Errorf("%s API responded with %d: %w", api, res.StatusCode, ctx.Err())
+		case <-timer.C:
+		}
+	}
 }
 
 func (a *APITracker) determineHostIP(hostIP string) string {
@@ -317,6 +419,10 @@ func verifyResponseBody(res *http.Response) error {
 
 		errMsg := strings.TrimSpace(string(apiResponse))
 
+		if res.StatusCode == http.StatusConflict {
+			return fmt.Errorf("%w: %s", ErrPortConflict, errMsg)
+		}
+
 		return fmt.Errorf("%w: %s", ErrAPI, errMsg)
 	}
 
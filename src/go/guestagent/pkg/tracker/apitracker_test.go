@@ -14,11 +14,13 @@ limitations under the License.
 package tracker_test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/containers/gvisor-tap-vsock/pkg/types"
 	"github.com/docker/go-connections/nat"
@@ -63,7 +65,7 @@ func TestBasicAdd(t *testing.T) {
 			},
 		},
 	}
-	err := apiTracker.Add(containerID, portMapping)
+	err := apiTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	assert.Equal(t, expectedExposeReq.Local, ipPortBuilder(hostIP, hostPort))
@@ -106,7 +108,7 @@ func TestAddOverride(t *testing.T) {
 			},
 		},
 	}
-	err := apiTracker.Add(containerID, portMapping)
+	err := apiTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	assert.ElementsMatch(t, expectedExposeReq,
@@ -141,7 +143,7 @@ func TestAddOverride(t *testing.T) {
 			},
 		},
 	}
-	err = apiTracker.Add(containerID, portMapping2)
+	err = apiTracker.Add(context.Background(), containerID, portMapping2)
 	require.NoError(t, err)
 
 	assert.ElementsMatch(t, expectedExposeReq,
@@ -200,7 +202,7 @@ func TestAddWithError(t *testing.T) {
 			},
 		},
 	}
-	err := apiTracker.Add(containerID, portMapping)
+	err := apiTracker.Add(context.Background(), containerID, portMapping)
 	require.Error(t, err)
 
 	errPortBinding := nat.PortBinding{
@@ -280,7 +282,7 @@ func TestGet(t *testing.T) {
 
 	forwarder := testForwarder{}
 	apiTracker := tracker.NewAPITracker(&forwarder, testSrv.URL, true)
-	err := apiTracker.Add(containerID, portMapping)
+	err := apiTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	actualPortMappings := apiTracker.Get(containerID)
@@ -329,12 +331,12 @@ func TestRemove(t *testing.T) {
 			},
 		},
 	}
-	err := apiTracker.Add(containerID, portMapping1)
+	err := apiTracker.Add(context.Background(), containerID, portMapping1)
 	require.NoError(t, err)
-	err = apiTracker.Add(containerID2, portMapping2)
+	err = apiTracker.Add(context.Background(), containerID2, portMapping2)
 	require.NoError(t, err)
 
-	err = apiTracker.Remove(containerID)
+	err = apiTracker.Remove(context.Background(), containerID)
 	require.NoError(t, err)
 
 	assert.Equal(t, expectedUnexposeReq.Local, ipPortBuilder(hostIP, hostPort))
@@ -391,10 +393,10 @@ func TestRemoveWithError(t *testing.T) {
 			},
 		},
 	}
-	err := apiTracker.Add(containerID, portMapping)
+	err := apiTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
-	err = apiTracker.Remove(containerID)
+	err = apiTracker.Remove(context.Background(), containerID)
 	require.Error(t, err)
 
 	errPortBinding := nat.PortBinding{
@@ -456,13 +458,13 @@ func TestRemoveAll(t *testing.T) {
 			},
 		},
 	}
-	err := apiTracker.Add(containerID, portMapping1)
+	err := apiTracker.Add(context.Background(), containerID, portMapping1)
 	require.NoError(t, err)
 
-	err = apiTracker.Add(containerID2, portMapping2)
+	err = apiTracker.Add(context.Background(), containerID2, portMapping2)
 	require.NoError(t, err)
 
-	err = apiTracker.RemoveAll()
+	err = apiTracker.RemoveAll(context.Background())
 	require.NoError(t, err)
 
 	expectedPortMapping1 := apiTracker.Get(containerID)
@@ -521,13 +523,13 @@ func TestRemoveAllWithError(t *testing.T) {
 			},
 		},
 	}
-	err := apiTracker.Add(containerID, portMapping1)
+	err := apiTracker.Add(context.Background(), containerID, portMapping1)
 	require.NoError(t, err)
 
-	err = apiTracker.Add(containerID2, portMapping2)
+	err = apiTracker.Add(context.Background(), containerID2, portMapping2)
 	require.NoError(t, err)
 
-	err = apiTracker.RemoveAll()
+	err = apiTracker.RemoveAll(context.Background())
 	require.Error(t, err)
 
 	errPortBinding := nat.PortBinding{
@@ -591,7 +593,7 @@ func TestNonAdminInstall(t *testing.T) {
 		},
 	}
 
-	err := apiTracker.Add(containerID, portMapping)
+	err := apiTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	assert.ElementsMatch(t, expectedExposeReq,
@@ -603,7 +605,7 @@ func TestNonAdminInstall(t *testing.T) {
 		},
 	)
 
-	err = apiTracker.Remove(containerID)
+	err = apiTracker.Remove(context.Background(), containerID)
 	require.NoError(t, err)
 
 	assert.ElementsMatch(t, expectedUnexposeReq,
@@ -617,6 +619,283 @@ func TestNonAdminInstall(t *testing.T) {
 	assert.Nil(t, portMapping)
 }
 
+func TestAddUnchanged(t *testing.T) {
+	t.Parallel()
+
+	exposeCalls := 0
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/services/forwarder/expose", func(_ http.ResponseWriter, _ *http.Request) {
+		exposeCalls++
+	})
+
+	testSrv := httptest.NewServer(mux)
+	defer testSrv.Close()
+
+	forwarder := testForwarder{}
+	apiTracker := tracker.NewAPITracker(&forwarder, testSrv.URL, true)
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		err := apiTracker.Add(context.Background(), containerID, portMapping)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 1, exposeCalls)
+	assert.Len(t, forwarder.received(), 1)
+
+	portMapping2 := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP2,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := apiTracker.Add(context.Background(), containerID, portMapping2)
+	require.NoError(t, err)
+
+	assert.Equal(t, 2, exposeCalls)
+	assert.Len(t, forwarder.received(), 2)
+}
+
+func TestAddRetryServerError(t *testing.T) {
+	t.Parallel()
+
+	var exposeReqs []*types.ExposeRequest
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/services/forwarder/expose", func(w http.ResponseWriter, r *http.Request) {
+		var tmpReq *types.ExposeRequest
+		err := json.NewDecoder(r.Body).Decode(&tmpReq)
+		require.NoError(t, err)
+		exposeReqs = append(exposeReqs, tmpReq)
+
+		// Fail the first two attempts
+		if len(exposeReqs) <= 2 {
+			http.Error(w, "temporarily unavailable", http.StatusServiceUnavailable)
+		}
+	})
+
+	testSrv := httptest.NewServer(mux)
+	defer testSrv.Close()
+
+	forwarder := testForwarder{}
+	apiTracker := tracker.NewAPITracker(&forwarder, testSrv.URL, true)
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := apiTracker.Add(context.Background(), containerID, portMapping)
+	require.NoError(t, err)
+
+	expectedReq := &types.ExposeRequest{
+		Local:  ipPortBuilder(hostIP, hostPort),
+		Remote: ipPortBuilder(hostSwitchIP, hostPort),
+	}
+	assert.Equal(t, []*types.ExposeRequest{expectedReq, expectedReq, expectedReq}, exposeReqs)
+	assert.Equal(t, portMapping, apiTracker.Get(containerID))
+}
+
+func TestAddRetryServerErrorExhausted(t *testing.T) {
+	t.Parallel()
+
+	exposeCalls := 0
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/services/forwarder/expose", func(w http.ResponseWriter, _ *http.Request) {
+		exposeCalls++
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	})
+
+	testSrv := httptest.NewServer(mux)
+	defer testSrv.Close()
+
+	forwarder := testForwarder{}
+	apiTracker := tracker.NewAPITracker(&forwarder, testSrv.URL, true)
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := apiTracker.Add(context.Background(), containerID, portMapping)
+	require.ErrorIs(t, err, tracker.ErrExposeAPI)
+	assert.Contains(t, err.Error(), "internal error")
+	assert.Equal(t, 3, exposeCalls)
+}
+
+func TestAddCancelled(t *testing.T) {
+	t.Parallel()
+
+	failed := make(chan struct{})
+	exposeCalls := 0
+
+	mux := http.NewServeMux()
+
+	// The first attempt fails, the retries hang until they are abandoned.
+	mux.HandleFunc("/services/forwarder/expose", func(w http.ResponseWriter, r *http.Request) {
+		exposeCalls++
+		if exposeCalls == 1 {
+			http.Error(w, "temporarily unavailable", http.StatusServiceUnavailable)
+			close(failed)
+
+			return
+		}
+
+		<-r.Context().Done()
+	})
+
+	testSrv := httptest.NewServer(mux)
+	defer testSrv.Close()
+
+	forwarder := testForwarder{}
+	apiTracker := tracker.NewAPITracker(&forwarder, testSrv.URL, true)
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- apiTracker.Add(ctx, containerID, portMapping)
+	}()
+
+	<-failed
+	cancel()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("the tracker did not return once the context of the Add was cancelled")
+	}
+}
+
+func TestAddPortConflict(t *testing.T) {
+	t.Parallel()
+
+	exposeCalls := 0
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/services/forwarder/expose", func(w http.ResponseWriter, r *http.Request) {
+		exposeCalls++
+
+		var tmpReq *types.ExposeRequest
+		err := json.NewDecoder(r.Body).Decode(&tmpReq)
+		require.NoError(t, err)
+		if tmpReq.Local == ipPortBuilder(hostIP2, hostPort) {
+			http.Error(w, "port already allocated", http.StatusConflict)
+		}
+	})
+
+	testSrv := httptest.NewServer(mux)
+	defer testSrv.Close()
+
+	forwarder := testForwarder{}
+	apiTracker := tracker.NewAPITracker(&forwarder, testSrv.URL, true)
+	changes := tracker.NewChangeCounter()
+	apiTracker.SetChangeCounter(changes)
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+			{
+				HostIP:   hostIP2,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := apiTracker.Add(context.Background(), containerID, portMapping, tracker.WithSource(tracker.SourceDocker))
+	require.ErrorIs(t, err, tracker.ErrExposeAPI)
+
+	// The port mapping is sent without the port binding that conflicted.
+	assert.Equal(t, []tracker.ChangeCount{
+		{Source: tracker.SourceDocker, Action: tracker.ActionAdd, Outcome: tracker.ChangeConflict, Count: 1},
+		{Source: tracker.SourceDocker, Action: tracker.ActionAdd, Outcome: tracker.ChangeOK, Count: 1},
+	}, changes.Counts())
+
+	// Conflicts are not retried
+	assert.Equal(t, 2, exposeCalls)
+
+	errPortBinding := nat.PortBinding{
+		HostIP:   hostIP2,
+		HostPort: hostPort,
+	}
+	nestedErr := fmt.Errorf("%w: port already allocated", tracker.ErrPortConflict)
+	errs := []error{
+		fmt.Errorf("exposing %+v failed: %w", errPortBinding, nestedErr),
+	}
+	expectedErr := fmt.Errorf("%w: %+v", tracker.ErrExposeAPI, errs)
+	require.EqualError(t, err, expectedErr.Error())
+	assert.ErrorIs(t, nestedErr, tracker.ErrAPI)
+
+	assert.Equal(t, nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}, apiTracker.Get(containerID))
+}
+
+func TestAddTimeout(t *testing.T) {
+	t.Parallel()
+
+	done := make(chan struct{})
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/services/forwarder/expose", func(_ http.ResponseWriter, _ *http.Request) {
+		<-done
+	})
+
+	testSrv := httptest.NewServer(mux)
+	defer testSrv.Close()
+	// Unblock the handler before the server is closed
+	defer close(done)
+
+	forwarder := testForwarder{}
+	apiTracker := tracker.NewAPITracker(&forwarder, testSrv.URL, true)
+	apiTracker.SetTimeout(10 * time.Millisecond)
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := apiTracker.Add(context.Background(), containerID, portMapping)
+	require.ErrorIs(t, err, tracker.ErrExposeAPI)
+	assert.Empty(t, apiTracker.Get(containerID)["80/tcp"])
+}
+
 func ipPortBuilder(ip, port string) string {
 	return ip + ":" + port
 }
@@ -0,0 +1,188 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+)
+
+// budgetTopSources is the number of sources that are
+// reported when the port budget is exceeded.
+const budgetTopSources = 3
+
+var ErrPortBudgetExceeded = errors.New("tracked port budget exceeded")
+
+// SourceCount is the number of port bindings that are tracked for a source.
+type SourceCount struct {
+	Source string `json:"source"`
+	Count  int    `json:"count"`
+}
+
+// Usage describes how much of the port budget is in use.
+type Usage struct {
+	Used  int `json:"used"`
+	Limit int `json:"limit"`
+	// TopSources are the sources that hold the most port bindings.
+	TopSources []SourceCount `json:"topSources,omitempty"`
+}
+
+// BudgetTracker caps the total number of port bindings that are held by
+// the underlying tracker. Adds that would exceed the cap are rejected with
+// ErrPortBudgetExceeded, removing entries frees the budget immediately.
+type BudgetTracker struct {
+	Tracker
+	maxPorts int
+	// mutex serializes the budget checks with the changes to the tracker.
+	mutex sync.Mutex
+}
+
+// NewBudgetTracker wraps the given tracker to hold at most maxPorts port bindings.
+func NewBudgetTracker(tracker Tracker, maxPorts int) *BudgetTracker {
+	return &BudgetTracker{
+		Tracker:  tracker,
+		maxPorts: maxPorts,
+	}
+}
+
+// Add adds the port mapping to the underlying tracker, unless the
+// total number of tracked port bindings would exceed the budget.
+func (b *BudgetTracker) Add(ctx context.Context, containerID string, portMap nat.PortMap, opts ...EntryOption) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// The entry's current bindings are replaced, so they do not count.
+	used := b.used() - countBindings(b.Tracker.Get(containerID))
+	requested := countBindings(portMap)
+
+	if used+requested > b.maxPorts {
+		topSources := b.topSources()
+
+		logger.Warnw("rejecting port mapping, the tracked port budget is exceeded", logging.Fields(
+			logging.ID(containerID),
+			log.Fields{
+				"requested":  requested,
+				"used":       used,
+				"limit":      b.maxPorts,
+				"topSources": formatSourceCounts(topSources),
+			},
+		))
+
+		return fmt.Errorf("%w: %d port bindings requested for %s, %d of %d in use, top sources: %s",
+			ErrPortBudgetExceeded, requested, containerID, used, b.maxPorts, formatSourceCounts(topSources))
+	}
+
+	return b.Tracker.Add(ctx, containerID, portMap, opts...)
+}
+
+// Remove removes the entry from the underlying tracker, which frees its budget.
+func (b *BudgetTracker) Remove(ctx context.Context, containerID string, opts ...EntryOption) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.Tracker.Remove(ctx, containerID, opts...)
+}
+
+// RemoveAll removes all the entries from the underlying tracker.
+func (b *BudgetTracker) RemoveAll(ctx context.Context) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.Tracker.RemoveAll(ctx)
+}
+
+// Flush sends the pending changes of the underlying tracker, if it defers them.
+func (b *BudgetTracker) Flush() error {
+	return flush(b.Tracker)
+}
+
+// Usage returns the number of port bindings in use and the budget.
+func (b *BudgetTracker) Usage() Usage {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return Usage{
+		Used:       b.used(),
+		Limit:      b.maxPorts,
+		TopSources: b.topSources(),
+	}
+}
+
+func (b *BudgetTracker) used() int {
+	used := 0
+	for _, entry := range b.Tracker.List() {
+		used += countBindings(entry.Ports)
+	}
+
+	return used
+}
+
+// topSources returns the sources that hold the most port bindings.
+func (b *BudgetTracker) topSources() []SourceCount {
+	counts := make(map[string]int)
+
+	for _, entry := range b.Tracker.List() {
+		source := entry.Source
+		if source == "" {
+			source = "unknown"
+		}
+
+		counts[source] += countBindings(entry.Ports)
+	}
+
+	sourceCounts := make([]SourceCount, 0, len(counts))
+	for source, count := range counts {
+		sourceCounts = append(sourceCounts, SourceCount{Source: source, Count: count})
+	}
+
+	sort.Slice(sourceCounts, func(i, j int) bool {
+		if sourceCounts[i].Count != sourceCounts[j].Count {
+			return sourceCounts[i].Count > sourceCounts[j].Count
+		}
+
+		return sourceCounts[i].Source < sourceCounts[j].Source
+	})
+
+	if len(sourceCounts) > budgetTopSources {
+		sourceCounts = sourceCounts[:budgetTopSources]
+	}
+
+	return sourceCounts
+}
+
+func countBindings(portMap nat.PortMap) int {
+	count := 0
+	for _, bindings := range portMap {
+		count += len(bindings)
+	}
+
+	return count
+}
+
+func formatSourceCounts(sourceCounts []SourceCount) string {
+	parts := make([]string, 0, len(sourceCounts))
+	for _, sourceCount := range sourceCounts {
+		parts = append(parts, fmt.Sprintf("%s=%d", sourceCount.Source, sourceCount.Count))
+	}
+
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBudgetTracker(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	budgetTracker := tracker.NewBudgetTracker(tracker.NewVTunnelTracker(&forwarder, wslConnectAddr), 3)
+
+	portMapping := func(ports ...int) nat.PortMap {
+		portMap := make(nat.PortMap)
+		for _, port := range ports {
+			portMap[nat.Port(strconv.Itoa(port)+"/tcp")] = []nat.PortBinding{
+				{
+					HostIP:   hostIP,
+					HostPort: strconv.Itoa(port),
+				},
+			}
+		}
+
+		return portMap
+	}
+
+	err := budgetTracker.Add(context.Background(), containerID, portMapping(80, 443), tracker.WithSource(tracker.SourceDocker))
+	require.NoError(t, err)
+	assert.Equal(t, tracker.Usage{
+		Used:       2,
+		Limit:      3,
+		TopSources: []tracker.SourceCount{{Source: tracker.SourceDocker, Count: 2}},
+	}, budgetTracker.Usage())
+
+	// Replacing the entry's bindings only counts the new ones
+	err = budgetTracker.Add(context.Background(), containerID, portMapping(80, 443, 8080), tracker.WithSource(tracker.SourceDocker))
+	require.NoError(t, err)
+	assert.Equal(t, 3, budgetTracker.Usage().Used)
+
+	err = budgetTracker.Add(context.Background(), containerID2, portMapping(9090), tracker.WithSource(tracker.SourceKubernetes))
+	require.ErrorIs(t, err, tracker.ErrPortBudgetExceeded)
+	assert.Contains(t, err.Error(), "top sources: docker=3")
+	assert.Nil(t, budgetTracker.Get(containerID2))
+	assert.Len(t, forwarder.received(), 2)
+
+	// Removing an entry frees the budget immediately
+	err = budgetTracker.Remove(context.Background(), containerID)
+	require.NoError(t, err)
+	assert.Equal(t, 0, budgetTracker.Usage().Used)
+
+	err = budgetTracker.Add(context.Background(), containerID2, portMapping(9090), tracker.WithSource(tracker.SourceKubernetes))
+	require.NoError(t, err)
+	assert.Equal(t, portMapping(9090), budgetTracker.Get(containerID2))
+}
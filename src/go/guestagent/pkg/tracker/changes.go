@@ -0,0 +1,142 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+)
+
+// ChangeOutcome is what became of a change of a port mapping, see ChangeCounter.
+type ChangeOutcome string
+
+const (
+	// ChangeOK is the outcome of the changes that were sent to the host.
+	ChangeOK ChangeOutcome = "ok"
+	// ChangeBlocked is the outcome of the port bindings of the additions that
+	// are not forwarded, since the filter blocks them or they are reserved.
+	ChangeBlocked ChangeOutcome = "blocked"
+	// ChangeConflict is the outcome of the port bindings of the additions that
+	// the host could not apply, e.g. since the host port is in use.
+	ChangeConflict ChangeOutcome = "conflict"
+	// ChangeForwarderError is the outcome of the changes that could not be sent to the host.
+	ChangeForwarderError ChangeOutcome = "forwarder-error"
+)
+
+// sourceUnknown is the source that the changes of the entries without one are counted under.
+const sourceUnknown = "unknown"
+
+// ChangeCount is the number of the changes of a source with the same action and outcome.
+type ChangeCount struct {
+	Source  string        `json:"source"`
+	Action  Action        `json:"action"`
+	Outcome ChangeOutcome `json:"outcome"`
+	Count   uint64        `json:"count"`
+}
+
+// changeKey identifies the counts of a ChangeCounter.
+type changeKey struct {
+	source  string
+	action  Action
+	outcome ChangeOutcome
+}
+
+// ChangeCounter counts the changes of the port mappings by source, action and
+// outcome; the trackers count them where they decide each outcome, e.g. the
+// FilterTracker counts the blocked ones. A change is counted once it was sent
+// or failed to be, and so is each of its port bindings that was blocked or
+// conflicted on the host besides. It is never labelled by port, so that the
+// number of its counts stays bounded. A nil counter counts nothing.
+type ChangeCounter struct {
+	mutex  sync.Mutex
+	counts map[changeKey]uint64
+}
+
+// NewChangeCounter creates a counter without any changes.
+func NewChangeCounter() *ChangeCounter {
+	return &ChangeCounter{counts: make(map[changeKey]uint64)}
+}
+
+// Count counts a change of the source.
+func (c *ChangeCounter) Count(source string, action Action, outcome ChangeOutcome) {
+	if c == nil {
+		return
+	}
+
+	if source == "" {
+		source = sourceUnknown
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.counts[changeKey{source: source, action: action, outcome: outcome}]++
+}
+
+// Counts returns the counts, sorted by source, action and outcome.
+func (c *ChangeCounter) Counts() []ChangeCount {
+	if c == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	counts := make([]ChangeCount, 0, len(c.counts))
+
+	for key, count := range c.counts {
+		counts = append(counts, ChangeCount{Source: key.source, Action: key.action, Outcome: key.outcome, Count: count})
+	}
+	c.mutex.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Source != counts[j].Source {
+			return counts[i].Source < counts[j].Source
+		}
+
+		if counts[i].Action != counts[j].Action {
+			return counts[i].Action < counts[j].Action
+		}
+
+		return counts[i].Outcome < counts[j].Outcome
+	})
+
+	return counts
+}
+
+// Collect returns the counts for the Prometheus endpoint, see metrics.Registry.
+func (c *ChangeCounter) Collect() []metrics.Family {
+	counts := c.Counts()
+
+	samples := make([]metrics.Sample, 0, len(counts))
+	for _, count := range counts {
+		samples = append(samples, metrics.Sample{
+			Labels: []metrics.Label{
+				{Name: "source", Value: count.Source},
+				{Name: "action", Value: string(count.Action)},
+				{Name: "outcome", Value: string(count.Outcome)},
+			},
+			Value: float64(count.Count),
+		})
+	}
+
+	return []metrics.Family{
+		{
+			Name:    metrics.Namespace + "port_changes_total",
+			Help:    "Number of the changes of the port mappings, by source, action and outcome.",
+			Type:    metrics.TypeCounter,
+			Samples: samples,
+		},
+	}
+}
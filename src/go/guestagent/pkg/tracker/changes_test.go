@@ -0,0 +1,170 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangeCounter(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	portMapping := nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: hostPort}}}
+
+	tests := []struct {
+		name string
+		// changes makes the changes; the ones that fail are not checked.
+		changes func(t *testing.T, changes *tracker.ChangeCounter)
+		want    []tracker.ChangeCount
+		metrics string
+	}{
+		{
+			name: "added",
+			changes: func(t *testing.T, changes *tracker.ChangeCounter) {
+				vtunnelTracker := tracker.NewVTunnelTracker(&testForwarder{}, wslConnectAddr)
+				vtunnelTracker.SetChangeCounter(changes)
+
+				require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithSource(tracker.SourceDocker)))
+				// Adding the same port mapping again is not a change.
+				require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithSource(tracker.SourceDocker)))
+			},
+			want: []tracker.ChangeCount{{Source: tracker.SourceDocker, Action: tracker.ActionAdd, Outcome: tracker.ChangeOK, Count: 1}},
+			metrics: `rd_guestagent_port_changes_total{source="docker",action="add",outcome="ok"} 1
+`,
+		},
+		{
+			name: "removed",
+			changes: func(t *testing.T, changes *tracker.ChangeCounter) {
+				vtunnelTracker := tracker.NewVTunnelTracker(&testForwarder{}, wslConnectAddr)
+				require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithSource(tracker.SourceKubernetes)))
+				vtunnelTracker.SetChangeCounter(changes)
+
+				require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+			},
+			want: []tracker.ChangeCount{{Source: tracker.SourceKubernetes, Action: tracker.ActionRemove, Outcome: tracker.ChangeOK, Count: 1}},
+			metrics: `rd_guestagent_port_changes_total{source="kubernetes",action="remove",outcome="ok"} 1
+`,
+		},
+		{
+			name: "blocked",
+			changes: func(t *testing.T, changes *tracker.ChangeCounter) {
+				vtunnelTracker := tracker.NewVTunnelTracker(&testForwarder{}, wslConnectAddr)
+				filterTracker := tracker.NewFilterTracker(vtunnelTracker, mustParsePortFilter(t, "", hostPort))
+				filterTracker.SetChangeCounter(changes)
+
+				require.NoError(t, filterTracker.Add(context.Background(), containerID, portMapping, tracker.WithSource(tracker.SourceContainerd)))
+			},
+			want: []tracker.ChangeCount{{Source: tracker.SourceContainerd, Action: tracker.ActionAdd, Outcome: tracker.ChangeBlocked, Count: 1}},
+			metrics: `rd_guestagent_port_changes_total{source="containerd",action="add",outcome="blocked"} 1
+`,
+		},
+		{
+			name: "conflicted",
+			changes: func(t *testing.T, changes *tracker.ChangeCounter) {
+				// The port mapping reached the host, which rejected its only port.
+				resultForwarder := &resultForwarder{rejected: map[string]string{hostPort: "port is in use"}}
+				vtunnelTracker := tracker.NewVTunnelTracker(resultForwarder, wslConnectAddr)
+				require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, nat.PortMap{
+					"443/tcp": []nat.PortBinding{{HostIP: hostIP2, HostPort: hostPort2}},
+				}))
+				vtunnelTracker.SetChangeCounter(changes)
+
+				require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithSource(tracker.SourceDocker)))
+
+				// The conflict that the host reports again on a resync is not counted again.
+				require.NoError(t, vtunnelTracker.Resync(context.Background(), true))
+			},
+			// The port mapping is counted as sent, besides its port binding that conflicted.
+			want: []tracker.ChangeCount{
+				{Source: tracker.SourceDocker, Action: tracker.ActionAdd, Outcome: tracker.ChangeConflict, Count: 1},
+				{Source: tracker.SourceDocker, Action: tracker.ActionAdd, Outcome: tracker.ChangeOK, Count: 1},
+			},
+			metrics: `rd_guestagent_port_changes_total{source="docker",action="add",outcome="conflict"} 1
+rd_guestagent_port_changes_total{source="docker",action="add",outcome="ok"} 1
+`,
+		},
+		{
+			name: "failed to add",
+			changes: func(t *testing.T, changes *tracker.ChangeCounter) {
+				vtunnelTracker := tracker.NewVTunnelTracker(&testForwarder{sendErr: errSend}, wslConnectAddr)
+				vtunnelTracker.SetChangeCounter(changes)
+
+				require.ErrorIs(t, vtunnelTracker.Add(context.Background(), containerID, portMapping), errSend)
+			},
+			want: []tracker.ChangeCount{{Source: "unknown", Action: tracker.ActionAdd, Outcome: tracker.ChangeForwarderError, Count: 1}},
+			metrics: `rd_guestagent_port_changes_total{source="unknown",action="add",outcome="forwarder-error"} 1
+`,
+		},
+		{
+			name: "failed to remove",
+			changes: func(t *testing.T, changes *tracker.ChangeCounter) {
+				forwarder := &testForwarder{}
+				vtunnelTracker := tracker.NewVTunnelTracker(forwarder, wslConnectAddr)
+				require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithSource(tracker.SourceDocker)))
+				vtunnelTracker.SetChangeCounter(changes)
+
+				forwarder.mutex.Lock()
+				forwarder.sendErr = errSend
+				forwarder.mutex.Unlock()
+
+				require.ErrorIs(t, vtunnelTracker.Remove(context.Background(), containerID), errSend)
+			},
+			want: []tracker.ChangeCount{
+				{Source: tracker.SourceDocker, Action: tracker.ActionRemove, Outcome: tracker.ChangeForwarderError, Count: 1},
+			},
+			metrics: `rd_guestagent_port_changes_total{source="docker",action="remove",outcome="forwarder-error"} 1
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			changes := tracker.NewChangeCounter()
+			tt.changes(t, changes)
+
+			assert.Equal(t, tt.want, changes.Counts())
+
+			registry := metrics.NewRegistry()
+			registry.Register(changes)
+
+			var output strings.Builder
+
+			require.NoError(t, registry.Write(&output))
+			assert.Equal(t, "# HELP rd_guestagent_port_changes_total "+
+				"Number of the changes of the port mappings, by source, action and outcome.\n"+
+				"# TYPE rd_guestagent_port_changes_total counter\n"+tt.metrics, output.String())
+		})
+	}
+}
+
+func TestChangeCounterNil(t *testing.T) {
+	t.Parallel()
+
+	var changes *tracker.ChangeCounter
+
+	changes.Count(tracker.SourceDocker, tracker.ActionAdd, tracker.ChangeOK)
+	assert.Empty(t, changes.Counts())
+}
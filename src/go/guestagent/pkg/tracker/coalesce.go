@@ -0,0 +1,109 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"time"
+)
+
+// EnableCoalescing makes the pending batch gather the changes of all the
+// sources for up to window: each change postpones it by the batch window,
+// so that a burst, e.g. a compose up along with a helm install, is sent as a
+// single batch once it settles, or once window elapsed since its first
+// change. A single change is still sent after the batch window. The removals
+// are not held for as long, they are sent on their own once the batch window
+// elapsed since the first of them, so that the host does not keep forwarding
+// the ports meanwhile. It has no effect unless batching is enabled.
+func (p *VTunnelTracker) EnableCoalescing(window time.Duration) {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	p.coalesceWindow = window
+}
+
+// extendBatch postpones the pending batch to the batch window from now,
+// unless it was postponed for the coalescing window already, or the rate
+// limit holds it for longer anyway. The batchMutex must be held.
+func (p *VTunnelTracker) extendBatch() {
+	if p.coalesceWindow <= 0 {
+		return
+	}
+
+	deadline := time.Now().Add(p.batchWindow)
+	if limit := p.batchStarted.Add(p.coalesceWindow); deadline.After(limit) {
+		deadline = limit
+	}
+
+	if !deadline.After(p.batchDeadline) {
+		return
+	}
+
+	// The timer that fired already sends the changes so far, the next ones
+	// start another batch.
+	if p.batchTimer.Stop() {
+		p.batchTimer.Reset(time.Until(deadline))
+		p.batchDeadline = deadline
+	}
+}
+
+// markRemoval records whether the latest change of the container ID in the
+// pending batch is a removal, which is then sent ahead of the batch. The
+// batchMutex must be held.
+func (p *VTunnelTracker) markRemoval(containerID string, removal bool) {
+	if p.coalesceWindow <= 0 {
+		return
+	}
+
+	if !removal {
+		delete(p.removals, containerID)
+
+		return
+	}
+
+	p.removals[containerID] = struct{}{}
+
+	if p.removalTimer == nil {
+		p.removalTimer = time.AfterFunc(p.batchWindow, func() {
+			if err := p.flush(true); err != nil {
+				logger.Errorf("flushing port mappings removals failed: %v", err)
+			}
+		})
+	}
+}
+
+// takeRemovals takes the removals out of the pending batch, along with the
+// correlation IDs of their latest changes. The batchMutex must be held.
+func (p *VTunnelTracker) takeRemovals() map[string]string {
+	removals := make(map[string]string, len(p.removals))
+
+	for containerID := range p.removals {
+		if correlationID, ok := p.dirty[containerID]; ok {
+			removals[containerID] = correlationID
+			delete(p.dirty, containerID)
+		}
+	}
+
+	p.removals = make(map[string]struct{})
+
+	return removals
+}
+
+// stopRemovalTimer stops the timer of the pending removals. The batchMutex must be held.
+func (p *VTunnelTracker) stopRemovalTimer() {
+	if p.removalTimer != nil {
+		p.removalTimer.Stop()
+	}
+
+	p.removalTimer = nil
+}
@@ -0,0 +1,148 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// burstSends applies a mixed burst of 50 changes from the sources, 45
+// additions and 5 removals of the port mappings that were sent before,
+// every 2ms, and returns the number of additions and removals that the
+// forwarder received for it.
+func burstSends(t *testing.T, coalesceWindow time.Duration) (int, int) {
+	t.Helper()
+
+	const batchWindow = 20 * time.Millisecond
+
+	forwarder := testForwarder{bulk: true}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+	vtunnelTracker.EnableBatching(batchWindow)
+	vtunnelTracker.EnableCoalescing(coalesceWindow)
+	vtunnelTracker.SetPeerBatches(func() bool { return true })
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, vtunnelTracker.Add(context.Background(), "sent"+strconv.Itoa(i), testPortMap(9000+i)))
+	}
+
+	require.NoError(t, vtunnelTracker.Flush())
+
+	before := len(forwarder.received())
+	sources := []string{tracker.SourceDocker, tracker.SourceKubernetes, tracker.SourceIptables}
+	expected := make(nat.PortMap)
+
+	for i := 0; i < 50; i++ {
+		if i%10 == 5 {
+			require.NoError(t, vtunnelTracker.Remove(context.Background(), "sent"+strconv.Itoa(i/10)))
+		} else {
+			portMap := testPortMap(8000 + i)
+			require.NoError(t, vtunnelTracker.Add(context.Background(), containerID+strconv.Itoa(i), portMap,
+				tracker.WithSource(sources[i%len(sources)])))
+
+			for port, bindings := range portMap {
+				expected[port] = bindings
+			}
+		}
+
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(expected, hostState(forwarder.received()))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	var additions, removals int
+
+	for _, portMapping := range forwarder.received()[before:] {
+		if portMapping.Remove {
+			removals++
+		} else {
+			additions++
+		}
+	}
+
+	return additions, removals
+}
+
+func TestVTunnelTrackerCoalescing(t *testing.T) {
+	t.Parallel()
+
+	batchedAdditions, batchedRemovals := burstSends(t, 0)
+	coalescedAdditions, coalescedRemovals := burstSends(t, 5*time.Second)
+
+	// The additions of the burst are sent at once, the removals are not
+	// held for the burst to settle, each one is sent on its own.
+	assert.Equal(t, 1, coalescedAdditions)
+	assert.LessOrEqual(t, coalescedRemovals, 5)
+	assert.Greater(t, batchedAdditions+batchedRemovals, coalescedAdditions+coalescedRemovals)
+}
+
+func TestVTunnelTrackerCoalescingSingleChange(t *testing.T) {
+	t.Parallel()
+
+	forwarder := testForwarder{bulk: true}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+	vtunnelTracker.EnableBatching(20 * time.Millisecond)
+	vtunnelTracker.EnableCoalescing(10 * time.Second)
+
+	// A single change is sent once the batch window elapsed, not the coalescing window.
+	start := time.Now()
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, testPortMap(8000)))
+	require.Eventually(t, func() bool {
+		return len(forwarder.received()) == 1
+	}, 5*time.Second, time.Millisecond)
+
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestVTunnelTrackerCoalescingRemovals(t *testing.T) {
+	t.Parallel()
+
+	forwarder := testForwarder{bulk: true}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+	vtunnelTracker.EnableBatching(50 * time.Millisecond)
+	vtunnelTracker.EnableCoalescing(10 * time.Second)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, testPortMap(9000)))
+	require.NoError(t, vtunnelTracker.Flush())
+
+	// The removal is sent while the additions around it keep coming.
+	for i := 0; i < 100; i++ {
+		if i == 10 {
+			require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID2))
+		}
+
+		require.NoError(t, vtunnelTracker.Add(context.Background(), containerID+strconv.Itoa(i), testPortMap(8000+i)))
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	require.Eventually(t, func() bool {
+		return len(forwarder.received()) >= 3
+	}, 5*time.Second, time.Millisecond)
+
+	received := forwarder.received()
+	assert.True(t, received[1].Remove)
+	assert.Equal(t, testPortMap(9000), received[1].Ports)
+	assert.False(t, received[2].Remove)
+}
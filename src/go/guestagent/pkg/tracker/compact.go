@@ -0,0 +1,63 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// compactMinPeak is the number of entries that a map must have held for
+	// it to be compacted, the memory of the smaller ones is not worth it.
+	compactMinPeak = 1024
+	// compactRatio is how much a map must shrink from its peak to be compacted.
+	compactRatio = 4
+)
+
+// compactions counts the maps that were compacted, see Compactions.
+var compactions atomic.Uint64 //nolint:gochecknoglobals
+
+// Compactions returns the number of times that a map of the trackers was
+// recreated after most of its entries were deleted, see deleteCompacted.
+func Compactions() uint64 {
+	return compactions.Load()
+}
+
+// deleteCompacted deletes the key from the map, and returns the map, or a
+// copy of it once it shrank to a quarter of its peak: a Go map never gives
+// back the memory of the entries that were deleted, so a burst of port
+// mappings would otherwise keep it at its peak size for as long as the
+// agent runs. The peak is the largest size that the map was seen with
+// since it was last compacted, which the largest map is always seen with
+// at its next deletion.
+func deleteCompacted[K comparable, V any](m map[K]V, key K, peak *int) map[K]V {
+	*peak = max(*peak, len(m))
+
+	delete(m, key)
+
+	if *peak < compactMinPeak || len(m)*compactRatio > *peak {
+		return m
+	}
+
+	// The copy is only sized for the entries that are left.
+	compacted := make(map[K]V, len(m))
+	for k, v := range m {
+		compacted[k] = v
+	}
+
+	*peak = len(compacted)
+	compactions.Add(1)
+
+	return compacted
+}
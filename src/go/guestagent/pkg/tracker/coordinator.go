@@ -0,0 +1,239 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+)
+
+// Flusher is implemented by the trackers that defer sending the changes
+// to the host, Flush sends the pending changes immediately.
+type Flusher interface {
+	Flush() error
+}
+
+// flush sends the pending changes of the tracker, if it defers them.
+func flush(tracker Tracker) error {
+	if flusher, ok := tracker.(Flusher); ok {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
+// ListenerAddr is the address of an in-VM listener that backs a port mapping.
+type ListenerAddr struct {
+	IP   net.IP
+	Port int
+}
+
+// Coordinator orders the changes to the port mappings on the host with the
+// in-VM listeners that back them, so that the host never forwards into a
+// closed socket and the workload can always rebind its ports:
+//   - on publish, the listeners are opened before the host learns about the port mapping;
+//   - on withdraw, the host forgets about the port mapping before the listeners are closed.
+type Coordinator struct {
+	Tracker
+	// listeners holds the listener addresses that were opened for each entry.
+	listeners map[string][]ListenerAddr
+	mutex     sync.Mutex
+}
+
+// NewCoordinator wraps the given tracker to coordinate its port mappings with the listeners.
+func NewCoordinator(tracker Tracker) *Coordinator {
+	return &Coordinator{
+		Tracker:   tracker,
+		listeners: make(map[string][]ListenerAddr),
+	}
+}
+
+// Publish opens the given listeners and then adds the port mapping to the
+// tracker. If the port mapping can not be added, the listeners are closed.
+func (c *Coordinator) Publish(
+	ctx context.Context,
+	containerID string,
+	portMap nat.PortMap,
+	listeners []ListenerAddr,
+	opts ...EntryOption,
+) error {
+	opened := make([]ListenerAddr, 0, len(listeners))
+
+	for _, listener := range listeners {
+		if err := c.Tracker.AddListener(ctx, listener.IP, listener.Port); err != nil {
+			logger.Errorw("failed to open listener", logging.Fields(
+				logging.Error(err),
+				logging.ID(containerID),
+				logging.Addr(ipPortToAddr(listener.IP, listener.Port)),
+				logging.Port(listener.Port),
+			))
+
+			continue
+		}
+
+		opened = append(opened, listener)
+	}
+
+	c.mutex.Lock()
+	c.listeners[containerID] = append(c.listeners[containerID], opened...)
+	c.mutex.Unlock()
+
+	if err := c.Tracker.Add(ctx, containerID, portMap, opts...); err != nil {
+		c.closeListeners(ctx, containerID)
+
+		return err
+	}
+
+	return nil
+}
+
+// Withdraw removes the port mapping from the tracker, making sure that the
+// removal reached the host, and then closes the listeners of the entry.
+func (c *Coordinator) Withdraw(ctx context.Context, containerID string, opts ...EntryOption) error {
+	c.mutex.Lock()
+	_, hasListeners := c.listeners[containerID]
+	c.mutex.Unlock()
+
+	err := c.withdraw(ctx, containerID, hasListeners, opts...)
+	c.closeListeners(ctx, containerID)
+
+	return err
+}
+
+// Remove withdraws the port mapping, see Withdraw.
+func (c *Coordinator) Remove(ctx context.Context, containerID string, opts ...EntryOption) error {
+	return c.Withdraw(ctx, containerID, opts...)
+}
+
+// RemoveAll withdraws all the port mappings, the removals are sent
+// in parallel and the listeners are closed once they are all sent.
+func (c *Coordinator) RemoveAll(ctx context.Context) error {
+	err := c.withdrawAll(ctx)
+	c.CloseListeners(ctx)
+
+	return err
+}
+
+// Shutdown withdraws all the port mappings like RemoveAll, but it leaves
+// their listeners open, for CloseListeners to close once the shutdown is
+// done with the host; it gives up once the context is done so that an
+// unresponsive host can not block the exit.
+func (c *Coordinator) Shutdown(ctx context.Context) error {
+	started := time.Now()
+	errCh := make(chan error, 1)
+
+	go func() {
+		errCh <- c.withdrawAll(ctx)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("%w after %s", ErrShutdownTimeout, time.Since(started).Round(time.Millisecond))
+	}
+}
+
+// CloseListeners closes the listeners of all the port mappings, in the order
+// of their IDs; it gives up on the ones that are left once the context is done.
+func (c *Coordinator) CloseListeners(ctx context.Context) {
+	c.mutex.Lock()
+	containerIDs := sortedIDs(c.listeners)
+	c.mutex.Unlock()
+
+	for _, containerID := range containerIDs {
+		if ctx.Err() != nil {
+			return
+		}
+
+		c.closeListeners(ctx, containerID)
+	}
+}
+
+// withdraw removes the entry from the tracker, the deferred changes are
+// only flushed when there are listeners that wait for the removal.
+func (c *Coordinator) withdraw(ctx context.Context, containerID string, wait bool, opts ...EntryOption) error {
+	if c.Tracker.Get(containerID) == nil {
+		return nil
+	}
+
+	if err := c.Tracker.Remove(ctx, containerID, opts...); err != nil {
+		return err
+	}
+
+	if !wait {
+		return nil
+	}
+
+	return flush(c.Tracker)
+}
+
+func (c *Coordinator) withdrawAll(ctx context.Context) error {
+	var (
+		wg        sync.WaitGroup
+		errsMutex sync.Mutex
+		errs      []error
+	)
+
+	for _, entry := range c.Tracker.List() {
+		wg.Add(1)
+
+		go func(containerID string) {
+			defer wg.Done()
+
+			if err := c.Tracker.Remove(ctx, containerID); err != nil {
+				errsMutex.Lock()
+				errs = append(errs, fmt.Errorf("removing %s failed: %w", containerID, err))
+				errsMutex.Unlock()
+			}
+		}(entry.ID)
+	}
+
+	wg.Wait()
+
+	// This sends any deferred removals, and drops what could not be removed.
+	if err := c.Tracker.RemoveAll(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("%w: %+v", ErrRemoveAll, errs)
+	}
+
+	return nil
+}
+
+func (c *Coordinator) closeListeners(ctx context.Context, containerID string) {
+	c.mutex.Lock()
+	listeners := c.listeners[containerID]
+	delete(c.listeners, containerID)
+	c.mutex.Unlock()
+
+	for _, listener := range listeners {
+		if err := c.Tracker.RemoveListener(ctx, listener.IP, listener.Port); err != nil {
+			logger.Errorw("failed to close listener", logging.Fields(
+				logging.Error(err),
+				logging.ID(containerID),
+				logging.Addr(ipPortToAddr(listener.IP, listener.Port)),
+				logging.Port(listener.Port),
+			))
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// callRecorder records the calls to the forwarder and the listeners in order.
+type callRecorder struct {
+	calls []string
+	mutex sync.Mutex
+}
+
+func (c *callRecorder) record(call string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.calls = append(c.calls, call)
+}
+
+func (c *callRecorder) recorded() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]string(nil), c.calls...)
+}
+
+type recordingForwarder struct {
+	recorder *callRecorder
+}
+
+func (r *recordingForwarder) Send(_ context.Context, portMapping types.PortMapping) error {
+	action := "add"
+	if portMapping.Remove {
+		action = "remove"
+	}
+
+	ports := make([]string, 0, len(portMapping.Ports))
+	for port := range portMapping.Ports {
+		ports = append(ports, string(port))
+	}
+
+	sort.Strings(ports)
+
+	for _, port := range ports {
+		r.recorder.record(fmt.Sprintf("%s %s", action, port))
+	}
+
+	return nil
+}
+
+func (r *recordingForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	return forwarder.RemoveEach(ctx, r, portMappings)
+}
+
+// recordingTracker records the listener calls instead of opening sockets.
+type recordingTracker struct {
+	tracker.Tracker
+	recorder *callRecorder
+}
+
+func (r *recordingTracker) AddListener(_ context.Context, _ net.IP, port int) error {
+	r.recorder.record(fmt.Sprintf("listen %d", port))
+
+	return nil
+}
+
+func (r *recordingTracker) RemoveListener(_ context.Context, _ net.IP, port int) error {
+	r.recorder.record(fmt.Sprintf("close %d", port))
+
+	return nil
+}
+
+func (r *recordingTracker) Flush() error {
+	if flusher, ok := r.Tracker.(tracker.Flusher); ok {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
+func newRecordingCoordinator(batchWindow time.Duration) (*tracker.Coordinator, *callRecorder) {
+	recorder := &callRecorder{}
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	vtunnelTracker := tracker.NewVTunnelTracker(&recordingForwarder{recorder: recorder}, wslConnectAddr)
+
+	if batchWindow > 0 {
+		vtunnelTracker.EnableBatching(batchWindow)
+	}
+
+	return tracker.NewCoordinator(&recordingTracker{Tracker: vtunnelTracker, recorder: recorder}), recorder
+}
+
+func TestCoordinatorOrdering(t *testing.T) {
+	t.Parallel()
+
+	for _, batchWindow := range []time.Duration{0, time.Hour} {
+		t.Run(fmt.Sprintf("batchWindow=%s", batchWindow), func(t *testing.T) {
+			t.Parallel()
+
+			coordinator, recorder := newRecordingCoordinator(batchWindow)
+			ctx := context.Background()
+
+			portMapping := nat.PortMap{
+				"80/tcp": []nat.PortBinding{
+					{
+						HostIP:   hostIP,
+						HostPort: hostPort,
+					},
+				},
+			}
+			listeners := []tracker.ListenerAddr{{IP: net.IPv4zero, Port: 80}}
+
+			err := coordinator.Publish(ctx, containerID, portMapping, listeners)
+			require.NoError(t, err)
+
+			if batchWindow > 0 {
+				require.NoError(t, coordinator.Tracker.(tracker.Flusher).Flush())
+			}
+
+			err = coordinator.Withdraw(ctx, containerID)
+			require.NoError(t, err)
+
+			assert.Equal(t, []string{
+				"listen 80",
+				"add 80/tcp",
+				"remove 80/tcp",
+				"close 80",
+			}, recorder.recorded())
+		})
+	}
+}
+
+func TestCoordinatorShutdown(t *testing.T) {
+	t.Parallel()
+
+	coordinator, recorder := newRecordingCoordinator(0)
+	ctx := context.Background()
+
+	for i, port := range []int{80, 443} {
+		portMapping := nat.PortMap{
+			nat.Port(fmt.Sprintf("%d/tcp", port)): []nat.PortBinding{
+				{
+					HostIP:   hostIP,
+					HostPort: fmt.Sprint(port),
+				},
+			},
+		}
+		listeners := []tracker.ListenerAddr{{IP: net.IPv4zero, Port: port}}
+
+		err := coordinator.Publish(ctx, fmt.Sprintf("container_%d", i), portMapping, listeners)
+		require.NoError(t, err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	err := coordinator.Shutdown(shutdownCtx)
+	require.NoError(t, err)
+
+	// The removals are sent in parallel, and the listeners are left open
+	// for the next phase of the shutdown.
+	calls := recorder.recorded()
+	require.Len(t, calls, 6)
+	assert.ElementsMatch(t, []string{"remove 80/tcp", "remove 443/tcp"}, calls[4:6])
+	assert.Empty(t, coordinator.List())
+
+	coordinator.CloseListeners(shutdownCtx)
+	assert.Equal(t, []string{"close 80", "close 443"}, recorder.recorded()[6:])
+}
+
+func TestCoordinatorPublishError(t *testing.T) {
+	t.Parallel()
+
+	recorder := &callRecorder{}
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{sendErr: errSend}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	coordinator := tracker.NewCoordinator(&recordingTracker{Tracker: vtunnelTracker, recorder: recorder})
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	listeners := []tracker.ListenerAddr{{IP: net.IPv4zero, Port: 80}}
+
+	err := coordinator.Publish(context.Background(), containerID, portMapping, listeners)
+	require.ErrorIs(t, err, errSend)
+
+	// The listener is not left behind when the host never learned about the port
+	assert.Equal(t, []string{"listen 80", "close 80"}, recorder.recorded())
+}
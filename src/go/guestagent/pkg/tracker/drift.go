@@ -0,0 +1,436 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// DefaultDriftInterval is how often the sources are compared with the tracker.
+	DefaultDriftInterval = 5 * time.Minute
+	// driftRepairs is the number of the repairs that are allowed within an
+	// interval, see DriftChecker.Repairs.
+	driftRepairs = 10
+	// driftHoldoff is the number of the intervals that a repaired
+	// discrepancy is left alone for if it is found again.
+	driftHoldoff = 12
+)
+
+// The kinds of the discrepancies between a source and the tracker.
+const (
+	// DriftMissing is a port mapping of the source that is not tracked.
+	DriftMissing = "missing"
+	// DriftOrphaned is a tracked port mapping that the source no longer has.
+	DriftOrphaned = "orphaned"
+)
+
+// DriftSource is a source that the drift checker lists apart from its events,
+// to compare it with what the tracker holds for it; see EntryDriftSource and
+// ListenerDriftSource.
+type DriftSource struct {
+	// Name is the source, e.g. SourceDocker.
+	Name string
+	// List lists the port mappings of the source, keyed like Tracked, see
+	// scan.Lister. The keys without port bindings are not missing when they
+	// are not tracked, only their tracked port mappings are not orphaned.
+	List func(ctx context.Context) (map[string]nat.PortMap, error)
+	// Tracked returns the keys of the port mappings that are tracked for it.
+	Tracked func() map[string]bool
+	// Requested, if set, returns true for the keys that the source added
+	// although they are not tracked, e.g. with FilterTracker.Requested since
+	// the filter let none of their port bindings through; they are not missing.
+	Requested func(key string) bool
+	// Add adds the port mapping that is missing, Remove the one that is orphaned.
+	Add    func(ctx context.Context, key string, ports nat.PortMap) error
+	Remove func(ctx context.Context, key string) error
+}
+
+// EntryDriftSource returns the drift source of the port mappings that the
+// source adds to the tracker, which are keyed by key(ID), or by their ID if
+// key is nil, e.g. so that the port mappings that a container has apart
+// from its ports are kept along with it.
+func EntryDriftSource(
+	tracker Tracker,
+	name string,
+	list func(ctx context.Context) (map[string]nat.PortMap, error),
+	key func(id string) string,
+) DriftSource {
+	if key == nil {
+		key = func(id string) string { return id }
+	}
+
+	return DriftSource{
+		Name: name,
+		List: list,
+		Tracked: func() map[string]bool {
+			tracked := make(map[string]bool)
+
+			for _, entry := range tracker.List() {
+				if entry.Source == name {
+					tracked[key(entry.ID)] = true
+				}
+			}
+
+			return tracked
+		},
+		Add: func(ctx context.Context, key string, ports nat.PortMap) error {
+			return tracker.Add(ctx, key, ports, WithSource(name), WithCorrelationID(NewCorrelationID()))
+		},
+		Remove: func(ctx context.Context, removed string) error {
+			var errs []error
+
+			for _, entry := range tracker.List() {
+				if entry.Source == name && key(entry.ID) == removed {
+					errs = append(errs, tracker.Remove(ctx, entry.ID, WithCorrelationID(NewCorrelationID())))
+				}
+			}
+
+			return errors.Join(errs...)
+		},
+	}
+}
+
+// ListenerDriftSource returns the drift source of the listeners that the
+// source opens in the VM, e.g. for the ports of the iptables rules, which are
+// the listeners whose origin is of the kind. They are keyed by their address,
+// which are the ones of the port bindings that the list returns.
+func ListenerDriftSource(
+	netTracker NetTracker,
+	listeners *ListenerTracker,
+	name, kind string,
+	list func(ctx context.Context) (map[string]nat.PortMap, error),
+) DriftSource {
+	return DriftSource{
+		Name: name,
+		List: func(ctx context.Context) (map[string]nat.PortMap, error) {
+			portMaps, err := list(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			addrs := make(map[string]nat.PortMap)
+
+			for _, portMap := range portMaps {
+				for port, bindings := range portMap {
+					for _, binding := range bindings {
+						addrs[net.JoinHostPort(binding.HostIP, binding.HostPort)] = nat.PortMap{port: {binding}}
+					}
+				}
+			}
+
+			return addrs, nil
+		},
+		Tracked: func() map[string]bool {
+			tracked := make(map[string]bool)
+
+			for addr, origin := range listeners.ListenerOrigins() {
+				if origin.Kind == kind {
+					tracked[addr] = true
+				}
+			}
+
+			return tracked
+		},
+		Add: func(ctx context.Context, addr string, _ nat.PortMap) error {
+			ip, port, err := splitAddr(addr)
+			if err != nil {
+				return err
+			}
+
+			return netTracker.AddListener(ContextWithOrigin(ctx, Origin{Kind: kind}), ip, port)
+		},
+		Remove: func(ctx context.Context, addr string) error {
+			ip, port, err := splitAddr(addr)
+			if err != nil {
+				return err
+			}
+
+			return netTracker.RemoveListener(ctx, ip, port)
+		},
+	}
+}
+
+// splitAddr returns the IP and the port of a listener address.
+func splitAddr(addr string) (net.IP, int, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid IP address %q of the listener %s", host, addr)
+	}
+
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port of the listener %s: %w", addr, err)
+	}
+
+	return ip, port, nil
+}
+
+// Drift is a discrepancy between a source and the tracker.
+type Drift struct {
+	Source string
+	Key    string
+	// Kind is DriftMissing or DriftOrphaned.
+	Kind string
+}
+
+// DriftChecker compares the sources with the tracker periodically, and
+// repairs the discrepancies that bugs left, see Check.
+type DriftChecker struct {
+	interval time.Duration
+	sources  []DriftSource
+	// Repairs limits the repairs, so that the checker does not fight a bug
+	// that keeps undoing them in a loop.
+	Repairs *rate.Limiter
+	// Holdoff is how long a discrepancy that was repaired is left alone for
+	// if it is found again, it is only reported meanwhile.
+	Holdoff time.Duration
+	// Now is the clock of the holdoff.
+	Now func() time.Time
+
+	// limiter keeps the sources that can not be listed from flooding the logs.
+	limiter *logging.Limiter
+
+	mutex sync.Mutex
+	// suspected are the discrepancies that the last check found and did not repair.
+	suspected map[Drift]struct{}
+	// repaired are when the discrepancies were last repaired, within the holdoff.
+	repaired map[Drift]time.Time
+	// drift are the discrepancies that the last check of each source found,
+	// and repairs the repairs of each source.
+	drift   map[string]uint64
+	repairs map[string]uint64
+}
+
+// NewDriftChecker returns the checker of the sources, which checks them every
+// interval, and repairs up to 10 discrepancies within an interval.
+func NewDriftChecker(interval time.Duration, sources ...DriftSource) *DriftChecker {
+	drift := make(map[string]uint64, len(sources))
+	for _, source := range sources {
+		drift[source.Name] = 0
+	}
+
+	return &DriftChecker{
+		interval:  interval,
+		sources:   sources,
+		Repairs:   rate.NewLimiter(rate.Every(interval/driftRepairs), driftRepairs),
+		Holdoff:   driftHoldoff * interval,
+		Now:       time.Now,
+		limiter:   logging.NewLimiter(0),
+		suspected: make(map[Drift]struct{}),
+		repaired:  make(map[Drift]time.Time),
+		drift:     drift,
+		repairs:   make(map[string]uint64),
+	}
+}
+
+// Check lists every source and compares it with what the tracker holds for
+// it. A discrepancy that two checks in a row found is repaired, since the
+// ones that only one of them found are likely the events that were being
+// handled while the source was listed. It is not repaired if the repairs
+// are over their rate limit, or if it was repaired within the holdoff,
+// which means that a bug undoes the repairs. It returns the discrepancies
+// of the sources that could be listed, and why the others could not.
+func (d *DriftChecker) Check(ctx context.Context) ([]Drift, error) {
+	var (
+		found []Drift
+		errs  []error
+	)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.Now()
+	for drift, repaired := range d.repaired {
+		if now.Sub(repaired) >= d.Holdoff {
+			delete(d.repaired, drift)
+		}
+	}
+
+	for _, source := range d.sources {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+
+			break
+		}
+
+		drifts, err := d.check(ctx, source, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("listing the port mappings of %s failed: %w", source.Name, err))
+
+			continue
+		}
+
+		found = append(found, drifts...)
+	}
+
+	return found, errors.Join(errs...)
+}
+
+// check compares the source with the tracker, and repairs the discrepancies
+// that the last check found too. The mutex must be held.
+func (d *DriftChecker) check(ctx context.Context, source DriftSource, now time.Time) ([]Drift, error) {
+	listed, err := source.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tracked := source.Tracked()
+
+	var drifts []Drift
+
+	for key, ports := range listed {
+		if len(ports) != 0 && !tracked[key] && (source.Requested == nil || !source.Requested(key)) {
+			drifts = append(drifts, Drift{Source: source.Name, Key: key, Kind: DriftMissing})
+		}
+	}
+
+	for key := range tracked {
+		if _, ok := listed[key]; !ok {
+			drifts = append(drifts, Drift{Source: source.Name, Key: key, Kind: DriftOrphaned})
+		}
+	}
+
+	sort.Slice(drifts, func(i, j int) bool {
+		if drifts[i].Key != drifts[j].Key {
+			return drifts[i].Key < drifts[j].Key
+		}
+
+		return drifts[i].Kind < drifts[j].Kind
+	})
+
+	d.drift[source.Name] = uint64(len(drifts))
+
+	confirmed := make(map[Drift]bool, len(drifts))
+
+	for drift := range d.suspected {
+		if drift.Source == source.Name {
+			confirmed[drift] = true
+
+			delete(d.suspected, drift)
+		}
+	}
+
+	if len(drifts) == 0 {
+		return nil, nil
+	}
+
+	logger.Warnw("the tracker drifted from the source", logging.Fields(
+		logging.Source(source.Name),
+		log.Fields{"discrepancies": len(drifts)},
+	))
+
+	for _, drift := range drifts {
+		if !confirmed[drift] || !d.repair(ctx, source, drift, listed[drift.Key], now) {
+			d.suspected[drift] = struct{}{}
+		}
+	}
+
+	return drifts, nil
+}
+
+// repair repairs the discrepancy, and returns false if it is left for a
+// later check. The mutex must be held.
+func (d *DriftChecker) repair(ctx context.Context, source DriftSource, drift Drift, ports nat.PortMap, now time.Time) bool {
+	fields := logging.Fields(logging.ID(drift.Key), logging.Source(source.Name), log.Fields{"drift": drift.Kind})
+
+	if repaired, ok := d.repaired[drift]; ok {
+		logger.Warnw("the discrepancy came back after it was repaired, it is left alone",
+			logging.Fields(fields, log.Fields{"repaired": repaired}))
+
+		return false
+	}
+
+	if !d.Repairs.Allow() {
+		logger.Warnw("too many discrepancies were repaired, this one is left for the next check", fields)
+
+		return false
+	}
+
+	var err error
+	if drift.Kind == DriftMissing {
+		err = source.Add(ctx, drift.Key, ports)
+	} else {
+		err = source.Remove(ctx, drift.Key)
+	}
+
+	d.repaired[drift] = now
+	d.repairs[source.Name]++
+
+	if err != nil {
+		logger.Errorw("repairing the discrepancy failed", logging.Fields(fields, logging.Error(err)))
+	} else {
+		logger.Infow("repaired the discrepancy", fields)
+	}
+
+	return true
+}
+
+// Run checks the sources every interval until the context is cancelled.
+func (d *DriftChecker) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := d.Check(ctx); err != nil && ctx.Err() == nil {
+				d.limiter.Warnf(logger, "checking the drift of the port mappings failed: %v", err)
+			} else if err == nil {
+				d.limiter.Reset(logger)
+			}
+		}
+	}
+}
+
+// Collect returns the metrics of the drift for the Prometheus endpoint, see metrics.Registry.
+func (d *DriftChecker) Collect() []metrics.Family {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return []metrics.Family{
+		{
+			Name:    metrics.Namespace + "drift",
+			Help:    "Number of the discrepancies between the source and the tracker that the last check found, by source.",
+			Type:    metrics.TypeGauge,
+			Samples: sourceSamples(d.drift),
+		},
+		{
+			Name:    metrics.Namespace + "drift_repairs_total",
+			Help:    "Number of the discrepancies between the sources and the tracker that were repaired, by source.",
+			Type:    metrics.TypeCounter,
+			Samples: sourceSamples(d.repairs),
+		},
+	}
+}
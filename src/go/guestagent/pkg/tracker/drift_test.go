@@ -0,0 +1,281 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+var errList = errors.New("the source can not be listed")
+
+// driftPorts returns the port mapping of a single port binding.
+func driftPorts(port string) nat.PortMap {
+	return nat.PortMap{nat.Port(port + "/tcp"): []nat.PortBinding{{HostIP: hostIP, HostPort: port}}}
+}
+
+// driftSource is a source whose port mappings are set by the test.
+type driftSource struct {
+	portMaps map[string]nat.PortMap
+	err      error
+}
+
+func (s *driftSource) list(context.Context) (map[string]nat.PortMap, error) {
+	return s.portMaps, s.err
+}
+
+// newDriftTracker returns a tracker that holds the docker port mappings of
+// the source, and the checker that compares them.
+func newDriftTracker(t *testing.T, source *driftSource) (*tracker.VTunnelTracker, *tracker.DriftChecker) {
+	t.Helper()
+
+	vtunnelTracker := tracker.NewVTunnelTracker(&testForwarder{}, []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}})
+
+	for id, ports := range source.portMaps {
+		require.NoError(t, vtunnelTracker.Add(context.Background(), id, ports, tracker.WithSource(tracker.SourceDocker)))
+	}
+
+	checker := tracker.NewDriftChecker(tracker.DefaultDriftInterval,
+		tracker.EntryDriftSource(vtunnelTracker, tracker.SourceDocker, source.list, nil))
+
+	return vtunnelTracker, checker
+}
+
+func trackedIDs(trk tracker.Tracker) []string {
+	var ids []string
+	for _, entry := range trk.List() {
+		ids = append(ids, entry.ID)
+	}
+
+	return ids
+}
+
+func TestDriftCheckerRepairs(t *testing.T) {
+	t.Parallel()
+
+	source := &driftSource{portMaps: map[string]nat.PortMap{
+		containerID:  driftPorts("8080"),
+		containerID2: driftPorts("8081"),
+	}}
+	vtunnelTracker, checker := newDriftTracker(t, source)
+	ctx := context.Background()
+
+	// The tracker misses the removal of a container that stopped, and the
+	// start of another one.
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "stopped", driftPorts("8082"), tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID2))
+
+	// The port mappings of the other sources are not the checker's.
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "service", driftPorts("8083"), tracker.WithSource(tracker.SourceKubernetes)))
+
+	want := []tracker.Drift{
+		{Source: tracker.SourceDocker, Key: containerID2, Kind: tracker.DriftMissing},
+		{Source: tracker.SourceDocker, Key: "stopped", Kind: tracker.DriftOrphaned},
+	}
+
+	// The first check only reports them, they could be events in flight.
+	drifts, err := checker.Check(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, want, drifts)
+	assert.ElementsMatch(t, []string{containerID, "stopped", "service"}, trackedIDs(vtunnelTracker))
+
+	// The second check repairs them.
+	drifts, err = checker.Check(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, want, drifts)
+	assert.ElementsMatch(t, []string{containerID, containerID2, "service"}, trackedIDs(vtunnelTracker))
+	assert.Equal(t, driftPorts("8081"), vtunnelTracker.Get(containerID2))
+
+	drifts, err = checker.Check(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, drifts)
+
+	families := checker.Collect()
+	require.Len(t, families, 2)
+	assert.Equal(t, metrics.Namespace+"drift", families[0].Name)
+	assert.Equal(t, []metrics.Sample{{Labels: []metrics.Label{{Name: "source", Value: tracker.SourceDocker}}, Value: 0}},
+		families[0].Samples)
+	assert.Equal(t, []metrics.Sample{{Labels: []metrics.Label{{Name: "source", Value: tracker.SourceDocker}}, Value: 2}},
+		families[1].Samples)
+}
+
+func TestDriftCheckerTransient(t *testing.T) {
+	t.Parallel()
+
+	source := &driftSource{portMaps: map[string]nat.PortMap{containerID: driftPorts("8080")}}
+	vtunnelTracker, checker := newDriftTracker(t, source)
+	ctx := context.Background()
+
+	// A container starts while the source is listed, before its event is handled.
+	source.portMaps = map[string]nat.PortMap{containerID: driftPorts("8080"), containerID2: driftPorts("8081")}
+
+	drifts, err := checker.Check(ctx)
+	require.NoError(t, err)
+	assert.Len(t, drifts, 1)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, driftPorts("8081"), tracker.WithSource(tracker.SourceDocker)))
+
+	// The event was handled in the meantime, nothing is repaired.
+	drifts, err = checker.Check(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, drifts)
+
+	// Nor is a discrepancy that is found again after a check without it.
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID2))
+
+	drifts, err = checker.Check(ctx)
+	require.NoError(t, err)
+	assert.Len(t, drifts, 1)
+	assert.Nil(t, vtunnelTracker.Get(containerID2))
+}
+
+func TestDriftCheckerHoldoff(t *testing.T) {
+	t.Parallel()
+
+	source := &driftSource{portMaps: map[string]nat.PortMap{containerID: driftPorts("8080")}}
+	vtunnelTracker, checker := newDriftTracker(t, source)
+	ctx := context.Background()
+
+	// A bug keeps removing the port mapping.
+	for range 2 {
+		require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+
+		_, err := checker.Check(ctx)
+		require.NoError(t, err)
+	}
+
+	require.NotNil(t, vtunnelTracker.Get(containerID))
+
+	// It is not repaired again within the holdoff, but still reported.
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+
+	for range 3 {
+		drifts, err := checker.Check(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []tracker.Drift{{Source: tracker.SourceDocker, Key: containerID, Kind: tracker.DriftMissing}}, drifts)
+		assert.Nil(t, vtunnelTracker.Get(containerID))
+	}
+
+	assert.Equal(t, float64(1), checker.Collect()[1].Samples[0].Value)
+}
+
+func TestDriftCheckerRateLimit(t *testing.T) {
+	t.Parallel()
+
+	source := &driftSource{portMaps: map[string]nat.PortMap{}}
+	vtunnelTracker, checker := newDriftTracker(t, source)
+	ctx := context.Background()
+
+	checker.Repairs = rate.NewLimiter(0, 1)
+
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, vtunnelTracker.Add(context.Background(), id, driftPorts("8080"), tracker.WithSource(tracker.SourceDocker)))
+	}
+
+	for range 2 {
+		_, err := checker.Check(ctx)
+		require.NoError(t, err)
+	}
+
+	// Only one of them is repaired, the others are left for later checks.
+	assert.Len(t, vtunnelTracker.List(), 2)
+}
+
+func TestDriftCheckerRequested(t *testing.T) {
+	t.Parallel()
+
+	vtunnelTracker := tracker.NewVTunnelTracker(&testForwarder{}, []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}})
+	filter, err := tracker.ParsePortFilter("", "8080")
+	require.NoError(t, err)
+
+	filterTracker := tracker.NewFilterTracker(vtunnelTracker, filter)
+	require.NoError(t, filterTracker.Add(context.Background(), containerID, driftPorts("8080"), tracker.WithSource(tracker.SourceDocker)))
+
+	source := &driftSource{portMaps: map[string]nat.PortMap{containerID: driftPorts("8080")}}
+	driftSource := tracker.EntryDriftSource(filterTracker, tracker.SourceDocker, source.list, nil)
+	driftSource.Requested = filterTracker.Requested
+	checker := tracker.NewDriftChecker(tracker.DefaultDriftInterval, driftSource)
+
+	// The port mapping that the filter blocks is not missing.
+	drifts, err := checker.Check(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, drifts)
+}
+
+func TestDriftCheckerListeners(t *testing.T) {
+	t.Parallel()
+
+	listenerTracker := tracker.NewListenerTracker()
+	listenerTracker.EnableDryRun()
+
+	ctx := context.Background()
+	loopback := net.IPv4(127, 0, 0, 1)
+	rule := tracker.ContextWithOrigin(ctx, tracker.Origin{Kind: tracker.OriginRule})
+
+	// The rule of the first port is gone, and the listener of the second one
+	// was missed; the listener of the third one is not the source's.
+	require.NoError(t, listenerTracker.AddListener(rule, loopback, 8080))
+	require.NoError(t, listenerTracker.AddListener(ctx, loopback, 8082))
+
+	source := &driftSource{portMaps: map[string]nat.PortMap{"127.0.0.1:8081": driftPorts("8081")}}
+	checker := tracker.NewDriftChecker(tracker.DefaultDriftInterval, tracker.ListenerDriftSource(
+		listenerTracker, listenerTracker, tracker.SourceIptables, tracker.OriginRule, source.list))
+
+	for range 2 {
+		drifts, err := checker.Check(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []tracker.Drift{
+			{Source: tracker.SourceIptables, Key: "127.0.0.1:8080", Kind: tracker.DriftOrphaned},
+			{Source: tracker.SourceIptables, Key: "127.0.0.1:8081", Kind: tracker.DriftMissing},
+		}, drifts)
+	}
+
+	assert.Equal(t, []string{"127.0.0.1:8081", "127.0.0.1:8082"}, listenerTracker.Listeners())
+	assert.Equal(t, tracker.OriginRule, listenerTracker.ListenerOrigins()["127.0.0.1:8081"].Kind)
+}
+
+func TestDriftCheckerListFailed(t *testing.T) {
+	t.Parallel()
+
+	failing := &driftSource{err: errList}
+	source := &driftSource{portMaps: map[string]nat.PortMap{}}
+	vtunnelTracker, _ := newDriftTracker(t, source)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, driftPorts("8080"), tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, driftPorts("8081"),
+		tracker.WithSource(tracker.SourceKubernetes)))
+
+	checker := tracker.NewDriftChecker(tracker.DefaultDriftInterval,
+		tracker.EntryDriftSource(vtunnelTracker, tracker.SourceKubernetes, failing.list, nil),
+		tracker.EntryDriftSource(vtunnelTracker, tracker.SourceDocker, source.list, nil))
+
+	// The source that can not be listed is left as it is, the others are checked.
+	for range 2 {
+		drifts, err := checker.Check(context.Background())
+		require.ErrorIs(t, err, errList)
+		assert.Len(t, drifts, 1)
+	}
+
+	assert.Equal(t, []string{containerID2}, trackedIDs(vtunnelTracker))
+}
@@ -0,0 +1,531 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// Sources of the port mappings that are added to the tracker.
+const (
+	SourceDocker     = "docker"
+	SourceContainerd = "containerd"
+	SourceKubernetes = "kubernetes"
+	SourceIptables   = "iptables"
+	// SourceLoopback is the source of the ports that the VM only listens on
+	// at its loopback, which are relayed from its other addresses.
+	SourceLoopback = "loopback"
+	// SourceManual is the source of the port mappings that are added with the admin API.
+	SourceManual = "manual"
+)
+
+// DeliveryState describes whether an entry has reached the host.
+type DeliveryState string
+
+const (
+	// StatePending is the state of an entry that has changed
+	// and has not been sent to the host yet.
+	StatePending DeliveryState = "pending"
+	// StateSent is the state of an entry that was successfully sent to the host.
+	StateSent DeliveryState = "sent"
+	// StateFailed is the state of an entry that could not be sent
+	// to the host, it is retried if the tracker supports it.
+	StateFailed DeliveryState = "failed"
+	// StateHostConflict is the state of an entry that was sent to the host,
+	// but the host could not apply some of its port bindings; for example,
+	// since another process on the host uses the port.
+	StateHostConflict DeliveryState = "host-conflict"
+)
+
+// Entry is a point in time copy of a port mapping that is held
+// by the tracker, it is safe to use after the tracker changes.
+type Entry struct {
+	// ID is the key that the port mapping was added with,
+	// e.g. a container ID or a Kubernetes service UID.
+	ID string `json:"id"`
+	// Source is the subsystem that added the port mapping.
+	Source string `json:"source,omitempty"`
+	// Origin is the object of the source that the port mapping was last
+	// added for, e.g. the container, see WithOrigin.
+	Origin *Origin `json:"origin,omitempty"`
+	// Ports are the tracked port mappings.
+	Ports nat.PortMap `json:"ports"`
+	// ConnectAddrs are the backend addresses the entry was sent with.
+	ConnectAddrs []types.ConnectAddrs `json:"connectAddrs,omitempty"`
+	// Added is the time when the entry was first added.
+	Added time.Time `json:"added"`
+	// Updated is the time when the entry was last added.
+	Updated time.Time `json:"updated"`
+	// Refreshed is the time when the entry was last added or refreshed.
+	Refreshed time.Time `json:"refreshed"`
+	// Leased indicates that the source refreshes the entry periodically,
+	// so it can be garbage-collected once it is no longer refreshed.
+	Leased bool `json:"leased,omitempty"`
+	// State is the delivery state of the entry's latest change.
+	State DeliveryState `json:"state,omitempty"`
+	// LastSent is the time when the entry was last sent to the host.
+	LastSent time.Time `json:"lastSent"`
+	// LastSendError is the error from the last attempt
+	// to send the entry to the host, if any.
+	LastSendError string `json:"lastSendError,omitempty"`
+	// HostConflicts holds the errors of the port bindings that the host
+	// could not apply, keyed by the binding in the "hostIP:hostPort/protocol" form.
+	HostConflicts map[string]string `json:"hostConflicts,omitempty"`
+	// LikelyConflicts holds the services of the host that likely hold the
+	// well-known host ports of the port bindings, keyed like HostConflicts;
+	// the port bindings are forwarded nonetheless, see FilterTracker.SetWellKnown.
+	LikelyConflicts map[string]string `json:"likelyConflicts,omitempty"`
+	// Metadata holds arbitrary key/value pairs that are
+	// forwarded to the host along with the port mappings.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// CorrelationID identifies the change that last added the entry, it is
+	// logged by the source, the tracker and the forwarder alike so that the
+	// events of the change can be linked; see NewCorrelationID.
+	CorrelationID string `json:"correlationID,omitempty"`
+	// EventTime is when the event that last added the entry happened, e.g.
+	// when its container started, to measure how long the port mapping took
+	// to reach the host; it is zero if the source did not set it, see
+	// WithEventTime.
+	EventTime time.Time `json:"eventTime"`
+	// traceContext carries the span of the event of the change, that the
+	// spans of the tracker are the children of; it is not stored, see
+	// WithTraceContext.
+	traceContext context.Context
+	// seq is the sequence number of the change that last added the entry,
+	// see sequencer.
+	seq uint64
+}
+
+// EntryOption sets optional attributes of an entry when it is added.
+type EntryOption func(*Entry)
+
+// WithSource sets the subsystem that the port mapping originates from.
+func WithSource(source string) EntryOption {
+	return func(e *Entry) {
+		e.Source = source
+	}
+}
+
+// WithMetadata attaches arbitrary key/value pairs to the entry (for example,
+// a container name or a compose project), they are forwarded to the host
+// for each of the entry's host ports.
+func WithMetadata(metadata map[string]string) EntryOption {
+	return func(e *Entry) {
+		e.Metadata = copyMetadata(metadata)
+	}
+}
+
+// WithCorrelationID sets the ID that links the log lines and the payloads
+// of the change to the port mapping, see NewCorrelationID. When it is passed
+// to Remove, it identifies the removal rather than the entry's last addition.
+func WithCorrelationID(correlationID string) EntryOption {
+	return func(e *Entry) {
+		e.CorrelationID = correlationID
+	}
+}
+
+// WithEventTime sets the time of the event that the port mapping is added for,
+// e.g. when a container started or when a scan found the port. It should be a
+// reading of the monotonic clock, from time.Now or EventTime, so that the
+// latency that is measured from it does not jump with the wall clock.
+func WithEventTime(eventTime time.Time) EntryOption {
+	return func(e *Entry) {
+		e.EventTime = eventTime
+	}
+}
+
+// WithTraceContext sets the context of the span of the event that the port
+// mapping is added or removed for, e.g. a container start, so that the spans
+// of the tracker and of the forwarder are its children; see tracing.Start.
+func WithTraceContext(ctx context.Context) EntryOption {
+	return func(e *Entry) {
+		e.traceContext = ctx
+	}
+}
+
+// EventTime returns the time of an event that happened at the given wall
+// clock time, e.g. the time that the docker engine reports for an event, as a
+// reading of the monotonic clock: it is the current time less the time since
+// the event. An event that is not in the past, e.g. since the clocks are
+// skewed, or without a time, happened now.
+func EventTime(wallTime time.Time) time.Time {
+	now := time.Now()
+	if wallTime.IsZero() || !wallTime.Before(now) {
+		return now
+	}
+
+	return now.Add(-now.Sub(wallTime))
+}
+
+// NewCorrelationID returns a short random ID for a change to a port mapping,
+// which a source generates when it adds or removes the port mapping.
+func NewCorrelationID() string {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// withConnectAddrs records the backend addresses that
+// the entry is sent to the host with.
+func withConnectAddrs(connectAddrs []types.ConnectAddrs) EntryOption {
+	return func(e *Entry) {
+		e.ConnectAddrs = connectAddrs
+	}
+}
+
+// startSpan starts the span of an operation of the tracker on the entry, as a
+// child of the span of WithTraceContext, which the entry then forgets, or of
+// the span of the context otherwise; it does nothing unless tracing is enabled,
+// see tracing.SetTracer. The returned context carries the span, and it is
+// cancelled with the given one, whatever the parent of the span.
+func (e *Entry) startSpan(ctx context.Context, name string) (context.Context, *tracing.Span) {
+	parent := e.traceContext
+	if parent == nil {
+		parent = ctx
+	}
+
+	e.traceContext = nil
+
+	_, span := tracing.Start(parent, name,
+		tracing.String(tracing.AttrID, e.ID),
+		tracing.String(tracing.AttrSource, e.Source),
+		tracing.String(tracing.AttrCorrelationID, e.CorrelationID))
+
+	return tracing.ContextWithSpan(ctx, span), span
+}
+
+// newEntry returns an entry for the given port mapping with the options applied,
+// it is used to compare a port mapping against the stored entry before adding it.
+func newEntry(containerID string, portMap nat.PortMap, opts ...EntryOption) Entry {
+	entry := Entry{
+		ID:    containerID,
+		Ports: portMap,
+	}
+
+	for _, opt := range opts {
+		opt(&entry)
+	}
+
+	return entry
+}
+
+// hasPort returns true if any of the entry's port bindings
+// uses the given host port and protocol.
+func (e *Entry) hasPort(hostPort, protocol string) bool {
+	for port, bindings := range e.Ports {
+		if port.Proto() != protocol {
+			continue
+		}
+
+		for _, binding := range bindings {
+			if binding.HostPort == hostPort {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (e *Entry) copy() Entry {
+	entry := *e
+	entry.Ports = copyPortMap(e.Ports)
+	entry.ConnectAddrs = append([]types.ConnectAddrs(nil), e.ConnectAddrs...)
+	entry.Metadata = copyMetadata(e.Metadata)
+	entry.LikelyConflicts = copyMetadata(e.LikelyConflicts)
+
+	if e.Origin != nil {
+		origin := *e.Origin
+		entry.Origin = &origin
+	}
+
+	return entry
+}
+
+// mergeEntryPorts merges the port mappings of the given entries
+// into a single portMap, in the order of the entries.
+func mergeEntryPorts(entries []Entry) nat.PortMap {
+	portMap := make(nat.PortMap, len(entries))
+
+	for _, entry := range entries {
+		for port, bindings := range entry.Ports {
+			portMap[port] = append(portMap[port], bindings...)
+		}
+	}
+
+	return portMap
+}
+
+// bindingKey identifies a port binding that is registered on the host;
+// the same binding is only registered once for each source.
+func bindingKey(source string, port nat.Port, binding nat.PortBinding) string {
+	return source + "/" + string(port) + "/" + binding.HostIP + "/" + binding.HostPort
+}
+
+// hostBindingKey identifies a port binding on the host, regardless of its source.
+func hostBindingKey(port nat.Port, binding nat.PortBinding) string {
+	return binding.HostIP + ":" + binding.HostPort + "/" + port.Proto()
+}
+
+func bindingKeys(entries []Entry) map[string]struct{} {
+	keys := make(map[string]struct{})
+
+	for _, entry := range entries {
+		for port, bindings := range entry.Ports {
+			for _, binding := range bindings {
+				keys[bindingKey(entry.Source, port, binding)] = struct{}{}
+			}
+		}
+	}
+
+	return keys
+}
+
+// filterEntries returns copies of the entries that only hold the port bindings
+// with the given keys; a binding that is held by more than one entry is only
+// kept in the first one. Entries that are left without bindings are dropped.
+func filterEntries(entries []Entry, keys map[string]struct{}) []Entry {
+	// The maps and the slice are sized up front, a snapshot of 10k ports
+	// would otherwise grow them a dozen times.
+	seen := make(map[string]struct{}, len(keys))
+	filtered := make([]Entry, 0, len(entries))
+
+	for _, entry := range entries {
+		portMap := make(nat.PortMap, len(entry.Ports))
+
+		for port, bindings := range entry.Ports {
+			for _, binding := range bindings {
+				key := bindingKey(entry.Source, port, binding)
+				if _, ok := keys[key]; !ok {
+					continue
+				}
+
+				if _, ok := seen[key]; ok {
+					continue
+				}
+
+				seen[key] = struct{}{}
+				portMap[port] = append(portMap[port], binding)
+			}
+		}
+
+		if len(portMap) == 0 {
+			continue
+		}
+
+		entry.Ports = portMap
+		filtered = append(filtered, entry)
+	}
+
+	return filtered
+}
+
+// diffEntries compares the entries that the host holds with the entries that
+// it should hold, and returns the port bindings that need to be removed and
+// added, both sorted by ID. A binding that is held by several entries of the
+// same source is only registered once, and it is only removed along with the
+// last entry that holds it. The bindings of the entries whose metadata or
+// connect addresses changed are added again, and so are the bindings that
+// the host could not apply; those are never removed from the host, which
+// does not hold them.
+func diffEntries(before, after []Entry) ([]Entry, []Entry) {
+	beforeKeys := bindingKeys(before)
+	afterKeys := bindingKeys(after)
+
+	for _, entry := range before {
+		for port, bindings := range entry.Ports {
+			for _, binding := range bindings {
+				if _, ok := entry.HostConflicts[hostBindingKey(port, binding)]; ok {
+					delete(beforeKeys, bindingKey(entry.Source, port, binding))
+				}
+			}
+		}
+	}
+
+	removedKeys := make(map[string]struct{})
+
+	for key := range beforeKeys {
+		if _, ok := afterKeys[key]; !ok {
+			removedKeys[key] = struct{}{}
+		}
+	}
+
+	addedKeys := make(map[string]struct{})
+
+	for key := range afterKeys {
+		if _, ok := beforeKeys[key]; !ok {
+			addedKeys[key] = struct{}{}
+		}
+	}
+
+	previous := make(map[string]*Entry, len(before))
+	for i := range before {
+		previous[before[i].ID] = &before[i]
+	}
+
+	for i := range after {
+		old, ok := previous[after[i].ID]
+		if !ok {
+			continue
+		}
+
+		if !reflect.DeepEqual(old.Metadata, after[i].Metadata) ||
+			!reflect.DeepEqual(old.ConnectAddrs, after[i].ConnectAddrs) {
+			for key := range bindingKeys(after[i : i+1]) {
+				addedKeys[key] = struct{}{}
+			}
+		}
+	}
+
+	return filterEntries(before, removedKeys), filterEntries(after, addedKeys)
+}
+
+// replaceEntry returns a copy of the entries, sorted by ID, where the entry
+// with the given ID is replaced; it is dropped when replacement is nil.
+func replaceEntry(entries []Entry, containerID string, replacement *Entry) []Entry {
+	replaced := make([]Entry, 0, len(entries)+1)
+
+	for _, entry := range entries {
+		if entry.ID != containerID {
+			replaced = append(replaced, entry)
+		}
+	}
+
+	if replacement != nil {
+		replaced = append(replaced, *replacement)
+	}
+
+	sort.Slice(replaced, func(i, j int) bool {
+		return replaced[i].ID < replaced[j].ID
+	})
+
+	return replaced
+}
+
+// mergeEntryMetadata returns the metadata of the given entries keyed by
+// each of their host ports in the "port/protocol" form, or nil if none
+// of the entries have metadata.
+func mergeEntryMetadata(entries []Entry) map[string]map[string]string {
+	var metadata map[string]map[string]string
+
+	for _, entry := range entries {
+		if len(entry.Metadata) == 0 && entry.CorrelationID == "" {
+			continue
+		}
+
+		if metadata == nil {
+			metadata = make(map[string]map[string]string)
+		}
+
+		for port, bindings := range entry.Ports {
+			for _, binding := range bindings {
+				hostPortMetadata := copyMetadata(entry.Metadata)
+				if entry.CorrelationID != "" {
+					if hostPortMetadata == nil {
+						hostPortMetadata = make(map[string]string, 1)
+					}
+
+					hostPortMetadata[types.MetadataCorrelationID] = entry.CorrelationID
+				}
+
+				metadata[binding.HostPort+"/"+port.Proto()] = hostPortMetadata
+			}
+		}
+	}
+
+	return metadata
+}
+
+// withCorrelationIDs returns a copy of the entries with the correlation IDs
+// of the changes that they are part of, keyed by the entry ID; the entries
+// that are not listed keep their own.
+func withCorrelationIDs(entries []Entry, correlationIDs map[string]string) []Entry {
+	result := make([]Entry, len(entries))
+	copy(result, entries)
+
+	for i := range result {
+		if correlationID := correlationIDs[result[i].ID]; correlationID != "" {
+			result[i].CorrelationID = correlationID
+		}
+	}
+
+	return result
+}
+
+// entryCorrelationIDs returns the distinct correlation IDs of the entries in order, for the logs.
+func entryCorrelationIDs(entries []Entry) []string {
+	var (
+		correlationIDs []string
+		seen           = make(map[string]struct{})
+	)
+
+	for _, entry := range entries {
+		if _, ok := seen[entry.CorrelationID]; ok || entry.CorrelationID == "" {
+			continue
+		}
+
+		seen[entry.CorrelationID] = struct{}{}
+		correlationIDs = append(correlationIDs, entry.CorrelationID)
+	}
+
+	return correlationIDs
+}
+
+// mergeEntrySources returns the source of the entries' host ports, keyed like mergeEntryMetadata.
+func mergeEntrySources(entries []Entry) map[string]string {
+	var sources map[string]string
+
+	for _, entry := range entries {
+		if entry.Source == "" {
+			continue
+		}
+
+		if sources == nil {
+			sources = make(map[string]string)
+		}
+
+		for port, bindings := range entry.Ports {
+			for _, binding := range bindings {
+				sources[binding.HostPort+"/"+port.Proto()] = entry.Source
+			}
+		}
+	}
+
+	return sources
+}
+
+func copyMetadata(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+
+	metadata := make(map[string]string, len(m))
+	for k, v := range m {
+		metadata[k] = v
+	}
+
+	return metadata
+}
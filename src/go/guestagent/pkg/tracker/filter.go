@@ -0,0 +1,580 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+var ErrInvalidPortFilter = errors.New("invalid port filter")
+
+// portRange is the host ports within [first, last].
+type portRange struct {
+	first int
+	last  int
+}
+
+// sourceListener is the source that the blocked listeners are counted
+// and logged with, since the listeners are opened without one.
+const sourceListener = "listener"
+
+// PortFilter is the host ports that are allowed to be forwarded, an empty
+// filter allows all of them, and the ones that are never forwarded.
+type PortFilter struct {
+	ranges  []portRange
+	blocked []portRange
+}
+
+// ParsePortFilter parses the comma separated lists of the host ports and
+// port ranges that are allowed and that are blocked, e.g. "80,443,8000-8999"
+// and "22,53"; the blocked ports take precedence.
+func ParsePortFilter(allowed, blocked string) (*PortFilter, error) {
+	filter := &PortFilter{}
+
+	var err error
+
+	if filter.ranges, err = parsePortRanges(allowed); err != nil {
+		return nil, fmt.Errorf("allowed ports: %w", err)
+	}
+
+	if filter.blocked, err = parsePortRanges(blocked); err != nil {
+		return nil, fmt.Errorf("blocked ports: %w", err)
+	}
+
+	return filter, nil
+}
+
+// parsePortRanges parses a comma separated list of host ports and port ranges.
+func parsePortRanges(spec string) ([]portRange, error) {
+	var ranges []portRange
+
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		first, last, isRange := strings.Cut(field, "-")
+
+		var (
+			allowed portRange
+			err     error
+		)
+
+		if allowed.first, err = parsePort(first); err != nil {
+			return nil, fmt.Errorf("%w: %q: %w", ErrInvalidPortFilter, field, err)
+		}
+
+		allowed.last = allowed.first
+		if isRange {
+			if allowed.last, err = parsePort(last); err != nil {
+				return nil, fmt.Errorf("%w: %q: %w", ErrInvalidPortFilter, field, err)
+			}
+		}
+
+		if allowed.last < allowed.first {
+			return nil, fmt.Errorf("%w: %q has an empty range", ErrInvalidPortFilter, field)
+		}
+
+		ranges = append(ranges, allowed)
+	}
+
+	return ranges, nil
+}
+
+// Allows returns true if the host port may be forwarded.
+func (f *PortFilter) Allows(hostPort string) bool {
+	if f.Blocks(hostPort) {
+		return false
+	}
+
+	if len(f.ranges) == 0 {
+		return true
+	}
+
+	return inRanges(f.ranges, hostPort)
+}
+
+// Blocks returns true if the host port is never forwarded, regardless of the allowed ports.
+func (f *PortFilter) Blocks(hostPort string) bool {
+	return inRanges(f.blocked, hostPort)
+}
+
+// inRanges returns true if the port is within one of the ranges.
+func inRanges(ranges []portRange, hostPort string) bool {
+	port, err := strconv.Atoi(hostPort)
+	if err != nil {
+		return false
+	}
+
+	for _, r := range ranges {
+		if port >= r.first && port <= r.last {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reservedBy returns the reserved ports that the host port of the protocol is within, if any.
+func reservedBy(reserved []types.ReservedPorts, hostPort, protocol string) (types.ReservedPorts, bool) {
+	port, err := strconv.Atoi(hostPort)
+	if err != nil {
+		return types.ReservedPorts{}, false
+	}
+
+	for _, r := range reserved {
+		last := max(r.Last, r.First)
+		if port >= r.First && port <= last && (r.Protocol == "" || strings.EqualFold(r.Protocol, protocol)) {
+			return r, true
+		}
+	}
+
+	return types.ReservedPorts{}, false
+}
+
+// validReserved returns the reserved ports whose range is valid, the others are logged and ignored.
+func validReserved(reserved []types.ReservedPorts) []types.ReservedPorts {
+	valid := make([]types.ReservedPorts, 0, len(reserved))
+
+	for _, r := range reserved {
+		if r.First < 1 || r.First > maxPort || r.Last > maxPort || (r.Last != 0 && r.Last < r.First) {
+			logger.Warnf("ignoring the invalid range of reserved host ports %d-%d", r.First, r.Last)
+
+			continue
+		}
+
+		valid = append(valid, r)
+	}
+
+	return valid
+}
+
+// filteredEntry is a port mapping as it was added to the FilterTracker, before it was filtered.
+type filteredEntry struct {
+	portMap nat.PortMap
+	opts    []EntryOption
+}
+
+// filteredListener is a listener as it was added to the FilterTracker, with
+// the origin of its context to open it again with.
+type filteredListener struct {
+	ListenerAddr
+	origin Origin
+}
+
+// FilterTracker drops the port bindings whose host port the PortFilter does
+// not allow, or that the host reported to be reserved, before they reach the
+// underlying tracker, and does not open the listeners on those ports. The
+// filter can be changed while the agent runs, see SetFilter, and so can the
+// reserved ports, see SetReserved. The port bindings on the well-known ports
+// of the host are forwarded with a warning, see SetWellKnown.
+type FilterTracker struct {
+	Tracker
+	filter *PortFilter
+	// reserved are the host ports that the host reported to be reserved.
+	reserved []types.ReservedPorts
+	// entries are the port mappings as they were added, to apply the new filters to.
+	entries map[string]filteredEntry
+	// listeners are the listeners as they were added, keyed by their address.
+	listeners map[string]filteredListener
+	// entriesPeak and listenersPeak are their peak sizes, see deleteCompacted.
+	entriesPeak   int
+	listenersPeak int
+	// blocked are the blocked attempts by source, and reported are the
+	// blocked ports of each source that were already logged.
+	blocked  map[string]uint64
+	reported map[string]struct{}
+	// warned are the reserved ports of each source that were already logged.
+	warned map[string]struct{}
+	// wellKnown are the host ports that a service of the host usually holds,
+	// and cautioned are the ones of each source that were already logged.
+	wellKnown []types.ReservedPorts
+	cautioned map[string]struct{}
+	// changes counts the port bindings that are blocked, see SetChangeCounter.
+	changes *ChangeCounter
+	// mutex serializes the filter changes with the changes to the tracker.
+	mutex sync.Mutex
+}
+
+// NewFilterTracker wraps the given tracker to only forward the host ports that the filter allows.
+func NewFilterTracker(tracker Tracker, filter *PortFilter) *FilterTracker {
+	return &FilterTracker{
+		Tracker:   tracker,
+		filter:    filter,
+		entries:   make(map[string]filteredEntry),
+		listeners: make(map[string]filteredListener),
+		blocked:   make(map[string]uint64),
+		reported:  make(map[string]struct{}),
+		warned:    make(map[string]struct{}),
+		cautioned: make(map[string]struct{}),
+	}
+}
+
+// Add adds the port bindings of the port mapping that the filter allows to the
+// underlying tracker, the entry is removed if the filter allows none of them.
+func (f *FilterTracker) Add(ctx context.Context, containerID string, portMap nat.PortMap, opts ...EntryOption) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// The port mappings that a new filter reapplies are not part of the trace of their event.
+	f.entries[containerID] = filteredEntry{portMap: portMap, opts: append(opts[:len(opts):len(opts)], WithTraceContext(context.Background()))}
+
+	return f.apply(ctx, containerID, portMap, opts, true)
+}
+
+// Remove removes the entry from the underlying tracker.
+func (f *FilterTracker) Remove(ctx context.Context, containerID string, opts ...EntryOption) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.entries = deleteCompacted(f.entries, containerID, &f.entriesPeak)
+
+	return f.Tracker.Remove(ctx, containerID, opts...)
+}
+
+// RemoveAll removes all the entries from the underlying tracker.
+func (f *FilterTracker) RemoveAll(ctx context.Context) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// The map is recreated, since clearing it would keep its size.
+	f.entries = make(map[string]filteredEntry)
+	f.entriesPeak = 0
+
+	return f.Tracker.RemoveAll(ctx)
+}
+
+// SetChangeCounter sets the counter of the port bindings of the added port
+// mappings that are blocked, or reserved on the host.
+func (f *FilterTracker) SetChangeCounter(changes *ChangeCounter) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.changes = changes
+}
+
+// SetWellKnown sets the host ports that a service of the host usually holds,
+// e.g. SMB on 445 on Windows, see ParseWellKnownPorts. The port bindings of
+// the port mappings that are added on them are still forwarded, unless they
+// are blocked or reserved, but with a warning, and the entry reports them as
+// its LikelyConflicts.
+func (f *FilterTracker) SetWellKnown(wellKnown []types.ReservedPorts) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.wellKnown = wellKnown
+}
+
+// AddListener opens the listener with the underlying tracker, unless its port is blocked or reserved.
+// The listener is opened without holding the mutex, so that the subsystems do
+// not wait for the listeners of one another; see ListenerTracker.
+func (f *FilterTracker) AddListener(ctx context.Context, ip net.IP, port int) error {
+	f.mutex.Lock()
+	f.listeners[ipPortToAddr(ip, port)] = filteredListener{
+		ListenerAddr: ListenerAddr{IP: ip, Port: port},
+		origin:       OriginFromContext(ctx),
+	}
+
+	if f.filter.Blocks(strconv.Itoa(port)) {
+		f.block(sourceListener, ip.String(), strconv.Itoa(port), "tcp")
+		f.mutex.Unlock()
+
+		return nil
+	}
+
+	if reserved, ok := reservedBy(f.reserved, strconv.Itoa(port), "tcp"); ok {
+		f.warnReserved(sourceListener, ip.String(), strconv.Itoa(port), "tcp", reserved.Owner)
+		f.mutex.Unlock()
+
+		return nil
+	}
+	f.mutex.Unlock()
+
+	return f.Tracker.AddListener(ctx, ip, port)
+}
+
+// RemoveListener closes the listener with the underlying tracker.
+func (f *FilterTracker) RemoveListener(ctx context.Context, ip net.IP, port int) error {
+	f.mutex.Lock()
+	f.listeners = deleteCompacted(f.listeners, ipPortToAddr(ip, port), &f.listenersPeak)
+	f.mutex.Unlock()
+
+	return f.Tracker.RemoveListener(ctx, ip, port)
+}
+
+// Allows returns true if the current filter allows the host port to be forwarded.
+func (f *FilterTracker) Allows(hostPort string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.filter.Allows(hostPort)
+}
+
+// Requested returns true if the port mapping was added, whatever the filter
+// let through of it, e.g. none of its port bindings; see DriftChecker.
+func (f *FilterTracker) Requested(containerID string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, ok := f.entries[containerID]
+
+	return ok
+}
+
+// RequestedListener returns true if the listener at the address was added,
+// whether the filter let it be opened or not; see DriftChecker.
+func (f *FilterTracker) RequestedListener(addr string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, ok := f.listeners[addr]
+
+	return ok
+}
+
+// SetFilter replaces the filter, and applies it to the port mappings that
+// were added: the port bindings that it no longer allows are withdrawn,
+// and the ones that it now allows are added. The listeners on the ports that
+// it now blocks are closed, and the ones on the ports that it no longer blocks
+// are opened. The filter is applied to all of them even if some fail.
+func (f *FilterTracker) SetFilter(filter *PortFilter) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	previous := f.filter
+	f.filter = filter
+
+	return f.reapply(previous, f.reserved)
+}
+
+// SetReserved replaces the host ports that the host reported to be reserved,
+// and applies them like SetFilter: the port bindings and the listeners on
+// the ports that are now reserved are withdrawn with a warning, and the ones
+// on the ports that are no longer reserved are forwarded. The ranges that
+// are not valid are ignored.
+func (f *FilterTracker) SetReserved(reserved []types.ReservedPorts) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	previous := f.reserved
+	f.reserved = validReserved(reserved)
+
+	// The ports that are still reserved are logged again, since their owner may have changed.
+	clear(f.warned)
+
+	return f.reapply(f.filter, previous)
+}
+
+// reapply applies the current filter and reserved ports to the port mappings
+// and the listeners that were added with the previous ones, see SetFilter.
+func (f *FilterTracker) reapply(previous *PortFilter, previousReserved []types.ReservedPorts) error {
+	var errs []error
+
+	for containerID, entry := range f.entries {
+		filtered, _ := f.filtered(containerID, entry.portMap, entry.opts, false)
+		if maps.EqualFunc(filtered, f.Tracker.Get(containerID), slices.Equal[[]nat.PortBinding]) {
+			continue
+		}
+
+		if err := f.apply(context.Background(), containerID, entry.portMap, entry.opts, false); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, listener := range f.listeners {
+		port := strconv.Itoa(listener.Port)
+
+		var err error
+
+		wasBlocked := previous.Blocks(port) || isReserved(previousReserved, port)
+		blocked := f.filter.Blocks(port) || isReserved(f.reserved, port)
+
+		switch {
+		case blocked && !wasBlocked:
+			if reserved, ok := reservedBy(f.reserved, port, "tcp"); ok {
+				f.warnReserved(sourceListener, listener.IP.String(), port, "tcp", reserved.Owner)
+			}
+
+			err = f.Tracker.RemoveListener(context.Background(), listener.IP, listener.Port)
+		case wasBlocked && !blocked:
+			err = f.Tracker.AddListener(ContextWithOrigin(context.Background(), listener.origin), listener.IP, listener.Port)
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := flush(f.Tracker); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Flush sends the pending changes of the underlying tracker, if it defers them.
+func (f *FilterTracker) Flush() error {
+	return flush(f.Tracker)
+}
+
+// apply adds the port bindings that the filter allows to the underlying tracker,
+// the blocked ones are counted if the port mapping is being added.
+func (f *FilterTracker) apply(ctx context.Context, containerID string, portMap nat.PortMap, opts []EntryOption, adding bool) error {
+	filtered, likelyConflicts := f.filtered(containerID, portMap, opts, adding)
+	if len(filtered) == 0 && len(portMap) != 0 {
+		if f.Tracker.Get(containerID) == nil {
+			return nil
+		}
+
+		return f.Tracker.Remove(ctx, containerID, opts...)
+	}
+
+	return f.Tracker.Add(ctx, containerID, filtered, append(opts[:len(opts):len(opts)], withLikelyConflicts(likelyConflicts))...)
+}
+
+// filtered returns the port bindings of the port mapping that the filter allows, and that are not reserved,
+// along with the services that likely hold the ones on the well-known ports, keyed like Entry.LikelyConflicts.
+func (f *FilterTracker) filtered(
+	containerID string,
+	portMap nat.PortMap,
+	opts []EntryOption,
+	adding bool,
+) (nat.PortMap, map[string]string) {
+	filtered := make(nat.PortMap, len(portMap))
+	source := newEntry(containerID, nil, opts...).Source
+
+	var likelyConflicts map[string]string
+
+	for port, bindings := range portMap {
+		if bindings == nil {
+			filtered[port] = nil
+
+			continue
+		}
+
+		allowed := make([]nat.PortBinding, 0, len(bindings))
+
+		for _, binding := range bindings {
+			if f.filter.Blocks(binding.HostPort) {
+				if adding {
+					f.block(source, binding.HostIP, binding.HostPort, port.Proto())
+					f.changes.Count(source, ActionAdd, ChangeBlocked)
+				}
+
+				continue
+			}
+
+			if reserved, ok := reservedBy(f.reserved, binding.HostPort, port.Proto()); ok {
+				f.warnReserved(source, binding.HostIP, binding.HostPort, port.Proto(), reserved.Owner)
+
+				if adding {
+					f.changes.Count(source, ActionAdd, ChangeBlocked)
+				}
+
+				continue
+			}
+
+			if !f.filter.Allows(binding.HostPort) {
+				logger.Debugw("not forwarding the host port, it is not allowed", logging.Fields(
+					logging.Port(binding.HostPort),
+					logging.Protocol(port.Proto()),
+					logging.Source(source),
+					logging.ID(containerID),
+				))
+
+				continue
+			}
+
+			if service, ok := f.likelyConflict(source, port, binding); ok {
+				if likelyConflicts == nil {
+					likelyConflicts = make(map[string]string)
+				}
+
+				likelyConflicts[hostBindingKey(port, binding)] = service
+			}
+
+			allowed = append(allowed, binding)
+		}
+
+		if len(allowed) != 0 {
+			filtered[port] = allowed
+		}
+	}
+
+	return filtered, likelyConflicts
+}
+
+// block counts a blocked attempt of the source to forward the host port,
+// and logs it the first time for each port of the source.
+func (f *FilterTracker) block(source, hostIP, hostPort, protocol string) {
+	f.blocked[source]++
+
+	key := source + "/" + hostPort + "/" + protocol
+	if _, ok := f.reported[key]; ok {
+		return
+	}
+
+	f.reported[key] = struct{}{}
+
+	logger.Infow("not forwarding the host port, it is blocked", logging.Fields(
+		logging.Port(hostPort),
+		logging.Protocol(protocol),
+		logging.HostIP(hostIP),
+		logging.Source(source),
+	))
+}
+
+// isReserved returns true if the listener port is reserved.
+func isReserved(reserved []types.ReservedPorts, port string) bool {
+	_, ok := reservedBy(reserved, port, "tcp")
+
+	return ok
+}
+
+// warnReserved logs that the host port of the source is not forwarded since
+// the host reserved it, once for each port of the source; naming what holds
+// it on the host, if the host reported it.
+func (f *FilterTracker) warnReserved(source, hostIP, hostPort, protocol, owner string) {
+	key := source + "/" + hostPort + "/" + protocol
+	if _, ok := f.warned[key]; ok {
+		return
+	}
+
+	f.warned[key] = struct{}{}
+
+	fields := logging.Fields(
+		logging.Port(hostPort),
+		logging.Protocol(protocol),
+		logging.HostIP(hostIP),
+		logging.Source(source),
+	)
+	if owner != "" {
+		fields["owner"] = owner
+	}
+
+	logger.Warnw("not forwarding the host port, it is reserved on the host", fields)
+}
@@ -0,0 +1,257 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParsePortFilter(t *testing.T, allowed, blocked string) *tracker.PortFilter {
+	t.Helper()
+
+	filter, err := tracker.ParsePortFilter(allowed, blocked)
+	require.NoError(t, err)
+
+	return filter
+}
+
+func TestParsePortFilter(t *testing.T) {
+	t.Parallel()
+
+	filter := mustParsePortFilter(t, "80, 443,8000-8999", "")
+	for port, allowed := range map[string]bool{
+		"80":   true,
+		"443":  true,
+		"8000": true,
+		"8999": true,
+		"81":   false,
+		"9000": false,
+		"http": false,
+	} {
+		assert.Equal(t, allowed, filter.Allows(port), port)
+	}
+
+	assert.True(t, mustParsePortFilter(t, "", "").Allows("22"))
+
+	for _, spec := range []string{"http", "0", "65536", "90-80", "80-"} {
+		_, err := tracker.ParsePortFilter(spec, "")
+		require.ErrorIs(t, err, tracker.ErrInvalidPortFilter, spec)
+
+		_, err = tracker.ParsePortFilter("", spec)
+		require.ErrorIs(t, err, tracker.ErrInvalidPortFilter, spec)
+		assert.ErrorContains(t, err, "blocked ports", spec)
+	}
+
+	// The blocked ports take precedence over the allowed ones.
+	filter = mustParsePortFilter(t, "1-1024", "22,53,6000-6010")
+	for port, allowed := range map[string]bool{
+		"80":   true,
+		"22":   false,
+		"53":   false,
+		"6005": false,
+		"8080": false,
+	} {
+		assert.Equal(t, allowed, filter.Allows(port), port)
+	}
+
+	assert.True(t, filter.Blocks("22"))
+	assert.False(t, filter.Blocks("8080"))
+	assert.False(t, mustParsePortFilter(t, "", "22").Allows("22"))
+	assert.True(t, mustParsePortFilter(t, "", "22").Allows("2222"))
+}
+
+func TestFilterTracker(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	filterTracker := tracker.NewFilterTracker(tracker.NewVTunnelTracker(&forwarder, wslConnectAddr),
+		mustParsePortFilter(t, "80,443,8000-8999", ""))
+
+	portMapping := func(ports ...int) nat.PortMap {
+		portMap := make(nat.PortMap)
+		for _, port := range ports {
+			portMap[nat.Port(strconv.Itoa(port)+"/tcp")] = []nat.PortBinding{
+				{
+					HostIP:   hostIP,
+					HostPort: strconv.Itoa(port),
+				},
+			}
+		}
+
+		return portMap
+	}
+
+	// The ports that are not allowed are dropped, the entry is not added if none is.
+	require.NoError(t, filterTracker.Add(context.Background(), containerID, portMapping(80, 22, 8080)))
+	require.NoError(t, filterTracker.Add(context.Background(), containerID2, portMapping(3306)))
+	assert.Equal(t, portMapping(80, 8080), filterTracker.Get(containerID))
+	assert.Nil(t, filterTracker.Get(containerID2))
+	assert.Len(t, forwarder.received(), 1)
+
+	// Tightening the filter withdraws the ports that it no longer allows.
+	require.NoError(t, filterTracker.SetFilter(mustParsePortFilter(t, "80-99", "")))
+	assert.Equal(t, portMapping(80), filterTracker.Get(containerID))
+	assert.True(t, filterTracker.Allows("80"))
+	assert.False(t, filterTracker.Allows("8080"))
+
+	received := forwarder.received()
+	require.Len(t, received, 2)
+	assert.True(t, received[1].Remove)
+	assert.Equal(t, portMapping(8080), received[1].Ports)
+
+	// Loosening it forwards the ports that it now allows.
+	require.NoError(t, filterTracker.SetFilter(mustParsePortFilter(t, "", "")))
+	assert.Equal(t, portMapping(80, 22, 8080), filterTracker.Get(containerID))
+	assert.Equal(t, portMapping(3306), filterTracker.Get(containerID2))
+	assert.Len(t, forwarder.received(), 4)
+
+	// A filter that allows none of the ports of an entry removes it.
+	require.NoError(t, filterTracker.SetFilter(mustParsePortFilter(t, "3306", "")))
+	assert.Nil(t, filterTracker.Get(containerID))
+	assert.Equal(t, portMapping(3306), filterTracker.Get(containerID2))
+
+	// The removed entries are not added back by the later filters.
+	require.NoError(t, filterTracker.Remove(context.Background(), containerID2))
+	require.NoError(t, filterTracker.SetFilter(mustParsePortFilter(t, "", "")))
+	assert.Nil(t, filterTracker.Get(containerID2))
+	assert.Equal(t, portMapping(80, 22, 8080), filterTracker.Get(containerID))
+}
+
+func TestFilterTrackerBlockedPorts(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableDryRun()
+	filterTracker := tracker.NewFilterTracker(vtunnelTracker, mustParsePortFilter(t, "", "22,53"))
+
+	binding := func(port string) nat.PortMap {
+		return nat.PortMap{nat.Port(port + "/tcp"): []nat.PortBinding{{HostIP: hostIP, HostPort: port}}}
+	}
+
+	// The blocked ports of every source are dropped, and so are the listeners on them.
+	require.NoError(t, filterTracker.Add(context.Background(), "docker", binding("22"), tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, filterTracker.Add(context.Background(), "kubernetes", binding("53"), tracker.WithSource(tracker.SourceKubernetes)))
+	require.NoError(t, filterTracker.Add(context.Background(), "manual/tcp/22", binding("22"), tracker.WithSource(tracker.SourceManual)))
+	require.NoError(t, filterTracker.Add(context.Background(), "web", binding("8080"), tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, filterTracker.AddListener(ctx, net.IPv4zero, 53))
+	require.NoError(t, filterTracker.AddListener(ctx, net.IPv4zero, 8080))
+
+	for _, id := range []string{"docker", "kubernetes", "manual/tcp/22"} {
+		assert.Nil(t, filterTracker.Get(id), id)
+	}
+
+	received := forwarder.received()
+	require.Len(t, received, 1)
+	assert.Equal(t, binding("8080"), received[0].Ports)
+	assert.Equal(t, []string{"0.0.0.0:8080"}, vtunnelTracker.Listeners())
+	assert.False(t, filterTracker.Allows("22"))
+
+	// The attempts are counted every time, by source.
+	require.NoError(t, filterTracker.Add(context.Background(), "docker", binding("22"), tracker.WithSource(tracker.SourceDocker)))
+
+	registry := metrics.NewRegistry()
+	registry.Register(filterTracker)
+
+	var output strings.Builder
+
+	require.NoError(t, registry.Write(&output))
+	assert.Contains(t, output.String(), "\nrd_guestagent_blocked_ports_total{source=\"docker\"} 2\n")
+	assert.Contains(t, output.String(), "\nrd_guestagent_blocked_ports_total{source=\"kubernetes\"} 1\n")
+	assert.Contains(t, output.String(), "\nrd_guestagent_blocked_ports_total{source=\"manual\"} 1\n")
+	assert.Contains(t, output.String(), "\nrd_guestagent_blocked_ports_total{source=\"listener\"} 1\n")
+
+	// Unblocking the ports forwards them, and opens their listeners.
+	require.NoError(t, filterTracker.SetFilter(mustParsePortFilter(t, "", "")))
+	assert.Equal(t, binding("22"), filterTracker.Get("docker"))
+	assert.Equal(t, binding("53"), filterTracker.Get("kubernetes"))
+	assert.Equal(t, []string{"0.0.0.0:53", "0.0.0.0:8080"}, vtunnelTracker.Listeners())
+
+	// Blocking them again withdraws them, and closes their listeners.
+	require.NoError(t, filterTracker.SetFilter(mustParsePortFilter(t, "", "53")))
+	assert.Equal(t, binding("22"), filterTracker.Get("docker"))
+	assert.Nil(t, filterTracker.Get("kubernetes"))
+	assert.Equal(t, []string{"0.0.0.0:8080"}, vtunnelTracker.Listeners())
+
+	// The listeners that were removed are not opened by the later filters.
+	require.NoError(t, filterTracker.RemoveListener(ctx, net.IPv4zero, 53))
+	require.NoError(t, filterTracker.SetFilter(mustParsePortFilter(t, "", "")))
+	assert.Equal(t, []string{"0.0.0.0:8080"}, vtunnelTracker.Listeners())
+}
+
+func TestFilterTrackerReservedPorts(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableDryRun()
+	filterTracker := tracker.NewFilterTracker(vtunnelTracker, mustParsePortFilter(t, "", ""))
+
+	binding := func(port, protocol string) nat.PortMap {
+		return nat.PortMap{nat.Port(port + "/" + protocol): []nat.PortBinding{{HostIP: hostIP, HostPort: port}}}
+	}
+
+	require.NoError(t, filterTracker.Add(context.Background(), "range", binding("50010", "tcp"), tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, filterTracker.Add(context.Background(), "web", binding("8080", "tcp"), tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, filterTracker.Add(context.Background(), "dns", binding("8080", "udp"), tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, filterTracker.AddListener(ctx, net.IPv4zero, 50020))
+
+	// The reserved ports that are forwarded are withdrawn, the invalid ranges are ignored.
+	require.NoError(t, filterTracker.SetReserved([]types.ReservedPorts{
+		{First: 50000, Last: 50059, Owner: "Hyper-V excluded port range"},
+		{First: 8080, Protocol: "tcp"},
+		{First: 9000, Last: 8000},
+		{First: 70000},
+	}))
+	assert.Nil(t, filterTracker.Get("range"))
+	assert.Nil(t, filterTracker.Get("web"))
+	assert.Equal(t, binding("8080", "udp"), filterTracker.Get("dns"))
+	assert.Empty(t, vtunnelTracker.Listeners())
+
+	// The port mappings and the listeners that are added later are skipped too.
+	require.NoError(t, filterTracker.Add(context.Background(), "other", binding("50030", "udp"), tracker.WithSource(tracker.SourceKubernetes)))
+	require.NoError(t, filterTracker.AddListener(ctx, net.IPv4zero, 50040))
+	require.NoError(t, filterTracker.AddListener(ctx, net.IPv4zero, 9500))
+	assert.Nil(t, filterTracker.Get("other"))
+	assert.Equal(t, []string{"0.0.0.0:9500"}, vtunnelTracker.Listeners())
+
+	// The refreshed list forwards the ports that are no longer reserved.
+	require.NoError(t, filterTracker.SetReserved([]types.ReservedPorts{{First: 8080}}))
+	assert.Equal(t, binding("50010", "tcp"), filterTracker.Get("range"))
+	assert.Equal(t, binding("50030", "udp"), filterTracker.Get("other"))
+	assert.Nil(t, filterTracker.Get("web"))
+	assert.Nil(t, filterTracker.Get("dns"))
+	assert.Equal(t, []string{"0.0.0.0:50020", "0.0.0.0:50040", "0.0.0.0:9500"}, vtunnelTracker.Listeners())
+
+	// Without a list, all the ports are forwarded again.
+	require.NoError(t, filterTracker.SetReserved(nil))
+	assert.Equal(t, binding("8080", "tcp"), filterTracker.Get("web"))
+	assert.Equal(t, binding("8080", "udp"), filterTracker.Get("dns"))
+}
@@ -0,0 +1,132 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/resume"
+)
+
+// gcChecksPerTTL is the number of garbage collection runs within a ttl.
+const gcChecksPerTTL = 2
+
+// CollectGarbage removes the leased entries that have not been refreshed
+// within the given ttl. Entries from sources that never call Refresh are not
+// leased, and therefore they are never collected.
+func CollectGarbage(ctx context.Context, tracker Tracker, ttl time.Duration) error {
+	return collectGarbage(ctx, tracker, ttl, time.Now(), time.Time{})
+}
+
+// collectGarbage removes the leased entries that have not been refreshed
+// within the ttl before now, or since resumed, if they were refreshed
+// before it.
+func collectGarbage(ctx context.Context, tracker Tracker, ttl time.Duration, now, resumed time.Time) error {
+	var errs []error
+
+	for _, entry := range tracker.List() {
+		refreshed := entry.Refreshed
+		if refreshed.Before(resumed) {
+			refreshed = resumed
+		}
+
+		if !entry.Leased || now.Sub(refreshed) < ttl {
+			continue
+		}
+
+		logger.Warnw("removing orphaned port mapping that was not refreshed", logging.Fields(
+			logging.ID(entry.ID),
+			logging.Source(entry.Source),
+			log.Fields{"ports": entry.Ports, "refreshed": entry.Refreshed},
+		))
+
+		if err := tracker.Remove(ctx, entry.ID); err != nil {
+			errs = append(errs, fmt.Errorf("removing orphaned entry %s failed: %w", entry.ID, err))
+		}
+	}
+
+	if len(errs) != 0 {
+		return fmt.Errorf("garbage collection failed: %+v", errs)
+	}
+
+	return nil
+}
+
+// GarbageCollector collects the leased entries periodically, see Collect.
+type GarbageCollector struct {
+	tracker Tracker
+	ttl     time.Duration
+	// Awake is the clock of the collections, see resume.Awake.
+	Awake *resume.Awake
+	// resumed is when the clock last jumped.
+	resumed time.Time
+}
+
+// NewGarbageCollector returns the collector of the leased entries of the
+// tracker, which collects them a few times within every ttl.
+func NewGarbageCollector(tracker Tracker, ttl time.Duration) *GarbageCollector {
+	return &GarbageCollector{
+		tracker: tracker,
+		ttl:     ttl,
+		Awake:   resume.NewAwake(ttl / gcChecksPerTTL),
+	}
+}
+
+// Collect removes the leased entries that have not been refreshed within the
+// ttl, like CollectGarbage. Once the clock jumped since the last collection,
+// e.g. since the VM was paused while the host slept, the entries are given the
+// ttl from then on to be refreshed, rather than all of them being removed at
+// once before their sources could refresh them.
+func (g *GarbageCollector) Collect(ctx context.Context) error {
+	now := g.Awake.Now()
+
+	if g.Awake.Observe() {
+		logger.Infof("the clock jumped since the last garbage collection, the leases are extended by %s", g.ttl)
+
+		g.resumed = now
+	}
+
+	return collectGarbage(ctx, g.tracker, g.ttl, now, g.resumed)
+}
+
+// Run collects the leased entries a few times within every ttl until the
+// context is cancelled.
+func (g *GarbageCollector) Run(ctx context.Context) {
+	ticker := time.NewTicker(g.ttl / gcChecksPerTTL)
+	defer ticker.Stop()
+
+	// The clock jumps are measured from the start.
+	g.Awake.Observe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := g.Collect(ctx); err != nil {
+				logger.Errorf("%v", err)
+			}
+		}
+	}
+}
+
+// CollectGarbagePeriodically calls CollectGarbage a few times within
+// every ttl interval until the context is cancelled, see GarbageCollector.
+func CollectGarbagePeriodically(ctx context.Context, tracker Tracker, ttl time.Duration) {
+	NewGarbageCollector(tracker, ttl).Run(ctx)
+}
@@ -0,0 +1,125 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithSource(tracker.SourceDocker)))
+	require.True(t, vtunnelTracker.Refresh(containerID))
+
+	// The second source never refreshes its entries, so it should be exempt
+	portMapping2 := nat.PortMap{
+		"443/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP2,
+				HostPort: hostPort2,
+			},
+		},
+	}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, portMapping2, tracker.WithSource(tracker.SourceKubernetes)))
+	assert.False(t, vtunnelTracker.Refresh("unknown"))
+
+	ttl := 20 * time.Millisecond
+
+	// Entries that are still refreshed are not collected
+	require.NoError(t, tracker.CollectGarbage(context.Background(), vtunnelTracker, ttl))
+	assert.Len(t, vtunnelTracker.List(), 2)
+
+	// The first source stops refreshing
+	time.Sleep(2 * ttl)
+
+	require.NoError(t, tracker.CollectGarbage(context.Background(), vtunnelTracker, ttl))
+	assert.Nil(t, vtunnelTracker.Get(containerID))
+	assert.Equal(t, portMapping2, vtunnelTracker.Get(containerID2))
+
+	received := forwarder.received()
+	require.Len(t, received, 3)
+	assert.Equal(t, types.PortMapping{
+		Remove:        true,
+		Ports:         portMapping,
+		ConnectAddrs:  wslConnectAddr,
+		Protocols:     types.PortProtocols(portMapping),
+		HostBindAddrs: types.PortHostBindAddrs(portMapping),
+		Sources:       map[string]string{"80/tcp": tracker.SourceDocker},
+	}, received[2])
+}
+
+func TestGarbageCollectorClockJump(t *testing.T) {
+	t.Parallel()
+
+	const (
+		ttl     = time.Minute
+		entries = 100
+	)
+
+	vtunnelTracker := tracker.NewVTunnelTracker(&testForwarder{}, nil)
+
+	for i := 0; i < entries; i++ {
+		require.NoError(t, vtunnelTracker.Add(context.Background(), containerID+strconv.Itoa(i), testPortMap(8000+i),
+			tracker.WithSource(tracker.SourceDocker)))
+		require.True(t, vtunnelTracker.Refresh(containerID+strconv.Itoa(i)))
+	}
+
+	// The entries that are not leased are never collected.
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, testPortMap(9000), tracker.WithSource(tracker.SourceKubernetes)))
+
+	var jump time.Duration
+
+	collector := tracker.NewGarbageCollector(vtunnelTracker, ttl)
+	collector.Awake.Now = func() time.Time { return time.Now().Add(jump) }
+	require.NoError(t, collector.Collect(context.Background()))
+
+	// The clock jumps 2 hours ahead, like it does once the VM was paused
+	// while the host slept: the leases are extended rather than all of the
+	// entries being collected at once, before their sources could refresh them.
+	jump = 2 * time.Hour
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.Len(t, vtunnelTracker.List(), entries+1)
+
+	jump += ttl / 2
+	require.NoError(t, collector.Collect(context.Background()))
+	assert.Len(t, vtunnelTracker.List(), entries+1)
+
+	// The entries that were not refreshed within the ttl since are collected.
+	jump += ttl / 2
+	require.NoError(t, collector.Collect(context.Background()))
+	require.Len(t, vtunnelTracker.List(), 1)
+	assert.Equal(t, containerID2, vtunnelTracker.List()[0].ID)
+}
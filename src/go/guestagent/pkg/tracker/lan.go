@@ -0,0 +1,33 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+// LANPolicy is what the VTunnelTracker does with the port mappings while the
+// VM is only reached at the addresses on the LAN, e.g. with the bridged
+// networking of WSL, where the LAN may reach the ports as well.
+type LANPolicy string
+
+const (
+	// LANForward forwards the port mappings like the others.
+	LANForward LANPolicy = "forward"
+	// LANReport only reports the port mappings to the privileged service,
+	// flagged as report only, see types.PortMapping.ReportOnly.
+	LANReport LANPolicy = "report"
+	// LANSkip sends none of the port mappings, the ones that were forwarded
+	// before are withdrawn by the next snapshot.
+	LANSkip LANPolicy = "skip"
+)
+
+// LANPolicies are the LAN policies.
+var LANPolicies = []LANPolicy{LANForward, LANReport, LANSkip}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+)
+
+// LatencyBufferSize is the number of events that are held while their
+// latencies are measured, the ones that do not fit are not measured.
+const LatencyBufferSize = 256
+
+// recentLatencies is the number of the latest latencies that Worst picks from.
+const recentLatencies = 100
+
+// Latency is how long a port binding took from the event that it was added
+// for, e.g. a container that started, to reach the host.
+type Latency struct {
+	ID       string        `json:"id"`
+	Source   string        `json:"source,omitempty"`
+	Port     string        `json:"port"`
+	Protocol string        `json:"protocol"`
+	Latency  time.Duration `json:"latency"`
+	// Timestamp is when the port binding reached the host.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// latencyHistogram counts the latencies within the buckets of forwarder.LatencyBuckets.
+type latencyHistogram struct {
+	counts []uint64
+	sum    time.Duration
+}
+
+// LatencyRecorder measures how long the port bindings take from their events to
+// the host, from the Latency of the tracker's events; see WithEventTime. It
+// keeps a histogram of the latencies by source, and the latest ones.
+type LatencyRecorder struct {
+	mutex      sync.Mutex
+	histograms map[string]*latencyHistogram
+	// recent holds the latest latencies in a ring buffer, next is the
+	// index that the next one is stored at.
+	recent []Latency
+	next   int
+}
+
+// NewLatencyRecorder creates a recorder without any latencies.
+func NewLatencyRecorder() *LatencyRecorder {
+	return &LatencyRecorder{histograms: make(map[string]*latencyHistogram)}
+}
+
+// Run measures the latencies of the events of the subscription, which must
+// deliver the outcomes, see WithOutcomes; it returns once the subscription
+// is unsubscribed.
+func (l *LatencyRecorder) Run(subscription *Subscription) {
+	for event := range subscription.Events() {
+		l.Observe(event)
+	}
+}
+
+// Observe records the latency of the event, the events without one are ignored.
+func (l *LatencyRecorder) Observe(event Event) {
+	if event.Outcome != OutcomeSent || event.Latency <= 0 {
+		return
+	}
+
+	bucket, _ := slices.BinarySearch(forwarder.LatencyBuckets, event.Latency)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	histogram, ok := l.histograms[event.Source]
+	if !ok {
+		histogram = &latencyHistogram{counts: make([]uint64, len(forwarder.LatencyBuckets)+1)}
+		l.histograms[event.Source] = histogram
+	}
+
+	histogram.counts[bucket]++
+	histogram.sum += event.Latency
+
+	latency := Latency{
+		ID:        event.ID,
+		Source:    event.Source,
+		Port:      event.Port,
+		Protocol:  event.Protocol,
+		Latency:   event.Latency,
+		Timestamp: event.Timestamp,
+	}
+
+	if len(l.recent) < recentLatencies {
+		l.recent = append(l.recent, latency)
+
+		return
+	}
+
+	l.recent[l.next] = latency
+	l.next = (l.next + 1) % recentLatencies
+}
+
+// Worst returns at most n of the latest latencies, the longest first.
+func (l *LatencyRecorder) Worst(n int) []Latency {
+	l.mutex.Lock()
+	latencies := slices.Clone(l.recent)
+	l.mutex.Unlock()
+
+	sort.SliceStable(latencies, func(i, j int) bool {
+		return latencies[i].Latency > latencies[j].Latency
+	})
+
+	if len(latencies) > n {
+		latencies = latencies[:n]
+	}
+
+	return latencies
+}
+
+// Collect returns the histogram of the latencies by source for the
+// Prometheus endpoint, see metrics.Registry.
+func (l *LatencyRecorder) Collect() []metrics.Family {
+	upperBounds := make([]float64, 0, len(forwarder.LatencyBuckets))
+	for _, bucket := range forwarder.LatencyBuckets {
+		upperBounds = append(upperBounds, bucket.Seconds())
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	histograms := make([]metrics.Histogram, 0, len(l.histograms))
+	for _, source := range sortedIDs(l.histograms) {
+		histogram := l.histograms[source]
+		histograms = append(histograms, metrics.Histogram{
+			Labels:      []metrics.Label{{Name: "source", Value: source}},
+			UpperBounds: upperBounds,
+			Counts:      slices.Clone(histogram.counts),
+			Sum:         histogram.sum.Seconds(),
+		})
+	}
+
+	return []metrics.Family{
+		{
+			Name:       metrics.Namespace + "port_latency_seconds",
+			Help:       "Duration from the events that the ports are added for to their forwarding by the host, by source.",
+			Type:       metrics.TypeHistogram,
+			Histograms: histograms,
+		},
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVTunnelTrackerLatency(t *testing.T) {
+	t.Parallel()
+
+	// The host takes a while to forward the ports.
+	forwarder := testForwarder{failCondition: func(types.PortMapping) error {
+		time.Sleep(20 * time.Millisecond)
+
+		return nil
+	}}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}})
+	subscription := vtunnelTracker.Subscribe(10, tracker.WithOutcomes())
+
+	eventTime := time.Now().Add(-100 * time.Millisecond)
+	portMapping := nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: hostPort}}}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping,
+		tracker.WithSource(tracker.SourceDocker), tracker.WithEventTime(eventTime)))
+
+	// The latency of a change is not measured without the time of its event.
+	portMapping2 := nat.PortMap{"443/tcp": []nat.PortBinding{{HostIP: hostIP2, HostPort: hostPort2}}}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, portMapping2))
+
+	subscription.Unsubscribe()
+
+	latencies := make(map[string]time.Duration)
+	for event := range subscription.Events() {
+		if event.Outcome == tracker.OutcomeSent {
+			latencies[event.ID] = event.Latency
+		}
+	}
+
+	require.Contains(t, latencies, containerID)
+	assert.GreaterOrEqual(t, latencies[containerID], 120*time.Millisecond)
+	assert.Less(t, latencies[containerID], 5*time.Second)
+	assert.Zero(t, latencies[containerID2])
+
+	entry, ok := vtunnelTracker.GetByPort(hostPort, "tcp")
+	require.True(t, ok)
+	assert.Equal(t, eventTime, entry.EventTime)
+
+	// An update without the time of its event does not keep the time of the earlier one.
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID,
+		nat.PortMap{"8080/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: "8080"}}}))
+
+	entry, ok = vtunnelTracker.GetByPort("8080", "tcp")
+	require.True(t, ok)
+	assert.Zero(t, entry.EventTime)
+}
+
+func TestLatencyRecorder(t *testing.T) {
+	t.Parallel()
+
+	recorder := tracker.NewLatencyRecorder()
+	now := time.Now()
+
+	for i, latency := range []time.Duration{3 * time.Millisecond, 70 * time.Millisecond, 2 * time.Second, 40 * time.Second} {
+		recorder.Observe(tracker.Event{
+			Action:    tracker.ActionAdd,
+			ID:        "container",
+			Port:      strings.Repeat("8", i+1),
+			Protocol:  "tcp",
+			Source:    tracker.SourceDocker,
+			Outcome:   tracker.OutcomeSent,
+			Latency:   latency,
+			Timestamp: now,
+		})
+	}
+
+	recorder.Observe(tracker.Event{Source: tracker.SourceKubernetes, Outcome: tracker.OutcomeSent, Latency: 7 * time.Millisecond})
+	// The failed sends and the changes without a latency are not measured.
+	recorder.Observe(tracker.Event{Source: tracker.SourceDocker, Outcome: tracker.OutcomeFailed, Latency: time.Minute})
+	recorder.Observe(tracker.Event{Source: tracker.SourceDocker, Outcome: tracker.OutcomeSent})
+	recorder.Observe(tracker.Event{Source: tracker.SourceDocker, Action: tracker.ActionAdd})
+
+	families := recorder.Collect()
+	require.Len(t, families, 1)
+	assert.Equal(t, metrics.Namespace+"port_latency_seconds", families[0].Name)
+	assert.Equal(t, metrics.TypeHistogram, families[0].Type)
+
+	histograms := families[0].Histograms
+	require.Len(t, histograms, 2)
+	assert.Equal(t, []metrics.Label{{Name: "source", Value: tracker.SourceDocker}}, histograms[0].Labels)
+	// The buckets are up to 1ms, 5ms, 10ms, 50ms, 100ms, 500ms, 1s, 5s, 30s and above.
+	assert.Equal(t, []uint64{0, 1, 0, 0, 1, 0, 0, 1, 0, 1}, histograms[0].Counts)
+	assert.InDelta(t, 42.073, histograms[0].Sum, 1e-9)
+	assert.Equal(t, []metrics.Label{{Name: "source", Value: tracker.SourceKubernetes}}, histograms[1].Labels)
+	assert.Equal(t, []uint64{0, 0, 1, 0, 0, 0, 0, 0, 0, 0}, histograms[1].Counts)
+
+	worst := recorder.Worst(2)
+	assert.Equal(t, []tracker.Latency{
+		{ID: "container", Source: tracker.SourceDocker, Port: "8888", Protocol: "tcp", Latency: 40 * time.Second, Timestamp: now},
+		{ID: "container", Source: tracker.SourceDocker, Port: "888", Protocol: "tcp", Latency: 2 * time.Second, Timestamp: now},
+	}, worst)
+	assert.Len(t, recorder.Worst(10), 5)
+}
+
+func TestLatencyRecorderRecent(t *testing.T) {
+	t.Parallel()
+
+	recorder := tracker.NewLatencyRecorder()
+	recorder.Observe(tracker.Event{Port: "1", Outcome: tracker.OutcomeSent, Latency: time.Hour})
+
+	// Only the latest latencies are kept for Worst, the histogram counts them all.
+	for range 100 {
+		recorder.Observe(tracker.Event{Port: "2", Outcome: tracker.OutcomeSent, Latency: time.Millisecond})
+	}
+
+	worst := recorder.Worst(1)
+	require.Len(t, worst, 1)
+	assert.Equal(t, "2", worst[0].Port)
+
+	var count uint64
+	for _, bucketCount := range recorder.Collect()[0].Histograms[0].Counts {
+		count += bucketCount
+	}
+
+	assert.Equal(t, uint64(101), count)
+}
+
+func TestEventTime(t *testing.T) {
+	t.Parallel()
+
+	eventTime := tracker.EventTime(time.Now().Add(-time.Second))
+	// The event time is a reading of the monotonic clock, which time.Time prints as "m=".
+	assert.Contains(t, eventTime.String(), "m=")
+	assert.InDelta(t, time.Second, time.Since(eventTime), float64(500*time.Millisecond))
+
+	// The events that are not in the past happened now.
+	assert.Less(t, time.Since(tracker.EventTime(time.Now().Add(time.Hour))), 500*time.Millisecond)
+	assert.Less(t, time.Since(tracker.EventTime(time.Time{})), 500*time.Millisecond)
+}
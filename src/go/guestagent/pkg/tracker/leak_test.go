@@ -0,0 +1,158 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	// weekRounds and weekContainers simulate a week of an agent: a round of
+	// containers that are started and stopped every few hours, 100k
+	// lifecycles in all.
+	weekRounds     = 50
+	weekContainers = 2000
+	// heapSlack is how much the heap may grow from the first round to the
+	// last, for the allocations of the runtime and the tests.
+	heapSlack = 2 << 20
+)
+
+// countingForwarder counts the ports that it is sent, without holding the
+// port mappings like testForwarder, so that it does not grow with them.
+type countingForwarder struct {
+	sent atomic.Int64
+}
+
+func (c *countingForwarder) Send(_ context.Context, portMapping types.PortMapping) error {
+	c.sent.Add(int64(len(portMapping.Ports)))
+
+	return nil
+}
+
+func (c *countingForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	for _, portMapping := range portMappings {
+		_ = c.Send(ctx, portMapping)
+	}
+
+	return nil
+}
+
+// heapInUse returns the memory of the live objects of the heap, once they
+// were collected.
+func heapInUse() uint64 {
+	runtime.GC()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	return stats.HeapAlloc
+}
+
+// TestTrackersSimulatedWeek checks that the trackers of an agent that runs
+// for a week of container lifecycles neither grow their heap nor leave
+// goroutines behind. It is not parallel, since it counts the goroutines
+// and measures the heap of the whole test binary.
+func TestTrackersSimulatedWeek(t *testing.T) {
+	filter, err := tracker.ParsePortFilter("", "")
+	require.NoError(t, err)
+
+	goroutines := runtime.NumGoroutine()
+	forwarder := &countingForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder, nil)
+	vtunnelTracker.EnableBatching(time.Millisecond)
+	metricsTracker := tracker.NewMetricsTracker(tracker.NewFilterTracker(vtunnelTracker, filter))
+	compactions := tracker.Compactions()
+
+	var warm uint64
+
+	for round := 0; round < weekRounds; round++ {
+		for i := 0; i < weekContainers; i++ {
+			require.NoError(t, metricsTracker.Add(context.Background(), containerID+strconv.Itoa(i), testPortMap(8000+i)))
+		}
+
+		require.NoError(t, metricsTracker.Flush())
+
+		for i := 0; i < weekContainers; i++ {
+			require.NoError(t, metricsTracker.Remove(context.Background(), containerID+strconv.Itoa(i)))
+		}
+
+		require.NoError(t, metricsTracker.Flush())
+
+		// The first round sizes the pools and the buffers of the runtime.
+		if round == 0 {
+			warm = heapInUse()
+		}
+	}
+
+	assert.Empty(t, metricsTracker.List())
+	assert.Equal(t, int64(2*weekRounds*weekContainers), forwarder.sent.Load())
+	assert.Greater(t, tracker.Compactions(), compactions, "the maps of the trackers were not compacted")
+	assert.LessOrEqual(t, heapInUse(), warm+heapSlack, "the heap grew over the week")
+	runtime.KeepAlive(metricsTracker)
+
+	// The timers of the batches are the only goroutines of the trackers.
+	require.Eventually(t, func() bool {
+		// The condition runs in a goroutine of its own.
+		return runtime.NumGoroutine()-1 <= goroutines
+	}, 5*time.Second, 10*time.Millisecond, "the trackers left goroutines behind")
+}
+
+// TestTrackersCompaction checks that the heap of the trackers shrinks back
+// once a burst of port mappings is removed; it is not parallel, since it
+// measures the heap of the whole test binary.
+func TestTrackersCompaction(t *testing.T) {
+	const burst = 20000
+
+	filter, err := tracker.ParsePortFilter("", "")
+	require.NoError(t, err)
+
+	// The burst is batched, like the agent does with -batchWindow.
+	vtunnelTracker := tracker.NewVTunnelTracker(&countingForwarder{}, nil)
+	vtunnelTracker.EnableBatching(time.Millisecond)
+	metricsTracker := tracker.NewMetricsTracker(tracker.NewFilterTracker(vtunnelTracker, filter))
+	compactions := tracker.Compactions()
+	before := heapInUse()
+
+	for i := 0; i < burst; i++ {
+		require.NoError(t, metricsTracker.Add(context.Background(), containerID+strconv.Itoa(i), testPortMap(1024+i)))
+	}
+
+	require.NoError(t, metricsTracker.Flush())
+
+	peak := heapInUse()
+
+	for i := 0; i < burst; i++ {
+		require.NoError(t, metricsTracker.Remove(context.Background(), containerID+strconv.Itoa(i)))
+	}
+
+	require.NoError(t, metricsTracker.Flush())
+
+	after := heapInUse()
+
+	assert.Greater(t, tracker.Compactions(), compactions, "the maps of the trackers were not compacted")
+	// The trackers give back all but a few percent of what the burst took.
+	assert.Less(t, after-before, (peak-before)/20, "the heap did not shrink after the burst")
+	// The trackers are measured, rather than collected along with their maps.
+	runtime.KeepAlive(metricsTracker)
+}
@@ -18,82 +18,328 @@ package tracker
 import (
 	"context"
 	"errors"
+	"fmt"
+	"maps"
 	"net"
+	"sort"
 	"strconv"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netns"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/retry"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
 	"golang.org/x/sys/unix"
 )
 
-// ListenerTracker manages listeners.
+// bindRetryPolicy is how the listeners whose address is not available yet are
+// opened again, e.g. the address of an interface that is still coming up, or a
+// port that another process is about to release.
+var bindRetryPolicy = retry.Policy{ //nolint:gochecknoglobals
+	Initial: 50 * time.Millisecond,
+	Max:     500 * time.Millisecond,
+	Budget:  2 * time.Second,
+}
+
+// ListenerTracker manages listeners. It is shared by the subsystems, e.g.
+// the Kubernetes services and the iptables scans, which add and remove the
+// listeners concurrently: the calls of an address take effect in the order
+// that they are made, as if the listener was opened at once, even though it
+// is opened without holding the mutex:
+//   - an AddListener of a listener that is being opened waits for it to be
+//     opened, and returns its error;
+//   - a RemoveListener of a listener that is being opened cancels it, it is
+//     closed once it is opened, and is not tracked.
 type ListenerTracker struct {
-	// outstanding listeners; the key is generated via ipPortToAddr.
+	// outstanding listeners; the key is generated via ipPortToAddr,
+	// the listeners are nil in a dry run.
 	listeners map[string]net.Listener
-	mutex     sync.Mutex
+	// opening are the listeners that are being opened, keyed like the
+	// listeners; they are not tracked until they are opened.
+	opening map[string]*openingListener
+	// origins are the objects that the listeners were opened for, if known,
+	// keyed like the listeners; see ContextWithOrigin.
+	origins map[string]Origin
+	// listenersPeak and originsPeak are their peak sizes, see deleteCompacted.
+	listenersPeak int
+	originsPeak   int
+	mutex         sync.Mutex
+	dryRun        bool
+	// namespace is the network namespace that the listeners are opened in,
+	// see SetNamespace; it is nil for the one of the agent.
+	namespace *netns.Namespace
+	// ipv6Only tells whether the VM only has IPv6 connectivity, see
+	// SetIPv6Only; it is nil when the listeners are opened as they are added.
+	ipv6Only func() bool
 }
 
 // NewListenerTracker creates a new listener tracker.
 func NewListenerTracker() *ListenerTracker {
 	return &ListenerTracker{
 		listeners: make(map[string]net.Listener),
+		opening:   make(map[string]*openingListener),
+		origins:   make(map[string]Origin),
 	}
 }
 
+// openingListener is a listener that is being opened.
+type openingListener struct {
+	// done is closed once it was opened, or failed to open with err.
+	done chan struct{}
+	err  error
+}
+
+// EnableDryRun makes the listener tracker log the listeners instead of
+// opening them; they are still tracked, so that they are listed.
+func (l *ListenerTracker) EnableDryRun() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.dryRun = true
+}
+
+// SetNamespace makes the listener tracker open the listeners in the network
+// namespace, e.g. the one of -netns, rather than in the one of the agent.
+func (l *ListenerTracker) SetNamespace(namespace *netns.Namespace) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.namespace = namespace
+}
+
+// SetIPv6Only makes the listener tracker open the listeners that are added
+// on the unspecified IPv4 address on the unspecified IPv6 one instead, which
+// also accepts IPv4, whenever ipv6Only returns true, e.g. when the VM only has
+// IPv6 connect addresses; they are still tracked at the address they were
+// added with. The listeners that are already open are left as they are.
+func (l *ListenerTracker) SetIPv6Only(ipv6Only func() bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.ipv6Only = ipv6Only
+}
+
 // AddListener adds an IP / port combination into the listener tracker.
-// If this combination is already being tracked, this is a no-op.
+// If this combination is already being tracked, this is a no-op, and if it
+// is being opened, it waits for it. The origin of the context, if any, is
+// recorded as the listener's.
 func (l *ListenerTracker) AddListener(ctx context.Context, ip net.IP, port int) error {
 	addr := ipPortToAddr(ip, port)
 
-	var oldListener net.Listener
-
 	l.mutex.Lock()
-	oldListener = l.listeners[addr]
-	l.mutex.Unlock()
+	if _, tracked := l.listeners[addr]; tracked {
+		l.mutex.Unlock()
 
-	if oldListener != nil {
 		return nil
 	}
 
-	listener, err := listen(ctx, addr)
-	if err != nil {
-		return err
+	if opening, ok := l.opening[addr]; ok {
+		l.mutex.Unlock()
+
+		select {
+		case <-opening.done:
+			return opening.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
+	opening := &openingListener{done: make(chan struct{})}
+	l.opening[addr] = opening
+	dryRun := l.dryRun
+	namespace := l.namespace
+	ipv6Only := l.ipv6Only
+	l.mutex.Unlock()
+
+	listener, err := bind(ctx, addr, ip, port, dryRun, namespace, ipv6Only)
+
 	l.mutex.Lock()
-	l.listeners[addr] = listener
+	// A remove while the listener was opened deleted it from the ones that are opening.
+	removed := l.opening[addr] != opening
+	if !removed {
+		delete(l.opening, addr)
+	}
+
+	if err == nil && !removed {
+		l.listeners[addr] = listener
+
+		if origin := OriginFromContext(ctx); !origin.IsZero() {
+			l.origins[addr] = origin
+		}
+	}
+
+	opening.err = err
+	close(opening.done)
 	l.mutex.Unlock()
 
-	return nil
+	if err == nil && removed && listener != nil {
+		logger.Debugw("the listener was removed while it was opened, closing it", logging.Fields(logging.Addr(addr), logging.Port(port)))
+
+		return listener.Close()
+	}
+
+	return err
+}
+
+// bind opens the listener of the address, or returns nil in a dry run.
+func bind(
+	ctx context.Context, addr string, ip net.IP, port int, dryRun bool, namespace *netns.Namespace, ipv6Only func() bool,
+) (net.Listener, error) {
+	listenAddr := addr
+	if ipv6Only != nil && ip.Equal(net.IPv4zero) && ipv6Only() {
+		listenAddr = ipPortToAddr(net.IPv6unspecified, port)
+		logger.Debugf("the VM only has IPv6 connectivity, listening on %s for %s", listenAddr, addr)
+	}
+
+	ctx, span := tracing.Start(ctx, "listener.bind", tracing.String("addr", addr))
+	defer span.End()
+
+	if dryRun {
+		logger.Infow("dry run, not listening", logging.Fields(logging.Addr(addr), logging.Port(port)))
+
+		return nil, nil
+	}
+
+	var listener net.Listener
+
+	backoff := bindRetryPolicy.Start()
+
+	for {
+		err := namespace.Do(func() error {
+			var err error
+			listener, err = listen(ctx, listenAddr)
+
+			return err
+		})
+		if err == nil {
+			return listener, nil
+		}
+
+		if bindRetryable(err) {
+			logger.Debugw("the address is not available yet, retrying", logging.Fields(logging.Addr(addr), logging.Error(err), log.Fields{
+				"attempt": backoff.Retries() + 1,
+			}))
+
+			waitErr := backoff.Wait(ctx)
+			if waitErr == nil {
+				continue
+			}
+
+			err = fmt.Errorf("giving up listening on %s: %w: %w", addr, waitErr, err)
+		}
+
+		span.RecordError(err)
+
+		return nil, err
+	}
+}
+
+// bindRetryable returns true if the address of the listener is not available
+// yet, either the IP address is not assigned to an interface, or the port is
+// held by a socket that does not share it.
+func bindRetryable(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EADDRINUSE)
 }
 
 // RemoveListener removes an IP / port combination from the listener tracker.  If this
-// combination was not being tracked, this is a no-op.
+// combination was not being tracked, this is a no-op, and if it is being opened, it is
+// closed once it is opened.
 func (l *ListenerTracker) RemoveListener(_ context.Context, ip net.IP, port int) error {
 	addr := ipPortToAddr(ip, port)
 
 	l.mutex.Lock()
 	defer l.mutex.Unlock()
 
+	delete(l.opening, addr)
+
 	if listener, ok := l.listeners[addr]; ok {
-		if err := listener.Close(); err != nil {
+		if listener == nil {
+			logger.Infow("dry run, not closing the listener", logging.Fields(logging.Addr(addr), logging.Port(port)))
+		} else if err := listener.Close(); err != nil {
 			return err
 		}
 
-		delete(l.listeners, addr)
+		l.listeners = deleteCompacted(l.listeners, addr, &l.listenersPeak)
+		l.origins = deleteCompacted(l.origins, addr, &l.originsPeak)
 	}
 
 	return nil
 }
 
+// CloseAll closes all the outstanding listeners, in the order of their
+// addresses, and cancels the ones that are being opened, e.g. once the port
+// mappings were withdrawn at shutdown; it gives up on the ones that are left
+// once the context is done, and returns the errors of closing the others.
+func (l *ListenerTracker) CloseAll(ctx context.Context) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	clear(l.opening)
+
+	var errs []error
+
+	addrs := make([]string, 0, len(l.listeners))
+	for addr := range l.listeners {
+		addrs = append(addrs, addr)
+	}
+
+	sort.Strings(addrs)
+
+	for _, addr := range addrs {
+		if ctx.Err() != nil {
+			break
+		}
+
+		if listener := l.listeners[addr]; listener != nil {
+			if err := listener.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("closing the listener of %s failed: %w", addr, err))
+
+				continue
+			}
+		}
+
+		l.listeners = deleteCompacted(l.listeners, addr, &l.listenersPeak)
+		l.origins = deleteCompacted(l.origins, addr, &l.originsPeak)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Listeners returns the addresses of the outstanding listeners, sorted.
+func (l *ListenerTracker) Listeners() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	addrs := make([]string, 0, len(l.listeners))
+	for addr := range l.listeners {
+		addrs = append(addrs, addr)
+	}
+
+	sort.Strings(addrs)
+
+	return addrs
+}
+
+// ListenerOrigins returns the origins of the outstanding listeners that
+// have one, keyed by their address.
+func (l *ListenerTracker) ListenerOrigins() map[string]Origin {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return maps.Clone(l.origins)
+}
+
 func ipPortToAddr(ip net.IP, port int) string {
 	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
 }
 
 // Listen on the given address and port.  The returned listener never handles
 // any traffic (immediately closing any incoming connection), and tries to
-// shutdown quickly when no longer needed.
+// shutdown quickly when no longer needed. The IPv4 addresses only listen on
+// IPv4, the IPv6 ones, such as [::], may accept IPv4 too.
 func listen(ctx context.Context, addr string) (net.Listener, error) {
 	config := &net.ListenConfig{
 		Control: func(_, _ string, c syscall.RawConn) error {
@@ -108,27 +354,15 @@ func listen(ctx context.Context, addr string) (net.Listener, error) {
 					Linger: 0,
 				})
 				if err != nil {
-					log.Errorw("failed to set SO_LINGER", log.Fields{
-						"error": err,
-						"addr":  addr,
-						"fd":    fd,
-					})
+					logger.Errorw("failed to set SO_LINGER", logging.Fields(logging.Error(err), logging.Addr(addr), log.Fields{"fd": fd}))
 				}
 				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
 				if err != nil {
-					log.Errorw("failed to set SO_REUSEADDR", log.Fields{
-						"error": err,
-						"addr":  addr,
-						"fd":    fd,
-					})
+					logger.Errorw("failed to set SO_REUSEADDR", logging.Fields(logging.Error(err), logging.Addr(addr), log.Fields{"fd": fd}))
 				}
 				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
 				if err != nil {
-					log.Errorw("failed to set SO_REUSEPORT", log.Fields{
-						"error": err,
-						"addr":  addr,
-						"fd":    fd,
-					})
+					logger.Errorw("failed to set SO_REUSEPORT", logging.Fields(logging.Error(err), logging.Addr(addr), log.Fields{"fd": fd}))
 				}
 			})
 			if err != nil {
@@ -139,36 +373,33 @@ func listen(ctx context.Context, addr string) (net.Listener, error) {
 		},
 	}
 
-	listener, err := config.Listen(ctx, "tcp4", addr)
+	network := "tcp"
+	if host, _, err := net.SplitHostPort(addr); err == nil && net.ParseIP(host).To4() != nil {
+		network = "tcp4"
+	}
+
+	listener, err := config.Listen(ctx, network, addr)
 	if err != nil {
 		return nil, err
 	}
 
+	// The connections are accepted until the listener is closed, the context
+	// only bounds the bind: the listener outlives the call that opened it, and
+	// the connections that it left unaccepted would hang.
 	go func() {
 		for {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				conn, err := listener.Accept()
-				if err != nil {
-					if !errors.Is(err, net.ErrClosed) {
-						log.Errorw("failed to accept connection", log.Fields{
-							"error": err,
-							"addr":  addr,
-						})
-					}
-
-					return
-				}
-				// We don't handle any traffic; just unceremoniously
-				// close the connection and let the other side deal.
-				if err = conn.Close(); err != nil {
-					log.Errorw("failed to close connection", log.Fields{
-						"error": err,
-						"addr":  addr,
-					})
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					logger.Errorw("failed to accept connection", logging.Fields(logging.Error(err), logging.Addr(addr)))
 				}
+
+				return
+			}
+			// We don't handle any traffic; just unceremoniously
+			// close the connection and let the other side deal.
+			if err = conn.Close(); err != nil {
+				logger.Errorw("failed to close connection", logging.Fields(logging.Error(err), logging.Addr(addr)))
 			}
 		}
 	}()
@@ -0,0 +1,98 @@
+//go:build root
+
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netns"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// newNamespace creates a network namespace with unshare, with its loopback
+// up, which is mounted at a file of a temporary directory.
+func newNamespace(t *testing.T) string {
+	t.Helper()
+
+	if os.Geteuid() != 0 {
+		t.Skip("creating the network namespaces requires root")
+	}
+
+	path := filepath.Join(t.TempDir(), "rd1")
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+	output, err := exec.Command("unshare", "--net="+path, "ip", "link", "set", "lo", "up").CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	t.Cleanup(func() {
+		if err := unix.Unmount(path, unix.MNT_DETACH); err != nil && !errors.Is(err, unix.EINVAL) {
+			t.Errorf("failed to unmount the network namespace %s: %v", path, err)
+		}
+	})
+
+	return path
+}
+
+func TestListenerTrackerNamespace(t *testing.T) {
+	path := newNamespace(t)
+	namespace := netns.New(path)
+
+	listenerTracker := tracker.NewListenerTracker()
+	listenerTracker.SetNamespace(namespace)
+
+	ctx := context.Background()
+	ip := net.IPv4(127, 0, 0, 1)
+	port := 9899
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+
+	require.NoError(t, listenerTracker.AddListener(ctx, ip, port))
+	assert.Equal(t, []string{addr}, listenerTracker.Listeners())
+
+	// The listener is only reachable within the namespace, it resets the connections right away.
+	var dialErr error
+	require.NoError(t, namespace.Do(func() error {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+		}
+
+		dialErr = err
+
+		return nil
+	}))
+	assert.NotErrorIs(t, dialErr, unix.ECONNREFUSED)
+
+	_, err := net.Dial("tcp", addr)
+	require.ErrorIs(t, err, unix.ECONNREFUSED)
+
+	require.NoError(t, listenerTracker.RemoveListener(ctx, ip, port))
+	assert.Empty(t, listenerTracker.Listeners())
+
+	// The listeners can not be opened while the namespace does not exist.
+	require.NoError(t, unix.Unmount(path, unix.MNT_DETACH))
+	require.ErrorIs(t, listenerTracker.AddListener(ctx, ip, port), netns.ErrNotFound)
+	assert.Empty(t, listenerTracker.Listeners())
+}
@@ -15,13 +15,17 @@ package tracker_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -60,6 +64,378 @@ func TestListenerTracker(t *testing.T) {
 	}
 }
 
+func TestListenerTrackerListeners(t *testing.T) {
+	t.Parallel()
+
+	listenerTracker := tracker.NewListenerTracker()
+	ctx := context.Background()
+	loopback := net.IPv4(127, 0, 0, 1)
+
+	require.Empty(t, listenerTracker.Listeners())
+
+	require.NoError(t, listenerTracker.AddListener(ctx, loopback, 0))
+	// Adding a listener that is already tracked is a no-op.
+	require.NoError(t, listenerTracker.AddListener(ctx, loopback, 0))
+	require.Equal(t, []string{"127.0.0.1:0"}, listenerTracker.Listeners())
+
+	require.NoError(t, listenerTracker.RemoveListener(ctx, loopback, 0))
+	require.Empty(t, listenerTracker.Listeners())
+}
+
+func TestListenerTrackerDryRun(t *testing.T) {
+	t.Parallel()
+
+	listenerTracker := tracker.NewListenerTracker()
+	listenerTracker.EnableDryRun()
+
+	ctx := context.Background()
+	loopback := net.IPv4(127, 0, 0, 1)
+
+	// A free port, which the dry run leaves free.
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	port := free.Addr().(*net.TCPAddr).Port
+	require.NoError(t, free.Close())
+
+	require.NoError(t, listenerTracker.AddListener(ctx, loopback, port))
+	require.Equal(t, []string{ipPortToAddr(loopback, port)}, listenerTracker.Listeners())
+
+	listener, err := net.Listen("tcp", ipPortToAddr(loopback, port))
+	require.NoError(t, err, "the dry run listened on the port")
+	require.NoError(t, listener.Close())
+
+	require.NoError(t, listenerTracker.RemoveListener(ctx, loopback, port))
+	require.Empty(t, listenerTracker.Listeners())
+}
+
+// TestListenerTrackerCancelled checks that the listener keeps closing the
+// connections that it accepts once the context that opened it is cancelled.
+func TestListenerTrackerCancelled(t *testing.T) {
+	t.Parallel()
+
+	listenerTracker := tracker.NewListenerTracker()
+	loopback := net.IPv4(127, 0, 0, 1)
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	port := free.Addr().(*net.TCPAddr).Port
+	require.NoError(t, free.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	require.NoError(t, listenerTracker.AddListener(ctx, loopback, port))
+	cancel()
+
+	for range 3 {
+		conn, err := net.Dial("tcp", ipPortToAddr(loopback, port))
+		if errors.Is(err, syscall.ECONNRESET) {
+			// The connection was closed as soon as it was accepted.
+			continue
+		}
+
+		require.NoError(t, err)
+		require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+
+		_, err = conn.Read(make([]byte, 1))
+		var netErr net.Error
+		require.False(t, errors.As(err, &netErr) && netErr.Timeout(), "the connection was not closed by the listener")
+		require.NoError(t, conn.Close())
+	}
+
+	require.NoError(t, listenerTracker.RemoveListener(context.Background(), loopback, port))
+}
+
+func TestListenerTrackerAddressNotAvailable(t *testing.T) {
+	t.Parallel()
+
+	listenerTracker := tracker.NewListenerTracker()
+
+	// The documentation address is not assigned to any interface, so the
+	// listen is retried until the context is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	err := listenerTracker.AddListener(ctx, net.IPv4(192, 0, 2, 1), 8080)
+	require.ErrorIs(t, err, syscall.EADDRNOTAVAIL)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Empty(t, listenerTracker.Listeners())
+}
+
+func TestListenerTrackerPortReleased(t *testing.T) {
+	t.Parallel()
+
+	listenerTracker := tracker.NewListenerTracker()
+	loopback := net.IPv4(127, 0, 0, 1)
+
+	// The listener of another process does not share the port, so the
+	// listener is opened once it is closed.
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	port := other.Addr().(*net.TCPAddr).Port
+	released := time.AfterFunc(100*time.Millisecond, func() { other.Close() })
+
+	defer released.Stop()
+
+	started := time.Now()
+
+	require.NoError(t, listenerTracker.AddListener(context.Background(), loopback, port))
+	assert.GreaterOrEqual(t, time.Since(started), 100*time.Millisecond)
+	assert.Len(t, listenerTracker.Listeners(), 1)
+	require.NoError(t, listenerTracker.RemoveListener(context.Background(), loopback, port))
+}
+
+func TestListenerTrackerCloseAll(t *testing.T) {
+	t.Parallel()
+
+	listenerTracker := tracker.NewListenerTracker()
+
+	ctx := context.Background()
+	loopback := net.IPv4(127, 0, 0, 1)
+
+	require.NoError(t, listenerTracker.AddListener(ctx, loopback, 0))
+	require.NoError(t, listenerTracker.AddListener(ctx, net.IPv6loopback, 0))
+	require.Len(t, listenerTracker.Listeners(), 2)
+
+	require.NoError(t, listenerTracker.CloseAll(ctx))
+	require.Empty(t, listenerTracker.Listeners())
+
+	// The listeners are gone, so closing them again is a no-op.
+	require.NoError(t, listenerTracker.CloseAll(ctx))
+}
+
+func TestListenerTrackerIPv6Only(t *testing.T) {
+	t.Parallel()
+
+	if listener, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	} else {
+		require.NoError(t, listener.Close())
+	}
+
+	tests := map[string]struct {
+		ipv6Only bool
+	}{
+		"dual-stack": {},
+		"IPv6 only":  {ipv6Only: true},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			listenerTracker := tracker.NewListenerTracker()
+			listenerTracker.SetIPv6Only(func() bool { return tt.ipv6Only })
+
+			ctx := context.Background()
+			port := freePort(t)
+
+			require.NoError(t, listenerTracker.AddListener(ctx, net.IPv4zero, port))
+			// The listener is tracked at the address that it was added with.
+			require.Equal(t, []string{ipPortToAddr(net.IPv4zero, port)}, listenerTracker.Listeners())
+
+			require.Equal(t, !tt.ipv6Only, refused(ipPortToAddr(net.IPv6loopback, port)))
+			// IPv4 is reached either way.
+			require.False(t, refused(ipPortToAddr(net.IPv4(127, 0, 0, 1), port)))
+
+			require.NoError(t, listenerTracker.RemoveListener(ctx, net.IPv4zero, port))
+			require.Empty(t, listenerTracker.Listeners())
+		})
+	}
+}
+
+func TestListenerTrackerConcurrentAdd(t *testing.T) {
+	t.Parallel()
+
+	listenerTracker := tracker.NewListenerTracker()
+	// The listeners take a while to be opened, like they may in a network
+	// namespace or on a loaded machine, so that the adds overlap.
+	listenerTracker.SetIPv6Only(func() bool {
+		time.Sleep(time.Millisecond)
+
+		return false
+	})
+
+	ctx := context.Background()
+
+	for i := 0; i < 20; i++ {
+		port := freePort(t)
+
+		// The listener of the address is opened once, the other adds wait
+		// for it rather than opening others, which a single remove would
+		// not close.
+		var wg sync.WaitGroup
+
+		start := make(chan struct{})
+
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+
+			go func() {
+				defer wg.Done()
+				<-start
+				assert.NoError(t, listenerTracker.AddListener(ctx, net.IPv4zero, port))
+			}()
+		}
+
+		close(start)
+		wg.Wait()
+		require.Equal(t, []string{ipPortToAddr(net.IPv4zero, port)}, listenerTracker.Listeners())
+
+		require.NoError(t, listenerTracker.RemoveListener(ctx, net.IPv4zero, port))
+		require.True(t, refused(ipPortToAddr(net.IPv4(127, 0, 0, 1), port)), "a listener was left open on %d", port)
+	}
+}
+
+func TestListenerTrackerRemoveWhileOpening(t *testing.T) {
+	t.Parallel()
+
+	opening := make(chan struct{})
+	removed := make(chan struct{})
+
+	listenerTracker := tracker.NewListenerTracker()
+	listenerTracker.SetIPv6Only(func() bool {
+		close(opening)
+		<-removed
+
+		return false
+	})
+
+	ctx := context.Background()
+	port := freePort(t)
+	added := make(chan error)
+
+	go func() { added <- listenerTracker.AddListener(ctx, net.IPv4zero, port) }()
+
+	// The remove comes after the add, so the listener is closed once it is
+	// opened, rather than tracked.
+	<-opening
+	require.NoError(t, listenerTracker.RemoveListener(ctx, net.IPv4zero, port))
+	close(removed)
+
+	require.NoError(t, <-added)
+	assert.Empty(t, listenerTracker.Listeners())
+	assert.True(t, refused(ipPortToAddr(net.IPv4(127, 0, 0, 1), port)))
+}
+
+// TestListenerTrackerSubsystems drives the calls of the Kubernetes services
+// and of the iptables scans to the same listeners concurrently, so that -race
+// checks them; the listeners that are tracked afterward are the ones that are
+// open, whichever way the calls interleaved.
+func TestListenerTrackerSubsystems(t *testing.T) {
+	t.Parallel()
+
+	const (
+		ports      = 8
+		iterations = 2000
+	)
+
+	filterTracker := tracker.NewFilterTracker(tracker.NewVTunnelTracker(&testForwarder{}, nil), mustParsePortFilter(t, "", ""))
+	vtunnelTracker := filterTracker.Tracker.(*tracker.VTunnelTracker)
+	ctx := context.Background()
+	loopback := net.IPv4(127, 0, 0, 1)
+
+	addrs := make([]int, 0, ports)
+	for i := 0; i < ports; i++ {
+		addrs = append(addrs, freePort(t))
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(3)
+
+	// The services are added and removed one at a time, as their events come.
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < iterations; i++ {
+			port := addrs[i%ports]
+			if (i/ports)%2 == 0 {
+				assert.NoError(t, filterTracker.AddListener(ctx, loopback, port))
+			} else {
+				assert.NoError(t, filterTracker.RemoveListener(ctx, loopback, port))
+			}
+		}
+	}()
+
+	// The scans add the ports of the rules that they find, and remove the
+	// ones of the rules that are gone, all of them at once.
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < iterations/ports; i++ {
+			for j, port := range addrs {
+				if (i+j)%3 == 0 {
+					assert.NoError(t, filterTracker.AddListener(ctx, loopback, port))
+				} else {
+					assert.NoError(t, filterTracker.RemoveListener(ctx, loopback, port))
+				}
+			}
+		}
+	}()
+
+	// The admin API and the metrics list the listeners meanwhile.
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < iterations/ports; i++ {
+			_ = vtunnelTracker.Listeners()
+			_ = vtunnelTracker.ListenerOrigins()
+		}
+	}()
+
+	wg.Wait()
+
+	listening := make(map[string]bool, ports)
+	for _, addr := range vtunnelTracker.Listeners() {
+		listening[addr] = true
+	}
+
+	for _, port := range addrs {
+		addr := ipPortToAddr(loopback, port)
+		assert.Equal(t, listening[addr], !refused(addr), "the listener of %s is tracked as %t", addr, listening[addr])
+	}
+
+	// None of the listeners is left open, or opening, once they are all removed.
+	for _, port := range addrs {
+		require.NoError(t, filterTracker.RemoveListener(ctx, loopback, port))
+		assert.True(t, refused(ipPortToAddr(loopback, port)))
+	}
+
+	assert.Empty(t, vtunnelTracker.Listeners())
+
+	for _, port := range addrs {
+		require.NoError(t, filterTracker.AddListener(ctx, loopback, port))
+	}
+
+	assert.Len(t, vtunnelTracker.Listeners(), ports)
+}
+
+// refused returns true if nothing listens on the address; the listeners of
+// the tracker close the connections right away, which may reset them.
+func refused(addr string) bool {
+	conn, err := net.Dial("tcp", addr)
+	if err == nil {
+		conn.Close()
+	}
+
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// freePort returns a TCP port that is free on both IPv4 and IPv6.
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "[::]:0")
+	require.NoError(t, err)
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	return port
+}
+
 func ipPortToAddr(ip net.IP, port int) string {
 	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
 }
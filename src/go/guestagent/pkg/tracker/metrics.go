@@ -0,0 +1,203 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+)
+
+// MetricsTracker counts the port mappings that are added to and removed from
+// the underlying tracker by source, to tell how often the forwards flap.
+type MetricsTracker struct {
+	Tracker
+	// sources are the sources of the entries, to count their removals by.
+	sources map[string]string
+	// sourcesPeak is the peak size of sources, see deleteCompacted.
+	sourcesPeak int
+
+	adds    map[string]uint64
+	removes map[string]uint64
+	mutex   sync.Mutex
+}
+
+// NewMetricsTracker wraps the given tracker to count its changes.
+func NewMetricsTracker(tracker Tracker) *MetricsTracker {
+	return &MetricsTracker{
+		Tracker: tracker,
+		sources: make(map[string]string),
+		adds:    make(map[string]uint64),
+		removes: make(map[string]uint64),
+	}
+}
+
+// Add adds the port mapping to the underlying tracker, and counts it if it succeeded.
+func (m *MetricsTracker) Add(ctx context.Context, containerID string, portMap nat.PortMap, opts ...EntryOption) error {
+	if err := m.Tracker.Add(ctx, containerID, portMap, opts...); err != nil {
+		return err
+	}
+
+	source := newEntry(containerID, portMap, opts...).Source
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.sources[containerID] = source
+	m.adds[source]++
+
+	return nil
+}
+
+// Remove removes the entry from the underlying tracker, and counts it if it was tracked.
+func (m *MetricsTracker) Remove(ctx context.Context, containerID string, opts ...EntryOption) error {
+	tracked := m.Tracker.Get(containerID) != nil
+
+	if err := m.Tracker.Remove(ctx, containerID, opts...); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if source, ok := m.sources[containerID]; ok {
+		m.sources = deleteCompacted(m.sources, containerID, &m.sourcesPeak)
+
+		if tracked {
+			m.removes[source]++
+		}
+	}
+
+	return nil
+}
+
+// RemoveAll removes all the entries from the underlying tracker, they are counted as removed.
+func (m *MetricsTracker) RemoveAll(ctx context.Context) error {
+	entries := m.Tracker.List()
+
+	if err := m.Tracker.RemoveAll(ctx); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, entry := range entries {
+		m.removes[entry.Source]++
+	}
+
+	m.sources = make(map[string]string)
+	m.sourcesPeak = 0
+
+	return nil
+}
+
+// Flush sends the pending changes of the underlying tracker, if it defers them.
+func (m *MetricsTracker) Flush() error {
+	return flush(m.Tracker)
+}
+
+// TrackedPorts returns the number of port bindings that are forwarded.
+func (m *MetricsTracker) TrackedPorts() int {
+	var ports int
+	for _, entry := range m.Tracker.List() {
+		ports += countBindings(entry.Ports)
+	}
+
+	return ports
+}
+
+// Collect returns the metrics of the tracked port mappings for the
+// Prometheus endpoint, see metrics.Registry.
+func (m *MetricsTracker) Collect() []metrics.Family {
+	ports := make(map[string]uint64)
+	for _, entry := range m.Tracker.List() {
+		ports[entry.Source] += uint64(countBindings(entry.Ports))
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return []metrics.Family{
+		{
+			Name:    metrics.Namespace + "tracked_ports",
+			Help:    "Number of port bindings that are forwarded, by source.",
+			Type:    metrics.TypeGauge,
+			Samples: sourceSamples(ports),
+		},
+		{
+			Name:    metrics.Namespace + "port_adds_total",
+			Help:    "Number of port mappings that were added or updated, by source.",
+			Type:    metrics.TypeCounter,
+			Samples: sourceSamples(m.adds),
+		},
+		{
+			Name:    metrics.Namespace + "port_removes_total",
+			Help:    "Number of port mappings that were removed, by source.",
+			Type:    metrics.TypeCounter,
+			Samples: sourceSamples(m.removes),
+		},
+	}
+}
+
+// Collect returns the number of the blocked attempts to forward a port by
+// source for the Prometheus endpoint, see metrics.Registry.
+func (f *FilterTracker) Collect() []metrics.Family {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return []metrics.Family{
+		{
+			Name:    metrics.Namespace + "blocked_ports_total",
+			Help:    "Number of the attempts to forward a blocked port, by source.",
+			Type:    metrics.TypeCounter,
+			Samples: sourceSamples(f.blocked),
+		},
+	}
+}
+
+// Collect returns the metrics of the listeners for the Prometheus endpoint, see metrics.Registry.
+func (l *ListenerTracker) Collect() []metrics.Family {
+	return []metrics.Family{
+		{
+			Name:    metrics.Namespace + "listeners",
+			Help:    "Number of the listeners that back the forwarded ports in the VM.",
+			Type:    metrics.TypeGauge,
+			Samples: []metrics.Sample{{Value: float64(len(l.Listeners()))}},
+		},
+	}
+}
+
+// sourceSamples returns the counts as samples that are labelled with their source, sorted.
+func sourceSamples(counts map[string]uint64) []metrics.Sample {
+	sources := make([]string, 0, len(counts))
+	for source := range counts {
+		sources = append(sources, source)
+	}
+
+	sort.Strings(sources)
+
+	samples := make([]metrics.Sample, 0, len(sources))
+	for _, source := range sources {
+		samples = append(samples, metrics.Sample{
+			Labels: []metrics.Label{{Name: "source", Value: source}},
+			Value:  float64(counts[source]),
+		})
+	}
+
+	return samples
+}
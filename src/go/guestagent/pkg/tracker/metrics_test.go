@@ -0,0 +1,100 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/metrics"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsTracker(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	metricsTracker := tracker.NewMetricsTracker(vtunnelTracker)
+
+	portMapping := func(ports ...int) nat.PortMap {
+		portMap := make(nat.PortMap)
+		for _, port := range ports {
+			portMap[nat.Port(strconv.Itoa(port)+"/tcp")] = []nat.PortBinding{
+				{
+					HostIP:   hostIP,
+					HostPort: strconv.Itoa(port),
+				},
+			}
+		}
+
+		return portMap
+	}
+
+	// A port that flaps is counted every time.
+	for range 3 {
+		require.NoError(t, metricsTracker.Add(context.Background(), containerID, portMapping(80, 443), tracker.WithSource(tracker.SourceDocker)))
+		require.NoError(t, metricsTracker.Remove(context.Background(), containerID))
+	}
+
+	require.NoError(t, metricsTracker.Add(context.Background(), containerID, portMapping(80, 443), tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, metricsTracker.Add(context.Background(), containerID2, portMapping(30080),
+		tracker.WithSource(tracker.SourceKubernetes)))
+	require.NoError(t, vtunnelTracker.AddListener(context.Background(), net.IPv4(127, 0, 0, 1), 0))
+
+	// Removing an entry that is not tracked is not counted.
+	require.NoError(t, metricsTracker.Remove(context.Background(), "unknown"))
+
+	registry := metrics.NewRegistry()
+	registry.Register(metricsTracker, vtunnelTracker.ListenerTracker)
+
+	var output strings.Builder
+
+	require.NoError(t, registry.Write(&output))
+	assert.Equal(t, `# HELP rd_guestagent_listeners Number of the listeners that back the forwarded ports in the VM.
+# TYPE rd_guestagent_listeners gauge
+rd_guestagent_listeners 1
+# HELP rd_guestagent_port_adds_total Number of port mappings that were added or updated, by source.
+# TYPE rd_guestagent_port_adds_total counter
+rd_guestagent_port_adds_total{source="docker"} 4
+rd_guestagent_port_adds_total{source="kubernetes"} 1
+# HELP rd_guestagent_port_removes_total Number of port mappings that were removed, by source.
+# TYPE rd_guestagent_port_removes_total counter
+rd_guestagent_port_removes_total{source="docker"} 3
+# HELP rd_guestagent_tracked_ports Number of port bindings that are forwarded, by source.
+# TYPE rd_guestagent_tracked_ports gauge
+rd_guestagent_tracked_ports{source="docker"} 2
+rd_guestagent_tracked_ports{source="kubernetes"} 1
+`, output.String())
+
+	// The entries that RemoveAll removes are counted as well.
+	require.NoError(t, metricsTracker.RemoveAll(context.Background()))
+	require.NoError(t, vtunnelTracker.RemoveListener(context.Background(), net.IPv4(127, 0, 0, 1), 0))
+
+	output.Reset()
+	require.NoError(t, registry.Write(&output))
+	assert.Contains(t, output.String(), "\nrd_guestagent_port_removes_total{source=\"docker\"} 4\n"+
+		"rd_guestagent_port_removes_total{source=\"kubernetes\"} 1\n")
+	assert.Contains(t, output.String(), "\nrd_guestagent_listeners 0\n")
+	assert.Contains(t, output.String(), "# TYPE rd_guestagent_tracked_ports gauge\n")
+	assert.NotContains(t, output.String(), "rd_guestagent_tracked_ports{")
+}
@@ -0,0 +1,66 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import "context"
+
+// Nudger hints the sources that poll for the port mappings, e.g. the
+// iptables scans, that they are about to change, since the sources that are
+// told about the changes, e.g. the Docker events, learn about them first.
+type Nudger struct {
+	nudges chan struct{}
+}
+
+// NewNudger returns a nudger whose nudges are not sent yet.
+func NewNudger() *Nudger {
+	return &Nudger{nudges: make(chan struct{}, 1)}
+}
+
+// Nudge sends a nudge, unless the last one was not received yet; a nil
+// nudger has no effect.
+func (n *Nudger) Nudge() {
+	if n == nil {
+		return
+	}
+
+	select {
+	case n.nudges <- struct{}{}:
+	default:
+	}
+}
+
+// Nudges returns the channel that the nudges are received from, which is
+// nil for a nil nudger.
+func (n *Nudger) Nudges() <-chan struct{} {
+	if n == nil {
+		return nil
+	}
+
+	return n.nudges
+}
+
+// nudgerKey is the key of the nudger of a context.
+type nudgerKey struct{}
+
+// ContextWithNudger returns a context that the events of the source nudge
+// the nudger with, see Nudge.
+func ContextWithNudger(ctx context.Context, nudger *Nudger) context.Context {
+	return context.WithValue(ctx, nudgerKey{}, nudger)
+}
+
+// Nudge nudges the nudger of the context, which has no effect if it has none.
+func Nudge(ctx context.Context) {
+	nudger, _ := ctx.Value(nudgerKey{}).(*Nudger)
+	nudger.Nudge()
+}
@@ -0,0 +1,42 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNudger(t *testing.T) {
+	t.Parallel()
+
+	nudger := tracker.NewNudger()
+	ctx := tracker.ContextWithNudger(context.Background(), nudger)
+
+	// The nudges that were not received yet are merged, rather than blocking the events.
+	tracker.Nudge(ctx)
+	tracker.Nudge(ctx)
+	assert.Len(t, nudger.Nudges(), 1)
+
+	<-nudger.Nudges()
+	assert.Empty(t, nudger.Nudges())
+
+	// The contexts without a nudger, and the nil nudgers, have no effect.
+	tracker.Nudge(context.Background())
+	tracker.Nudge(tracker.ContextWithNudger(context.Background(), nil))
+	assert.Nil(t, (*tracker.Nudger)(nil).Nudges())
+}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"context"
+	"strings"
+)
+
+// Kinds of the objects that the port mappings and the listeners originate from.
+const (
+	OriginContainer = "container"
+	OriginService   = "service"
+	OriginRule      = "iptables-rule"
+	// OriginListener is the kind of the listeners of the loopback that are relayed.
+	OriginListener = "loopback-listener"
+	// OriginRequest is the kind of the admin API requests.
+	OriginRequest = "request"
+)
+
+// shortIDLength is the length of the container IDs in the summaries, like docker ps.
+const shortIDLength = 12
+
+// Origin describes the object that a port mapping or a listener was added
+// for, as it was at the time, so that a snapshot of the tracked ports tells
+// why each of them is forwarded without the logs of its event.
+type Origin struct {
+	// Kind is the kind of the object, e.g. OriginContainer.
+	Kind string `json:"kind"`
+	// ID is the ID of the object, e.g. a container ID or a service UID.
+	ID string `json:"id,omitempty"`
+	// Namespace is the namespace of the object, e.g. of a Kubernetes service
+	// or of a containerd container.
+	Namespace string `json:"namespace,omitempty"`
+	// Name is the name of the object, e.g. a container name, a service name,
+	// the iptables chain of a rule, the address of a relayed listener, or the
+	// path of a request.
+	Name string `json:"name,omitempty"`
+	// Rule is the text of the iptables rule, as listed by iptables -S.
+	Rule string `json:"rule,omitempty"`
+}
+
+// IsZero returns true if the origin is not known.
+func (o Origin) IsZero() bool {
+	return o == Origin{}
+}
+
+// String describes the origin for the humans, e.g. "container nginx (3f9a1c07ab12)",
+// "service default/web" or "iptables-rule -A CNI-DN-2e2f8 -p tcp -m tcp --dport 8081 -j DNAT".
+func (o Origin) String() string {
+	switch {
+	case o.Rule != "":
+		return o.Kind + " " + o.Rule
+	case o.Kind == OriginContainer && o.Name != "" && o.ID != "":
+		return o.Kind + " " + o.Short() + " (" + o.shortID() + ")"
+	default:
+		return strings.TrimSpace(o.Kind + " " + o.Short())
+	}
+}
+
+// Short names the object of the origin in a single word, e.g. "nginx",
+// "default/web" or "CNI-DN-2e2f8", for the summaries.
+func (o Origin) Short() string {
+	switch {
+	case o.Name == "":
+		return o.shortID()
+	case o.Namespace != "":
+		return o.Namespace + "/" + o.Name
+	default:
+		return o.Name
+	}
+}
+
+// shortID returns the ID of the origin, the container IDs are shortened.
+func (o Origin) shortID() string {
+	if o.Kind == OriginContainer && len(o.ID) > shortIDLength {
+		return o.ID[:shortIDLength]
+	}
+
+	return o.ID
+}
+
+// WithOrigin sets the object that the port mapping is added for, see Origin.
+func WithOrigin(origin Origin) EntryOption {
+	return func(e *Entry) {
+		if origin.IsZero() {
+			e.Origin = nil
+		} else {
+			e.Origin = &origin
+		}
+	}
+}
+
+// originKey is the key of the origin of a context.
+type originKey struct{}
+
+// ContextWithOrigin returns a context that carries the object that the
+// listeners are opened for, see NetTracker.AddListener.
+func ContextWithOrigin(ctx context.Context, origin Origin) context.Context {
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+// OriginFromContext returns the origin of the context, which is zero if it has none.
+func OriginFromContext(ctx context.Context) Origin {
+	origin, _ := ctx.Value(originKey{}).(Origin)
+
+	return origin
+}
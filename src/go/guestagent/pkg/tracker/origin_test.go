@@ -0,0 +1,119 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginString(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		origin tracker.Origin
+		want   string
+		short  string
+	}{
+		{
+			origin: tracker.Origin{Kind: tracker.OriginContainer, ID: "3f9a1c07ab12cd34ef56", Name: "nginx"},
+			want:   "container nginx (3f9a1c07ab12)",
+			short:  "nginx",
+		},
+		{
+			origin: tracker.Origin{Kind: tracker.OriginContainer, ID: "3f9a1c07ab12cd34ef56"},
+			want:   "container 3f9a1c07ab12",
+			short:  "3f9a1c07ab12",
+		},
+		{
+			origin: tracker.Origin{Kind: tracker.OriginService, ID: "0b5f", Namespace: "default", Name: "web"},
+			want:   "service default/web",
+			short:  "default/web",
+		},
+		{
+			origin: tracker.Origin{Kind: tracker.OriginRule, Name: "CNI-DN-2e2f8", Rule: "-A CNI-DN-2e2f8 -p tcp -m tcp --dport 8081 -j DNAT"},
+			want:   "iptables-rule -A CNI-DN-2e2f8 -p tcp -m tcp --dport 8081 -j DNAT",
+			short:  "CNI-DN-2e2f8",
+		},
+		{
+			origin: tracker.Origin{Kind: tracker.OriginRule},
+			want:   "iptables-rule",
+			short:  "",
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, test.origin.String())
+		assert.Equal(t, test.short, test.origin.Short(), test.want)
+	}
+
+	assert.True(t, tracker.Origin{}.IsZero())
+}
+
+func TestWithOrigin(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	vtunnelTracker := tracker.NewVTunnelTracker(&testForwarder{}, wslConnectAddr)
+	vtunnelTracker.EnableDryRun()
+
+	origin := tracker.Origin{Kind: tracker.OriginContainer, ID: "web", Name: "web-1"}
+	portMap := nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: "8080"}}}
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "web", portMap, tracker.WithSource(tracker.SourceDocker),
+		tracker.WithOrigin(origin)))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "db", portMap, tracker.WithSource(tracker.SourceDocker)))
+
+	entries := vtunnelTracker.List()
+	require.Len(t, entries, 2)
+	assert.Nil(t, entries[0].Origin, "db has no origin")
+	require.NotNil(t, entries[1].Origin)
+	assert.Equal(t, origin, *entries[1].Origin)
+
+	// The entries are copies, mutating their origin does not change the tracker's.
+	entries[1].Origin.Name = "changed"
+	assert.Equal(t, origin, *vtunnelTracker.List()[1].Origin)
+}
+
+func TestListenerTrackerOrigins(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	vtunnelTracker := tracker.NewVTunnelTracker(&testForwarder{}, wslConnectAddr)
+	vtunnelTracker.EnableDryRun()
+	filterTracker := tracker.NewFilterTracker(vtunnelTracker, mustParsePortFilter(t, "", ""))
+
+	origin := tracker.Origin{Kind: tracker.OriginService, ID: "0b5f", Namespace: "default", Name: "web"}
+	ctx := tracker.ContextWithOrigin(context.Background(), origin)
+
+	require.NoError(t, filterTracker.AddListener(ctx, net.IPv4zero, 30080))
+	require.NoError(t, filterTracker.AddListener(context.Background(), net.IPv4zero, 8080))
+	assert.Equal(t, map[string]tracker.Origin{"0.0.0.0:30080": origin}, vtunnelTracker.ListenerOrigins())
+
+	// The listeners that the filter opens again keep their origin.
+	require.NoError(t, filterTracker.SetFilter(mustParsePortFilter(t, "", "30080")))
+	assert.Empty(t, vtunnelTracker.ListenerOrigins())
+	require.NoError(t, filterTracker.SetFilter(mustParsePortFilter(t, "", "")))
+	assert.Equal(t, map[string]tracker.Origin{"0.0.0.0:30080": origin}, vtunnelTracker.ListenerOrigins())
+
+	require.NoError(t, filterTracker.RemoveListener(ctx, net.IPv4zero, 30080))
+	assert.Empty(t, vtunnelTracker.ListenerOrigins())
+}
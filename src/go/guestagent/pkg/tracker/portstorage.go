@@ -14,73 +14,499 @@ limitations under the License.
 package tracker
 
 import (
+	"reflect"
+	"sort"
 	"sync"
+	"time"
 
-	"github.com/Masterminds/log-go"
 	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
 )
 
 // portStorage is responsible for storing all the port mappings.
 type portStorage struct {
 	// container ID is the key for both docker and containerd
-	portmap map[string]nat.PortMap
+	entries map[string]*Entry
+	// entriesPeak is the peak size of entries, see deleteCompacted.
+	entriesPeak int
+	// holders holds the IDs of the entries that hold each host binding,
+	// keyed by hostBindingKey, so that the entries that share the bindings
+	// of a changed one are found without going through all of them, see
+	// related; holdersPeak is its peak size.
+	holders     map[string]map[string]struct{}
+	holdersPeak int
+	// hostConflicts holds the errors of the port bindings that the
+	// host could not apply, keyed by hostBindingKey.
+	hostConflicts map[string]string
+	// uncounted are the keys of the host conflicts that are not counted yet,
+	// they are counted once the outcome of sending their entry is recorded.
+	uncounted map[string]struct{}
+	// changes counts the outcomes of sending the entries, see setChangeCounter.
+	changes *ChangeCounter
 	mutex   sync.Mutex
+	// broker notifies the subscribers of the changes to the entries.
+	broker *broker
 }
 
 func newPortStorage() *portStorage {
 	return &portStorage{
-		portmap: make(map[string]nat.PortMap),
+		entries:       make(map[string]*Entry),
+		holders:       make(map[string]map[string]struct{}),
+		hostConflicts: make(map[string]string),
+		uncounted:     make(map[string]struct{}),
+		broker:        newBroker(),
 	}
 }
 
-func (p *portStorage) add(containerID string, portMap nat.PortMap) {
+func (p *portStorage) subscribe(bufferSize int, opts ...SubscribeOption) *Subscription {
+	return p.broker.subscribe(bufferSize, opts...)
+}
+
+// publishOutcomes publishes the outcome of sending the action on the entries
+// to the host, for the changes that are not recorded by setSendStatus.
+func (p *portStorage) publishOutcomes(action Action, entries []Entry, err error) {
+	now := time.Now()
+
+	for i := range entries {
+		p.broker.publish(outcomeEvents(action, &entries[i], err, now))
+		p.countChange(entries[i].Source, action, changeOutcome(err))
+	}
+}
+
+// countChange counts the outcome of a change, for the outcomes that are not
+// counted by setSendStatus or setHostResults.
+func (p *portStorage) countChange(source string, action Action, outcome ChangeOutcome) {
 	p.mutex.Lock()
-	p.portmap[containerID] = portMap
-	p.mutex.Unlock()
-	log.Debugf("portStorage add status: %+v", p.portmap)
+	defer p.mutex.Unlock()
+
+	p.changes.Count(source, action, outcome)
 }
 
-func (p *portStorage) get(containerID string) nat.PortMap {
+// setChangeCounter sets the counter of the outcomes of sending the entries.
+func (p *portStorage) setChangeCounter(changes *ChangeCounter) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.changes = changes
+}
+
+// changeOutcome returns the outcome of a change that was sent with the error.
+func changeOutcome(err error) ChangeOutcome {
+	if err != nil {
+		return ChangeForwarderError
+	}
+
+	return ChangeOK
+}
+
+func (p *portStorage) add(containerID string, portMap nat.PortMap, opts ...EntryOption) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+
+	entry, ok := p.entries[containerID]
+	if !ok {
+		entry = &Entry{
+			ID:    containerID,
+			Added: now,
+		}
+		p.entries[containerID] = entry
+	}
+
+	// The options replace the fields rather than mutating
+	// them, so a shallow copy is enough to detect changes.
+	old := *entry
+	oldPorts := entry.Ports
+	p.index(containerID, oldPorts, false)
+	p.index(containerID, portMap, true)
+	entry.Ports = portMap
+	entry.Updated = now
+	entry.Refreshed = now
+	// The time of an earlier event does not tell how long this change takes.
+	entry.EventTime = time.Time{}
+
+	for _, opt := range opts {
+		opt(entry)
+	}
+
+	// The span of the event ends with the change.
+	entry.traceContext = nil
+
+	if !ok || entry.State == "" || changed(&old, entry) {
+		entry.State = StatePending
+	}
+
+	p.broker.publish(diffEvents(entry, oldPorts, portMap, now))
+
+	// The entry is not formatted whole, which is thousands of ports with a port range.
+	logger.Debugf("portStorage add status: [%s] %s with %d ports", containerID, entry.State, len(portMap))
+}
+
+// index records the host bindings of the port mapping as held by the entry,
+// or as no longer held by it unless held is set; the mutex must be held.
+func (p *portStorage) index(containerID string, portMap nat.PortMap, held bool) {
+	for port, bindings := range portMap {
+		for _, binding := range bindings {
+			key := hostBindingKey(port, binding)
+
+			if held {
+				if p.holders[key] == nil {
+					p.holders[key] = make(map[string]struct{}, 1)
+				}
+
+				p.holders[key][containerID] = struct{}{}
+
+				continue
+			}
+
+			delete(p.holders[key], containerID)
+
+			if len(p.holders[key]) == 0 {
+				p.holders = deleteCompacted(p.holders, key, &p.holdersPeak)
+			}
+		}
+	}
+}
+
+// related returns copies of the delivered entries, sorted by their ID, that a
+// change of the entry to the port mapping is compared with by diffEntries:
+// the entry itself, the ones that hold a host binding of either its ports or
+// the port mapping, and the ones with host conflicts, whose bindings are sent
+// again with every change. The other entries would come out of the diff as
+// they went in, so the cost of a change does not grow with all the entries.
+func (p *portStorage) related(containerID string, portMap nat.PortMap) []Entry {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	log.Debugf("portStorage get status: %+v", p.portmap)
+	ids := map[string]struct{}{containerID: {}}
+	addHolders := func(portMap nat.PortMap) {
+		for port, bindings := range portMap {
+			for _, binding := range bindings {
+				for id := range p.holders[hostBindingKey(port, binding)] {
+					ids[id] = struct{}{}
+				}
+			}
+		}
+	}
+
+	if entry, ok := p.entries[containerID]; ok {
+		addHolders(entry.Ports)
+	}
+
+	addHolders(portMap)
+
+	for key := range p.hostConflicts {
+		for id := range p.holders[key] {
+			ids[id] = struct{}{}
+		}
+	}
+
+	entries := make([]Entry, 0, len(ids))
+
+	for _, id := range sortedIDs(ids) {
+		if entry, ok := p.entries[id]; ok && !entry.LastSent.IsZero() {
+			entries = append(entries, p.copyEntry(entry))
+		}
+	}
+
+	return entries
+}
+
+func (p *portStorage) get(containerID string) nat.PortMap {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
 
-	if portMap, ok := p.portmap[containerID]; ok {
-		return portMap
+	if entry, ok := p.entries[containerID]; ok {
+		return entry.Ports
 	}
 
 	return nil
 }
 
+// unchanged returns true if the stored entry with the candidate's ID holds the
+// same port mappings, connect addresses and metadata, and it was successfully
+// sent to the host; in which case sending it again would be a no-op.
+func (p *portStorage) unchanged(candidate Entry) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entry, ok := p.entries[candidate.ID]
+	if !ok || entry.LastSent.IsZero() || entry.LastSendError != "" {
+		return false
+	}
+
+	// The host may be able to apply the conflicting port bindings by now.
+	if p.copyEntry(entry).State == StateHostConflict {
+		return false
+	}
+
+	return !changed(entry, &candidate)
+}
+
+// changed returns true if the entries differ in anything that is sent to the host.
+func changed(a, b *Entry) bool {
+	return !reflect.DeepEqual(a.Ports, b.Ports) ||
+		!reflect.DeepEqual(a.ConnectAddrs, b.ConnectAddrs) ||
+		!reflect.DeepEqual(a.Metadata, b.Metadata)
+}
+
+// getEntry returns a copy of the entry for the given container ID.
+func (p *portStorage) getEntry(containerID string) (Entry, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if entry, ok := p.entries[containerID]; ok {
+		return p.copyEntry(entry), true
+	}
+
+	return Entry{}, false
+}
+
+// getByPort returns a copy of the first entry that has a port binding
+// for the given host port and protocol.
+func (p *portStorage) getByPort(hostPort, protocol string) (Entry, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, entry := range p.entries {
+		if entry.hasPort(hostPort, protocol) {
+			return p.copyEntry(entry), true
+		}
+	}
+
+	return Entry{}, false
+}
+
+// list returns a copy of all the entries sorted by their ID.
+func (p *portStorage) list() []Entry {
+	return p.listFunc(func(*Entry) bool { return true })
+}
+
+// listFunc returns a copy of the entries that keep returns true for, sorted
+// by their ID; the IDs are sorted rather than the copies, which are large to
+// swap, and only the entries that are kept are copied.
+func (p *portStorage) listFunc(keep func(entry *Entry) bool) []Entry {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entries := make([]Entry, 0, len(p.entries))
+
+	for _, id := range sortedIDs(p.entries) {
+		if entry := p.entries[id]; keep(entry) {
+			entries = append(entries, p.copyEntry(entry))
+		}
+	}
+
+	return entries
+}
+
+// refresh renews the lease of the entry for the given container ID,
+// it returns false if the entry does not exist.
+func (p *portStorage) refresh(containerID string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entry, ok := p.entries[containerID]
+	if !ok {
+		return false
+	}
+
+	entry.Refreshed = time.Now()
+	entry.Leased = true
+
+	return true
+}
+
+// setSendStatus records the outcome of sending the entry for the given
+// container ID to the host, and publishes it when it changed.
+func (p *portStorage) setSendStatus(containerID string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entry, ok := p.entries[containerID]
+	if !ok {
+		return
+	}
+
+	state, lastSendError := entry.State, entry.LastSendError
+	now := time.Now()
+
+	if err != nil {
+		entry.State = StateFailed
+		entry.LastSendError = err.Error()
+	} else {
+		entry.State = StateSent
+		entry.LastSent = now
+		entry.LastSendError = ""
+	}
+
+	// The entries that are sent again unchanged, e.g. by a resync, are not counted again.
+	if entry.State != state || entry.LastSendError != lastSendError {
+		p.broker.publish(outcomeEvents(ActionAdd, entry, err, now))
+		p.changes.Count(entry.Source, ActionAdd, changeOutcome(err))
+	}
+
+	for port, bindings := range entry.Ports {
+		for _, binding := range bindings {
+			key := hostBindingKey(port, binding)
+			if _, ok := p.uncounted[key]; ok {
+				delete(p.uncounted, key)
+				p.changes.Count(entry.Source, ActionAdd, ChangeConflict)
+			}
+		}
+	}
+}
+
+// setHostResults records the port bindings that the host could not apply,
+// and forgets about the earlier errors of the ones that it applied.
+func (p *portStorage) setHostResults(results []forwarder.PortResult) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, result := range results {
+		key := hostBindingKey(result.Port, result.Binding)
+		if result.Err != nil {
+			// The conflicts that the host reports again on a resync are not counted again.
+			if old, ok := p.hostConflicts[key]; !ok || old != result.Err.Error() {
+				p.uncounted[key] = struct{}{}
+			}
+
+			p.hostConflicts[key] = result.Err.Error()
+
+			continue
+		}
+
+		delete(p.hostConflicts, key)
+		delete(p.uncounted, key)
+	}
+}
+
+// clearHostConflicts forgets about the errors of the given port bindings,
+// once they were removed from the host.
+func (p *portStorage) clearHostConflicts(portMap nat.PortMap) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for port, bindings := range portMap {
+		for _, binding := range bindings {
+			delete(p.hostConflicts, hostBindingKey(port, binding))
+			delete(p.uncounted, hostBindingKey(port, binding))
+		}
+	}
+}
+
+// copyEntry returns a copy of the entry with its host conflicts,
+// it must be called with the mutex held.
+func (p *portStorage) copyEntry(entry *Entry) Entry {
+	copied := entry.copy()
+
+	for port, bindings := range entry.Ports {
+		for _, binding := range bindings {
+			key := hostBindingKey(port, binding)
+			if conflict, ok := p.hostConflicts[key]; ok {
+				if copied.HostConflicts == nil {
+					copied.HostConflicts = make(map[string]string)
+				}
+
+				copied.HostConflicts[key] = conflict
+			}
+		}
+	}
+
+	if copied.State == StateSent && len(copied.HostConflicts) != 0 {
+		copied.State = StateHostConflict
+	}
+
+	return copied
+}
+
+// failed returns a copy of the entries that could not be sent to the host.
+func (p *portStorage) failed() []Entry {
+	return p.listFunc(func(entry *Entry) bool { return entry.State == StateFailed })
+}
+
+// delivered returns a copy of the entries that the host has learned about,
+// sorted by their ID.
+func (p *portStorage) delivered() []Entry {
+	return p.listFunc(func(entry *Entry) bool { return !entry.LastSent.IsZero() })
+}
+
+// setConnectAddrs records the backend addresses for all the entries,
+// after they have changed.
+func (p *portStorage) setConnectAddrs(connectAddrs []types.ConnectAddrs) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, entry := range p.entries {
+		entry.ConnectAddrs = connectAddrs
+	}
+}
+
 func (p *portStorage) removeAll() {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	for containerID, portMap := range p.portmap {
-		log.Debugf("removing the following container [%s] port binding: %+v", containerID, portMap)
-		delete(p.portmap, containerID)
+	now := time.Now()
+
+	// A line for each of them would be thousands of lines with a port range.
+	logger.Debugf("removing the port bindings of %d port mappings", len(p.entries))
+
+	for _, entry := range p.entries {
+		p.broker.publish(diffEvents(entry, entry.Ports, nil, now))
 	}
+
+	// The maps are recreated, since clearing them would keep their size.
+	p.entries = make(map[string]*Entry)
+	p.entriesPeak = 0
+	p.holders = make(map[string]map[string]struct{})
+	p.holdersPeak = 0
+	p.hostConflicts = make(map[string]string)
+	p.uncounted = make(map[string]struct{})
 }
 
 func (p *portStorage) getAll() map[string]nat.PortMap {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	portMappings := make(map[string]nat.PortMap, len(p.portmap))
+	portMappings := make(map[string]nat.PortMap, len(p.entries))
 
-	for k, v := range p.portmap {
-		portMappings[k] = copyPortMap(v)
+	for k, v := range p.entries {
+		portMappings[k] = copyPortMap(v.Ports)
 	}
 
 	return portMappings
 }
 
+// sortedIDs returns the container IDs that key the given map in sorted order,
+// so that the entries are always merged in a stable order.
+func sortedIDs[V any](m map[string]V) []string {
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids
+}
+
 func copyPortMap(m nat.PortMap) nat.PortMap {
+	if m == nil {
+		return nil
+	}
+
 	portMap := make(nat.PortMap, len(m))
 
 	for k, v := range m {
-		portMap[k] = v
+		if v == nil {
+			portMap[k] = nil
+
+			continue
+		}
+
+		portMap[k] = append(make([]nat.PortBinding, 0, len(v)), v...)
 	}
 
 	return portMap
@@ -89,6 +515,12 @@ func copyPortMap(m nat.PortMap) nat.PortMap {
 func (p *portStorage) remove(containerID string) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
-	delete(p.portmap, containerID)
-	log.Debugf("portStorage remove status: %+v", p.portmap)
+
+	if entry, ok := p.entries[containerID]; ok {
+		p.index(containerID, entry.Ports, false)
+		p.entries = deleteCompacted(p.entries, containerID, &p.entriesPeak)
+		p.broker.publish(diffEvents(entry, entry.Ports, nil, time.Now()))
+	}
+
+	logger.Debugf("portStorage remove status: %d entries left", len(p.entries))
 }
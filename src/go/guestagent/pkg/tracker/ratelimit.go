@@ -0,0 +1,72 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// EnableRateLimit limits the batches that are sent to the forwarder to
+// perSecond, with bursts of up to burst batches. A batch that is over the
+// limit is postponed rather than dropped, so the changes that arrive in the
+// meantime collapse into it; since every batch sends its removals first, a
+// removal is never delayed by more than one batch. Only the batches that are
+// sent when their window elapses are limited, an explicit Flush is not, and
+// the limit has no effect unless batching is enabled.
+func (p *VTunnelTracker) EnableRateLimit(perSecond float64, burst int) {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	p.limiter = rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// Throttled returns the number of batches that were
+// postponed beyond their window because of the rate limit.
+func (p *VTunnelTracker) Throttled() uint64 {
+	return p.throttled.Load()
+}
+
+// batchDelay returns how long to wait before sending the next batch,
+// which is the batch window unless the rate limit calls for a longer
+// wait. The batchMutex must be held.
+func (p *VTunnelTracker) batchDelay() time.Duration {
+	if p.limiter == nil {
+		return p.batchWindow
+	}
+
+	p.reservation = p.limiter.Reserve()
+
+	delay := p.reservation.Delay()
+	if delay <= p.batchWindow {
+		return p.batchWindow
+	}
+
+	p.throttled.Add(1)
+	logger.Debugf("port mappings batch is rate limited, sending it in %s", delay)
+
+	return delay
+}
+
+// stopBatchTimer stops the timer of the pending batch, and gives back its
+// rate limit reservation if the batch is sent early. The batchMutex must be held.
+func (p *VTunnelTracker) stopBatchTimer() {
+	if p.batchTimer != nil && p.batchTimer.Stop() && p.reservation != nil {
+		p.reservation.Cancel()
+	}
+
+	p.batchTimer = nil
+	p.reservation = nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hostState replays the payloads that the forwarder received,
+// and returns the port mappings that the host ends up with.
+func hostState(received []types.PortMapping) nat.PortMap {
+	state := make(nat.PortMap)
+
+	for _, portMapping := range received {
+		for port, bindings := range portMapping.Ports {
+			if portMapping.Remove {
+				delete(state, port)
+			} else {
+				state[port] = bindings
+			}
+		}
+	}
+
+	return state
+}
+
+func testPortMap(port int) nat.PortMap {
+	return nat.PortMap{
+		nat.Port(strconv.Itoa(port) + "/tcp"): []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: strconv.Itoa(port),
+			},
+		},
+	}
+}
+
+func TestVTunnelTrackerRateLimit(t *testing.T) {
+	t.Parallel()
+
+	const (
+		containers = 100
+		updates    = 10000
+		perSecond  = 50
+		burst      = 1
+	)
+
+	forwarder := testForwarder{bulk: true}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+	vtunnelTracker.EnableBatching(time.Millisecond)
+	vtunnelTracker.EnableRateLimit(perSecond, burst)
+	vtunnelTracker.SetPeerBatches(func() bool { return true })
+
+	expected := make(nat.PortMap)
+	start := time.Now()
+
+	for i := 0; i < updates; i++ {
+		id := i % containers
+
+		// The updates are spread over several batch windows.
+		if id == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		portMap := testPortMap(8000 + id)
+
+		if (i/containers+id)%2 == 0 {
+			require.NoError(t, vtunnelTracker.Add(context.Background(), containerID+strconv.Itoa(id), portMap))
+
+			for port, bindings := range portMap {
+				expected[port] = bindings
+			}
+		} else {
+			require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID+strconv.Itoa(id)))
+
+			for port := range portMap {
+				delete(expected, port)
+			}
+		}
+	}
+
+	require.NotEmpty(t, expected)
+
+	// The changes that were held back by the limit are all sent eventually.
+	require.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual(expected, hostState(forwarder.received()))
+	}, 5*time.Second, 10*time.Millisecond)
+
+	elapsed := time.Since(start)
+
+	// Every batch sends at most a removal and an addition.
+	maxSends := 2 * (burst + int(elapsed.Seconds()*perSecond) + 1)
+	assert.LessOrEqual(t, len(forwarder.received()), maxSends)
+	assert.NotZero(t, vtunnelTracker.Throttled())
+}
+
+func TestVTunnelTrackerRateLimitRemovals(t *testing.T) {
+	t.Parallel()
+
+	forwarder := testForwarder{bulk: true}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+	vtunnelTracker.EnableBatching(time.Millisecond)
+	vtunnelTracker.EnableRateLimit(10, 1)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, testPortMap(8000)))
+	require.Eventually(t, func() bool {
+		return len(forwarder.received()) == 1
+	}, time.Second, time.Millisecond)
+
+	// The batch is postponed by the limit, and the removal that arrives
+	// meanwhile is sent in it ahead of the addition.
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, testPortMap(8001)))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+	require.Eventually(t, func() bool {
+		return len(forwarder.received()) == 3
+	}, time.Second, time.Millisecond)
+
+	received := forwarder.received()
+	assert.True(t, received[1].Remove)
+	assert.Equal(t, testPortMap(8000), received[1].Ports)
+	assert.False(t, received[2].Remove)
+	assert.Equal(t, testPortMap(8001), received[2].Ports)
+	assert.Equal(t, uint64(1), vtunnelTracker.Throttled())
+
+	// An explicit flush is not limited.
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, testPortMap(8000)))
+	require.NoError(t, vtunnelTracker.Flush())
+	assert.Len(t, forwarder.received(), 4)
+}
@@ -0,0 +1,294 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+)
+
+// RemapMetadataPrefix prefixes the metadata keys that record the original
+// host port of a remapped port binding, e.g. "remap:8080/tcp" is set to "80"
+// when the host port 80 was remapped to 8080.
+const RemapMetadataPrefix = "remap:"
+
+const maxPort = 65535
+
+var (
+	ErrInvalidRemapRule = errors.New("invalid port remap rule")
+	ErrRemapCollision   = errors.New("remapped port collides with an existing port")
+)
+
+// remapRule translates the host ports within [first, last], either by
+// adding offset to them, or to the exact target port.
+type remapRule struct {
+	first  int
+	last   int
+	offset int
+	target int
+}
+
+// RemapTable translates the host ports of the port mappings before they
+// reach the forwarder, the first matching rule is applied.
+type RemapTable struct {
+	rules []remapRule
+}
+
+// ParseRemapTable parses a comma separated list of remap rules, a rule is
+// either an offset applied to a port range (e.g. "80-99:+8000") or an exact
+// port translation (e.g. "5432:15432").
+func ParseRemapTable(spec string) (*RemapTable, error) {
+	table := &RemapTable{}
+
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		rule, err := parseRemapRule(field)
+		if err != nil {
+			return nil, err
+		}
+
+		table.rules = append(table.rules, rule)
+	}
+
+	return table, nil
+}
+
+func parseRemapRule(field string) (remapRule, error) {
+	from, to, ok := strings.Cut(field, ":")
+	if !ok {
+		return remapRule{}, fmt.Errorf("%w: %q is missing the target", ErrInvalidRemapRule, field)
+	}
+
+	var rule remapRule
+
+	first, last, isRange := strings.Cut(from, "-")
+
+	var err error
+	if rule.first, err = parsePort(first); err != nil {
+		return remapRule{}, fmt.Errorf("%w: %q: %w", ErrInvalidRemapRule, field, err)
+	}
+
+	rule.last = rule.first
+	if isRange {
+		if rule.last, err = parsePort(last); err != nil {
+			return remapRule{}, fmt.Errorf("%w: %q: %w", ErrInvalidRemapRule, field, err)
+		}
+	}
+
+	if rule.last < rule.first {
+		return remapRule{}, fmt.Errorf("%w: %q has an empty range", ErrInvalidRemapRule, field)
+	}
+
+	if strings.HasPrefix(to, "+") || strings.HasPrefix(to, "-") {
+		if rule.offset, err = strconv.Atoi(to); err != nil {
+			return remapRule{}, fmt.Errorf("%w: %q: %w", ErrInvalidRemapRule, field, err)
+		}
+
+		if rule.first+rule.offset < 1 || rule.last+rule.offset > maxPort {
+			return remapRule{}, fmt.Errorf("%w: %q remaps ports out of range", ErrInvalidRemapRule, field)
+		}
+
+		return rule, nil
+	}
+
+	if isRange {
+		return remapRule{}, fmt.Errorf("%w: %q maps a range to a single port", ErrInvalidRemapRule, field)
+	}
+
+	if rule.target, err = parsePort(to); err != nil {
+		return remapRule{}, fmt.Errorf("%w: %q: %w", ErrInvalidRemapRule, field, err)
+	}
+
+	return rule, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if port < 1 || port > maxPort {
+		return 0, fmt.Errorf("port %d is out of range", port)
+	}
+
+	return port, nil
+}
+
+// Remap returns the translated host port, and whether any rule matched it.
+func (r *RemapTable) Remap(hostPort string) (string, bool) {
+	port, err := strconv.Atoi(hostPort)
+	if err != nil {
+		return hostPort, false
+	}
+
+	for _, rule := range r.rules {
+		if port < rule.first || port > rule.last {
+			continue
+		}
+
+		if rule.target != 0 {
+			return strconv.Itoa(rule.target), true
+		}
+
+		return strconv.Itoa(port + rule.offset), true
+	}
+
+	return hostPort, false
+}
+
+// RemapTracker applies a RemapTable to the port mappings that are added to
+// the underlying tracker, the original host ports are recorded in the
+// entry's metadata.
+type RemapTracker struct {
+	Tracker
+	table *RemapTable
+}
+
+// NewRemapTracker wraps the given tracker to remap the host ports using the table.
+func NewRemapTracker(tracker Tracker, table *RemapTable) *RemapTracker {
+	return &RemapTracker{
+		Tracker: tracker,
+		table:   table,
+	}
+}
+
+// Add remaps the host ports of the port mapping and adds it to the
+// underlying tracker. The bindings whose remapped port collides with
+// another binding are dropped and reported with ErrRemapCollision.
+func (r *RemapTracker) Add(ctx context.Context, containerID string, portMap nat.PortMap, opts ...EntryOption) error {
+	remapped := make(nat.PortMap, len(portMap))
+	metadata := make(map[string]string)
+	seen := make(map[string]struct{})
+
+	var collisions []string
+
+	for port, bindings := range portMap {
+		for _, binding := range bindings {
+			seen[port.Proto()+"/"+binding.HostIP+"/"+binding.HostPort] = struct{}{}
+		}
+	}
+
+	for _, port := range sortedPorts(portMap) {
+		bindings := portMap[port]
+		if bindings == nil {
+			remapped[port] = nil
+
+			continue
+		}
+
+		remapped[port] = make([]nat.PortBinding, 0, len(bindings))
+
+		for _, binding := range bindings {
+			hostPort, ok := r.table.Remap(binding.HostPort)
+			if !ok || hostPort == binding.HostPort {
+				remapped[port] = append(remapped[port], binding)
+
+				continue
+			}
+
+			key := port.Proto() + "/" + binding.HostIP + "/" + hostPort
+			if _, ok := seen[key]; ok || r.collides(containerID, hostPort, port.Proto()) {
+				collisions = append(collisions,
+					fmt.Sprintf("%s/%s -> %s/%s", binding.HostPort, port.Proto(), hostPort, port.Proto()))
+
+				continue
+			}
+
+			seen[key] = struct{}{}
+
+			logger.Debugw("remapping the host port", logging.Fields(
+				logging.Port(binding.HostPort),
+				logging.Protocol(port.Proto()),
+				logging.ID(containerID),
+				log.Fields{"remappedPort": hostPort},
+			))
+			metadata[RemapMetadataPrefix+hostPort+"/"+port.Proto()] = binding.HostPort
+			binding.HostPort = hostPort
+			remapped[port] = append(remapped[port], binding)
+		}
+	}
+
+	opts = append(opts, withRemapMetadata(metadata))
+
+	if err := r.Tracker.Add(ctx, containerID, remapped, opts...); err != nil {
+		return err
+	}
+
+	if len(collisions) != 0 {
+		return fmt.Errorf("%w: %s", ErrRemapCollision, strings.Join(collisions, ", "))
+	}
+
+	return nil
+}
+
+// withRemapMetadata replaces the remapped ports that are recorded in the
+// entry's metadata, while leaving any other metadata untouched.
+func withRemapMetadata(remaps map[string]string) EntryOption {
+	return func(e *Entry) {
+		metadata := make(map[string]string, len(e.Metadata)+len(remaps))
+
+		for k, v := range e.Metadata {
+			if !strings.HasPrefix(k, RemapMetadataPrefix) {
+				metadata[k] = v
+			}
+		}
+
+		for k, v := range remaps {
+			metadata[k] = v
+		}
+
+		if len(metadata) == 0 {
+			metadata = nil
+		}
+
+		e.Metadata = metadata
+	}
+}
+
+// collides returns true if another entry already holds the host port.
+func (r *RemapTracker) collides(containerID, hostPort, protocol string) bool {
+	entry, ok := r.Tracker.GetByPort(hostPort, protocol)
+
+	return ok && entry.ID != containerID
+}
+
+func sortedPorts(portMap nat.PortMap) []nat.Port {
+	ports := make([]nat.Port, 0, len(portMap))
+	for port := range portMap {
+		ports = append(ports, port)
+	}
+
+	nat.Sort(ports, func(i, j nat.Port) bool {
+		return i < j
+	})
+
+	return ports
+}
+
+// Flush sends the pending changes of the underlying tracker, if it defers them.
+func (r *RemapTracker) Flush() error {
+	return flush(r.Tracker)
+}
@@ -0,0 +1,178 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRemapTable(t *testing.T) {
+	t.Parallel()
+
+	table, err := tracker.ParseRemapTable("80-99:+8000, 5432:15432,9000-9010:-1000")
+	require.NoError(t, err)
+
+	for hostPort, expected := range map[string]string{
+		"80":   "8080",
+		"99":   "8099",
+		"5432": "15432",
+		"9005": "8005",
+	} {
+		remapped, ok := table.Remap(hostPort)
+		assert.True(t, ok, hostPort)
+		assert.Equal(t, expected, remapped, hostPort)
+	}
+
+	remapped, ok := table.Remap("100")
+	assert.False(t, ok)
+	assert.Equal(t, "100", remapped)
+
+	for _, spec := range []string{
+		"80",
+		"80-79:+1",
+		"80-99:8080",
+		"65535:+1",
+		"0:80",
+		"http:80",
+	} {
+		_, err := tracker.ParseRemapTable(spec)
+		require.ErrorIs(t, err, tracker.ErrInvalidRemapRule, spec)
+	}
+}
+
+func TestRemapTracker(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	table, err := tracker.ParseRemapTable("80-99:+8000,5432:15432")
+	require.NoError(t, err)
+
+	remapTracker := tracker.NewRemapTracker(tracker.NewVTunnelTracker(&forwarder, wslConnectAddr), table)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+		"5432/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: "5432",
+			},
+		},
+		"443/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort2,
+			},
+		},
+	}
+	err = remapTracker.Add(context.Background(), containerID, portMapping, tracker.WithMetadata(map[string]string{"name": "web"}))
+	require.NoError(t, err)
+
+	expectedPortMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: "8080",
+			},
+		},
+		"5432/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: "15432",
+			},
+		},
+		"443/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort2,
+			},
+		},
+	}
+	assert.Equal(t, expectedPortMapping, remapTracker.Get(containerID))
+
+	received := forwarder.received()
+	require.Len(t, received, 1)
+	assert.Equal(t, expectedPortMapping, received[0].Ports)
+
+	// The requested host address follows the remapped host ports.
+	assert.Equal(t, map[string]string{"8080/tcp": hostIP, "15432/tcp": hostIP, "443/tcp": hostIP}, received[0].HostBindAddrs)
+
+	entry, ok := remapTracker.GetByPort("8080", "tcp")
+	require.True(t, ok)
+	assert.Equal(t, map[string]string{
+		"name":                                   "web",
+		tracker.RemapMetadataPrefix + "8080/tcp": "80",
+		tracker.RemapMetadataPrefix + "15432/tcp": "5432",
+	}, entry.Metadata)
+}
+
+func TestRemapTrackerCollision(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	table, err := tracker.ParseRemapTable("80:8080")
+	require.NoError(t, err)
+
+	remapTracker := tracker.NewRemapTracker(tracker.NewVTunnelTracker(&forwarder, wslConnectAddr), table)
+
+	// The remapped port collides with a port of the same entry
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+		"8080/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: "8080",
+			},
+		},
+	}
+	err = remapTracker.Add(context.Background(), containerID, portMapping)
+	require.ErrorIs(t, err, tracker.ErrRemapCollision)
+	assert.Equal(t, nat.PortMap{
+		"80/tcp":   []nat.PortBinding{},
+		"8080/tcp": portMapping["8080/tcp"],
+	}, remapTracker.Get(containerID))
+
+	// The remapped port collides with a port of another entry
+	portMapping2 := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP2,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err = remapTracker.Add(context.Background(), containerID2, portMapping2)
+	require.ErrorIs(t, err, tracker.ErrRemapCollision)
+	assert.Equal(t, nat.PortMap{
+		"80/tcp": []nat.PortBinding{},
+	}, remapTracker.Get(containerID2))
+}
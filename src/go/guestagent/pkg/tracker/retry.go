@@ -0,0 +1,99 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/retry"
+)
+
+// retrier schedules the retries of the failed sends with an exponential
+// backoff of random delays, so that the agents whose peer restarted do not
+// retry in step; the backoff is reset once a retry succeeds.
+type retrier struct {
+	// name describes what is retried in the logs.
+	name    string
+	backoff *retry.Backoff
+	timer   *time.Timer
+	retry   func() error
+	mutex   sync.Mutex
+	// limiter keeps the retries that keep failing from flooding the logs.
+	limiter *logging.Limiter
+}
+
+func newRetrier(name string, minBackoff, maxBackoff time.Duration, send func() error) *retrier {
+	return &retrier{
+		name:    name,
+		backoff: retry.Policy{Initial: minBackoff, Max: maxBackoff}.Start(),
+		retry:   send,
+		limiter: logging.NewLimiter(0),
+	}
+}
+
+// schedule arms the retry timer, unless a retry is already pending.
+func (r *retrier) schedule() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.timer != nil {
+		return
+	}
+
+	delay, _ := r.backoff.Next()
+	logger.Debugf("retrying %s in %s", r.name, delay)
+	r.timer = time.AfterFunc(delay, r.run)
+}
+
+func (r *retrier) run() {
+	err := r.retry()
+
+	r.mutex.Lock()
+	r.timer = nil
+
+	if err == nil {
+		r.backoff.Reset()
+		r.mutex.Unlock()
+		r.limiter.Reset(logger)
+
+		return
+	}
+
+	r.mutex.Unlock()
+
+	// Everything is sent again once the circuit to the peer closes, see PeerRecovered.
+	if errors.Is(err, forwarder.ErrCircuitOpen) {
+		logger.Debugf("not retrying %s while the circuit to the peer is open", r.name)
+
+		return
+	}
+
+	r.limiter.Errorf(logger, "retrying %s failed: %v", r.name, err)
+	r.schedule()
+}
+
+// stop cancels the pending retry, if any.
+func (r *retrier) stop() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
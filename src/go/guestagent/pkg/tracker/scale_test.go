@@ -0,0 +1,275 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/require"
+)
+
+// scalePorts is the number of the ports that the tracker is driven to, e.g.
+// a port range that is published or the NodePorts of a large cluster.
+const scalePorts = 10000
+
+// resyncBudget is how many times the marshaling of its snapshot a Resync of
+// scalePorts ports may take at most: it marshals the snapshot twice, once
+// into its hash and once in the forwarder, and lists, filters and merges the
+// entries in between, which takes about 7 times as long as a single
+// marshaling. The budget is relative so that it holds on slow machines and
+// with -race; a Resync of 10k ports, a snapshot of about 1.2MB, takes about
+// 150ms on a single core. Going back to a cost per port that grows with the
+// number of the ports blows it by far.
+const resyncBudget = 10
+
+// scalePortMap returns the port mapping of the i-th container, one port each.
+func scalePortMap(i int) nat.PortMap {
+	port := strconv.Itoa(10000 + i)
+
+	return nat.PortMap{nat.Port(port + "/tcp"): []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: port}}}
+}
+
+func scaleID(i int) string {
+	return "container-" + strconv.Itoa(i)
+}
+
+// marshalingForwarder marshals the payloads like the vtunnel forwarder, and
+// counts their bytes, without sending them.
+type marshalingForwarder struct {
+	bytes    atomic.Int64
+	ports    atomic.Int64
+	snapshot atomic.Pointer[types.PortMapping]
+}
+
+func (m *marshalingForwarder) Send(_ context.Context, portMapping types.PortMapping) error {
+	bin, err := json.Marshal(portMapping)
+	if err != nil {
+		return err
+	}
+
+	m.bytes.Add(int64(len(bin)))
+
+	if portMapping.Replace {
+		m.ports.Store(int64(len(portMapping.Ports)))
+		m.snapshot.Store(&portMapping)
+	}
+
+	return nil
+}
+
+func (m *marshalingForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	for _, portMapping := range portMappings {
+		if err := m.Send(ctx, portMapping); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scaleTracker(tb testing.TB, ports int) (*tracker.VTunnelTracker, *marshalingForwarder) {
+	tb.Helper()
+
+	forwarder := &marshalingForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder, []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}})
+
+	for i := range ports {
+		if err := vtunnelTracker.Add(context.Background(), scaleID(i), scalePortMap(i), tracker.WithSource(tracker.SourceDocker)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return vtunnelTracker, forwarder
+}
+
+func BenchmarkVTunnelTrackerAdd(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		scaleTracker(b, scalePorts)
+	}
+}
+
+func BenchmarkVTunnelTrackerResync(b *testing.B) {
+	vtunnelTracker, _ := scaleTracker(b, scalePorts)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := vtunnelTracker.Resync(context.Background(), true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkVTunnelTrackerList(b *testing.B) {
+	vtunnelTracker, _ := scaleTracker(b, scalePorts)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		vtunnelTracker.List()
+	}
+}
+
+func BenchmarkVTunnelTrackerRemove(b *testing.B) {
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		vtunnelTracker, _ := scaleTracker(b, scalePorts)
+		b.StartTimer()
+
+		for j := range scalePorts {
+			if err := vtunnelTracker.Remove(context.Background(), scaleID(j)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkListenerTracker(b *testing.B) {
+	ctx := context.Background()
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		listenerTracker := tracker.NewListenerTracker()
+		listenerTracker.EnableDryRun()
+
+		for j := range scalePorts {
+			if err := listenerTracker.AddListener(ctx, net.IPv4zero, 10000+j); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		for j := range scalePorts {
+			if err := listenerTracker.RemoveListener(ctx, net.IPv4zero, 10000+j); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestVTunnelTrackerScale(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the tracker is not driven to scale in short mode")
+	}
+
+	tests := []struct {
+		name  string
+		batch bool
+	}{
+		{name: "Unbatched"},
+		{name: "Batched", batch: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			forwarder := &marshalingForwarder{}
+			vtunnelTracker := tracker.NewVTunnelTracker(forwarder, []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}})
+
+			// The batch is flushed explicitly, not by its timer.
+			if tt.batch {
+				vtunnelTracker.EnableBatching(time.Hour)
+			}
+
+			// The mappings are added and removed by as many goroutines as
+			// the event sources that the agent runs.
+			const workers = 8
+
+			run := func(do func(i int) error) {
+				var wg sync.WaitGroup
+
+				for w := range workers {
+					wg.Add(1)
+
+					go func() {
+						defer wg.Done()
+
+						for i := w; i < scalePorts; i += workers {
+							require.NoError(t, do(i))
+						}
+					}()
+				}
+
+				wg.Wait()
+			}
+
+			run(func(i int) error {
+				return vtunnelTracker.Add(context.Background(), scaleID(i), scalePortMap(i), tracker.WithSource(tracker.SourceDocker))
+			})
+			require.NoError(t, vtunnelTracker.Flush())
+
+			require.Len(t, vtunnelTracker.List(), scalePorts)
+			require.NoError(t, vtunnelTracker.Resync(ctx, true))
+			require.EqualValues(t, scalePorts, forwarder.ports.Load())
+
+			run(func(i int) error {
+				return vtunnelTracker.Remove(context.Background(), scaleID(i))
+			})
+			require.NoError(t, vtunnelTracker.Flush())
+
+			require.Empty(t, vtunnelTracker.List())
+			require.NoError(t, vtunnelTracker.Resync(ctx, true))
+			require.Zero(t, forwarder.ports.Load())
+		})
+	}
+}
+
+// TestVTunnelTrackerResyncBudget fails when a Resync of scalePorts ports
+// takes more than resyncBudget times the marshaling of its snapshot.
+func TestVTunnelTrackerResyncBudget(t *testing.T) {
+	if testing.Short() {
+		t.Skip("the benchmarks are not run in short mode")
+	}
+
+	vtunnelTracker, forwarder := scaleTracker(t, scalePorts)
+	require.NoError(t, vtunnelTracker.Resync(context.Background(), true))
+
+	snapshot := forwarder.snapshot.Load()
+	require.NotNil(t, snapshot)
+
+	baseline := testing.Benchmark(func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := json.Marshal(snapshot); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	resync := testing.Benchmark(func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := vtunnelTracker.Resync(context.Background(), true); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	t.Logf("marshaling: %s, resync: %s", baseline, resync)
+	require.LessOrEqual(t, resync.NsPerOp(), resyncBudget*baseline.NsPerOp(),
+		"a Resync of %d ports is over its budget of %d times the marshaling of the snapshot", scalePorts, resyncBudget)
+}
@@ -0,0 +1,189 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// sequencer assigns the sequence numbers of the changes to the host ports,
+// see types.PortMapping.PortSeqs, so that the privileged service can drop
+// the payloads that a later change overtook; e.g. a retried addition that
+// arrives after the removal of a container that restarted.
+type sequencer struct {
+	mutex sync.Mutex
+	// last is the sequence number of the last change.
+	last uint64
+	// ports holds the sequence number of the last change to each host port,
+	// keyed like types.PortMapping.PortSeqs.
+	ports map[string]uint64
+	// changes holds the sequence number of the last change to each entry,
+	// the entries that were removed have none.
+	changes map[string]uint64
+	// synced is the last sequence number when the last snapshot that
+	// was delivered was taken, see prune.
+	synced uint64
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{
+		// The sequence numbers start from the time that the agent started
+		// so that they keep increasing when the agent restarts.
+		last:    uint64(time.Now().UnixNano()),
+		ports:   make(map[string]uint64),
+		changes: make(map[string]uint64),
+	}
+}
+
+// change assigns a new sequence number to the host ports of the port maps,
+// for a change to the entry; the entry is forgotten if it is removed.
+func (s *sequencer) change(containerID string, remove bool, portMaps ...nat.PortMap) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	seq := s.next(portMaps...)
+
+	if remove {
+		delete(s.changes, containerID)
+	} else {
+		s.changes[containerID] = seq
+	}
+
+	return seq
+}
+
+// removeAll assigns a new sequence number to the host ports of the port
+// maps, for the removal of all the entries.
+func (s *sequencer) removeAll(portMaps ...nat.PortMap) uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	clear(s.changes)
+
+	return s.next(portMaps...)
+}
+
+// renew assigns a new sequence number to the host ports of the entry for
+// its retry, unless a later change to the entry superseded the change that
+// the entry holds; the entry keeps its own sequence number, so that it is
+// superseded by the same changes whichever retry it is.
+func (s *sequencer) renew(entry Entry) (uint64, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if seq, ok := s.changes[entry.ID]; !ok || seq != entry.seq {
+		return 0, false
+	}
+
+	return s.next(entry.Ports), true
+}
+
+// latest returns the sequence numbers of the last changes to the host ports.
+// For a snapshot, it also returns the sequence number that prune takes once
+// the snapshot is delivered.
+func (s *sequencer) latest() (map[string]uint64, uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return maps.Clone(s.ports), s.last
+}
+
+// prune forgets the host ports that did not change since the snapshot before
+// the one that was taken at the given sequence number, which were carried by
+// both snapshots; the changes that they overtook are long gone.
+func (s *sequencer) prune(taken uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	synced := s.synced
+	maps.DeleteFunc(s.ports, func(_ string, seq uint64) bool {
+		return seq <= synced
+	})
+
+	s.synced = taken
+}
+
+// next assigns the next sequence number to the host ports of the port maps,
+// it must be called with the mutex held.
+func (s *sequencer) next(portMaps ...nat.PortMap) uint64 {
+	s.last++
+
+	for _, portMap := range portMaps {
+		for port, bindings := range portMap {
+			for _, binding := range bindings {
+				s.ports[portSeqKey(port, binding)] = s.last
+			}
+		}
+	}
+
+	return s.last
+}
+
+// withSeq sets the sequence numbers of the host ports of the payload to the
+// one of the change that it is sent for.
+func withSeq(portMapping types.PortMapping, seq uint64) types.PortMapping {
+	portMapping.PortSeqs = nil
+
+	for port, bindings := range portMapping.Ports {
+		for _, binding := range bindings {
+			if portMapping.PortSeqs == nil {
+				portMapping.PortSeqs = make(map[string]uint64)
+			}
+
+			portMapping.PortSeqs[portSeqKey(port, binding)] = seq
+		}
+	}
+
+	return portMapping
+}
+
+// withLatestSeqs sets the sequence numbers of the host ports of the payload
+// to the ones of their last changes, see sequencer.latest, for the payloads
+// that carry the current state of the port mappings.
+func withLatestSeqs(portMapping types.PortMapping, latest map[string]uint64) types.PortMapping {
+	portMapping.PortSeqs = nil
+
+	for port, bindings := range portMapping.Ports {
+		for _, binding := range bindings {
+			key := portSeqKey(port, binding)
+			if seq, ok := latest[key]; ok {
+				if portMapping.PortSeqs == nil {
+					portMapping.PortSeqs = make(map[string]uint64)
+				}
+
+				portMapping.PortSeqs[key] = seq
+			}
+		}
+	}
+
+	return portMapping
+}
+
+// withChangeSeq records the sequence number of the change that adds
+// the entry, see sequencer.renew.
+func withChangeSeq(seq uint64) EntryOption {
+	return func(e *Entry) {
+		e.seq = seq
+	}
+}
+
+// portSeqKey is the key of the host port of the binding in types.PortMapping.PortSeqs.
+func portSeqKey(port nat.Port, binding nat.PortBinding) string {
+	return binding.HostPort + "/" + port.Proto()
+}
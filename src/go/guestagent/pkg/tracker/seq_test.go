@@ -0,0 +1,197 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedForwarder holds the sends that the gate matches until they are
+// released, without holding up the other sends.
+type gatedForwarder struct {
+	testForwarder
+	gate    func(types.PortMapping) bool
+	held    chan struct{}
+	release chan struct{}
+}
+
+func (g *gatedForwarder) Send(ctx context.Context, portMapping types.PortMapping) error {
+	if g.gate(portMapping) {
+		g.held <- struct{}{}
+		<-g.release
+	}
+
+	return g.testForwarder.Send(ctx, portMapping)
+}
+
+// hostPorts applies the received port mappings in order like the
+// privileged service does, see types.PortMapping.PortSeqs, and returns
+// the host ports that end up forwarded.
+func hostPorts(portMappings []types.PortMapping, portSeqs []map[string]uint64) []string {
+	forwarded := make(map[string]struct{})
+	recorded := make(map[string]uint64)
+
+	for i, portMapping := range portMappings {
+		if portMapping.Replace {
+			clear(forwarded)
+			recorded = portSeqs[i]
+		}
+
+		for port, bindings := range portMapping.Ports {
+			for _, binding := range bindings {
+				key := binding.HostPort + "/" + port.Proto()
+				if seq, ok := portSeqs[i][key]; ok && !portMapping.Replace {
+					if seq < recorded[key] {
+						continue
+					}
+
+					recorded[key] = seq
+				}
+
+				if portMapping.Remove {
+					delete(forwarded, key)
+				} else {
+					forwarded[key] = struct{}{}
+				}
+			}
+		}
+	}
+
+	ports := make([]string, 0, len(forwarded))
+	for key := range forwarded {
+		ports = append(ports, key)
+	}
+
+	sort.Strings(ports)
+
+	return ports
+}
+
+func TestVTunnelTrackerDelayedRetry(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	portMap := nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: "80"}}}
+	changedPortMap := nat.PortMap{
+		"80/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: "80"}},
+		"81/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: "81"}},
+	}
+
+	var (
+		mutex    sync.Mutex
+		attempts int
+	)
+
+	// The change of the port mapping fails, and its retry is delayed
+	// until the container restarted.
+	forwarder := &gatedForwarder{
+		gate: func(portMapping types.PortMapping) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+
+			if _, ok := portMapping.Ports["81/tcp"]; !ok || portMapping.Remove {
+				return false
+			}
+
+			attempts++
+
+			return attempts == 2
+		},
+		held:    make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	forwarder.failCondition = func(portMapping types.PortMapping) error {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if _, ok := portMapping.Ports["81/tcp"]; ok && !portMapping.Remove && attempts == 1 {
+			return errSend
+		}
+
+		return nil
+	}
+
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder, wslConnectAddr)
+	vtunnelTracker.EnableRetry(time.Millisecond, 10*time.Millisecond)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMap))
+	require.ErrorIs(t, vtunnelTracker.Add(context.Background(), containerID, changedPortMap), errSend)
+
+	select {
+	case <-forwarder.held:
+	case <-time.After(time.Second):
+		require.FailNow(t, "the failed port mapping was not retried")
+	}
+
+	// The container restarts while the retry is on its way.
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMap))
+	close(forwarder.release)
+
+	require.Eventually(t, func() bool {
+		return len(forwarder.received()) == 4
+	}, time.Second, time.Millisecond)
+
+	forwarder.mutex.Lock()
+	defer forwarder.mutex.Unlock()
+
+	// The retry arrives last, and it does not override the restart.
+	assert.Contains(t, forwarder.receivedPortMappings[3].Ports, nat.Port("81/tcp"))
+	assert.Equal(t, []string{"80/tcp"}, hostPorts(forwarder.receivedPortMappings, forwarder.portSeqs))
+}
+
+func TestVTunnelTrackerResyncPortSeqs(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, nat.PortMap{
+		"80/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: "80"}},
+	}))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, nat.PortMap{
+		"443/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: "443"}},
+	}))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID2))
+	require.NoError(t, vtunnelTracker.Resync(context.Background(), true))
+
+	received := forwarder.received()
+	require.Len(t, received, 4)
+	require.True(t, received[3].Replace)
+
+	// The snapshot carries the sequence number of the removed port as well,
+	// so that the delayed addition of the port is still dropped.
+	snapshotSeqs := forwarder.portSeqs[3]
+	assert.Equal(t, forwarder.portSeqs[0]["80/tcp"], snapshotSeqs["80/tcp"])
+	assert.Equal(t, forwarder.portSeqs[2]["443/tcp"], snapshotSeqs["443/tcp"])
+
+	delayed := append(received, received[1])
+	assert.Equal(t, []string{"80/tcp"}, hostPorts(delayed, append(forwarder.portSeqs, forwarder.portSeqs[1])))
+
+	// The ports that did not change since the previous snapshot are forgotten.
+	require.NoError(t, vtunnelTracker.Resync(context.Background(), true))
+	require.NoError(t, vtunnelTracker.Resync(context.Background(), true))
+	assert.Empty(t, forwarder.portSeqs[len(forwarder.portSeqs)-1])
+}
@@ -0,0 +1,219 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+)
+
+// Holder holds the changes of the port mappings until they are released
+// as a single batch, see VTunnelTracker.Hold.
+type Holder interface {
+	Hold()
+	Release() error
+}
+
+// Hold holds the changes of the port mappings in the pending batch, even
+// if batching is disabled, until Release sends them as a single batch.
+func (p *VTunnelTracker) Hold() {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	p.held = true
+}
+
+// Release sends the changes that were held since Hold, and then sends the
+// next ones as it did before.
+func (p *VTunnelTracker) Release() error {
+	p.batchMutex.Lock()
+	p.held = false
+	p.batchMutex.Unlock()
+
+	return p.Flush()
+}
+
+// StartupBatch gathers the port mappings that the sources find in their
+// initial pass at startup, e.g. the running containers and the services
+// that exist already, so that the host learns about all of them in a single
+// batch rather than one source after another. The sources run their initial
+// pass concurrently, and report its end with InitialPassDone; the batch is
+// sent once all of them did, or once the timeout elapsed, so that a source
+// that fails or hangs, e.g. a Docker API that is not served yet, does not
+// delay the others for longer.
+type StartupBatch struct {
+	holder  Holder
+	started time.Time
+	timer   *time.Timer
+	mutex   sync.Mutex
+	// pending are the sources whose initial pass did not end yet, failed
+	// the ones whose initial pass failed.
+	pending  map[string]struct{}
+	failed   []string
+	released chan struct{}
+}
+
+// NewStartupBatch holds the changes of the holder, unless it is nil, until
+// all of the sources reported the end of their initial pass, or until the
+// timeout elapsed.
+func NewStartupBatch(holder Holder, timeout time.Duration, sources ...string) *StartupBatch {
+	batch := &StartupBatch{
+		holder:   holder,
+		started:  time.Now(),
+		pending:  make(map[string]struct{}, len(sources)),
+		released: make(chan struct{}),
+	}
+
+	for _, source := range sources {
+		batch.pending[source] = struct{}{}
+	}
+
+	if holder != nil {
+		holder.Hold()
+	}
+
+	if len(sources) == 0 {
+		batch.release()
+
+		return batch
+	}
+
+	batch.timer = time.AfterFunc(timeout, func() {
+		batch.mutex.Lock()
+		waiting := batch.take()
+		batch.mutex.Unlock()
+
+		if waiting != nil {
+			logger.Warnw("sending the startup batch of the port mappings without the sources that did not finish their initial pass",
+				log.Fields{"waiting": waiting, "timeout": timeout.String()})
+			batch.release()
+		}
+	})
+
+	return batch
+}
+
+// Done reports the end of the initial pass of the source, which failed if
+// err is set; the reports of the sources that are not pending, e.g. after
+// they were restarted, are ignored.
+func (b *StartupBatch) Done(source string, err error) {
+	b.mutex.Lock()
+
+	if _, ok := b.pending[source]; !ok {
+		b.mutex.Unlock()
+
+		return
+	}
+
+	delete(b.pending, source)
+
+	if err != nil {
+		b.failed = append(b.failed, source)
+	}
+
+	logger.Debugw("the initial pass of the source ended", logging.Fields(
+		logging.Source(source),
+		logging.Error(err),
+		log.Fields{"elapsed": time.Since(b.started).String()},
+	))
+
+	var last bool
+	if len(b.pending) == 0 {
+		last = b.take() != nil
+	}
+
+	b.mutex.Unlock()
+
+	if last {
+		b.release()
+	}
+}
+
+// Released returns a channel that is closed once the batch was sent.
+func (b *StartupBatch) Released() <-chan struct{} {
+	return b.released
+}
+
+// take returns the sources that are still pending, sorted, and marks the
+// batch as released, or returns nil if it was released already. The mutex
+// must be held.
+func (b *StartupBatch) take() []string {
+	if b.pending == nil {
+		return nil
+	}
+
+	waiting := make([]string, 0, len(b.pending))
+	for source := range b.pending {
+		waiting = append(waiting, source)
+	}
+
+	sort.Strings(waiting)
+
+	b.pending = nil
+
+	return waiting
+}
+
+// release sends the batch, once take marked it as released.
+func (b *StartupBatch) release() {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+
+	if b.holder != nil {
+		if err := b.holder.Release(); err != nil {
+			logger.Errorf("sending the startup batch of the port mappings failed: %v", err)
+		}
+	}
+
+	b.mutex.Lock()
+	failed := b.failed
+	b.mutex.Unlock()
+
+	logger.Infow("sent the startup batch of the port mappings", log.Fields{
+		"elapsed": time.Since(b.started).String(),
+		"failed":  failed,
+	})
+
+	close(b.released)
+}
+
+// startupKey is the key of the startup batch of a context.
+type startupKey struct{}
+
+// startupSource is the source that reports to a startup batch.
+type startupSource struct {
+	batch  *StartupBatch
+	source string
+}
+
+// ContextWithStartupBatch returns a context that the source reports the end
+// of its initial pass to the startup batch with, see InitialPassDone.
+func ContextWithStartupBatch(ctx context.Context, batch *StartupBatch, source string) context.Context {
+	return context.WithValue(ctx, startupKey{}, startupSource{batch: batch, source: source})
+}
+
+// InitialPassDone reports the end of the initial pass of the source of the
+// context to its startup batch, which failed if err is set; it has no effect
+// if the context has no startup batch, or once the source reported it.
+func InitialPassDone(ctx context.Context, err error) {
+	if startup, ok := ctx.Value(startupKey{}).(startupSource); ok {
+		startup.batch.Done(startup.source, err)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// initialPassDelay is how long the slow fakes of the sources take for their
+// initial pass, e.g. a Docker API or a kube-apiserver under load.
+const initialPassDelay = 200 * time.Millisecond
+
+var errInitialPass = errors.New("initial pass failed")
+
+// initialPass is a fake source that adds its port mapping once its initial
+// pass took the delay, and reports its end to the startup batch with err.
+func initialPass(
+	batch *tracker.StartupBatch, vtunnelTracker *tracker.VTunnelTracker, source string, port int, delay time.Duration, err error,
+) {
+	ctx := tracker.ContextWithStartupBatch(context.Background(), batch, source)
+
+	time.Sleep(delay)
+
+	if err == nil {
+		_ = vtunnelTracker.Add(context.Background(), source, testPortMap(port), tracker.WithSource(source))
+	}
+
+	tracker.InitialPassDone(ctx, err)
+}
+
+func TestStartupBatch(t *testing.T) {
+	t.Parallel()
+
+	forwarder := testForwarder{bulk: true}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+	vtunnelTracker.SetPeerBatches(func() bool { return true })
+	sources := []string{tracker.SourceDocker, tracker.SourceKubernetes, tracker.SourceIptables}
+	batch := tracker.NewStartupBatch(vtunnelTracker, 10*time.Second, sources...)
+	start := time.Now()
+
+	for i, source := range sources {
+		// The sources take longer one after another, so that the
+		// mappings of the first ones are held until the last one is done.
+		go initialPass(batch, vtunnelTracker, source, 8000+i, time.Duration(i+1)*initialPassDelay/2, nil)
+	}
+
+	time.Sleep(initialPassDelay)
+	assert.Empty(t, forwarder.received(), "the startup batch was sent before the last source was done")
+
+	select {
+	case <-batch.Released():
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the startup batch was not sent")
+	}
+
+	elapsed := time.Since(start)
+
+	// The host learns about the mappings of all of the sources at once.
+	require.Len(t, forwarder.received(), 1)
+	assert.Len(t, forwarder.received()[0].Ports, len(sources))
+
+	// The initial passes run concurrently: the batch is sent once the
+	// slowest one is done, rather than after all of them in turn.
+	sequential := time.Duration(1+2+3) * initialPassDelay / 2
+	assert.GreaterOrEqual(t, elapsed, 3*initialPassDelay/2)
+	assert.Less(t, elapsed, sequential)
+
+	// The changes after the startup batch are sent as they were before.
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, testPortMap(9000)))
+	assert.Len(t, forwarder.received(), 2)
+}
+
+func TestStartupBatchFailedSource(t *testing.T) {
+	t.Parallel()
+
+	forwarder := testForwarder{bulk: true}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+	batch := tracker.NewStartupBatch(vtunnelTracker, 10*time.Second, tracker.SourceDocker, tracker.SourceKubernetes)
+	start := time.Now()
+
+	// The source that fails at once does not hold the batch for the other
+	// one, nor does the batch wait for it any longer.
+	go initialPass(batch, vtunnelTracker, tracker.SourceDocker, 8000, 0, errInitialPass)
+	go initialPass(batch, vtunnelTracker, tracker.SourceKubernetes, 8001, initialPassDelay, nil)
+
+	select {
+	case <-batch.Released():
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the startup batch was not sent")
+	}
+
+	assert.Less(t, time.Since(start), 5*initialPassDelay)
+	assert.Equal(t, testPortMap(8001), hostState(forwarder.received()))
+}
+
+func TestStartupBatchTimeout(t *testing.T) {
+	t.Parallel()
+
+	forwarder := testForwarder{bulk: true}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+	batch := tracker.NewStartupBatch(vtunnelTracker, initialPassDelay, tracker.SourceDocker, tracker.SourceKubernetes)
+
+	// The Kubernetes source hangs, e.g. on an API that is not served yet:
+	// the batch is sent without it once the timeout elapsed.
+	initialPass(batch, vtunnelTracker, tracker.SourceDocker, 8000, 0, nil)
+	assert.Empty(t, forwarder.received())
+
+	select {
+	case <-batch.Released():
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "the startup batch was not sent")
+	}
+
+	assert.Equal(t, testPortMap(8000), hostState(forwarder.received()))
+
+	// The source that ends its initial pass late sends its changes as
+	// they come, and does not release the batch again.
+	initialPass(batch, vtunnelTracker, tracker.SourceKubernetes, 8001, 0, nil)
+	assert.Len(t, forwarder.received(), 2)
+}
+
+func TestStartupBatchWithoutSources(t *testing.T) {
+	t.Parallel()
+
+	forwarder := testForwarder{bulk: true}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+	batch := tracker.NewStartupBatch(vtunnelTracker, time.Minute)
+
+	select {
+	case <-batch.Released():
+	default:
+		require.FailNow(t, "the startup batch without sources was not sent at once")
+	}
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, testPortMap(8000)))
+	assert.Len(t, forwarder.received(), 1)
+
+	// A context without a startup batch has no effect.
+	tracker.InitialPassDone(context.Background(), nil)
+}
@@ -0,0 +1,256 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// Action is the type of change that an Event describes.
+type Action string
+
+const (
+	ActionAdd    Action = "add"
+	ActionRemove Action = "remove"
+)
+
+// Outcome is the outcome of sending a change to the host, see WithOutcomes.
+type Outcome string
+
+const (
+	OutcomeSent   Outcome = "sent"
+	OutcomeFailed Outcome = "failed"
+)
+
+// Event describes a single port binding being added to or removed from the tracker.
+type Event struct {
+	Action Action `json:"action"`
+	// ID is the key of the entry the port binding belongs to.
+	ID       string            `json:"id"`
+	Port     string            `json:"port"`
+	Protocol string            `json:"protocol"`
+	HostIP   string            `json:"hostIP"`
+	Source   string            `json:"source,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Outcome is set on the events that tell whether the change was sent to
+	// the host rather than the change itself, which are only delivered to the
+	// subscriptions WithOutcomes; Error is why it failed.
+	Outcome Outcome `json:"outcome,omitempty"`
+	Error   string  `json:"error,omitempty"`
+	// Latency is how long the port binding took from the event that it was
+	// added for to reach the host, see WithEventTime. It is only set on the
+	// events of the additions that were sent, whose event time is known.
+	Latency time.Duration `json:"latency,omitempty"`
+	// Timestamp is the time when the change was applied to the tracker.
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Subscription delivers the tracker's change events. The events are buffered,
+// a subscriber that does not keep up loses the events that do not fit in its
+// buffer, rather than blocking the tracker.
+type Subscription struct {
+	events   chan Event
+	dropped  atomic.Uint64
+	broker   *broker
+	outcomes bool
+}
+
+// SubscribeOption configures a subscription, see Tracker.Subscribe.
+type SubscribeOption func(*Subscription)
+
+// WithOutcomes also delivers the outcome of sending the changes to the host,
+// which are the events with an Outcome: the changes that failed to be sent
+// are only reported by them, the tracker keeps the entries as they were.
+func WithOutcomes() SubscribeOption {
+	return func(s *Subscription) {
+		s.outcomes = true
+	}
+}
+
+// Events returns the channel that the events are delivered on,
+// it is closed once Unsubscribe is called.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped returns the number of events that were
+// lost since the subscriber's buffer was full.
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Queued returns the number of events that were
+// delivered but not yet received by the subscriber.
+func (s *Subscription) Queued() int {
+	return len(s.events)
+}
+
+// Unsubscribe stops the delivery of events and closes the events channel.
+// It is safe to call it more than once.
+func (s *Subscription) Unsubscribe() {
+	s.broker.unsubscribe(s)
+}
+
+// broker fans out the change events to all the subscribers.
+type broker struct {
+	subscriptions map[*Subscription]struct{}
+	mutex         sync.Mutex
+}
+
+func newBroker() *broker {
+	return &broker{
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+func (b *broker) subscribe(bufferSize int, opts ...SubscribeOption) *Subscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	subscription := &Subscription{
+		events: make(chan Event, bufferSize),
+		broker: b,
+	}
+	for _, opt := range opts {
+		opt(subscription)
+	}
+	b.subscriptions[subscription] = struct{}{}
+
+	return subscription
+}
+
+func (b *broker) unsubscribe(subscription *Subscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscriptions[subscription]; ok {
+		delete(b.subscriptions, subscription)
+		close(subscription.events)
+	}
+}
+
+// publish delivers the events to all the subscribers without blocking.
+func (b *broker) publish(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for subscription := range b.subscriptions {
+		for _, event := range events {
+			if event.Outcome != "" && !subscription.outcomes {
+				continue
+			}
+
+			select {
+			case subscription.events <- event:
+			default:
+				subscription.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// diffEvents returns the events that describe the change from the old
+// to the new port mappings; removals are listed before additions.
+func diffEvents(entry *Entry, oldPorts, newPorts nat.PortMap, timestamp time.Time) []Event {
+	oldBindings := bindingEvents(entry, oldPorts)
+	newBindings := bindingEvents(entry, newPorts)
+
+	var events []Event
+
+	for _, key := range sortedKeys(oldBindings) {
+		if _, ok := newBindings[key]; !ok {
+			event := oldBindings[key]
+			event.Action = ActionRemove
+			event.Timestamp = timestamp
+			events = append(events, event)
+		}
+	}
+
+	for _, key := range sortedKeys(newBindings) {
+		if _, ok := oldBindings[key]; !ok {
+			event := newBindings[key]
+			event.Action = ActionAdd
+			event.Timestamp = timestamp
+			events = append(events, event)
+		}
+	}
+
+	return events
+}
+
+// outcomeEvents returns the events that tell the outcome of sending
+// the action on the entry's port bindings to the host.
+func outcomeEvents(action Action, entry *Entry, err error, timestamp time.Time) []Event {
+	bindings := bindingEvents(entry, entry.Ports)
+	events := make([]Event, 0, len(bindings))
+
+	for _, key := range sortedKeys(bindings) {
+		event := bindings[key]
+		event.Action = action
+		event.Outcome = OutcomeSent
+		event.Timestamp = timestamp
+
+		switch {
+		case err != nil:
+			event.Outcome = OutcomeFailed
+			event.Error = err.Error()
+		case action == ActionAdd && !entry.EventTime.IsZero():
+			event.Latency = timestamp.Sub(entry.EventTime)
+		}
+
+		events = append(events, event)
+	}
+
+	return events
+}
+
+func bindingEvents(entry *Entry, portMap nat.PortMap) map[string]Event {
+	events := make(map[string]Event)
+
+	for port, bindings := range portMap {
+		for _, binding := range bindings {
+			key := port.Proto() + "/" + binding.HostIP + "/" + binding.HostPort
+			events[key] = Event{
+				ID:       entry.ID,
+				Port:     binding.HostPort,
+				Protocol: port.Proto(),
+				HostIP:   binding.HostIP,
+				Source:   entry.Source,
+				Metadata: entry.Metadata,
+			}
+		}
+	}
+
+	return events
+}
+
+func sortedKeys(events map[string]Event) []string {
+	keys := make([]string, 0, len(events))
+	for key := range events {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,199 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSubscribe(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	subscription1 := vtunnelTracker.Subscribe(10)
+	subscription2 := vtunnelTracker.Subscribe(10)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithSource(tracker.SourceDocker)))
+
+	portMapping2 := nat.PortMap{
+		"443/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP2,
+				HostPort: hostPort2,
+			},
+		},
+	}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping2, tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+
+	type change struct {
+		action tracker.Action
+		port   string
+	}
+
+	expected := []change{
+		{tracker.ActionAdd, hostPort},
+		{tracker.ActionRemove, hostPort},
+		{tracker.ActionAdd, hostPort2},
+		{tracker.ActionRemove, hostPort2},
+	}
+
+	for _, subscription := range []*tracker.Subscription{subscription1, subscription2} {
+		subscription.Unsubscribe()
+
+		var actual []change
+
+		for event := range subscription.Events() {
+			assert.Equal(t, containerID, event.ID)
+			assert.Equal(t, "tcp", event.Protocol)
+			assert.Equal(t, tracker.SourceDocker, event.Source)
+			assert.False(t, event.Timestamp.IsZero())
+			actual = append(actual, change{event.Action, event.Port})
+		}
+
+		assert.Equal(t, expected, actual)
+		assert.Zero(t, subscription.Dropped())
+	}
+}
+
+func TestSubscribeSlowSubscriber(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	subscription := vtunnelTracker.Subscribe(1)
+	defer subscription.Unsubscribe()
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+
+	// The tracker must never block on a subscriber that is not reading
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, portMapping))
+	require.NoError(t, vtunnelTracker.RemoveAll(context.Background()))
+
+	assert.Equal(t, uint64(3), subscription.Dropped())
+
+	event := <-subscription.Events()
+	assert.Equal(t, tracker.ActionAdd, event.Action)
+
+	// Unsubscribing twice is harmless
+	subscription.Unsubscribe()
+	subscription.Unsubscribe()
+}
+
+func TestSubscribeWithOutcomes(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	subscription := vtunnelTracker.Subscribe(10, tracker.WithOutcomes())
+	changes := vtunnelTracker.Subscribe(10)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	metadata := map[string]string{"name": "web"}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithMetadata(metadata)))
+
+	// The failed change is only reported by its outcome, the tracker is unchanged.
+	forwarder.sendErr = errSend
+	portMapping2 := nat.PortMap{
+		"443/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP2,
+				HostPort: hostPort2,
+			},
+		},
+	}
+	require.ErrorIs(t, vtunnelTracker.Add(context.Background(), containerID2, portMapping2), errSend)
+	require.ErrorIs(t, vtunnelTracker.Remove(context.Background(), containerID), errSend)
+
+	forwarder.sendErr = nil
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+
+	type change struct {
+		action  tracker.Action
+		id      string
+		outcome tracker.Outcome
+		error   string
+	}
+
+	subscription.Unsubscribe()
+
+	var actual []change
+
+	for event := range subscription.Events() {
+		actual = append(actual, change{event.Action, event.ID, event.Outcome, event.Error})
+
+		if event.ID == containerID {
+			assert.Equal(t, hostPort, event.Port)
+			assert.Equal(t, metadata, event.Metadata)
+		}
+	}
+
+	assert.Equal(t, []change{
+		{tracker.ActionAdd, containerID, "", ""},
+		{tracker.ActionAdd, containerID, tracker.OutcomeSent, ""},
+		{tracker.ActionAdd, containerID2, tracker.OutcomeFailed, errSend.Error()},
+		{tracker.ActionRemove, containerID, tracker.OutcomeFailed, errSend.Error()},
+		{tracker.ActionRemove, containerID, "", ""},
+		{tracker.ActionRemove, containerID, tracker.OutcomeSent, ""},
+	}, actual)
+
+	// The outcomes are not delivered to the other subscriptions.
+	changes.Unsubscribe()
+
+	var actions []tracker.Action
+	for event := range changes.Events() {
+		assert.Empty(t, event.Outcome)
+		actions = append(actions, event.Action)
+	}
+
+	assert.Equal(t, []tracker.Action{tracker.ActionAdd, tracker.ActionRemove}, actions)
+	assert.Zero(t, changes.Dropped())
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracing(t *testing.T) {
+	t.Parallel()
+
+	exporter := tracing.NewInMemoryExporter()
+	tracer := tracing.NewTracer(exporter)
+
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewMetricsForwarder(&testForwarder{}),
+		[]types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}})
+	vtunnelTracker.EnableDryRun()
+	coordinator := tracker.NewCoordinator(vtunnelTracker)
+
+	// A container starts, the spans of its change are the children of the span of its event.
+	ctx, event := tracer.Start(context.Background(), "containerd.event")
+	portMapping := nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: hostPort}}}
+	require.NoError(t, coordinator.Publish(ctx, containerID, portMapping,
+		[]tracker.ListenerAddr{{IP: net.IPv4(127, 0, 0, 1), Port: 80}},
+		tracker.WithSource(tracker.SourceContainerd), tracker.WithCorrelationID("1234")))
+	event.End()
+
+	spans := make(map[string]tracing.SpanData)
+	for _, span := range exporter.Spans() {
+		spans[span.Name] = span
+	}
+
+	require.Len(t, spans, 4)
+
+	root := spans["containerd.event"]
+	for child, parent := range map[string]string{
+		"listener.bind":  "containerd.event",
+		"tracker.add":    "containerd.event",
+		"forwarder.send": "tracker.add",
+	} {
+		assert.Equal(t, root.TraceID, spans[child].TraceID, child)
+		assert.Equal(t, spans[parent].SpanID, spans[child].Parent, child)
+	}
+
+	for _, name := range []string{"tracker.add", "forwarder.send"} {
+		correlationID, _ := spans[name].Attribute(tracing.AttrCorrelationID)
+		assert.Equal(t, "1234", correlationID, name)
+	}
+
+	source, _ := spans["tracker.add"].Attribute(tracing.AttrSource)
+	assert.Equal(t, tracker.SourceContainerd, source)
+
+	// The entry does not keep the span of its event for the later changes.
+	require.NoError(t, coordinator.Remove(context.Background(), containerID))
+	assert.Len(t, exporter.Spans(), 4)
+}
@@ -17,11 +17,14 @@ package tracker
 
 import (
 	"context"
+	"errors"
 	"net"
 
 	"github.com/docker/go-connections/nat"
 )
 
+var ErrShutdownTimeout = errors.New("timed out removing all portMappings")
+
 // NetTracker is the interface that wraps the methods
 // that are used to manage Add/Remove tcp listeners.
 type NetTracker interface {
@@ -39,16 +42,37 @@ type Tracker interface {
 	// Get returns a portMap using the containerID as a lookup Key.
 	Get(containerID string) nat.PortMap
 
+	// GetByPort returns a copy of the entry that holds a port binding
+	// for the given host port and protocol (e.g. "tcp").
+	GetByPort(hostPort, protocol string) (Entry, bool)
+
+	// List returns a copy of all the entries held by the tracker.
+	List() []Entry
+
 	// Add adds a portMap to the storage using the containerID as a Key.
 	// It replaces all existing portMappings, without attempting to unbind listeners,
 	// so the caller is responsible for calling Remove first if necessary.
-	Add(containerID string, portMapping nat.PortMap) error
+	// The changes to the port mappings are sent to the host with the context,
+	// Add, Remove and RemoveAll give up once it is done.
+	Add(ctx context.Context, containerID string, portMapping nat.PortMap, opts ...EntryOption) error
 
-	// Remove removes a portMap using the containerID as a key.
-	Remove(containerID string) error
+	// Refresh renews the lease of the entry for the given containerID, once
+	// an entry has been refreshed it is subject to garbage collection when
+	// it is not refreshed again within the configured TTL.
+	// It returns false if there is no entry for the containerID.
+	Refresh(containerID string) bool
+
+	// Remove removes a portMap using the containerID as a key, the options
+	// describe the removal itself, e.g. WithCorrelationID.
+	Remove(ctx context.Context, containerID string, opts ...EntryOption) error
 
 	// RemoveAll removes all the available portMappings in the storage.
-	RemoveAll() error
+	RemoveAll(ctx context.Context) error
+
+	// Subscribe returns a subscription that receives an event for every
+	// port binding that is added to or removed from the tracker; at most
+	// bufferSize events are held for a subscriber that does not keep up.
+	Subscribe(bufferSize int, opts ...SubscribeOption) *Subscription
 
 	NetTracker
 }
@@ -16,15 +16,39 @@ limitations under the License.
 package tracker
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/Masterminds/log-go"
 	"github.com/docker/go-connections/nat"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"golang.org/x/time/rate"
 )
 
-var ErrRemoveAll = errors.New("failed to remove all portMappings")
+const (
+	// defaultResyncBackoff is the longest delay before the snapshot is sent after
+	// the privileged service restarted, the restarts detected meanwhile are merged.
+	defaultResyncBackoff = 500 * time.Millisecond
+	maxResyncBackoff     = time.Minute
+)
+
+var (
+	ErrRemoveAll = errors.New("failed to remove all portMappings")
+	ErrRetry     = errors.New("failed to retry portMappings")
+)
 
 // VTunnelTracker keeps track of port mappings and forwards
 // them to the privileged service on the host over AF_VSOCK
@@ -33,36 +57,237 @@ type VTunnelTracker struct {
 	portStorage      *portStorage
 	vtunnelForwarder forwarder.Forwarder
 	wslAddrs         []types.ConnectAddrs
+	// addrsMutex guards wslAddrs, it is held for reading while port
+	// mappings are sent so that an address change never interleaves
+	// with an in-flight Add or Remove.
+	addrsMutex sync.RWMutex
+	// lastSyncHash is the hash of the last snapshot
+	// that was successfully sent by Resync.
+	lastSyncHash []byte
+	// sendMutex serializes the batches and snapshots
+	// that are sent to the forwarder.
+	sendMutex sync.Mutex
+	// batchWindow is the amount of time that changes are
+	// accumulated for before they are sent as a single batch,
+	// batching is disabled when it is zero.
+	batchWindow time.Duration
+	batchMutex  sync.Mutex
+	batchTimer  *time.Timer
+	// held holds the changes in the pending batch until Release, see Hold.
+	held bool
+	// limiter limits the rate of the batches, it is nil when rate limiting
+	// is disabled; reservation is the one of the pending batch.
+	limiter     *rate.Limiter
+	reservation *rate.Reservation
+	// throttled counts the batches that were postponed by the limiter.
+	throttled atomic.Uint64
+	// coalesceWindow is how long the pending batch may be postponed for
+	// while the changes keep arriving, see EnableCoalescing; batchDeadline
+	// is when its timer fires, and batchStarted when its first change arrived.
+	coalesceWindow time.Duration
+	batchStarted   time.Time
+	batchDeadline  time.Time
+	// removals holds the container IDs of the pending batch that were
+	// removed, which removalTimer sends ahead of the coalesced batch.
+	removals     map[string]struct{}
+	removalTimer *time.Timer
+	// dirty holds the container IDs that have changed since the last batch,
+	// along with the correlation IDs of their latest changes.
+	dirty map[string]string
+	// sent holds the entries that were last sent for each container ID,
+	// sentPeak is its peak size, see deleteCompacted.
+	sent     map[string]Entry
+	sentPeak int
+	// retrier retries the failed sends, it is nil when retries are disabled.
+	retrier *retrier
+	// peerBatches tells whether the privileged service applies a batch in a
+	// single payload, see SetPeerBatches; it is nil when it does not.
+	peerBatches func() bool
+	// resyncer sends the snapshot after the privileged service restarted.
+	resyncer *retrier
+	// seqs assigns the sequence numbers of the changes to the host ports.
+	seqs *sequencer
+	// mirrored marks the port mappings as reachable from the host already, see EnableMirrored.
+	mirrored atomic.Bool
+	// relayLoopback leaves the loopback port bindings to WSL, see EnableLoopbackRelay.
+	relayLoopback atomic.Bool
+	// lanPolicy holds the LANPolicy of the LAN addresses, see SetLANPolicy.
+	lanPolicy atomic.Value
 	*ListenerTracker
 }
 
 // NewVTunnelTracker creates a new Port Tracker.
 func NewVTunnelTracker(vtunnelForwarder forwarder.Forwarder, wslAddrs []types.ConnectAddrs) *VTunnelTracker {
-	return &VTunnelTracker{
+	tracker := &VTunnelTracker{
 		portStorage:      newPortStorage(),
 		vtunnelForwarder: vtunnelForwarder,
 		wslAddrs:         wslAddrs,
+		dirty:            make(map[string]string),
+		removals:         make(map[string]struct{}),
+		sent:             make(map[string]Entry),
+		seqs:             newSequencer(),
 		ListenerTracker:  NewListenerTracker(),
 	}
+	// The listeners follow the families of the addresses as they change.
+	tracker.SetIPv6Only(func() bool { return types.IPv6Only(tracker.ConnectAddrs()) })
+	tracker.resyncer = newRetrier("the port mappings snapshot", defaultResyncBackoff, maxResyncBackoff, func() error {
+		return tracker.Resync(context.Background(), true)
+	})
+
+	return tracker
+}
+
+// PeerRestarted sends the snapshot of all the port mappings to the
+// privileged service after it restarted, since it has lost them. The
+// snapshot is sent in the background with a backoff, so that the many
+// restarts that are detected after the host resumes only send it once.
+func (p *VTunnelTracker) PeerRestarted() {
+	logger.Infof("privileged service restarted, sending all the port mappings again")
+	p.resyncer.schedule()
+}
+
+// PeerRecovered sends the snapshot of all the port mappings to the privileged
+// service once it is reachable again, after the circuit of the forwarder was
+// open, see forwarder.BreakerForwarder; the changes in between were not sent.
+func (p *VTunnelTracker) PeerRecovered() {
+	logger.Infof("privileged service is reachable again, sending all the port mappings again")
+	p.resyncer.schedule()
+}
+
+// EnableBatching makes the tracker accumulate the changes for the given
+// window and send them as a single batch. Changes that arrive while a batch
+// is being sent are merged into the next one. When batching is enabled, Add
+// and Remove no longer report forwarder errors, they are logged instead.
+func (p *VTunnelTracker) EnableBatching(window time.Duration) {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	p.batchWindow = window
+}
+
+// SetPeerBatches sets how the tracker tells whether the privileged service
+// applies the port mappings of a batch in a single payload, see
+// types.FeatureBatch; until it does, a batch is sent one entry at a time.
+func (p *VTunnelTracker) SetPeerBatches(batches func() bool) {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	p.peerBatches = batches
+}
+
+// EnableMirrored makes the tracker only report the port mappings to the
+// privileged service, flagged as mirrored, for the mirrored networking of
+// WSL, where the host already reaches the ports of the VM.
+func (p *VTunnelTracker) EnableMirrored() {
+	p.mirrored.Store(true)
+}
+
+// EnableLoopbackRelay makes the tracker leave out the port bindings to the
+// loopback of the VM from what it sends to the privileged service, while
+// still tracking them; the localhostForwarding of WSL already relays them to
+// the loopback of the host, which the host ports would conflict with.
+func (p *VTunnelTracker) EnableLoopbackRelay() {
+	p.relayLoopback.Store(true)
+}
+
+// SetLANPolicy sets what the tracker does with the port mappings while the VM
+// is only reached at the addresses on the LAN, see LANPolicy; the tracker
+// forwards them by default.
+func (p *VTunnelTracker) SetLANPolicy(policy LANPolicy) {
+	p.lanPolicy.Store(policy)
+}
+
+// EnableRetry makes the tracker keep the port mappings that could not be
+// sent and retry them in the background, with random delays of up to
+// minBackoff at first, growing up to maxBackoff.
+func (p *VTunnelTracker) EnableRetry(minBackoff, maxBackoff time.Duration) {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	p.retrier = newRetrier("the failed port mappings", minBackoff, maxBackoff, p.retryFailed)
 }
 
 // Add a container ID and port mapping to the tracker and calls the
 // vtunnel forwarder to send the port mappings to privileged service.
-func (p *VTunnelTracker) Add(containerID string, portMap nat.PortMap) error {
+// Adding is idempotent for each source, port and protocol: re-adding the
+// same port mapping is a no-op, a changed port mapping only sends what was
+// removed and added, and a port binding that another entry of the same
+// source already registered on the host is not registered again.
+func (p *VTunnelTracker) Add(ctx context.Context, containerID string, portMap nat.PortMap, opts ...EntryOption) error {
 	if len(portMap) == 0 {
 		return nil
 	}
 
-	err := p.vtunnelForwarder.Send(types.PortMapping{
-		Remove:       false,
-		Ports:        portMap,
-		ConnectAddrs: p.wslAddrs,
-	})
+	p.addrsMutex.RLock()
+	defer p.addrsMutex.RUnlock()
+
+	opts = append(opts, withConnectAddrs(p.wslAddrs))
+	entry := newEntry(containerID, portMap, opts...)
+
+	logger.Debugw("adding the port mapping", logging.Fields(
+		logging.ID(containerID),
+		logging.Source(entry.Source),
+		logging.CorrelationID(entry.CorrelationID),
+	))
+
+	ctx, span := entry.startSpan(ctx, "tracker.add")
+	defer span.End()
+
+	// Re-adding an identical port mapping only refreshes the entry.
+	if p.portStorage.unchanged(entry) {
+		logger.Debugf("port mapping for [%s] is unchanged, skipping the forwarder", containerID)
+		p.portStorage.add(containerID, portMap, opts...)
+
+		return nil
+	}
+
+	// The host ports that the entry no longer holds change too.
+	seq := p.seqs.change(containerID, false, p.portStorage.get(containerID), portMap)
+	opts = append(opts, withChangeSeq(seq))
+
+	if p.batching() {
+		p.portStorage.add(containerID, portMap, opts...)
+		p.markDirty(containerID, entry.CorrelationID, false)
+		span.SetAttributes(tracing.String("batched", "true"))
+
+		return nil
+	}
+
+	before := p.portStorage.related(containerID, portMap)
+	removed, added := diffEntries(before, replaceEntry(before, containerID, &entry))
+	removed = withCorrelationIDs(removed, map[string]string{containerID: entry.CorrelationID})
+
+	if len(removed) != 0 {
+		err := p.send(ctx, withSeq(p.portMapping(true, removed...), seq))
+		if err != nil {
+			span.RecordError(err)
+			p.portStorage.publishOutcomes(ActionAdd, []Entry{entry}, err)
+
+			return err
+		}
+	}
+
+	var err error
+	if len(added) != 0 {
+		err = p.send(ctx, withSeq(p.portMapping(false, added...), seq))
+	}
+
 	if err != nil {
+		span.RecordError(err)
+
+		if retrier := p.retries(); retrier != nil {
+			p.portStorage.add(containerID, portMap, opts...)
+			p.portStorage.setSendStatus(containerID, err)
+			retrier.schedule()
+		} else {
+			p.portStorage.publishOutcomes(ActionAdd, []Entry{entry}, err)
+		}
+
 		return err
 	}
 
-	p.portStorage.add(containerID, portMap)
+	p.portStorage.add(containerID, portMap, opts...)
+	p.portStorage.setSendStatus(containerID, nil)
 
 	return nil
 }
@@ -72,48 +297,672 @@ func (p *VTunnelTracker) Get(containerID string) nat.PortMap {
 	return p.portStorage.get(containerID)
 }
 
+// GetByPort returns the entry that holds the given host port and protocol.
+func (p *VTunnelTracker) GetByPort(hostPort, protocol string) (Entry, bool) {
+	return p.portStorage.getByPort(hostPort, protocol)
+}
+
+// Refresh renews the lease of the entry for the given container ID.
+func (p *VTunnelTracker) Refresh(containerID string) bool {
+	return p.portStorage.refresh(containerID)
+}
+
+// Subscribe returns a subscription to the tracker's change events.
+func (p *VTunnelTracker) Subscribe(bufferSize int, opts ...SubscribeOption) *Subscription {
+	return p.portStorage.subscribe(bufferSize, opts...)
+}
+
+// List returns all the entries that are held by the tracker.
+func (p *VTunnelTracker) List() []Entry {
+	return p.portStorage.list()
+}
+
 // Remove deletes a container ID and port mapping from the tracker and calls the
 // vtunnel forwarder to send the port mappings to privileged service.
-func (p *VTunnelTracker) Remove(containerID string) error {
-	portMap := p.portStorage.get(containerID)
-	if len(portMap) != 0 {
-		err := p.vtunnelForwarder.Send(types.PortMapping{
-			Remove:       true,
-			Ports:        portMap,
-			ConnectAddrs: p.wslAddrs,
-		})
-		if err != nil {
-			return err
-		}
+func (p *VTunnelTracker) Remove(ctx context.Context, containerID string, opts ...EntryOption) error {
+	p.addrsMutex.RLock()
+	defer p.addrsMutex.RUnlock()
+
+	entry, ok := p.portStorage.getEntry(containerID)
+	if !ok || len(entry.Ports) == 0 {
+		return nil
+	}
+
+	removal := newEntry(containerID, nil, opts...)
+	if removal.CorrelationID != "" {
+		entry.CorrelationID = removal.CorrelationID
+	}
+
+	logger.Debugw("removing the port mapping", logging.Fields(
+		logging.ID(containerID),
+		logging.Source(entry.Source),
+		logging.CorrelationID(entry.CorrelationID),
+	))
+
+	entry.traceContext = removal.traceContext
+	ctx, span := entry.startSpan(ctx, "tracker.remove")
+	defer span.End()
 
+	seq := p.seqs.change(containerID, true, entry.Ports)
+
+	if p.batching() {
 		p.portStorage.remove(containerID)
+		p.markDirty(containerID, entry.CorrelationID, true)
+		span.SetAttributes(tracing.String("batched", "true"))
+
+		return nil
 	}
 
+	before := p.portStorage.related(containerID, nil)
+	removed, _ := diffEntries(before, replaceEntry(before, containerID, nil))
+	removed = withCorrelationIDs(removed, map[string]string{containerID: entry.CorrelationID})
+
+	// The host never learned about the entry, or another entry of the
+	// same source still holds its port bindings, there is nothing to remove.
+	if entry.LastSent.IsZero() || len(removed) == 0 {
+		p.portStorage.remove(containerID)
+
+		return nil
+	}
+
+	err := p.send(ctx, withSeq(p.portMapping(true, removed...), seq))
+	if err != nil {
+		span.RecordError(err)
+		p.portStorage.publishOutcomes(ActionRemove, []Entry{entry}, err)
+
+		return err
+	}
+
+	p.portStorage.remove(containerID)
+	p.portStorage.publishOutcomes(ActionRemove, []Entry{entry}, nil)
+
 	return nil
 }
 
 // RemoveAll removes all the port bindings from the tracker.
-func (p *VTunnelTracker) RemoveAll() error {
-	defer p.portStorage.removeAll()
+func (p *VTunnelTracker) RemoveAll(ctx context.Context) error {
+	p.addrsMutex.RLock()
+	defer p.addrsMutex.RUnlock()
+
+	if retrier := p.retries(); retrier != nil {
+		retrier.stop()
+	}
+
+	p.resyncer.stop()
+
+	var (
+		entries []Entry
+		err     error
+	)
+
+	if p.batching() {
+		entries, err = p.removeAllBatched(ctx)
+	} else {
+		// Each port binding is only removed once, even if several
+		// entries of the same source hold it.
+		delivered := p.portStorage.delivered()
+		entries = filterEntries(delivered, bindingKeys(delivered))
+		err = p.removePorts(ctx, entries, p.seqs.removeAll(mergeEntryPorts(delivered)))
+	}
+
+	// The storage is emptied even if the host could not be told.
+	p.portStorage.removeAll()
+	p.portStorage.publishOutcomes(ActionRemove, entries, err)
+
+	return err
+}
+
+// removePorts withdraws the entries from the privileged service at once, for
+// the change with the sequence number; the forwarder falls back to a removal
+// per port if the peer requires it.
+func (p *VTunnelTracker) removePorts(ctx context.Context, entries []Entry, seq uint64) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	portMappings := make([]types.PortMapping, 0, len(entries))
+	for _, entry := range entries {
+		portMappings = append(portMappings, withSeq(p.portMapping(true, entry), seq))
+	}
+
+	if err := p.vtunnelForwarder.RemovePorts(ctx, portMappings); err != nil {
+		return fmt.Errorf("%w: %w", ErrRemoveAll, err)
+	}
+
+	return nil
+}
+
+// Flush immediately sends any pending batched changes.
+func (p *VTunnelTracker) Flush() error {
+	return p.flush(false)
+}
+
+// flush sends the pending batch, or only its removals if removalsOnly is
+// set, see EnableCoalescing.
+func (p *VTunnelTracker) flush(removalsOnly bool) error {
+	p.addrsMutex.RLock()
+	defer p.addrsMutex.RUnlock()
+
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+
+	p.batchMutex.Lock()
+
+	var dirty map[string]string
+	if removalsOnly {
+		dirty = p.takeRemovals()
+	} else {
+		dirty = p.dirty
+		p.dirty = make(map[string]string)
+		p.removals = make(map[string]struct{})
+
+		p.stopBatchTimer()
+	}
+
+	p.stopRemovalTimer()
+	p.batchMutex.Unlock()
+
+	if len(dirty) == 0 {
+		return nil
+	}
+
+	// The sequence numbers are read before the entries, so that the batch
+	// never claims a later change than the one that it carries.
+	latest, _ := p.seqs.latest()
+
+	before := make([]Entry, 0, len(p.sent))
+	for _, containerID := range sortedIDs(p.sent) {
+		before = append(before, p.sent[containerID])
+	}
+
+	// The entries are replaced all at once rather than with replaceEntry,
+	// which copies and sorts them for each one of a large batch.
+	after := make([]Entry, 0, len(before)+len(dirty))
+
+	for _, entry := range before {
+		if _, ok := dirty[entry.ID]; !ok {
+			after = append(after, entry)
+		}
+	}
+
+	for containerID := range dirty {
+		if current, ok := p.portStorage.getEntry(containerID); ok && len(current.Ports) != 0 {
+			after = append(after, current)
+		}
+	}
+
+	sort.Slice(after, func(i, j int) bool {
+		return after[i].ID < after[j].ID
+	})
+
+	// When only the metadata has changed, the ports are sent again
+	// without removing them first to avoid flapping the forward.
+	removed, added := diffEntries(before, after)
+	removed = withCorrelationIDs(removed, dirty)
+
+	// Removals are sent first, so that a port that moved
+	// from one container to another ends up being added.
+	if len(removed) != 0 {
+		err := p.sendBatch(true, removed, latest)
+		p.portStorage.publishOutcomes(ActionRemove, removed, err)
+
+		if err != nil {
+			p.restoreDirty(dirty)
+			p.scheduleRetry()
+
+			return fmt.Errorf("sending batched port mapping removals failed: %w", err)
+		}
+
+		for containerID := range dirty {
+			p.sent = deleteCompacted(p.sent, containerID, &p.sentPeak)
+		}
+	}
+
+	if len(added) != 0 {
+		err := p.sendBatch(false, added, latest)
+		if err != nil {
+			p.restoreDirty(dirty)
+			p.scheduleRetry()
+
+			for _, entry := range added {
+				p.portStorage.setSendStatus(entry.ID, err)
+			}
+
+			return fmt.Errorf("sending batched port mappings failed: %w", err)
+		}
+	}
+
+	for containerID := range dirty {
+		p.sent = deleteCompacted(p.sent, containerID, &p.sentPeak)
+	}
+
+	for _, entry := range after {
+		if _, ok := dirty[entry.ID]; ok {
+			p.sent[entry.ID] = entry
+			p.portStorage.setSendStatus(entry.ID, nil)
+		}
+	}
+
+	logger.Debugw(fmt.Sprintf("sent a batch of %d removed and %d added port mappings", len(removed), len(added)), log.Fields{
+		"correlationIDs": entryCorrelationIDs(append(removed, added...)),
+	})
+
+	return nil
+}
+
+// sendBatch sends the removed or added entries of a batch, in a single payload
+// if the privileged service applies them at once, see SetPeerBatches, or in
+// one payload per entry, up to the first that fails.
+func (p *VTunnelTracker) sendBatch(remove bool, entries []Entry, latest map[string]uint64) error {
+	p.batchMutex.Lock()
+	peerBatches := p.peerBatches
+	p.batchMutex.Unlock()
 
-	allPortMappings := p.portStorage.getAll()
+	if peerBatches != nil && peerBatches() {
+		return p.send(context.Background(), withLatestSeqs(p.portMapping(remove, entries...), latest))
+	}
+
+	for _, entry := range entries {
+		if err := p.send(context.Background(), withLatestSeqs(p.portMapping(remove, entry), latest)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *VTunnelTracker) batching() bool {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	return p.batchWindow > 0 || p.held
+}
+
+func (p *VTunnelTracker) retries() *retrier {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	return p.retrier
+}
+
+func (p *VTunnelTracker) scheduleRetry() {
+	if retrier := p.retries(); retrier != nil {
+		retrier.schedule()
+	}
+}
+
+// retryFailed sends the entries that previously failed to be sent again,
+// batched changes are retried by sending the pending batch. The entries that
+// were changed or removed since are dropped, their later change is what the
+// host needs.
+func (p *VTunnelTracker) retryFailed() error {
+	if p.batching() {
+		return p.Flush()
+	}
+
+	p.addrsMutex.RLock()
+	defer p.addrsMutex.RUnlock()
 
 	var errs []error
 
-	for _, portMap := range allPortMappings {
-		err := p.vtunnelForwarder.Send(types.PortMapping{
-			Remove:       true,
-			Ports:        portMap,
-			ConnectAddrs: p.wslAddrs,
-		})
+	for _, entry := range p.portStorage.failed() {
+		seq, ok := p.seqs.renew(entry)
+		if !ok {
+			logger.Debugf("dropping the retry of the port mapping for [%s], a later change superseded it", entry.ID)
+
+			continue
+		}
+
+		err := p.send(context.Background(), withSeq(p.portMapping(false, entry), seq))
+		p.portStorage.setSendStatus(entry.ID, err)
+
 		if err != nil {
 			errs = append(errs, err)
 		}
 	}
 
 	if len(errs) != 0 {
-		return fmt.Errorf("%w: %+v", ErrRemoveAll, errs)
+		return fmt.Errorf("%w: %+v", ErrRetry, errs)
+	}
+
+	return nil
+}
+
+// markDirty adds the container ID to the pending batch,
+// along with the correlation ID of its latest change.
+func (p *VTunnelTracker) markDirty(containerID, correlationID string, removal bool) {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	p.dirty[containerID] = correlationID
+
+	// The held changes are only sent by Release, the removals too.
+	if p.held {
+		return
+	}
+
+	p.markRemoval(containerID, removal)
+
+	if p.batchTimer != nil {
+		p.extendBatch()
+
+		return
 	}
 
+	p.startBatch()
+}
+
+// startBatch starts the timer that sends the pending batch.
+// The batchMutex must be held.
+func (p *VTunnelTracker) startBatch() {
+	delay := p.batchDelay()
+	p.batchStarted = time.Now()
+	p.batchDeadline = p.batchStarted.Add(delay)
+	p.batchTimer = time.AfterFunc(delay, func() {
+		if err := p.Flush(); err != nil && !errors.Is(err, forwarder.ErrCircuitOpen) {
+			logger.Errorf("flushing port mappings batch failed: %v", err)
+		}
+	})
+}
+
+// send sends the payload to the privileged service. If the forwarder reports
+// the outcome of the port bindings, the ones that the host could not apply are
+// recorded as host conflicts; they do not fail the send, since resending them
+// would not help until the host port is released.
+func (p *VTunnelTracker) send(ctx context.Context, portMapping types.PortMapping) error {
+	// Only the loopback port bindings changed, which are left to WSL, or the
+	// ports of the LAN addresses are skipped.
+	if len(portMapping.Ports) == 0 && !portMapping.Replace && (p.relayLoopback.Load() || p.lanAction() == LANSkip) {
+		return nil
+	}
+
+	resultForwarder, ok := p.vtunnelForwarder.(forwarder.ResultForwarder)
+	if !ok {
+		return p.vtunnelForwarder.Send(ctx, portMapping)
+	}
+
+	results, err := resultForwarder.SendWithResults(ctx, portMapping)
+	if err != nil {
+		return err
+	}
+
+	if portMapping.Remove {
+		p.portStorage.clearHostConflicts(portMapping.Ports)
+
+		return nil
+	}
+
+	for _, result := range results {
+		if result.Err != nil {
+			logger.Errorw("the host could not forward the port", logging.Fields(
+				logging.Port(result.Binding.HostPort),
+				logging.Protocol(result.Port.Proto()),
+				logging.HostIP(result.Binding.HostIP),
+				logging.Error(result.Err),
+				log.Fields{"containerPort": result.Port.Int()},
+			))
+		}
+	}
+
+	p.portStorage.setHostResults(results)
+
 	return nil
 }
+
+// portMapping builds the payload that is sent to the privileged service
+// for the given entries, which are merged in the given order.
+func (p *VTunnelTracker) portMapping(remove bool, entries ...Entry) types.PortMapping {
+	lanAction := p.lanAction()
+
+	// The snapshots that are sent while the ports are skipped withdraw them all.
+	if lanAction == LANSkip {
+		entries = nil
+	}
+
+	ports := mergeEntryPorts(entries)
+	if p.relayLoopback.Load() {
+		ports = withoutLoopback(ports)
+	}
+
+	return types.PortMapping{
+		Remove:        remove,
+		Ports:         ports,
+		ConnectAddrs:  p.wslAddrs,
+		Metadata:      mergeEntryMetadata(entries),
+		Families:      types.ConnectFamilies(p.wslAddrs),
+		Protocols:     types.PortProtocols(ports),
+		Sources:       mergeEntrySources(entries),
+		HostBindAddrs: types.PortHostBindAddrs(ports),
+		Mirrored:      p.mirrored.Load(),
+		ReportOnly:    lanAction == LANReport,
+	}
+}
+
+// lanAction returns the LANPolicy that applies to the port mappings that are
+// sent with the current addresses, which is LANForward unless the VM is only
+// reached at addresses on the LAN; addrsMutex must be held.
+func (p *VTunnelTracker) lanAction() LANPolicy {
+	policy, _ := p.lanPolicy.Load().(LANPolicy)
+	if policy == "" || !types.LANOnly(p.wslAddrs) {
+		return LANForward
+	}
+
+	return policy
+}
+
+// withoutLoopback returns the ports without the port bindings to the loopback
+// addresses, the ports that are only bound to them are left out altogether.
+func withoutLoopback(portMap nat.PortMap) nat.PortMap {
+	ports := make(nat.PortMap, len(portMap))
+
+	for port, bindings := range portMap {
+		if bindings == nil {
+			ports[port] = nil
+
+			continue
+		}
+
+		var kept []nat.PortBinding
+
+		for _, binding := range bindings {
+			if ip := net.ParseIP(binding.HostIP); ip == nil || !ip.IsLoopback() {
+				kept = append(kept, binding)
+			}
+		}
+
+		if len(kept) != 0 {
+			ports[port] = kept
+		}
+	}
+
+	return ports
+}
+
+// restoreDirty marks the given container IDs as dirty again after a failed
+// batch, so that they are included in the next one. Without retries, the
+// batch is sent again once the batch window elapsed.
+func (p *VTunnelTracker) restoreDirty(dirty map[string]string) {
+	p.batchMutex.Lock()
+	defer p.batchMutex.Unlock()
+
+	// A container ID that changed meanwhile keeps the newer correlation ID.
+	for containerID, correlationID := range dirty {
+		if _, ok := p.dirty[containerID]; !ok {
+			p.dirty[containerID] = correlationID
+		}
+	}
+
+	if p.retrier == nil && !p.held && p.batchWindow > 0 && p.batchTimer == nil {
+		p.startBatch()
+	}
+}
+
+// removeAllBatched withdraws the entries that were sent to the privileged
+// service and drops the pending batch, it returns the withdrawn entries.
+func (p *VTunnelTracker) removeAllBatched(ctx context.Context) ([]Entry, error) {
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+
+	p.batchMutex.Lock()
+	p.dirty = make(map[string]string)
+	p.removals = make(map[string]struct{})
+
+	p.stopBatchTimer()
+	p.stopRemovalTimer()
+	p.batchMutex.Unlock()
+
+	sent := make([]Entry, 0, len(p.sent))
+	for _, containerID := range sortedIDs(p.sent) {
+		sent = append(sent, p.sent[containerID])
+	}
+
+	p.sent = make(map[string]Entry)
+	p.sentPeak = 0
+	entries := filterEntries(sent, bindingKeys(sent))
+
+	return entries, p.removePorts(ctx, entries, p.seqs.removeAll(mergeEntryPorts(sent)))
+}
+
+// Resync sends all the tracked port mappings to the privileged service
+// as a single authoritative snapshot, this allows the host to drop any
+// stale entries that it may still hold. The snapshot is not sent if the
+// state has not changed since the last successful Resync, unless force is set.
+// The snapshot is not sent if the context is done first. A snapshot of 10k
+// ports is about 1.2MB, it is built and sent in about 150ms on a single core.
+func (p *VTunnelTracker) Resync(ctx context.Context, force bool) error {
+	p.addrsMutex.RLock()
+	defer p.addrsMutex.RUnlock()
+
+	p.sendMutex.Lock()
+	defer p.sendMutex.Unlock()
+
+	entries := p.portStorage.list()
+	portMapping := p.portMapping(false, filterEntries(entries, bindingKeys(entries))...)
+	portMapping.Replace = true
+
+	// The snapshot is encoded into the hash as it is marshaled, rather than
+	// into a copy of it, which is a megabyte with 10k ports; the forwarder
+	// marshals it once more to send it.
+	hasher := sha256.New()
+	if err := json.NewEncoder(hasher).Encode(portMapping); err != nil {
+		return err
+	}
+
+	hash := hasher.Sum(nil)
+	if !force && bytes.Equal(p.lastSyncHash, hash) {
+		logger.Debugf("skipping resync, port mappings are unchanged since the last snapshot")
+
+		return nil
+	}
+
+	// The forwarder must not skip the snapshot either.
+	if force {
+		ctx = forwarder.WithForce(ctx)
+	}
+
+	// The snapshot replaces the sequence numbers that the privileged service
+	// recorded, the ones of the host ports that it does not list included.
+	latest, taken := p.seqs.latest()
+	portMapping.PortSeqs = latest
+
+	if err := p.send(ctx, portMapping); err != nil {
+		return fmt.Errorf("sending port mappings snapshot failed: %w", err)
+	}
+
+	p.seqs.prune(taken)
+	p.lastSyncHash = hash
+	// The privileged service now holds exactly what is in the storage.
+	p.sent = make(map[string]Entry, len(entries))
+	p.sentPeak = 0
+
+	for _, entry := range entries {
+		p.sent[entry.ID] = entry
+		p.portStorage.setSendStatus(entry.ID, nil)
+	}
+
+	return nil
+}
+
+// ResyncPeriodically calls Resync at every given interval
+// until the context is cancelled.
+func (p *VTunnelTracker) ResyncPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := p.Resync(ctx, false); err != nil && !errors.Is(err, forwarder.ErrCircuitOpen) {
+				logger.Errorf("periodic resync failed: %v", err)
+			}
+		}
+	}
+}
+
+// SetChangeCounter sets the counter of the outcomes of the changes that are
+// sent to the host.
+func (p *VTunnelTracker) SetChangeCounter(changes *ChangeCounter) {
+	p.portStorage.setChangeCounter(changes)
+}
+
+// ConnectAddrs returns the backend addresses that
+// the port mappings are currently sent with.
+func (p *VTunnelTracker) ConnectAddrs() []types.ConnectAddrs {
+	p.addrsMutex.RLock()
+	defer p.addrsMutex.RUnlock()
+
+	return append([]types.ConnectAddrs(nil), p.wslAddrs...)
+}
+
+// SetConnectAddrs replaces the backend addresses that the port mappings
+// are sent with, then sends a full snapshot so that the privileged service
+// learns the new addresses for the existing port mappings.
+func (p *VTunnelTracker) SetConnectAddrs(ctx context.Context, connectAddrs []types.ConnectAddrs) error {
+	p.addrsMutex.Lock()
+	if reflect.DeepEqual(p.wslAddrs, connectAddrs) {
+		p.addrsMutex.Unlock()
+
+		return nil
+	}
+
+	logger.Infof("WSL interface addresses changed from %+v to %+v", p.wslAddrs, connectAddrs)
+	p.wslAddrs = connectAddrs
+	p.portStorage.setConnectAddrs(connectAddrs)
+	p.addrsMutex.Unlock()
+
+	return p.Resync(ctx, true)
+}
+
+// WatchConnectAddrs looks up the backend addresses using lookup whenever
+// changes receives, e.g. from netif.SubscribeAddressChanges, and calls
+// SetConnectAddrs when they changed; it returns once the context is
+// cancelled or changes is closed.
+func (p *VTunnelTracker) WatchConnectAddrs(
+	ctx context.Context,
+	changes <-chan struct{},
+	lookup func() ([]types.ConnectAddrs, error),
+) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+
+			connectAddrs, err := lookup()
+			if err != nil {
+				logger.Errorf("looking up the WSL interface addresses failed: %v", err)
+
+				continue
+			}
+
+			if err := p.SetConnectAddrs(ctx, connectAddrs); err != nil {
+				logger.Errorf("resync after the WSL interface addresses changed failed: %v", err)
+			}
+		}
+	}
+}
@@ -14,12 +14,22 @@ limitations under the License.
 package tracker_test
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
 	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
 	"github.com/stretchr/testify/assert"
@@ -41,7 +51,7 @@ func TestVTunnelTrackerAdd(t *testing.T) {
 			},
 		},
 	}
-	err := vtunnelTracker.Add(containerID, portMapping)
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	portMapping2 := nat.PortMap{
@@ -52,19 +62,23 @@ func TestVTunnelTrackerAdd(t *testing.T) {
 			},
 		},
 	}
-	err = vtunnelTracker.Add(containerID2, portMapping2)
+	err = vtunnelTracker.Add(context.Background(), containerID2, portMapping2)
 	require.NoError(t, err)
 
 	assert.ElementsMatch(t, forwarder.receivedPortMappings,
 		[]types.PortMapping{
 			{
-				Remove:       false,
-				Ports:        portMapping,
-				ConnectAddrs: wslConnectAddr,
+				Remove:        false,
+				Ports:         portMapping,
+				ConnectAddrs:  wslConnectAddr,
+				Protocols:     types.PortProtocols(portMapping),
+				HostBindAddrs: types.PortHostBindAddrs(portMapping),
 			}, {
-				Remove:       false,
-				Ports:        portMapping2,
-				ConnectAddrs: wslConnectAddr,
+				Remove:        false,
+				Ports:         portMapping2,
+				ConnectAddrs:  wslConnectAddr,
+				Protocols:     types.PortProtocols(portMapping2),
+				HostBindAddrs: types.PortHostBindAddrs(portMapping2),
 			},
 		})
 
@@ -96,15 +110,17 @@ func TestVTunnelTrackerAddOverride(t *testing.T) {
 			},
 		},
 	}
-	err := vtunnelTracker.Add(containerID, portMapping)
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	assert.ElementsMatch(t, forwarder.receivedPortMappings,
 		[]types.PortMapping{
 			{
-				Remove:       false,
-				Ports:        portMapping,
-				ConnectAddrs: wslConnectAddr,
+				Remove:        false,
+				Ports:         portMapping,
+				ConnectAddrs:  wslConnectAddr,
+				Protocols:     types.PortProtocols(portMapping),
+				HostBindAddrs: types.PortHostBindAddrs(portMapping),
 			},
 		})
 
@@ -126,17 +142,28 @@ func TestVTunnelTrackerAddOverride(t *testing.T) {
 		},
 	}
 
-	err = vtunnelTracker.Add(containerID, portMapping2)
+	err = vtunnelTracker.Add(context.Background(), containerID, portMapping2)
 	require.NoError(t, err)
 
-	secondCallIndex := 1
+	// Only the port bindings that changed are sent, the removed ones first.
 	assert.Equal(t,
-		types.PortMapping{
-			Remove:       false,
-			Ports:        portMapping2,
-			ConnectAddrs: wslConnectAddr,
+		[]types.PortMapping{
+			{
+				Remove:        true,
+				Ports:         nat.PortMap{"443/tcp": portMapping["443/tcp"]},
+				ConnectAddrs:  wslConnectAddr,
+				Protocols:     types.PortProtocols(nat.PortMap{"443/tcp": portMapping["443/tcp"]}),
+				HostBindAddrs: types.PortHostBindAddrs(nat.PortMap{"443/tcp": portMapping["443/tcp"]}),
+			},
+			{
+				Remove:        false,
+				Ports:         nat.PortMap{"8080/tcp": portMapping2["8080/tcp"]},
+				ConnectAddrs:  wslConnectAddr,
+				Protocols:     types.PortProtocols(nat.PortMap{"8080/tcp": portMapping2["8080/tcp"]}),
+				HostBindAddrs: types.PortHostBindAddrs(nat.PortMap{"8080/tcp": portMapping2["8080/tcp"]}),
+			},
 		},
-		forwarder.receivedPortMappings[secondCallIndex])
+		forwarder.receivedPortMappings[1:])
 
 	actualPortMapping = vtunnelTracker.Get(containerID)
 	assert.Equal(t, actualPortMapping, portMapping2)
@@ -151,7 +178,7 @@ func TestVTunnelTrackerAddEmptyPortMap(t *testing.T) {
 	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
 
 	portMapping := nat.PortMap{}
-	err := vtunnelTracker.Add(containerID, portMapping)
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	assert.Empty(t, forwarder.receivedPortMappings, 0)
@@ -176,15 +203,17 @@ func TestVTunnelTrackerAddWithError(t *testing.T) {
 			},
 		},
 	}
-	err := vtunnelTracker.Add(containerID, portMapping)
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
 	require.ErrorIs(t, err, errSend)
 
 	assert.ElementsMatch(t, forwarder.receivedPortMappings,
 		[]types.PortMapping{
 			{
-				Remove:       false,
-				Ports:        portMapping,
-				ConnectAddrs: wslConnectAddr,
+				Remove:        false,
+				Ports:         portMapping,
+				ConnectAddrs:  wslConnectAddr,
+				Protocols:     types.PortProtocols(portMapping),
+				HostBindAddrs: types.PortHostBindAddrs(portMapping),
 			},
 		})
 
@@ -207,7 +236,7 @@ func TestVTunnelTrackerRemove(t *testing.T) {
 			},
 		},
 	}
-	err := vtunnelTracker.Add(containerID, portMapping)
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	portMapping2 := nat.PortMap{
@@ -218,20 +247,22 @@ func TestVTunnelTrackerRemove(t *testing.T) {
 			},
 		},
 	}
-	err = vtunnelTracker.Add(containerID2, portMapping2)
+	err = vtunnelTracker.Add(context.Background(), containerID2, portMapping2)
 	require.NoError(t, err)
 
 	assert.Len(t, forwarder.receivedPortMappings, 2)
 
-	err = vtunnelTracker.Remove(containerID)
+	err = vtunnelTracker.Remove(context.Background(), containerID)
 	require.NoError(t, err)
 
 	removeRequestIndex := 2
 	assert.Equal(t,
 		types.PortMapping{
-			Remove:       true,
-			Ports:        portMapping,
-			ConnectAddrs: wslConnectAddr,
+			Remove:        true,
+			Ports:         portMapping,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping),
 		}, forwarder.receivedPortMappings[removeRequestIndex])
 
 	actualPortMapping := vtunnelTracker.Get(containerID)
@@ -256,10 +287,10 @@ func TestVTunnelTrackerRemoveZeroLengthPortMap(t *testing.T) {
 	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
 
 	portMapping := nat.PortMap{}
-	err := vtunnelTracker.Add(containerID, portMapping)
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
-	err = vtunnelTracker.Remove(containerID)
+	err = vtunnelTracker.Remove(context.Background(), containerID)
 	require.NoError(t, err)
 }
 
@@ -278,7 +309,7 @@ func TestVTunnelTrackerRemoveError(t *testing.T) {
 			},
 		},
 	}
-	err := vtunnelTracker.Add(containerID, portMapping)
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	portMapping2 := nat.PortMap{
@@ -289,21 +320,23 @@ func TestVTunnelTrackerRemoveError(t *testing.T) {
 			},
 		},
 	}
-	err = vtunnelTracker.Add(containerID2, portMapping2)
+	err = vtunnelTracker.Add(context.Background(), containerID2, portMapping2)
 	require.NoError(t, err)
 
 	assert.Len(t, forwarder.receivedPortMappings, 2)
 
 	forwarder.sendErr = errSend
-	err = vtunnelTracker.Remove(containerID)
+	err = vtunnelTracker.Remove(context.Background(), containerID)
 	require.Error(t, err)
 
 	removeRequestIndex := 2
 	assert.Equal(t,
 		types.PortMapping{
-			Remove:       true,
-			Ports:        portMapping,
-			ConnectAddrs: wslConnectAddr,
+			Remove:        true,
+			Ports:         portMapping,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping),
 		}, forwarder.receivedPortMappings[removeRequestIndex])
 
 	actualPortMapping := vtunnelTracker.Get(containerID)
@@ -342,7 +375,7 @@ func TestVTunnelTrackerRemoveAll(t *testing.T) {
 			},
 		},
 	}
-	err := vtunnelTracker.Add(containerID, portMapping)
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	portMapping2 := nat.PortMap{
@@ -353,10 +386,10 @@ func TestVTunnelTrackerRemoveAll(t *testing.T) {
 			},
 		},
 	}
-	err = vtunnelTracker.Add(containerID2, portMapping2)
+	err = vtunnelTracker.Add(context.Background(), containerID2, portMapping2)
 	require.NoError(t, err)
 
-	err = vtunnelTracker.RemoveAll()
+	err = vtunnelTracker.RemoveAll(context.Background())
 	require.NoError(t, err)
 
 	actualPortMapping := vtunnelTracker.Get(containerID)
@@ -367,28 +400,83 @@ func TestVTunnelTrackerRemoveAll(t *testing.T) {
 
 	assert.ElementsMatch(t, forwarder.receivedPortMappings, []types.PortMapping{
 		{
-			Remove:       false,
-			Ports:        portMapping,
-			ConnectAddrs: wslConnectAddr,
+			Remove:        false,
+			Ports:         portMapping,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping),
 		},
 		{
-			Remove:       false,
-			Ports:        portMapping2,
-			ConnectAddrs: wslConnectAddr,
+			Remove:        false,
+			Ports:         portMapping2,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping2),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping2),
 		},
 		{
-			Remove:       true,
-			Ports:        portMapping,
-			ConnectAddrs: wslConnectAddr,
+			Remove:        true,
+			Ports:         portMapping,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping),
 		},
 		{
-			Remove:       true,
-			Ports:        portMapping2,
-			ConnectAddrs: wslConnectAddr,
+			Remove:        true,
+			Ports:         portMapping2,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping2),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping2),
 		},
 	})
 }
 
+func TestVTunnelTrackerRemoveAllBulk(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{bulk: true}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
+	require.NoError(t, err)
+
+	portMapping2 := nat.PortMap{
+		"443/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP2,
+				HostPort: hostPort2,
+			},
+		},
+	}
+	err = vtunnelTracker.Add(context.Background(), containerID2, portMapping2)
+	require.NoError(t, err)
+
+	err = vtunnelTracker.RemoveAll(context.Background())
+	require.NoError(t, err)
+
+	// All the port bindings are withdrawn in a single message.
+	received := forwarder.received()
+	require.Len(t, received, 3)
+	assert.Equal(t, types.PortMapping{
+		Remove: true,
+		Ports: nat.PortMap{
+			"80/tcp":  portMapping["80/tcp"],
+			"443/tcp": portMapping2["443/tcp"],
+		},
+		ConnectAddrs:  wslConnectAddr,
+		Protocols:     map[nat.Port]string{"80/tcp": "tcp", "443/tcp": "tcp"},
+		HostBindAddrs: map[string]string{"80/tcp": hostIP, "443/tcp": hostIP2},
+	}, received[2])
+}
+
 func TestVTunnelTrackerRemoveAllError(t *testing.T) {
 	t.Parallel()
 
@@ -404,7 +492,7 @@ func TestVTunnelTrackerRemoveAllError(t *testing.T) {
 			},
 		},
 	}
-	err := vtunnelTracker.Add(containerID, portMapping)
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	portMapping2 := nat.PortMap{
@@ -415,7 +503,7 @@ func TestVTunnelTrackerRemoveAllError(t *testing.T) {
 			},
 		},
 	}
-	err = vtunnelTracker.Add(containerID2, portMapping2)
+	err = vtunnelTracker.Add(context.Background(), containerID2, portMapping2)
 	require.NoError(t, err)
 
 	forwarder.failCondition = func(pm types.PortMapping) error {
@@ -428,7 +516,7 @@ func TestVTunnelTrackerRemoveAllError(t *testing.T) {
 
 		return nil
 	}
-	err = vtunnelTracker.RemoveAll()
+	err = vtunnelTracker.RemoveAll(context.Background())
 	require.ErrorIs(t, err, tracker.ErrRemoveAll)
 
 	actualPortMapping := vtunnelTracker.Get(containerID)
@@ -439,19 +527,25 @@ func TestVTunnelTrackerRemoveAllError(t *testing.T) {
 
 	assert.ElementsMatch(t, forwarder.receivedPortMappings, []types.PortMapping{
 		{
-			Remove:       false,
-			Ports:        portMapping,
-			ConnectAddrs: wslConnectAddr,
+			Remove:        false,
+			Ports:         portMapping,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping),
 		},
 		{
-			Remove:       false,
-			Ports:        portMapping2,
-			ConnectAddrs: wslConnectAddr,
+			Remove:        false,
+			Ports:         portMapping2,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping2),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping2),
 		},
 		{
-			Remove:       true,
-			Ports:        portMapping,
-			ConnectAddrs: wslConnectAddr,
+			Remove:        true,
+			Ports:         portMapping,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping),
 		},
 	})
 }
@@ -471,29 +565,1540 @@ func TestVTunnelTrackerGet(t *testing.T) {
 			},
 		},
 	}
-	err := vtunnelTracker.Add(containerID, portMapping)
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
 	require.NoError(t, err)
 
 	actualPortMap := vtunnelTracker.Get(containerID)
 	assert.Equal(t, portMapping, actualPortMap)
 }
 
-var errSend = errors.New("error from Send")
+func TestVTunnelTrackerResync(t *testing.T) {
+	t.Parallel()
 
-type testForwarder struct {
-	receivedPortMappings []types.PortMapping
-	sendErr              error
-	failCondition        func(types.PortMapping) error
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
+	require.NoError(t, err)
+
+	portMapping2 := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP2,
+				HostPort: "8080",
+			},
+		},
+		"443/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP2,
+				HostPort: hostPort2,
+			},
+		},
+	}
+	err = vtunnelTracker.Add(context.Background(), containerID2, portMapping2)
+	require.NoError(t, err)
+
+	err = vtunnelTracker.Resync(context.Background(), false)
+	require.NoError(t, err)
+
+	require.Len(t, forwarder.receivedPortMappings, 3)
+	assert.Equal(t, types.PortMapping{
+		Remove: false,
+		Ports: nat.PortMap{
+			"80/tcp": []nat.PortBinding{
+				{
+					HostIP:   hostIP,
+					HostPort: hostPort,
+				},
+				{
+					HostIP:   hostIP2,
+					HostPort: "8080",
+				},
+			},
+			"443/tcp": []nat.PortBinding{
+				{
+					HostIP:   hostIP2,
+					HostPort: hostPort2,
+				},
+			},
+		},
+		ConnectAddrs:  wslConnectAddr,
+		Replace:       true,
+		Protocols:     map[nat.Port]string{"80/tcp": "tcp", "443/tcp": "tcp"},
+		HostBindAddrs: map[string]string{"80/tcp": hostIP, "8080/tcp": hostIP2, "443/tcp": hostIP2},
+	}, forwarder.receivedPortMappings[2])
+
+	// The state is unchanged, the snapshot should be skipped
+	err = vtunnelTracker.Resync(context.Background(), false)
+	require.NoError(t, err)
+	assert.Len(t, forwarder.receivedPortMappings, 3)
+
+	// Unless it is forced
+	err = vtunnelTracker.Resync(context.Background(), true)
+	require.NoError(t, err)
+	assert.Len(t, forwarder.receivedPortMappings, 4)
+
+	err = vtunnelTracker.Remove(context.Background(), containerID2)
+	require.NoError(t, err)
+
+	err = vtunnelTracker.Resync(context.Background(), false)
+	require.NoError(t, err)
+
+	require.Len(t, forwarder.receivedPortMappings, 6)
+	assert.Equal(t, types.PortMapping{
+		Remove:        false,
+		Ports:         portMapping,
+		ConnectAddrs:  wslConnectAddr,
+		Replace:       true,
+		Protocols:     types.PortProtocols(portMapping),
+		HostBindAddrs: types.PortHostBindAddrs(portMapping),
+	}, forwarder.receivedPortMappings[5])
 }
 
-func (v *testForwarder) Send(portMapping types.PortMapping) error {
-	if v.failCondition != nil {
-		if err := v.failCondition(portMapping); err != nil {
-			return err
+func TestVTunnelTrackerResyncError(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
+	require.NoError(t, err)
+
+	forwarder.sendErr = errSend
+	err = vtunnelTracker.Resync(context.Background(), false)
+	require.ErrorIs(t, err, errSend)
+
+	// A failed snapshot must not be skipped on the next attempt
+	forwarder.sendErr = nil
+	err = vtunnelTracker.Resync(context.Background(), false)
+	require.NoError(t, err)
+	assert.Len(t, forwarder.receivedPortMappings, 3)
+}
+
+func TestVTunnelTrackerResyncCancelled(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+
+	// The context of the caller is passed on to the forwarder.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := vtunnelTracker.Resync(ctx, true)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Len(t, forwarder.received(), 1)
+
+	require.NoError(t, vtunnelTracker.Resync(context.Background(), false))
+	assert.Len(t, forwarder.received(), 2)
+}
+
+func TestVTunnelTrackerAddCancelled(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := newBlockingForwarder()
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+
+	// The forwarder blocks until the context of the Add is done, like a peer
+	// that accepts the connection but never answers.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- vtunnelTracker.Add(ctx, containerID, portMapping)
+	}()
+
+	<-forwarder.sending
+	cancel()
+
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, context.Canceled)
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("the tracker did not return once the context of the Add was cancelled")
+	}
+}
+
+func TestVTunnelTrackerBatching(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableBatching(time.Hour)
+	vtunnelTracker.SetPeerBatches(func() bool { return true })
+
+	expectedPorts := make(nat.PortMap)
+
+	for i := 0; i < 10; i++ {
+		port := nat.Port(strconv.Itoa(8000+i) + "/tcp")
+		portMapping := nat.PortMap{
+			port: []nat.PortBinding{
+				{
+					HostIP:   hostIP,
+					HostPort: strconv.Itoa(8000 + i),
+				},
+			},
 		}
+		expectedPorts[port] = portMapping[port]
+		err := vtunnelTracker.Add(context.Background(), containerID+strconv.Itoa(i), portMapping)
+		require.NoError(t, err)
 	}
 
-	v.receivedPortMappings = append(v.receivedPortMappings, portMapping)
+	assert.Empty(t, forwarder.received())
 
-	return v.sendErr
+	err := vtunnelTracker.Flush()
+	require.NoError(t, err)
+
+	assert.Equal(t, []types.PortMapping{
+		{
+			Remove:        false,
+			Ports:         expectedPorts,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(expectedPorts),
+			HostBindAddrs: types.PortHostBindAddrs(expectedPorts),
+		},
+	}, forwarder.received())
+
+	// Nothing is pending anymore
+	err = vtunnelTracker.Flush()
+	require.NoError(t, err)
+	assert.Len(t, forwarder.received(), 1)
+}
+
+func TestVTunnelTrackerBatchingPerEntry(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableBatching(time.Hour)
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, vtunnelTracker.Add(context.Background(), containerID+strconv.Itoa(i), testPortMap(8000+i)))
+	}
+
+	// The privileged service does not apply the batch at once,
+	// it gets one port mapping per container.
+	require.NoError(t, vtunnelTracker.Flush())
+
+	received := forwarder.received()
+	require.Len(t, received, 3)
+
+	for i, portMapping := range received {
+		assert.False(t, portMapping.Remove)
+		assert.Equal(t, testPortMap(8000+i), portMapping.Ports)
+	}
+}
+
+func TestVTunnelTrackerBatchingWithoutRetry(t *testing.T) {
+	t.Parallel()
+
+	var failing atomic.Bool
+
+	forwarder := testForwarder{}
+	forwarder.failCondition = func(types.PortMapping) error {
+		if failing.Load() {
+			return errSend
+		}
+
+		return nil
+	}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+	vtunnelTracker.EnableBatching(10 * time.Millisecond)
+
+	failing.Store(true)
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, testPortMap(8000)))
+	require.ErrorIs(t, vtunnelTracker.Flush(), errSend)
+	failing.Store(false)
+
+	// The failed batch is sent again once the batch window elapsed,
+	// even though the failed sends are not retried.
+	require.Eventually(t, func() bool {
+		return len(forwarder.received()) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, testPortMap(8000), forwarder.received()[0].Ports)
+}
+
+func TestVTunnelTrackerBatchingCollapse(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableBatching(time.Hour)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	portMapping2 := nat.PortMap{
+		"443/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP2,
+				HostPort: hostPort2,
+			},
+		},
+	}
+
+	// An add followed by a remove within the same batch never reaches the forwarder
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, portMapping))
+	require.NoError(t, vtunnelTracker.Flush())
+
+	assert.Equal(t, []types.PortMapping{
+		{
+			Remove:        false,
+			Ports:         portMapping,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping),
+		},
+	}, forwarder.received())
+
+	// The port mapping is replaced, the previous one must be removed first
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID2))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, portMapping2))
+	require.NoError(t, vtunnelTracker.Flush())
+
+	assert.Equal(t, []types.PortMapping{
+		{
+			Remove:        false,
+			Ports:         portMapping,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping),
+		},
+		{
+			Remove:        true,
+			Ports:         portMapping,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping),
+		},
+		{
+			Remove:        false,
+			Ports:         portMapping2,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping2),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping2),
+		},
+	}, forwarder.received())
+
+	require.NoError(t, vtunnelTracker.RemoveAll(context.Background()))
+	assert.Equal(t, types.PortMapping{
+		Remove:        true,
+		Ports:         portMapping2,
+		ConnectAddrs:  wslConnectAddr,
+		Protocols:     types.PortProtocols(portMapping2),
+		HostBindAddrs: types.PortHostBindAddrs(portMapping2),
+	}, forwarder.received()[3])
+	assert.Nil(t, vtunnelTracker.Get(containerID2))
+}
+
+func TestVTunnelTrackerBatchingWindow(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableBatching(10 * time.Millisecond)
+	vtunnelTracker.SetPeerBatches(func() bool { return true })
+
+	for i := 0; i < 10; i++ {
+		portMapping := nat.PortMap{
+			nat.Port(strconv.Itoa(8000+i) + "/tcp"): []nat.PortBinding{
+				{
+					HostIP:   hostIP,
+					HostPort: strconv.Itoa(8000 + i),
+				},
+			},
+		}
+		err := vtunnelTracker.Add(context.Background(), containerID+strconv.Itoa(i), portMapping)
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		ports := 0
+		for _, portMapping := range forwarder.received() {
+			ports += len(portMapping.Ports)
+		}
+
+		return ports == 10
+	}, time.Second, 5*time.Millisecond)
+
+	assert.Less(t, len(forwarder.received()), 10)
+}
+
+func TestVTunnelTrackerList(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithSource(tracker.SourceDocker))
+	require.NoError(t, err)
+
+	portMapping2 := nat.PortMap{
+		"443/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP2,
+				HostPort: hostPort2,
+			},
+		},
+	}
+	err = vtunnelTracker.Add(context.Background(), containerID2, portMapping2, tracker.WithSource(tracker.SourceKubernetes))
+	require.NoError(t, err)
+
+	entries := vtunnelTracker.List()
+	require.Len(t, entries, 2)
+	assert.Equal(t, containerID, entries[0].ID)
+	assert.Equal(t, tracker.SourceDocker, entries[0].Source)
+	assert.Equal(t, portMapping, entries[0].Ports)
+	assert.False(t, entries[0].Added.IsZero())
+	assert.False(t, entries[0].LastSent.IsZero())
+	assert.Empty(t, entries[0].LastSendError)
+	assert.Equal(t, containerID2, entries[1].ID)
+	assert.Equal(t, tracker.SourceKubernetes, entries[1].Source)
+
+	entry, ok := vtunnelTracker.GetByPort(hostPort2, "tcp")
+	require.True(t, ok)
+	assert.Equal(t, containerID2, entry.ID)
+
+	_, ok = vtunnelTracker.GetByPort(hostPort2, "udp")
+	assert.False(t, ok)
+
+	bin, err := json.Marshal(entries)
+	require.NoError(t, err)
+	assert.Contains(t, string(bin), `"source":"docker"`)
+}
+
+func TestVTunnelTrackerListIsolation(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
+	require.NoError(t, err)
+
+	entries := vtunnelTracker.List()
+	require.Len(t, entries, 1)
+
+	// Changing the snapshot must not affect the tracker
+	entries[0].Ports["80/tcp"][0].HostPort = "9999"
+	entries[0].Ports["8080/tcp"] = nil
+	assert.Equal(t, portMapping, vtunnelTracker.Get(containerID))
+	assert.Equal(t, hostPort, portMapping["80/tcp"][0].HostPort)
+
+	// Changing the tracker must not affect the snapshot
+	err = vtunnelTracker.Remove(context.Background(), containerID)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Empty(t, vtunnelTracker.List())
+}
+
+func TestVTunnelTrackerAddUnchanged(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, nat.PortMap{
+			"80/tcp": []nat.PortBinding{
+				{
+					HostIP:   hostIP,
+					HostPort: hostPort,
+				},
+			},
+		}))
+	}
+
+	assert.Len(t, forwarder.received(), 1)
+
+	entry, ok := vtunnelTracker.GetByPort(hostPort, "tcp")
+	require.True(t, ok)
+	assert.True(t, entry.Refreshed.After(entry.Added))
+
+	// A slightly different port mapping must be sent, as a removal and an add
+	portMapping["80/tcp"][0].HostIP = hostIP2
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+	assert.Len(t, forwarder.received(), 3)
+
+	// A failed send is attempted again
+	portMapping2 := nat.PortMap{
+		"443/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort2,
+			},
+		},
+	}
+	forwarder.sendErr = errSend
+	require.ErrorIs(t, vtunnelTracker.Add(context.Background(), containerID2, portMapping2), errSend)
+	forwarder.sendErr = nil
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, portMapping2))
+	assert.Len(t, forwarder.received(), 5)
+}
+
+var errSend = errors.New("error from Send")
+
+type testForwarder struct {
+	receivedPortMappings []types.PortMapping
+	sendErr              error
+	failCondition        func(types.PortMapping) error
+	// bulk makes RemovePorts send a single removal, like a peer that supports bulk removals.
+	bulk bool
+	// portSeqs are the PortSeqs of the received port mappings, which are left
+	// out of them since they start from the time that the tracker was created.
+	portSeqs []map[string]uint64
+	mutex    sync.Mutex
+}
+
+func (v *testForwarder) Send(ctx context.Context, portMapping types.PortMapping) error {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if v.failCondition != nil {
+		if err := v.failCondition(portMapping); err != nil {
+			return err
+		}
+	}
+
+	v.portSeqs = append(v.portSeqs, portMapping.PortSeqs)
+	portMapping.PortSeqs = nil
+	v.receivedPortMappings = append(v.receivedPortMappings, portMapping)
+
+	return v.sendErr
+}
+
+func (v *testForwarder) RemovePorts(ctx context.Context, portMappings []types.PortMapping) error {
+	if !v.bulk {
+		return forwarder.RemoveEach(ctx, v, portMappings)
+	}
+
+	return v.Send(ctx, forwarder.MergeRemovals(portMappings))
+}
+
+func (v *testForwarder) received() []types.PortMapping {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return append([]types.PortMapping(nil), v.receivedPortMappings...)
+}
+
+func TestVTunnelTrackerMetadata(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	metadata := map[string]string{"name": "web", "project": "demo"}
+	expected := map[string]map[string]string{
+		"80/tcp": {"name": "web", "project": "demo"},
+	}
+
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithMetadata(metadata))
+	require.NoError(t, err)
+
+	// Changing the caller's map must not affect the tracked entry
+	metadata["name"] = "changed"
+
+	err = vtunnelTracker.Resync(context.Background(), true)
+	require.NoError(t, err)
+
+	err = vtunnelTracker.Remove(context.Background(), containerID)
+	require.NoError(t, err)
+
+	received := forwarder.received()
+	require.Len(t, received, 3)
+
+	for _, portMapping := range received {
+		assert.Equal(t, expected, portMapping.Metadata)
+	}
+
+	assert.False(t, received[0].Remove)
+	assert.True(t, received[1].Replace)
+	assert.True(t, received[2].Remove)
+}
+
+func TestVTunnelTrackerBatchingMetadata(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableBatching(time.Hour)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithMetadata(map[string]string{"name": "web"}))
+	require.NoError(t, err)
+	require.NoError(t, vtunnelTracker.Flush())
+
+	// Only the metadata changes, the ports should not be removed first
+	err = vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithMetadata(map[string]string{"name": "api"}))
+	require.NoError(t, err)
+	require.NoError(t, vtunnelTracker.Flush())
+
+	received := forwarder.received()
+	require.Len(t, received, 2)
+	assert.False(t, received[1].Remove)
+	assert.Equal(t, map[string]map[string]string{
+		"80/tcp": {"name": "api"},
+	}, received[1].Metadata)
+
+	err = vtunnelTracker.RemoveAll(context.Background())
+	require.NoError(t, err)
+
+	received = forwarder.received()
+	require.Len(t, received, 3)
+	assert.True(t, received[2].Remove)
+	assert.Equal(t, map[string]map[string]string{
+		"80/tcp": {"name": "api"},
+	}, received[2].Metadata)
+}
+
+func TestVTunnelTrackerBatchingSources(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{bulk: true}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableBatching(time.Hour)
+	vtunnelTracker.SetPeerBatches(func() bool { return true })
+
+	portMap := func(port string) nat.PortMap {
+		return nat.PortMap{nat.Port(port + "/tcp"): []nat.PortBinding{{HostIP: hostIP, HostPort: port}}}
+	}
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMap("80"), tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, portMap("443"), tracker.WithSource(tracker.SourceKubernetes)))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "untagged", portMap("8080")))
+	require.NoError(t, vtunnelTracker.Flush())
+	require.NoError(t, vtunnelTracker.Resync(context.Background(), true))
+	require.NoError(t, vtunnelTracker.RemoveAll(context.Background()))
+
+	// Every payload tells the sources of its ports apart.
+	received := forwarder.received()
+	require.Len(t, received, 3)
+	assert.True(t, received[1].Replace)
+	assert.True(t, received[2].Remove)
+
+	for _, portMapping := range received {
+		assert.Len(t, portMapping.Ports, 3)
+		assert.Equal(t, map[string]string{
+			"80/tcp":  tracker.SourceDocker,
+			"443/tcp": tracker.SourceKubernetes,
+		}, portMapping.Sources)
+	}
+}
+
+func TestVTunnelTrackerBatchingCorrelationIDs(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableBatching(time.Hour)
+	vtunnelTracker.SetPeerBatches(func() bool { return true })
+
+	portMap := func(port string) nat.PortMap {
+		return nat.PortMap{nat.Port(port + "/tcp"): []nat.PortBinding{{HostIP: hostIP, HostPort: port}}}
+	}
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMap("80"), tracker.WithCorrelationID("add1")))
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, portMap("443"), tracker.WithCorrelationID("add2")))
+	require.NoError(t, vtunnelTracker.Flush())
+
+	// The removal is sent with its own correlation ID, not with the one of the addition.
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID, tracker.WithCorrelationID("remove1")))
+	require.NoError(t, vtunnelTracker.Flush())
+
+	received := forwarder.received()
+	require.Len(t, received, 2)
+	assert.False(t, received[0].Remove)
+	assert.Equal(t, map[string]map[string]string{
+		"80/tcp":  {types.MetadataCorrelationID: "add1"},
+		"443/tcp": {types.MetadataCorrelationID: "add2"},
+	}, received[0].Metadata)
+	assert.True(t, received[1].Remove)
+	assert.Equal(t, map[string]map[string]string{
+		"80/tcp": {types.MetadataCorrelationID: "remove1"},
+	}, received[1].Metadata)
+
+	entries := vtunnelTracker.List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "add2", entries[0].CorrelationID)
+}
+
+func TestVTunnelTrackerMirrored(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableMirrored()
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+	require.NoError(t, vtunnelTracker.Resync(context.Background(), true))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+
+	// The additions, the snapshots and the removals are all flagged.
+	received := forwarder.received()
+	require.Len(t, received, 3)
+
+	for _, portMapping := range received {
+		assert.True(t, portMapping.Mirrored, "%+v", portMapping)
+	}
+
+	assert.True(t, received[1].Replace)
+	assert.True(t, received[2].Remove)
+}
+
+func TestVTunnelTrackerLoopbackRelay(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableLoopbackRelay()
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{HostIP: "127.0.0.1", HostPort: "80"},
+			{HostIP: "0.0.0.0", HostPort: "80"},
+		},
+		"443/tcp": []nat.PortBinding{
+			{HostIP: "::1", HostPort: "443"},
+		},
+	}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+
+	// The port mappings that are only bound to the loopback are not sent at all.
+	loopbackOnly := nat.PortMap{
+		"8080/tcp": []nat.PortBinding{
+			{HostIP: "127.0.0.1", HostPort: "8080"},
+		},
+	}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), "loopback", loopbackOnly))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), "loopback"))
+	require.NoError(t, vtunnelTracker.Resync(context.Background(), true))
+
+	received := forwarder.received()
+	require.Len(t, received, 2)
+
+	expected := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{HostIP: "0.0.0.0", HostPort: "80"},
+		},
+	}
+	assert.Equal(t, expected, received[0].Ports)
+	assert.True(t, received[1].Replace)
+	assert.Equal(t, expected, received[1].Ports)
+
+	// The loopback port bindings are still tracked.
+	assert.Equal(t, portMapping, vtunnelTracker.Get(containerID))
+}
+
+func TestVTunnelTrackerLANPolicy(t *testing.T) {
+	t.Parallel()
+
+	lanConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.1.50", Scope: types.ScopeLAN}}
+	natConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "172.26.118.5", Scope: types.ScopeNAT}}
+
+	tests := []struct {
+		name         string
+		policy       tracker.LANPolicy
+		connectAddrs []types.ConnectAddrs
+		// received is how many of the addition and the removal are sent.
+		received   int
+		reportOnly bool
+	}{
+		{name: "forward", policy: tracker.LANForward, connectAddrs: lanConnectAddr, received: 2},
+		{name: "report", policy: tracker.LANReport, connectAddrs: lanConnectAddr, received: 2, reportOnly: true},
+		{name: "skip", policy: tracker.LANSkip, connectAddrs: lanConnectAddr},
+		{name: "skip with a nat address", policy: tracker.LANSkip, connectAddrs: natConnectAddr, received: 2},
+		{
+			name:         "report with a nat and a lan address",
+			policy:       tracker.LANReport,
+			connectAddrs: []types.ConnectAddrs{natConnectAddr[0], lanConnectAddr[0]},
+			received:     2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			forwarder := testForwarder{}
+			vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, test.connectAddrs)
+			vtunnelTracker.SetLANPolicy(test.policy)
+
+			portMapping := nat.PortMap{
+				"80/tcp": []nat.PortBinding{
+					{
+						HostIP:   hostIP,
+						HostPort: hostPort,
+					},
+				},
+			}
+			require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+			// The port mappings are tracked whatever the policy.
+			assert.Equal(t, portMapping, vtunnelTracker.Get(containerID))
+			require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+
+			received := forwarder.received()
+			require.Len(t, received, test.received)
+
+			for _, portMapping := range received {
+				assert.Equal(t, test.reportOnly, portMapping.ReportOnly, "%+v", portMapping)
+				assert.Len(t, portMapping.Ports, 1)
+			}
+		})
+	}
+}
+
+func TestVTunnelTrackerLANPolicySkipWithdraws(t *testing.T) {
+	t.Parallel()
+
+	natConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "172.26.118.5", Scope: types.ScopeNAT}}
+	lanConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.1.50", Scope: types.ScopeLAN}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, natConnectAddr)
+	vtunnelTracker.SetLANPolicy(tracker.LANSkip)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+
+	// Switching to the bridged networking withdraws the port mappings,
+	// switching back sends them again.
+	require.NoError(t, vtunnelTracker.SetConnectAddrs(context.Background(), lanConnectAddr))
+	assert.Equal(t, portMapping, vtunnelTracker.Get(containerID))
+	require.NoError(t, vtunnelTracker.SetConnectAddrs(context.Background(), natConnectAddr))
+
+	received := forwarder.received()
+	require.Len(t, received, 3)
+	assert.Equal(t, portMapping, received[0].Ports)
+	assert.True(t, received[1].Replace)
+	assert.Empty(t, received[1].Ports)
+	assert.True(t, received[2].Replace)
+	assert.Equal(t, portMapping, received[2].Ports)
+}
+
+func TestVTunnelTrackerWatchConnectAddrs(t *testing.T) {
+	t.Parallel()
+
+	oldConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	newConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.2"}}
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, oldConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+
+	current := oldConnectAddr
+	lookup := func() ([]types.ConnectAddrs, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		return current, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changes := make(chan struct{})
+
+	go vtunnelTracker.WatchConnectAddrs(ctx, changes, lookup)
+
+	// Nothing is sent while the addresses are unchanged.
+	changes <- struct{}{}
+
+	// Swap the address provider mid-run
+	mutex.Lock()
+	current = newConnectAddr
+	mutex.Unlock()
+
+	changes <- struct{}{}
+
+	require.Eventually(t, func() bool {
+		return len(forwarder.received()) == 2
+	}, time.Second, time.Millisecond)
+
+	received := forwarder.received()
+	assert.Equal(t, types.PortMapping{
+		Remove:        false,
+		Ports:         portMapping,
+		ConnectAddrs:  newConnectAddr,
+		Replace:       true,
+		Protocols:     types.PortProtocols(portMapping),
+		HostBindAddrs: types.PortHostBindAddrs(portMapping),
+	}, received[1])
+	assert.Equal(t, newConnectAddr, vtunnelTracker.ConnectAddrs())
+	assert.Equal(t, newConnectAddr, vtunnelTracker.List()[0].ConnectAddrs)
+
+	// The addresses are unchanged, nothing else should be sent
+	changes <- struct{}{}
+	changes <- struct{}{}
+	assert.Len(t, forwarder.received(), 2)
+}
+
+func TestVTunnelTrackerRetry(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	attempts := 0
+	forwarder.failCondition = func(types.PortMapping) error {
+		attempts++
+		if attempts <= 2 {
+			return errSend
+		}
+
+		return nil
+	}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableRetry(time.Millisecond, 10*time.Millisecond)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
+	require.ErrorIs(t, err, errSend)
+
+	entries := vtunnelTracker.List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, tracker.StateFailed, entries[0].State)
+	assert.Equal(t, portMapping, vtunnelTracker.Get(containerID))
+
+	require.Eventually(t, func() bool {
+		entries := vtunnelTracker.List()
+
+		return len(entries) == 1 && entries[0].State == tracker.StateSent
+	}, time.Second, time.Millisecond)
+
+	// Nothing is retried once the mapping is sent
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, []types.PortMapping{
+		{
+			Remove:        false,
+			Ports:         portMapping,
+			ConnectAddrs:  wslConnectAddr,
+			Protocols:     types.PortProtocols(portMapping),
+			HostBindAddrs: types.PortHostBindAddrs(portMapping),
+		},
+	}, forwarder.received())
+	assert.Empty(t, vtunnelTracker.List()[0].LastSendError)
+}
+
+func TestVTunnelTrackerRemoveNeverSent(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	forwarder := testForwarder{}
+	var removals int
+	forwarder.failCondition = func(portMapping types.PortMapping) error {
+		if portMapping.Remove {
+			removals++
+		}
+
+		return errSend
+	}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+	vtunnelTracker.EnableRetry(time.Hour, time.Hour)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{
+				HostIP:   hostIP,
+				HostPort: hostPort,
+			},
+		},
+	}
+	err := vtunnelTracker.Add(context.Background(), containerID, portMapping)
+	require.ErrorIs(t, err, errSend)
+
+	err = vtunnelTracker.Remove(context.Background(), containerID)
+	require.NoError(t, err)
+	assert.Zero(t, removals)
+	assert.Empty(t, vtunnelTracker.List())
+}
+
+func TestVTunnelTrackerIdempotentAdd(t *testing.T) {
+	t.Parallel()
+
+	type step struct {
+		remove      bool
+		containerID string
+		source      string
+		port        nat.Port
+	}
+
+	portMap := func(port nat.Port) nat.PortMap {
+		return nat.PortMap{
+			port: []nat.PortBinding{
+				{
+					HostIP:   hostIP,
+					HostPort: port.Port(),
+				},
+			},
+		}
+	}
+
+	sources := func(source string, port nat.Port) map[string]string {
+		return map[string]string{port.Port() + "/" + port.Proto(): source}
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+		// sends are the port mappings that reach the host, true for the removals.
+		sends []types.PortMapping
+	}{
+		{
+			name: "add, add identical, remove",
+			steps: []step{
+				{containerID: containerID, source: tracker.SourceDocker, port: "80/tcp"},
+				{containerID: containerID, source: tracker.SourceDocker, port: "80/tcp"},
+				{remove: true, containerID: containerID},
+			},
+			sends: []types.PortMapping{
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+				{Remove: true, Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+			},
+		},
+		{
+			name: "add, add changed, remove",
+			steps: []step{
+				{containerID: containerID, source: tracker.SourceDocker, port: "80/tcp"},
+				{containerID: containerID, source: tracker.SourceDocker, port: "8080/tcp"},
+				{remove: true, containerID: containerID},
+			},
+			sends: []types.PortMapping{
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+				{Remove: true, Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+				{Ports: portMap("8080/tcp"), Sources: sources(tracker.SourceDocker, "8080/tcp")},
+				{Remove: true, Ports: portMap("8080/tcp"), Sources: sources(tracker.SourceDocker, "8080/tcp")},
+			},
+		},
+		{
+			name: "add, remove, add",
+			steps: []step{
+				{containerID: containerID, source: tracker.SourceDocker, port: "80/tcp"},
+				{remove: true, containerID: containerID},
+				{containerID: containerID, source: tracker.SourceDocker, port: "80/tcp"},
+			},
+			sends: []types.PortMapping{
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+				{Remove: true, Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+			},
+		},
+		{
+			name: "same source, add, add, remove first",
+			steps: []step{
+				{containerID: containerID, source: tracker.SourceDocker, port: "80/tcp"},
+				{containerID: containerID2, source: tracker.SourceDocker, port: "80/tcp"},
+				{remove: true, containerID: containerID},
+			},
+			sends: []types.PortMapping{
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+			},
+		},
+		{
+			name: "same source, add, add, remove second",
+			steps: []step{
+				{containerID: containerID, source: tracker.SourceDocker, port: "80/tcp"},
+				{containerID: containerID2, source: tracker.SourceDocker, port: "80/tcp"},
+				{remove: true, containerID: containerID2},
+			},
+			sends: []types.PortMapping{
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+			},
+		},
+		{
+			name: "same source, add, add, remove both",
+			steps: []step{
+				{containerID: containerID, source: tracker.SourceDocker, port: "80/tcp"},
+				{containerID: containerID2, source: tracker.SourceDocker, port: "80/tcp"},
+				{remove: true, containerID: containerID},
+				{remove: true, containerID: containerID2},
+			},
+			sends: []types.PortMapping{
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+				{Remove: true, Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+			},
+		},
+		{
+			name: "same source, add, add, change first, remove second",
+			steps: []step{
+				{containerID: containerID, source: tracker.SourceDocker, port: "80/tcp"},
+				{containerID: containerID2, source: tracker.SourceDocker, port: "80/tcp"},
+				{containerID: containerID, source: tracker.SourceDocker, port: "8080/tcp"},
+				{remove: true, containerID: containerID2},
+			},
+			sends: []types.PortMapping{
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+				{Ports: portMap("8080/tcp"), Sources: sources(tracker.SourceDocker, "8080/tcp")},
+				{Remove: true, Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+			},
+		},
+		{
+			name: "different sources, add, add, remove first",
+			steps: []step{
+				{containerID: containerID, source: tracker.SourceDocker, port: "80/tcp"},
+				{containerID: containerID2, source: tracker.SourceKubernetes, port: "80/tcp"},
+				{remove: true, containerID: containerID},
+			},
+			sends: []types.PortMapping{
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceKubernetes, "80/tcp")},
+				{Remove: true, Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+			},
+		},
+		{
+			name: "different sources, add, add, remove both",
+			steps: []step{
+				{containerID: containerID, source: tracker.SourceDocker, port: "80/tcp"},
+				{containerID: containerID2, source: tracker.SourceKubernetes, port: "80/tcp"},
+				{remove: true, containerID: containerID2},
+				{remove: true, containerID: containerID},
+			},
+			sends: []types.PortMapping{
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+				{Ports: portMap("80/tcp"), Sources: sources(tracker.SourceKubernetes, "80/tcp")},
+				{Remove: true, Ports: portMap("80/tcp"), Sources: sources(tracker.SourceKubernetes, "80/tcp")},
+				{Remove: true, Ports: portMap("80/tcp"), Sources: sources(tracker.SourceDocker, "80/tcp")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, batching := range []bool{false, true} {
+			tt, batching := tt, batching
+
+			t.Run(fmt.Sprintf("%s (batching: %t)", tt.name, batching), func(t *testing.T) {
+				t.Parallel()
+
+				wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+				forwarder := testForwarder{}
+				vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, wslConnectAddr)
+
+				if batching {
+					vtunnelTracker.EnableBatching(time.Hour)
+				}
+
+				for _, step := range tt.steps {
+					if step.remove {
+						require.NoError(t, vtunnelTracker.Remove(context.Background(), step.containerID))
+					} else {
+						require.NoError(t, vtunnelTracker.Add(context.Background(), step.containerID, portMap(step.port),
+							tracker.WithSource(step.source)))
+					}
+
+					require.NoError(t, vtunnelTracker.Flush())
+				}
+
+				sends := make([]types.PortMapping, 0, len(tt.sends))
+				for _, send := range tt.sends {
+					send.ConnectAddrs = wslConnectAddr
+					send.Protocols = types.PortProtocols(send.Ports)
+					send.HostBindAddrs = types.PortHostBindAddrs(send.Ports)
+					sends = append(sends, send)
+				}
+
+				assert.Equal(t, sends, forwarder.received())
+			})
+		}
+	}
+}
+
+// resultForwarder reports the outcome of every port binding, the
+// host ports in rejected fail with the corresponding error.
+// blockingForwarder blocks the sends until their context is done.
+type blockingForwarder struct {
+	sending chan struct{}
+	once    sync.Once
+}
+
+func newBlockingForwarder() *blockingForwarder {
+	return &blockingForwarder{sending: make(chan struct{})}
+}
+
+func (b *blockingForwarder) Send(ctx context.Context, _ types.PortMapping) error {
+	b.once.Do(func() { close(b.sending) })
+	<-ctx.Done()
+
+	return ctx.Err()
+}
+
+func (b *blockingForwarder) RemovePorts(ctx context.Context, _ []types.PortMapping) error {
+	return b.Send(ctx, types.PortMapping{})
+}
+
+type resultForwarder struct {
+	testForwarder
+	rejected map[string]string
+}
+
+func (r *resultForwarder) SendWithResults(ctx context.Context, portMapping types.PortMapping) ([]forwarder.PortResult, error) {
+	if err := r.Send(ctx, portMapping); err != nil {
+		return nil, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var results []forwarder.PortResult
+
+	for port, bindings := range portMapping.Ports {
+		for _, binding := range bindings {
+			result := forwarder.PortResult{Port: port, Binding: binding}
+			if reason, ok := r.rejected[binding.HostPort]; ok && !portMapping.Remove {
+				result.Err = errors.New(reason)
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+func (r *resultForwarder) setRejected(rejected map[string]string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.rejected = rejected
+}
+
+func TestVTunnelTrackerHostConflict(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	resultForwarder := &resultForwarder{rejected: map[string]string{"8080": "port is in use"}}
+	vtunnelTracker := tracker.NewVTunnelTracker(resultForwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp":   []nat.PortBinding{{HostIP: hostIP, HostPort: hostPort}},
+		"8080/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: "8080"}},
+	}
+
+	// The conflict does not fail the add, since the port mapping reached the host.
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+
+	entries := vtunnelTracker.List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, tracker.StateHostConflict, entries[0].State)
+	assert.Equal(t, map[string]string{"127.0.0.1:8080/tcp": "port is in use"}, entries[0].HostConflicts)
+
+	// Adding the same port mapping again is sent again once the port is free.
+	resultForwarder.setRejected(nil)
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+	assert.Len(t, resultForwarder.received(), 2)
+
+	entries = vtunnelTracker.List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, tracker.StateSent, entries[0].State)
+	assert.Empty(t, entries[0].HostConflicts)
+}
+
+func TestVTunnelTrackerHostConflictRemoved(t *testing.T) {
+	t.Parallel()
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	resultForwarder := &resultForwarder{rejected: map[string]string{hostPort: "port is in use"}}
+	vtunnelTracker := tracker.NewVTunnelTracker(resultForwarder, wslConnectAddr)
+
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: hostPort}},
+	}
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+
+	// The conflict went away with the port binding that caused it.
+	resultForwarder.setRejected(nil)
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID2, portMapping))
+
+	entries := vtunnelTracker.List()
+	require.Len(t, entries, 1)
+	assert.Equal(t, tracker.StateSent, entries[0].State)
+	assert.Empty(t, entries[0].HostConflicts)
+}
+
+func TestVTunnelTrackerProtocols(t *testing.T) {
+	t.Parallel()
+
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+
+	portMapping := nat.PortMap{
+		"53/udp": []nat.PortBinding{{HostIP: hostIP, HostPort: "53"}},
+		"80/tcp": []nat.PortBinding{{HostIP: hostIP, HostPort: hostPort}},
+	}
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+	require.NoError(t, vtunnelTracker.Remove(context.Background(), containerID))
+
+	received := forwarder.received()
+	require.Len(t, received, 2)
+
+	for _, portMapping := range received {
+		assert.Equal(t, map[nat.Port]string{"53/udp": "udp", "80/tcp": "tcp"}, portMapping.Protocols)
+	}
+}
+
+func TestVTunnelTrackerHostBindAddrs(t *testing.T) {
+	t.Parallel()
+
+	forwarder := testForwarder{}
+	vtunnelTracker := tracker.NewVTunnelTracker(&forwarder, nil)
+
+	// Like docker run -p 127.0.0.1:8080:80 -p 9090:90
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+		"90/tcp": []nat.PortBinding{
+			{HostIP: "0.0.0.0", HostPort: "9090"},
+			{HostIP: "::", HostPort: "9090"},
+		},
+	}
+
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping, tracker.WithSource(tracker.SourceDocker)))
+
+	received := forwarder.received()
+	require.Len(t, received, 1)
+	assert.Equal(t, map[string]string{"8080/tcp": "127.0.0.1"}, received[0].HostBindAddrs)
+}
+
+// TestVTunnelTrackerIPv6Only runs the port forwarding of a VM that only has
+// IPv6 connectivity: the addresses of its interface, the port mappings that
+// are sent to a peer that is only reached over IPv6, and the listeners.
+func TestVTunnelTrackerIPv6Only(t *testing.T) {
+	t.Parallel()
+
+	peerListener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	t.Cleanup(func() { _ = peerListener.Close() })
+
+	received := make(chan types.PortMapping, 10)
+
+	go func() {
+		for {
+			conn, err := peerListener.Accept()
+			if err != nil {
+				return
+			}
+
+			serveIPv6Peer(conn, received)
+		}
+	}()
+
+	// The link-local address is left out of the connect addresses.
+	interfaces := []netif.Interface{{
+		Name:  "eth0",
+		Flags: net.FlagUp,
+		Addrs: []netif.Addr{
+			{IPNet: &net.IPNet{IP: net.ParseIP("2001:db8::5"), Mask: net.CIDRMask(64, 128)}},
+			{IPNet: &net.IPNet{IP: net.ParseIP("fe80::215:5dff:fe3d:1a2b"), Mask: net.CIDRMask(64, 128)}},
+		},
+	}}
+	connectAddrs := netif.ConnectAddrs(interfaces)
+	require.True(t, types.IPv6Only(connectAddrs))
+
+	vtunnelForwarder := forwarder.NewVTunnelForwarder(peerListener.Addr().String())
+	vtunnelTracker := tracker.NewVTunnelTracker(vtunnelForwarder, connectAddrs)
+
+	// Like docker run -p 8080:80, which binds both families.
+	portMapping := nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{HostIP: "0.0.0.0", HostPort: "8080"},
+			{HostIP: "::", HostPort: "8080"},
+		},
+	}
+	require.NoError(t, vtunnelTracker.Add(context.Background(), containerID, portMapping))
+
+	select {
+	case sent := <-received:
+		assert.Equal(t, portMapping, sent.Ports)
+		assert.Equal(t, []string{types.FamilyIPv6}, sent.Families)
+		assert.Equal(t, []types.ConnectAddrs{{
+			Network: "ip+net",
+			Addr:    "2001:db8::5/64",
+			Family:  types.FamilyIPv6,
+			IP:      "2001:db8::5",
+		}}, sent.ConnectAddrs)
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "the port mapping was not sent to the peer")
+	}
+
+	// The listener of the iptables rule of the port is opened on [::].
+	listener, err := net.Listen("tcp", "[::]:0")
+	require.NoError(t, err)
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	require.NoError(t, listener.Close())
+
+	ctx := context.Background()
+	require.NoError(t, vtunnelTracker.AddListener(ctx, net.IPv4zero, port))
+	t.Cleanup(func() { _ = vtunnelTracker.RemoveListener(ctx, net.IPv4zero, port) })
+
+	conn, err := net.Dial("tcp", net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err == nil {
+		conn.Close()
+	}
+	require.NotErrorIs(t, err, syscall.ECONNREFUSED, "the listener is not on [::]")
+}
+
+// serveIPv6Peer answers a port mapping like the RD Privileged Service does, and
+// records it unless it is a Hello.
+func serveIPv6Peer(conn net.Conn, received chan<- types.PortMapping) {
+	defer conn.Close()
+
+	payload, err := forwarder.ReadFrame(conn)
+	if err != nil {
+		return
+	}
+
+	var portMapping types.PortMapping
+	if err := json.Unmarshal(payload, &portMapping); err != nil {
+		return
+	}
+
+	status := types.PeerStatus{InstanceID: "ipv6"}
+	if portMapping.Hello != nil {
+		status.ProtocolVersion = types.ProtocolVersion
+	} else {
+		received <- portMapping
+	}
+
+	if bin, err := json.Marshal(status); err == nil {
+		_ = forwarder.WriteFrame(conn, bin)
+	}
 }
@@ -0,0 +1,102 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+var ErrInvalidWellKnownPorts = errors.New("invalid well-known host ports")
+
+// ParseWellKnownPorts parses a comma separated list of the host ports and port
+// ranges that a service of the host usually holds, each optionally with its
+// protocol and the name of the service, e.g. "445=SMB,137-139/udp=NetBIOS".
+// The ports are of all the protocols when none is given.
+func ParseWellKnownPorts(spec string) ([]types.ReservedPorts, error) {
+	var wellKnown []types.ReservedPorts
+
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		ports, service, _ := strings.Cut(field, "=")
+		ports, protocol, _ := strings.Cut(ports, "/")
+
+		if protocol != "" && protocol != "tcp" && protocol != "udp" {
+			return nil, fmt.Errorf("%w: %q has an unknown protocol, valid options are tcp and udp", ErrInvalidWellKnownPorts, field)
+		}
+
+		ranges, err := parsePortRanges(ports)
+		if err != nil || len(ranges) != 1 {
+			return nil, fmt.Errorf("%w: %q must be a host port or a port range", ErrInvalidWellKnownPorts, field)
+		}
+
+		port := types.ReservedPorts{
+			First:    ranges[0].first,
+			Protocol: protocol,
+			Owner:    strings.TrimSpace(service),
+		}
+		if ranges[0].last != ranges[0].first {
+			port.Last = ranges[0].last
+		}
+
+		wellKnown = append(wellKnown, port)
+	}
+
+	return wellKnown, nil
+}
+
+// withLikelyConflicts sets the port bindings of the entry that are likely to
+// conflict on the host, see FilterTracker.SetWellKnown.
+func withLikelyConflicts(likelyConflicts map[string]string) EntryOption {
+	return func(e *Entry) {
+		e.LikelyConflicts = likelyConflicts
+	}
+}
+
+// likelyConflict returns the service of the host that likely holds the host
+// port of the binding, and logs it once for each port of the source.
+func (f *FilterTracker) likelyConflict(source string, port nat.Port, binding nat.PortBinding) (string, bool) {
+	wellKnown, ok := reservedBy(f.wellKnown, binding.HostPort, port.Proto())
+	if !ok {
+		return "", false
+	}
+
+	key := source + "/" + binding.HostPort + "/" + port.Proto()
+	if _, ok := f.cautioned[key]; !ok {
+		f.cautioned[key] = struct{}{}
+
+		fields := logging.Fields(
+			logging.Port(binding.HostPort),
+			logging.Protocol(port.Proto()),
+			logging.HostIP(binding.HostIP),
+			logging.Source(source),
+		)
+		if wellKnown.Owner != "" {
+			fields["hostService"] = wellKnown.Owner
+		}
+
+		logger.Warnw("forwarding the host port, but it is well known to be held on the host and is likely to conflict", fields)
+	}
+
+	return wellKnown.Owner, true
+}
@@ -0,0 +1,150 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracker_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/platform"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWellKnownPorts(t *testing.T) {
+	t.Parallel()
+
+	for name, test := range map[string]struct {
+		spec      string
+		wellKnown []types.ReservedPorts
+		fails     bool
+	}{
+		"empty": {spec: ""},
+		"ports": {
+			spec: "445=SMB, 137-139/udp=NetBIOS,3389",
+			wellKnown: []types.ReservedPorts{
+				{First: 445, Owner: "SMB"},
+				{First: 137, Last: 139, Protocol: "udp", Owner: "NetBIOS"},
+				{First: 3389},
+			},
+		},
+		"unknown protocol": {spec: "445/sctp=SMB", fails: true},
+		"invalid port":     {spec: "70000=SMB", fails: true},
+		"no port":          {spec: "=SMB", fails: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			wellKnown, err := tracker.ParseWellKnownPorts(test.spec)
+			if test.fails {
+				require.ErrorIs(t, err, tracker.ErrInvalidWellKnownPorts)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.wellKnown, wellKnown)
+		})
+	}
+
+	// The defaults of the platforms are valid.
+	for _, name := range []string{platform.WSL, platform.Lima} {
+		wellKnown, err := tracker.ParseWellKnownPorts(platform.Defaults(name)["wellKnownPorts"])
+		require.NoError(t, err, name)
+		assert.NotEmpty(t, wellKnown, name)
+	}
+}
+
+// lockedBuffer is a bytes.Buffer that the logger can write to while it is read.
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.buffer.Write(p)
+}
+
+func (l *lockedBuffer) String() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.buffer.String()
+}
+
+// TestFilterTrackerWellKnownPorts checks that the port bindings on the
+// well-known ports are forwarded with a warning, and reported as the likely
+// conflicts of their entry, unless they are reserved on the host. The package
+// logger is set, so the test does not run in parallel to the others.
+func TestFilterTrackerWellKnownPorts(t *testing.T) {
+	output := &lockedBuffer{}
+	tracker.SetLogger(logging.New(output, logging.FormatText).Named("tracker"))
+	t.Cleanup(func() { tracker.SetLogger(log.Current) })
+
+	wslConnectAddr := []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}}
+	vtunnelTracker := tracker.NewVTunnelTracker(&testForwarder{}, wslConnectAddr)
+	vtunnelTracker.EnableDryRun()
+	filterTracker := tracker.NewFilterTracker(vtunnelTracker, mustParsePortFilter(t, "", ""))
+
+	wellKnown, err := tracker.ParseWellKnownPorts(platform.Defaults(platform.WSL)["wellKnownPorts"])
+	require.NoError(t, err)
+	filterTracker.SetWellKnown(wellKnown)
+
+	binding := func(port string) nat.PortMap {
+		return nat.PortMap{nat.Port(port + "/tcp"): []nat.PortBinding{{HostIP: hostIP, HostPort: port}}}
+	}
+
+	require.NoError(t, filterTracker.Add(context.Background(), "smb", binding("445"), tracker.WithSource(tracker.SourceDocker)))
+	require.NoError(t, filterTracker.Add(context.Background(), "web", binding("8080"), tracker.WithSource(tracker.SourceDocker)))
+
+	// The port mapping on the well-known port is still forwarded.
+	entry, ok := vtunnelTracker.GetByPort("445", "tcp")
+	require.True(t, ok)
+	assert.Equal(t, binding("445"), entry.Ports)
+	assert.Equal(t, map[string]string{hostIP + ":445/tcp": "SMB"}, entry.LikelyConflicts)
+
+	entry, ok = vtunnelTracker.GetByPort("8080", "tcp")
+	require.True(t, ok)
+	assert.Empty(t, entry.LikelyConflicts)
+
+	logs := output.String()
+	assert.Contains(t, logs, "likely to conflict")
+	assert.Contains(t, logs, "[port=445][proto=tcp]")
+	assert.Contains(t, logs, "[hostService=SMB]")
+	assert.NotContains(t, logs, "port=8080")
+	assert.Equal(t, 1, strings.Count(logs, "likely to conflict"))
+
+	// The entry forgets the likely conflicts once its ports change.
+	require.NoError(t, filterTracker.Add(context.Background(), "smb", binding("8445"), tracker.WithSource(tracker.SourceDocker)))
+	entry, ok = vtunnelTracker.GetByPort("8445", "tcp")
+	require.True(t, ok)
+	assert.Empty(t, entry.LikelyConflicts)
+
+	// The reserved ports of the host take precedence, they are not forwarded.
+	require.NoError(t, filterTracker.SetReserved([]types.ReservedPorts{{First: 3389, Owner: "svchost.exe"}}))
+	require.NoError(t, filterTracker.Add(context.Background(), "rdp", binding("3389"), tracker.WithSource(tracker.SourceDocker)))
+	assert.Nil(t, filterTracker.Get("rdp"))
+	assert.Equal(t, 1, strings.Count(output.String(), "likely to conflict"))
+}
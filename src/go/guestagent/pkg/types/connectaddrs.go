@@ -0,0 +1,129 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"net"
+	"net/netip"
+)
+
+// The address families of ConnectAddrs.Family.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// The scopes of ConnectAddrs.Scope, see wsl.Classify.
+const (
+	// ScopeNAT is the scope of the addresses of the NAT network of WSL,
+	// which only the host reaches.
+	ScopeNAT = "nat"
+	// ScopeLAN is the scope of the other addresses, e.g. with the bridged
+	// networking of WSL, which the LAN may reach as well.
+	ScopeLAN = "lan"
+)
+
+// NewConnectAddrs returns the ConnectAddrs of an address of the interface;
+// zone is the name of the interface, which is the zone of its link-local
+// IPv6 addresses. Network and Addr are set from the address as they always
+// were, the other fields are left empty if it is not an IP address.
+func NewConnectAddrs(addr net.Addr, zone string) ConnectAddrs {
+	connectAddrs := ConnectAddrs{
+		Network: addr.Network(),
+		Addr:    addr.String(),
+	}
+
+	var ip net.IP
+
+	switch addr := addr.(type) {
+	case *net.IPNet:
+		ip = addr.IP
+	case *net.IPAddr:
+		ip = addr.IP
+
+		if addr.Zone != "" {
+			zone = addr.Zone
+		}
+	default:
+		if prefix, err := netip.ParsePrefix(addr.String()); err == nil {
+			ip = net.IP(prefix.Addr().AsSlice())
+		} else if addr, err := netip.ParseAddr(addr.String()); err == nil {
+			ip = net.IP(addr.WithZone("").AsSlice())
+
+			if addr.Zone() != "" {
+				zone = addr.Zone()
+			}
+		}
+	}
+
+	if ip == nil {
+		return connectAddrs
+	}
+
+	connectAddrs.IP = ip.String()
+
+	if ip.To4() != nil {
+		connectAddrs.Family = FamilyIPv4
+
+		return connectAddrs
+	}
+
+	connectAddrs.Family = FamilyIPv6
+
+	if ip.IsLinkLocalUnicast() {
+		connectAddrs.Zone = zone
+	}
+
+	return connectAddrs
+}
+
+// ConnectFamilies returns the address families of the connect addresses,
+// FamilyIPv4 before FamilyIPv6, for PortMapping.Families; the addresses
+// without a family are left out, and it is nil if none are left.
+func ConnectFamilies(connectAddrs []ConnectAddrs) []string {
+	var families []string
+
+	for _, family := range []string{FamilyIPv4, FamilyIPv6} {
+		for _, connectAddr := range connectAddrs {
+			if connectAddr.Family == family {
+				families = append(families, family)
+
+				break
+			}
+		}
+	}
+
+	return families
+}
+
+// IPv6Only returns true if the connect addresses only have the IPv6 family,
+// e.g. with the experimental networking of WSL or Lima that only gives the
+// VM IPv6 connectivity.
+func IPv6Only(connectAddrs []ConnectAddrs) bool {
+	families := ConnectFamilies(connectAddrs)
+
+	return len(families) == 1 && families[0] == FamilyIPv6
+}
+
+// LANOnly returns true if all the connect addresses are on the LAN, see
+// ScopeLAN; the ones without a scope are not.
+func LANOnly(connectAddrs []ConnectAddrs) bool {
+	for _, connectAddr := range connectAddrs {
+		if connectAddr.Scope != ScopeLAN {
+			return false
+		}
+	}
+
+	return len(connectAddrs) != 0
+}
@@ -0,0 +1,157 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// textAddr is an address that is only known from its text form.
+type textAddr string
+
+func (a textAddr) Network() string { return "ip+net" }
+func (a textAddr) String() string  { return string(a) }
+
+// mustParseCIDR returns the address of an interface in the CIDR form.
+func mustParseCIDR(cidr string) *net.IPNet {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+
+	ipNet.IP = ip
+
+	return ipNet
+}
+
+func TestNewConnectAddrs(t *testing.T) {
+	t.Parallel()
+
+	// The addresses of eth0 as they were captured on a WSL distribution.
+	tests := []struct {
+		name     string
+		addr     net.Addr
+		expected types.ConnectAddrs
+	}{
+		{
+			name: "IPv4",
+			addr: mustParseCIDR("172.26.118.5/20"),
+			expected: types.ConnectAddrs{
+				Network: "ip+net",
+				Addr:    "172.26.118.5/20",
+				Family:  types.FamilyIPv4,
+				IP:      "172.26.118.5",
+			},
+		},
+		{
+			name: "global IPv6",
+			addr: mustParseCIDR("2001:db8:4006:812::200e/64"),
+			expected: types.ConnectAddrs{
+				Network: "ip+net",
+				Addr:    "2001:db8:4006:812::200e/64",
+				Family:  types.FamilyIPv6,
+				IP:      "2001:db8:4006:812::200e",
+			},
+		},
+		{
+			name: "link-local IPv6",
+			addr: mustParseCIDR("fe80::215:5dff:fe3d:1a2b/64"),
+			expected: types.ConnectAddrs{
+				Network: "ip+net",
+				Addr:    "fe80::215:5dff:fe3d:1a2b/64",
+				Family:  types.FamilyIPv6,
+				IP:      "fe80::215:5dff:fe3d:1a2b",
+				Zone:    "eth0",
+			},
+		},
+		{
+			name: "link-local IPv6 with its own zone",
+			addr: &net.IPAddr{IP: net.ParseIP("fe80::1"), Zone: "eth1"},
+			expected: types.ConnectAddrs{
+				Network: "ip",
+				Addr:    "fe80::1%eth1",
+				Family:  types.FamilyIPv6,
+				IP:      "fe80::1",
+				Zone:    "eth1",
+			},
+		},
+		{
+			name: "IPv4-mapped IPv6",
+			addr: &net.IPNet{IP: net.ParseIP("::ffff:172.26.118.5"), Mask: net.CIDRMask(20, 32)},
+			expected: types.ConnectAddrs{
+				Network: "ip+net",
+				Addr:    "172.26.118.5/20",
+				Family:  types.FamilyIPv4,
+				IP:      "172.26.118.5",
+			},
+		},
+		{
+			name: "text",
+			addr: textAddr("fe80::2%eth2"),
+			expected: types.ConnectAddrs{
+				Network: "ip+net",
+				Addr:    "fe80::2%eth2",
+				Family:  types.FamilyIPv6,
+				IP:      "fe80::2",
+				Zone:    "eth2",
+			},
+		},
+		{
+			name:     "not an IP address",
+			addr:     textAddr("/run/socket"),
+			expected: types.ConnectAddrs{Network: "ip+net", Addr: "/run/socket"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, types.NewConnectAddrs(test.addr, "eth0"))
+		})
+	}
+}
+
+func TestLANOnly(t *testing.T) {
+	t.Parallel()
+
+	lan := types.ConnectAddrs{Network: "ip+net", Addr: "192.168.1.50/24", Scope: types.ScopeLAN}
+	nat := types.ConnectAddrs{Network: "ip+net", Addr: "172.26.118.5/20", Scope: types.ScopeNAT}
+	unclassified := types.ConnectAddrs{Network: "ip+net", Addr: "192.168.5.15/24"}
+
+	assert.True(t, types.LANOnly([]types.ConnectAddrs{lan}))
+	assert.False(t, types.LANOnly([]types.ConnectAddrs{lan, nat}))
+	assert.False(t, types.LANOnly([]types.ConnectAddrs{unclassified}))
+	assert.False(t, types.LANOnly(nil))
+}
+
+func TestConnectFamilies(t *testing.T) {
+	t.Parallel()
+
+	ipv4 := types.NewConnectAddrs(mustParseCIDR("172.26.118.5/20"), "eth0")
+	ipv6 := types.NewConnectAddrs(mustParseCIDR("2001:db8:4006:812::200e/64"), "eth0")
+	unknown := types.ConnectAddrs{Network: "tcp", Addr: "192.168.0.1"}
+
+	assert.Equal(t, []string{types.FamilyIPv4, types.FamilyIPv6}, types.ConnectFamilies([]types.ConnectAddrs{ipv6, ipv4, ipv6}))
+	assert.Equal(t, []string{types.FamilyIPv6}, types.ConnectFamilies([]types.ConnectAddrs{ipv6, unknown}))
+	assert.Nil(t, types.ConnectFamilies([]types.ConnectAddrs{unknown}))
+
+	assert.True(t, types.IPv6Only([]types.ConnectAddrs{ipv6}))
+	assert.False(t, types.IPv6Only([]types.ConnectAddrs{ipv4, ipv6}))
+	assert.False(t, types.IPv6Only(nil))
+}
@@ -0,0 +1,55 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The well-known keys of PortMapping.Labels, the receivers should
+// ignore the keys that they do not know about.
+const (
+	// LabelContainerName is the name of the container that publishes the ports.
+	LabelContainerName = "containerName"
+	// LabelComposeProject is the compose project of the container.
+	LabelComposeProject = "composeProject"
+	// LabelKubernetesService is the Kubernetes service that
+	// exposes the ports, in the "namespace/name" form.
+	LabelKubernetesService = "kubernetesService"
+	// LabelRemappedFrom is the host port that the ports were
+	// requested on before they were remapped, see -portRemap.
+	LabelRemappedFrom = "remappedFrom"
+)
+
+// MaxLabelsSize is the largest total length of the keys
+// and the values of PortMapping.Labels that is sent.
+const MaxLabelsSize = 4096
+
+var ErrLabelsTooLarge = errors.New("labels are too large")
+
+// ValidateLabels fails if the total length of the keys
+// and the values of the labels exceeds MaxLabelsSize.
+func ValidateLabels(labels map[string]string) error {
+	size := 0
+	for key, value := range labels {
+		size += len(key) + len(value)
+	}
+
+	if size > MaxLabelsSize {
+		return fmt.Errorf("%w: %d bytes exceed %d bytes", ErrLabelsTooLarge, size, MaxLabelsSize)
+	}
+
+	return nil
+}
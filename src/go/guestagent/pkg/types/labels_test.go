@@ -0,0 +1,94 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPortMappingLabels(t *testing.T) {
+	t.Parallel()
+
+	portMapping := types.PortMapping{
+		Ports:        nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}}},
+		ConnectAddrs: []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}},
+		Labels: map[string]string{
+			types.LabelContainerName:     "web",
+			types.LabelComposeProject:    "demo",
+			types.LabelKubernetesService: "default/web",
+			types.LabelRemappedFrom:      "80",
+		},
+		Protocols: map[nat.Port]string{"80/tcp": "tcp"},
+	}
+	assertGolden(t, "labels", portMapping)
+}
+
+func TestPortMappingLabelsOmitted(t *testing.T) {
+	t.Parallel()
+
+	for _, labels := range []map[string]string{nil, {}} {
+		bin, err := json.Marshal(types.PortMapping{Labels: labels})
+		require.NoError(t, err)
+		assert.NotContains(t, string(bin), "labels")
+	}
+}
+
+func TestPortMappingLabelsLegacyReceiver(t *testing.T) {
+	t.Parallel()
+
+	// legacyPortMapping is the PortMapping of the receivers that predate the labels.
+	type legacyPortMapping struct {
+		Remove       bool                 `json:"remove"`
+		Ports        nat.PortMap          `json:"ports"`
+		ConnectAddrs []types.ConnectAddrs `json:"connectAddrs"`
+	}
+
+	portMapping := types.PortMapping{
+		Remove:       true,
+		Ports:        nat.PortMap{"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}}},
+		ConnectAddrs: []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}},
+		Labels:       map[string]string{types.LabelContainerName: "web"},
+	}
+
+	bin, err := json.Marshal(portMapping)
+	require.NoError(t, err)
+
+	var legacy legacyPortMapping
+	require.NoError(t, json.Unmarshal(bin, &legacy))
+	assert.Equal(t, legacyPortMapping{
+		Remove:       portMapping.Remove,
+		Ports:        portMapping.Ports,
+		ConnectAddrs: portMapping.ConnectAddrs,
+	}, legacy)
+}
+
+func TestValidateLabels(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, types.ValidateLabels(nil))
+
+	labels := map[string]string{types.LabelContainerName: strings.Repeat("w", types.MaxLabelsSize-len(types.LabelContainerName))}
+	require.NoError(t, types.ValidateLabels(labels))
+
+	// The keys count towards the size as well.
+	labels[types.LabelComposeProject] = ""
+	require.ErrorIs(t, types.ValidateLabels(labels), types.ErrLabelsTooLarge)
+}
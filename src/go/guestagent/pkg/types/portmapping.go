@@ -15,17 +15,338 @@ limitations under the License.
 // different packages.
 package types
 
-import "github.com/docker/go-connections/nat"
+import (
+	"net"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+)
+
+// ProtocolVersion is the version of the protocol that the agent speaks, see
+// Hello. The receivers that do not answer the Hello speak version 0, which
+// is raw JSON without any of the optional features; see SchemaVersionFor for
+// the PortMapping schema that each version understands.
+const ProtocolVersion = 6
+
+// FeatureBulkRemove indicates that the RD Privileged Service applies every
+// port binding of a removal even if some of them fail, so that many port
+// mappings can be withdrawn in a single PortMapping.
+const FeatureBulkRemove = "bulkRemove"
+
+// FeatureBatch indicates that the RD Privileged Service applies the port
+// mappings of many containers in a single PortMapping, so that a batch of
+// changes is sent at once; the other services get one PortMapping per
+// container of the batch.
+const FeatureBatch = "batch"
+
+// FeatureReservedPorts indicates that the agent does not forward the host
+// ports that the RD Privileged Service reports to be reserved in its
+// response to a Hello, see PeerStatus.Reserved.
+const FeatureReservedPorts = "reservedPorts"
+
+// FeatureLogs indicates that the RD Privileged Service accepts the logs of
+// the agent, see PortMapping.Logs, e.g. to show them in its troubleshooting
+// view; the agent only logs locally to the services that do not support it.
+const FeatureLogs = "logs"
+
+// The capabilities describe what the agent does, see Hello.Capabilities.
+// Unlike the features they are not needed to speak the protocol, they let
+// the RD Privileged Service tell what it can offer, e.g. in its UI; the
+// source capabilities are those of the subsystems that the agent watches.
+const (
+	// CapabilityUDP indicates that the agent forwards the UDP ports, see PortMapping.Protocols.
+	CapabilityUDP = "udp"
+	// CapabilityMetadata indicates that the agent describes the origin of
+	// the host ports, see PortMapping.Metadata and PortMapping.Sources.
+	CapabilityMetadata = "metadata"
+	// CapabilityLabels indicates that the agent labels the port mappings, see PortMapping.Labels.
+	CapabilityLabels = "labels"
+	// CapabilityHostBindAddrs indicates that the agent asks for the host
+	// ports to be bound to loopback, see PortMapping.HostBindAddrs.
+	CapabilityHostBindAddrs = "hostBindAddrs"
+	// CapabilityMirrored indicates that the agent only reports the ports when
+	// WSL runs the VM with the mirrored networking, see PortMapping.Mirrored.
+	CapabilityMirrored = "mirrored"
+	// CapabilityDocker, CapabilityContainerd, CapabilityKubernetes and
+	// CapabilityIptables indicate the subsystems that the agent watches.
+	CapabilityDocker     = "source:docker"
+	CapabilityContainerd = "source:containerd"
+	CapabilityKubernetes = "source:kubernetes"
+	CapabilityIptables   = "source:iptables"
+)
+
+// MetadataCorrelationID is the key of PortMapping.Metadata that holds the ID
+// of the change that the host port is sent for; the agent logs the same ID,
+// so that the receiver's logs can be linked to the agent's.
+const MetadataCorrelationID = "correlationID"
+
+// DefaultProtocol is the protocol of the port entries that do not name one,
+// which is the case for all the port entries of the older senders.
+const DefaultProtocol = "tcp"
 
 // PortMapping is used to send Port/IP list over
 // the Vtunnel to the RD Privileged Service.
 type PortMapping struct {
+	// SchemaVersion is the version of the schema that the PortMapping
+	// follows, see CurrentSchemaVersion; it is 0 for the older senders.
+	SchemaVersion int `json:"schemaVersion,omitempty"`
 	// Remove indicates whether to remove or add the entry
 	Remove bool `json:"remove"`
 	// Ports are the port mappings for both IPV4 and IPV6
 	Ports nat.PortMap `json:"ports"`
 	// ConnectAddrs are the backend addresses to connect to
 	ConnectAddrs []ConnectAddrs `json:"connectAddrs"`
+	// Families are the address families of the ConnectAddrs, FamilyIPv4
+	// and FamilyIPv6, see ConnectFamilies; when the VM only has IPv6
+	// connectivity, the receiver should forward all the ports, including
+	// the ones bound to IPv4 addresses, to the IPv6 ones. Older receivers
+	// ignore them.
+	Families []string `json:"families,omitempty"`
+	// Replace indicates that Ports is an authoritative snapshot of
+	// all the port mappings, the receiver should drop any existing
+	// entries that are not listed.
+	Replace bool `json:"replace,omitempty"`
+	// Metadata holds arbitrary key/value pairs describing the origin
+	// of the port mappings (for example, a container name or a compose
+	// project). It is keyed by the host port and its protocol in the
+	// "port/protocol" form (for example, "8080/tcp").
+	Metadata map[string]map[string]string `json:"metadata,omitempty"`
+	// Labels describe all the port mappings of the PortMapping, see the
+	// Label constants for the well-known keys; their total size is at most
+	// MaxLabelsSize. Older receivers ignore them.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Protocols are the protocols of the port entries (for example, "tcp"
+	// or "udp"), keyed like Ports; see Protocol for the port entries that
+	// are not listed. Older senders do not set them.
+	Protocols map[nat.Port]string `json:"protocols,omitempty"`
+	// Sources are the subsystems that the port mappings originate from
+	// (for example, "docker" or "kubernetes"), so that the receiver can tell
+	// them apart even when they are sent together. Like Metadata, they are
+	// keyed by the host port and its protocol; older receivers ignore them.
+	Sources map[string]string `json:"sources,omitempty"`
+	// HostBindAddrs are the addresses that the host ports were asked to be
+	// bound to, keyed like Metadata. A host port that is not listed is bound
+	// as the receiver sees fit, a loopback address asks for the host port to
+	// only be bound to loopback, and any other address is a best-effort hint.
+	// Older receivers ignore them.
+	HostBindAddrs map[string]string `json:"hostBindAddrs,omitempty"`
+	// Mirrored indicates that the VM runs with the mirrored networking of
+	// WSL, so the ports are already reachable from the host; the receiver
+	// should only report the port mappings, not forward them.
+	Mirrored bool `json:"mirrored,omitempty"`
+	// ReportOnly indicates that the ports are reached at LAN addresses only,
+	// see ConnectAddrs.Scope, and that the agent was asked not to have them
+	// forwarded; like with Mirrored, the receiver should only report them.
+	ReportOnly bool `json:"reportOnly,omitempty"`
+	// Ping indicates a heartbeat that carries no port mappings, it only
+	// checks that the receiver is reachable. Older receivers handle it
+	// like adding an empty set of port mappings.
+	Ping bool `json:"ping,omitempty"`
+	// Seq increases with every PortMapping that is sent, the receiver should
+	// only apply the port bindings that it did not apply a newer PortMapping
+	// for, so that a delayed PortMapping can not override a later one; its
+	// retries keep it. It starts from 1 with every Hello.InstanceID. A
+	// snapshot is always applied. Older senders do not set it.
+	Seq uint64 `json:"seq,omitempty"`
+	// PortSeqs are the sequence numbers of the changes that the host ports
+	// are sent for, keyed like Metadata; they increase with every change to
+	// a host port, and the removals and additions of the same change share
+	// them. Unlike Seq, they are assigned when the change happens rather
+	// than when it is sent, so the receiver should not apply a port binding
+	// whose sequence number is older than the last one that it recorded for
+	// the host port, e.g. a retry that a later change overtook. A snapshot
+	// carries the ones of the host ports that recently changed, including
+	// the ports that it does not list, and the receiver should replace the
+	// ones that it recorded with them. Older receivers ignore them.
+	PortSeqs map[string]uint64 `json:"portSeqs,omitempty"`
+	// Hello starts the negotiation of the protocol, it is sent on its own
+	// whenever the sender connects to the receiver and it carries no port
+	// mappings. Older receivers handle it like adding an empty set of port
+	// mappings.
+	Hello *Hello `json:"hello,omitempty"`
+	// Logs carries the recent log lines of the agent, it is sent on its own
+	// and carries no port mappings. It is only sent to the receivers that
+	// support FeatureLogs.
+	Logs *LogBatch `json:"logs,omitempty"`
+}
+
+// Protocol returns the protocol of the port entry, which defaults to
+// the one in the port itself, and to DefaultProtocol if it has none.
+func (p *PortMapping) Protocol(port nat.Port) string {
+	if protocol, ok := p.Protocols[port]; ok && protocol != "" {
+		return protocol
+	}
+
+	return portProtocol(port)
+}
+
+// PortProtocols returns the protocols of the port entries, for the
+// PortMapping.Protocols of the ports; it is nil if there are none.
+func PortProtocols(ports nat.PortMap) map[nat.Port]string {
+	if len(ports) == 0 {
+		return nil
+	}
+
+	protocols := make(map[nat.Port]string, len(ports))
+	for port := range ports {
+		protocols[port] = portProtocol(port)
+	}
+
+	return protocols
+}
+
+// PortHostBindAddrs returns the host addresses that the host ports are bound
+// to, for the PortMapping.HostBindAddrs of the ports. A host port is left out
+// if one of its port bindings is on all the addresses, or if they are not all
+// on the same address; it is nil if none are left.
+func PortHostBindAddrs(ports nat.PortMap) map[string]string {
+	var (
+		hostBindAddrs map[string]string
+		unbound       = make(map[string]struct{})
+	)
+
+	for port, bindings := range ports {
+		for _, binding := range bindings {
+			key := binding.HostPort + "/" + portProtocol(port)
+			if _, ok := unbound[key]; ok {
+				continue
+			}
+
+			ip := net.ParseIP(binding.HostIP)
+			hostBindAddr, ok := hostBindAddrs[key]
+
+			if ip == nil || ip.IsUnspecified() || (ok && hostBindAddr != binding.HostIP) {
+				unbound[key] = struct{}{}
+				delete(hostBindAddrs, key)
+
+				continue
+			}
+
+			if hostBindAddrs == nil {
+				hostBindAddrs = make(map[string]string)
+			}
+
+			hostBindAddrs[key] = binding.HostIP
+		}
+	}
+
+	if len(hostBindAddrs) == 0 {
+		return nil
+	}
+
+	return hostBindAddrs
+}
+
+func portProtocol(port nat.Port) string {
+	if protocol := port.Proto(); protocol != "" {
+		return protocol
+	}
+
+	return DefaultProtocol
+}
+
+// LogBatch holds the log lines that the agent wrote since the last LogBatch.
+type LogBatch struct {
+	// Records are the log lines, the oldest first.
+	Records []LogRecord `json:"records"`
+	// Dropped is the number of log lines that were left out of the batch,
+	// since there were more than a batch holds.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// LogRecord is a log line of the agent.
+type LogRecord struct {
+	Time time.Time `json:"time"`
+	// Level is the level of the line, e.g. "warn" or "error".
+	Level string `json:"level"`
+	// Logger is the subsystem that wrote the line, e.g. "kube"; it is empty for the agent itself.
+	Logger  string `json:"logger,omitempty"`
+	Message string `json:"msg"`
+	// Fields are the fields of the line, formatted like fmt.Sprint.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// Hello carries the protocol version and the optional features of the sender.
+type Hello struct {
+	// ProtocolVersion is the highest version that the sender speaks.
+	ProtocolVersion int `json:"protocolVersion"`
+	// Features are the optional parts of the protocol that the
+	// sender supports, for example FeatureBulkRemove.
+	Features []string `json:"features,omitempty"`
+	// AgentVersion is the version of the agent that sent the Hello, for
+	// diagnostics; it does not take part in the negotiation.
+	AgentVersion string `json:"agentVersion,omitempty"`
+	// InstanceID identifies the sender of the PortMappings, it changes when
+	// the agent restarts. The PortMapping.Seq start over from 1 with every
+	// instance, so the receiver should forget the ones that it recorded when
+	// it changes. Older senders do not set it.
+	InstanceID string `json:"instanceID,omitempty"`
+	// SchemaVersion is the highest version of the PortMapping schema that
+	// the sender writes, see CurrentSchemaVersion.
+	SchemaVersion int `json:"schemaVersion,omitempty"`
+	// Capabilities are what the sender does, for example CapabilityUDP,
+	// from the features that it is built with and the ones it runs with.
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// PeerStatus is the optional response of the RD Privileged Service to
+// a PortMapping, older versions close the connection without responding.
+type PeerStatus struct {
+	// InstanceID identifies the running instance of the service, it changes
+	// when the service restarts and has lost all the port mappings.
+	InstanceID string `json:"instanceID"`
+	// Results are the outcome of each port binding of the PortMapping,
+	// older versions do not report them.
+	Results []PortStatus `json:"results,omitempty"`
+	// Features are the optional parts of the protocol that the service
+	// supports, for example FeatureBulkRemove; like ProtocolVersion, they
+	// are set in the response to a Hello.
+	Features []string `json:"features,omitempty"`
+	// ProtocolVersion is the highest version that the service speaks,
+	// older versions do not set it.
+	ProtocolVersion int `json:"protocolVersion,omitempty"`
+	// MinProtocolVersion is the lowest version that the service still
+	// speaks, the ones that do not set it speak all the versions up to
+	// ProtocolVersion; like ProtocolVersion, it is set in the response to a Hello.
+	MinProtocolVersion int `json:"minProtocolVersion,omitempty"`
+	// ServiceVersion is the version of the service, e.g. of Rancher Desktop,
+	// for diagnostics; it does not take part in the negotiation.
+	ServiceVersion string `json:"serviceVersion,omitempty"`
+	// Reserved are the host ports that are in use or excluded on the host,
+	// e.g. the port ranges that Hyper-V excludes, which the agent does not
+	// forward; like Features, they are set in the response to a Hello.
+	Reserved []ReservedPorts `json:"reserved,omitempty"`
+	// Capabilities are the ones of the Hello that the service acknowledges,
+	// i.e. that it makes use of; like Features, they are set in the response
+	// to a Hello.
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// ReservedPorts is a range of host ports that the host can not bind.
+type ReservedPorts struct {
+	// First and Last are the first and the last host ports of the range,
+	// Last is zero for a single port.
+	First int `json:"first"`
+	Last  int `json:"last,omitempty"`
+	// Protocol is the protocol of the reserved ports (for example, "tcp"),
+	// they are reserved for all the protocols when it is empty.
+	Protocol string `json:"protocol,omitempty"`
+	// Owner names what holds the ports on the host, if it is known (for
+	// example, "Hyper-V excluded port range" or "svchost.exe (PID 4242)").
+	Owner string `json:"owner,omitempty"`
+}
+
+// PortStatus is the outcome of applying a single port binding on the host.
+type PortStatus struct {
+	// Port is the port and its protocol (for example, "80/tcp")
+	Port nat.Port `json:"port"`
+	// HostIP is the host address of the port binding
+	HostIP string `json:"hostIP"`
+	// HostPort is the host port of the port binding
+	HostPort string `json:"hostPort"`
+	// Error describes why the port binding could not be applied, for
+	// example since the host port is in use; it is empty on success.
+	Error string `json:"error,omitempty"`
 }
 
 // ConnectAddrs represent the address for WSL interface
@@ -35,4 +356,16 @@ type ConnectAddrs struct {
 	Network string `json:"network"`
 	// Address is either IPV4 or IPV6 (for example, "192.0.2.1:25", "[2001:db8::1]:80")
 	Addr string `json:"addr"`
+	// Family is the address family of the address, either FamilyIPv4 or FamilyIPv6.
+	Family string `json:"family,omitempty"`
+	// IP is the address without its prefix length and zone (for example,
+	// "192.0.2.1" for the "192.0.2.1/20" Addr of an interface).
+	IP string `json:"ip,omitempty"`
+	// Zone is the interface of a link-local IPv6 address (for example, "eth0"),
+	// which is needed to connect to it.
+	Zone string `json:"zone,omitempty"`
+	// Scope tells whether the address is in the NAT network of WSL or on the
+	// LAN, either ScopeNAT or ScopeLAN; it is empty when it is not known, e.g.
+	// on Lima.
+	Scope string `json:"scope,omitempty"`
 }
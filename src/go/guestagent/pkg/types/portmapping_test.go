@@ -0,0 +1,151 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// assertGolden asserts that the port mapping is encoded as in the golden
+// file, and that the golden file decodes to the port mapping.
+func assertGolden(t *testing.T, name string, portMapping types.PortMapping) {
+	t.Helper()
+
+	bin, err := json.Marshal(portMapping)
+	require.NoError(t, err)
+
+	var indented bytes.Buffer
+	require.NoError(t, json.Indent(&indented, bin, "", "  "))
+	indented.WriteByte('\n')
+
+	golden := filepath.Join("testdata", name+".golden.json")
+	if *update {
+		require.NoError(t, os.WriteFile(golden, indented.Bytes(), 0o644))
+	}
+
+	expected, err := os.ReadFile(golden)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), indented.String())
+
+	var decoded types.PortMapping
+	require.NoError(t, json.Unmarshal(expected, &decoded))
+	assert.Equal(t, portMapping, decoded)
+}
+
+func TestPortMappingLegacy(t *testing.T) {
+	t.Parallel()
+
+	// The payloads of the older senders do not carry the protocols.
+	portMapping := types.PortMapping{
+		Ports: nat.PortMap{
+			"80": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+			"443/tcp": []nat.PortBinding{
+				{HostIP: "127.0.0.1", HostPort: "8443"},
+				{HostIP: "::1", HostPort: "8443"},
+			},
+		},
+		ConnectAddrs: []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}},
+	}
+	assertGolden(t, "legacy", portMapping)
+
+	assert.Equal(t, types.DefaultProtocol, portMapping.Protocol("80"))
+	assert.Equal(t, "tcp", portMapping.Protocol("443/tcp"))
+}
+
+func TestPortMappingProtocols(t *testing.T) {
+	t.Parallel()
+
+	ports := nat.PortMap{
+		"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+		"53/udp": []nat.PortBinding{
+			{HostIP: "127.0.0.1", HostPort: "5353"},
+			{HostIP: "::1", HostPort: "5353"},
+		},
+	}
+	portMapping := types.PortMapping{
+		Remove:       true,
+		Ports:        ports,
+		ConnectAddrs: []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}},
+		Protocols:    types.PortProtocols(ports),
+		Seq:          42,
+	}
+	assertGolden(t, "protocols", portMapping)
+
+	assert.Equal(t, map[nat.Port]string{"80/tcp": "tcp", "53/udp": "udp"}, portMapping.Protocols)
+	assert.Equal(t, "udp", portMapping.Protocol("53/udp"))
+
+	// The port entries that are not listed default to their own protocol.
+	assert.Equal(t, "sctp", portMapping.Protocol("9000/sctp"))
+	assert.Nil(t, types.PortProtocols(nil))
+}
+
+func TestPortMappingHostBindAddrs(t *testing.T) {
+	t.Parallel()
+
+	ports := nat.PortMap{
+		"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+		"90/tcp": []nat.PortBinding{
+			{HostIP: "0.0.0.0", HostPort: "9090"},
+			{HostIP: "::", HostPort: "9090"},
+		},
+		"53/udp": []nat.PortBinding{{HostIP: "192.168.1.10", HostPort: "53"}},
+		"5432":   []nat.PortBinding{{HostIP: "::1", HostPort: "15432"}},
+	}
+	portMapping := types.PortMapping{
+		Ports:         ports,
+		ConnectAddrs:  []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1"}},
+		HostBindAddrs: types.PortHostBindAddrs(ports),
+	}
+	assertGolden(t, "hostbindaddrs", portMapping)
+
+	// The host ports that are bound to all the addresses are left to the host.
+	assert.Equal(t, map[string]string{
+		"8080/tcp":  "127.0.0.1",
+		"53/udp":    "192.168.1.10",
+		"15432/tcp": "::1",
+	}, portMapping.HostBindAddrs)
+}
+
+func TestPortHostBindAddrs(t *testing.T) {
+	t.Parallel()
+
+	assert.Nil(t, types.PortHostBindAddrs(nil))
+	assert.Nil(t, types.PortHostBindAddrs(nat.PortMap{
+		"80/tcp": []nat.PortBinding{{HostIP: "", HostPort: "8080"}},
+	}))
+
+	// The port bindings of a host port that ask for different addresses cancel out.
+	assert.Equal(t, map[string]string{"9090/tcp": "127.0.0.1"}, types.PortHostBindAddrs(nat.PortMap{
+		"80/tcp": []nat.PortBinding{
+			{HostIP: "127.0.0.1", HostPort: "8080"},
+			{HostIP: "::1", HostPort: "8080"},
+		},
+		"90/tcp": []nat.PortBinding{
+			{HostIP: "127.0.0.1", HostPort: "9090"},
+			{HostIP: "127.0.0.1", HostPort: "9090"},
+		},
+	}))
+}
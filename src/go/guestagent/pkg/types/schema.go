@@ -0,0 +1,107 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+// CurrentSchemaVersion is the version of the PortMapping schema that the
+// agent produces. The versions are:
+//
+//   - 0, before the schema was versioned: the port mappings with their
+//     metadata and sources, the snapshots, the pings, the sequence numbers
+//     and the hellos.
+//   - 1 adds the schema version, the protocols, the labels, the host bind
+//     addresses and the family, IP and zone of the connect addresses.
+//   - 2 adds the mirrored flag.
+//   - 3 adds the report only flag and the scope of the connect addresses.
+//   - 4 adds the families of the connect addresses.
+//   - 5 adds the sequence numbers of the host ports.
+const CurrentSchemaVersion = 5
+
+// SchemaVersionFor returns the version of the PortMapping schema that
+// the receivers that negotiated the protocol version understand.
+func SchemaVersionFor(protocolVersion int) int {
+	switch {
+	case protocolVersion >= 6:
+		return 5
+	case protocolVersion >= 5:
+		return 4
+	case protocolVersion >= 4:
+		return 3
+	case protocolVersion >= 3:
+		return 2
+	case protocolVersion >= 2:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Reportable returns whether the receivers of the given version of the schema
+// can tell that the ports of the port mapping are only to be reported, see
+// PortMapping.Mirrored and PortMapping.ReportOnly; the older receivers would
+// forward them.
+func Reportable(portMapping PortMapping, version int) bool {
+	return (!portMapping.Mirrored || version >= 2) && (!portMapping.ReportOnly || version >= 3)
+}
+
+// Downgrade returns the port mapping in the given version of the schema,
+// without the fields that were added after it; the versions newer than
+// CurrentSchemaVersion get the current one. The port mapping that is
+// passed in is left untouched.
+func Downgrade(portMapping PortMapping, version int) PortMapping {
+	version = min(max(version, 0), CurrentSchemaVersion)
+	portMapping.SchemaVersion = version
+
+	if version < 5 {
+		portMapping.PortSeqs = nil
+	}
+
+	if version < 4 {
+		portMapping.Families = nil
+	}
+
+	if version < 3 {
+		portMapping.ReportOnly = false
+
+		if portMapping.ConnectAddrs != nil {
+			connectAddrs := make([]ConnectAddrs, 0, len(portMapping.ConnectAddrs))
+			for _, connectAddr := range portMapping.ConnectAddrs {
+				connectAddr.Scope = ""
+				connectAddrs = append(connectAddrs, connectAddr)
+			}
+
+			portMapping.ConnectAddrs = connectAddrs
+		}
+	}
+
+	if version < 2 {
+		portMapping.Mirrored = false
+	}
+
+	if version < 1 {
+		portMapping.Protocols = nil
+		portMapping.Labels = nil
+		portMapping.HostBindAddrs = nil
+
+		if portMapping.ConnectAddrs != nil {
+			connectAddrs := make([]ConnectAddrs, 0, len(portMapping.ConnectAddrs))
+			for _, connectAddr := range portMapping.ConnectAddrs {
+				connectAddrs = append(connectAddrs, ConnectAddrs{Network: connectAddr.Network, Addr: connectAddr.Addr})
+			}
+
+			portMapping.ConnectAddrs = connectAddrs
+		}
+	}
+
+	return portMapping
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types_test
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// schemaPortMapping sets every field of the current schema.
+func schemaPortMapping() types.PortMapping {
+	ports := nat.PortMap{
+		"80/tcp": []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: "8080"}},
+		"53/udp": []nat.PortBinding{{HostIP: "0.0.0.0", HostPort: "53"}},
+	}
+
+	return types.PortMapping{
+		SchemaVersion: types.CurrentSchemaVersion,
+		Remove:        false,
+		Ports:         ports,
+		ConnectAddrs: []types.ConnectAddrs{
+			withScope(types.NewConnectAddrs(mustParseCIDR("172.26.118.5/20"), "eth0"), types.ScopeNAT),
+			withScope(types.NewConnectAddrs(mustParseCIDR("fe80::215:5dff:fe3d:1a2b/64"), "eth0"), types.ScopeLAN),
+		},
+		Replace:       true,
+		Metadata:      map[string]map[string]string{"8080/tcp": {"name": "web"}},
+		Labels:        map[string]string{types.LabelComposeProject: "demo"},
+		Protocols:     types.PortProtocols(ports),
+		Sources:       map[string]string{"8080/tcp": "docker", "53/udp": "docker"},
+		HostBindAddrs: types.PortHostBindAddrs(ports),
+		Mirrored:      true,
+		ReportOnly:    true,
+		Families:      []string{types.FamilyIPv4, types.FamilyIPv6},
+		Seq:           7,
+		PortSeqs:      map[string]uint64{"8080/tcp": 3, "53/udp": 2, "443/tcp": 1},
+	}
+}
+
+func withScope(connectAddrs types.ConnectAddrs, scope string) types.ConnectAddrs {
+	connectAddrs.Scope = scope
+
+	return connectAddrs
+}
+
+func TestDowngrade(t *testing.T) {
+	t.Parallel()
+
+	// Every supported version of the schema is locked down, so that
+	// the changes to the current one can not break the older receivers.
+	for version := 0; version <= types.CurrentSchemaVersion; version++ {
+		t.Run(strconv.Itoa(version), func(t *testing.T) {
+			t.Parallel()
+
+			portMapping := schemaPortMapping()
+			downgraded := types.Downgrade(portMapping, version)
+			assertGolden(t, "schema-v"+strconv.Itoa(version), downgraded)
+
+			// The port mapping that was downgraded is left untouched.
+			assert.Equal(t, schemaPortMapping(), portMapping)
+		})
+	}
+}
+
+func TestDowngradeOutOfRange(t *testing.T) {
+	t.Parallel()
+
+	portMapping := schemaPortMapping()
+	assert.Equal(t, portMapping, types.Downgrade(portMapping, types.CurrentSchemaVersion+1))
+	assert.Equal(t, types.Downgrade(portMapping, 0), types.Downgrade(portMapping, -1))
+}
+
+func TestReportable(t *testing.T) {
+	t.Parallel()
+
+	// The receivers of the schemas before the mirrored flag would forward the ports.
+	mirrored := types.PortMapping{Mirrored: true}
+	assert.False(t, types.Reportable(mirrored, 0))
+	assert.False(t, types.Reportable(mirrored, 1))
+	assert.True(t, types.Reportable(mirrored, 2))
+	assert.True(t, types.Reportable(types.PortMapping{}, 0))
+
+	// The ones before the report only flag would forward them too.
+	reportOnly := types.PortMapping{ReportOnly: true}
+	assert.False(t, types.Reportable(reportOnly, 2))
+	assert.True(t, types.Reportable(reportOnly, 3))
+}
+
+func TestSchemaVersionFor(t *testing.T) {
+	t.Parallel()
+
+	assert.Zero(t, types.SchemaVersionFor(0))
+	assert.Zero(t, types.SchemaVersionFor(1))
+	assert.Equal(t, 1, types.SchemaVersionFor(2))
+	assert.Equal(t, 2, types.SchemaVersionFor(3))
+	assert.Equal(t, 3, types.SchemaVersionFor(4))
+	assert.Equal(t, 4, types.SchemaVersionFor(5))
+	assert.Equal(t, types.CurrentSchemaVersion, types.SchemaVersionFor(types.ProtocolVersion))
+}
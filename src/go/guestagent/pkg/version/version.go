@@ -0,0 +1,75 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package version identifies the build of the agent. The release builds set
+// the variables with the linker, e.g.
+//
+//	go build -ldflags "-X github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version.Version=1.15.0"
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// The build information, which the development builds leave to their defaults.
+//
+//nolint:gochecknoglobals
+var (
+	Version = "dev"
+	// Commit is the git commit of the build, it defaults to
+	// the one that the go command records if it knows it.
+	Commit = ""
+	// Date is when the agent was built.
+	Date = "unknown"
+)
+
+// Info is the build information of the agent.
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the build information of the agent.
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    commit(),
+		Date:      Date,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// String returns the build information as it is printed by -version and logged at startup.
+func (i Info) String() string {
+	return fmt.Sprintf("version: %s, commit: %s, build date: %s, go version: %s", i.Version, i.Commit, i.Date, i.GoVersion)
+}
+
+func commit() string {
+	if Commit != "" {
+		return Commit
+	}
+
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+
+	return "unknown"
+}
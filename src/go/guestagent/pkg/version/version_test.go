@@ -0,0 +1,44 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package version_test
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGet(t *testing.T) {
+	info := version.Get()
+	assert.Equal(t, "dev", info.Version)
+	assert.Equal(t, "unknown", info.Date)
+	assert.Equal(t, runtime.Version(), info.GoVersion)
+	assert.NotEmpty(t, info.Commit)
+
+	// The variables that the linker sets take precedence.
+	version.Version, version.Commit, version.Date = "1.15.0", "0123abc", "2024-06-01T00:00:00Z"
+
+	t.Cleanup(func() { version.Version, version.Commit, version.Date = "dev", "", "unknown" })
+
+	assert.Equal(t, version.Info{
+		Version:   "1.15.0",
+		Commit:    "0123abc",
+		Date:      "2024-06-01T00:00:00Z",
+		GoVersion: runtime.Version(),
+	}, version.Get())
+	assert.Equal(t, "version: 1.15.0, commit: 0123abc, build date: 2024-06-01T00:00:00Z, go version: "+runtime.Version(),
+		version.Get().String())
+}
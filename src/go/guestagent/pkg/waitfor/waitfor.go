@@ -0,0 +1,165 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package waitfor waits for the unix sockets of the services that the agent
+// talks to, e.g. the APIs of the container engines, to become usable, since
+// they can start long after the agent.
+package waitfor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/resume"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/retry"
+)
+
+const (
+	// DefaultInitialInterval is the longest delay after the first attempt.
+	DefaultInitialInterval = 250 * time.Millisecond
+	// DefaultMaxInterval is the longest delay between two attempts.
+	DefaultMaxInterval = 5 * time.Second
+)
+
+// ErrTimeout is returned by WaitForSocket when the socket was not usable
+// within the timeout.
+var ErrTimeout = errors.New("timed out")
+
+// Options are the options of WaitForSocket, the zero value waits for as long
+// as it takes, with the default intervals.
+type Options struct {
+	// Name is what is waited for in the logs, e.g. "docker".
+	Name string
+	// InitialInterval is the longest delay after the first attempt, which
+	// doubles after every attempt up to MaxInterval; the delays are random,
+	// see retry.Policy, so that the agents that started together spread out.
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// Timeout is how long the agent has to be awake before WaitForSocket
+	// gives up, 0 waits for as long as it takes.
+	Timeout time.Duration
+	// Now is the clock of the timeout, time.Now if nil; its jumps are not
+	// counted, see resume.Awake.
+	Now func() time.Time
+	// Source draws the delays, the global source if nil.
+	Source rand.Source
+}
+
+// WaitForSocket waits for the unix socket at path to be usable, which is once
+// it exists and probe succeeds, e.g. with the version of the API that is
+// served on it. It is checked right away, and then with a backoff that grows
+// from opts.InitialInterval to opts.MaxInterval, until the timeout. It fails
+// with ErrTimeout and the last error of the checks once the timeout passed,
+// or with the error of ctx once it is done.
+func WaitForSocket(ctx context.Context, path string, probe func(ctx context.Context) error, opts Options) error {
+	opts = opts.withDefaults()
+
+	awake := resume.NewAwake(opts.MaxInterval)
+	awake.Now = opts.Now
+	awake.Observe()
+
+	backoff := retry.Policy{Initial: opts.InitialInterval, Max: opts.MaxInterval, Source: opts.Source}.Start()
+
+	for attempt := 1; ; attempt++ {
+		err := check(ctx, path, probe)
+		if err == nil {
+			if attempt > 1 {
+				logger.Infow("the socket is ready", logging.Fields(opts.fields(path), log.Fields{
+					"attempts": attempt,
+					"elapsed":  awake.Elapsed().Round(time.Millisecond).String(),
+				}))
+			}
+
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		elapsed := awake.Elapsed()
+		if opts.Timeout > 0 && elapsed >= opts.Timeout {
+			return fmt.Errorf("%w waiting for %s after %s: %w", ErrTimeout, path, opts.Timeout, err)
+		}
+
+		// The last attempt is made once the timeout passes, rather than
+		// the full delay after it.
+		wait, _ := backoff.Next()
+		if opts.Timeout > 0 {
+			wait = min(wait, opts.Timeout-elapsed)
+		}
+
+		fields := logging.Fields(opts.fields(path), logging.Error(err), log.Fields{
+			"attempt": attempt,
+			"retry":   wait.Round(time.Millisecond).String(),
+		})
+		if attempt == 1 {
+			logger.Infow("waiting for the socket", fields)
+		} else {
+			logger.Debugw("the socket is not ready yet", fields)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// check returns nil if the socket is usable. The errors other than a
+// missing socket, e.g. permission denied while the socket is still being set
+// up, are retried like it.
+func check(ctx context.Context, path string, probe func(ctx context.Context) error) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	return probe(ctx)
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxInterval <= 0 {
+		o.MaxInterval = DefaultMaxInterval
+	}
+
+	if o.InitialInterval <= 0 {
+		o.InitialInterval = DefaultInitialInterval
+	}
+
+	o.InitialInterval = min(o.InitialInterval, o.MaxInterval)
+
+	if o.Now == nil {
+		o.Now = time.Now
+	}
+
+	return o
+}
+
+func (o Options) fields(path string) log.Fields {
+	fields := log.Fields{"socket": path}
+	if o.Name != "" {
+		fields["name"] = o.Name
+	}
+
+	return fields
+}
@@ -0,0 +1,199 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package waitfor_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/retry"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/waitfor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errNotServing = errors.New("not serving")
+
+// fastOptions checks the socket every few milliseconds.
+var fastOptions = waitfor.Options{ //nolint:gochecknoglobals
+	InitialInterval: time.Millisecond,
+	MaxInterval:     5 * time.Millisecond,
+}
+
+// newSocket returns the path of a socket file that exists.
+func newSocket(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "engine.sock")
+	require.NoError(t, os.WriteFile(path, nil, 0o600))
+
+	return path
+}
+
+func TestWaitForSocketImmediate(t *testing.T) {
+	t.Parallel()
+
+	var probes atomic.Int32
+
+	probe := func(context.Context) error {
+		probes.Add(1)
+
+		return nil
+	}
+
+	// The socket is checked right away, rather than after the first interval.
+	opts := waitfor.Options{InitialInterval: time.Hour, MaxInterval: time.Hour}
+	started := time.Now()
+
+	require.NoError(t, waitfor.WaitForSocket(context.Background(), newSocket(t), probe, opts))
+	assert.Equal(t, int32(1), probes.Load())
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+func TestWaitForSocketDelayedCreation(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "engine.sock")
+
+	var probes atomic.Int32
+
+	probe := func(context.Context) error {
+		probes.Add(1)
+
+		return nil
+	}
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		_ = os.WriteFile(path, nil, 0o600)
+	}()
+
+	// The socket is only probed once it exists.
+	require.NoError(t, waitfor.WaitForSocket(context.Background(), path, probe, fastOptions))
+	assert.Equal(t, int32(1), probes.Load())
+}
+
+func TestWaitForSocketPermissionDenied(t *testing.T) {
+	t.Parallel()
+
+	var probes atomic.Int32
+
+	// The socket is not accessible yet, e.g. while its group is being set.
+	probe := func(context.Context) error {
+		if probes.Add(1) < 3 {
+			return fmt.Errorf("dial unix: %w", fs.ErrPermission)
+		}
+
+		return nil
+	}
+
+	require.NoError(t, waitfor.WaitForSocket(context.Background(), newSocket(t), probe, fastOptions))
+	assert.Equal(t, int32(3), probes.Load())
+}
+
+func TestWaitForSocketTimeout(t *testing.T) {
+	t.Parallel()
+
+	var probes atomic.Int32
+
+	probe := func(context.Context) error {
+		probes.Add(1)
+
+		return errNotServing
+	}
+
+	opts := fastOptions
+	opts.Timeout = 50 * time.Millisecond
+	started := time.Now()
+
+	err := waitfor.WaitForSocket(context.Background(), newSocket(t), probe, opts)
+	require.ErrorIs(t, err, waitfor.ErrTimeout)
+	require.ErrorIs(t, err, errNotServing)
+	assert.GreaterOrEqual(t, time.Since(started), opts.Timeout)
+	assert.Less(t, time.Since(started), opts.Timeout+time.Second)
+	assert.Greater(t, probes.Load(), int32(2))
+}
+
+func TestWaitForSocketTimeoutMissing(t *testing.T) {
+	t.Parallel()
+
+	opts := fastOptions
+	opts.Timeout = 20 * time.Millisecond
+
+	err := waitfor.WaitForSocket(context.Background(), filepath.Join(t.TempDir(), "missing.sock"),
+		func(context.Context) error { return nil }, opts)
+	require.ErrorIs(t, err, waitfor.ErrTimeout)
+	require.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestWaitForSocketCancelled(t *testing.T) {
+	t.Parallel()
+
+	probe := func(context.Context) error { return errNotServing }
+
+	// The delay is much longer than the context, which is not waited out.
+	opts := waitfor.Options{InitialInterval: time.Hour, MaxInterval: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+
+	err := waitfor.WaitForSocket(ctx, newSocket(t), probe, opts)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.NotErrorIs(t, err, waitfor.ErrTimeout)
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+func TestWaitForSocketBackoff(t *testing.T) {
+	t.Parallel()
+
+	var probes []time.Time
+
+	probe := func(context.Context) error {
+		probes = append(probes, time.Now())
+		if len(probes) < 5 {
+			return errNotServing
+		}
+
+		return nil
+	}
+
+	// With the same seed, the delays are the ones of the schedule of the
+	// policy, which are at most 10ms, 20ms, 40ms, 40ms.
+	policy := retry.Policy{Initial: 10 * time.Millisecond, Max: 40 * time.Millisecond, Source: retry.NewSource(1)}
+	opts := waitfor.Options{
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     40 * time.Millisecond,
+		Source:          retry.NewSource(1),
+	}
+
+	require.NoError(t, waitfor.WaitForSocket(context.Background(), newSocket(t), probe, opts))
+	require.Len(t, probes, 5)
+
+	backoff := policy.Start()
+
+	for i, ceiling := range []time.Duration{10, 20, 40, 40} {
+		want, _ := backoff.Next()
+		require.LessOrEqual(t, want, ceiling*time.Millisecond)
+		assert.GreaterOrEqual(t, probes[i+1].Sub(probes[i]), want, "delay %d", i)
+	}
+}
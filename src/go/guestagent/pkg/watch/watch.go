@@ -0,0 +1,485 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package watch prints the changes of the port mappings of a running agent
+// as they happen, from its admin API, for the debugging in the VM; see
+// -watchPorts.
+package watch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/history"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// ErrAdminAPI is returned when the admin API of the agent can not be reached.
+var ErrAdminAPI = errors.New("the admin API can not be reached")
+
+// errNoStream is returned when the admin API does not stream the events,
+// e.g. since it is served by an agent that does not keep them.
+var errNoStream = errors.New("the admin API does not stream the events")
+
+const (
+	// DefaultPollInterval is the interval that GET /ports is polled at when
+	// the events can not be streamed.
+	DefaultPollInterval = 2 * time.Second
+	// UnixBaseURL is the base URL of the requests of UnixClient.
+	UnixBaseURL = "http://guestagent"
+	// reconnectDelay is how long the watcher waits to reconnect to a stream that ended.
+	reconnectDelay = time.Second
+	// maxEventSize is the size of the largest event of the stream that is read.
+	maxEventSize = 1 << 20
+	// timeLayout is the time of the changes in the table.
+	timeLayout = "15:04:05"
+	// rowFormat lays out the columns of the table.
+	rowFormat = "%-8s  %-9s  %-10s  %-21s  %-16s  %-7s  %s"
+)
+
+// The escape sequences that color the rows of the table.
+const (
+	colorReset  = "\x1b[0m"
+	colorBold   = "\x1b[1m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+)
+
+// Options configure how the changes are printed.
+type Options struct {
+	// JSON prints the changes as JSON lines, like the records of GET /events,
+	// rather than as a table.
+	JSON bool
+	// Color colors the rows of the table by their action, e.g. when the output is a terminal.
+	Color bool
+	// PollInterval is the interval that GET /ports is polled at when the
+	// events can not be streamed, DefaultPollInterval if it is not positive.
+	PollInterval time.Duration
+}
+
+// Watcher prints the port mappings that an agent holds, and then their
+// changes as they happen: from GET /events/stream of its admin API, or by
+// polling GET /ports when the events are not streamed.
+type Watcher struct {
+	client  *http.Client
+	baseURL string
+	output  io.Writer
+	options Options
+	// header tells whether the header of the table was printed.
+	header bool
+	// lastSeq is the sequence number of the last record that was received,
+	// to resume the stream from when it is reconnected.
+	lastSeq uint64
+}
+
+// New creates a watcher of the admin API at the base URL, which prints to the output.
+func New(client *http.Client, baseURL string, output io.Writer, options Options) *Watcher {
+	if options.PollInterval <= 0 {
+		options.PollInterval = DefaultPollInterval
+	}
+
+	return &Watcher{client: client, baseURL: baseURL, output: output, options: options}
+}
+
+// UnixClient returns a client of the admin API that is served on the unix
+// socket at path, whose requests are made to UnixBaseURL.
+func UnixClient(path string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// Run prints the port mappings that the agent holds, then their changes until
+// the context is cancelled. It returns an error if the admin API can not be
+// reached, either at first or once a stream that ended can not be reconnected.
+func (w *Watcher) Run(ctx context.Context) error {
+	// The stream is opened before the port mappings are listed, so that
+	// none of the changes in between are missed.
+	stream, streamErr := w.openStream(ctx)
+	if streamErr != nil && !errors.Is(streamErr, errNoStream) {
+		return streamErr
+	}
+
+	entries, err := w.ports(ctx)
+	if err != nil {
+		if stream != nil {
+			stream.Close()
+		}
+
+		return err
+	}
+
+	w.printHeader()
+
+	for _, record := range diffRecords(nil, entries, time.Now()) {
+		w.print(record)
+	}
+
+	if stream == nil {
+		log.Debugf("polling the port mappings every %s: %v", w.options.PollInterval, streamErr)
+
+		return w.poll(ctx, entries)
+	}
+
+	return w.stream(ctx, stream)
+}
+
+// openStream requests GET /events/stream, from the last record that was
+// received; it returns errNoStream if the admin API does not stream the
+// events, or if the agent does not keep them.
+func (w *Watcher) openStream(ctx context.Context) (io.ReadCloser, error) {
+	if w.lastSeq == 0 {
+		var config map[string]string
+		if err := w.get(ctx, "/config", &config); err == nil && config["eventHistorySize"] == "0" {
+			return nil, fmt.Errorf("%w: -eventHistorySize is 0", errNoStream)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.baseURL+"/events/stream", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if w.lastSeq != 0 {
+		req.Header.Set("Last-Event-ID", strconv.FormatUint(w.lastSeq, 10))
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrAdminAPI, err)
+	}
+
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed:
+		res.Body.Close()
+
+		return nil, fmt.Errorf("%w: GET /events/stream returned %s", errNoStream, res.Status)
+	case res.StatusCode != http.StatusOK:
+		res.Body.Close()
+
+		return nil, fmt.Errorf("%w: GET /events/stream returned %s", ErrAdminAPI, res.Status)
+	case !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream"):
+		res.Body.Close()
+
+		return nil, fmt.Errorf("%w: GET /events/stream is not an event stream", errNoStream)
+	}
+
+	return res.Body, nil
+}
+
+// stream prints the records of the stream, and of the streams that it is
+// reconnected to once it ends, until the context is cancelled.
+func (w *Watcher) stream(ctx context.Context, stream io.ReadCloser) error {
+	for {
+		err := w.readEvents(stream)
+		stream.Close()
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		log.Debugf("the events stream ended, reconnecting: %v", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(reconnectDelay):
+		}
+
+		stream, err = w.openStream(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readEvents prints the records of the server-sent events of the stream until it ends.
+func (w *Watcher) readEvents(stream io.Reader) error {
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(nil, maxEventSize)
+
+	var data strings.Builder
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			// An empty line ends the event.
+			if data.Len() != 0 {
+				w.printEvent(data.String())
+			}
+
+			data.Reset()
+		case strings.HasPrefix(line, ":"):
+			// The comments keep the idle streams alive.
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			if field == "data" {
+				if data.Len() != 0 {
+					data.WriteByte('\n')
+				}
+
+				data.WriteString(strings.TrimPrefix(value, " "))
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return io.EOF
+}
+
+// printEvent prints the record of the data of an event.
+func (w *Watcher) printEvent(data string) {
+	var record history.Record
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		log.Debugf("skipping an event that is not a record: %v", err)
+
+		return
+	}
+
+	if record.Seq != 0 {
+		w.lastSeq = record.Seq
+	}
+
+	w.print(record)
+}
+
+// poll prints the changes of the port mappings of GET /ports every poll
+// interval, from the given entries, until the context is cancelled.
+func (w *Watcher) poll(ctx context.Context, previous []tracker.Entry) error {
+	ticker := time.NewTicker(w.options.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		entries, err := w.ports(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		for _, record := range diffRecords(previous, entries, time.Now()) {
+			w.print(record)
+		}
+
+		previous = entries
+	}
+}
+
+// ports returns the entries of GET /ports.
+func (w *Watcher) ports(ctx context.Context) ([]tracker.Entry, error) {
+	var entries []tracker.Entry
+	if err := w.get(ctx, "/ports", &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// get decodes the JSON response of the path of the admin API into value.
+func (w *Watcher) get(ctx context.Context, path string, value any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrAdminAPI, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: GET %s returned %s", ErrAdminAPI, path, res.Status)
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(value); err != nil {
+		return fmt.Errorf("%w: failed to decode GET %s: %w", ErrAdminAPI, path, err)
+	}
+
+	return nil
+}
+
+// diffRecords returns the records of the port bindings that were removed
+// from the entries, and then of the ones that were added to them, sorted.
+func diffRecords(before, after []tracker.Entry, now time.Time) []history.Record {
+	previous := bindingRecords(before)
+	current := bindingRecords(after)
+
+	var removed, added []history.Record
+
+	for key, record := range previous {
+		if _, ok := current[key]; !ok {
+			record.Action = string(tracker.ActionRemove)
+			removed = append(removed, record)
+		}
+	}
+
+	for key, record := range current {
+		if _, ok := previous[key]; !ok {
+			record.Action = string(tracker.ActionAdd)
+			added = append(added, record)
+		}
+	}
+
+	records := append(sortRecords(removed), sortRecords(added)...)
+	for i := range records {
+		records[i].Timestamp = now
+	}
+
+	return records
+}
+
+// bindingRecords returns the records of the port bindings of the entries, keyed by the binding.
+func bindingRecords(entries []tracker.Entry) map[string]history.Record {
+	records := make(map[string]history.Record)
+
+	for _, entry := range entries {
+		for port, bindings := range entry.Ports {
+			for _, binding := range bindings {
+				key := entry.ID + "/" + port.Proto() + "/" + binding.HostIP + "/" + binding.HostPort
+				records[key] = history.Record{
+					Kind:     history.KindTracker,
+					ID:       entry.ID,
+					Port:     binding.HostPort,
+					Protocol: port.Proto(),
+					HostIP:   binding.HostIP,
+					Source:   entry.Source,
+					Metadata: entry.Metadata,
+				}
+			}
+		}
+	}
+
+	return records
+}
+
+// sortRecords sorts the records by their ID, and then by their address.
+func sortRecords(records []history.Record) []history.Record {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].ID != records[j].ID {
+			return records[i].ID < records[j].ID
+		}
+
+		return address(records[i]) < address(records[j])
+	})
+
+	return records
+}
+
+// printHeader prints the header of the table, once.
+func (w *Watcher) printHeader() {
+	if w.options.JSON || w.header {
+		return
+	}
+
+	w.header = true
+	w.printRow(colorBold, "TIME", "ACTION", "SOURCE", "ADDRESS", "ID", "OUTCOME", "DETAILS")
+}
+
+// print prints the record as a row of the table, or as a JSON line.
+func (w *Watcher) print(record history.Record) {
+	if w.options.JSON {
+		if err := json.NewEncoder(w.output).Encode(record); err != nil {
+			log.Errorf("failed to write the change: %v", err)
+		}
+
+		return
+	}
+
+	timestamp := record.Timestamp.Local().Format(timeLayout)
+
+	switch record.Kind {
+	case history.KindSubsystem:
+		w.printRow(colorYellow, timestamp, record.Kind, record.Subsystem, "", "", "", record.State+": "+record.Error)
+	case history.KindDropped:
+		w.printRow(colorYellow, timestamp, record.Kind, "", "", "", "", fmt.Sprintf("%d changes were lost", record.Dropped))
+	default:
+		color := colorGreen
+
+		switch {
+		case record.Error != "" || record.Outcome == string(tracker.OutcomeFailed):
+			color = colorYellow
+		case record.Action == string(tracker.ActionRemove):
+			color = colorRed
+		}
+
+		details := record.Error
+		if details == "" {
+			details = formatMetadata(record.Metadata)
+		}
+
+		w.printRow(color, timestamp, record.Action, record.Source, address(record), record.ID, record.Outcome, details)
+	}
+}
+
+// printRow prints the columns of a row of the table, in the color if the table is colored.
+func (w *Watcher) printRow(color string, columns ...any) {
+	row := strings.TrimRight(fmt.Sprintf(rowFormat, columns...), " ")
+	if w.options.Color {
+		row = color + row + colorReset
+	}
+
+	if _, err := fmt.Fprintln(w.output, row); err != nil {
+		log.Errorf("failed to write the change: %v", err)
+	}
+}
+
+// address returns the host address of the port binding of the record, e.g. 127.0.0.1:8080/tcp.
+func address(record history.Record) string {
+	return net.JoinHostPort(record.HostIP, record.Port) + "/" + record.Protocol
+}
+
+// formatMetadata returns the metadata as key=value pairs, sorted by key.
+func formatMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+"="+value)
+	}
+
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, " ")
+}
@@ -0,0 +1,303 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package watch_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/history"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/watch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// syncBuffer is the output of a watcher, which is read while it runs.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.buffer.Write(p)
+}
+
+// lines returns the lines that were written so far.
+func (s *syncBuffer) lines() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return strings.Split(strings.TrimSuffix(s.buffer.String(), "\n"), "\n")
+}
+
+var timestamp = time.Date(2024, 5, 14, 10, 11, 12, 0, time.UTC) //nolint:gochecknoglobals
+
+// clock is the time of the records in the table.
+var clock = timestamp.Local().Format("15:04:05") //nolint:gochecknoglobals
+
+func entry(id, source, port string) tracker.Entry {
+	return tracker.Entry{
+		ID:       id,
+		Source:   source,
+		Ports:    nat.PortMap{nat.Port(port + "/tcp"): []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: port}}},
+		Metadata: map[string]string{"name": id},
+	}
+}
+
+// writeEvent writes the record as a server-sent event, like GET /events/stream.
+func writeEvent(w http.ResponseWriter, record history.Record) {
+	data, _ := json.Marshal(record)
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", record.Seq, record.Kind, data)
+	w.(http.Flusher).Flush()
+}
+
+// run runs the watcher until the output has the given number of lines.
+func run(t *testing.T, server *httptest.Server, options watch.Options, lines int) []string {
+	t.Helper()
+
+	output := &syncBuffer{}
+	watcher := watch.New(server.Client(), server.URL, output, options)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- watcher.Run(ctx)
+	}()
+
+	require.Eventually(t, func() bool {
+		return len(output.lines()) >= lines
+	}, 5*time.Second, 10*time.Millisecond, "the changes were not printed")
+
+	cancel()
+	require.NoError(t, <-done)
+
+	return output.lines()
+}
+
+func TestWatcherStream(t *testing.T) {
+	t.Parallel()
+
+	var lastEventIDs []string
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"eventHistorySize": "500"})
+	})
+	mux.HandleFunc("GET /ports", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode([]tracker.Entry{entry("web", tracker.SourceDocker, "8080")})
+	})
+
+	var mutex sync.Mutex
+
+	mux.HandleFunc("GET /events/stream", func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+		reconnected := len(lastEventIDs) > 1
+		mutex.Unlock()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+
+		// The first stream ends after its first events, like a stream that fell behind.
+		if !reconnected {
+			fmt.Fprint(w, ": keepalive\n\n")
+			writeEvent(w, history.Record{
+				Seq: 1, Timestamp: timestamp, Kind: history.KindTracker, Action: "add", ID: "db",
+				Port: "5432", Protocol: "tcp", HostIP: "0.0.0.0", Source: tracker.SourceDocker,
+				Metadata: map[string]string{"name": "db", "compose": "app"},
+			})
+			writeEvent(w, history.Record{
+				Seq: 2, Timestamp: timestamp, Kind: history.KindTracker, Action: "add", ID: "db",
+				Port: "5432", Protocol: "tcp", HostIP: "0.0.0.0", Source: tracker.SourceDocker, Outcome: "sent",
+			})
+
+			return
+		}
+
+		writeEvent(w, history.Record{
+			Seq: 3, Timestamp: timestamp, Kind: history.KindTracker, Action: "remove", ID: "web",
+			Port: "8080", Protocol: "tcp", HostIP: "127.0.0.1", Source: tracker.SourceDocker,
+			Outcome: "failed", Error: "connection refused",
+		})
+		writeEvent(w, history.Record{
+			Seq: 4, Timestamp: timestamp, Kind: history.KindSubsystem, Subsystem: "kubernetes",
+			State: "backing off", Error: "no such host",
+		})
+		writeEvent(w, history.Record{Timestamp: timestamp, Kind: history.KindDropped, Dropped: 3})
+
+		<-r.Context().Done()
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	lines := run(t, server, watch.Options{}, 7)
+
+	// The port mappings that are held at first are listed at the time they are watched.
+	require.Len(t, lines, 7)
+	assert.Equal(t, "TIME      ACTION     SOURCE      ADDRESS                ID                OUTCOME  DETAILS", lines[0])
+	assert.Regexp(t, `^\d\d:\d\d:\d\d  add        docker      127\.0\.0\.1:8080/tcp     web                        name=web$`, lines[1])
+	assert.Equal(t, []string{
+		clock + "  add        docker      0.0.0.0:5432/tcp       db                         compose=app name=db",
+		clock + "  add        docker      0.0.0.0:5432/tcp       db                sent",
+		clock + "  remove     docker      127.0.0.1:8080/tcp     web               failed   connection refused",
+		clock + "  subsystem  kubernetes                                                    backing off: no such host",
+		clock + "  dropped                                                                  3 changes were lost",
+	}, lines[2:])
+
+	// The stream is resumed from the last record that was received.
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(t, []string{"", "2"}, lastEventIDs)
+}
+
+func TestWatcherPoll(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mutex sync.Mutex
+		polls int
+	)
+
+	// GET /events/stream is not served, like by an agent that predates it.
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ports", func(w http.ResponseWriter, _ *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		entries := [][]tracker.Entry{
+			{entry("web", tracker.SourceDocker, "8080")},
+			{entry("web", tracker.SourceDocker, "8080"), entry("nginx-uid", tracker.SourceKubernetes, "30080")},
+			{entry("nginx-uid", tracker.SourceKubernetes, "30080")},
+		}[min(polls, 2)]
+		polls++
+
+		_ = json.NewEncoder(w).Encode(entries)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	lines := run(t, server, watch.Options{PollInterval: 10 * time.Millisecond}, 4)
+
+	require.Len(t, lines, 4)
+	assert.Contains(t, lines[1], "  add        docker      127.0.0.1:8080/tcp     web                        name=web")
+	assert.Contains(t, lines[2], "  add        kubernetes  127.0.0.1:30080/tcp    nginx-uid                  name=nginx-uid")
+	assert.Contains(t, lines[3], "  remove     docker      127.0.0.1:8080/tcp     web                        name=web")
+}
+
+func TestWatcherPollWithoutHistory(t *testing.T) {
+	t.Parallel()
+
+	// The agent streams the events, but it does not keep them.
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /config", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"eventHistorySize": "0"})
+	})
+	mux.HandleFunc("GET /ports", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode([]tracker.Entry{entry("web", tracker.SourceDocker, "8080")})
+	})
+	mux.HandleFunc("GET /events/stream", func(_ http.ResponseWriter, _ *http.Request) {
+		t.Error("the events were streamed")
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	lines := run(t, server, watch.Options{PollInterval: 10 * time.Millisecond}, 2)
+	assert.Contains(t, lines[1], "web")
+}
+
+func TestWatcherJSON(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ports", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode([]tracker.Entry{entry("web", tracker.SourceDocker, "8080")})
+	})
+	mux.HandleFunc("GET /events/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		writeEvent(w, history.Record{
+			Seq: 1, Timestamp: timestamp, Kind: history.KindTracker, Action: "remove", ID: "web",
+			Port: "8080", Protocol: "tcp", HostIP: "127.0.0.1", Source: tracker.SourceDocker,
+		})
+
+		<-r.Context().Done()
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	// The JSON lines have no header, they are the records of the changes.
+	lines := run(t, server, watch.Options{JSON: true}, 2)
+	require.Len(t, lines, 2)
+
+	var records []history.Record
+
+	for _, line := range lines {
+		var record history.Record
+		require.NoError(t, json.Unmarshal([]byte(line), &record), line)
+		records = append(records, record)
+	}
+
+	assert.Equal(t, "add", records[0].Action)
+	assert.Equal(t, "web", records[0].ID)
+	assert.Equal(t, map[string]string{"name": "web"}, records[0].Metadata)
+	assert.Equal(t, history.Record{
+		Seq: 1, Timestamp: timestamp, Kind: history.KindTracker, Action: "remove", ID: "web",
+		Port: "8080", Protocol: "tcp", HostIP: "127.0.0.1", Source: tracker.SourceDocker,
+	}, records[1])
+}
+
+func TestWatcherColor(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /ports", func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode([]tracker.Entry{entry("web", tracker.SourceDocker, "8080")})
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	lines := run(t, server, watch.Options{Color: true}, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "\x1b[1mTIME"), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "\x1b[32m"), lines[1])
+	assert.True(t, strings.HasSuffix(lines[1], "\x1b[0m"), lines[1])
+}
+
+func TestWatcherUnreachable(t *testing.T) {
+	t.Parallel()
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	err := watch.New(server.Client(), server.URL, &syncBuffer{}, watch.Options{}).Run(context.Background())
+	require.ErrorIs(t, err, watch.ErrAdminAPI)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wsl
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+)
+
+// DefaultNATSubnets is the range that WSL picks the NAT network of the VM
+// from, unless the NatNetwork of WSL sets a custom one.
+const DefaultNATSubnets = "172.16.0.0/12"
+
+var ErrInvalidNATSubnet = errors.New("invalid NAT subnet")
+
+// ParseNATSubnets parses a comma separated list of the subnets of the NAT
+// network of WSL in the CIDR form, e.g. "172.16.0.0/12,10.200.0.0/16".
+func ParseNATSubnets(spec string) ([]netip.Prefix, error) {
+	var subnets []netip.Prefix
+
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		subnet, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidNATSubnet, err)
+		}
+
+		subnets = append(subnets, subnet.Masked())
+	}
+
+	return subnets, nil
+}
+
+// Classify returns the connect addresses with their scope: the addresses
+// within the NAT subnets are in the NAT network of WSL, any other one is on
+// the LAN, e.g. the address that the bridged networking gets from the LAN.
+// The connect addresses that are not IP addresses are left without a scope,
+// and the ones that are passed in are left untouched.
+func Classify(connectAddrs []types.ConnectAddrs, natSubnets []netip.Prefix) []types.ConnectAddrs {
+	if connectAddrs == nil {
+		return nil
+	}
+
+	classified := make([]types.ConnectAddrs, 0, len(connectAddrs))
+
+	for _, connectAddr := range connectAddrs {
+		if ip, err := netip.ParseAddr(connectAddr.IP); err == nil {
+			connectAddr.Scope = types.ScopeLAN
+
+			for _, subnet := range natSubnets {
+				if subnet.Contains(ip.Unmap()) {
+					connectAddr.Scope = types.ScopeNAT
+
+					break
+				}
+			}
+		}
+
+		classified = append(classified, connectAddr)
+	}
+
+	return classified
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wsl_test
+
+import (
+	"net"
+	"testing"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/types"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/wsl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func connectAddrs(t *testing.T, cidrs ...string) []types.ConnectAddrs {
+	t.Helper()
+
+	var connectAddrs []types.ConnectAddrs
+
+	for _, cidr := range cidrs {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+
+		ipNet.IP = ip
+		connectAddrs = append(connectAddrs, types.NewConnectAddrs(ipNet, "eth0"))
+	}
+
+	return connectAddrs
+}
+
+func TestClassify(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		natSubnets string
+		addrs      []string
+		scopes     []string
+	}{
+		{
+			name:       "nat",
+			natSubnets: wsl.DefaultNATSubnets,
+			addrs:      []string{"172.26.118.5/20"},
+			scopes:     []string{types.ScopeNAT},
+		},
+		{
+			name:       "bridged",
+			natSubnets: wsl.DefaultNATSubnets,
+			addrs:      []string{"192.168.1.50/24", "2001:db8::50/64"},
+			scopes:     []string{types.ScopeLAN, types.ScopeLAN},
+		},
+		{
+			name:       "custom subnet",
+			natSubnets: "10.200.0.0/16",
+			addrs:      []string{"10.200.3.4/16", "172.26.118.5/20"},
+			scopes:     []string{types.ScopeNAT, types.ScopeLAN},
+		},
+		{
+			name:       "default and custom subnets",
+			natSubnets: wsl.DefaultNATSubnets + ", 10.200.0.0/16",
+			addrs:      []string{"10.200.3.4/16", "172.26.118.5/20", "10.0.0.7/8"},
+			scopes:     []string{types.ScopeNAT, types.ScopeNAT, types.ScopeLAN},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			natSubnets, err := wsl.ParseNATSubnets(test.natSubnets)
+			require.NoError(t, err)
+
+			addrs := connectAddrs(t, test.addrs...)
+			classified := wsl.Classify(addrs, natSubnets)
+			require.Len(t, classified, len(test.scopes))
+
+			for i, scope := range test.scopes {
+				assert.Equal(t, scope, classified[i].Scope, classified[i].Addr)
+				assert.Empty(t, addrs[i].Scope)
+			}
+		})
+	}
+}
+
+func TestClassifyWithoutIP(t *testing.T) {
+	t.Parallel()
+
+	classified := wsl.Classify([]types.ConnectAddrs{{Network: "unix", Addr: "/run/peer.sock"}}, nil)
+	require.Len(t, classified, 1)
+	assert.Empty(t, classified[0].Scope)
+	assert.Nil(t, wsl.Classify(nil, nil))
+}
+
+func TestParseNATSubnetsInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := wsl.ParseNATSubnets("172.16.0.0/12,10.200.0.0")
+	require.ErrorIs(t, err, wsl.ErrInvalidNATSubnet)
+}
@@ -0,0 +1,177 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package wsl detects how the Windows Subsystem for Linux runs the VM.
+package wsl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+)
+
+const (
+	// ModeMirrored is the networking mode that wslinfo reports for the mirrored networking.
+	ModeMirrored = "mirrored"
+	// LoopbackInterface is the interface that the mirrored networking adds
+	// for the loopback traffic of the host.
+	LoopbackInterface = "loopback0"
+	wslInfoTimeout    = 5 * time.Second
+	// relayInterval is how often the host is checked for the relay of the probe.
+	relayInterval = 250 * time.Millisecond
+)
+
+// The forwarding profiles, see Detector.LocalhostForwarding.
+const (
+	// ProfileRelay leaves the ports bound to the loopback of the VM to the
+	// relay of WSL (localhostForwarding=true in .wslconfig, the default),
+	// which already listens on them at the loopback of the host.
+	ProfileRelay = "relay"
+	// ProfileDirect forwards all the ports, since WSL relays none of them
+	// (localhostForwarding=false in .wslconfig).
+	ProfileDirect = "direct"
+)
+
+// Profiles are the forwarding profiles.
+var Profiles = []string{ProfileRelay, ProfileDirect}
+
+var ErrRelayProbe = errors.New("failed to probe the localhost relay of WSL")
+
+// Detector detects the mirrored networking of WSL, see Mirrored.
+type Detector struct {
+	// WSLInfo runs wslinfo with the arguments and returns its output.
+	WSLInfo func(ctx context.Context, args ...string) ([]byte, error)
+	// Lister lists the network interfaces of the VM.
+	Lister netif.Lister
+	// Relayed returns true if the host listens on its loopback at the port,
+	// see LocalhostForwarding.
+	Relayed func(ctx context.Context, port int) (bool, error)
+}
+
+// NewDetector returns the detector of the system.
+func NewDetector() *Detector {
+	return &Detector{
+		WSLInfo: runWSLInfo,
+		Lister:  netif.Netlink(),
+		Relayed: netstatRelayed,
+	}
+}
+
+func runWSLInfo(ctx context.Context, args ...string) ([]byte, error) {
+	return exec.CommandContext(ctx, "wslinfo", args...).Output()
+}
+
+// Mirrored returns true if WSL runs the VM with the mirrored networking
+// (networkingMode=mirrored in .wslconfig), along with how it was detected.
+// The networking mode is asked to wslinfo, and the interfaces are checked
+// for the mirrored loopback when it can not tell, e.g. with the older WSL
+// versions.
+func (d *Detector) Mirrored(ctx context.Context) (bool, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, wslInfoTimeout)
+	defer cancel()
+
+	output, err := d.WSLInfo(ctx, "--networking-mode")
+	if err == nil {
+		mode := strings.TrimSpace(string(output))
+
+		return mode == ModeMirrored, "wslinfo reports the " + mode + " networking mode", nil
+	}
+
+	log.Debugf("wslinfo can not tell the networking mode, checking the network interfaces instead: %v", err)
+
+	interfaces, err := d.Lister.Interfaces()
+	if err != nil {
+		return false, "", err
+	}
+
+	for _, inf := range interfaces {
+		if inf.Name == LoopbackInterface {
+			return true, "the " + LoopbackInterface + " interface of the mirrored loopback exists", nil
+		}
+	}
+
+	return false, "there is no " + LoopbackInterface + " interface of the mirrored loopback", nil
+}
+
+// LocalhostForwarding returns the forwarding profile that matches the
+// localhostForwarding setting of .wslconfig, along with how it was detected.
+// The setting is probed with a throwaway port that listens on the loopback
+// of the VM: WSL relays it when the host listens on it within the timeout.
+func (d *Detector) LocalhostForwarding(ctx context.Context, timeout time.Duration) (string, string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %w", ErrRelayProbe, err)
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(relayInterval)
+	defer ticker.Stop()
+
+	for {
+		relayed, err := d.Relayed(ctx, port)
+		if err != nil && ctx.Err() == nil {
+			return "", "", fmt.Errorf("%w: %w", ErrRelayProbe, err)
+		}
+
+		if relayed {
+			return ProfileRelay, fmt.Sprintf("the host relays the probe port %d", port), nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if parent := context.Cause(ctx); !errors.Is(parent, context.DeadlineExceeded) {
+				return "", "", fmt.Errorf("%w: %w", ErrRelayProbe, parent)
+			}
+
+			return ProfileDirect, fmt.Sprintf("the host did not relay the probe port %d within %s", port, timeout), nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// netstatRelayed runs netstat.exe on the host, through the interop of WSL,
+// and returns true if it lists the port as listening on the host loopback.
+func netstatRelayed(ctx context.Context, port int) (bool, error) {
+	output, err := exec.CommandContext(ctx, "netstat.exe", "-a", "-n", "-p", "TCP").Output()
+	if err != nil {
+		return false, err
+	}
+
+	local := "127.0.0.1:" + strconv.Itoa(port)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+
+	// e.g. "  TCP    127.0.0.1:40123        0.0.0.0:0              LISTENING"
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 4 && fields[1] == local && fields[3] == "LISTENING" {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package wsl_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/wsl"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	errNotFound   = errors.New(`exec: "wslinfo": executable file not found in $PATH`)
+	errInterfaces = errors.New("netlink is not available")
+)
+
+type fakeLister struct {
+	names []string
+	err   error
+}
+
+func (f fakeLister) Interfaces() ([]netif.Interface, error) {
+	interfaces := make([]netif.Interface, 0, len(f.names))
+	for _, name := range f.names {
+		interfaces = append(interfaces, netif.Interface{Name: name})
+	}
+
+	return interfaces, f.err
+}
+
+func (f fakeLister) DefaultRoutes() ([]string, error) {
+	return nil, nil
+}
+
+// wslInfo returns the fake wslinfo that outputs the networking mode, or fails with err.
+func wslInfo(t *testing.T, mode string, err error) func(context.Context, ...string) ([]byte, error) {
+	t.Helper()
+
+	return func(_ context.Context, args ...string) ([]byte, error) {
+		assert.Equal(t, []string{"--networking-mode"}, args)
+
+		return []byte(mode + "\n"), err
+	}
+}
+
+func TestMirrored(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		detector wsl.Detector
+		mirrored bool
+		reason   string
+	}{
+		{
+			name:     "wslinfo reports mirrored",
+			detector: wsl.Detector{WSLInfo: wslInfo(t, "mirrored", nil), Lister: fakeLister{names: []string{"lo", "eth0"}}},
+			mirrored: true,
+			reason:   "wslinfo reports the mirrored networking mode",
+		},
+		{
+			name:     "wslinfo reports nat",
+			detector: wsl.Detector{WSLInfo: wslInfo(t, "nat", nil), Lister: fakeLister{names: []string{"lo", "loopback0"}}},
+			reason:   "wslinfo reports the nat networking mode",
+		},
+		{
+			name: "mirrored loopback without wslinfo",
+			detector: wsl.Detector{
+				WSLInfo: wslInfo(t, "", errNotFound),
+				Lister:  fakeLister{names: []string{"lo", "loopback0", "eth0"}},
+			},
+			mirrored: true,
+			reason:   "the loopback0 interface of the mirrored loopback exists",
+		},
+		{
+			name:     "no mirrored loopback without wslinfo",
+			detector: wsl.Detector{WSLInfo: wslInfo(t, "", errNotFound), Lister: fakeLister{names: []string{"lo", "eth0"}}},
+			reason:   "there is no loopback0 interface of the mirrored loopback",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			mirrored, reason, err := test.detector.Mirrored(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, test.mirrored, mirrored)
+			assert.Equal(t, test.reason, reason)
+		})
+	}
+}
+
+func TestMirroredFailure(t *testing.T) {
+	t.Parallel()
+
+	detector := wsl.Detector{WSLInfo: wslInfo(t, "", errNotFound), Lister: fakeLister{err: errInterfaces}}
+
+	_, _, err := detector.Mirrored(context.Background())
+	require.ErrorIs(t, err, errInterfaces)
+}
+
+// relayed returns the fake check of the relay that reports the probe port as
+// relayed from the given call on, it never does when from is 0.
+func relayed(from int, err error) func(context.Context, int) (bool, error) {
+	var calls atomic.Int32
+
+	return func(_ context.Context, port int) (bool, error) {
+		if port == 0 {
+			return false, errors.New("the probe port is not set")
+		}
+
+		call := int(calls.Add(1))
+
+		return from != 0 && call >= from, err
+	}
+}
+
+func TestLocalhostForwarding(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		relayed func(context.Context, int) (bool, error)
+		profile string
+		reason  string
+	}{
+		{
+			name:    "relayed right away",
+			relayed: relayed(1, nil),
+			profile: wsl.ProfileRelay,
+			reason:  "the host relays the probe port",
+		},
+		{
+			name:    "relayed after a while",
+			relayed: relayed(3, nil),
+			profile: wsl.ProfileRelay,
+			reason:  "the host relays the probe port",
+		},
+		{
+			name:    "not relayed",
+			relayed: relayed(0, nil),
+			profile: wsl.ProfileDirect,
+			reason:  "the host did not relay the probe port",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			detector := wsl.Detector{Relayed: test.relayed}
+
+			profile, reason, err := detector.LocalhostForwarding(context.Background(), time.Second)
+			require.NoError(t, err)
+			assert.Equal(t, test.profile, profile)
+			assert.Contains(t, reason, test.reason)
+		})
+	}
+}
+
+func TestLocalhostForwardingFailure(t *testing.T) {
+	t.Parallel()
+
+	errInterop := errors.New("exec: \"netstat.exe\": executable file not found in $PATH")
+	detector := wsl.Detector{Relayed: relayed(0, errInterop)}
+
+	_, _, err := detector.LocalhostForwarding(context.Background(), time.Second)
+	require.ErrorIs(t, err, wsl.ErrRelayProbe)
+	require.ErrorIs(t, err, errInterop)
+}
+
+func TestLocalhostForwardingCanceled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	detector := wsl.Detector{Relayed: relayed(0, nil)}
+
+	_, _, err := detector.LocalhostForwarding(ctx, time.Second)
+	require.ErrorIs(t, err, wsl.ErrRelayProbe)
+	require.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/startup"
+)
+
+// runPrintConfig prints the effective configuration to the output in the
+// format of -printConfig, with the values that the agent would detect at
+// startup, e.g. the forwarder and the network interface.
+func runPrintConfig(output io.Writer, origins config.Origins) int {
+	settings := config.Settings(flag.CommandLine, origins)
+
+	selection := selectForwarder(context.Background())
+	forwarderKind := selection.Kind
+	settings["forwarder"] = config.Setting{Value: forwarderKind, Origin: forwarderOrigin(origins, selection)}
+
+	// The API forwarder does not send the addresses of the interface.
+	if forwarderKind != forwarder.KindAPI && *netInterface == "" {
+		interfaces, err := interfaceSelector(nil).Select()
+		if err != nil {
+			log.Warnf("failed to detect the network interface: %v", err)
+		} else {
+			names := make([]string, 0, len(interfaces))
+			for _, iface := range interfaces {
+				names = append(names, iface.Name)
+			}
+
+			settings["interface"] = config.Setting{Value: strings.Join(names, ","), Origin: startup.OriginDetected}
+		}
+	}
+
+	if err := config.Print(output, settings, *printConfig); err != nil {
+		return fail(fmt.Errorf("failed to print the configuration: %w", err))
+	}
+
+	return 0
+}
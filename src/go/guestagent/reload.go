@@ -0,0 +1,370 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/exitcode"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/logging"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// loop is a periodic task of the agent, which is restarted
+// when the flags that it depends on are reloaded.
+type loop struct {
+	name   string
+	flags  []string
+	run    func(ctx context.Context)
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// loops runs the periodic tasks of the agent until the context is cancelled.
+type loops struct {
+	ctx   context.Context
+	mutex sync.Mutex
+	loops []*loop
+}
+
+func newLoops(ctx context.Context) *loops {
+	return &loops{ctx: ctx}
+}
+
+// start runs the task until the context is cancelled, and again whenever
+// one of the flags is reloaded; run reads the flags every time it starts.
+func (l *loops) start(name string, run func(ctx context.Context), flags ...string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	task := &loop{name: name, flags: flags, run: run}
+	l.loops = append(l.loops, task)
+	l.run(task)
+}
+
+func (l *loops) run(task *loop) {
+	ctx, cancel := context.WithCancel(l.ctx)
+	done := make(chan struct{})
+	task.cancel, task.done = cancel, done
+
+	go func() {
+		defer close(done)
+		task.run(ctx)
+	}()
+}
+
+// restart stops the tasks that depend on the changed flags, calls apply once
+// they are stopped so that it can set the flags, and starts them again.
+// It returns the names of the tasks that were restarted.
+func (l *loops) restart(changed map[string]string, apply func()) []string {
+	return l.restartMatching(func(task *loop) bool {
+		return slices.ContainsFunc(task.flags, func(name string) bool { _, ok := changed[name]; return ok })
+	}, apply)
+}
+
+// rearm restarts the named tasks in the background, e.g. the ones with the
+// tickers that may have fired erratically after the host resumed from sleep;
+// it does not wait, since the task that calls it may be restarted itself.
+func (l *loops) rearm(names ...string) {
+	go l.restartMatching(func(task *loop) bool {
+		return slices.Contains(names, task.name)
+	}, func() {})
+}
+
+func (l *loops) restartMatching(match func(task *loop) bool, apply func()) []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var affected []*loop
+
+	for _, task := range l.loops {
+		if match(task) {
+			task.cancel()
+			affected = append(affected, task)
+		}
+	}
+
+	for _, task := range affected {
+		<-task.done
+	}
+
+	apply()
+
+	restarted := make([]string, 0, len(affected))
+
+	for _, task := range affected {
+		if l.ctx.Err() != nil {
+			break
+		}
+
+		l.run(task)
+		restarted = append(restarted, task.name)
+	}
+
+	return restarted
+}
+
+// wait waits for the context to be cancelled and for the tasks to stop.
+func (l *loops) wait() {
+	<-l.ctx.Done()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, task := range l.loops {
+		<-task.done
+	}
+}
+
+// flags returns the flags that the tasks depend on.
+func (l *loops) flags() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var flags []string
+	for _, task := range l.loops {
+		flags = append(flags, task.flags...)
+	}
+
+	return flags
+}
+
+// reloader applies the configuration again on SIGHUP, see reload.
+type reloader struct {
+	// mutex guards the flags against the reads of the admin API.
+	mutex sync.Mutex
+	// commandLine are the flags that were set on the command line.
+	commandLine   map[string]string
+	logger        *logging.Logger
+	filterTracker *tracker.FilterTracker
+	loops         *loops
+	subsystems    *supervised
+	// logFile is the log file, if any, which is reopened for the external log rotation tools.
+	logFile *logging.RotatingFile
+	// auditFile is the audit log, if any, which is reopened like the log file.
+	auditFile *logging.RotatingFile
+}
+
+// liveFlags are the flags whose changes are applied in place when the
+// configuration is reloaded, besides the ones of the loops and of the subsystems.
+var liveFlags = []string{"debug", "logLevel", "logLevelOverride", "allowPorts", "blockPorts"} //nolint:gochecknoglobals
+
+// reloadOnSIGHUP reopens the log files and reloads the configuration on
+// every SIGHUP that hupCh receives until the context is cancelled.
+func (r *reloader) reloadOnSIGHUP(ctx context.Context, hupCh <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hupCh:
+			if r.logFile != nil {
+				if err := r.logFile.Reopen(); err != nil {
+					log.Errorf("failed to reopen the log file: %v", err)
+				}
+			}
+
+			if r.auditFile != nil {
+				if err := r.auditFile.Reopen(); err != nil {
+					log.Errorf("failed to reopen the audit log: %v", err)
+				}
+			}
+
+			log.Info("received [hangup] signal, reloading the configuration")
+			r.reload()
+		}
+	}
+}
+
+// reload resolves the flags again like at startup. The changes of the live
+// flags are applied in place, the loops and the subsystems that depend on the
+// changed flags are restarted, e.g. the containerd one for -containerdSock,
+// and the changes of the other flags, e.g. -forwarder or -vtunnelAddr, which
+// the forwarder and all the trackers are built with, only apply once the
+// agent is restarted.
+func (r *reloader) reload() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	changed, err := config.Reload(flag.CommandLine, r.commandLine, *configFile, os.LookupEnv)
+	if err != nil {
+		log.Errorf("failed to reload the configuration, keeping the current one: %v", err)
+
+		return
+	}
+
+	if len(changed) == 0 {
+		log.Info("reloaded the configuration, nothing changed")
+
+		return
+	}
+
+	// The new port filter is checked before any flag is set.
+	var filter *tracker.PortFilter
+
+	_, allowChanged := changed["allowPorts"]
+	_, blockChanged := changed["blockPorts"]
+
+	if allowChanged || blockChanged {
+		allowed, blocked := *allowPorts, *blockPorts
+		if allowChanged {
+			allowed = changed["allowPorts"]
+		}
+
+		if blockChanged {
+			blocked = changed["blockPorts"]
+		}
+
+		if filter, err = tracker.ParsePortFilter(allowed, blocked); err != nil {
+			log.Errorf("failed to reload the configuration, keeping the current one: %v", err)
+
+			return
+		}
+	}
+
+	// The subsystems are not restarted with invalid flags.
+	if err := checkReloadedFlags(changed); err != nil {
+		log.Errorf("failed to reload the configuration, keeping the current one: %v", err)
+
+		return
+	}
+
+	// The new log levels are applied right away, unless they are invalid.
+	if err := r.applyLogLevels(changed); err != nil {
+		log.Errorf("failed to reload the configuration, keeping the current one: %v", err)
+
+		return
+	}
+
+	names := make([]string, 0, len(changed))
+	for name := range changed {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	live := slices.Concat(liveFlags, r.loops.flags(), r.subsystems.flags())
+
+	var applied, pending, restartedSubsystems []string
+
+	// The flags are only set once the loops and the subsystems that read them are stopped.
+	restartedLoops := r.loops.restart(changed, func() {
+		restartedSubsystems = r.subsystems.restart(changed, func() {
+			for _, name := range names {
+				if !slices.Contains(live, name) {
+					pending = append(pending, "-"+name)
+
+					continue
+				}
+
+				if err := flag.Set(name, changed[name]); err != nil {
+					log.Errorf("failed to apply the reloaded -%s flag: %v", name, err)
+
+					continue
+				}
+
+				applied = append(applied, "-"+name+"="+changed[name])
+			}
+		})
+	})
+
+	restarted := slices.Concat(restartedSubsystems, restartedLoops)
+
+	if filter != nil {
+		if err := r.filterTracker.SetFilter(filter); err != nil {
+			log.Errorf("failed to apply the reloaded port filter: %v", err)
+		}
+	}
+
+	log.Infof("reloaded the configuration, applied: %v, restarted: %v", applied, restarted)
+
+	if len(pending) != 0 {
+		log.Warnf("the changes of %v only apply once the agent is restarted", pending)
+	}
+}
+
+// checkReloadedFlags checks the reloaded values of the flags that the
+// subsystems read when they are restarted, like checkAddrFlags does at startup.
+func checkReloadedFlags(changed map[string]string) error {
+	if addr, ok := changed["k8sServiceListenerAddr"]; ok {
+		if err := checkK8sServiceListenerAddr(addr); err != nil {
+			return err
+		}
+	}
+
+	if value, ok := changed["k8sWorkers"]; ok {
+		if workers, err := strconv.Atoi(value); err != nil || workers <= 0 {
+			return fmt.Errorf("%w: -k8sWorkers must be positive", exitcode.ErrConfig)
+		}
+	}
+
+	// The admin API is only served when -adminSocket is set at startup.
+	if value, ok := changed["adminSocket"]; ok {
+		if value == "" {
+			return fmt.Errorf("%w: -adminSocket can not be unset by a reload", exitcode.ErrConfig)
+		}
+
+		if _, err := config.SocketPath(value); err != nil {
+			return fmt.Errorf("invalid -adminSocket: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// applyLogLevels applies the log levels of the flags with their changes, if any, see applyLogLevels.
+func (r *reloader) applyLogLevels(changed map[string]string) error {
+	debugValue, levelName, overridesSpec := *debug, *logLevel, *logLevelOverride
+
+	_, debugChanged := changed["debug"]
+	_, levelChanged := changed["logLevel"]
+	_, overridesChanged := changed["logLevelOverride"]
+
+	if !debugChanged && !levelChanged && !overridesChanged {
+		return nil
+	}
+
+	if debugChanged {
+		var err error
+		if debugValue, err = strconv.ParseBool(changed["debug"]); err != nil {
+			return fmt.Errorf("invalid -debug: %w", err)
+		}
+	}
+
+	if levelChanged {
+		levelName = changed["logLevel"]
+	}
+
+	if overridesChanged {
+		overridesSpec = changed["logLevelOverride"]
+	}
+
+	return applyLogLevels(r.logger, debugValue, levelName, overridesSpec)
+}
+
+// config returns the effective configuration for the admin API.
+func (r *reloader) config() map[string]string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return config.Effective(flag.CommandLine)
+}
@@ -0,0 +1,93 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/docker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/exitcode"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/kube"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/recording"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// replayResult is the output of -replayEvents.
+type replayResult struct {
+	// Entries are the port mappings that the tracker holds once the events are replayed.
+	Entries []tracker.Entry `json:"entries"`
+	// Listeners are the listeners that the tracker would hold, e.g. for the Kubernetes services
+	// of the non-admin installations.
+	Listeners []string `json:"listeners"`
+}
+
+// runReplay replays the events of -replayEvents through the handlers of their
+// subsystems, which are wrapped by the trackers of the flags like the agent
+// wraps them, and prints the port mappings that are tracked afterwards as
+// JSON. The port mappings are only sent to the noop forwarder, and neither
+// the listeners nor the iptables rules are applied.
+func runReplay(ctx context.Context, output io.Writer) int {
+	input, err := os.Open(*replayEvents)
+	if err != nil {
+		return fail(fmt.Errorf("failed to open -replayEvents: %w", err))
+	}
+	defer input.Close()
+
+	vtunnelTracker := tracker.NewVTunnelTracker(forwarder.NewNoopForwarder(), nil)
+	vtunnelTracker.EnableDryRun()
+
+	portTracker, err := wrapTracker(vtunnelTracker)
+	if err != nil {
+		return fail(err)
+	}
+
+	k8sServiceListenerIP := net.ParseIP(*k8sServiceListenerAddr)
+	if k8sServiceListenerIP == nil {
+		return fail(fmt.Errorf("%w: invalid Kubernetes service listener IP address %q", exitcode.ErrConfig, *k8sServiceListenerAddr))
+	}
+
+	eventMonitor, err := docker.NewEventMonitor(portTracker)
+	if err != nil {
+		return fail(fmt.Errorf("error initializing docker event monitor: %w", err))
+	}
+
+	eventMonitor.EnableDryRun()
+
+	err = recording.Replay(ctx, input, *replaySpeed, map[string]recording.Handler{
+		tracker.SourceDocker:     eventMonitor.Replay,
+		tracker.SourceKubernetes: kube.ReplayHandler(k8sServiceListenerIP, listenerOnlyMode(), portTracker),
+	})
+	if err != nil {
+		return fail(fmt.Errorf("failed to replay -replayEvents: %w", err))
+	}
+
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+
+	result := replayResult{Entries: portTracker.List(), Listeners: vtunnelTracker.Listeners()}
+	if err := encoder.Encode(result); err != nil {
+		log.Errorf("failed to write the port mappings: %v", err)
+
+		return exitcode.Failure
+	}
+
+	return 0
+}
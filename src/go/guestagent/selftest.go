@@ -0,0 +1,235 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/capabilities"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/containerd"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/docker"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/exitcode"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/iptables"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/kube"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/selftest"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+const (
+	// selftestPort is the high port that the self-test forwards to the host
+	// and withdraws, to check the forwarder.
+	selftestPort = nat.Port("64999/tcp")
+	// selftestID and selftestSource are what the test port mapping is added with.
+	selftestID     = "selftest"
+	selftestSource = "selftest"
+	// selftestEventWait is how long the subscription to the Docker events is held.
+	selftestEventWait = time.Second
+)
+
+// runSelftest runs the checks of the enabled subsystems and writes their
+// report to the output, the exit code is a failure if any of them failed.
+func runSelftest(ctx context.Context, output io.Writer) int {
+	report := selftest.Run(ctx, selftestChecks(), selftestTimeout)
+
+	if err := report.Write(output); err != nil {
+		log.Errorf("failed to write the self-test report: %v", err)
+
+		return exitcode.Failure
+	}
+
+	if len(report.Failed()) != 0 {
+		return exitcode.Failure
+	}
+
+	return 0
+}
+
+// selftestChecks returns the checks of the pipeline in the order that the
+// port mappings go through it, the ones of the disabled subsystems are skipped.
+func selftestChecks() []selftest.Check {
+	return []selftest.Check{
+		{
+			Name: "capabilities",
+			Hint: "run the agent as root, or grant it the capabilities of its enabled subsystems, " +
+				"e.g. with AmbientCapabilities= of its systemd service",
+			Run: func(context.Context) (string, error) {
+				return "", capabilities.Check(capabilities.Effective, requiredCapabilities())
+			},
+		},
+		{
+			Name: "network interface",
+			Hint: "check that -interface names an interface that is up and has an address, or leave it empty to detect it",
+			Run: func(context.Context) (string, error) {
+				interfaces, err := interfaceSelector(interfaceNames(*netInterface)).Select()
+				if err != nil {
+					return "", err
+				}
+
+				return formatInterfaces(interfaces), nil
+			},
+		},
+		{
+			Name: "network namespace",
+			Skip: skipUnset("netns", *netNamespace),
+			Hint: "create the namespace of -netns, e.g. with ip netns add, and check that the agent has CAP_SYS_ADMIN to enter it",
+			Run: func(context.Context) (string, error) {
+				namespace := scanNamespace()
+				if err := namespace.Do(func() error { return nil }); err != nil {
+					return "", err
+				}
+
+				return "entered " + namespace.String(), nil
+			},
+		},
+		{
+			Name: "iptables",
+			Skip: skipDisabled("iptables", *enableIptables),
+			Hint: "check that the iptables binary is in PATH, and that the agent has CAP_NET_ADMIN to read the rules",
+			Run: func(ctx context.Context) (string, error) {
+				ports, err := iptables.ListPorts(ctx, scanNamespace(), forwardedChains())
+				if err != nil {
+					return "", err
+				}
+
+				return fmt.Sprintf("%d forwarded ports", len(ports)), nil
+			},
+		},
+		{
+			Name: "docker API",
+			Skip: skipDisabled("docker", *enableDocker),
+			Hint: "check that dockerd is running, and that DOCKER_HOST points to its socket if it is not the default one",
+			Run: func(ctx context.Context) (string, error) {
+				return "", docker.Ping(ctx)
+			},
+		},
+		{
+			Name:     "docker events",
+			Skip:     skipDisabled("docker", *enableDocker),
+			Requires: "docker API",
+			Hint:     "check that the Docker API allows the events of the containers to be subscribed to",
+			Run: func(ctx context.Context) (string, error) {
+				return "", docker.CheckEvents(ctx, selftestEventWait)
+			},
+		},
+		{
+			Name: "containerd API",
+			Skip: skipDisabled("containerd", *enableContainerd),
+			Hint: "check that containerd is running, and that -containerdSock is its socket",
+			Run: func(ctx context.Context) (string, error) {
+				return *containerdSock, containerd.CheckServing(ctx, *containerdSock)
+			},
+		},
+		{
+			Name: "kubeconfig",
+			Skip: skipDisabled("kubernetes", *enableKubernetes),
+			Hint: "check that -kubeconfig is the kubeconfig of the cluster, e.g. the one that k3s writes",
+			Run: func(context.Context) (string, error) {
+				return kube.CheckConfig(*configPath)
+			},
+		},
+		{
+			Name:     "kubernetes API",
+			Skip:     skipDisabled("kubernetes", *enableKubernetes),
+			Requires: "kubeconfig",
+			Hint:     "check that the API server of the kubeconfig is running, and that the kubeconfig may list the services",
+			Run: func(ctx context.Context) (string, error) {
+				return kube.CheckAPI(ctx, *configPath)
+			},
+		},
+		{
+			Name: "forwarder",
+			Hint: "check that the host side is running, e.g. the privileged service or the wsl-proxy, " +
+				"and that -forwarder and -vtunnelAddr are the ones that it listens on",
+			Run: func(ctx context.Context) (string, error) {
+				return checkForwarder(ctx, selectForwarder(ctx).Kind)
+			},
+		},
+	}
+}
+
+// skipDisabled returns why the check of the subsystem with the given flag is
+// skipped, if it is disabled.
+func skipDisabled(name string, enabled bool) string {
+	if enabled {
+		return ""
+	}
+
+	return fmt.Sprintf("disabled with -%s=false", name)
+}
+
+// skipUnset returns why the check of an optional flag is skipped, if it is.
+func skipUnset(name, value string) string {
+	if value != "" {
+		return ""
+	}
+
+	return fmt.Sprintf("-%s is not set", name)
+}
+
+// checkForwarder forwards the test port to the host with the forwarder of the
+// given kind, and withdraws it, like the agent does with the other ports.
+func checkForwarder(ctx context.Context, kind string) (string, error) {
+	if err := checkAddrFlags(kind); err != nil {
+		return "", err
+	}
+
+	// The port mapping is sent once, neither retried nor queued when the peer
+	// is not reachable, and the queue of the agent is left to it.
+	options := forwarderOptions
+	options.VTunnel.RetryTimeout = 0
+	options.VTunnel.QueueSize = 0
+	options.VTunnel.QueueFile = ""
+
+	metricsForwarder, err := forwarder.NewFromConfig(kind, *vtunnelAddr, options)
+	if err != nil {
+		return "", err
+	}
+
+	if closer, ok := metricsForwarder.Unwrap().(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	var portTracker tracker.Tracker
+
+	if kind == forwarder.KindAPI {
+		apiTracker := tracker.NewAPITracker(metricsForwarder, *apiBaseURL, *adminInstall)
+		apiTracker.SetTimeout(*apiTimeout)
+		portTracker = apiTracker
+	} else {
+		interfaces, err := interfaceSelector(interfaceNames(*netInterface)).Select()
+		if err != nil {
+			return "", err
+		}
+
+		portTracker = tracker.NewVTunnelTracker(metricsForwarder, netif.ConnectAddrs(interfaces))
+	}
+
+	portMap := nat.PortMap{selftestPort: []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: selftestPort.Port()}}}
+	if err := portTracker.Add(ctx, selftestID, portMap, tracker.WithSource(selftestSource)); err != nil {
+		return kind, fmt.Errorf("failed to forward the test port %s: %w", selftestPort, err)
+	}
+
+	if err := portTracker.Remove(ctx, selftestID); err != nil {
+		return kind, fmt.Errorf("failed to withdraw the test port %s: %w", selftestPort, err)
+	}
+
+	return fmt.Sprintf("%s, forwarded and withdrew the test port %s", kind, selftestPort), nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+)
+
+const (
+	httpReadHeaderTimeout = 5 * time.Second
+	httpShutdownTimeout   = 5 * time.Second
+)
+
+// httpServer is a server of some of the HTTP endpoints of the agent, see httpEndpoints.
+type httpServer struct {
+	addr  string
+	names []string
+	mux   *http.ServeMux
+}
+
+// httpEndpoints are the HTTP endpoints of the agent, e.g. the metrics. The
+// endpoints that are given the same address share its server.
+type httpEndpoints struct {
+	servers []*httpServer
+}
+
+// handle registers the endpoint of the given name on the mux of the address.
+func (e *httpEndpoints) handle(addr, name string, register func(mux *http.ServeMux)) {
+	for _, server := range e.servers {
+		if server.addr == addr {
+			server.names = append(server.names, name)
+			register(server.mux)
+
+			return
+		}
+	}
+
+	server := &httpServer{addr: addr, names: []string{name}, mux: http.NewServeMux()}
+	register(server.mux)
+	e.servers = append(e.servers, server)
+}
+
+// serve serves the endpoints under the supervisor until the context is
+// cancelled, it returns the names of their subsystems.
+func (e *httpEndpoints) serve(ctx context.Context, subsystems *supervisor.Supervisor) []string {
+	names := make([]string, 0, len(e.servers))
+
+	for _, server := range e.servers {
+		name := strings.Join(server.names, " and ")
+		subsystems.Go(ctx, name, func(ctx context.Context) error {
+			return serveHTTP(ctx, name, server.addr, server.mux)
+		})
+
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// registerPprof registers the handlers of net/http/pprof.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// checkLoopback returns an error unless the address only binds
+// the loopback interface, e.g. 127.0.0.1:6060.
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("%s is not a loopback address", addr)
+	}
+
+	return nil
+}
+
+// serveHTTP serves the handler on the TCP address until the context is
+// cancelled, the requests in flight are answered before it returns.
+func serveHTTP(ctx context.Context, name, addr string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to serve the %s on %s: %w", name, addr, err)
+	}
+
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: httpReadHeaderTimeout,
+	}
+
+	shutdown := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(shutdown)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("failed to shut down the %s: %v", name, err)
+		}
+	})
+
+	log.Infof("serving the %s on %s", name, listener.Addr())
+
+	err = server.Serve(listener)
+
+	if !stop() {
+		<-shutdown
+	}
+
+	if !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("failed to serve the %s on %s: %w", name, addr, err)
+	}
+
+	return nil
+}
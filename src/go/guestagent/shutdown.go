@@ -0,0 +1,173 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/exitcode"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/shutdown"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracker"
+)
+
+// stopAgent shuts the agent down in phases once the context is cancelled,
+// see supervisor.Shutdown, from the time that it started to; it reports
+// the shutdown, and returns the exit code of the agent.
+func stopAgent(
+	ctx context.Context,
+	started time.Time,
+	f *forwarding,
+	subsystems *supervisor.Supervisor,
+	periodic *loops,
+	sources, surfaces []string,
+) int {
+	// The sources stop on their own when they fail permanently.
+	cause := context.Cause(ctx).Error()
+	if errors.Is(context.Cause(ctx), errSubsystemsStopped) {
+		if err := subsystems.Wait(sources...); err != nil {
+			cause = err.Error()
+		}
+	}
+
+	shutdownRecorder := shutdown.NewRecorder(cause, started, time.Now)
+
+	withdrawals := f.portTracker.Subscribe(shutdown.BufferSize, tracker.WithOutcomes())
+	withdrawalsDone := make(chan struct{})
+
+	go func() {
+		defer close(withdrawalsDone)
+
+		shutdownRecorder.Run(withdrawals)
+	}()
+
+	listeners := f.listenerTracker.Listeners()
+	sourcesStopped := make(chan struct{})
+
+	// The sources are stopped first, so that nothing changes the port mappings
+	// once they are withdrawn, and the listeners and the forwarder are only
+	// closed then; the failures are only logged since they should never
+	// prevent the exit, and the report is given the rest of the timeout.
+	phases, shutdownErr := supervisor.Shutdown(started.Add(shutdownTimeout-shutdownReportTimeout),
+		supervisor.Phase{Name: "sources", Timeout: sourcesStopTimeout, Stop: func(ctx context.Context) error {
+			if err := subsystems.Stop(ctx, sources...); err != nil {
+				return err
+			}
+
+			close(sourcesStopped)
+			periodic.wait()
+
+			return nil
+		}},
+		// Withdraw all the forwarded ports from the host.
+		supervisor.Phase{Name: "withdraw", Timeout: withdrawTimeout, Stop: f.coordinator.Shutdown},
+		supervisor.Phase{Name: "listeners", Timeout: listenersCloseTimeout, Stop: func(ctx context.Context) error {
+			f.coordinator.CloseListeners(ctx)
+
+			return f.listenerTracker.CloseAll(ctx)
+		}},
+		supervisor.Phase{Name: "forwarder", Timeout: forwarderCloseTimeout, Stop: func(context.Context) error {
+			return closeForwarder(f.metricsForwarder)
+		}},
+		supervisor.Phase{Name: "surfaces", Timeout: surfacesStopTimeout, Stop: func(ctx context.Context) error {
+			return subsystems.Stop(ctx, surfaces...)
+		}},
+	)
+
+	exitCode := 0
+
+	// The permanent failures of the sources are only known once they stopped.
+	select {
+	case <-sourcesStopped:
+		if err := subsystems.Wait(sources...); err != nil {
+			exitCode = fail(err)
+		}
+	default:
+	}
+
+	if shutdownTimedOut(shutdownErr) && exitCode == 0 {
+		exitCode = exitcode.ShutdownTimeout
+	}
+
+	withdrawals.Unsubscribe()
+	<-withdrawalsDone
+	shutdownRecorder.Phases(phases)
+	shutdownRecorder.Subsystems(subsystems.Status())
+	shutdownRecorder.Listeners(listeners, f.listenerTracker.Listeners())
+
+	report := shutdownRecorder.Report(shutdownErr)
+	reportShutdown(&report, *diagnosticsDir, shutdownReportTimeout)
+
+	return exitCode
+}
+
+// closeForwarder saves the removals that the forwarder could not deliver, for
+// the next agent to send them, and closes its connection to the host.
+func closeForwarder(metricsForwarder *forwarder.MetricsForwarder) error {
+	var errs []error
+
+	if queue, ok := metricsForwarder.Unwrap().(forwarder.QueuePersister); ok && forwarderOptions.VTunnel.QueueFile != "" {
+		if err := queue.SaveQueue(forwarderOptions.VTunnel.QueueFile); err != nil {
+			errs = append(errs, fmt.Errorf("failed to save the undelivered port mappings: %w", err))
+		}
+	}
+
+	if closer, ok := metricsForwarder.Unwrap().(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close the forwarder: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// shutdownTimedOut returns whether a phase of the shutdown ran out of its time.
+func shutdownTimedOut(err error) bool {
+	return errors.Is(err, supervisor.ErrPhaseTimeout) ||
+		errors.Is(err, supervisor.ErrStopTimeout) ||
+		errors.Is(err, tracker.ErrShutdownTimeout)
+}
+
+// reportShutdown logs the report, and writes it to the directory unless it
+// is empty; it gives up on writing it after the timeout, so that a stuck
+// file system can not block the exit.
+func reportShutdown(report *shutdown.Report, dir string, timeout time.Duration) {
+	report.Log(log.Current)
+
+	if dir == "" {
+		return
+	}
+
+	written := make(chan error, 1)
+
+	go func() {
+		_, err := report.Write(dir)
+		written <- err
+	}()
+
+	select {
+	case err := <-written:
+		if err != nil {
+			log.Errorf("failed to write the shutdown report: %v", err)
+		}
+	case <-time.After(timeout):
+		log.Errorf("failed to write the shutdown report within %s", timeout)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/forwarder"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/netif"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/startup"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/tracing"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/version"
+)
+
+// networkSummary is the network that the port mappings are reached at, see startupSummary.
+type networkSummary struct {
+	interfaces     []netif.Interface
+	mirrored       bool
+	mirroredReason string
+	// lanOnly is set when the VM is only reached at addresses on the LAN, see -lanPorts.
+	lanOnly bool
+	// families are the address families of the connect addresses, see types.ConnectFamilies.
+	families []string
+	// profile is the forwarding profile, it is empty when none was selected.
+	profile       string
+	profileReason string
+}
+
+// startupSummary returns the summary of the subsystems and the parameters
+// that the agent starts with; network is nil for the forwarders that do
+// not send the addresses of the interfaces, e.g. the API forwarder.
+func startupSummary(origins config.Origins, selection forwarder.Selection, network *networkSummary) *startup.Summary {
+	values := config.Effective(flag.CommandLine)
+	origin := func(name string) string {
+		return string(origins.Of(name))
+	}
+	parameter := func(summary *startup.Summary, name string) {
+		summary.AddParameter(name, values[name], origin(name))
+	}
+
+	summary := &startup.Summary{Version: version.Get()}
+
+	parameter(summary, "platform")
+
+	summary.AddSubsystem("iptables", *enableIptables, origin("iptables"))
+	summary.AddSubsystem("docker", *enableDocker, origin("docker"))
+	summary.AddSubsystem("containerd", *enableContainerd, origin("containerd"))
+	summary.AddSubsystem("kubernetes", *enableKubernetes, origin("kubernetes"))
+	summary.AddSubsystem("privilegedService", *enablePrivilegedService, origin("privilegedService"))
+	summary.AddSubsystem("adminAPI", *adminSocket != "", origin("adminSocket"))
+	summary.AddSubsystem("metrics", *metricsAddr != "", origin("metricsAddr"))
+	summary.AddSubsystem("pprof", *pprofAddr != "", origin("pprofAddr"))
+
+	// The tracing is only configured with the environment variables of OpenTelemetry, see tracing.FromEnv.
+	tracingOrigin := config.OriginDefault
+	if tracing.Enabled() {
+		tracingOrigin = config.OriginEnv
+	}
+
+	summary.AddSubsystem("tracing", tracing.Enabled(), string(tracingOrigin))
+
+	if len(selection.Probes) != 0 {
+		summary.AddParameter("forwarder", selection.Kind+", probed "+formatProbes(selection.Probes), startup.OriginDetected)
+	} else {
+		summary.AddParameter("forwarder", selection.Kind, string(forwarderOrigin(origins, selection)))
+	}
+
+	switch selection.Kind {
+	case forwarder.KindAPI:
+		parameter(summary, "apiBaseURL")
+	case forwarder.KindRecord:
+		parameter(summary, "recordFile")
+	case forwarder.KindNoop:
+	default:
+		parameter(summary, "vtunnelAddr")
+	}
+
+	if network != nil {
+		addNetwork(summary, network, origin)
+	}
+
+	if *enableIptables {
+		parameter(summary, "iptablesMaxInterval")
+	}
+
+	if *enableContainerd {
+		parameter(summary, "containerdSock")
+	}
+
+	if *enableDocker {
+		// The Docker client connects to DOCKER_HOST, if it is set.
+		if host := os.Getenv("DOCKER_HOST"); host != "" {
+			summary.AddParameter("dockerHost", host, string(config.OriginEnv))
+		} else {
+			summary.AddParameter("dockerHost", "unix://"+dockerSocketFile, string(config.OriginDefault))
+		}
+
+		parameter(summary, "dockerWaitTimeout")
+	}
+
+	if *enableKubernetes {
+		parameter(summary, "kubeconfig")
+		parameter(summary, "k8sServiceListenerAddr")
+		parameter(summary, "k8sWorkers")
+	}
+
+	for _, name := range []string{
+		"resyncInterval", "batchWindow", "startupBatchTimeout", "heartbeatInterval", "addrWatchInterval", "resumeCheckInterval",
+		"portTTL", "driftInterval", "summaryInterval",
+		"logLevel", "logFile", "auditLog", "pidFile", "readyFile", "diagnosticsDir", config.FlagName,
+	} {
+		parameter(summary, name)
+	}
+
+	for _, name := range []string{"adminSocket", "metricsAddr", "pprofAddr", "netns"} {
+		if values[name] != "" {
+			parameter(summary, name)
+		}
+	}
+
+	return summary
+}
+
+// forwarderOrigin returns where the selected forwarder comes from, the forwarder
+// is selected by -dryRun, -forwarder, the probes of -forwarder=auto, or
+// -privilegedService, see selectForwarder.
+func forwarderOrigin(origins config.Origins, selection forwarder.Selection) config.Origin {
+	switch {
+	case *dryRun:
+		return origins.Of("dryRun")
+	case *forwarderType != forwarder.KindAuto:
+		return origins.Of("forwarder")
+	case len(selection.Probes) != 0:
+		return startup.OriginDetected
+	default:
+		return origins.Of("privilegedService")
+	}
+}
+
+// addNetwork adds the interfaces that the port mappings are reached at, their
+// address families, the -lanPorts of the addresses on the LAN, whether the
+// ports are only reported because WSL mirrors them, and the forwarding profile
+// of the ports bound to the loopback.
+func addNetwork(summary *startup.Summary, network *networkSummary, origin func(name string) string) {
+	interfaceOrigin := origin("interface")
+	if *netInterface == "" {
+		interfaceOrigin = startup.OriginDetected
+	}
+
+	summary.AddParameter("interface", formatInterfaces(network.interfaces), interfaceOrigin)
+	summary.AddParameter("families", strings.Join(network.families, ","), startup.OriginDetected)
+
+	if network.lanOnly {
+		summary.AddParameter("lanPorts", *lanPorts, origin("lanPorts"))
+	}
+
+	switch {
+	case *forwardMirrored:
+		summary.AddParameter("forwardMirrored", strconv.FormatBool(true), origin("forwardMirrored"))
+	case network.mirroredReason != "":
+		summary.AddParameter("mirrored", strconv.FormatBool(network.mirrored)+", "+network.mirroredReason, startup.OriginDetected)
+	}
+
+	switch {
+	case *forwardingProfile != "":
+		summary.AddParameter("forwardingProfile", network.profile, origin("forwardingProfile"))
+	case network.profile != "":
+		summary.AddParameter("forwardingProfile", network.profile+", "+network.profileReason, startup.OriginDetected)
+	}
+}
+
+// formatProbes returns the outcome of each probe of -forwarder=auto,
+// e.g. "hvsock=dial vsock: no such device vtunnel=answered".
+func formatProbes(probes []forwarder.ProbeResult) string {
+	formatted := make([]string, 0, len(probes))
+
+	for _, probe := range probes {
+		outcome := "answered"
+		if probe.Error != "" {
+			outcome = probe.Error
+		}
+
+		formatted = append(formatted, probe.Kind+"="+outcome)
+	}
+
+	return strings.Join(formatted, " ")
+}
+
+// formatInterfaces returns the names of the interfaces with their addresses, e.g. "eth0=172.20.1.2,fd00::2".
+func formatInterfaces(interfaces []netif.Interface) string {
+	formatted := make([]string, 0, len(interfaces))
+
+	for _, iface := range interfaces {
+		addrs := make([]string, 0, len(iface.Addrs))
+		for _, addr := range iface.Addrs {
+			addrs = append(addrs, addr.IP.String())
+		}
+
+		formatted = append(formatted, iface.Name+"="+strings.Join(addrs, ","))
+	}
+
+	return strings.Join(formatted, " ")
+}
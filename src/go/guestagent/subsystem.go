@@ -0,0 +1,102 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/supervisor"
+)
+
+// subsystem is a subsystem of the agent that the supervisor runs under its
+// name, which the status, the metrics and the shutdown phases refer to it by,
+// see supervisor.Supervisor.Go.
+type subsystem struct {
+	name string
+	// flags are the flags that run reads when it starts, the subsystem is
+	// restarted when one of them is reloaded, see supervised.restart.
+	flags []string
+	run   func(ctx context.Context) error
+}
+
+// supervised are the subsystems that the supervisor runs, which are
+// restarted when the flags that they depend on are reloaded, like loops.
+type supervised struct {
+	supervisor *supervisor.Supervisor
+	mutex      sync.Mutex
+	subsystems []subsystem
+}
+
+func newSupervised(subsystems *supervisor.Supervisor) *supervised {
+	return &supervised{supervisor: subsystems}
+}
+
+// start runs the subsystem under the supervisor until the context is
+// cancelled, see supervisor.Supervisor.Go.
+func (s *supervised) start(ctx context.Context, sub subsystem) {
+	s.mutex.Lock()
+	s.subsystems = append(s.subsystems, sub)
+	s.mutex.Unlock()
+
+	s.supervisor.Go(ctx, sub.name, sub.run)
+}
+
+// restart stops the subsystems that depend on the changed flags, calls apply
+// once they are stopped so that it can set the flags, and starts them again,
+// see supervisor.Supervisor.Restart. It returns the names of the subsystems
+// that were restarted.
+func (s *supervised) restart(changed map[string]string, apply func()) []string {
+	s.mutex.Lock()
+
+	var names []string
+
+	for _, sub := range s.subsystems {
+		if slices.ContainsFunc(sub.flags, func(name string) bool { _, ok := changed[name]; return ok }) {
+			names = append(names, sub.name)
+		}
+	}
+
+	s.mutex.Unlock()
+
+	return s.supervisor.Restart(names, apply)
+}
+
+// flags returns the flags that the subsystems depend on.
+func (s *supervised) flags() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var flags []string
+	for _, sub := range s.subsystems {
+		flags = append(flags, sub.flags...)
+	}
+
+	return flags
+}
+
+// sourceSubsystems returns the names of the subsystems that are not surfaces,
+// in the order they were started.
+func sourceSubsystems(statuses []supervisor.Status, surfaces []string) []string {
+	sources := make([]string, 0, len(statuses))
+
+	for _, status := range statuses {
+		if !slices.Contains(surfaces, status.Name) {
+			sources = append(sources, status.Name)
+		}
+	}
+
+	return sources
+}
@@ -0,0 +1,58 @@
+/*
+Copyright © 2024 SUSE LLC
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/config"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/exitcode"
+	"github.com/rancher-sandbox/rancher-desktop/src/go/guestagent/pkg/watch"
+)
+
+// runWatch prints the port mappings of the agent that serves the admin API
+// on -adminSocket, and then their changes as they happen, until the context
+// is cancelled. The rows of the table are colored when the output is a
+// terminal, unless NO_COLOR is set.
+func runWatch(ctx context.Context, output *os.File) int {
+	if *adminSocket == "" {
+		return fail(fmt.Errorf("%w: -watchPorts requires -adminSocket", exitcode.ErrConfig))
+	}
+
+	path, err := config.SocketPath(*adminSocket)
+	if err != nil {
+		return fail(fmt.Errorf("invalid -adminSocket: %w", err))
+	}
+
+	_, noColor := os.LookupEnv("NO_COLOR")
+	watcher := watch.New(watch.UnixClient(path), watch.UnixBaseURL, output, watch.Options{
+		JSON:  *watchJSON,
+		Color: !*watchJSON && !noColor && isTerminal(output),
+	})
+
+	if err := watcher.Run(ctx); err != nil {
+		return fail(err)
+	}
+
+	return 0
+}
+
+// isTerminal returns true if the file is a terminal.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
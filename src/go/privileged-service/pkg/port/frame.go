@@ -0,0 +1,84 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package port
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+const (
+	// frameVersion is the first byte of the frames that the Guest Agent
+	// sends, older agents send raw JSON instead, which starts with '{'.
+	frameVersion byte = 1
+	// maxFrameSize is the largest payload that is read from a frame.
+	maxFrameSize = 1 << 20
+)
+
+// readPayload reads a port event, either a frame or raw JSON,
+// and returns whether it was framed.
+func readPayload(reader *bufio.Reader, v interface{}) (bool, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return false, err
+	}
+
+	if first[0] != frameVersion {
+		return false, json.NewDecoder(reader).Decode(v)
+	}
+
+	var header [5]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return true, err
+	}
+
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > maxFrameSize {
+		return true, fmt.Errorf("frame payload of %d bytes exceeds %d bytes", size, maxFrameSize)
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return true, fmt.Errorf("truncated frame payload: %w", err)
+	}
+
+	return true, json.Unmarshal(payload, v)
+}
+
+// writePayload writes the response in the format of the port event.
+func writePayload(w io.Writer, v interface{}, framed bool) error {
+	if !framed {
+		return json.NewEncoder(w).Encode(v)
+	}
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 5, 5+len(payload))
+	frame[0] = frameVersion
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+
+	// Write returns an error on short writes.
+	_, err = w.Write(append(frame, payload...))
+
+	return err
+}
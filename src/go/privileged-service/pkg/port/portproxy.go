@@ -42,15 +42,19 @@ type portProxy struct {
 type proxy struct {
 	portMappings map[string]portProxy
 	mutex        sync.Mutex
+	// execCommand runs netsh, it is replaced in the tests.
+	execCommand func(cmd string, args []string) error
 }
 
 func newProxy() *proxy {
 	return &proxy{
 		portMappings: make(map[string]portProxy),
+		execCommand:  command.Exec,
 	}
 }
 
-func (p *proxy) exec(portMapping types.PortMapping) error {
+// exec applies the port mapping, a replace makes it the only one, see replace.
+func (p *proxy) exec(portMapping types.PortMapping, replace bool) error {
 	port := portProxy{
 		PortMap:      portMapping.Ports,
 		ConnectAddrs: portMapping.ConnectAddrs,
@@ -58,6 +62,9 @@ func (p *proxy) exec(portMapping types.PortMapping) error {
 	if portMapping.Remove {
 		return p.delete(port)
 	}
+	if replace {
+		return p.replace(port)
+	}
 	return p.add(port)
 }
 
@@ -72,7 +79,7 @@ func (p *proxy) add(port portProxy) error {
 			if err != nil {
 				return err
 			}
-			err = command.Exec(netsh, args)
+			err = p.execCommand(netsh, args)
 			if err != nil {
 				return err
 			}
@@ -96,7 +103,7 @@ func (p *proxy) add(port portProxy) error {
 }
 
 func (p *proxy) delete(port portProxy) error {
-	if err := execNetshDelete(port); err != nil {
+	if err := p.execNetshDelete(port); err != nil {
 		return err
 	}
 
@@ -117,12 +124,59 @@ func (p *proxy) delete(port portProxy) error {
 	return nil
 }
 
+// replace makes the snapshot of the Guest Agent the only port mappings: the
+// port proxies that it does not list are deleted, and its own are added, so
+// that the host recovers from the removals that it missed.
+func (p *proxy) replace(port portProxy) error {
+	listed := make(map[string]bool)
+	for _, v := range port.PortMap {
+		for _, addr := range v {
+			listed[net.JoinHostPort(addr.HostIP, addr.HostPort)] = true
+		}
+	}
+
+	p.mutex.Lock()
+	stale := p.portMappings
+	p.portMappings = make(map[string]portProxy)
+	p.mutex.Unlock()
+
+	errs := make([]error, 0)
+	for _, proxy := range stale {
+		for _, v := range proxy.PortMap {
+			for _, addr := range v {
+				listen := net.JoinHostPort(addr.HostIP, addr.HostPort)
+				if listed[listen] {
+					continue
+				}
+				// The same listener is only deleted once, even if several port mappings had it.
+				listed[listen] = true
+				args, err := portProxyDeleteArgs(addr.HostPort, addr.HostIP)
+				if err == nil {
+					err = p.execCommand(netsh, args)
+				}
+				if err != nil {
+					errs = append(errs, fmt.Errorf("deleting portproxy: %s failed: %w", listen, err))
+				}
+			}
+		}
+	}
+	if len(port.PortMap) > 0 {
+		if err := p.add(port); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %+v", ErrPortProxy, errs)
+}
+
 func (p *proxy) removeAll() error {
 	errs := make([]error, 0)
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 	for _, proxy := range p.portMappings {
-		if err := execNetshDelete(proxy); err != nil {
+		if err := p.execNetshDelete(proxy); err != nil {
 			errs = append(errs, fmt.Errorf("deleting portproxy: %+v failed: %w", proxy, err))
 		}
 	}
@@ -132,14 +186,14 @@ func (p *proxy) removeAll() error {
 	return fmt.Errorf("%w: %+v", ErrPortProxy, errs)
 }
 
-func execNetshDelete(port portProxy) error {
+func (p *proxy) execNetshDelete(port portProxy) error {
 	for _, v := range port.PortMap {
 		for _, addr := range v {
 			args, err := portProxyDeleteArgs(addr.HostPort, addr.HostIP)
 			if err != nil {
 				return err
 			}
-			err = command.Exec(netsh, args)
+			err = p.execCommand(netsh, args)
 			if err != nil {
 				return err
 			}
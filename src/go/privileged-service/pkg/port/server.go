@@ -17,9 +17,11 @@ limitations under the License.
 package port
 
 import (
-	"encoding/json"
+	"bufio"
 	"fmt"
 	"net"
+	"os"
+	"time"
 
 	"github.com/Microsoft/go-winio"
 	"golang.org/x/sys/windows"
@@ -31,6 +33,9 @@ import (
 const (
 	npipeEndpoint = "npipe:////./pipe/rancher_desktop/privileged_service"
 	protocol      = "npipe://"
+	// protocolVersion is the version of the Guest Agent's protocol
+	// that the server speaks, see Hello in its types package.
+	protocolVersion = 1
 )
 
 // Server is a port server listening for port events from
@@ -41,6 +46,30 @@ type Server struct {
 	quit        chan interface{}
 	listener    net.Listener
 	stopped     bool
+	// instanceID is sent back to the Guest Agent after each port event,
+	// a new ID tells the agent that the port mappings were lost.
+	instanceID string
+}
+
+// peerStatus is the response to a port event, see PeerStatus in the
+// Guest Agent's types package.
+type peerStatus struct {
+	InstanceID      string `json:"instanceID"`
+	ProtocolVersion int    `json:"protocolVersion,omitempty"`
+}
+
+// portEvent is a port mapping, or a hello that the Guest Agent
+// sends to negotiate the protocol when it connects.
+type portEvent struct {
+	types.PortMapping
+	// Replace marks a snapshot of all the port mappings of the Guest Agent,
+	// the ones that it does not list are deleted.
+	Replace bool `json:"replace"`
+	// Ping is the heartbeat of the Guest Agent, it is only answered.
+	Ping  bool `json:"ping"`
+	Hello *struct {
+		ProtocolVersion int `json:"protocolVersion"`
+	} `json:"hello"`
 }
 
 // NewServer creates and returns a new instance of a Port Server.
@@ -49,6 +78,7 @@ func NewServer(elog debug.Log) *Server {
 		proxy:       newProxy(),
 		eventLogger: elog,
 		stopped:     true,
+		instanceID:  fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano()),
 	}
 }
 
@@ -90,16 +120,35 @@ func (s *Server) Start() error {
 func (s *Server) handleEvent(conn net.Conn) {
 	defer conn.Close()
 
-	var pm types.PortMapping
-	err := json.NewDecoder(conn).Decode(&pm)
+	var event portEvent
+	framed, err := readPayload(bufio.NewReader(conn), &event)
 	if err != nil {
 		s.eventLogger.Error(uint32(windows.ERROR_EXCEPTION_IN_SERVICE), fmt.Sprintf("port server decoding received payload error: %v", err))
 		return
 	}
+	if event.Hello != nil {
+		// The hello carries no port mappings, it is only answered.
+		status := peerStatus{InstanceID: s.instanceID, ProtocolVersion: protocolVersion}
+		if err = writePayload(conn, status, framed); err != nil {
+			s.eventLogger.Warning(uint32(windows.ERROR_EXCEPTION_IN_SERVICE), fmt.Sprintf("port server answering hello error: %v", err))
+		}
+		return
+	}
+	if event.Ping {
+		// The heartbeats come every few seconds, they are neither logged nor applied.
+		if err = writePayload(conn, peerStatus{InstanceID: s.instanceID}, framed); err != nil {
+			s.eventLogger.Warning(uint32(windows.ERROR_EXCEPTION_IN_SERVICE), fmt.Sprintf("port server answering ping error: %v", err))
+		}
+		return
+	}
+	pm := event.PortMapping
 	s.eventLogger.Info(uint32(windows.NO_ERROR), fmt.Sprintf("handleEvent for %+v", pm))
-	if err = s.proxy.exec(pm); err != nil {
+	if err = s.proxy.exec(pm, event.Replace); err != nil {
 		s.eventLogger.Error(uint32(windows.ERROR_EXCEPTION_IN_SERVICE), fmt.Sprintf("port proxy [%+v] failed: %v", pm, err))
 	}
+	if err = writePayload(conn, peerStatus{InstanceID: s.instanceID}, framed); err != nil {
+		s.eventLogger.Warning(uint32(windows.ERROR_EXCEPTION_IN_SERVICE), fmt.Sprintf("port server sending status error: %v", err))
+	}
 }
 
 // Stop shuts down the server gracefully
@@ -0,0 +1,171 @@
+/*
+Copyright © 2024 SUSE LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package port
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/rancher-sandbox/rancher-desktop-agent/pkg/types"
+)
+
+// testLog is the event log of the tests, it keeps the entries.
+type testLog struct {
+	entries []string
+	mutex   sync.Mutex
+}
+
+func (l *testLog) record(msg string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, msg)
+	return nil
+}
+
+func (l *testLog) Close() error                       { return nil }
+func (l *testLog) Info(_ uint32, msg string) error    { return l.record(msg) }
+func (l *testLog) Warning(_ uint32, msg string) error { return l.record(msg) }
+func (l *testLog) Error(_ uint32, msg string) error   { return l.record(msg) }
+
+// newTestServer returns a server whose netsh commands are recorded rather than run.
+func newTestServer() (*Server, *[]string) {
+	var commands []string
+	proxy := newProxy()
+	proxy.execCommand = func(cmd string, args []string) error {
+		commands = append(commands, cmd+" "+strings.Join(args, " "))
+		return nil
+	}
+	return &Server{proxy: proxy, eventLogger: &testLog{}, instanceID: "test"}, &commands
+}
+
+// send hands the event to the server and returns its response.
+func send(t *testing.T, s *Server, event portEvent) peerStatus {
+	t.Helper()
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.handleEvent(conn)
+
+	if err := json.NewEncoder(client).Encode(event); err != nil {
+		t.Fatalf("failed to send the event: %s", err)
+	}
+	var status peerStatus
+	if err := json.NewDecoder(client).Decode(&status); err != nil {
+		t.Fatalf("failed to read the response: %s", err)
+	}
+	return status
+}
+
+func testPortMapping(ports ...string) types.PortMapping {
+	portMap := make(nat.PortMap)
+	for _, port := range ports {
+		portMap[nat.Port(port+"/tcp")] = []nat.PortBinding{{HostIP: "127.0.0.1", HostPort: port}}
+	}
+	return types.PortMapping{
+		Ports:        portMap,
+		ConnectAddrs: []types.ConnectAddrs{{Network: "tcp", Addr: "192.168.0.1/24"}},
+	}
+}
+
+func TestHandleEventReplace(t *testing.T) {
+	s, commands := newTestServer()
+	send(t, s, portEvent{PortMapping: testPortMapping("80")})
+	send(t, s, portEvent{PortMapping: testPortMapping("443")})
+	*commands = nil
+
+	// The snapshot only lists 443 and 8080, so 80 is deleted.
+	status := send(t, s, portEvent{PortMapping: testPortMapping("443", "8080"), Replace: true})
+	if status.InstanceID != "test" {
+		t.Fatalf("unexpected instance ID: %s", status.InstanceID)
+	}
+
+	deleted := []string{"netsh interface portproxy delete v4tov4 listenport=80 listenaddress=127.0.0.1"}
+	if !reflect.DeepEqual((*commands)[:1], deleted) {
+		t.Fatalf("expected the unlisted port to be deleted first, got: %v", *commands)
+	}
+	for _, port := range []string{"443", "8080"} {
+		added := "netsh interface portproxy add v4tov4 listenport=" + port +
+			" listenaddress=127.0.0.1 connectport=" + port + " connectaddress=192.168.0.1"
+		found := false
+		for _, command := range (*commands)[1:] {
+			found = found || command == added
+		}
+		if !found {
+			t.Fatalf("expected %s to be added, got: %v", port, *commands)
+		}
+	}
+	if len(*commands) != 3 {
+		t.Fatalf("expected 3 commands, got: %v", *commands)
+	}
+	if len(s.proxy.portMappings) != 1 {
+		t.Fatalf("expected the snapshot to be the only port mapping, got: %+v", s.proxy.portMappings)
+	}
+
+	// Without the replace, the port mappings are added to the existing ones.
+	*commands = nil
+	send(t, s, portEvent{PortMapping: testPortMapping("9090")})
+	if len(*commands) != 1 || !strings.Contains((*commands)[0], " add ") {
+		t.Fatalf("expected a single add, got: %v", *commands)
+	}
+}
+
+func TestHandleEventEmptyReplace(t *testing.T) {
+	s, commands := newTestServer()
+	send(t, s, portEvent{PortMapping: testPortMapping("80", "443")})
+	*commands = nil
+
+	// An empty snapshot deletes everything.
+	send(t, s, portEvent{PortMapping: types.PortMapping{}, Replace: true})
+	if len(*commands) != 2 {
+		t.Fatalf("expected both ports to be deleted, got: %v", *commands)
+	}
+	for _, command := range *commands {
+		if !strings.Contains(command, " delete ") {
+			t.Fatalf("expected a delete, got: %s", command)
+		}
+	}
+	if len(s.proxy.portMappings) != 0 {
+		t.Fatalf("expected no port mappings, got: %+v", s.proxy.portMappings)
+	}
+}
+
+func TestHandleEventPing(t *testing.T) {
+	s, commands := newTestServer()
+	send(t, s, portEvent{PortMapping: testPortMapping("80")})
+	*commands = nil
+	log := s.eventLogger.(*testLog)
+	log.entries = nil
+
+	// The ping is answered without touching the port mappings or the event log.
+	status := send(t, s, portEvent{Ping: true})
+	if status.InstanceID != "test" {
+		t.Fatalf("unexpected instance ID: %s", status.InstanceID)
+	}
+	if len(*commands) != 0 {
+		t.Fatalf("expected no commands, got: %v", *commands)
+	}
+	if len(log.entries) != 0 {
+		t.Fatalf("expected no event log entries, got: %v", log.entries)
+	}
+	if len(s.proxy.portMappings) != 1 {
+		t.Fatalf("expected the port mappings to be kept, got: %+v", s.proxy.portMappings)
+	}
+}